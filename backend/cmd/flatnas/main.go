@@ -0,0 +1,323 @@
+// Command flatnas administers a FlatNas instance from the shell. By default
+// it calls the REST API with an API token; with -offline it works on the
+// data directory directly, for recovery while the server is stopped or its
+// web UI is broken.
+//
+//	flatnas user add <name>
+//	flatnas user passwd <name>
+//	flatnas config export [-user admin] [-o file]
+//	flatnas rss refresh --all | <url>...
+//	flatnas backup now
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/handlers"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const requestTimeout = 2 * time.Minute
+
+const usage = `Usage: flatnas [flags] <command> [args]
+
+Commands:
+  user add <name>            Create a user (password from -password, $FLATNAS_PASSWORD or stdin)
+  user passwd <name>         Set a user's password; offline this also works for admin
+  config export              Print a user's dashboard and the system config as JSON
+  rss refresh --all | <url>  Refresh all configured feeds or the given ones
+  backup now                 Write a backup with the scheduled backup settings
+
+Flags:
+`
+
+type cli struct {
+	url     string
+	token   string
+	offline bool
+	client  *http.Client
+}
+
+func main() {
+	c := &cli{client: &http.Client{Timeout: requestTimeout}}
+	flags := flag.NewFlagSet("flatnas", flag.ExitOnError)
+	flags.StringVar(&c.url, "url", envOr("FLATNAS_URL", "http://127.0.0.1:3000"), "FlatNas server URL ($FLATNAS_URL)")
+	flags.StringVar(&c.token, "token", os.Getenv("FLATNAS_TOKEN"), "API token ($FLATNAS_TOKEN)")
+	flags.BoolVar(&c.offline, "offline", false, "Work on the data directory instead of the API; stop the server first")
+	baseDir := flags.String("base-dir", os.Getenv("BASE_DIR"), "Installation directory for -offline ($BASE_DIR)")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	args := flags.Args()
+	if len(args) < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if c.offline {
+		if *baseDir != "" {
+			os.Setenv("BASE_DIR", *baseDir)
+		}
+		config.Init()
+	} else if c.token == "" {
+		fail(errors.New("an API token is required (-token or $FLATNAS_TOKEN), or use -offline"))
+	}
+
+	var err error
+	switch args[0] + " " + args[1] {
+	case "user add":
+		err = c.userAdd(args[2:])
+	case "user passwd":
+		err = c.userPasswd(args[2:])
+	case "config export":
+		err = c.configExport(args[2:])
+	case "rss refresh":
+		err = c.rssRefresh(args[2:])
+	case "backup now":
+		err = c.backupNow()
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func (c *cli) userAdd(args []string) error {
+	fs := flag.NewFlagSet("user add", flag.ExitOnError)
+	password := fs.String("password", "", "Password; prefer $FLATNAS_PASSWORD or stdin")
+	name, err := oneArg(parseArgs(fs, args), "user name")
+	if err != nil {
+		return err
+	}
+	pass, err := readPassword(*password)
+	if err != nil {
+		return err
+	}
+	if c.offline {
+		err = handlers.CreateUser(name, pass)
+	} else {
+		err = c.call(http.MethodPost, "/api/admin/users", map[string]string{"username": name, "password": pass}, nil)
+	}
+	if err == nil {
+		fmt.Printf("User %s created\n", name)
+	}
+	return err
+}
+
+func (c *cli) userPasswd(args []string) error {
+	fs := flag.NewFlagSet("user passwd", flag.ExitOnError)
+	password := fs.String("password", "", "Password; prefer $FLATNAS_PASSWORD or stdin")
+	name, err := oneArg(parseArgs(fs, args), "user name")
+	if err != nil {
+		return err
+	}
+	pass, err := readPassword(*password)
+	if err != nil {
+		return err
+	}
+	if c.offline {
+		err = handlers.SetPassword(name, pass)
+	} else {
+		err = c.call(http.MethodPost, "/api/admin/users/"+url.PathEscape(name)+"/password", map[string]string{"password": pass}, nil)
+	}
+	if err == nil {
+		fmt.Printf("Password of %s changed\n", name)
+	}
+	return err
+}
+
+func (c *cli) configExport(args []string) error {
+	fs := flag.NewFlagSet("config export", flag.ExitOnError)
+	user := fs.String("user", "admin", "User whose dashboard to export (-offline only; online it is the token's user)")
+	out := fs.String("o", "", "Write to this file instead of stdout")
+	if len(parseArgs(fs, args)) > 0 {
+		return errors.New("config export takes no arguments")
+	}
+
+	var data interface{}
+	if c.offline {
+		exported, err := handlers.ExportConfig(*user)
+		if err != nil {
+			return err
+		}
+		data = exported
+	} else if err := c.call(http.MethodGet, "/api/data", nil, &data); err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+	if *out == "" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+	return os.WriteFile(*out, body, 0600)
+}
+
+func (c *cli) rssRefresh(args []string) error {
+	fs := flag.NewFlagSet("rss refresh", flag.ExitOnError)
+	all := fs.Bool("all", false, "Refresh every configured feed")
+	urls := parseArgs(fs, args)
+	if *all == (len(urls) > 0) {
+		return errors.New("give either --all or feed URLs")
+	}
+
+	if !c.offline {
+		var resp struct {
+			Data struct {
+				Feeds int `json:"feeds"`
+			} `json:"data"`
+		}
+		if err := c.call(http.MethodPost, "/api/rss/refresh", map[string][]string{"urls": urls}, &resp); err != nil {
+			return err
+		}
+		fmt.Printf("Refreshing %d feeds in the background\n", resp.Data.Feeds)
+		return nil
+	}
+
+	handlers.InitWidgetCache()
+	defer handlers.FlushWidgetCache()
+	if *all {
+		urls = handlers.RssFeedUrls()
+	}
+	failed := 0
+	for _, u := range urls {
+		status := handlers.RefreshRssFeed(u)
+		if status == "error" {
+			failed++
+		}
+		fmt.Printf("%-12s %s\n", status, u)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d feeds failed", failed, len(urls))
+	}
+	return nil
+}
+
+func (c *cli) backupNow() error {
+	if c.offline {
+		name, err := handlers.BackupNow(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backup %s written\n", name)
+		return nil
+	}
+	var resp struct {
+		Data struct {
+			LastFile string `json:"lastFile"`
+		} `json:"data"`
+	}
+	if err := c.call(http.MethodPost, "/api/admin/backup/run", nil, &resp); err != nil {
+		return err
+	}
+	fmt.Printf("Backup %s written\n", resp.Data.LastFile)
+	return nil
+}
+
+// call sends a JSON request to the API and decodes the reply into out
+func (c *cli) call(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.url, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(raw, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s (HTTP %d)", apiErr.Error, resp.StatusCode)
+		}
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// parseArgs parses fs from args, allowing flags after the positional
+// arguments, and returns the positional ones
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func oneArg(args []string, what string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expected one %s", what)
+	}
+	return args[0], nil
+}
+
+// readPassword takes the flag, then $FLATNAS_PASSWORD, then a line of stdin
+func readPassword(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	if env := os.Getenv("FLATNAS_PASSWORD"); env != "" {
+		return env, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no password given")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "flatnas:", err)
+	os.Exit(1)
+}
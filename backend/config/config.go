@@ -1,10 +1,15 @@
 package config
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
+	"flatnasgo-backend/logging"
+	"flatnasgo-backend/store"
+	"flatnasgo-backend/utils"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,6 +17,8 @@ import (
 	"time"
 )
 
+var configLog = logging.For("config")
+
 //go:embed default.json
 var defaultJson []byte
 
@@ -27,9 +34,13 @@ var (
 	BackgroundsDir       string
 	MobileBackgroundsDir string
 	IconCacheDir         string
+	ThumbCacheDir        string
 	PublicDir            string
 	ConfigVersionsDir    string
 	SecretKey            []byte
+	// Store holds data.json, system.json and the user files; utils reads
+	// and writes them there by their old paths
+	Store *store.Store
 )
 
 func Init() {
@@ -58,10 +69,15 @@ func Init() {
 	BackgroundsDir = filepath.Join(BaseDir, "server", "PC")
 	MobileBackgroundsDir = filepath.Join(BaseDir, "server", "APP")
 	IconCacheDir = filepath.Join(DataDir, "icon-cache")
+	ThumbCacheDir = filepath.Join(DataDir, "thumb-cache")
 	PublicDir = filepath.Join(BaseDir, "server", "public")
 	ConfigVersionsDir = filepath.Join(DataDir, "config_versions")
 
 	ensureDirs()
+	if Store, err = store.Open(DataDir); err != nil {
+		log.Fatal(err)
+	}
+	utils.SetDocumentStore(Store)
 	ensureSystemConfig()
 	ensureDataFile()
 	ensureAdditionalDataFiles()
@@ -69,24 +85,24 @@ func Init() {
 }
 
 func ensureDirs() {
-	dirs := []string{DataDir, UsersDir, DocDir, MusicDir, BackgroundsDir, MobileBackgroundsDir, IconCacheDir, PublicDir, ConfigVersionsDir}
+	dirs := []string{DataDir, UsersDir, DocDir, MusicDir, BackgroundsDir, MobileBackgroundsDir, IconCacheDir, ThumbCacheDir, PublicDir, ConfigVersionsDir}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Printf("Failed to create dir %s: %v", dir, err)
+			configLog.Error("Failed to create dir", "dir", dir, "error", err)
 		}
 	}
 }
 
 func ensureSystemConfig() {
-	if _, err := os.Stat(SystemConfigFile); err == nil {
-		data, err := os.ReadFile(SystemConfigFile)
+	if _, err := utils.ModTime(SystemConfigFile); err == nil {
+		data, err := utils.ReadFile(SystemConfigFile)
 		if err != nil {
-			log.Printf("Failed to read system config: %v", err)
+			configLog.Error("Failed to read system config", "error", err)
 			return
 		}
 		var current map[string]interface{}
 		if err := json.Unmarshal(data, &current); err != nil {
-			log.Printf("Failed to parse system config: %v", err)
+			configLog.Error("Failed to parse system config", "error", err)
 			return
 		}
 		changed := false
@@ -103,15 +119,15 @@ func ensureSystemConfig() {
 		}
 		updated, err := json.MarshalIndent(current, "", "  ")
 		if err != nil {
-			log.Printf("Failed to marshal system config: %v", err)
+			configLog.Error("Failed to marshal system config", "error", err)
 			return
 		}
-		if err := os.WriteFile(SystemConfigFile, updated, 0644); err != nil {
-			log.Printf("Failed to write system config: %v", err)
+		if err := utils.AtomicWriteFile(SystemConfigFile, updated); err != nil {
+			configLog.Error("Failed to write system config", "error", err)
 		}
 		return
 	} else if !os.IsNotExist(err) {
-		log.Printf("Failed to check system config: %v", err)
+		configLog.Error("Failed to check system config", "error", err)
 		return
 	}
 	defaultConfig := map[string]interface{}{
@@ -120,40 +136,40 @@ func ensureSystemConfig() {
 	}
 	data, err := json.MarshalIndent(defaultConfig, "", "  ")
 	if err != nil {
-		log.Printf("Failed to marshal system config: %v", err)
+		configLog.Error("Failed to marshal system config", "error", err)
 		return
 	}
-	if err := os.WriteFile(SystemConfigFile, data, 0644); err != nil {
-		log.Printf("Failed to write system config: %v", err)
+	if err := utils.AtomicWriteFile(SystemConfigFile, data); err != nil {
+		configLog.Error("Failed to write system config", "error", err)
 	}
 }
 
 func ensureDataFile() {
 	dataFile := filepath.Join(DataDir, "data.json")
-	if _, err := os.Stat(dataFile); err == nil {
+	if _, err := utils.ModTime(dataFile); err == nil {
 		return
 	} else if !os.IsNotExist(err) {
-		log.Printf("Failed to check data file: %v", err)
+		configLog.Error("Failed to check data file", "error", err)
 		return
 	}
 
 	if len(defaultJson) == 0 {
-		log.Printf("Embedded default.json is empty!")
+		configLog.Error("Embedded default.json is empty!")
 		// Fallback to reading from file if embed fails (shouldn't happen)
 		var err error
 		defaultJson, err = os.ReadFile(DefaultFile)
 		if err != nil {
 			if os.IsNotExist(err) {
-				log.Printf("Default template not found: %s", DefaultFile)
+				configLog.Error("Default template not found", "path", DefaultFile)
 				return
 			}
-			log.Printf("Failed to read default template: %v", err)
+			configLog.Error("Failed to read default template", "error", err)
 			return
 		}
 	}
 
-	if err := os.WriteFile(dataFile, defaultJson, 0644); err != nil {
-		log.Printf("Failed to initialize data file: %v", err)
+	if err := utils.AtomicWriteFile(dataFile, defaultJson); err != nil {
+		configLog.Error("Failed to initialize data file", "error", err)
 	}
 }
 
@@ -181,10 +197,26 @@ func loadSecretKey() {
 	}
 }
 
+// SchemaVersion is the version of the configuration database
+func SchemaVersion() int {
+	if Store == nil {
+		return 0
+	}
+	return Store.Version()
+}
+
 func GetSecretKeyString() string {
 	return string(SecretKey)
 }
 
+// DerivedKey is a signing key for purpose, made from the secret key, so
+// tokens of one kind never verify as another
+func DerivedKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, SecretKey)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
 func ensureAdditionalDataFiles() {
 	// Ensure amap_stats.json
 	amapStatsFile := filepath.Join(DataDir, "amap_stats.json")
@@ -196,7 +228,7 @@ func ensureAdditionalDataFiles() {
 		}
 		if data, err := json.MarshalIndent(initialStats, "", "  "); err == nil {
 			if err := os.WriteFile(amapStatsFile, data, 0644); err != nil {
-				log.Printf("Failed to create amap_stats.json: %v", err)
+				configLog.Error("Failed to create amap_stats.json", "error", err)
 			}
 		}
 	}
@@ -211,7 +243,7 @@ func ensureAdditionalDataFiles() {
 		}
 		if data, err := json.MarshalIndent(initialVisitors, "", "  "); err == nil {
 			if err := os.WriteFile(visitorsFile, data, 0644); err != nil {
-				log.Printf("Failed to create visitors.json: %v", err)
+				configLog.Error("Failed to create visitors.json", "error", err)
 			}
 		}
 	}
@@ -220,15 +252,7 @@ func ensureAdditionalDataFiles() {
 	customScriptsFile := filepath.Join(DataDir, "custom_scripts.json")
 	if _, err := os.Stat(customScriptsFile); os.IsNotExist(err) {
 		if err := os.WriteFile(customScriptsFile, []byte("{}"), 0644); err != nil {
-			log.Printf("Failed to create custom_scripts.json: %v", err)
-		}
-	}
-
-	// Ensure widget_cache.json
-	widgetCacheFile := filepath.Join(DataDir, "widget_cache.json")
-	if _, err := os.Stat(widgetCacheFile); os.IsNotExist(err) {
-		if err := os.WriteFile(widgetCacheFile, []byte("{}"), 0644); err != nil {
-			log.Printf("Failed to create widget_cache.json: %v", err)
+			configLog.Error("Failed to create custom_scripts.json", "error", err)
 		}
 	}
 }
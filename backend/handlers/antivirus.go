@@ -0,0 +1,749 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Files can be scanned for malware by ClamAV's clamd, when the admin
+// enables it. Uploads to the transfer area and through share links are
+// scanned once written, before anyone can download them; folders are
+// scanned on demand as jobs of the queue. Files are streamed to clamd with
+// INSTREAM, so it need not see the shares. An infected upload is moved to
+// the quarantine in DataDir/quarantine and refused; a folder scan reports
+// what it finds and quarantines it when asked to. The admin can restore or
+// delete quarantined files.
+
+const (
+	clamdDefaultAddress  = "/var/run/clamav/clamd.ctl"
+	clamdTimeout         = 10 * time.Second // To connect and for clamd's answer
+	clamdChunk           = 64 << 10
+	antivirusKeepReports = 50
+	antivirusMaxFindings = 1000 // Per report, the count is always exact
+	antivirusAlertFiles  = 10
+)
+
+var (
+	errClamdLimit         = errors.New("File is larger than clamd accepts")
+	errScannerUnavailable = errors.New("Virus scanner unavailable")
+	errFileInfected       = errors.New("File is infected")
+	errAntivirusDisabled  = errors.New("Virus scanning is not enabled")
+	errNoScanReport       = errors.New("Report not found")
+	errNotQuarantined     = errors.New("Quarantined file not found")
+	errCannotRestore      = errors.New("Only files from shares can be restored")
+)
+
+// QuarantineEntry is a file taken out of reach because clamd found malware
+// in it
+type QuarantineEntry struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Share      string `json:"share,omitempty"` // Empty for transfer uploads
+	Path       string `json:"path,omitempty"`  // Where it was in Share
+	Source     string `json:"source"`          // upload, share-link or scan
+	User       string `json:"user,omitempty"`
+	Virus      string `json:"virus"`
+	Size       int64  `json:"size"`
+	DetectedAt int64  `json:"detectedAt"`
+}
+
+// ScanFinding is an infected file found by a folder scan
+type ScanFinding struct {
+	Path       string `json:"path"`
+	Virus      string `json:"virus"`
+	Size       int64  `json:"size"`
+	Quarantine string `json:"quarantine,omitempty"` // Entry ID when quarantined
+}
+
+// ScanReport is the outcome of one folder scan; its ID is that of the job
+type ScanReport struct {
+	ID         string        `json:"id"`
+	Share      string        `json:"share"`
+	Path       string        `json:"path"`
+	User       string        `json:"user"`
+	StartedAt  int64         `json:"startedAt"`
+	FinishedAt int64         `json:"finishedAt"`
+	Files      int64         `json:"files"`
+	Bytes      int64         `json:"bytes"`
+	Infected   int64         `json:"infected"`
+	Skipped    int64         `json:"skipped"` // Larger than clamd accepts
+	Errors     int64         `json:"errors"`  // Files that could not be read
+	Cancelled  bool          `json:"cancelled,omitempty"`
+	Findings   []ScanFinding `json:"findings,omitempty"`
+}
+
+// ScanRequest starts a folder scan; Quarantine moves infected files away
+type ScanRequest struct {
+	Share      string `json:"share"`
+	Path       string `json:"path"`
+	Quarantine bool   `json:"quarantine,omitempty"`
+}
+
+// scanPlan is a virus scan job
+type scanPlan struct {
+	Share      string `json:"share"`
+	Path       string `json:"path"`
+	Quarantine bool   `json:"quarantine,omitempty"`
+	User       string `json:"user"`
+}
+
+// antivirusFiles serializes access to the reports and the quarantine index
+var antivirusFiles sync.Mutex
+
+func antivirusReportsFile() string {
+	return filepath.Join(config.DataDir, "antivirus", "reports.json")
+}
+
+func quarantineDir() string {
+	return filepath.Join(config.DataDir, "quarantine")
+}
+
+func quarantineIndexFile() string {
+	return filepath.Join(quarantineDir(), "index.json")
+}
+
+func antivirusSettings() models.AntivirusSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.Antivirus == nil {
+		return models.AntivirusSettings{}
+	}
+	settings := *sysConfig.Antivirus
+	if settings.Address == "" {
+		settings.Address = clamdDefaultAddress
+	}
+	return settings
+}
+
+func decodeAntivirusSettings(raw interface{}) (*models.AntivirusSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid antivirus settings")
+	}
+	settings := &models.AntivirusSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid antivirus settings")
+	}
+	settings.Address = strings.TrimSpace(settings.Address)
+	if settings.Address != "" {
+		if _, _, err := clamdNetwork(settings.Address); err != nil {
+			return nil, fmt.Errorf("Invalid antivirus address")
+		}
+	}
+	return settings, nil
+}
+
+// clamdNetwork tells how to reach clamd at address: a socket path, or
+// host:port
+func clamdNetwork(address string) (string, string, error) {
+	address = strings.TrimPrefix(address, "tcp://")
+	if rest, ok := strings.CutPrefix(address, "unix:"); ok {
+		return "unix", strings.TrimPrefix(rest, "//"), nil
+	}
+	if strings.HasPrefix(address, "/") {
+		return "unix", address, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", err
+	}
+	return "tcp", address, nil
+}
+
+// clamdDial connects to clamd and sends a command, the z form ending in a
+// NUL byte
+func clamdDial(ctx context.Context, address, command string) (net.Conn, error) {
+	network, addr, err := clamdNetwork(address)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: clamdTimeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("z" + command + "\x00")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// clamdReply reads clamd's answer, which ends in a NUL byte
+func clamdReply(conn net.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(clamdTimeout))
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// clamdVersion asks clamd for its version, which also tells it is up
+func clamdVersion(ctx context.Context, address string) (string, error) {
+	conn, err := clamdDial(ctx, address, "VERSION")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return clamdReply(conn)
+}
+
+// clamdScan streams src to clamd and returns the name of the malware it
+// found, "" when clean
+func clamdScan(ctx context.Context, address string, src io.Reader) (string, error) {
+	conn, err := clamdDial(ctx, address, "INSTREAM")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	buf := make([]byte, 4+clamdChunk)
+	var sendErr error
+	for {
+		n, err := src.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, sendErr = conn.Write(buf[:4+n]); sendErr != nil {
+				// clamd hangs up once a stream is over its limit; its
+				// answer says so
+				break
+			}
+		}
+		if err == io.EOF {
+			binary.BigEndian.PutUint32(buf, 0)
+			_, sendErr = conn.Write(buf[:4])
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	reply, err := clamdReply(conn)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		if sendErr != nil {
+			return "", sendErr
+		}
+		return "", err
+	}
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	case strings.HasSuffix(reply, "OK"):
+		return "", nil
+	case strings.Contains(reply, "size limit"):
+		return "", errClamdLimit
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// clamdScanFile scans the file at full
+func clamdScanFile(ctx context.Context, address, full string) (string, error) {
+	f, err := os.Open(full)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return clamdScan(ctx, address, f)
+}
+
+// quarantineFile moves full into the quarantine
+func quarantineFile(full string, entry QuarantineEntry) (QuarantineEntry, error) {
+	entry.ID = randomHexID(8)
+	entry.DetectedAt = time.Now().UnixMilli()
+	if info, err := os.Lstat(full); err == nil {
+		entry.Size = info.Size()
+	}
+	if err := os.MkdirAll(quarantineDir(), 0700); err != nil {
+		return entry, err
+	}
+	dst := filepath.Join(quarantineDir(), entry.ID)
+	if err := movePath(full, dst); err != nil {
+		return entry, err
+	}
+	os.Chmod(dst, 0600)
+
+	antivirusFiles.Lock()
+	defer antivirusFiles.Unlock()
+	entries := loadQuarantine()
+	entries = append([]QuarantineEntry{entry}, entries...)
+	if err := utils.WriteJSON(quarantineIndexFile(), entries); err != nil {
+		return entry, err
+	}
+	filesLog.Warn("File quarantined", "name", entry.Name, "share", entry.Share, "virus", entry.Virus, "source", entry.Source, "id", entry.ID)
+	return entry, nil
+}
+
+// loadQuarantine returns the quarantined files, newest first.
+// antivirusFiles must be locked.
+func loadQuarantine() []QuarantineEntry {
+	entries := []QuarantineEntry{}
+	_ = utils.ReadJSON(quarantineIndexFile(), &entries)
+	return entries
+}
+
+// screenUpload scans a file just uploaded, when uploads are to be scanned.
+// An infected file is quarantined and errFileInfected returned with the
+// name of the malware. While clamd cannot be reached the file is kept,
+// unless the admin asked to refuse uploads then.
+func screenUpload(ctx context.Context, full string, origin QuarantineEntry) (string, error) {
+	settings := antivirusSettings()
+	if !settings.Enable || !settings.ScanUploads {
+		return "", nil
+	}
+	virus, err := clamdScanFile(ctx, settings.Address, full)
+	switch {
+	case errors.Is(err, errClamdLimit):
+		filesLog.Info("Upload too large to scan", "name", origin.Name)
+		return "", nil
+	case err != nil:
+		filesLog.Warn("Upload not scanned", "name", origin.Name, "error", err)
+		if settings.FailClosed {
+			return "", errScannerUnavailable
+		}
+		return "", nil
+	case virus == "":
+		return "", nil
+	}
+	origin.Virus = virus
+	entry, err := quarantineFile(full, origin)
+	if err != nil {
+		// Out of reach either way
+		os.Remove(full)
+	}
+	go raiseUploadVirusAlert(entry)
+	return virus, errFileInfected
+}
+
+// uploadScanError answers an upload refused by screenUpload
+func uploadScanError(c *gin.Context, virus string, err error) {
+	if errors.Is(err, errFileInfected) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "virus": virus})
+		return
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+}
+
+func raiseUploadVirusAlert(entry QuarantineEntry) {
+	where := entry.Name
+	if entry.Share != "" {
+		where = entry.Share + ":" + entry.Path
+	}
+	sendNotification(backgroundCtx, Notification{
+		Title:  i18n.T(notifyLocale(), "notify_virus_upload", where),
+		Body:   entry.Virus,
+		Source: "antivirus",
+	}, antivirusSettings().Channels)
+	fireWebhook(WebhookVirusFound, map[string]interface{}{
+		"source":     entry.Source,
+		"share":      entry.Share,
+		"path":       entry.Path,
+		"name":       entry.Name,
+		"user":       entry.User,
+		"virus":      entry.Virus,
+		"quarantine": entry.ID,
+	})
+}
+
+func raiseScanVirusAlert(report ScanReport) {
+	paths := make([]string, 0, antivirusAlertFiles)
+	for i, f := range report.Findings {
+		if i == antivirusAlertFiles {
+			break
+		}
+		paths = append(paths, f.Path+" ("+f.Virus+")")
+	}
+	body := strings.Join(paths, "\n")
+	if more := report.Infected - int64(len(paths)); more > 0 {
+		body += "\n" + i18n.T(notifyLocale(), "notify_virus_more", more)
+	}
+	sendNotification(backgroundCtx, Notification{
+		Title:  i18n.T(notifyLocale(), "notify_virus_scan", report.Infected, report.Share),
+		Body:   body,
+		Source: "antivirus",
+	}, antivirusSettings().Channels)
+	fireWebhook(WebhookVirusFound, map[string]interface{}{
+		"source":   "scan",
+		"share":    report.Share,
+		"path":     report.Path,
+		"report":   report.ID,
+		"infected": report.Infected,
+		"files":    paths,
+	})
+}
+
+// loadScanReports returns the reports, newest first. antivirusFiles must
+// be locked.
+func loadScanReports() []ScanReport {
+	var reports []ScanReport
+	_ = utils.ReadJSON(antivirusReportsFile(), &reports)
+	return reports
+}
+
+func addScanReport(report ScanReport) error {
+	antivirusFiles.Lock()
+	defer antivirusFiles.Unlock()
+	reports := append([]ScanReport{report}, loadScanReports()...)
+	if len(reports) > antivirusKeepReports {
+		reports = reports[:antivirusKeepReports]
+	}
+	if err := os.MkdirAll(filepath.Dir(antivirusReportsFile()), 0755); err != nil {
+		return err
+	}
+	return utils.WriteJSON(antivirusReportsFile(), reports)
+}
+
+// runScanJob scans the files of a folder. The report is kept even when the
+// job is cancelled, with what was scanned so far.
+func runScanJob(ctx context.Context, r *jobRun) error {
+	var plan scanPlan
+	if err := r.params(&plan); err != nil {
+		return err
+	}
+	settings := antivirusSettings()
+	if !settings.Enable {
+		return errAntivirusDisabled
+	}
+	share, err := findFileShare(plan.Share)
+	if err != nil {
+		return err
+	}
+	root, err := resolveSharePath(share, plan.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := clamdVersion(ctx, settings.Address); err != nil {
+		return fmt.Errorf("%w: %v", errScannerUnavailable, err)
+	}
+	report := ScanReport{ID: r.job.ID, Share: share.Name, Path: plan.Path, User: plan.User, StartedAt: time.Now().UnixMilli()}
+
+	var total, files int64
+	filepath.WalkDir(root, func(full string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+				files++
+			}
+		}
+		return nil
+	})
+	r.setTotal(total, files)
+
+	err = filepath.WalkDir(root, func(full string, d fs.DirEntry, err error) error {
+		if err := r.wait(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			report.Errors++
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		sub, _ := filepath.Rel(root, full)
+		rel := path.Join(plan.Path, filepath.ToSlash(sub))
+		if d.IsDir() {
+			if plan.Path == "" && hiddenShareDir(filepath.ToSlash(sub)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			report.Errors++
+			return nil
+		}
+		r.at(rel)
+		f, err := os.Open(full)
+		if err != nil {
+			report.Errors++
+			r.add(info.Size(), 1)
+			return nil
+		}
+		virus, err := clamdScan(ctx, settings.Address, r.reader(ctx, f))
+		f.Close()
+		r.add(0, 1)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, errClamdLimit):
+			report.Skipped++
+			return nil
+		case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission):
+			report.Errors++
+			return nil
+		case err != nil:
+			// clamd went away; the files left would all fail
+			return fmt.Errorf("%w: %v", errScannerUnavailable, err)
+		}
+		report.Files++
+		report.Bytes += info.Size()
+		if virus == "" {
+			return nil
+		}
+		report.Infected++
+		finding := ScanFinding{Path: rel, Virus: virus, Size: info.Size()}
+		if plan.Quarantine {
+			entry, err := quarantineFile(full, QuarantineEntry{Name: d.Name(), Share: share.Name, Path: rel, Source: "scan", User: plan.User, Virus: virus})
+			if err != nil {
+				filesLog.Warn("Failed to quarantine file", "share", share.Name, "path", rel, "error", err)
+			} else {
+				finding.Quarantine = entry.ID
+			}
+		}
+		if len(report.Findings) < antivirusMaxFindings {
+			report.Findings = append(report.Findings, finding)
+		}
+		return nil
+	})
+	report.Cancelled = ctx.Err() != nil
+	report.FinishedAt = time.Now().UnixMilli()
+	if backgroundCtx.Err() == nil {
+		// A scan stopped by a restart runs again and reports then
+		if saveErr := addScanReport(report); saveErr != nil {
+			filesLog.Warn("Failed to save scan report", "error", saveErr)
+		}
+	}
+	if report.Infected > 0 {
+		raiseScanVirusAlert(report)
+	}
+	filesLog.Info("Virus scan finished", "share", share.Name, "path", plan.Path, "files", report.Files, "infected", report.Infected, "cancelled", report.Cancelled)
+	return err
+}
+
+// GetAntivirus tells whether scanning is on and clamd answers, and lists
+// the scan reports of ?share=, or all, without their findings
+func GetAntivirus(c *gin.Context) {
+	settings := antivirusSettings()
+	status := gin.H{"enabled": settings.Enable, "scanUploads": settings.ScanUploads}
+	if settings.Enable {
+		version, err := clamdVersion(c.Request.Context(), settings.Address)
+		status["available"] = err == nil
+		if err == nil {
+			status["version"] = version
+		} else {
+			status["error"] = err.Error()
+		}
+	}
+	antivirusFiles.Lock()
+	all := loadScanReports()
+	quarantined := len(loadQuarantine())
+	antivirusFiles.Unlock()
+	reports := []ScanReport{}
+	for _, r := range all {
+		if share := c.Query("share"); share == "" || r.Share == share {
+			r.Findings = nil
+			reports = append(reports, r)
+		}
+	}
+	status["quarantined"] = quarantined
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"status": status, "reports": reports}})
+}
+
+// ScanFolder queues a virus scan of a folder
+func ScanFolder(c *gin.Context) {
+	var req ScanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !antivirusSettings().Enable {
+		c.JSON(http.StatusConflict, gin.H{"error": errAntivirusDisabled.Error()})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err == nil && req.Quarantine && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	rel, err := cleanSharePath(req.Path)
+	if err == nil {
+		var full string
+		if full, err = resolveSharePath(share, rel); err == nil {
+			var info os.FileInfo
+			if info, err = os.Stat(full); err == nil && !info.IsDir() {
+				err = errInvalidPath
+			}
+		}
+	}
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	c.Set("auditTarget", share.Name+":"+rel)
+	startFileJob(c, "virusscan", scanPlan{Share: share.Name, Path: rel, Quarantine: req.Quarantine, User: c.GetString("username")})
+}
+
+// DownloadScanReport sends a report as JSON, or its findings as CSV with
+// ?format=csv
+func DownloadScanReport(c *gin.Context) {
+	antivirusFiles.Lock()
+	reports := loadScanReports()
+	antivirusFiles.Unlock()
+	var report *ScanReport
+	for i := range reports {
+		if reports[i].ID == c.Param("id") {
+			report = &reports[i]
+			break
+		}
+	}
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoScanReport.Error()})
+		return
+	}
+	name := "virus-scan-" + report.Share + "-" + time.UnixMilli(report.StartedAt).Format("20060102-150405")
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.json\"", name))
+		c.JSON(http.StatusOK, report)
+	case "csv":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", name))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"path", "virus", "size", "quarantine"})
+		for _, f := range report.Findings {
+			w.Write([]string{f.Path, f.Virus, strconv.FormatInt(f.Size, 10), f.Quarantine})
+		}
+		w.Flush()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	}
+}
+
+// GetQuarantine lists the quarantined files, newest first
+func GetQuarantine(c *gin.Context) {
+	antivirusFiles.Lock()
+	entries := loadQuarantine()
+	antivirusFiles.Unlock()
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": entries})
+}
+
+// takeQuarantined removes an entry from the quarantine index and returns
+// it with the path of its file
+func takeQuarantined(id string) (QuarantineEntry, string, error) {
+	antivirusFiles.Lock()
+	defer antivirusFiles.Unlock()
+	entries := loadQuarantine()
+	for i, e := range entries {
+		if e.ID != id {
+			continue
+		}
+		entries = append(entries[:i], entries[i+1:]...)
+		if err := utils.WriteJSON(quarantineIndexFile(), entries); err != nil {
+			return e, "", err
+		}
+		return e, filepath.Join(quarantineDir(), e.ID), nil
+	}
+	return QuarantineEntry{}, "", errNotQuarantined
+}
+
+// RestoreQuarantine puts a quarantined file back where it was found, under
+// a copy name when that is taken, e.g. after a false positive
+func RestoreQuarantine(c *gin.Context) {
+	antivirusFiles.Lock()
+	var entry *QuarantineEntry
+	for _, e := range loadQuarantine() {
+		if e.ID == c.Param("id") {
+			entry = &e
+			break
+		}
+	}
+	antivirusFiles.Unlock()
+	if entry == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNotQuarantined.Error()})
+		return
+	}
+	if entry.Share == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errCannotRestore.Error()})
+		return
+	}
+	share, err := findFileShare(entry.Share)
+	if err == nil && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	dst, err := resolveShareTarget(share, entry.Path)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+	}
+	if err != nil {
+		fileError(c, err, entry.Path)
+		return
+	}
+	rel := entry.Path
+	if _, err := os.Lstat(dst); err == nil {
+		name := copyName(filepath.Dir(dst), filepath.Base(dst))
+		dst = filepath.Join(filepath.Dir(dst), name)
+		rel = path.Join(path.Dir(rel), name)
+	}
+	c.Set("auditTarget", share.Name+":"+rel)
+	_, src, err := takeQuarantined(entry.ID)
+	if err == nil {
+		err = movePath(src, dst)
+	}
+	if err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	os.Chmod(dst, 0644)
+	markQuotaStale(share.Name)
+	filesLog.Warn("Quarantined file restored", "share", share.Name, "path", rel, "virus", entry.Virus)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"share": share.Name, "path": rel}})
+}
+
+// DeleteQuarantine deletes a quarantined file for good
+func DeleteQuarantine(c *gin.Context) {
+	entry, src, err := takeQuarantined(c.Param("id"))
+	if errors.Is(err, errNotQuarantined) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err == nil {
+		err = os.Remove(src)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete", "details": err.Error()})
+		return
+	}
+	c.Set("auditTarget", entry.Name)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
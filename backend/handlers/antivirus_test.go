@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const fakeClamdLimit = 1000
+
+// fakeClamd answers VERSION and INSTREAM like clamd: streams holding
+// "EICAR" are infected, those over fakeClamdLimit bytes refused
+func fakeClamd(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				cmd, _ := br.ReadString(0)
+				switch cmd {
+				case "zVERSION\x00":
+					conn.Write([]byte("ClamAV 1.3.1/27400\x00"))
+				case "zINSTREAM\x00":
+					var data []byte
+					for {
+						var size uint32
+						if binary.Read(br, binary.BigEndian, &size) != nil {
+							return
+						}
+						if size == 0 {
+							break
+						}
+						chunk := make([]byte, size)
+						io.ReadFull(br, chunk)
+						data = append(data, chunk...)
+						if len(data) > fakeClamdLimit {
+							conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+							return
+						}
+					}
+					if bytes.Contains(data, []byte("EICAR")) {
+						conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					} else {
+						conn.Write([]byte("stream: OK\x00"))
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestClamd(t *testing.T) {
+	addr := fakeClamd(t).Addr().String()
+	ctx := context.Background()
+	if v, err := clamdVersion(ctx, addr); err != nil || !strings.HasPrefix(v, "ClamAV") {
+		t.Fatalf("version = %q, %v", v, err)
+	}
+	if virus, err := clamdScan(ctx, addr, strings.NewReader("hello")); err != nil || virus != "" {
+		t.Fatalf("clean file: %q, %v", virus, err)
+	}
+	if virus, err := clamdScan(ctx, addr, strings.NewReader("X5O!P%@AP EICAR test")); err != nil || virus != "Eicar-Test-Signature" {
+		t.Fatalf("infected file: %q, %v", virus, err)
+	}
+	if _, err := clamdScan(ctx, addr, strings.NewReader(strings.Repeat("a", 200<<10))); err != errClamdLimit {
+		t.Fatalf("expected the size limit, got %v", err)
+	}
+	for address, want := range map[string]string{
+		"/run/clamd.sock":           "unix /run/clamd.sock",
+		"unix:///run/clamd.sock":    "unix /run/clamd.sock",
+		"tcp://10.0.0.5:3310":       "tcp 10.0.0.5:3310",
+		"clamav:3310":               "tcp clamav:3310",
+		"clamav-without-a-port.lan": "",
+	} {
+		network, a, err := clamdNetwork(address)
+		if got := network + " " + a; (err == nil && got != want) || (err != nil && want != "") {
+			t.Fatalf("%s: got %q %v, want %q", address, got, err, want)
+		}
+	}
+}
+
+func TestAntivirusUploads(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	ln := fakeClamd(t)
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "inbox"), 0755)
+	settings := &models.AntivirusSettings{Enable: true, Address: ln.Addr().String(), ScanUploads: true}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{
+		Shares:    []models.FileShare{{Name: "main", Path: root}},
+		Antivirus: settings,
+	})
+
+	r := gin.New()
+	auth := r.Group("/", func(c *gin.Context) { c.Set("username", "admin") })
+	auth.POST("/links", CreateShareLink)
+	auth.GET("/quarantine", GetQuarantine)
+	auth.POST("/quarantine/:id/restore", RestoreQuarantine)
+	auth.DELETE("/quarantine/:id", DeleteQuarantine)
+	r.POST("/public/links/:token/upload", UploadShareLink)
+
+	w := serve(r, "POST", "/links", `{"share":"main","path":"inbox","allowUpload":true}`)
+	var link struct{ Data models.ShareLink }
+	json.Unmarshal(w.Body.Bytes(), &link)
+	upload := func(name, content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", name)
+		part.Write([]byte(content))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/public/links/"+link.Data.Token+"/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := upload("ok.txt", "hello"); w.Code != 200 {
+		t.Fatalf("clean upload: %d %s", w.Code, w.Body.String())
+	}
+	w = upload("bad.exe", "EICAR")
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "Eicar-Test-Signature") {
+		t.Fatalf("infected upload: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(root, "inbox", "bad.exe")); !os.IsNotExist(err) {
+		t.Fatalf("infected upload left in the share")
+	}
+	var list struct{ Data []QuarantineEntry }
+	json.Unmarshal(serve(r, "GET", "/quarantine", "").Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].Path != "inbox/bad.exe" || list.Data[0].Source != "share-link" || list.Data[0].Size != 5 {
+		t.Fatalf("unexpected quarantine %+v", list.Data)
+	}
+
+	// A false positive goes back where it was
+	if w := serve(r, "POST", "/quarantine/"+list.Data[0].ID+"/restore", ""); w.Code != 200 {
+		t.Fatalf("restore: %d %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "inbox", "bad.exe")); string(data) != "EICAR" {
+		t.Fatalf("file not restored")
+	}
+	upload("bad.exe", "EICAR")
+	json.Unmarshal(serve(r, "GET", "/quarantine", "").Body.Bytes(), &list)
+	if w := serve(r, "DELETE", "/quarantine/"+list.Data[0].ID, ""); w.Code != 200 {
+		t.Fatalf("delete: %d", w.Code)
+	}
+	if items, _ := os.ReadDir(quarantineDir()); len(items) != 1 {
+		t.Fatalf("expected only the index left in the quarantine, got %v", items)
+	}
+
+	// Files larger than clamd takes are kept unscanned
+	if w := upload("big.bin", strings.Repeat("a", 200<<10)); w.Code != 200 {
+		t.Fatalf("large upload: %d %s", w.Code, w.Body.String())
+	}
+
+	// Without clamd, uploads go through unless the admin said otherwise
+	ln.Close()
+	if w := upload("later.txt", "hello"); w.Code != 200 {
+		t.Fatalf("upload while clamd is down: %d", w.Code)
+	}
+	settings.FailClosed = true
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{
+		Shares:    []models.FileShare{{Name: "main", Path: root}},
+		Antivirus: settings,
+	})
+	if w := upload("refused.txt", "hello"); w.Code != 503 {
+		t.Fatalf("expected 503 while clamd is down, got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(root, "inbox", "refused.txt")); !os.IsNotExist(err) {
+		t.Fatalf("refused upload kept")
+	}
+}
+
+func TestVirusScanJob(t *testing.T) {
+	useTestConfig(t)
+	useTestJobs(t)
+	gin.SetMode(gin.TestMode)
+	ln := fakeClamd(t)
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "dl", "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "dl", "a.txt"), []byte("fine"), 0644)
+	os.WriteFile(filepath.Join(root, "dl", "sub", "b.exe"), []byte("EICAR"), 0644)
+	os.WriteFile(filepath.Join(root, "dl", "big.iso"), bytes.Repeat([]byte("a"), 2000), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{
+		Shares:    []models.FileShare{{Name: "main", Path: root}},
+		Antivirus: &models.AntivirusSettings{Enable: true, Address: ln.Addr().String()},
+	})
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("username", "alice") })
+	r.POST("/scan", ScanFolder)
+	r.GET("/antivirus", GetAntivirus)
+	r.GET("/reports/:id", DownloadScanReport)
+
+	w := serve(r, "POST", "/scan", `{"share":"main","path":"dl","quarantine":true}`)
+	var resp struct{ Data Job }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 202 {
+		t.Fatalf("scan: %d %s", w.Code, w.Body.String())
+	}
+	if j := waitJob(t, resp.Data.ID, JobDone); j.Items != 3 || j.TotalItems != 3 {
+		t.Fatalf("unexpected progress %+v", j)
+	}
+	if _, err := os.Stat(filepath.Join(root, "dl", "sub", "b.exe")); !os.IsNotExist(err) {
+		t.Fatalf("infected file not quarantined")
+	}
+
+	var status struct {
+		Data struct {
+			Status  map[string]interface{} `json:"status"`
+			Reports []ScanReport           `json:"reports"`
+		}
+	}
+	json.Unmarshal(serve(r, "GET", "/antivirus", "").Body.Bytes(), &status)
+	if status.Data.Status["available"] != true || status.Data.Status["quarantined"] != float64(1) || len(status.Data.Reports) != 1 {
+		t.Fatalf("unexpected status %s", serve(r, "GET", "/antivirus", "").Body.String())
+	}
+	if rep := status.Data.Reports[0]; rep.ID != resp.Data.ID || rep.Files != 2 || rep.Infected != 1 || rep.Skipped != 1 || rep.Findings != nil {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	w = serve(r, "GET", "/reports/"+resp.Data.ID+"?format=csv", "")
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "dl/sub/b.exe,Eicar-Test-Signature,5,") {
+		t.Fatalf("unexpected CSV %q", w.Body.String())
+	}
+
+	// A scan needs clamd
+	ln.Close()
+	json.Unmarshal(serve(r, "POST", "/scan", `{"share":"main","path":"dl"}`).Body.Bytes(), &resp)
+	if j := waitJob(t, resp.Data.ID, JobFailed); !strings.Contains(j.Error, errScannerUnavailable.Error()) {
+		t.Fatalf("unexpected error %q", j.Error)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"flatnasgo-backend/middleware"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateApiTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"` // 0 = never
+}
+
+// GetApiTokens lists the caller's personal access tokens
+func GetApiTokens(c *gin.Context) {
+	tokens, err := middleware.ListApiTokens(c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": tokens})
+}
+
+// CreateApiToken issues a token for scripts and integrations. The secret is
+// only part of this response.
+func CreateApiToken(c *gin.Context) {
+	var req CreateApiTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	username := c.GetString("username")
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{middleware.ScopeRead}
+	}
+	scopes := middleware.NormalizeScopes(req.Scopes, username)
+	if len(scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scopes"})
+		return
+	}
+	if req.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry"})
+		return
+	}
+	ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	token, secret, err := middleware.CreateApiToken(username, name, scopes, ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": token, "token": secret})
+}
+
+// DeleteApiToken revokes one of the caller's tokens
+func DeleteApiToken(c *gin.Context) {
+	found, err := middleware.RevokeApiToken(c.GetString("username"), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save tokens"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"flatnasgo-backend/middleware"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAuditLog returns audit entries, newest first. Query parameters are
+// user, action (a prefix such as "user" or "docker"), since and until (Unix
+// ms), success (true or false) and limit.
+func GetAuditLog(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	q := middleware.AuditQuery{User: c.Query("user"), Action: c.Query("action")}
+	q.Since, _ = strconv.ParseInt(c.Query("since"), 10, 64)
+	q.Until, _ = strconv.ParseInt(c.Query("until"), 10, 64)
+	q.Limit, _ = strconv.Atoi(c.Query("limit"))
+	if v, err := strconv.ParseBool(c.Query("success")); err == nil {
+		q.Success = &v
+	}
+	entries, err := middleware.QueryAudit(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": entries})
+}
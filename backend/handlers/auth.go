@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
 	"flatnasgo-backend/models"
 	"flatnasgo-backend/utils"
 	"net/http"
@@ -31,6 +32,23 @@ func Login(c *gin.Context) {
 	if req.Username == "" {
 		req.Username = "admin"
 	}
+	c.Set("auditUser", req.Username)
+	if !validUsername(req.Username) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found or password incorrect"})
+		return
+	}
+
+	// Directory users come first; the local admin always logs in locally so a
+	// directory outage cannot lock it out
+	if req.Username != "admin" {
+		account, handled, err := tryLdapLogin(req.Username, req.Password)
+		if err != nil {
+			authLog.Warn("LDAP login failed", "user", req.Username, "error", err)
+		} else if handled {
+			finishLogin(c, account, req.Code)
+			return
+		}
+	}
 
 	userFile := filepath.Join(config.UsersDir, req.Username+".json")
 	if req.Username == "admin" && sysConfig.AuthMode == "single" {
@@ -88,8 +106,7 @@ func Login(c *gin.Context) {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 					return
 				}
-				user.Password = string(hashed)
-				if err := utils.WriteJSON(userFile, user); err != nil {
+				if err := setUserPassword(userFile, string(hashed)); err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
 					return
 				}
@@ -98,16 +115,7 @@ func Login(c *gin.Context) {
 	}
 
 	if match {
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"username": req.Username,
-			"exp":      time.Now().Add(time.Hour * 24 * 30).Unix(),
-		})
-		tokenString, err := token.SignedString([]byte(config.GetSecretKeyString()))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{"success": true, "token": tokenString, "username": req.Username})
+		finishLogin(c, req.Username, req.Code)
 	} else {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password incorrect"})
 	}
@@ -129,25 +137,27 @@ func GetUsers(c *gin.Context) {
 		return
 	}
 
-	files, err := os.ReadDir(config.UsersDir)
+	names, err := utils.ListJSON(config.UsersDir)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read users directory"})
 		return
 	}
 
 	var users []string
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
-			name := strings.TrimSuffix(file.Name(), ".json")
-			if name != "admin" {
-				users = append(users, name)
-			}
+	for _, file := range names {
+		if name := strings.TrimSuffix(file, ".json"); name != "admin" {
+			users = append(users, name)
 		}
 	}
 	c.JSON(http.StatusOK, gin.H{"users": users})
 }
 
 func AddUser(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
 	var req AddUserRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
@@ -158,14 +168,20 @@ func AddUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Username and password required"})
 		return
 	}
+	c.Set("auditTarget", req.Username)
 
 	if req.Username == "admin" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot add admin user manually"})
 		return
 	}
 
+	if !validUsername(req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username may only contain letters, digits, '.', '_' and '-'"})
+		return
+	}
+
 	userFile := filepath.Join(config.UsersDir, req.Username+".json")
-	if _, err := os.Stat(userFile); err == nil {
+	if _, err := utils.ModTime(userFile); err == nil {
 		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
 		return
 	}
@@ -176,12 +192,7 @@ func AddUser(c *gin.Context) {
 		return
 	}
 
-	user := models.User{
-		Username: req.Username,
-		Password: string(hashed),
-	}
-
-	if err := utils.WriteJSON(userFile, user); err != nil {
+	if err := createUserFile(userFile, req.Username, string(hashed)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
 		return
 	}
@@ -197,20 +208,236 @@ func DeleteUser(c *gin.Context) {
 	}
 
 	username := c.Param("usr")
-	if username == "" || username == "admin" {
+	if username == "" || username == "admin" || !validUsername(username) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
 		return
 	}
 
 	userFile := filepath.Join(config.UsersDir, username+".json")
-	if err := os.Remove(userFile); err != nil {
+	if err := utils.RemoveFile(userFile); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
 		return
 	}
+	forgetDavAuth(username)
+	if err := middleware.RevokeUserApiTokens(username); err != nil {
+		authLog.Error("Failed to revoke tokens of deleted user", "user", username, "error", err)
+	}
+	if err := middleware.SetRole(username, middleware.RoleUser); err != nil {
+		authLog.Error("Failed to clear role of deleted user", "user", username, "error", err)
+	}
+	if config.Store != nil {
+		if err := config.Store.DeleteUserMarks(username); err != nil {
+			authLog.Error("Failed to delete file marks of deleted user", "user", username, "error", err)
+		}
+		if err := config.Store.DeleteUserAlbums(username); err != nil {
+			authLog.Error("Failed to delete albums of deleted user", "user", username, "error", err)
+		}
+	}
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
+type ChangePasswordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// ChangePassword lets a signed-in user replace their own password
+func ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.NewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	userFile := resolveUserDataFile(c.GetString("username"))
+	var user models.User
+	if err := utils.ReadJSON(userFile, &user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if !checkUserPassword(user.Password, req.OldPassword) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password incorrect"})
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), 10)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+	if err := setUserPassword(userFile, string(hashed)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
+		return
+	}
+	forgetDavAuth(c.GetString("username"))
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ResetUserPassword lets the admin set a new password for a family member
+func ResetUserPassword(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	username := c.Param("usr")
+	if username == "" || username == "admin" || !validUsername(username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+		return
+	}
+	var req AddUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password required"})
+		return
+	}
+
+	userFile := filepath.Join(config.UsersDir, username+".json")
+	if _, err := utils.ModTime(userFile); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), 10)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+	if err := setUserPassword(userFile, string(hashed)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
+		return
+	}
+	forgetDavAuth(username)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// issueSessionToken signs the login token handed to the browser
+func issueSessionToken(username string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": username,
+		"exp":      time.Now().Add(time.Hour * 24 * 30).Unix(),
+	})
+	return token.SignedString([]byte(config.GetSecretKeyString()))
+}
+
+// createUserFile starts a new user from the default template, so each
+// account has its own copy of the dashboard, widgets and feeds
+func createUserFile(userFile, username, hashedPassword string) error {
+	var userData map[string]interface{}
+	if err := utils.ReadJSON(config.DefaultFile, &userData); err != nil || userData == nil {
+		userData = map[string]interface{}{}
+	}
+	userData["username"] = username
+	userData["password"] = hashedPassword
+	userData["created_at"] = time.Now().UnixMilli()
+	return utils.WriteJSON(userFile, userData)
+}
+
+type UserRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// GetRoles lists the role of every account
+func GetRoles(c *gin.Context) {
+	roles := map[string]string{"admin": middleware.RoleAdmin}
+	if names, err := utils.ListJSON(config.UsersDir); err == nil {
+		for _, file := range names {
+			if name := strings.TrimSuffix(file, ".json"); name != "admin" {
+				roles[name] = middleware.RoleOf(name)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": roles})
+}
+
+// SetUserRole makes an account a user or a view-only guest
+func SetUserRole(c *gin.Context) {
+	username := c.Param("usr")
+	if !validUsername(username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+		return
+	}
+	var req UserRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if _, err := utils.ModTime(filepath.Join(config.UsersDir, username+".json")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := middleware.SetRole(username, req.Role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// validUsername keeps user names usable as file names under UsersDir
+func validUsername(name string) bool {
+	if name == "" || len(name) > 32 || name[0] == '.' {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUserPassword accepts bcrypt hashes and the legacy plain passwords
+// that Login upgrades on first use
+func checkUserPassword(stored, password string) bool {
+	if stored == "" {
+		stored = "admin"
+	}
+	if stored[0] == '$' {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return stored == password
+}
+
+// checkAccountPassword checks a password the way Login does, minus the
+// second factor, for protocols that cannot ask for one: accounts with it,
+// or required to set it up, must use an API token or SSH key
+func checkAccountPassword(username, password string) bool {
+	if secondFactor(username) != factorNone {
+		return false
+	}
+	if username != "admin" {
+		if account, handled, err := tryLdapLogin(username, password); err == nil && handled {
+			return account == username
+		}
+	}
+	if !validUsername(username) {
+		return false
+	}
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	userFile := filepath.Join(config.UsersDir, username+".json")
+	if username == "admin" && sysConfig.AuthMode == "single" {
+		userFile = filepath.Join(config.DataDir, "data.json")
+	}
+	var user models.User
+	if err := utils.ReadJSON(userFile, &user); err != nil {
+		return false
+	}
+	return checkUserPassword(user.Password, password)
+}
+
+// setUserPassword replaces the password in a user file without touching the
+// rest of the user's data
+func setUserPassword(userFile, hashed string) error {
+	return utils.WithFileLock(userFile, func() error {
+		var userData map[string]interface{}
+		if err := utils.ReadJSONUnlocked(userFile, &userData); err != nil {
+			return err
+		}
+		userData["password"] = hashed
+		return utils.WriteJSONUnlocked(userFile, userData)
+	})
+}
+
 func UploadLicense(c *gin.Context) {
 	var req LicenseRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
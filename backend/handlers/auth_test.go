@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"flatnasgo-backend/utils"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetUserPasswordKeepsUserData(t *testing.T) {
+	userFile := filepath.Join(t.TempDir(), "alice.json")
+	if err := utils.WriteJSON(userFile, map[string]interface{}{"username": "alice", "password": "old", "rssAlerts": []interface{}{"x"}}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := setUserPassword(userFile, "$2a$hash"); err != nil {
+		t.Fatalf("set password: %v", err)
+	}
+	var data map[string]interface{}
+	_ = utils.ReadJSON(userFile, &data)
+	if data["password"] != "$2a$hash" || data["rssAlerts"] == nil {
+		t.Fatalf("expected password replaced and data kept, got %v", data)
+	}
+	for _, name := range []string{"../admin", ".hidden", "a/b", ""} {
+		if validUsername(name) {
+			t.Fatalf("expected %q to be rejected", name)
+		}
+	}
+	if !validUsername("mom_2") {
+		t.Fatalf("expected plain name to be accepted")
+	}
+}
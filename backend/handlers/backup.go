@@ -0,0 +1,664 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/store"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted archives are backupMagic, a scrypt salt, a GCM nonce and the
+// sealed tar.gz
+const backupMagic = "FNBK01"
+
+const (
+	backupSaltSize       = 16
+	backupMinPassword    = 8
+	backupMaxUpload      = 512 << 20
+	backupDefaultHours   = 24
+	backupDefaultKeep    = 7
+	backupSchedulerTick  = time.Minute
+	backupRemoteTimeout  = 2 * time.Minute
+	backupManifestName   = "manifest.json"
+	backupArchiveSuffix  = ".fnbk"
+	backupScheduledLabel = "flatnas-backup-"
+	// backupWidgetCacheName holds the widget cache in an archive
+	backupWidgetCacheName = "widget_cache.json"
+)
+
+// Never archived: old backups and logs, and the signing key, which stays
+// with the instance
+var backupSkipped = map[string]bool{
+	"backups":    true,
+	"logs":       true,
+	"secret.key": true,
+	// Rebuilt on demand and can be large
+	"thumb-cache":  true,
+	"transcode":    true,
+	"search-index": true,
+	// Malware does not go into backups
+	"quarantine": true,
+	// The documents of the database are archived one by one instead
+	store.FileName:          true,
+	store.FileName + "-wal": true,
+	store.FileName + "-shm": true,
+}
+
+// Only archived when caches are asked for. The widget cache lives in the
+// database and is added as widget_cache.json.
+var backupCaches = map[string]bool{
+	"icon-cache":          true,
+	backupWidgetCacheName: true,
+}
+
+var errBackupPassword = errors.New("Wrong password or damaged backup")
+
+// backupManifest describes an archive; it is its first entry
+type backupManifest struct {
+	App           string `json:"app"`
+	SchemaVersion int    `json:"schemaVersion"`
+	CreatedAt     int64  `json:"createdAt"` // Unix timestamp in ms
+	IncludeCaches bool   `json:"includeCaches"`
+	Files         int    `json:"files"`
+}
+
+type backupState struct {
+	LastRun   int64  `json:"lastRun,omitempty"` // Unix timestamp in ms
+	LastFile  string `json:"lastFile,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+func backupStateFile() string {
+	return filepath.Join(config.DataDir, "backup_state.json")
+}
+
+func backupFiles(includeCaches bool) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(config.DataDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(config.DataDir, p)
+		if rel == "." {
+			return nil
+		}
+		top := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+		if backupSkipped[top] || (backupCaches[top] && !includeCaches) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && !strings.HasSuffix(p, ".tmp") {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err == nil && config.Store != nil {
+		var docs []string
+		if docs, err = config.Store.Files(); err == nil {
+			for _, doc := range docs {
+				rel, _ := filepath.Rel(config.DataDir, doc)
+				files = append(files, rel)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, err
+}
+
+// buildBackupArchive packs the data directory into a tar.gz. Each file is
+// read under its lock so no half-written file ends up in the archive.
+func buildBackupArchive(includeCaches bool) ([]byte, error) {
+	files, err := backupFiles(includeCaches)
+	if err != nil {
+		return nil, err
+	}
+	var widgetCache []byte
+	if includeCaches {
+		if widgetCache, err = sharedWidgetCache.snapshot(); err != nil {
+			return nil, err
+		}
+		files = append(files, backupWidgetCacheName)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	manifest, _ := json.Marshal(backupManifest{
+		App:           "flatnas",
+		SchemaVersion: config.SchemaVersion(),
+		CreatedAt:     now.UnixMilli(),
+		IncludeCaches: includeCaches,
+		Files:         len(files),
+	})
+	if err := add(backupManifestName, manifest); err != nil {
+		return nil, err
+	}
+	for _, rel := range files {
+		if rel == backupWidgetCacheName {
+			if err := add("data/"+rel, widgetCache); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		full := filepath.Join(config.DataDir, rel)
+		var data []byte
+		err := utils.WithFileLock(full, func() error {
+			var err error
+			data, err = utils.ReadFile(full)
+			return err
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := add("data/"+filepath.ToSlash(rel), data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func backupKey(password string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(password), salt, 1<<15, 8, 1, 32)
+}
+
+func encryptBackup(archive []byte, password string) ([]byte, error) {
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := backupKey(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(backupMagic)+len(salt)+len(nonce)+len(archive)+gcm.Overhead())
+	out = append(out, backupMagic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	// The header is authenticated too, so it cannot be swapped
+	return gcm.Seal(out, nonce, archive, out), nil
+}
+
+func decryptBackup(blob []byte, password string) ([]byte, error) {
+	if !bytes.HasPrefix(blob, []byte(backupMagic)) {
+		return nil, errors.New("Not a FlatNas backup")
+	}
+	header := len(backupMagic) + backupSaltSize
+	if len(blob) < header {
+		return nil, errBackupPassword
+	}
+	key, err := backupKey(password, blob[len(backupMagic):header])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < header+gcm.NonceSize() {
+		return nil, errBackupPassword
+	}
+	nonce := blob[header : header+gcm.NonceSize()]
+	archive, err := gcm.Open(nil, nonce, blob[header+gcm.NonceSize():], blob[:header+gcm.NonceSize()])
+	if err != nil {
+		return nil, errBackupPassword
+	}
+	return archive, nil
+}
+
+// readBackupArchive unpacks a tar.gz into data file paths (relative to
+// DataDir) and contents, refusing anything outside the data directory
+func readBackupArchive(archive []byte) (backupManifest, map[string][]byte, error) {
+	var manifest backupManifest
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return manifest, nil, errors.New("Damaged backup")
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string][]byte)
+	seenManifest := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, errors.New("Damaged backup")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return manifest, nil, errors.New("Damaged backup")
+		}
+		if hdr.Name == backupManifestName {
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return manifest, nil, errors.New("Damaged backup manifest")
+			}
+			seenManifest = true
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if !strings.HasPrefix(name, "data/") || strings.Contains(name, "..") {
+			return manifest, nil, fmt.Errorf("Unexpected file in backup: %s", hdr.Name)
+		}
+		rel := filepath.FromSlash(strings.TrimPrefix(name, "data/"))
+		if backupSkipped[strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]] {
+			continue
+		}
+		files[rel] = data
+	}
+	if !seenManifest || manifest.App != "flatnas" {
+		return manifest, nil, errors.New("Not a FlatNas backup")
+	}
+	if manifest.SchemaVersion > config.SchemaVersion() {
+		return manifest, nil, fmt.Errorf("Backup is from a newer version (schema %d)", manifest.SchemaVersion)
+	}
+	return manifest, files, nil
+}
+
+// restoreBackup writes the files of an archive over the data directory.
+// The current files are saved to backups/pre-restore-*.tar.gz first; files
+// the archive does not contain are left alone.
+func restoreBackup(files map[string][]byte) error {
+	current, err := buildBackupArchive(true)
+	if err != nil {
+		return fmt.Errorf("snapshot before restore: %w", err)
+	}
+	dir := filepath.Join(config.DataDir, "backups")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	snapshot := filepath.Join(dir, "pre-restore-"+time.Now().Format("20060102-150405")+".tar.gz")
+	if err := os.WriteFile(snapshot, current, 0600); err != nil {
+		return fmt.Errorf("snapshot before restore: %w", err)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if name != backupWidgetCacheName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, rel := range names {
+		full := filepath.Join(config.DataDir, rel)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			return err
+		}
+		if err := utils.AtomicWriteFile(full, files[rel]); err != nil {
+			return fmt.Errorf("restore %s: %w", rel, err)
+		}
+	}
+	if data, ok := files[backupWidgetCacheName]; ok {
+		if err := sharedWidgetCache.restore(data); err != nil {
+			return fmt.Errorf("restore %s: %w", backupWidgetCacheName, err)
+		}
+	}
+	reloadOutboundClients()
+	return nil
+}
+
+func backupFileName(now time.Time) string {
+	return backupScheduledLabel + now.Format("20060102-150405") + backupArchiveSuffix
+}
+
+// ExportBackup downloads the configuration as an encrypted archive. The
+// JSON body has password and includeCaches.
+func ExportBackup(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	var req struct {
+		Password      string `json:"password"`
+		IncludeCaches bool   `json:"includeCaches"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if len(req.Password) < backupMinPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Password must be at least %d characters", backupMinPassword)})
+		return
+	}
+	archive, err := buildBackupArchive(req.IncludeCaches)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build backup"})
+		return
+	}
+	blob, err := encryptBackup(archive, req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt backup"})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+backupFileName(time.Now())+`"`)
+	c.Data(http.StatusOK, "application/octet-stream", blob)
+}
+
+// RestoreBackup restores an archive uploaded as the multipart field "file"
+// with its password in "password"
+func RestoreBackup(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No backup file"})
+		return
+	}
+	if fh.Size > backupMaxUpload {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Backup too large"})
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read backup"})
+		return
+	}
+	blob, err := io.ReadAll(io.LimitReader(f, backupMaxUpload))
+	f.Close()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read backup"})
+		return
+	}
+	archive, err := decryptBackup(blob, c.PostForm("password"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	manifest, files, err := readBackupArchive(archive)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := restoreBackup(files); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"createdAt": manifest.CreatedAt, "files": len(files)}})
+}
+
+// decodeBackupSettings reads the "backup" field of a system config update.
+// Empty passwords keep the stored ones.
+func decodeBackupSettings(raw interface{}, current *models.BackupSettings) (*models.BackupSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid backup settings")
+	}
+	settings := &models.BackupSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid backup settings")
+	}
+	settings.Dir = strings.TrimSpace(settings.Dir)
+	settings.RemoteUrl = strings.TrimSpace(settings.RemoteUrl)
+	if current != nil {
+		if settings.Password == "" {
+			settings.Password = current.Password
+		}
+		if settings.RemotePassword == "" && settings.RemoteUsername == current.RemoteUsername {
+			settings.RemotePassword = current.RemotePassword
+		}
+	}
+	if settings.IntervalHours < 0 || settings.Keep < 0 {
+		return nil, fmt.Errorf("Backup interval and keep cannot be negative")
+	}
+	if settings.Dir != "" && !filepath.IsAbs(settings.Dir) {
+		return nil, fmt.Errorf("Backup folder must be an absolute path")
+	}
+	if settings.RemoteUrl != "" {
+		u, err := url.Parse(settings.RemoteUrl)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid backup remote url")
+		}
+	}
+	if settings.Enable && len(settings.Password) < backupMinPassword {
+		return nil, fmt.Errorf("Backup password must be at least %d characters", backupMinPassword)
+	}
+	return settings, nil
+}
+
+func loadBackupSettings() *models.BackupSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	return sysConfig.Backup
+}
+
+func backupDir(settings *models.BackupSettings) string {
+	if settings.Dir != "" {
+		return settings.Dir
+	}
+	return filepath.Join(config.DataDir, "backups", "scheduled")
+}
+
+// runScheduledBackup writes one archive to the backup folder, uploads it
+// when a remote is set and prunes old archives
+func runScheduledBackup(ctx context.Context, settings *models.BackupSettings) (string, error) {
+	archive, err := buildBackupArchive(settings.IncludeCaches)
+	if err != nil {
+		return "", err
+	}
+	blob, err := encryptBackup(archive, settings.Password)
+	if err != nil {
+		return "", err
+	}
+	dir := backupDir(settings)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := backupFileName(time.Now())
+	if err := utils.AtomicWriteFile(filepath.Join(dir, name), blob); err != nil {
+		return "", err
+	}
+	pruneBackups(dir, settings.Keep)
+	if settings.RemoteUrl != "" {
+		if err := uploadBackup(ctx, settings, name, blob); err != nil {
+			return name, fmt.Errorf("upload: %w", err)
+		}
+	}
+	return name, nil
+}
+
+func pruneBackups(dir string, keep int) {
+	if keep <= 0 {
+		keep = backupDefaultKeep
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), backupScheduledLabel) && strings.HasSuffix(e.Name(), backupArchiveSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	// Names sort by time
+	sort.Strings(names)
+	for len(names) > keep {
+		os.Remove(filepath.Join(dir, names[0]))
+		names = names[1:]
+	}
+}
+
+// uploadBackup PUTs the archive into the remote folder
+func uploadBackup(ctx context.Context, settings *models.BackupSettings, name string, blob []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, backupRemoteTimeout)
+	defer cancel()
+	target := strings.TrimRight(settings.RemoteUrl, "/") + "/" + url.PathEscape(name)
+	// The admin chose this target, so LAN addresses are fine
+	req, err := http.NewRequestWithContext(allowOutbound(ctx), http.MethodPut, target, bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if settings.RemoteUsername != "" {
+		req.SetBasicAuth(settings.RemoteUsername, settings.RemotePassword)
+	}
+	resp, err := (&http.Client{Transport: newProxyTransport()}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("remote answered %s", resp.Status)
+	}
+	return nil
+}
+
+func recordBackupRun(name string, err error) backupState {
+	state := backupState{LastRun: time.Now().UnixMilli(), LastFile: name}
+	if err != nil {
+		state.LastError = err.Error()
+		dataLog.Error("Scheduled backup failed", "error", err)
+	} else {
+		dataLog.Info("Scheduled backup written", "file", name)
+	}
+	utils.WriteJSON(backupStateFile(), state)
+	return state
+}
+
+// StartBackupScheduler writes a backup every IntervalHours while backups
+// are enabled
+func StartBackupScheduler() {
+	go func() {
+		ticker := time.NewTicker(backupSchedulerTick)
+		defer ticker.Stop()
+		beat := registerWorker("backup.scheduler", backupSchedulerTick)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case now := <-ticker.C:
+				beat()
+				settings := loadBackupSettings()
+				if settings == nil || !settings.Enable {
+					continue
+				}
+				hours := settings.IntervalHours
+				if hours <= 0 {
+					hours = backupDefaultHours
+				}
+				var state backupState
+				utils.ReadJSON(backupStateFile(), &state)
+				if now.Sub(time.UnixMilli(state.LastRun)) < time.Duration(hours)*time.Hour {
+					continue
+				}
+				done, ok := beginTask()
+				if !ok {
+					return
+				}
+				name, err := runScheduledBackup(fetchCtx, settings)
+				recordBackupRun(name, err)
+				done()
+			}
+		}
+	}()
+}
+
+// GetBackupStatus reports the last scheduled backup and the archives in
+// the backup folder
+func GetBackupStatus(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	var state backupState
+	utils.ReadJSON(backupStateFile(), &state)
+	archives := []gin.H{}
+	if settings := loadBackupSettings(); settings != nil {
+		entries, _ := os.ReadDir(backupDir(settings))
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), backupArchiveSuffix) {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				archives = append(archives, gin.H{"name": e.Name(), "size": info.Size(), "modified": info.ModTime().UnixMilli()})
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"state": state, "archives": archives}})
+}
+
+// RunBackup writes a scheduled backup now
+func RunBackup(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	settings := loadBackupSettings()
+	if settings == nil || len(settings.Password) < backupMinPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Backups are not configured"})
+		return
+	}
+	name, err := runScheduledBackup(c.Request.Context(), settings)
+	state := recordBackupRun(name, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "data": state})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": state})
+}
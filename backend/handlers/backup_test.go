@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupRoundTrip(t *testing.T) {
+	useTestConfig(t)
+
+	write := func(rel, content string) {
+		full := filepath.Join(config.DataDir, rel)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	write("system.json", `{"authMode":"multi"}`)
+	write("users/bob.json", `{"username":"bob","version":3}`)
+	write("icon-cache/a.png", "png")
+	write("secret.key", "do-not-export")
+	write("logs/flatnas.log", "log line")
+
+	archive, err := buildBackupArchive(false)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	blob, err := encryptBackup(archive, "correct horse")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if _, err := decryptBackup(blob, "wrong password"); err != errBackupPassword {
+		t.Fatalf("expected wrong password error, got %v", err)
+	}
+	plain, err := decryptBackup(blob, "correct horse")
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	manifest, files, err := readBackupArchive(plain)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if manifest.Files != 2 || len(files) != 2 || string(files[filepath.Join("users", "bob.json")]) != `{"username":"bob","version":3}` {
+		t.Fatalf("unexpected archive contents: %+v %v", manifest, files)
+	}
+
+	write("users/bob.json", `{"username":"bob","version":9}`)
+	if err := restoreBackup(files); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(config.DataDir, "users", "bob.json"))
+	if string(data) != `{"username":"bob","version":3}` {
+		t.Fatalf("expected restored user file, got %s", data)
+	}
+	if snapshots, _ := filepath.Glob(filepath.Join(config.DataDir, "backups", "pre-restore-*.tar.gz")); len(snapshots) != 1 {
+		t.Fatalf("expected a snapshot before restoring, got %v", snapshots)
+	}
+}
@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
 	"flatnasgo-backend/models"
 	"flatnasgo-backend/utils"
-	"log"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -19,6 +23,98 @@ import (
 
 var socketServer *socketio.Server
 
+// backgroundCtx is cancelled on shutdown so warmup, the scheduler and other
+// loops stop starting new work
+var backgroundCtx, stopBackgroundTasks = context.WithCancel(context.Background())
+
+// fetchCtx bounds fetches that are already running. It is only cancelled
+// when draining them at shutdown runs out of time.
+var fetchCtx, cancelFetches = context.WithCancel(context.Background())
+
+// Socket events and fetches shutdown waits for, see beginTask
+var (
+	inflightMu sync.Mutex
+	inflight   sync.WaitGroup
+)
+
+// Cancelled fetches return quickly; this is how long they get to finish
+// writing what they have
+const cancelledTaskGrace = 2 * time.Second
+
+// beginTask registers work shutdown should wait for and returns its done
+// func. It refuses once shutdown started.
+func beginTask() (func(), bool) {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+	if backgroundCtx.Err() != nil {
+		return nil, false
+	}
+	inflight.Add(1)
+	return inflight.Done, true
+}
+
+// Open socket connections, closed at shutdown so long-polling requests end
+var (
+	socketConnsMu sync.Mutex
+	socketConns   = make(map[string]socketio.Conn)
+)
+
+func SocketConnected(s socketio.Conn) {
+	socketConnsMu.Lock()
+	socketConns[s.ID()] = s
+	socketConnsMu.Unlock()
+}
+
+func SocketDisconnected(s socketio.Conn) {
+	socketConnsMu.Lock()
+	delete(socketConns, s.ID())
+	socketConnsMu.Unlock()
+}
+
+// CloseSockets disconnects every socket; clients reconnect to the next
+// server
+func CloseSockets() {
+	socketConnsMu.Lock()
+	conns := make([]socketio.Conn, 0, len(socketConns))
+	for _, s := range socketConns {
+		conns = append(conns, s)
+	}
+	socketConnsMu.Unlock()
+	for _, s := range conns {
+		s.Close()
+	}
+}
+
+// ShuttingDown reports whether StopBackgroundTasks was called
+func ShuttingDown() bool {
+	return backgroundCtx.Err() != nil
+}
+
+// StopBackgroundTasks stops new background work, then waits for running
+// socket events and fetches until ctx expires and cancels what is left.
+func StopBackgroundTasks(ctx context.Context) error {
+	inflightMu.Lock()
+	stopBackgroundTasks()
+	inflightMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+	cancelFetches()
+	select {
+	case <-drained:
+	case <-time.After(cancelledTaskGrace):
+	}
+	return ctx.Err()
+}
+
 type getDataCacheEntry struct {
 	dataMod  time.Time
 	sysMod   time.Time
@@ -89,7 +185,7 @@ func GetData(c *gin.Context) {
 
 	var sysConfig models.SystemConfig
 	sysStatStart := time.Now()
-	sysInfo, sysStatErr := os.Stat(config.SystemConfigFile)
+	sysMod, sysStatErr := utils.ModTime(config.SystemConfigFile)
 	sysStatMs := time.Since(sysStatStart).Milliseconds()
 	sysReadStart := time.Now()
 	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
@@ -101,16 +197,8 @@ func GetData(c *gin.Context) {
 	}
 
 	userStatStart := time.Now()
-	userInfo, userStatErr := os.Stat(userFile)
+	dataMod, userStatErr := utils.ModTime(userFile)
 	userStatMs := time.Since(userStatStart).Milliseconds()
-	dataMod := time.Time{}
-	if userStatErr == nil {
-		dataMod = userInfo.ModTime()
-	}
-	sysMod := time.Time{}
-	if sysStatErr == nil {
-		sysMod = sysInfo.ModTime()
-	}
 
 	cacheKey := userFile
 	if isGuest {
@@ -124,7 +212,7 @@ func GetData(c *gin.Context) {
 		getDataCacheMu.RUnlock()
 		if ok && entry.dataMod.Equal(dataMod) && entry.sysMod.Equal(sysMod) {
 			totalMs := time.Since(start).Milliseconds()
-			log.Printf("GetData cache hit user=%s guest=%v sysStatMs=%d userStatMs=%d sysReadMs=%d totalMs=%d", username, isGuest, sysStatMs, userStatMs, sysReadMs, totalMs)
+			dataLog.Debug("GetData cache hit", "user", username, "guest", isGuest, "sysStatMs", sysStatMs, "userStatMs", userStatMs, "sysReadMs", sysReadMs, "totalMs", totalMs)
 			c.JSON(http.StatusOK, entry.response)
 			return
 		}
@@ -187,13 +275,18 @@ func GetData(c *gin.Context) {
 			"lanUrl":        {},
 			"backupLanUrls": {},
 			"lanHost":       {},
+			"fetchProfile":  {},
+			"apiKey":        {},
+			"notifications": {},
+			"rssAlerts":     {},
+			"rssDigest":     {},
 		}
 		removeSensitiveFields(userData, sensitiveKeys)
 	}
 	filterMs := time.Since(filterStart).Milliseconds()
 
 	// Inject system config
-	userData["systemConfig"] = sysConfig
+	userData["systemConfig"] = sysConfig.Redacted()
 	// Inject username if missing (for consistency)
 	if _, ok := userData["username"]; !ok {
 		userData["username"] = username
@@ -238,7 +331,7 @@ func GetData(c *gin.Context) {
 		getDataCacheMu.Unlock()
 	}
 	totalMs := time.Since(start).Milliseconds()
-	log.Printf("GetData cache miss user=%s guest=%v sysStatMs=%d userStatMs=%d sysReadMs=%d userReadMs=%d filterMs=%d totalMs=%d", username, isGuest, sysStatMs, userStatMs, sysReadMs, userReadMs, filterMs, totalMs)
+	dataLog.Debug("GetData cache miss", "user", username, "guest", isGuest, "sysStatMs", sysStatMs, "userStatMs", userStatMs, "sysReadMs", sysReadMs, "userReadMs", userReadMs, "filterMs", filterMs, "totalMs", totalMs)
 
 	c.JSON(http.StatusOK, userData)
 }
@@ -491,16 +584,16 @@ func SaveMemo(c *gin.Context) {
 		return
 	}
 
-	if socketServer != nil {
-		socketServer.BroadcastToNamespace("/", "memo:updated", map[string]interface{}{
-			"widgetId": widgetID,
-			"content":  next,
-		})
-	}
+	broadcastAll("memo:updated", map[string]interface{}{
+		"widgetId": widgetID,
+		"content":  next,
+	})
 
 	c.JSON(http.StatusOK, gin.H{"success": true, "data": next})
 }
 
+var errVersionConflict = errors.New("version conflict")
+
 func SaveData(c *gin.Context) {
 	username := c.GetString("username")
 	if username == "" {
@@ -523,77 +616,81 @@ func SaveData(c *gin.Context) {
 		userFile = filepath.Join(config.DataDir, "data.json")
 	}
 
-	// 2. Read existing data to map to preserve EVERYTHING in file
-	var existingData map[string]interface{}
-	utils.ReadJSON(userFile, &existingData)
-	if existingData == nil {
-		existingData = make(map[string]interface{})
-	}
-	existingVersion := normalizeVersion(existingData["version"])
 	clientVersion := int64(0)
 	hasClientVersion := false
 	if v, ok := payload["version"]; ok {
 		clientVersion = normalizeVersion(v)
 		hasClientVersion = true
 	}
-	if hasClientVersion && clientVersion != existingVersion {
-		c.JSON(http.StatusConflict, gin.H{"error": "Version conflict", "currentVersion": existingVersion})
-		return
-	}
-	newVersion := existingVersion + 1
-	payload["version"] = newVersion
 
-	// 3. Handle Password Hashing
-	// Check if payload has a password string
+	// 2. Hash a new password before taking the file lock; bcrypt is slow
+	newPassword := false
 	if pwd, ok := payload["password"].(string); ok && pwd != "" {
-		// Hash new password
 		hashed, err := utils.HashPassword(pwd)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 			return
 		}
 		payload["password"] = hashed
-	} else {
-		// Keep existing password
-		if existingPwd, ok := existingData["password"]; ok {
-			payload["password"] = existingPwd
-		}
+		newPassword = true
 	}
 
-	// 4. Merge other fields?
-	// Actually, payload contains the full state of groups, widgets, appConfig etc.
-	// So we can just use payload as the new state, but we should preserve top-level keys
-	// that might be missing in payload but present in existingData (if any).
-	// Frontend sends: groups, widgets, appConfig, rssFeeds, rssCategories.
-	// If there are other top-level keys in existingData (like "created_at"?), we might want to keep them.
-	for k, v := range existingData {
-		if _, exists := payload[k]; !exists {
-			payload[k] = v
+	// 3. Check the version and write under the file lock, so two tabs
+	// saving at once cannot both pass the check
+	var existingData map[string]interface{}
+	var existingVersion, newVersion int64
+	err := utils.UpdateJSON(userFile, &existingData, func() error {
+		if existingData == nil {
+			existingData = make(map[string]interface{})
 		}
-	}
+		existingVersion = normalizeVersion(existingData["version"])
+		if hasClientVersion && clientVersion != existingVersion {
+			return errVersionConflict
+		}
+		newVersion = existingVersion + 1
+		payload["version"] = newVersion
 
-	// Clean up legacy "items" field if "groups" is present in payload
-	// This prevents the issue where deleting all groups causes legacy items to reappear as a "Default Group"
-	if _, hasGroups := payload["groups"]; hasGroups {
-		delete(payload, "items")
-	}
+		// Keep the existing password unless a new one was sent
+		if !newPassword {
+			if existingPwd, ok := existingData["password"]; ok {
+				payload["password"] = existingPwd
+			}
+		}
 
-	// Ensure username is set
-	if _, ok := payload["username"]; !ok {
-		payload["username"] = username
-	}
+		// Payload is the full state of groups, widgets, appConfig etc.; keep
+		// top-level keys it does not carry, such as created_at
+		for k, v := range existingData {
+			if _, exists := payload[k]; !exists {
+				payload[k] = v
+			}
+		}
 
-	if err := utils.WriteJSON(userFile, payload); err != nil {
+		// Clean up legacy "items" field if "groups" is present in payload
+		// This prevents the issue where deleting all groups causes legacy items to reappear as a "Default Group"
+		if _, hasGroups := payload["groups"]; hasGroups {
+			delete(payload, "items")
+		}
+
+		// Ensure username is set
+		if _, ok := payload["username"]; !ok {
+			payload["username"] = username
+		}
+		existingData = payload
+		return nil
+	})
+	if errors.Is(err, errVersionConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Version conflict", "currentVersion": existingVersion})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save data"})
 		return
 	}
 
-	if socketServer != nil {
-		socketServer.BroadcastToNamespace("/", "data-updated", map[string]interface{}{
-			"username": username,
-			"version":  newVersion,
-		})
-	}
+	broadcastAll("data-updated", map[string]interface{}{
+		"username": username,
+		"version":  newVersion,
+	})
 
 	c.JSON(http.StatusOK, gin.H{"success": true, "version": newVersion})
 }
@@ -694,7 +791,7 @@ func ResetData(c *gin.Context) {
 func GetSystemConfig(c *gin.Context) {
 	var sysConfig models.SystemConfig
 	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
-	c.JSON(http.StatusOK, sysConfig)
+	c.JSON(http.StatusOK, sysConfig.Redacted())
 }
 
 func UpdateSystemConfig(c *gin.Context) {
@@ -711,12 +808,32 @@ func UpdateSystemConfig(c *gin.Context) {
 	}
 
 	var sysConfig models.SystemConfig
-	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	invalid := false
+	err := utils.UpdateJSON(config.SystemConfigFile, &sysConfig, func() error {
+		err := applySystemConfig(&sysConfig, payload)
+		invalid = err != nil
+		return err
+	})
+	if err != nil {
+		if invalid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update system config"})
+		return
+	}
+	reloadOutboundClients()
+	reloadSftpServer()
 
+	c.JSON(http.StatusOK, sysConfig.Redacted())
+}
+
+// applySystemConfig copies the fields present in payload onto sysConfig,
+// validating each
+func applySystemConfig(sysConfig *models.SystemConfig, payload map[string]interface{}) error {
 	if v, ok := payload["authMode"].(string); ok {
 		if v != "single" && v != "multi" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid authMode"})
-			return
+			return fmt.Errorf("Invalid authMode")
 		}
 		sysConfig.AuthMode = v
 	}
@@ -727,19 +844,180 @@ func UpdateSystemConfig(c *gin.Context) {
 	if v, ok := payload["dockerHost"].(string); ok {
 		sysConfig.DockerHost = v
 	}
-
-	if err := utils.WriteJSON(config.SystemConfigFile, sysConfig); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update system config"})
-		return
+	if v, ok := payload["realtimeTransport"].(string); ok {
+		if v != "" && v != TransportSocketIO && v != TransportWebSocket {
+			return fmt.Errorf("Invalid realtimeTransport")
+		}
+		sysConfig.RealtimeTransport = v
+	}
+	if v, ok := payload["locale"].(string); ok {
+		if v != "" && i18n.Normalize(v) != v {
+			return fmt.Errorf("Invalid locale")
+		}
+		sysConfig.Locale = v
+	}
+	if v, ok := payload["trashDays"].(float64); ok {
+		if v < 0 || v != float64(int(v)) {
+			return fmt.Errorf("Invalid trashDays")
+		}
+		sysConfig.TrashDays = int(v)
+	}
+	if v, ok := payload["streamRateLimit"].(float64); ok {
+		if v < 0 || v != float64(int(v)) {
+			return fmt.Errorf("Invalid streamRateLimit")
+		}
+		sysConfig.StreamRateLimit = int(v)
+	}
+	if v, ok := payload["enableWebdav"].(bool); ok {
+		sysConfig.EnableWebDAV = v
+	}
+	if v, ok := payload["enableSearchIndex"].(bool); ok {
+		sysConfig.EnableSearchIndex = v
+	}
+	if raw, ok := payload["sftp"]; ok {
+		sftp, err := decodeSftpSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Sftp = sftp
+	}
+	if raw, ok := payload["integrity"]; ok {
+		integrity, err := decodeIntegritySettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Integrity = integrity
+	}
+	if raw, ok := payload["antivirus"]; ok {
+		antivirus, err := decodeAntivirusSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Antivirus = antivirus
+	}
+	if raw, ok := payload["office"]; ok {
+		office, err := decodeOfficeSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Office = office
+	}
+	if raw, ok := payload["music"]; ok {
+		music, err := decodeMusicSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Music = music
+	}
+	if raw, ok := payload["versions"]; ok {
+		versions, err := decodeVersionSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Versions = versions
+	}
+	if raw, ok := payload["smart"]; ok {
+		smart, err := decodeSmartSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Smart = smart
+	}
+	if raw, ok := payload["raid"]; ok {
+		raid, err := decodeRaidSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Raid = raid
 	}
+	if raw, ok := payload["zpool"]; ok {
+		zpool, err := decodeZpoolSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Zpool = zpool
+	}
+	if raw, ok := payload["quotas"]; ok {
+		quotas, err := decodeQuotaSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.Quotas = quotas
+	}
+	if err := applyNetworkSettings(sysConfig, payload); err != nil {
+		return err
+	}
+	if raw, ok := payload["oidc"]; ok {
+		oidc, err := decodeOidcSettings(raw, sysConfig.Oidc)
+		if err != nil {
+			return err
+		}
+		sysConfig.Oidc = oidc
+	}
+	if raw, ok := payload["ldap"]; ok {
+		ldap, err := decodeLdapSettings(raw, sysConfig.Ldap)
+		if err != nil {
+			return err
+		}
+		sysConfig.Ldap = ldap
+	}
+	if raw, ok := payload["rateLimit"]; ok {
+		rateLimit, err := decodeRateLimitSettings(raw)
+		if err != nil {
+			return err
+		}
+		sysConfig.RateLimit = rateLimit
+	}
+	if raw, ok := payload["backup"]; ok {
+		backup, err := decodeBackupSettings(raw, sysConfig.Backup)
+		if err != nil {
+			return err
+		}
+		sysConfig.Backup = backup
+	}
+	if raw, ok := payload["transcode"]; ok {
+		transcode, err := decodeTranscodeSettings(raw, sysConfig.Transcode)
+		if err != nil {
+			return err
+		}
+		sysConfig.Transcode = transcode
+	}
+	if raw, ok := payload["shares"]; ok {
+		shares, err := decodeFileShares(raw, sysConfig.Shares)
+		if err != nil {
+			return err
+		}
+		sysConfig.Shares = shares
+	}
+	return nil
+}
 
-	c.JSON(http.StatusOK, sysConfig)
+// decodeRateLimitSettings reads the "rateLimit" field of a system config
+// update; null goes back to the defaults
+func decodeRateLimitSettings(raw interface{}) (*models.RateLimitSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rate limit settings")
+	}
+	settings := &models.RateLimitSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid rate limit settings")
+	}
+	for _, v := range []int{settings.RestPerMinute, settings.RestBurst, settings.SocketPerMinute, settings.SocketBurst, settings.SocketIPPerMinute, settings.SocketIPBurst} {
+		if v < 0 {
+			return nil, fmt.Errorf("Rate limits cannot be negative")
+		}
+	}
+	return settings, nil
 }
 
 func StartDataWarmup() {
 	go func() {
 		dataFile := filepath.Join(config.DataDir, "data.json")
-		if _, err := os.Stat(dataFile); err != nil {
+		if _, err := utils.ModTime(dataFile); err != nil {
 			if os.IsNotExist(err) {
 				time.Sleep(5 * time.Second)
 			} else {
@@ -754,7 +1032,10 @@ func StartDataWarmup() {
 
 		rssUrls := extractRssUrls(payload)
 		if len(rssUrls) > 0 {
-			WarmRssCache(rssUrls)
+			WarmRssCache(backgroundCtx, rssUrls)
+		}
+		if backgroundCtx.Err() != nil {
+			return
 		}
 
 		weatherPayloads := extractWeatherPayloads(payload)
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"runtime"
@@ -57,7 +56,7 @@ func InitDocker() {
 	dockerClient, err = client.NewClientWithOpts(opts...)
 	dockerHostUsed = host
 	if err != nil {
-		log.Printf("Failed to init docker client: %v", err)
+		dockerLog.Error("Failed to init docker client", "error", err)
 		dockerClient = nil
 		dockerInitError = err
 	} else {
@@ -376,7 +375,7 @@ func ListContainers(c *gin.Context) {
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Printf("Recovered from panic in collectStatsIfNeeded: %v", r)
+					dockerLog.Error("Recovered from panic in collectStatsIfNeeded", "panic", r)
 				}
 				statsCollecting.Store(false)
 			}()
@@ -0,0 +1,775 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The file browser works on shares: host folders the admin lists in the
+// system config. Clients address files as a share name plus a slash
+// separated path inside it; resolveSharePath is the only way from that to
+// a host path and refuses anything that would end up outside the share,
+// through ".." or through a symlink.
+
+var shareNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 _.-]{0,63}$`)
+
+var (
+	errShareNotFound = errors.New("Share not found")
+	errInvalidPath   = errors.New("Invalid path")
+	errShareReadOnly = errors.New("Share is read-only")
+	errFileExists    = errors.New("File already exists")
+	errSymlinkLeaf   = errors.New("Cannot write through a symlink")
+	errSymlinkShare  = errors.New("Symlinks cannot be moved or copied to another share")
+	errInsideItself  = errors.New("Cannot put a folder inside itself")
+)
+
+// FileEntry is one item of a directory listing
+type FileEntry struct {
+	Name    string   `json:"name"`
+	Path    string   `json:"path"` // Inside the share, e.g. "photos/2024/a.jpg"
+	IsDir   bool     `json:"isDir"`
+	Size    int64    `json:"size"`
+	ModTime int64    `json:"modTime"` // Unix timestamp in ms
+	Mime    string   `json:"mime,omitempty"`
+	Symlink bool     `json:"symlink,omitempty"`
+	Thumb   string   `json:"thumb,omitempty"` // Thumbnail URL of photos and videos
+	Share   string   `json:"share,omitempty"` // In virtual folders, which hold items of several shares
+	Tags    []string `json:"tags,omitempty"`
+	Starred bool     `json:"starred,omitempty"`
+}
+
+// FileOpRequest names files for rename, move, copy and delete. Move and
+// copy put Paths into the folder To of ToShare (Share when empty).
+type FileOpRequest struct {
+	Share      string   `json:"share"`
+	Paths      []string `json:"paths"`
+	ToShare    string   `json:"toShare,omitempty"`
+	To         string   `json:"to,omitempty"`
+	Name       string   `json:"name,omitempty"` // New name, for rename
+	Overwrite  bool     `json:"overwrite,omitempty"`
+	Permanent  bool     `json:"permanent,omitempty"`  // Delete without the recycle bin
+	Background bool     `json:"background,omitempty"` // Queue a job and answer with it
+}
+
+func loadFileShares() []models.FileShare {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	return sysConfig.Shares
+}
+
+// browseShares is every root of the file browser: the shares, then the
+// remote mounts that are up
+func browseShares() []models.FileShare {
+	shares := loadFileShares()
+	return append(shares, remoteMountShares(shares)...)
+}
+
+// findFileShare finds a share by name; "<share>@<snapshot>" is the share
+// as it was in a snapshot, read-only
+func findFileShare(name string) (models.FileShare, error) {
+	name, snapshot, inSnapshot := strings.Cut(name, "@")
+	for _, s := range browseShares() {
+		if s.Name == name {
+			if inSnapshot {
+				return snapshotShare(s, snapshot)
+			}
+			return s, nil
+		}
+	}
+	return models.FileShare{}, errShareNotFound
+}
+
+// decodeFileShares reads the "shares" field of a system config update. A
+// share sent without a path keeps its current one, as the browser never
+// sees paths.
+func decodeFileShares(raw interface{}, current []models.FileShare) ([]models.FileShare, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid shares")
+	}
+	var shares []models.FileShare
+	if err := json.Unmarshal(data, &shares); err != nil {
+		return nil, fmt.Errorf("Invalid shares")
+	}
+	seen := make(map[string]bool, len(shares))
+	for i := range shares {
+		s := &shares[i]
+		s.Name = strings.TrimSpace(s.Name)
+		s.Path = strings.TrimSpace(s.Path)
+		s.Remote = ""
+		if !shareNamePattern.MatchString(s.Name) {
+			return nil, fmt.Errorf("Invalid share name %q", s.Name)
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("Duplicate share name %q", s.Name)
+		}
+		seen[s.Name] = true
+		if s.Path == "" {
+			for _, c := range current {
+				if c.Name == s.Name {
+					s.Path = c.Path
+				}
+			}
+		}
+		if !filepath.IsAbs(s.Path) {
+			return nil, fmt.Errorf("Share %q needs an absolute path", s.Name)
+		}
+		s.Path = filepath.Clean(s.Path)
+		if info, err := os.Stat(s.Path); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("Share %q: folder not found", s.Name)
+		}
+	}
+	return shares, nil
+}
+
+// hiddenShareDir reports whether a folder in the root of a share is kept
+// out of the browser: the recycle bin, the file versions and the snapshot
+// folders
+func hiddenShareDir(name string) bool {
+	return name == trashDirName || name == versionsDirName || name == snapshotDirName || name == zfsControlDir
+}
+
+// cleanSharePath normalizes a client path to "a/b/c", "" being the root.
+// The recycle bin, version and snapshot folders are not reachable this way.
+func cleanSharePath(p string) (string, error) {
+	if strings.ContainsRune(p, 0) {
+		return "", errInvalidPath
+	}
+	p = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+	if hiddenShareDir(strings.SplitN(p, "/", 2)[0]) {
+		return "", errInvalidPath
+	}
+	return p, nil
+}
+
+// resolveSharePath maps a path inside a share to the host path with its
+// symlinks followed, so later calls cannot be led elsewhere by a link
+// swapped in meanwhile. The path need not exist, but its deepest existing
+// ancestor must, once resolved, still be inside the share.
+func resolveSharePath(share models.FileShare, p string) (string, error) {
+	rel, err := cleanSharePath(p)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(share.Path)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(share.Path, filepath.FromSlash(rel))
+	existing, rest := full, ""
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			resolved := filepath.Join(real, rest)
+			if !pathWithin(root, resolved) {
+				return "", errInvalidPath
+			}
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return "", errInvalidPath
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// resolveShareTarget resolves a path that is about to be created or
+// written. Its folder is resolved like resolveSharePath does, but the item
+// itself must not be a symlink, which the write would follow.
+func resolveShareTarget(share models.FileShare, p string) (string, error) {
+	rel, err := cleanSharePath(p)
+	if err != nil {
+		return "", err
+	}
+	if rel == "" {
+		return resolveSharePath(share, rel)
+	}
+	dir, err := resolveSharePath(share, path.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(dir, path.Base(rel))
+	if info, err := os.Lstat(full); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return "", errSymlinkLeaf
+	}
+	return full, nil
+}
+
+// hasSymlink reports whether p is or holds a symlink. Those stay in their
+// share: elsewhere they could point anywhere, and the file services of the
+// other share follow them.
+func hasSymlink(p string) bool {
+	found := false
+	_ = filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type()&fs.ModeSymlink != 0 {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// pathWithin reports whether p is root or inside it
+func pathWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+func fileEntry(dirRel string, info os.FileInfo) FileEntry {
+	e := FileEntry{
+		Name:    info.Name(),
+		Path:    path.Join(dirRel, info.Name()),
+		IsDir:   info.IsDir(),
+		ModTime: info.ModTime().UnixMilli(),
+		Symlink: info.Mode()&os.ModeSymlink != 0,
+	}
+	if !e.IsDir {
+		e.Size = info.Size()
+		e.Mime = fileMime(info.Name())
+	}
+	return e
+}
+
+// listEntry is the entry of the browser for a file in the folder dirRel
+// of share
+func listEntry(share models.FileShare, dirRel string, info os.FileInfo) FileEntry {
+	e := fileEntry(dirRel, info)
+	if e.Symlink {
+		// Show what the link points to when it stays inside the share
+		if target, err := resolveSharePath(share, e.Path); err == nil {
+			if st, err := os.Stat(target); err == nil {
+				e.IsDir, e.Size = st.IsDir(), 0
+				if !st.IsDir() {
+					e.Size = st.Size()
+				}
+			}
+		}
+	}
+	if !e.IsDir && thumbKind(e.Name) != "" {
+		e.Thumb = thumbURL(share.Name, e.Path)
+	}
+	return e
+}
+
+func fileMime(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if m := mediaTypes[ext]; m != "" {
+		return m
+	}
+	if m := mime.TypeByExtension(ext); m != "" {
+		return m
+	}
+	return "application/octet-stream"
+}
+
+// fileError answers with the status matching err
+func fileError(c *gin.Context, err error, p string) {
+	status := http.StatusInternalServerError
+	message := "File operation failed"
+	switch {
+	case errors.Is(err, errShareNotFound):
+		status, message = http.StatusNotFound, err.Error()
+	case errors.Is(err, errInvalidPath), errors.Is(err, errSymlinkLeaf), errors.Is(err, errSymlinkShare), errors.Is(err, errInsideItself),
+		errors.Is(err, errArchiveFormat), errors.Is(err, errArchiveEncrypted):
+		status, message = http.StatusBadRequest, err.Error()
+	case errors.Is(err, errShareReadOnly):
+		status, message = http.StatusForbidden, err.Error()
+	case errors.Is(err, errFileExists):
+		status, message = http.StatusConflict, err.Error()
+	case errors.Is(err, errQuotaExceeded):
+		status, message = http.StatusInsufficientStorage, err.Error()
+	case errors.Is(err, errArchiveTool):
+		status, message = http.StatusNotImplemented, err.Error()
+	case os.IsNotExist(err):
+		status, message = http.StatusNotFound, "File not found"
+	case os.IsPermission(err):
+		status, message = http.StatusForbidden, "Permission denied"
+	default:
+		filesLog.Error("File operation failed", "path", p, "error", err)
+	}
+	body := gin.H{"error": message}
+	if p != "" {
+		body["path"] = p
+	}
+	c.JSON(status, body)
+}
+
+// GetFileShares lists the shares and remote mounts; the admin also sees
+// their host paths
+func GetFileShares(c *gin.Context) {
+	shares := browseShares()
+	if c.GetString("username") != "admin" {
+		for i := range shares {
+			shares[i].Path = ""
+		}
+	}
+	if shares == nil {
+		shares = []models.FileShare{}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": shares})
+}
+
+// ListFiles lists a folder of a share, folders first
+func ListFiles(c *gin.Context) {
+	share, err := findFileShare(c.Query("share"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	rel, err := cleanSharePath(c.Query("path"))
+	if err != nil {
+		fileError(c, err, c.Query("path"))
+		return
+	}
+	dir, err := resolveSharePath(share, rel)
+	if err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	entries := make([]FileEntry, 0, len(items))
+	for _, item := range items {
+		if rel == "" && hiddenShareDir(item.Name()) {
+			continue
+		}
+		info, err := item.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, listEntry(share, rel, info))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name)
+	})
+	markEntries(c.GetString("username"), share.Name, rel, entries)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"share":    share.Name,
+		"path":     rel,
+		"readOnly": share.ReadOnly,
+		"entries":  entries,
+	}})
+}
+
+// bindFileOp reads a FileOpRequest for an operation on its share, which
+// must be writable when write is set
+func bindFileOp(c *gin.Context, write bool) (FileOpRequest, models.FileShare, bool) {
+	var req FileOpRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Paths) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return req, models.FileShare{}, false
+	}
+	share, err := findFileShare(req.Share)
+	if err == nil && write && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		fileError(c, err, "")
+		return req, share, false
+	}
+	c.Set("auditTarget", req.Share+":"+strings.Join(req.Paths, ","))
+	return req, share, true
+}
+
+// resolveFileItem resolves a path that must exist and not be the root.
+// Only its folder is resolved, so a symlink is handled as the link itself
+// wherever it points.
+func resolveFileItem(share models.FileShare, p string) (string, string, error) {
+	rel, err := cleanSharePath(p)
+	if err != nil {
+		return "", "", err
+	}
+	if rel == "" {
+		return "", "", errInvalidPath
+	}
+	dir, err := resolveSharePath(share, path.Dir(rel))
+	if err != nil {
+		return "", rel, err
+	}
+	full := filepath.Join(dir, path.Base(rel))
+	if _, err := os.Lstat(full); err != nil {
+		return "", rel, err
+	}
+	return full, rel, nil
+}
+
+// validFileName reports whether name is a single path element
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && len(name) <= 255 &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+// RenameFile renames one file or folder in place
+func RenameFile(c *gin.Context) {
+	req, share, ok := bindFileOp(c, true)
+	if !ok {
+		return
+	}
+	if len(req.Paths) != 1 || !validFileName(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+	src, rel, err := resolveFileItem(share, req.Paths[0])
+	if err != nil {
+		fileError(c, err, req.Paths[0])
+		return
+	}
+	newRel := path.Join(path.Dir(rel), req.Name)
+	dst, err := resolveShareTarget(share, newRel)
+	if err != nil {
+		fileError(c, err, newRel)
+		return
+	}
+	// A case-only rename is the same file on case-insensitive systems
+	if !strings.EqualFold(src, dst) {
+		if _, err := os.Lstat(dst); err == nil {
+			fileError(c, errFileExists, newRel)
+			return
+		}
+	}
+	if err := os.Rename(src, dst); err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	moveFileMarks(share.Name, rel, share.Name, newRel)
+	moveFileVersions(share.Name, rel, share.Name, newRel)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"path": newRel}})
+}
+
+// MoveFiles moves files into a folder, across shares if need be
+func MoveFiles(c *gin.Context) {
+	transferFiles(c, true)
+}
+
+// CopyFiles copies files and folders into a folder
+func CopyFiles(c *gin.Context) {
+	transferFiles(c, false)
+}
+
+// transferPlan is a move or copy checked against both shares. Its paths
+// are resolved again when it runs.
+type transferPlan struct {
+	Move      bool           `json:"move"`
+	Share     string         `json:"share"`
+	ToShare   string         `json:"toShare"`
+	Items     []transferItem `json:"items"`
+	Overwrite bool           `json:"overwrite,omitempty"`
+	Charged   int64          `json:"charged,omitempty"` // Bytes added to the quota of ToShare
+}
+
+type transferItem struct {
+	Path string `json:"path"` // In Share
+	To   string `json:"to"`   // In ToShare
+}
+
+// planTransfer checks a move or copy and picks the names in the target
+// folder. On error it also returns the path at fault.
+func planTransfer(req FileOpRequest, share models.FileShare, move bool) (transferPlan, string, error) {
+	plan := transferPlan{Move: move, Share: share.Name, ToShare: share.Name, Overwrite: req.Overwrite}
+	dstShare := share
+	var err error
+	if req.ToShare != "" && req.ToShare != req.Share {
+		dstShare, err = findFileShare(req.ToShare)
+	}
+	if err == nil && dstShare.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		return plan, "", err
+	}
+	plan.ToShare = dstShare.Name
+	toRel, err := cleanSharePath(req.To)
+	if err != nil {
+		return plan, req.To, err
+	}
+	toDir, err := resolveSharePath(dstShare, toRel)
+	if err != nil {
+		return plan, toRel, err
+	}
+	if info, err := os.Stat(toDir); err != nil || !info.IsDir() {
+		return plan, toRel, errInvalidPath
+	}
+	// A move within a share adds nothing to it
+	if (!move || dstShare.Name != share.Name) && quotaSettings().Shares[dstShare.Name] > 0 {
+		var size int64
+		for _, p := range req.Paths {
+			if src, _, err := resolveFileItem(share, p); err == nil {
+				size += pathSize(src)
+			}
+		}
+		if err := checkShareQuota(dstShare.Name, size); err != nil {
+			return plan, "", err
+		}
+		plan.Charged = size
+	}
+
+	for _, p := range req.Paths {
+		src, rel, err := resolveFileItem(share, p)
+		if err != nil {
+			return plan, p, err
+		}
+		if dstShare.Name != share.Name && hasSymlink(src) {
+			return plan, rel, errSymlinkShare
+		}
+		dstRel := path.Join(toRel, path.Base(rel))
+		dst, err := resolveShareTarget(dstShare, dstRel)
+		if err != nil {
+			return plan, dstRel, err
+		}
+		if src == dst && !move {
+			// Copying onto itself makes "name (copy)"
+			dstRel = path.Join(toRel, copyName(toDir, path.Base(rel)))
+			dst = filepath.Join(toDir, path.Base(dstRel))
+		}
+		if src != dst && pathWithin(src, dst) {
+			return plan, rel, errInsideItself
+		}
+		if _, err := os.Lstat(dst); err == nil && src != dst && !req.Overwrite {
+			return plan, dstRel, errFileExists
+		}
+		plan.Items = append(plan.Items, transferItem{Path: rel, To: dstRel})
+	}
+	return plan, "", nil
+}
+
+func transferFiles(c *gin.Context, move bool) {
+	// Copying only reads the source share
+	req, share, ok := bindFileOp(c, move)
+	if !ok {
+		return
+	}
+	plan, p, err := planTransfer(req, share, move)
+	if err != nil {
+		fileError(c, err, p)
+		return
+	}
+	if req.Background {
+		kind := "copy"
+		if move {
+			kind = "move"
+		}
+		startFileJob(c, kind, plan)
+		return
+	}
+	dstShare, err := findFileShare(plan.ToShare)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+
+	done := make([]string, 0, len(plan.Items))
+	for _, item := range plan.Items {
+		src, rel, err := resolveFileItem(share, item.Path)
+		if err != nil {
+			fileError(c, err, item.Path)
+			return
+		}
+		dst, err := resolveShareTarget(dstShare, item.To)
+		if err != nil {
+			fileError(c, err, item.To)
+			return
+		}
+		if src == dst {
+			done = append(done, item.To)
+			continue
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			if err := os.RemoveAll(dst); err != nil {
+				fileError(c, err, item.To)
+				return
+			}
+		}
+		if move {
+			err = movePath(src, dst)
+		} else {
+			err = copyPath(src, dst)
+		}
+		if err != nil {
+			fileError(c, err, rel)
+			return
+		}
+		done = append(done, item.To)
+	}
+	finishTransfer(plan)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"paths": done}})
+}
+
+// finishTransfer updates the quotas once a transfer is done, and makes
+// the marks and versions of moved items follow them
+func finishTransfer(plan transferPlan) {
+	if plan.Move {
+		for _, item := range plan.Items {
+			moveFileMarks(plan.Share, item.Path, plan.ToShare, item.To)
+			moveFileVersions(plan.Share, item.Path, plan.ToShare, item.To)
+		}
+	}
+	if plan.Charged > 0 {
+		chargeShareQuota(plan.ToShare, plan.Charged)
+	}
+	if plan.Move && plan.ToShare != plan.Share {
+		markQuotaStale(plan.Share)
+	}
+}
+
+// DeleteFiles moves files and folders to the recycle bin, or removes them
+// with their contents when permanent is set
+func DeleteFiles(c *gin.Context) {
+	req, share, ok := bindFileOp(c, true)
+	if !ok {
+		return
+	}
+	if req.Background {
+		plan := deletePlan{Share: share.Name, Permanent: req.Permanent, User: c.GetString("username")}
+		for _, p := range req.Paths {
+			_, rel, err := resolveFileItem(share, p)
+			if err != nil {
+				fileError(c, err, p)
+				return
+			}
+			plan.Paths = append(plan.Paths, rel)
+		}
+		startFileJob(c, "delete", plan)
+		return
+	}
+	for _, p := range req.Paths {
+		full, rel, err := resolveFileItem(share, p)
+		if err != nil {
+			fileError(c, err, p)
+			return
+		}
+		if req.Permanent {
+			err = os.RemoveAll(full)
+		} else {
+			err = moveToTrash(share, full, rel, c.GetString("username"))
+		}
+		if err != nil {
+			fileError(c, err, rel)
+			return
+		}
+		dropFileMarks(share.Name, rel)
+	}
+	if req.Permanent {
+		markQuotaStale(share.Name)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// copyName picks "name (copy).ext", "name (copy 2).ext", ... free in dir
+func copyName(dir, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		suffix := " (copy)"
+		if i > 1 {
+			suffix = fmt.Sprintf(" (copy %d)", i)
+		}
+		candidate := base + suffix + ext
+		if _, err := os.Lstat(filepath.Join(dir, candidate)); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// movePath renames, falling back to copy and delete across file systems
+func movePath(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyPath(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyPath copies a file, symlink or folder tree, keeping modes and
+// modification times. Symlinks are copied as links, not followed.
+func copyPath(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case info.IsDir():
+		if err := os.Mkdir(dst, info.Mode().Perm()|0700); err != nil {
+			return err
+		}
+		items, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := copyPath(filepath.Join(src, item.Name()), filepath.Join(dst, item.Name())); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		if err := copyFile(src, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	default:
+		// Devices, sockets and pipes are skipped
+		return nil
+	}
+	return os.Chtimes(dst, time.Now(), info.ModTime())
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
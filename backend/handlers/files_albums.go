@@ -0,0 +1,729 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/store"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Albums gather photos for a user. Manual albums hold the photos added to
+// them; folder, date, place and person albums are rules over the photos
+// of the search index, so they fill themselves as photos arrive. The
+// people on photos are names set through the API, by hand or by a face
+// recognition plugin; FlatNas does not recognize faces itself.
+
+const (
+	maxAlbumName        = 100
+	maxAlbumBatch       = 1000
+	galleryDefaultLimit = 100
+	galleryMaxLimit     = 500
+)
+
+var albumKinds = map[string]bool{"manual": true, "folder": true, "date": true, "place": true, "person": true}
+
+var (
+	errAlbumsUnavailable = errors.New("Albums need the database")
+	errInvalidAlbum      = errors.New("Invalid album")
+	errAlbumNotManual    = errors.New("Photos are only added to manual albums")
+)
+
+// AlbumRule picks the photos of an album that is not manual: a folder of
+// a share, a range of days, a box of the map or a person
+type AlbumRule struct {
+	Share  string    `json:"share,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	From   string    `json:"from,omitempty"` // YYYY-MM-DD
+	To     string    `json:"to,omitempty"`
+	BBox   []float64 `json:"bbox,omitempty"` // South, west, north, east
+	Person string    `json:"person,omitempty"`
+}
+
+// PhotoRef names a photo
+type PhotoRef struct {
+	Share string `json:"share"`
+	Path  string `json:"path"`
+}
+
+// AlbumRequest creates an album, or renames it and changes its rule and
+// cover; updates keep a rule or cover left out. Without a cover, or with
+// an empty one, the newest photo is shown.
+type AlbumRequest struct {
+	Name  string     `json:"name"`
+	Kind  string     `json:"kind"` // Ignored on updates
+	Rule  *AlbumRule `json:"rule,omitempty"`
+	Cover *PhotoRef  `json:"cover,omitempty"`
+}
+
+// AlbumItemsRequest adds photos of a share to a manual album, or takes
+// them out
+type AlbumItemsRequest struct {
+	Share  string   `json:"share"`
+	Paths  []string `json:"paths"`
+	Remove bool     `json:"remove,omitempty"`
+}
+
+// PhotoPeopleRequest replaces the people on a photo
+type PhotoPeopleRequest struct {
+	Share  string   `json:"share"`
+	Path   string   `json:"path"`
+	People []string `json:"people"`
+}
+
+// PhotoAlbum is an album with its number of photos and cover
+type PhotoAlbum struct {
+	ID      int64      `json:"id,omitempty"` // 0 for the albums made on the fly
+	Name    string     `json:"name"`
+	Kind    string     `json:"kind"`
+	Rule    *AlbumRule `json:"rule,omitempty"`
+	Count   int        `json:"count"`
+	Cover   *PhotoItem `json:"cover,omitempty"`
+	Created int64      `json:"created,omitempty"`
+	Updated int64      `json:"updated,omitempty"`
+}
+
+// PersonGroup is a person with the number of photos they are on
+type PersonGroup struct {
+	Person string     `json:"person"`
+	Count  int        `json:"count"`
+	Cover  *PhotoItem `json:"cover,omitempty"`
+}
+
+// matches tells whether a photo is picked by the rule; Person is matched
+// by the store
+func (r *AlbumRule) matches(p PhotoItem) bool {
+	if r.Share != "" && (p.Share != r.Share || (r.Path != "" && !strings.HasPrefix(p.Path, r.Path+"/"))) {
+		return false
+	}
+	if r.From != "" || r.To != "" {
+		day := photoDay(p)
+		if (r.From != "" && day < r.From) || (r.To != "" && day > r.To) {
+			return false
+		}
+	}
+	if r.BBox != nil && (p.Lat == nil || p.Lon == nil || !inBBox(r.BBox, *p.Lat, *p.Lon)) {
+		return false
+	}
+	return true
+}
+
+// cleanAlbumRule checks that rule fits an album of kind and keeps only
+// what that kind uses
+func cleanAlbumRule(kind string, rule *AlbumRule) (*AlbumRule, error) {
+	if kind == "manual" {
+		return nil, nil
+	}
+	if rule == nil {
+		return nil, errInvalidAlbum
+	}
+	out := &AlbumRule{}
+	switch kind {
+	case "folder":
+		share, err := findFileShare(rule.Share)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := cleanSharePath(rule.Path)
+		if err != nil {
+			return nil, err
+		}
+		out.Share, out.Path = share.Name, rel
+	case "date":
+		for _, day := range []string{rule.From, rule.To} {
+			if _, err := time.Parse(photoDayLayout, day); day != "" && err != nil {
+				return nil, errInvalidAlbum
+			}
+		}
+		if (rule.From == "" && rule.To == "") || (rule.From != "" && rule.To != "" && rule.From > rule.To) {
+			return nil, errInvalidAlbum
+		}
+		out.From, out.To = rule.From, rule.To
+	case "place":
+		b := rule.BBox
+		if len(b) != 4 || b[0] > b[2] || b[0] < -90 || b[2] > 90 || math.Abs(b[1]) > 180 || math.Abs(b[3]) > 180 {
+			return nil, errInvalidAlbum
+		}
+		out.BBox = b
+	case "person":
+		people, ok := cleanFileTags([]string{rule.Person})
+		if !ok || len(people) != 1 {
+			return nil, errInvalidAlbum
+		}
+		out.Person = people[0]
+	}
+	return out, nil
+}
+
+// albumError answers for errors of the album handlers
+func albumError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errInvalidAlbum):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errAlbumNotManual):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+	default:
+		fileError(c, err, "")
+	}
+}
+
+// photoLibrary reads the indexed photos once for a request
+type photoLibrary struct {
+	photos []PhotoItem
+	byRef  map[PhotoRef]int
+}
+
+func (l *photoLibrary) all() []PhotoItem {
+	if l.byRef == nil {
+		l.photos = indexedPhotos(loadFileShares(), "")
+		l.byRef = make(map[PhotoRef]int, len(l.photos))
+		for i, p := range l.photos {
+			l.byRef[PhotoRef{p.Share, p.Path}] = i
+		}
+	}
+	return l.photos
+}
+
+// find returns the photos refs name, newest first. The index gives their
+// metadata; files it has not seen yet are read, and missing ones left out.
+func (l *photoLibrary) find(refs []store.PhotoRef) []PhotoItem {
+	l.all()
+	photos := []PhotoItem{}
+	for _, ref := range refs {
+		if i, ok := l.byRef[PhotoRef{ref.Share, ref.Path}]; ok {
+			photos = append(photos, l.photos[i])
+			continue
+		}
+		share, err := findFileShare(ref.Share)
+		if err != nil {
+			continue
+		}
+		full, rel, err := resolveFileItem(share, ref.Path)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(full)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		m, _ := readPhotoMeta(full)
+		photos = append(photos, newPhotoItem(share.Name, rel, info.Size(), info.ModTime().UnixMilli(), m))
+	}
+	sortPhotos(photos)
+	return photos
+}
+
+// albumPhotos lists the photos of an album, newest first
+func (l *photoLibrary) albumPhotos(a store.Album) ([]PhotoItem, error) {
+	var rule AlbumRule
+	if a.Rule != "" {
+		if err := json.Unmarshal([]byte(a.Rule), &rule); err != nil {
+			return nil, err
+		}
+	}
+	switch a.Kind {
+	case "manual":
+		refs, err := config.Store.AlbumItems(a.ID)
+		if err != nil {
+			return nil, err
+		}
+		return l.find(refs), nil
+	case "person":
+		return l.personPhotos(rule.Person)
+	}
+	return l.rulePhotos(&rule), nil
+}
+
+func (l *photoLibrary) personPhotos(person string) ([]PhotoItem, error) {
+	refs, err := config.Store.PersonPhotos(person)
+	if err != nil {
+		return nil, err
+	}
+	return l.find(refs), nil
+}
+
+func (l *photoLibrary) rulePhotos(rule *AlbumRule) []PhotoItem {
+	photos := []PhotoItem{}
+	for _, p := range l.all() {
+		if rule.matches(p) {
+			photos = append(photos, p)
+		}
+	}
+	return photos
+}
+
+// albumCover is the chosen cover when it is still in the album, else the
+// newest photo
+func albumCover(a store.Album, photos []PhotoItem) *PhotoItem {
+	for i := range photos {
+		if photos[i].Share == a.CoverShare && photos[i].Path == a.CoverPath {
+			return &photos[i]
+		}
+	}
+	if len(photos) == 0 {
+		return nil
+	}
+	return &photos[0]
+}
+
+// describeAlbum fills in the number of photos and the cover of an album
+func (l *photoLibrary) describeAlbum(a store.Album) (PhotoAlbum, error) {
+	out := PhotoAlbum{ID: a.ID, Name: a.Name, Kind: a.Kind, Created: a.Created, Updated: a.Updated}
+	if a.Rule != "" {
+		out.Rule = &AlbumRule{}
+		if err := json.Unmarshal([]byte(a.Rule), out.Rule); err != nil {
+			return out, err
+		}
+	}
+	photos, err := l.albumPhotos(a)
+	if err != nil {
+		return out, err
+	}
+	out.Count, out.Cover = len(photos), albumCover(a, photos)
+	return out, nil
+}
+
+// userAlbum loads an album of the user by its ID
+func userAlbum(c *gin.Context, albumID string) (store.Album, bool) {
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errAlbumsUnavailable.Error()})
+		return store.Album{}, false
+	}
+	id, err := strconv.ParseInt(albumID, 10, 64)
+	if err != nil {
+		albumError(c, os.ErrNotExist)
+		return store.Album{}, false
+	}
+	a, err := config.Store.Album(c.GetString("username"), id)
+	if err != nil {
+		albumError(c, err)
+		return a, false
+	}
+	return a, true
+}
+
+// applyAlbumRequest checks a create or update request and sets it on a.
+// On updates a rule or cover left out is kept.
+func applyAlbumRequest(a *store.Album, req AlbumRequest, update bool) error {
+	a.Name = strings.TrimSpace(req.Name)
+	if a.Name == "" || len([]rune(a.Name)) > maxAlbumName || !albumKinds[a.Kind] {
+		return errInvalidAlbum
+	}
+	if !update || req.Rule != nil {
+		rule, err := cleanAlbumRule(a.Kind, req.Rule)
+		if err != nil {
+			return err
+		}
+		a.Rule = ""
+		if rule != nil {
+			data, _ := json.Marshal(rule)
+			a.Rule = string(data)
+		}
+	}
+	switch {
+	case req.Cover == nil && update:
+	case req.Cover == nil || req.Cover.Share == "":
+		a.CoverShare, a.CoverPath = "", ""
+	default:
+		rel, err := cleanSharePath(req.Cover.Path)
+		if err != nil || rel == "" {
+			return errInvalidAlbum
+		}
+		a.CoverShare, a.CoverPath = req.Cover.Share, rel
+	}
+	return nil
+}
+
+// ListAlbums lists the albums of the user with their covers
+func ListAlbums(c *gin.Context) {
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errAlbumsUnavailable.Error()})
+		return
+	}
+	albums, err := config.Store.Albums(c.GetString("username"))
+	if err != nil {
+		albumError(c, err)
+		return
+	}
+	lib := &photoLibrary{}
+	out := make([]PhotoAlbum, 0, len(albums))
+	for _, a := range albums {
+		described, err := lib.describeAlbum(a)
+		if err != nil {
+			filesLog.Warn("Failed to load album", "album", a.ID, "error", err)
+		}
+		out = append(out, described)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"albums": out, "indexed": searchEnabled()}})
+}
+
+// CreateAlbum adds an album for the user
+func CreateAlbum(c *gin.Context) {
+	var req AlbumRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errAlbumsUnavailable.Error()})
+		return
+	}
+	a := store.Album{User: c.GetString("username"), Kind: req.Kind}
+	if err := applyAlbumRequest(&a, req, false); err != nil {
+		albumError(c, err)
+		return
+	}
+	a, err := config.Store.CreateAlbum(a)
+	if err != nil {
+		albumError(c, err)
+		return
+	}
+	out, err := (&photoLibrary{}).describeAlbum(a)
+	if err != nil {
+		albumError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": out})
+}
+
+// UpdateAlbum renames an album, changes its rule or picks its cover
+func UpdateAlbum(c *gin.Context) {
+	var req AlbumRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	a, ok := userAlbum(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if err := applyAlbumRequest(&a, req, true); err != nil {
+		albumError(c, err)
+		return
+	}
+	if err := config.Store.UpdateAlbum(a); err != nil {
+		albumError(c, err)
+		return
+	}
+	a, _ = config.Store.Album(a.User, a.ID)
+	out, err := (&photoLibrary{}).describeAlbum(a)
+	if err != nil {
+		albumError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": out})
+}
+
+// DeleteAlbum drops an album; its photos stay where they are
+func DeleteAlbum(c *gin.Context) {
+	a, ok := userAlbum(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if err := config.Store.DeleteAlbum(a.User, a.ID); err != nil {
+		albumError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// SetAlbumItems adds photos to a manual album, or takes them out
+func SetAlbumItems(c *gin.Context) {
+	var req AlbumItemsRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Paths) == 0 || len(req.Paths) > maxAlbumBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	a, ok := userAlbum(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if a.Kind != "manual" {
+		albumError(c, errAlbumNotManual)
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	refs := make([]store.PhotoRef, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		var full, rel string
+		if req.Remove {
+			// A photo can be taken out of an album once it is gone
+			rel, err = cleanSharePath(p)
+		} else {
+			full, rel, err = resolveFileItem(share, p)
+			if err == nil && thumbKind(rel) != "image" {
+				err = errInvalidPath
+			}
+			if err == nil {
+				var info os.FileInfo
+				if info, err = os.Stat(full); err == nil && info.IsDir() {
+					err = errInvalidPath
+				}
+			}
+		}
+		if err != nil {
+			fileError(c, err, p)
+			return
+		}
+		refs = append(refs, store.PhotoRef{Share: share.Name, Path: rel})
+	}
+	if err := config.Store.AddAlbumItems(a.ID, refs, req.Remove); err != nil {
+		albumError(c, err)
+		return
+	}
+	a, _ = config.Store.Album(a.User, a.ID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"count": a.Items}})
+}
+
+// GetAutoAlbums groups the indexed photos on the fly by=folder, month,
+// year or place (on a grid of cell degrees). Each group has the rule of
+// an album that can be saved or opened in the gallery.
+func GetAutoAlbums(c *gin.Context) {
+	by := c.DefaultQuery("by", "folder")
+	cell, err := strconv.ParseFloat(c.DefaultQuery("cell", strconv.FormatFloat(photoDefaultCell, 'f', -1, 64)), 64)
+	switch by {
+	case "folder", "month", "year", "place":
+	default:
+		err = errInvalidAlbum
+	}
+	if err != nil || cell < photoMinCellDegrees || cell > 90 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	groups := make(map[string]*PhotoAlbum)
+	var order []string
+	for _, p := range indexedPhotos(loadFileShares(), "") {
+		var key string
+		var album PhotoAlbum
+		switch by {
+		case "folder":
+			dir := path.Dir(p.Path)
+			if dir == "." {
+				dir = ""
+			}
+			key = p.Share + "\x00" + dir
+			album = PhotoAlbum{Name: path.Base(dir), Kind: "folder", Rule: &AlbumRule{Share: p.Share, Path: dir}}
+			if dir == "" {
+				album.Name = p.Share
+			}
+		case "month", "year":
+			start, err := time.Parse(photoDayLayout, photoDay(p))
+			if err != nil {
+				continue
+			}
+			end := start.AddDate(0, 1, -start.Day())
+			key = start.Format("2006-01")
+			if by == "year" {
+				start, end = time.Date(start.Year(), 1, 1, 0, 0, 0, 0, time.UTC), time.Date(start.Year(), 12, 31, 0, 0, 0, 0, time.UTC)
+				key = start.Format("2006")
+			} else {
+				start = start.AddDate(0, 0, 1-start.Day())
+			}
+			album = PhotoAlbum{Name: key, Kind: "date", Rule: &AlbumRule{From: start.Format(photoDayLayout), To: end.Format(photoDayLayout)}}
+		default:
+			if p.Lat == nil || p.Lon == nil {
+				continue
+			}
+			lat, lon := math.Floor(*p.Lat/cell)*cell, math.Floor(*p.Lon/cell)*cell
+			key = fmt.Sprintf("%g,%g", lat, lon)
+			album = PhotoAlbum{Name: fmt.Sprintf("%.4g, %.4g", lat+cell/2, lon+cell/2), Kind: "place",
+				Rule: &AlbumRule{BBox: []float64{lat, lon, math.Min(lat+cell, 90), math.Min(lon+cell, 180)}}}
+		}
+		g := groups[key]
+		if g == nil {
+			// Photos come newest first, so the first is the cover
+			cover := p
+			album.Cover = &cover
+			g = &album
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.Count++
+	}
+	out := make([]PhotoAlbum, 0, len(order))
+	for _, key := range order {
+		out = append(out, *groups[key])
+	}
+	switch by {
+	case "folder":
+		sort.SliceStable(out, func(i, j int) bool {
+			if out[i].Rule.Share != out[j].Rule.Share {
+				return out[i].Rule.Share < out[j].Rule.Share
+			}
+			return out[i].Rule.Path < out[j].Rule.Path
+		})
+	case "place":
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"albums": out, "indexed": searchEnabled()}})
+}
+
+// GetPhotoGallery pages through the photos of an album, newest first:
+// a saved one with album=<id>, or one made on the fly from the query with
+// share and path, from and to, bbox or person. offset and limit (100) pick
+// the page; the thumbnails of the page are made in the background.
+func GetPhotoGallery(c *gin.Context) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, lerr := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(galleryDefaultLimit)))
+	if err != nil || lerr != nil || offset < 0 || limit < 1 || limit > galleryMaxLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	lib := &photoLibrary{}
+	var photos []PhotoItem
+	switch {
+	case c.Query("album") != "":
+		a, ok := userAlbum(c, c.Query("album"))
+		if !ok {
+			return
+		}
+		if photos, err = lib.albumPhotos(a); err != nil {
+			albumError(c, err)
+			return
+		}
+	case c.Query("person") != "":
+		if config.Store == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": errAlbumsUnavailable.Error()})
+			return
+		}
+		if photos, err = lib.personPhotos(c.Query("person")); err != nil {
+			albumError(c, err)
+			return
+		}
+	default:
+		bbox, ok := parseBBox(c.Query("bbox"))
+		rule := &AlbumRule{From: c.Query("from"), To: c.Query("to"), BBox: bbox}
+		for _, day := range []string{rule.From, rule.To} {
+			if _, err := time.Parse(photoDayLayout, day); day != "" && err != nil {
+				ok = false
+			}
+		}
+		if c.Query("share") != "" {
+			folder, err := cleanAlbumRule("folder", &AlbumRule{Share: c.Query("share"), Path: c.Query("path")})
+			if err != nil {
+				albumError(c, err)
+				return
+			}
+			rule.Share, rule.Path = folder.Share, folder.Path
+		} else if c.Query("path") != "" {
+			ok = false
+		}
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		photos = lib.rulePhotos(rule)
+	}
+
+	total := len(photos)
+	page := photos[min(offset, total):min(offset+limit, total)]
+	next := 0
+	if offset+limit < total {
+		next = offset + limit
+	}
+	byShare := make(map[string][]string)
+	var shareOrder []string
+	for _, p := range page {
+		if byShare[p.Share] == nil {
+			shareOrder = append(shareOrder, p.Share)
+		}
+		byShare[p.Share] = append(byShare[p.Share], p.Path)
+	}
+	for _, name := range shareOrder {
+		if config.Store != nil {
+			people, err := config.Store.PhotoPeople(name)
+			if err != nil {
+				filesLog.Warn("Failed to load the people on photos", "share", name, "error", err)
+			}
+			for i := range page {
+				if page[i].Share == name {
+					page[i].People = people[page[i].Path]
+				}
+			}
+		}
+		if share, err := findFileShare(name); err == nil {
+			prefetchThumbs(share, byShare[name])
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"photos":  page,
+		"total":   total,
+		"offset":  offset,
+		"next":    next,
+		"indexed": searchEnabled(),
+	}})
+}
+
+// GetPhotoPeople lists the people set on photos, with how many photos
+// they are on and the newest of them
+func GetPhotoPeople(c *gin.Context) {
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errAlbumsUnavailable.Error()})
+		return
+	}
+	people, err := config.Store.People()
+	if err != nil {
+		albumError(c, err)
+		return
+	}
+	lib := &photoLibrary{}
+	out := make([]PersonGroup, 0, len(people))
+	for _, p := range people {
+		g := PersonGroup{Person: p.Person, Count: p.Count}
+		if photos, err := lib.personPhotos(p.Person); err == nil && len(photos) > 0 {
+			g.Cover = &photos[0]
+		}
+		out = append(out, g)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": out})
+}
+
+// SetPhotoPeople replaces the people on a photo. Face recognition plugins
+// call it with an API token to feed person albums.
+func SetPhotoPeople(c *gin.Context) {
+	var req PhotoPeopleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	people, ok := cleanFileTags(req.People)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid people"})
+		return
+	}
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errAlbumsUnavailable.Error()})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	_, rel, err := resolveFileItem(share, req.Path)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	if err := config.Store.SetPhotoPeople(store.PhotoRef{Share: share.Name, Path: rel}, people); err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"path": rel, "people": people}})
+}
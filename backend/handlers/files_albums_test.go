@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPhotoAlbums(t *testing.T) {
+	useTestConfig(t)
+	useTestJobs(t)
+	t.Cleanup(closeSearchIndexes)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "paris"), 0755)
+	os.MkdirAll(filepath.Join(root, "sydney"), 0755)
+	os.WriteFile(filepath.Join(root, "paris", "a.jpg"), exifJpeg("2024:05:01 09:30:00", "Pixel 8", 48.8584, 2.2945), 0644)
+	os.WriteFile(filepath.Join(root, "paris", "b.jpg"), exifJpeg("2024:05:02 18:00:00", "Pixel 8", 48.86, 2.35), 0644)
+	os.WriteFile(filepath.Join(root, "sydney", "c.jpg"), exifJpeg("2024:07:03 12:00:00", "X100V", -33.8568, 151.2153), 0644)
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("x"), 0644)
+	share := models.FileShare{Name: "main", Path: root}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{share}, EnableSearchIndex: true})
+	if err := indexShare(context.Background(), share); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	// Photos added after indexing are read from the file
+	os.WriteFile(filepath.Join(root, "sydney", "d.jpg"), exifJpeg("2024:07:04 08:00:00", "X100V", -33.87, 151.21), 0644)
+
+	router := func(user string) *gin.Engine {
+		r := gin.New()
+		r.Use(func(c *gin.Context) { c.Set("username", user) })
+		r.GET("/gallery", GetPhotoGallery)
+		r.GET("/auto", GetAutoAlbums)
+		r.GET("/albums", ListAlbums)
+		r.POST("/albums", CreateAlbum)
+		r.PUT("/albums/:id", UpdateAlbum)
+		r.DELETE("/albums/:id", DeleteAlbum)
+		r.POST("/albums/:id/items", SetAlbumItems)
+		r.GET("/people", GetPhotoPeople)
+		r.PUT("/people", SetPhotoPeople)
+		r.POST("/rename", RenameFile)
+		return r
+	}
+	r := router("alice")
+	create := func(body string) PhotoAlbum {
+		t.Helper()
+		w := serve(r, "POST", "/albums", body)
+		if w.Code != 200 {
+			t.Fatalf("create %s: %d %s", body, w.Code, w.Body.String())
+		}
+		var resp struct{ Data PhotoAlbum }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Data
+	}
+	gallery := func(query string) (string, int, int) {
+		t.Helper()
+		w := serve(r, "GET", "/gallery?"+query, "")
+		if w.Code != 200 {
+			t.Fatalf("gallery %s: %d %s", query, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Data struct {
+				Photos      []PhotoItem
+				Total, Next int
+			}
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		var names []string
+		for _, p := range resp.Data.Photos {
+			name := p.Name
+			if len(p.People) > 0 {
+				name += "(" + strings.Join(p.People, ",") + ")"
+			}
+			names = append(names, name)
+		}
+		return strings.Join(names, " "), resp.Data.Total, resp.Data.Next
+	}
+
+	// Manual albums hold what is added to them
+	trip := create(`{"name":"Trip","kind":"manual"}`)
+	if w := serve(r, "POST", fmt.Sprintf("/albums/%d/items", trip.ID), `{"share":"main","paths":["paris/a.jpg","sydney/d.jpg"]}`); w.Code != 200 || !strings.Contains(w.Body.String(), `"count":2`) {
+		t.Fatalf("add items: %d %s", w.Code, w.Body.String())
+	}
+	for body, status := range map[string]int{
+		`{"share":"main","paths":["notes.txt"]}`: 400,
+		`{"share":"main","paths":["paris"]}`:     400,
+		`{"share":"main","paths":["none.jpg"]}`:  404,
+		`{"share":"main","paths":[]}`:            400,
+	} {
+		if w := serve(r, "POST", fmt.Sprintf("/albums/%d/items", trip.ID), body); w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", body, status, w.Code)
+		}
+	}
+	if got, total, _ := gallery(fmt.Sprintf("album=%d", trip.ID)); got != "d.jpg a.jpg" || total != 2 {
+		t.Fatalf("unexpected manual album %q %d", got, total)
+	}
+
+	// Rule albums fill themselves, and pages follow each other
+	paris := create(`{"name":"Paris","kind":"folder","rule":{"share":"main","path":"paris"}}`)
+	if paris.Count != 2 || paris.Cover == nil || paris.Cover.Name != "b.jpg" {
+		t.Fatalf("unexpected folder album %+v", paris)
+	}
+	may := create(`{"name":"May","kind":"date","rule":{"from":"2024-05-01","to":"2024-05-31"}}`)
+	if may.Count != 2 {
+		t.Fatalf("unexpected date album %+v", may)
+	}
+	if place := create(`{"name":"Sydney","kind":"place","rule":{"bbox":[-34,151,-33,152]}}`); place.Count != 1 || place.Cover.Name != "c.jpg" {
+		t.Fatalf("unexpected place album %+v", place)
+	}
+	if got, total, next := gallery(fmt.Sprintf("album=%d&limit=1", paris.ID)); got != "b.jpg" || total != 2 || next != 1 {
+		t.Fatalf("unexpected first page %q %d %d", got, total, next)
+	}
+	if got, _, next := gallery(fmt.Sprintf("album=%d&limit=1&offset=1", paris.ID)); got != "a.jpg" || next != 0 {
+		t.Fatalf("unexpected last page %q %d", got, next)
+	}
+	if got, _, _ := gallery("share=main&path=sydney"); got != "c.jpg" {
+		t.Fatalf("unexpected folder gallery %q", got)
+	}
+	for body, status := range map[string]int{
+		`{"name":"","kind":"manual"}`: 400,
+		`{"name":"x","kind":"smart"}`: 400,
+		`{"name":"x","kind":"date","rule":{"from":"2024-06-01","to":"2024-05-01"}}`: 400,
+		`{"name":"x","kind":"place","rule":{"bbox":[1,2,3]}}`:                       400,
+		`{"name":"x","kind":"folder","rule":{"share":"nope"}}`:                      404,
+	} {
+		if w := serve(r, "POST", "/albums", body); w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", body, status, w.Code)
+		}
+	}
+
+	// The cover can be chosen, and falls back to the newest photo
+	if w := serve(r, "PUT", fmt.Sprintf("/albums/%d", paris.ID), `{"name":"Paris 2024","cover":{"share":"main","path":"paris/a.jpg"}}`); w.Code != 200 || !strings.Contains(w.Body.String(), `"name":"Paris 2024"`) || !strings.Contains(w.Body.String(), `"cover":{"share":"main","path":"paris/a.jpg"`) {
+		t.Fatalf("update: %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(r, "POST", fmt.Sprintf("/albums/%d/items", paris.ID), `{"share":"main","paths":["paris/a.jpg"]}`); w.Code != 409 {
+		t.Fatalf("expected 409 adding to a folder album, got %d", w.Code)
+	}
+	if w := serve(r, "PUT", fmt.Sprintf("/albums/%d", paris.ID), `{"name":"Paris 2024","cover":{}}`); !strings.Contains(w.Body.String(), `"path":"paris/b.jpg"`) {
+		t.Fatalf("expected the newest photo as cover: %s", w.Body.String())
+	}
+
+	// Auto albums group by folder, month and place
+	auto := func(by string) string {
+		w := serve(r, "GET", "/auto?by="+by, "")
+		var resp struct {
+			Data struct{ Albums []PhotoAlbum }
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		var out []string
+		for _, a := range resp.Data.Albums {
+			out = append(out, fmt.Sprintf("%s:%d:%s", a.Name, a.Count, a.Cover.Name))
+		}
+		return strings.Join(out, " ")
+	}
+	if got := auto("folder"); got != "paris:2:b.jpg sydney:1:c.jpg" {
+		t.Fatalf("unexpected folder albums %q", got)
+	}
+	if got := auto("month"); got != "2024-07:1:c.jpg 2024-05:2:b.jpg" {
+		t.Fatalf("unexpected month albums %q", got)
+	}
+	if got := auto("place"); got != "48.5, 2.5:2:b.jpg -33.5, 151.5:1:c.jpg" {
+		t.Fatalf("unexpected place albums %q", got)
+	}
+
+	// People come through the API and make person albums
+	serve(r, "PUT", "/people", `{"share":"main","path":"paris/a.jpg","people":["Ana","Ben"]}`)
+	serve(r, "PUT", "/people", `{"share":"main","path":"sydney/d.jpg","people":["ana"]}`)
+	if w := serve(r, "GET", "/people", ""); !strings.Contains(w.Body.String(), `"person":"Ana","count":2`) || !strings.Contains(w.Body.String(), `"person":"Ben","count":1`) {
+		t.Fatalf("unexpected people %s", w.Body.String())
+	}
+	if got, _, _ := gallery("person=ANA"); got != "d.jpg(ana) a.jpg(Ana,Ben)" {
+		t.Fatalf("unexpected person gallery %q", got)
+	}
+	if ana := create(`{"name":"Ana","kind":"person","rule":{"person":"Ana"}}`); ana.Count != 2 {
+		t.Fatalf("unexpected person album %+v", ana)
+	}
+
+	// Albums follow renames, and are each user's own
+	serve(r, "POST", "/rename", `{"share":"main","paths":["paris"],"name":"france"}`)
+	if got, _, _ := gallery(fmt.Sprintf("album=%d", trip.ID)); got != "d.jpg(ana) a.jpg(Ana,Ben)" {
+		t.Fatalf("the manual album lost the renamed photo: %q", got)
+	}
+	if w := serve(router("bob"), "GET", fmt.Sprintf("/gallery?album=%d", trip.ID), ""); w.Code != 404 {
+		t.Fatalf("expected 404 for another user's album, got %d", w.Code)
+	}
+	if w := serve(router("bob"), "DELETE", fmt.Sprintf("/albums/%d", trip.ID), ""); w.Code != 404 {
+		t.Fatalf("expected 404 deleting another user's album, got %d", w.Code)
+	}
+	if w := serve(r, "DELETE", fmt.Sprintf("/albums/%d", trip.ID), ""); w.Code != 200 {
+		t.Fatalf("delete: %d", w.Code)
+	}
+	if w := serve(r, "GET", "/albums", ""); strings.Contains(w.Body.String(), `"Trip"`) || !strings.Contains(w.Body.String(), `"Paris 2024"`) {
+		t.Fatalf("unexpected albums after delete %s", w.Body.String())
+	}
+}
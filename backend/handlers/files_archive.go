@@ -0,0 +1,927 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flatnasgo-backend/models"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// Archives are extracted and made on the server, as jobs of the queue.
+// ZIP and tar (plain or gzipped) are read and written here; 7z and RAR are
+// extracted by 7-Zip or bsdtar, when installed, into a staging folder next
+// to the target and moved into place from there. Either way every entry
+// goes through the same checks: names are cleaned and resolved inside the
+// target share, links, devices and entries under the share's hidden
+// folders are left out. An entry that collides with a file already there
+// is handled by the conflict strategy:
+//
+//	fail       stop the job at the first collision (the default)
+//	skip       keep what is there
+//	overwrite  replace it
+//	rename     extract beside it as "name (2).ext"
+//
+// Folders of the archive merge with folders already there.
+//
+// What an archive unpacks to is only known for sure once it is unpacked,
+// so the bytes are counted as they are written, and the job stops once
+// they reach what the share's quota leaves, or the free space of the disk
+// less extractReserve.
+
+const (
+	conflictFail      = "fail"
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+)
+
+var (
+	errArchiveFormat    = errors.New("Unsupported archive format")
+	errArchiveTool      = errors.New("Extracting 7z and RAR archives needs 7-Zip or bsdtar on the server")
+	errArchiveEncrypted = errors.New("Encrypted archives are not supported")
+	errConflictStrategy = errors.New("Invalid conflict strategy")
+	errArchiveTooLarge  = errors.New("Not enough free space to extract the archive")
+)
+
+// extractReserve is left free on the disk an archive is extracted to
+var extractReserve int64 = 1 << 30
+
+// extractWatchInterval is how often the staging folder of 7-Zip or bsdtar
+// is measured while the tool runs
+var extractWatchInterval = time.Second
+
+// Tools that extract 7z and RAR, in order of preference
+var archiveTools = []string{"7zz", "7z", "bsdtar"}
+
+// ExtractRequest extracts the archive Path into the folder To of ToShare
+// (Share when empty). Without To, a new folder named after the archive is
+// made beside it.
+type ExtractRequest struct {
+	Share    string `json:"share"`
+	Path     string `json:"path"`
+	ToShare  string `json:"toShare,omitempty"`
+	To       string `json:"to,omitempty"`
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// ArchiveRequest packs Paths into the archive Name in the folder To of
+// Share. Format is zip or tar.gz, guessed from Name when empty.
+type ArchiveRequest struct {
+	Share    string   `json:"share"`
+	Paths    []string `json:"paths"`
+	To       string   `json:"to,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Format   string   `json:"format,omitempty"`
+	Conflict string   `json:"conflict,omitempty"` // fail, overwrite or rename
+}
+
+// extractPlan is an extract job
+type extractPlan struct {
+	Share    string `json:"share"`
+	Path     string `json:"path"`
+	Format   string `json:"format"`
+	ToShare  string `json:"toShare"`
+	To       string `json:"to"`
+	Conflict string `json:"conflict"`
+}
+
+// archivePlan is an archive job; To is the archive to write
+type archivePlan struct {
+	Share     string   `json:"share"`
+	Paths     []string `json:"paths"`
+	Format    string   `json:"format"`
+	To        string   `json:"to"`
+	Overwrite bool     `json:"overwrite,omitempty"`
+}
+
+// archiveFormat tells the format of an archive from its name
+func archiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".7z"):
+		return "7z"
+	case strings.HasSuffix(name, ".rar"):
+		return "rar"
+	}
+	return ""
+}
+
+// archiveStem is name without its archive extension
+func archiveStem(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip", ".7z", ".rar"} {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+func archiveTool() (string, error) {
+	for _, name := range archiveTools {
+		if bin, err := exec.LookPath(name); err == nil {
+			return bin, nil
+		}
+	}
+	return "", errArchiveTool
+}
+
+func validConflict(s string, allowed ...string) bool {
+	for _, a := range allowed {
+		if s == a {
+			return true
+		}
+	}
+	return false
+}
+
+// freeName picks "name (2).ext", "name (3).ext", ... free in dir
+func freeName(dir, name string) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if _, err := os.Lstat(filepath.Join(dir, candidate)); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// ExtractArchive queues a job extracting an archive
+func ExtractArchive(c *gin.Context) {
+	var req ExtractRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Path == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Conflict == "" {
+		req.Conflict = conflictFail
+	}
+	if !validConflict(req.Conflict, conflictFail, conflictSkip, conflictOverwrite, conflictRename) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errConflictStrategy.Error()})
+		return
+	}
+	c.Set("auditTarget", req.Share+":"+req.Path)
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	src, rel, err := resolveFileItem(share, req.Path)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	plan := extractPlan{Share: share.Name, Path: rel, Format: archiveFormat(rel), ToShare: share.Name, Conflict: req.Conflict}
+	if plan.Format == "" {
+		fileError(c, errArchiveFormat, rel)
+		return
+	}
+	if plan.Format == "7z" || plan.Format == "rar" {
+		if _, err := archiveTool(); err != nil {
+			fileError(c, err, rel)
+			return
+		}
+	}
+	dstShare := share
+	if req.ToShare != "" && req.ToShare != share.Name {
+		dstShare, err = findFileShare(req.ToShare)
+	}
+	if err == nil && dstShare.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	plan.ToShare = dstShare.Name
+
+	if req.To == "" && req.ToShare == "" {
+		// A new folder beside the archive
+		dir := filepath.Dir(src)
+		name := archiveStem(path.Base(rel))
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			name = freeName(dir, name)
+		}
+		plan.To = path.Join(path.Dir(rel), name)
+	} else {
+		if plan.To, err = cleanSharePath(req.To); err == nil {
+			var toDir string
+			if toDir, err = resolveSharePath(dstShare, plan.To); err == nil {
+				if info, statErr := os.Stat(toDir); statErr != nil || !info.IsDir() {
+					err = errInvalidPath
+				}
+			}
+		}
+		if err != nil {
+			fileError(c, err, req.To)
+			return
+		}
+	}
+	if err := checkShareQuota(dstShare.Name, extractedSize(src, plan.Format)); err != nil {
+		fileError(c, err, "")
+		return
+	}
+	startFileJob(c, "extract", plan)
+}
+
+// extractedSize is what an archive takes once extracted: the sizes a ZIP
+// lists, or the archive's own size for the formats that do not say
+func extractedSize(src, format string) int64 {
+	if format == "zip" {
+		if zr, err := zip.OpenReader(src); err == nil {
+			defer zr.Close()
+			var size int64
+			for _, f := range zr.File {
+				size += int64(f.UncompressedSize64)
+			}
+			return size
+		}
+	}
+	return pathSize(src)
+}
+
+// CreateArchive queues a job packing files and folders into an archive
+func CreateArchive(c *gin.Context) {
+	var req ArchiveRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Paths) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Conflict == "" {
+		req.Conflict = conflictFail
+	}
+	if !validConflict(req.Conflict, conflictFail, conflictOverwrite, conflictRename) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errConflictStrategy.Error()})
+		return
+	}
+	c.Set("auditTarget", req.Share+":"+strings.Join(req.Paths, ","))
+	share, err := findFileShare(req.Share)
+	if err == nil && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	plan := archivePlan{Share: share.Name, Format: req.Format, Overwrite: req.Conflict == conflictOverwrite}
+	var size int64
+	for _, p := range req.Paths {
+		src, rel, err := resolveFileItem(share, p)
+		if err != nil {
+			fileError(c, err, p)
+			return
+		}
+		plan.Paths = append(plan.Paths, rel)
+		size += pathSize(src)
+	}
+
+	name := req.Name
+	if name == "" {
+		name = share.Name
+		if len(plan.Paths) == 1 {
+			name = path.Base(plan.Paths[0])
+		}
+		name = archiveStem(name)
+	}
+	if plan.Format == "" {
+		plan.Format = archiveFormat(name)
+	}
+	if plan.Format == "tgz" {
+		plan.Format = "tar.gz"
+	}
+	switch plan.Format {
+	case "":
+		plan.Format = "zip"
+		fallthrough
+	case "zip", "tar.gz":
+		if archiveFormat(name) != plan.Format {
+			name += "." + plan.Format
+		}
+	default:
+		fileError(c, errArchiveFormat, "")
+		return
+	}
+	if !validFileName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+
+	toRel, err := cleanSharePath(req.To)
+	if err != nil {
+		fileError(c, err, req.To)
+		return
+	}
+	toDir, err := resolveSharePath(share, toRel)
+	if err == nil {
+		if info, statErr := os.Stat(toDir); statErr != nil || !info.IsDir() {
+			err = errInvalidPath
+		}
+	}
+	if err != nil {
+		fileError(c, err, toRel)
+		return
+	}
+	plan.To = path.Join(toRel, name)
+	if _, err := os.Lstat(filepath.Join(toDir, name)); err == nil {
+		switch req.Conflict {
+		case conflictFail:
+			fileError(c, errFileExists, plan.To)
+			return
+		case conflictRename:
+			plan.To = path.Join(toRel, freeName(toDir, name))
+		}
+	}
+	if err := checkShareQuota(share.Name, size); err != nil {
+		fileError(c, err, "")
+		return
+	}
+	startFileJob(c, "archive", plan)
+}
+
+// extractor puts the entries of an archive into a folder of a share. Its
+// maps are keyed by the folder paths of the archive.
+type extractor struct {
+	ctx      context.Context
+	r        *jobRun
+	share    models.FileShare
+	to       string // Folder of the share extracted into
+	conflict string
+	resume   bool              // A later attempt: files already extracted are kept
+	dirs     map[string]string // Folder made or merged -> its path in the share
+	skipped  map[string]bool
+	ignored  int
+	room     int64 // Bytes that may still be written
+	roomErr  error // Why the job stops once room runs out
+}
+
+// extractRoom is how much extracting into dir of share may write, and the
+// error once that is used up
+func extractRoom(share, dir string) (int64, error) {
+	room, roomErr := int64(1<<62), errArchiveTooLarge // Free space unknown
+	if d, err := disk.Usage(dir); err == nil {
+		room = max(int64(d.Free)-extractReserve, 0)
+	}
+	if limit, used, ok := shareQuota(share); ok && limit-used < room {
+		room, roomErr = max(limit-used, 0), errQuotaExceeded
+	}
+	return room, roomErr
+}
+
+// archiveEntryName cleans the name of an entry; "" means leave it out
+func archiveEntryName(name string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+	if rel == "." || strings.ContainsRune(rel, 0) {
+		return ""
+	}
+	return rel
+}
+
+// resolve maps target, a path of the share, to the host. Only its folder
+// is resolved: whatever is at target, a link included, is a collision.
+// False means target is under the share's hidden folders.
+func (x *extractor) resolve(target string) (string, bool, error) {
+	rel, err := cleanSharePath(target)
+	if errors.Is(err, errInvalidPath) {
+		x.ignored++
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	dir, err := resolveSharePath(x.share, path.Dir(rel))
+	if err != nil {
+		return "", false, err
+	}
+	return filepath.Join(dir, path.Base(rel)), true, nil
+}
+
+// dir makes the folder rel of the archive and returns its path in the
+// share; false means it and what it holds are skipped
+func (x *extractor) dir(rel string) (string, bool, error) {
+	if rel == "" || rel == "." {
+		return x.to, true, nil
+	}
+	if target, ok := x.dirs[rel]; ok {
+		return target, true, nil
+	}
+	if x.skipped[rel] {
+		return "", false, nil
+	}
+	parent, ok, err := x.dir(path.Dir(rel))
+	if !ok || err != nil {
+		x.skipped[rel] = true
+		return "", false, err
+	}
+	target := path.Join(parent, path.Base(rel))
+	full, ok, err := x.resolve(target)
+	if !ok || err != nil {
+		x.skipped[rel] = true
+		return "", false, err
+	}
+	if info, err := os.Lstat(full); err == nil {
+		if info.IsDir() {
+			x.dirs[rel] = target
+			return target, true, nil
+		}
+		switch x.conflict {
+		case conflictSkip:
+			x.skipped[rel] = true
+			return "", false, nil
+		case conflictOverwrite:
+			if err := os.Remove(full); err != nil {
+				return "", false, err
+			}
+		case conflictRename:
+			target = path.Join(parent, freeName(filepath.Dir(full), path.Base(rel)))
+			full = filepath.Join(filepath.Dir(full), path.Base(target))
+		default:
+			return "", false, fmt.Errorf("%w: %s", errFileExists, target)
+		}
+	}
+	if err := os.Mkdir(full, 0755); err != nil && !os.IsExist(err) {
+		return "", false, err
+	}
+	x.dirs[rel] = target
+	return target, true, nil
+}
+
+// file writes the file rel of the archive, read from open, or moved from
+// staged when it was extracted by a tool. It returns whether it was
+// written, so the caller can count what it skipped.
+func (x *extractor) file(rel string, size int64, mtime time.Time, perm fs.FileMode, open func() (io.ReadCloser, error), staged string) (bool, error) {
+	parent, ok, err := x.dir(path.Dir(rel))
+	if !ok || err != nil {
+		return false, err
+	}
+	target := path.Join(parent, path.Base(rel))
+	full, ok, err := x.resolve(target)
+	if !ok || err != nil {
+		return false, err
+	}
+	if info, err := os.Lstat(full); err == nil {
+		if x.resume && info.Mode().IsRegular() && info.Size() == size && info.ModTime().Equal(mtime) {
+			// Extracted before the job was interrupted
+			return false, nil
+		}
+		switch x.conflict {
+		case conflictSkip:
+			return false, nil
+		case conflictOverwrite:
+			if err := os.RemoveAll(full); err != nil {
+				return false, err
+			}
+		case conflictRename:
+			full = filepath.Join(filepath.Dir(full), freeName(filepath.Dir(full), path.Base(target)))
+		default:
+			return false, fmt.Errorf("%w: %s", errFileExists, target)
+		}
+	}
+	x.r.at(rel)
+	if staged != "" {
+		if err := os.Rename(staged, full); err != nil {
+			return false, err
+		}
+	} else if err := x.write(full, perm, open); err != nil {
+		// A partial file would look extracted if its time were set
+		os.Remove(full)
+		return false, err
+	}
+	return true, os.Chtimes(full, time.Now(), mtime)
+}
+
+func (x *extractor) write(full string, perm fs.FileMode, open func() (io.ReadCloser, error)) error {
+	if perm&0600 != 0600 {
+		perm |= 0600
+	}
+	in, err := open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, io.LimitReader(in, x.room+1))
+	if x.room -= n; err == nil && x.room < 0 {
+		err = x.roomErr
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func runExtractJob(ctx context.Context, r *jobRun) error {
+	var plan extractPlan
+	if err := r.params(&plan); err != nil {
+		return err
+	}
+	share, err := findFileShare(plan.Share)
+	if err != nil {
+		return err
+	}
+	dstShare, err := findFileShare(plan.ToShare)
+	if err == nil && dstShare.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		return err
+	}
+	src, _, err := resolveFileItem(share, plan.Path)
+	if err != nil {
+		return err
+	}
+	toDir, err := resolveShareTarget(dstShare, plan.To)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(toDir, 0755); err != nil {
+		return err
+	}
+	x := &extractor{
+		ctx: ctx, r: r, share: dstShare, to: plan.To, conflict: plan.Conflict, resume: r.job.Attempt > 1,
+		dirs: make(map[string]string), skipped: make(map[string]bool),
+	}
+	x.room, x.roomErr = extractRoom(dstShare.Name, toDir)
+	switch plan.Format {
+	case "zip":
+		err = x.zip(src)
+	case "tar", "tar.gz":
+		err = x.tar(src, plan.Format == "tar.gz")
+	case "7z", "rar":
+		err = x.tool(src, filepath.Join(toDir, ".flatnas-extract-"+r.job.ID))
+	default:
+		err = errArchiveFormat
+	}
+	markQuotaStale(dstShare.Name)
+	if x.ignored > 0 {
+		filesLog.Info("Left out archive entries", "archive", plan.Share+":"+plan.Path, "count", x.ignored)
+	}
+	return err
+}
+
+// zip extracts a ZIP; the bytes are counted as they are decompressed
+func (x *extractor) zip(src string) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	var bytes, items int64
+	for _, f := range zr.File {
+		if f.Flags&0x1 != 0 {
+			return errArchiveEncrypted
+		}
+		if f.Mode().IsRegular() {
+			bytes, items = bytes+int64(f.UncompressedSize64), items+1
+		}
+	}
+	x.r.setTotal(bytes, items)
+	for _, f := range zr.File {
+		if err := x.r.wait(x.ctx); err != nil {
+			return err
+		}
+		rel := archiveEntryName(f.Name)
+		mode := f.Mode()
+		switch {
+		case rel == "":
+		case mode.IsDir():
+			if _, _, err := x.dir(rel); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			open := func() (io.ReadCloser, error) {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				return struct {
+					io.Reader
+					io.Closer
+				}{x.r.reader(x.ctx, rc), rc}, nil
+			}
+			written, err := x.file(rel, int64(f.UncompressedSize64), f.Modified, mode.Perm(), open, "")
+			if err != nil {
+				return err
+			}
+			if written {
+				x.r.add(0, 1)
+			} else {
+				x.r.add(int64(f.UncompressedSize64), 1)
+			}
+		default:
+			x.ignored++
+		}
+	}
+	return nil
+}
+
+// tar extracts a tar, gzipped or not. Its entries are only known as it is
+// read, so the progress is that of the archive file.
+func (x *extractor) tar(src string, gzipped bool) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	x.r.setTotal(info.Size(), 0)
+	var in io.Reader = x.r.reader(x.ctx, f)
+	if gzipped {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel := archiveEntryName(hdr.Name)
+		switch {
+		case rel == "":
+		case hdr.Typeflag == tar.TypeDir:
+			if _, _, err := x.dir(rel); err != nil {
+				return err
+			}
+		case hdr.Typeflag == tar.TypeReg:
+			open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+			if _, err := x.file(rel, hdr.Size, hdr.ModTime, fs.FileMode(hdr.Mode).Perm(), open, ""); err != nil {
+				return err
+			}
+			x.r.add(0, 1)
+		default:
+			x.ignored++
+		}
+	}
+}
+
+// tool extracts with 7-Zip or bsdtar into stage, then moves the files into
+// place. The tool cannot be paused; the job holds once it is done.
+func (x *extractor) tool(src, stage string) error {
+	bin, err := archiveTool()
+	if err != nil {
+		return err
+	}
+	// Left over by an interrupted attempt
+	if err := os.RemoveAll(stage); err != nil {
+		return err
+	}
+	if err := os.Mkdir(stage, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+
+	args := []string{"x", "-y", "-bd", "-o" + stage, "--", src}
+	if filepath.Base(bin) == "bsdtar" {
+		args = []string{"-x", "-f", src, "-C", stage}
+	}
+	x.r.at(filepath.Base(src))
+	// The tool is stopped once the stage holds more than there is room for
+	toolCtx, stop := context.WithCancel(x.ctx)
+	defer stop()
+	go func(room int64) {
+		tick := time.NewTicker(extractWatchInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-toolCtx.Done():
+				return
+			case <-tick.C:
+				if size, _ := treeSize(stage); size > room {
+					stop()
+					return
+				}
+			}
+		}
+	}(x.room)
+	out, err := exec.CommandContext(toolCtx, bin, args...).CombinedOutput()
+	stop()
+	if err := x.ctx.Err(); err != nil {
+		return err
+	}
+	size, items := treeSize(stage)
+	if size > x.room {
+		return x.roomErr
+	}
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		return fmt.Errorf("%s failed: %s", filepath.Base(bin), strings.TrimSpace(lines[len(lines)-1]))
+	}
+	x.room -= size
+
+	x.r.setTotal(size, items)
+	var paths []string
+	filepath.WalkDir(stage, func(p string, _ fs.DirEntry, err error) error {
+		if err == nil && p != stage {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	// Folders before what they hold
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := x.r.wait(x.ctx); err != nil {
+			return err
+		}
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			// Below a folder that was skipped
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sub, _ := filepath.Rel(stage, p)
+		rel := filepath.ToSlash(sub)
+		switch {
+		case info.IsDir():
+			_, ok, err := x.dir(rel)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				os.RemoveAll(p)
+			}
+			x.r.add(0, 1)
+		case info.Mode().IsRegular():
+			if _, err := x.file(rel, info.Size(), info.ModTime(), info.Mode().Perm(), nil, p); err != nil {
+				return err
+			}
+			x.r.add(info.Size(), 1)
+		default:
+			x.ignored++
+			x.r.add(0, 1)
+		}
+	}
+	return nil
+}
+
+func runArchiveJob(ctx context.Context, r *jobRun) error {
+	var plan archivePlan
+	if err := r.params(&plan); err != nil {
+		return err
+	}
+	share, err := findFileShare(plan.Share)
+	if err == nil && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		return err
+	}
+	dst, err := resolveShareTarget(share, plan.To)
+	if err != nil {
+		return err
+	}
+	// Written aside and moved into place once complete. The selection may
+	// hold the folder it is written to, so it leaves itself out.
+	partial := filepath.Join(filepath.Dir(dst), ".flatnas-archive-"+r.job.ID+".partial")
+	var bytes, items int64
+	err = walkZipItems(ctx, share, plan.Paths, func(item zipItem) error {
+		if item.full != partial {
+			items++
+			if !item.info.IsDir() {
+				bytes += item.info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.setTotal(bytes, items)
+
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	if err := writeArchive(ctx, r, out, share, plan, partial); err != nil {
+		out.Close()
+		os.Remove(partial)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	if info, err := os.Lstat(dst); err == nil {
+		if !plan.Overwrite {
+			os.Remove(partial)
+			return fmt.Errorf("%w: %s", errFileExists, plan.To)
+		}
+		if info.IsDir() {
+			os.RemoveAll(dst)
+		}
+	}
+	if err := os.Rename(partial, dst); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	markQuotaStale(share.Name)
+	return nil
+}
+
+func writeArchive(ctx context.Context, r *jobRun, out io.Writer, share models.FileShare, plan archivePlan, partial string) error {
+	read := func(f io.Reader) io.Reader { return r.reader(ctx, f) }
+	if plan.Format == "zip" {
+		zw := zip.NewWriter(out)
+		err := walkZipItems(ctx, share, plan.Paths, func(item zipItem) error {
+			if item.full == partial {
+				return nil
+			}
+			r.at(item.name)
+			if err := copyZipItem(zw, item, read); err != nil {
+				return err
+			}
+			r.add(0, 1)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	err := walkZipItems(ctx, share, plan.Paths, func(item zipItem) error {
+		if item.full == partial {
+			return nil
+		}
+		r.at(item.name)
+		if err := addTarItem(tw, item, read); err != nil {
+			return err
+		}
+		r.add(0, 1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addTarItem(tw *tar.Writer, item zipItem, read func(io.Reader) io.Reader) error {
+	header, err := tar.FileInfoHeader(item.info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = item.name
+	header.Uname, header.Gname = "", ""
+	if item.info.IsDir() {
+		header.Name += "/"
+		return tw.WriteHeader(header)
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	f, err := os.Open(item.full)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// The header promised this many bytes, whatever the file does meanwhile
+	n, err := io.Copy(tw, io.LimitReader(read(f), header.Size))
+	if err == nil && n < header.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+func TestArchiveJobs(t *testing.T) {
+	useTestConfig(t)
+	useTestJobs(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "in"), 0755)
+	os.MkdirAll(filepath.Join(root, "docs", "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(root, "docs", "sub", "b.txt"), []byte("beta"), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range map[string]string{"photos/a.jpg": "jpeg", "../../escape.txt": "out", "notes.txt": "hi"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(body))
+	}
+	link := &zip.FileHeader{Name: "link"}
+	link.SetMode(os.ModeSymlink | 0777)
+	w, _ := zw.CreateHeader(link)
+	w.Write([]byte("/etc/passwd"))
+	zw.Close()
+	os.WriteFile(filepath.Join(root, "in", "pack.zip"), buf.Bytes(), 0644)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("username", "alice") })
+	r.POST("/files/extract", ExtractArchive)
+	r.POST("/files/archive", CreateArchive)
+	run := func(target, body, status string) Job {
+		t.Helper()
+		w := serve(r, "POST", target, body)
+		var resp struct {
+			Data Job `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 202 {
+			t.Fatalf("%s %s: %d %s", target, body, w.Code, w.Body.String())
+		}
+		return waitJob(t, resp.Data.ID, status)
+	}
+
+	// Without a target, a folder named after the archive is made beside it
+	j := run("/files/extract", `{"share":"main","path":"in/pack.zip"}`, JobDone)
+	if got := listTree(t, filepath.Join(root, "in", "pack")); got != "escape.txt=out notes.txt=hi photos/ photos/a.jpg=jpeg" {
+		t.Fatalf("unexpected extraction %q", got)
+	}
+	if j.Bytes != 9 || j.TotalItems != 3 || j.Percent != 100 {
+		t.Fatalf("unexpected progress %+v", j)
+	}
+	run("/files/extract", `{"share":"main","path":"in/pack.zip"}`, JobDone)
+	if _, err := os.Stat(filepath.Join(root, "in", "pack (2)", "notes.txt")); err != nil {
+		t.Fatalf("second extraction did not get a new folder: %v", err)
+	}
+
+	// Conflict strategies, with a tar.gz into a folder that has files
+	buf.Reset()
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct{ name, body string }{{"a.txt", "new"}, {"sub/b.txt", "new"}, {"c.txt", "new"}} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), ModTime: time.Unix(1700000000, 0), Typeflag: tar.TypeReg})
+		tw.Write([]byte(f.body))
+	}
+	tw.Close()
+	gz.Close()
+	os.WriteFile(filepath.Join(root, "in", "up.tar.gz"), buf.Bytes(), 0644)
+
+	j = run("/files/extract", `{"share":"main","path":"in/up.tar.gz","to":"docs"}`, JobFailed)
+	if !strings.Contains(j.Error, "File already exists") {
+		t.Fatalf("expected a collision to fail the job, got %q", j.Error)
+	}
+	run("/files/extract", `{"share":"main","path":"in/up.tar.gz","to":"docs","conflict":"skip"}`, JobDone)
+	if got := listTree(t, filepath.Join(root, "docs")); got != "a.txt=alpha c.txt=new sub/ sub/b.txt=beta" {
+		t.Fatalf("skip: %q", got)
+	}
+	run("/files/extract", `{"share":"main","path":"in/up.tar.gz","to":"docs","conflict":"rename"}`, JobDone)
+	if got := listTree(t, filepath.Join(root, "docs")); got != "a (2).txt=new a.txt=alpha c (2).txt=new c.txt=new sub/ sub/b (2).txt=new sub/b.txt=beta" {
+		t.Fatalf("rename: %q", got)
+	}
+	run("/files/extract", `{"share":"main","path":"in/up.tar.gz","to":"docs","conflict":"overwrite"}`, JobDone)
+	if data, _ := os.ReadFile(filepath.Join(root, "docs", "sub", "b.txt")); string(data) != "new" {
+		t.Fatalf("overwrite kept %q", data)
+	}
+	if w := serve(r, "POST", "/files/extract", `{"share":"main","path":"docs/a.txt"}`); w.Code != 400 {
+		t.Fatalf("expected 400 for a file that is no archive, got %d", w.Code)
+	}
+	if w := serve(r, "POST", "/files/extract", `{"share":"main","path":"in/up.tar.gz","conflict":"merge"}`); w.Code != 400 {
+		t.Fatalf("expected 400 for an unknown strategy, got %d", w.Code)
+	}
+
+	// Archives of a selection, written into a folder of the selection
+	os.RemoveAll(filepath.Join(root, "docs", "sub"))
+	os.Remove(filepath.Join(root, "docs", "a (2).txt"))
+	os.Remove(filepath.Join(root, "docs", "c (2).txt"))
+	j = run("/files/archive", `{"share":"main","paths":["docs"],"to":"docs"}`, JobDone)
+	zr, err := zip.OpenReader(filepath.Join(root, "docs", "docs.zip"))
+	if err != nil {
+		t.Fatalf("archive not written: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	zr.Close()
+	if strings.Join(names, " ") != "docs/ docs/a.txt docs/c.txt" || j.Items != 3 {
+		t.Fatalf("unexpected archive %q, job %+v", names, j)
+	}
+	if w := serve(r, "POST", "/files/archive", `{"share":"main","paths":["docs"],"to":"docs"}`); w.Code != 409 {
+		t.Fatalf("expected 409 for an existing archive, got %d", w.Code)
+	}
+
+	run("/files/archive", `{"share":"main","paths":["docs/a.txt","docs/c.txt"],"name":"two","format":"tar.gz"}`, JobDone)
+	f, err := os.Open(filepath.Join(root, "two.tar.gz"))
+	if err != nil {
+		t.Fatalf("tar.gz not written: %v", err)
+	}
+	defer f.Close()
+	gr, _ := gzip.NewReader(f)
+	tr := tar.NewReader(gr)
+	var got []string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		body, _ := io.ReadAll(tr)
+		got = append(got, hdr.Name+"="+string(body))
+	}
+	if strings.Join(got, " ") != "a.txt=new c.txt=new" {
+		t.Fatalf("unexpected tar.gz %q", got)
+	}
+	if w := serve(r, "POST", "/files/archive", `{"share":"main","paths":["docs"],"format":"rar"}`); w.Code != 400 {
+		t.Fatalf("expected 400 for making a RAR, got %d", w.Code)
+	}
+}
+
+func TestExtractRoom(t *testing.T) {
+	useTestConfig(t)
+	useTestJobs(t)
+
+	// 8 MiB of zeros pack into a few KB, far below the quota the archive's
+	// own size is checked against
+	root := t.TempDir()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "zeros.bin", Mode: 0644, Size: 8 << 20, Typeflag: tar.TypeReg})
+	tw.Write(make([]byte, 8<<20))
+	tw.Close()
+	gz.Close()
+	os.WriteFile(filepath.Join(root, "bomb.tar.gz"), buf.Bytes(), 0644)
+	sysConfig := models.SystemConfig{
+		Shares: []models.FileShare{{Name: "main", Path: root}},
+		Quotas: &models.QuotaSettings{Shares: map[string]int64{"main": 1 << 20}},
+	}
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+	quotaCounts.Lock()
+	delete(quotaCounts.shares, "main")
+	quotaCounts.Unlock()
+	countQuotas(context.Background(), false)
+	extract := func() Job {
+		t.Helper()
+		j, _ := enqueueJob("extract", "alice", extractPlan{Share: "main", Path: "bomb.tar.gz", Format: "tar.gz", ToShare: "main", To: "out", Conflict: conflictFail})
+		return waitJob(t, j.ID, JobFailed)
+	}
+
+	// The quota stops the job while it writes, and the partial file goes
+	if j := extract(); j.Error != errQuotaExceeded.Error() {
+		t.Fatalf("expected the quota to stop the job, got %q", j.Error)
+	}
+	if got := listTree(t, filepath.Join(root, "out")); got != "" {
+		t.Fatalf("expected nothing left, got %q", got)
+	}
+
+	// Without a quota, the disk keeps extractReserve free
+	sysConfig.Quotas = nil
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+	d, err := disk.Usage(root)
+	if err != nil {
+		t.Skipf("free space unknown: %v", err)
+	}
+	prevReserve := extractReserve
+	extractReserve = int64(d.Free) - 1<<20
+	defer func() { extractReserve = prevReserve }()
+	if j := extract(); j.Error != errArchiveTooLarge.Error() {
+		t.Fatalf("expected the free space to stop the job, got %q", j.Error)
+	}
+}
+
+func TestExtractWithTool(t *testing.T) {
+	bsdtar, err := exec.LookPath("bsdtar")
+	if err != nil {
+		t.Skip("bsdtar not installed")
+	}
+	useTestConfig(t)
+	useTestJobs(t)
+	prevTools := archiveTools
+	archiveTools = []string{"bsdtar"}
+	defer func() { archiveTools = prevTools }()
+
+	root := t.TempDir()
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "set", "deep"), 0755)
+	os.WriteFile(filepath.Join(src, "set", "deep", "x.txt"), []byte("seven"), 0644)
+	os.WriteFile(filepath.Join(src, "set", "y.txt"), []byte("zip"), 0644)
+	cmd := exec.Command(bsdtar, "--format", "7zip", "-cf", filepath.Join(root, "set.7z"), "-C", src, "set")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("bsdtar cannot write 7z: %v %s", err, out)
+	}
+	os.MkdirAll(filepath.Join(root, "out", "set"), 0755)
+	os.WriteFile(filepath.Join(root, "out", "set", "y.txt"), []byte("mine"), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	j, _ := enqueueJob("extract", "alice", extractPlan{Share: "main", Path: "set.7z", Format: "7z", ToShare: "main", To: "out", Conflict: conflictRename})
+	if j = waitJob(t, j.ID, JobDone); j.Bytes != 8 {
+		t.Fatalf("unexpected progress %+v", j)
+	}
+	if got := listTree(t, filepath.Join(root, "out")); got != "set/ set/deep/ set/deep/x.txt=seven set/y (2).txt=zip set/y.txt=mine" {
+		t.Fatalf("unexpected extraction %q", got)
+	}
+
+	// What the tool unpacks past the room left is thrown away
+	os.WriteFile(filepath.Join(src, "set", "zeros.bin"), make([]byte, 8<<20), 0644)
+	cmd = exec.Command(bsdtar, "--format", "7zip", "-cf", filepath.Join(root, "bomb.7z"), "-C", src, "set")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("bsdtar: %v %s", err, out)
+	}
+	prevReserve := extractReserve
+	if d, err := disk.Usage(root); err == nil {
+		extractReserve = int64(d.Free) - 1<<20
+	}
+	defer func() { extractReserve = prevReserve }()
+	j, _ = enqueueJob("extract", "alice", extractPlan{Share: "main", Path: "bomb.7z", Format: "7z", ToShare: "main", To: "bomb", Conflict: conflictFail})
+	if j = waitJob(t, j.ID, JobFailed); j.Error != errArchiveTooLarge.Error() {
+		t.Fatalf("expected the job stopped, got %q", j.Error)
+	}
+	if got := listTree(t, filepath.Join(root, "bomb")); got != "" {
+		t.Fatalf("expected nothing extracted, got %q", got)
+	}
+}
+
+// listTree lists the files of dir as "path=contents" and its folders as
+// "path/", sorted
+func listTree(t *testing.T, dir string) string {
+	t.Helper()
+	var out []string
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			out = append(out, rel+"/")
+		} else {
+			data, _ := os.ReadFile(p)
+			out = append(out, rel+"="+string(data))
+		}
+		return nil
+	})
+	sort.Strings(out)
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,568 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/models"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The duplicate finder walks a share in the background and groups files
+// with the same content. Files are first grouped by size, then by a hash
+// of their head, and only files still alike are hashed whole, so most of
+// a share is never read. Hard links to the same file are one file. The
+// result is kept in memory until the next scan; bulk actions check the
+// content again before touching a file and always keep one copy.
+
+const (
+	dupePartialSpan = 64 << 10
+	dupeDefaultMin  = 1
+)
+
+var (
+	errNoDupeScan     = errors.New("Share not scanned yet")
+	errDupeChanged    = errors.New("File changed since the scan")
+	errDupeNotInScan  = errors.New("File is not a duplicate")
+	errDupeAllCopies  = errors.New("Every copy is selected")
+	errDupeNotRunning = errors.New("No scan is running")
+)
+
+// DupeFile is a copy in a duplicate group
+type DupeFile struct {
+	Path    string `json:"path"`
+	ModTime int64  `json:"modTime"`
+}
+
+// DupeGroup is a set of files with the same content
+type DupeGroup struct {
+	Hash  string     `json:"hash"`
+	Size  int64      `json:"size"`
+	Files []DupeFile `json:"files"`
+}
+
+// DupeResult is the outcome of the last scan of a share
+type DupeResult struct {
+	Share     string      `json:"share"`
+	Path      string      `json:"path"`
+	MinSize   int64       `json:"minSize"`
+	Files     int64       `json:"files"`  // Files looked at
+	Wasted    int64       `json:"wasted"` // Bytes freed by keeping one copy of each
+	Groups    []DupeGroup `json:"groups"`
+	ScannedAt int64       `json:"scannedAt"`
+}
+
+// DupeStatus tells how far a running scan is
+type DupeStatus struct {
+	Scanning  bool   `json:"scanning"`
+	Phase     string `json:"phase,omitempty"` // walking or hashing
+	Files     int64  `json:"files,omitempty"`
+	Hashed    int64  `json:"hashed,omitempty"` // Bytes read for hashing
+	StartedAt int64  `json:"startedAt,omitempty"`
+}
+
+// DupeActionRequest acts on some copies of the last scan. Action is
+// delete (to the recycle bin), hardlink (replace with a link to the kept
+// copy) or move (into the folder To).
+type DupeActionRequest struct {
+	Share  string   `json:"share"`
+	Action string   `json:"action"`
+	Paths  []string `json:"paths"`
+	To     string   `json:"to,omitempty"`
+	DryRun bool     `json:"dryRun"`
+}
+
+// DupeActionResult is what was, or with a dry run would be, done to a file
+type DupeActionResult struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"` // Kept copy of a hardlink, new path of a move
+	Error  string `json:"error,omitempty"`
+}
+
+type dupeRun struct {
+	started time.Time
+	cancel  context.CancelFunc
+	phase   atomic.Value
+	files   atomic.Int64
+	hashed  atomic.Int64
+}
+
+var dupeJobs = struct {
+	sync.Mutex
+	results map[string]*DupeResult
+	running map[string]*dupeRun
+}{results: make(map[string]*DupeResult), running: make(map[string]*dupeRun)}
+
+// dupeCandidate is a file found by the walk
+type dupeCandidate struct {
+	rel  string
+	full string
+	info os.FileInfo
+}
+
+// hashDupeFile hashes the first limit bytes of a file, all of it when
+// limit is negative
+func hashDupeFile(ctx context.Context, full string, limit int64, run *dupeRun) (string, error) {
+	f, err := os.Open(full)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+	h := sha256.New()
+	buf := make([]byte, 256<<10)
+	for {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		n, err := r.Read(buf)
+		h.Write(buf[:n])
+		if run != nil {
+			run.hashed.Add(int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// groupDupes splits files by the hash key gives them, dropping groups of
+// one and the files key fails on
+func groupDupes(files []dupeCandidate, key func(dupeCandidate) (string, error)) map[string][]dupeCandidate {
+	groups := make(map[string][]dupeCandidate)
+	for _, f := range files {
+		if k, err := key(f); err == nil {
+			groups[k] = append(groups[k], f)
+		}
+	}
+	for k, g := range groups {
+		if len(g) < 2 {
+			delete(groups, k)
+		}
+	}
+	return groups
+}
+
+// withoutHardLinks keeps one of the files that are the same file
+func withoutHardLinks(files []dupeCandidate) []dupeCandidate {
+	out := files[:0]
+	for _, f := range files {
+		linked := false
+		for _, o := range out {
+			if os.SameFile(f.info, o.info) {
+				linked = true
+				break
+			}
+		}
+		if !linked {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func findDupes(ctx context.Context, share models.FileShare, rel string, minSize int64, run *dupeRun) (*DupeResult, error) {
+	root, err := resolveSharePath(share, rel)
+	if err != nil {
+		return nil, err
+	}
+	run.phase.Store("walking")
+	bySize := make(map[int64][]dupeCandidate)
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil
+		}
+		fileRel := strings.TrimPrefix(path.Join(rel, filepath.ToSlash(strings.TrimPrefix(p, root))), "/")
+		if d.IsDir() {
+			if hiddenShareDir(fileRel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() < minSize {
+			return nil
+		}
+		run.files.Add(1)
+		bySize[info.Size()] = append(bySize[info.Size()], dupeCandidate{rel: fileRel, full: p, info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	run.phase.Store("hashing")
+	result := &DupeResult{Share: share.Name, Path: rel, MinSize: minSize, Files: run.files.Load(), Groups: []DupeGroup{}}
+	for size, files := range bySize {
+		if files = withoutHardLinks(files); len(files) < 2 {
+			continue
+		}
+		partial := groupDupes(files, func(f dupeCandidate) (string, error) {
+			return hashDupeFile(ctx, f.full, dupePartialSpan, run)
+		})
+		for partialHash, group := range partial {
+			whole := map[string][]dupeCandidate{partialHash: group}
+			// The head of a small file is all of it
+			if size > dupePartialSpan {
+				whole = groupDupes(group, func(f dupeCandidate) (string, error) {
+					return hashDupeFile(ctx, f.full, -1, run)
+				})
+			}
+			for hash, g := range whole {
+				dg := DupeGroup{Hash: hash, Size: size}
+				for _, f := range g {
+					dg.Files = append(dg.Files, DupeFile{Path: f.rel, ModTime: f.info.ModTime().UnixMilli()})
+				}
+				sort.Slice(dg.Files, func(i, j int) bool { return dg.Files[i].Path < dg.Files[j].Path })
+				result.Groups = append(result.Groups, dg)
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	sortDupeGroups(result)
+	return result, nil
+}
+
+// sortDupeGroups puts the groups wasting the most space first and totals it
+func sortDupeGroups(result *DupeResult) {
+	sort.Slice(result.Groups, func(i, j int) bool {
+		wi := result.Groups[i].Size * int64(len(result.Groups[i].Files)-1)
+		wj := result.Groups[j].Size * int64(len(result.Groups[j].Files)-1)
+		if wi != wj {
+			return wi > wj
+		}
+		return result.Groups[i].Files[0].Path < result.Groups[j].Files[0].Path
+	})
+	result.Wasted = 0
+	for _, g := range result.Groups {
+		result.Wasted += g.Size * int64(len(g.Files)-1)
+	}
+}
+
+func dupeStatus(share string) DupeStatus {
+	run := dupeJobs.running[share]
+	if run == nil {
+		return DupeStatus{}
+	}
+	phase, _ := run.phase.Load().(string)
+	return DupeStatus{Scanning: true, Phase: phase, Files: run.files.Load(), Hashed: run.hashed.Load(), StartedAt: run.started.UnixMilli()}
+}
+
+// ScanDuplicates starts a duplicate scan of a share or one of its folders
+func ScanDuplicates(c *gin.Context) {
+	var req struct {
+		Share   string `json:"share"`
+		Path    string `json:"path"`
+		MinSize int64  `json:"minSize"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.MinSize < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	rel, err := cleanSharePath(req.Path)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	if req.MinSize == 0 {
+		req.MinSize = dupeDefaultMin
+	}
+	dupeJobs.Lock()
+	defer dupeJobs.Unlock()
+	if dupeJobs.running[share.Name] != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A scan is already running", "status": dupeStatus(share.Name)})
+		return
+	}
+	ctx, cancel := context.WithCancel(backgroundCtx)
+	run := &dupeRun{started: time.Now(), cancel: cancel}
+	dupeJobs.running[share.Name] = run
+	go func() {
+		defer cancel()
+		result, err := findDupes(ctx, share, rel, req.MinSize, run)
+		dupeJobs.Lock()
+		defer dupeJobs.Unlock()
+		delete(dupeJobs.running, share.Name)
+		if err != nil {
+			if ctx.Err() == nil {
+				filesLog.Warn("Duplicate scan failed", "share", share.Name, "path", rel, "error", err)
+			}
+			return
+		}
+		result.ScannedAt = time.Now().UnixMilli()
+		dupeJobs.results[share.Name] = result
+		filesLog.Info("Duplicate scan done", "share", share.Name, "path", rel, "groups", len(result.Groups), "wasted", result.Wasted, "took", time.Since(run.started).Round(time.Millisecond))
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": dupeStatus(share.Name)})
+}
+
+// CancelDuplicateScan stops the running scan of ?share=
+func CancelDuplicateScan(c *gin.Context) {
+	dupeJobs.Lock()
+	run := dupeJobs.running[c.Query("share")]
+	dupeJobs.Unlock()
+	if run == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errDupeNotRunning.Error()})
+		return
+	}
+	run.cancel()
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetDuplicates returns the last result and the scan status of ?share=
+func GetDuplicates(c *gin.Context) {
+	share, err := findFileShare(c.Query("share"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	dupeJobs.Lock()
+	defer dupeJobs.Unlock()
+	result := dupeJobs.results[share.Name]
+	if result == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoDupeScan.Error(), "status": dupeStatus(share.Name)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"result": result, "status": dupeStatus(share.Name)}})
+}
+
+// dupeVerify checks that a file still has the content it was grouped by
+func dupeVerify(share models.FileShare, rel string, group DupeGroup) (string, error) {
+	full, _, err := resolveFileItem(share, rel)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(full)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() || info.Size() != group.Size {
+		return "", errDupeChanged
+	}
+	if hash, err := hashDupeFile(backgroundCtx, full, -1, nil); err != nil || hash != group.Hash {
+		return "", errDupeChanged
+	}
+	return full, nil
+}
+
+// DuplicateAction deletes, hard links or moves copies found by the last
+// scan, or with dryRun lists what it would do
+func DuplicateAction(c *gin.Context) {
+	var req DupeActionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Paths) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	switch req.Action {
+	case "delete", "hardlink", "move":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err == nil && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	var toDir, toRel string
+	if req.Action == "move" {
+		if toRel, err = cleanSharePath(req.To); err == nil {
+			toDir, err = resolveSharePath(share, toRel)
+		}
+		if err == nil {
+			if info, serr := os.Stat(toDir); serr != nil || !info.IsDir() {
+				err = os.ErrNotExist
+			}
+		}
+		if err != nil {
+			fileError(c, err, req.To)
+			return
+		}
+	}
+	c.Set("auditTarget", req.Share+":"+strings.Join(req.Paths, ","))
+
+	// Work on a copy of the groups: the files are hashed and moved without
+	// the lock, so other shares can scan meanwhile
+	dupeJobs.Lock()
+	result := dupeJobs.results[share.Name]
+	var groups []DupeGroup
+	if result != nil {
+		groups = make([]DupeGroup, len(result.Groups))
+		for i, g := range result.Groups {
+			groups[i] = g
+			groups[i].Files = append([]DupeFile(nil), g.Files...)
+		}
+	}
+	dupeJobs.Unlock()
+	if result == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoDupeScan.Error()})
+		return
+	}
+	selected := make(map[string]bool, len(req.Paths))
+	for _, p := range req.Paths {
+		if rel, err := cleanSharePath(p); err == nil {
+			selected[rel] = true
+		}
+	}
+	done := make(map[string]bool)
+	results := []DupeActionResult{}
+	for _, group := range groups {
+		keep := ""
+		for _, f := range group.Files {
+			if !selected[f.Path] {
+				keep = f.Path
+				break
+			}
+		}
+		for _, f := range group.Files {
+			if !selected[f.Path] {
+				continue
+			}
+			delete(selected, f.Path)
+			res := DupeActionResult{Path: f.Path, Action: req.Action}
+			switch {
+			case keep == "":
+				res.Error = errDupeAllCopies.Error()
+			case req.Action == "hardlink":
+				res.Target = keep
+			case req.Action == "move":
+				res.Target = path.Join(toRel, path.Base(f.Path))
+			}
+			if res.Error == "" && !req.DryRun {
+				if err := applyDupeAction(c, share, group, f.Path, keep, toDir, toRel, &res); err != nil {
+					res.Error = err.Error()
+				} else {
+					done[f.Path] = true
+				}
+			}
+			results = append(results, res)
+		}
+	}
+	for p := range selected {
+		results = append(results, DupeActionResult{Path: p, Action: req.Action, Error: errDupeNotInScan.Error()})
+	}
+
+	// Acted on copies are no longer duplicates. A scan that finished in the
+	// meantime already saw the files as they are now.
+	if len(done) > 0 {
+		dupeJobs.Lock()
+		if dupeJobs.results[share.Name] == result {
+			pruneDupes(result, done)
+		}
+		dupeJobs.Unlock()
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"dryRun": req.DryRun, "results": results}})
+}
+
+// pruneDupes drops the done files from a result, and the groups left
+// with a single copy
+func pruneDupes(result *DupeResult, done map[string]bool) {
+	groups := result.Groups[:0]
+	for _, g := range result.Groups {
+		files := make([]DupeFile, 0, len(g.Files))
+		for _, f := range g.Files {
+			if !done[f.Path] {
+				files = append(files, f)
+			}
+		}
+		if g.Files = files; len(files) > 1 {
+			groups = append(groups, g)
+		}
+	}
+	result.Groups = groups
+	sortDupeGroups(result)
+}
+
+func applyDupeAction(c *gin.Context, share models.FileShare, group DupeGroup, rel, keep, toDir, toRel string, res *DupeActionResult) error {
+	// The kept copy is checked too, so the content is never lost
+	full, err := dupeVerify(share, rel, group)
+	if err != nil {
+		return err
+	}
+	keepFull, err := dupeVerify(share, keep, group)
+	if err != nil {
+		return err
+	}
+	switch res.Action {
+	case "delete":
+		return moveToTrash(share, full, rel, c.GetString("username"))
+	case "hardlink":
+		// Link beside the copy, then swap it in
+		tmp, err := linkDupeTemp(keepFull, filepath.Dir(full))
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, full); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	default:
+		name := path.Base(rel)
+		if _, err := os.Lstat(filepath.Join(toDir, name)); err == nil {
+			name = copyName(toDir, name)
+		}
+		res.Target = path.Join(toRel, name)
+		return movePath(full, filepath.Join(toDir, name))
+	}
+}
+
+// linkDupeTemp hard links file under a new random name in dir. Link
+// never replaces a file, so a name that is taken is skipped, not lost.
+func linkDupeTemp(file, dir string) (string, error) {
+	buf := make([]byte, 8)
+	for i := 0; i < 10; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		tmp := filepath.Join(dir, ".dupe-link-"+hex.EncodeToString(buf))
+		err := os.Link(file, tmp)
+		if err == nil {
+			return tmp, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+	}
+	return "", fs.ErrExist
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDuplicates(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	big := make([]byte, 100<<10)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	write := func(p string, data []byte) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, p)), 0755)
+		os.WriteFile(filepath.Join(root, p), data, 0644)
+	}
+	write("a.bin", big)
+	write("b.bin", big)
+	write("sub/c.bin", big)
+	// Same size and head, different tail
+	other := append([]byte{}, big...)
+	other[len(other)-1]++
+	write("d.bin", other)
+	write("x.txt", []byte("hello"))
+	write("y.txt", []byte("hello"))
+	write("z1.txt", []byte("world"))
+	write("z2.txt", []byte("world"))
+	write("h1.txt", []byte("linked"))
+	os.Link(filepath.Join(root, "h1.txt"), filepath.Join(root, "h2.txt"))
+	os.MkdirAll(filepath.Join(root, "moved"), 0755)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	r := gin.New()
+	r.GET("/dupes", GetDuplicates)
+	r.POST("/dupes/scan", ScanDuplicates)
+	r.POST("/dupes/action", DuplicateAction)
+	if w := serve(r, "POST", "/dupes/scan", `{"share":"main"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("scan failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data struct{ Result DupeResult }
+	}
+	for i := 0; ; i++ {
+		w := serve(r, "GET", "/dupes?share=main", "")
+		if w.Code == 200 {
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			break
+		}
+		if i > 500 {
+			t.Fatalf("scan did not finish: %d %s", w.Code, w.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	groups := resp.Data.Result.Groups
+	if len(groups) != 3 || len(groups[0].Files) != 3 || groups[0].Files[0].Path != "a.bin" || resp.Data.Result.Wasted != 2*int64(len(big))+10 {
+		t.Fatalf("unexpected groups %+v", resp.Data.Result)
+	}
+
+	action := func(body string) []DupeActionResult {
+		var resp struct {
+			Data struct{ Results []DupeActionResult }
+		}
+		w := serve(r, "POST", "/dupes/action", body)
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 {
+			t.Fatalf("action failed: %d %s", w.Code, w.Body.String())
+		}
+		return resp.Data.Results
+	}
+	res := action(`{"share":"main","action":"delete","paths":["x.txt","y.txt","d.bin"],"dryRun":true}`)
+	if len(res) != 3 || res[0].Error != "Every copy is selected" || res[2].Error != "File is not a duplicate" {
+		t.Fatalf("unexpected dry run %+v", res)
+	}
+	res = action(`{"share":"main","action":"hardlink","paths":["b.bin"],"dryRun":true}`)
+	a, _ := os.Stat(filepath.Join(root, "a.bin"))
+	if b, _ := os.Stat(filepath.Join(root, "b.bin")); len(res) != 1 || res[0].Target != "a.bin" || os.SameFile(a, b) {
+		t.Fatalf("dry run acted: %+v", res)
+	}
+
+	res = action(`{"share":"main","action":"hardlink","paths":["b.bin"]}`)
+	if b, _ := os.Stat(filepath.Join(root, "b.bin")); res[0].Error != "" || !os.SameFile(a, b) {
+		t.Fatalf("hardlink failed: %+v", res)
+	}
+	res = action(`{"share":"main","action":"move","paths":["sub/c.bin"],"to":"moved"}`)
+	if _, err := os.Stat(filepath.Join(root, "moved", "c.bin")); res[0].Error != "" || res[0].Target != "moved/c.bin" || err != nil {
+		t.Fatalf("move failed: %+v", res)
+	}
+	res = action(`{"share":"main","action":"delete","paths":["y.txt"]}`)
+	if _, err := os.Stat(filepath.Join(root, "y.txt")); res[0].Error != "" || !os.IsNotExist(err) || len(listTrash(models.FileShare{Name: "main", Path: root})) != 1 {
+		t.Fatalf("delete failed: %+v", res)
+	}
+	os.WriteFile(filepath.Join(root, "z2.txt"), []byte("WORLD"), 0644)
+	res = action(`{"share":"main","action":"delete","paths":["z2.txt"]}`)
+	if _, err := os.Stat(filepath.Join(root, "z2.txt")); res[0].Error != "File changed since the scan" || err != nil {
+		t.Fatalf("changed file acted on: %+v", res)
+	}
+
+	json.Unmarshal(serve(r, "GET", "/dupes?share=main", "").Body.Bytes(), &resp)
+	if len(resp.Data.Result.Groups) != 1 || resp.Data.Result.Groups[0].Files[0].Path != "z1.txt" {
+		t.Fatalf("acted on copies still listed %+v", resp.Data.Result.Groups)
+	}
+}
@@ -0,0 +1,500 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/models"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/html/charset"
+)
+
+// The editor reads and writes small text files of a share. Files are
+// decoded to UTF-8 for the browser and encoded back as they were found, so
+// a Latin-1 config or a UTF-16 script with a BOM keeps its bytes. Saves
+// carry the etag the editor loaded: a file changed meanwhile is not
+// overwritten but answered with 412 and its current etag.
+
+// maxTextFileSize is the largest file the editor opens or saves
+const maxTextFileSize = 5 << 20
+
+var (
+	errNotText       = errors.New("Not a text file")
+	errTextTooLarge  = errors.New("File is too large to edit")
+	errTextEncoding  = errors.New("Unknown encoding")
+	errTextUnmapped  = errors.New("The text has characters the encoding cannot hold")
+	errTextChanged   = errors.New("File was changed since it was loaded")
+	errTextNeedsETag = errors.New("Saving over a file needs the etag it was loaded with")
+)
+
+// textEdits serializes the check of the etag and the write of a save
+var textEdits sync.Mutex
+
+var (
+	utf16LEBOM = []byte{0xff, 0xfe}
+	utf16BEBOM = []byte{0xfe, 0xff}
+)
+
+// TextFile is a file opened in the editor
+type TextFile struct {
+	Share      string `json:"share"`
+	Path       string `json:"path"`
+	Content    string `json:"content"`
+	Encoding   string `json:"encoding"`   // e.g. "utf-8", "windows-1252", "utf-16le"
+	BOM        bool   `json:"bom"`        // Whether the file starts with a byte order mark
+	LineEnding string `json:"lineEnding"` // "lf" or "crlf", whichever the file uses most
+	Syntax     string `json:"syntax"`     // Highlighting hint, "plaintext" when unknown
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+	ModTime    int64  `json:"modTime"`
+	ReadOnly   bool   `json:"readOnly"`
+}
+
+// TextFileRequest saves a file from the editor. ETag is the one it was
+// loaded with, empty to create a file; the If-Match header may carry it
+// instead.
+type TextFileRequest struct {
+	Share    string `json:"share"`
+	Path     string `json:"path"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding,omitempty"` // UTF-8 when empty
+	BOM      bool   `json:"bom,omitempty"`
+	ETag     string `json:"etag,omitempty"`
+}
+
+// textETag is the strong etag of a file's bytes. Timestamps are too
+// coarse on some file systems to tell two quick saves apart.
+func textETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// detectTextEncoding finds the encoding of data from its byte order mark,
+// then whether it is valid UTF-8, then a guess. Data with NUL bytes and no
+// UTF-16 mark is not text.
+func detectTextEncoding(data []byte) (string, bool, error) {
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		return "utf-8", true, nil
+	case bytes.HasPrefix(data, utf16LEBOM):
+		return "utf-16le", true, nil
+	case bytes.HasPrefix(data, utf16BEBOM):
+		return "utf-16be", true, nil
+	}
+	if bytes.IndexByte(data[:min(len(data), 8192)], 0) >= 0 {
+		return "", false, errNotText
+	}
+	if utf8.Valid(data) {
+		return "utf-8", false, nil
+	}
+	_, name, _ := charset.DetermineEncoding(data, "text/plain")
+	return name, false, nil
+}
+
+// decodeText turns the bytes of a file in the given encoding into UTF-8,
+// dropping the byte order mark
+func decodeText(data []byte, encoding string, bom bool) (string, error) {
+	if bom {
+		switch {
+		case bytes.HasPrefix(data, utf8BOM):
+			data = data[len(utf8BOM):]
+		case bytes.HasPrefix(data, utf16LEBOM), bytes.HasPrefix(data, utf16BEBOM):
+			data = data[2:]
+		}
+	}
+	if isUTF8Label(encoding) {
+		if !utf8.Valid(data) {
+			return "", errTextEncoding
+		}
+		return string(data), nil
+	}
+	enc, _ := charset.Lookup(encoding)
+	if enc == nil {
+		return "", errTextEncoding
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", errTextEncoding
+	}
+	return string(decoded), nil
+}
+
+// encodeText is the reverse of decodeText. It fails rather than writing
+// replacement characters for text the encoding cannot hold.
+func encodeText(text, encoding string, bom bool) ([]byte, string, error) {
+	if encoding == "" || isUTF8Label(encoding) {
+		data := []byte(text)
+		if bom {
+			data = append(append([]byte{}, utf8BOM...), data...)
+		}
+		return data, "utf-8", nil
+	}
+	enc, name := charset.Lookup(encoding)
+	if enc == nil {
+		return nil, "", errTextEncoding
+	}
+	// The encoders of the HTML index write character references for what
+	// they cannot map, so the text must survive the way back
+	data, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		return nil, "", errTextUnmapped
+	}
+	if back, err := enc.NewDecoder().Bytes(data); err != nil || string(back) != text {
+		return nil, "", errTextUnmapped
+	}
+	if bom {
+		switch name {
+		case "utf-16le":
+			data = append(append([]byte{}, utf16LEBOM...), data...)
+		case "utf-16be":
+			data = append(append([]byte{}, utf16BEBOM...), data...)
+		}
+	}
+	return data, name, nil
+}
+
+// textLineEnding reports the line ending most lines of text use
+func textLineEnding(text string) string {
+	crlf := strings.Count(text, "\r\n")
+	if crlf > 0 && crlf >= strings.Count(text, "\n")-crlf {
+		return "crlf"
+	}
+	return "lf"
+}
+
+// textSyntaxes lists the extensions of each language the editor
+// highlights
+var textSyntaxes = map[string][]string{
+	"markdown":   {".md", ".markdown"},
+	"json":       {".json", ".jsonc", ".json5"},
+	"yaml":       {".yaml", ".yml"},
+	"toml":       {".toml"},
+	"ini":        {".ini", ".conf", ".cfg", ".properties"},
+	"dotenv":     {".env"},
+	"xml":        {".xml", ".svg", ".plist"},
+	"html":       {".html", ".htm"},
+	"css":        {".css"},
+	"scss":       {".scss"},
+	"less":       {".less"},
+	"javascript": {".js", ".mjs", ".cjs", ".jsx"},
+	"typescript": {".ts", ".tsx"},
+	"vue":        {".vue"},
+	"shell":      {".sh", ".bash", ".zsh"},
+	"powershell": {".ps1"},
+	"bat":        {".bat", ".cmd"},
+	"python":     {".py"},
+	"go":         {".go"},
+	"rust":       {".rs"},
+	"java":       {".java"},
+	"kotlin":     {".kt"},
+	"c":          {".c", ".h"},
+	"cpp":        {".cpp", ".cc", ".hpp"},
+	"csharp":     {".cs"},
+	"php":        {".php"},
+	"ruby":       {".rb"},
+	"lua":        {".lua"},
+	"perl":       {".pl"},
+	"sql":        {".sql"},
+	"csv":        {".csv"},
+	"diff":       {".diff", ".patch"},
+	"nginx":      {".nginx"},
+}
+
+var textSyntaxByExt = func() map[string]string {
+	byExt := make(map[string]string)
+	for syntax, exts := range textSyntaxes {
+		for _, ext := range exts {
+			byExt[ext] = syntax
+		}
+	}
+	return byExt
+}()
+
+// textSyntaxNames maps file names that say more than their extension
+var textSyntaxNames = map[string]string{
+	"dockerfile":       "dockerfile",
+	"containerfile":    "dockerfile",
+	"makefile":         "makefile",
+	"caddyfile":        "caddyfile",
+	"nginx.conf":       "nginx",
+	"crontab":          "crontab",
+	"requirements.txt": "pip-requirements",
+	".env":             "dotenv",
+	".bashrc":          "shell",
+	".profile":         "shell",
+	".zshrc":           "shell",
+	".gitignore":       "ignore",
+	".dockerignore":    "ignore",
+}
+
+// textInterpreters maps the interpreter of a #! line, without its
+// version, to its language
+var textInterpreters = map[string]string{
+	"sh": "shell", "bash": "shell", "zsh": "shell", "ash": "shell", "dash": "shell",
+	"python": "python", "node": "javascript", "perl": "perl", "ruby": "ruby", "php": "php", "lua": "lua",
+}
+
+// textSyntax guesses the language of a file from its name, then from the
+// interpreter of a #! line
+func textSyntax(name, text string) string {
+	lower := strings.ToLower(name)
+	if s := textSyntaxNames[lower]; s != "" {
+		return s
+	}
+	if strings.HasPrefix(lower, "dockerfile.") || strings.HasSuffix(lower, ".dockerfile") {
+		return "dockerfile"
+	}
+	if strings.HasPrefix(lower, ".env.") {
+		return "dotenv"
+	}
+	if s := textSyntaxByExt[path.Ext(lower)]; s != "" {
+		return s
+	}
+	if line, _, _ := strings.Cut(text, "\n"); strings.HasPrefix(line, "#!") {
+		if fields := strings.Fields(line[2:]); len(fields) > 0 {
+			interp := path.Base(fields[0])
+			if interp == "env" && len(fields) > 1 {
+				interp = fields[1]
+			}
+			if s := textInterpreters[strings.TrimRight(interp, "0123456789.")]; s != "" {
+				return s
+			}
+		}
+	}
+	return "plaintext"
+}
+
+// textError answers with the status matching an editor error
+func textError(c *gin.Context, err error, p string) {
+	switch {
+	case errors.Is(err, errTextTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "limit": maxTextFileSize})
+	case errors.Is(err, errNotText):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, errTextEncoding), errors.Is(err, errTextUnmapped):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, errTextNeedsETag):
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": err.Error()})
+	default:
+		fileError(c, err, p)
+	}
+}
+
+// readTextFile reads a file the editor may open
+func readTextFile(full string) ([]byte, os.FileInfo, error) {
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, errNotText
+	}
+	if info.Size() > maxTextFileSize {
+		return nil, nil, errTextTooLarge
+	}
+	data, err := os.ReadFile(full)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > maxTextFileSize {
+		return nil, nil, errTextTooLarge
+	}
+	return data, info, nil
+}
+
+// replaceFile writes what r holds over full through a temporary file in
+// the same folder and a rename, so readers never see half of it
+func replaceFile(full string, r io.Reader, mode os.FileMode) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(full), ".edit-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), full)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+// textFileShare finds the share and the file of an editor request
+func textFileShare(shareName, p string) (models.FileShare, string, string, error) {
+	share, err := findFileShare(shareName)
+	if err != nil {
+		return share, "", "", err
+	}
+	rel, err := cleanSharePath(p)
+	if err == nil && rel == "" {
+		err = errInvalidPath
+	}
+	if err != nil {
+		return share, "", "", err
+	}
+	full, err := resolveSharePath(share, rel)
+	return share, full, rel, err
+}
+
+// GetTextFile opens a text file for the editor. encoding reads it with
+// another encoding than the one detected.
+func GetTextFile(c *gin.Context) {
+	share, full, rel, err := textFileShare(c.Query("share"), c.Query("path"))
+	if err != nil {
+		fileError(c, err, c.Query("path"))
+		return
+	}
+	data, info, err := readTextFile(full)
+	if err != nil {
+		textError(c, err, rel)
+		return
+	}
+	encoding, bom, err := detectTextEncoding(data)
+	if want := c.Query("encoding"); want != "" && err == nil {
+		if isUTF8Label(want) {
+			encoding = "utf-8"
+		} else if _, name := charset.Lookup(want); name != "" {
+			encoding = name
+		} else {
+			err = errTextEncoding
+		}
+	}
+	var text string
+	if err == nil {
+		text, err = decodeText(data, encoding, bom)
+	}
+	if err != nil {
+		textError(c, err, rel)
+		return
+	}
+	etag := textETag(data)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": TextFile{
+		Share:      share.Name,
+		Path:       rel,
+		Content:    text,
+		Encoding:   encoding,
+		BOM:        bom,
+		LineEnding: textLineEnding(text),
+		Syntax:     textSyntax(path.Base(rel), text),
+		ETag:       etag,
+		Size:       info.Size(),
+		ModTime:    info.ModTime().UnixMilli(),
+		ReadOnly:   share.ReadOnly,
+	}})
+}
+
+// SaveTextFile writes a file from the editor, or creates it when no etag
+// is given. The file is replaced in one rename, so readers never see half
+// of it.
+func SaveTextFile(c *gin.Context) {
+	var req TextFileRequest
+	// JSON escaping can take six bytes per byte of content
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, 6*maxTextFileSize+4096)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			textError(c, errTextTooLarge, req.Path)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.ETag == "" {
+		req.ETag = c.GetHeader("If-Match")
+	}
+	share, full, rel, err := textFileShare(req.Share, req.Path)
+	if err == nil && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	c.Set("auditTarget", share.Name+":"+rel)
+	data, encoding, err := encodeText(req.Content, req.Encoding, req.BOM)
+	if err == nil && len(data) > maxTextFileSize {
+		err = errTextTooLarge
+	}
+	if err != nil {
+		textError(c, err, rel)
+		return
+	}
+
+	textEdits.Lock()
+	defer textEdits.Unlock()
+	mode := os.FileMode(0644)
+	var oldSize int64
+	current, info, err := readTextFile(full)
+	switch {
+	case err == nil:
+		if req.ETag == "" {
+			textError(c, errTextNeedsETag, rel)
+			return
+		}
+		if etag := textETag(current); etag != req.ETag {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": errTextChanged.Error(), "etag": etag})
+			return
+		}
+		mode, oldSize = info.Mode().Perm(), info.Size()
+	case os.IsNotExist(err):
+		if req.ETag != "" {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": errTextChanged.Error()})
+			return
+		}
+		if dir, err := os.Stat(filepath.Dir(full)); err != nil || !dir.IsDir() {
+			fileError(c, os.ErrNotExist, path.Dir(rel))
+			return
+		}
+	default:
+		textError(c, err, rel)
+		return
+	}
+	if grow := int64(len(data)) - oldSize; grow > 0 {
+		if err := checkShareQuota(share.Name, grow); err != nil {
+			fileError(c, err, rel)
+			return
+		}
+	}
+
+	if info != nil {
+		keepVersion(share, rel, full, c.GetString("username"))
+	}
+	if _, err := replaceFile(full, bytes.NewReader(data), mode); err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	chargeShareQuota(share.Name, int64(len(data))-oldSize)
+
+	etag := textETag(data)
+	var modTime int64
+	if info, err := os.Stat(full); err == nil {
+		modTime = info.ModTime().UnixMilli()
+	}
+	c.Header("ETag", etag)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"path":     rel,
+		"encoding": encoding,
+		"etag":     etag,
+		"size":     len(data),
+		"modTime":  modTime,
+	}})
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTextEditor(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "etc"), 0755)
+	os.WriteFile(filepath.Join(root, "etc", "app.yml"), []byte("name: nas\r\nport: 80\r\n"), 0600)
+	os.WriteFile(filepath.Join(root, "etc", "latin.conf"), []byte("caf\xe9=1\n"), 0644)
+	os.WriteFile(filepath.Join(root, "etc", "win.ps1"), append([]byte{0xff, 0xfe}, 'h', 0, 'i', 0), 0644)
+	os.WriteFile(filepath.Join(root, "etc", "run"), []byte("#!/usr/bin/env python3\nprint(1)\n"), 0755)
+	os.WriteFile(filepath.Join(root, "etc", "blob.bin"), []byte("ab\x00cd"), 0644)
+	os.WriteFile(filepath.Join(root, "etc", "huge.log"), bytes.Repeat([]byte("x"), maxTextFileSize+1), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{
+		{Name: "main", Path: root},
+		{Name: "ro", Path: root, ReadOnly: true},
+	}})
+
+	r := gin.New()
+	r.GET("/text", GetTextFile)
+	r.PUT("/text", SaveTextFile)
+	open := func(query string) TextFile {
+		t.Helper()
+		w := serve(r, "GET", "/text?"+query, "")
+		var resp struct{ Data TextFile }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 {
+			t.Fatalf("open %s: %d %s", query, w.Code, w.Body.String())
+		}
+		if w.Header().Get("ETag") != resp.Data.ETag {
+			t.Fatalf("ETag header %q differs from %q", w.Header().Get("ETag"), resp.Data.ETag)
+		}
+		return resp.Data
+	}
+	save := func(req TextFileRequest) (int, map[string]interface{}) {
+		body, _ := json.Marshal(req)
+		return serveJSON(r, "PUT", "/text", string(body))
+	}
+
+	f := open("share=main&path=etc/app.yml")
+	if f.Content != "name: nas\r\nport: 80\r\n" || f.Encoding != "utf-8" || f.LineEnding != "crlf" || f.Syntax != "yaml" || f.Size != 21 {
+		t.Fatalf("unexpected file %+v", f)
+	}
+	if f := open("share=main&path=etc/latin.conf"); f.Content != "café=1\n" || f.Encoding != "windows-1252" || f.Syntax != "ini" {
+		t.Fatalf("unexpected latin-1 file %+v", f)
+	}
+	if f := open("share=main&path=etc/latin.conf&encoding=iso-8859-15"); f.Content != "café=1\n" || f.Encoding != "iso-8859-15" {
+		t.Fatalf("unexpected file with the encoding forced %+v", f)
+	}
+	if f := open("share=main&path=etc/win.ps1"); f.Content != "hi" || f.Encoding != "utf-16le" || !f.BOM || f.Syntax != "powershell" {
+		t.Fatalf("unexpected UTF-16 file %+v", f)
+	}
+	if f := open("share=main&path=etc/run"); f.Syntax != "python" {
+		t.Fatalf("expected the #! line to give python, got %q", f.Syntax)
+	}
+	for query, status := range map[string]int{
+		"share=main&path=etc/blob.bin":                  415,
+		"share=main&path=etc/huge.log":                  413,
+		"share=main&path=etc":                           415,
+		"share=main&path=etc/none.txt":                  404,
+		"share=main&path=etc/app.yml&encoding=klingon":  422,
+		"share=main&path=etc/latin.conf&encoding=utf-8": 422,
+		"share=main&path=.trash/x.txt":                  400,
+	} {
+		if w := serve(r, "GET", "/text?"+query, ""); w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", query, status, w.Code)
+		}
+	}
+
+	// Saves need the etag of what was loaded
+	if code, _ := save(TextFileRequest{Share: "main", Path: "etc/app.yml", Content: "x"}); code != 428 {
+		t.Fatalf("expected 428 without an etag, got %d", code)
+	}
+	code, resp := save(TextFileRequest{Share: "main", Path: "etc/app.yml", Content: "name: flat\r\n", ETag: f.ETag})
+	if code != 200 {
+		t.Fatalf("save: %d %v", code, resp)
+	}
+	newETag := resp["data"].(map[string]interface{})["etag"].(string)
+	if data, _ := os.ReadFile(filepath.Join(root, "etc", "app.yml")); string(data) != "name: flat\r\n" {
+		t.Fatalf("unexpected content %q", data)
+	}
+	if info, _ := os.Stat(filepath.Join(root, "etc", "app.yml")); info.Mode().Perm() != 0600 {
+		t.Fatalf("save changed the mode to %v", info.Mode().Perm())
+	}
+	code, resp = save(TextFileRequest{Share: "main", Path: "etc/app.yml", Content: "lost", ETag: f.ETag})
+	if code != 412 || resp["etag"] != newETag {
+		t.Fatalf("expected 412 with the current etag for a stale save, got %d %v", code, resp)
+	}
+
+	// Files are written back in their encoding
+	latin := open("share=main&path=etc/latin.conf")
+	if code, _ := save(TextFileRequest{Share: "main", Path: "etc/latin.conf", Content: "thé=2\n", Encoding: latin.Encoding, ETag: latin.ETag}); code != 200 {
+		t.Fatalf("save latin-1: %d", code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "etc", "latin.conf")); string(data) != "th\xe9=2\n" {
+		t.Fatalf("unexpected latin-1 bytes %q", data)
+	}
+	latin = open("share=main&path=etc/latin.conf")
+	if code, _ := save(TextFileRequest{Share: "main", Path: "etc/latin.conf", Content: "日本", Encoding: latin.Encoding, ETag: latin.ETag}); code != 422 {
+		t.Fatalf("expected 422 for text latin-1 cannot hold, got %d", code)
+	}
+	ps := open("share=main&path=etc/win.ps1")
+	save(TextFileRequest{Share: "main", Path: "etc/win.ps1", Content: "ok", Encoding: ps.Encoding, BOM: ps.BOM, ETag: ps.ETag})
+	if data, _ := os.ReadFile(filepath.Join(root, "etc", "win.ps1")); !bytes.Equal(data, []byte{0xff, 0xfe, 'o', 0, 'k', 0}) {
+		t.Fatalf("unexpected UTF-16 bytes %v", data)
+	}
+
+	// New files are created without an etag, never over an existing one
+	if code, _ := save(TextFileRequest{Share: "main", Path: "etc/notes.md", Content: "# hi"}); code != 200 {
+		t.Fatalf("create: %d", code)
+	}
+	if code, _ := save(TextFileRequest{Share: "main", Path: "etc/gone.md", Content: "x", ETag: `"abc"`}); code != 412 {
+		t.Fatalf("expected 412 for a file deleted meanwhile, got %d", code)
+	}
+	if code, _ := save(TextFileRequest{Share: "main", Path: "nodir/a.txt", Content: "x"}); code != 404 {
+		t.Fatalf("expected 404 without the folder, got %d", code)
+	}
+	if code, _ := save(TextFileRequest{Share: "ro", Path: "etc/new.txt", Content: "x"}); code != 403 {
+		t.Fatalf("expected 403 on a read-only share, got %d", code)
+	}
+	if code, _ := save(TextFileRequest{Share: "main", Path: "etc/big.txt", Content: strings.Repeat("x", maxTextFileSize+1)}); code != 413 {
+		t.Fatalf("expected 413 for a large save, got %d", code)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(root, "etc", ".edit-*")); len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+}
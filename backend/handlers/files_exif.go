@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Photo metadata is read from the EXIF block of JPEG files and of TIFF
+// based files (TIFF and most camera raw formats), and from the XMP packet
+// of JPEG files for what EXIF lacks. Only the fields the photos view uses
+// are kept.
+
+const (
+	exifMaxRead    = 1 << 20 // Of a TIFF based file; IFDs beyond are ignored
+	exifMaxEntries = 1000
+)
+
+var errNoExif = errors.New("no photo metadata")
+
+// PhotoMeta is the metadata of a photo. TakenAt is the wall clock time the
+// camera recorded, stored as if it were UTC, so it groups by the day the
+// photo was taken wherever that was.
+type PhotoMeta struct {
+	TakenAt     int64    `json:"takenAt,omitempty"`
+	Offset      string   `json:"offset,omitempty"` // Of TakenAt from UTC, e.g. "+02:00", when known
+	Make        string   `json:"make,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Lens        string   `json:"lens,omitempty"`
+	Width       int      `json:"width,omitempty"`
+	Height      int      `json:"height,omitempty"`
+	Orientation int      `json:"orientation,omitempty"`
+	Lat         *float64 `json:"lat,omitempty"`
+	Lon         *float64 `json:"lon,omitempty"`
+	Altitude    *float64 `json:"altitude,omitempty"`
+	Exposure    string   `json:"exposure,omitempty"` // e.g. "1/125"
+	FNumber     float64  `json:"fNumber,omitempty"`
+	ISO         int      `json:"iso,omitempty"`
+	FocalLength float64  `json:"focalLength,omitempty"`
+}
+
+// readPhotoMeta reads the metadata of a JPEG or TIFF based file
+func readPhotoMeta(full string) (*PhotoMeta, error) {
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return nil, errNoExif
+	}
+	meta := &PhotoMeta{}
+	switch {
+	case head[0] == 0xFF && head[1] == 0xD8:
+		f.Seek(2, io.SeekStart)
+		err = readJpegMeta(f, meta)
+	case string(head) == "II*\x00" || string(head) == "MM\x00*":
+		f.Seek(0, io.SeekStart)
+		data, _ := io.ReadAll(io.LimitReader(f, exifMaxRead))
+		err = parseTiffMeta(data, meta)
+	default:
+		return nil, errNoExif
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *meta == (PhotoMeta{}) {
+		return nil, errNoExif
+	}
+	return meta, nil
+}
+
+// readJpegMeta walks the JPEG segments up to the image data
+func readJpegMeta(r io.Reader, meta *PhotoMeta) error {
+	var xmp []byte
+	found := false
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:2]); err != nil || marker[0] != 0xFF {
+			break
+		}
+		// Fill bytes
+		for marker[1] == 0xFF {
+			if _, err := io.ReadFull(r, marker[1:2]); err != nil {
+				return errNoExif
+			}
+		}
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			break
+		}
+		if _, err := io.ReadFull(r, marker[2:4]); err != nil {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(marker[2:4])) - 2
+		if n < 0 {
+			break
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			break
+		}
+		switch {
+		case marker[1] == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")):
+			if parseTiffMeta(seg[6:], meta) == nil {
+				found = true
+			}
+		case marker[1] == 0xE1 && bytes.HasPrefix(seg, []byte("http://ns.adobe.com/xap/1.0/\x00")):
+			xmp = seg
+		case marker[1] >= 0xC0 && marker[1] <= 0xCF && marker[1] != 0xC4 && marker[1] != 0xC8 && marker[1] != 0xCC && len(seg) >= 5:
+			// Start of frame: the real size when EXIF has none
+			if meta.Width == 0 {
+				meta.Height = int(binary.BigEndian.Uint16(seg[1:3]))
+				meta.Width = int(binary.BigEndian.Uint16(seg[3:5]))
+			}
+		}
+	}
+	if xmp != nil {
+		parseXmpMeta(xmp, meta)
+		found = true
+	}
+	if !found && meta.Width == 0 {
+		return errNoExif
+	}
+	return nil
+}
+
+// tiffReader reads IFDs of a TIFF block
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// ifd reads the entries of the IFD at off
+func (t tiffReader) ifd(off uint32) map[uint16]tiffEntry {
+	entries := make(map[uint16]tiffEntry)
+	if int64(off)+2 > int64(len(t.data)) {
+		return entries
+	}
+	n := int(t.order.Uint16(t.data[off:]))
+	if n > exifMaxEntries {
+		return entries
+	}
+	sizes := map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	for i := 0; i < n; i++ {
+		p := int64(off) + 2 + int64(i)*12
+		if p+12 > int64(len(t.data)) {
+			break
+		}
+		e := t.data[p : p+12]
+		typ, count := t.order.Uint16(e[2:]), t.order.Uint32(e[4:])
+		size := int64(sizes[typ]) * int64(count)
+		if size == 0 {
+			continue
+		}
+		value := e[8:12]
+		if size > 4 {
+			at := int64(t.order.Uint32(e[8:]))
+			if at+size > int64(len(t.data)) {
+				continue
+			}
+			value = t.data[at : at+size]
+		}
+		entries[t.order.Uint16(e)] = tiffEntry{typ: typ, count: count, value: value[:min(size, int64(len(value)))]}
+	}
+	return entries
+}
+
+func (t tiffReader) str(e tiffEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// uint reads a SHORT or LONG value
+func (t tiffReader) uint(e tiffEntry) (uint32, bool) {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(t.order.Uint16(e.value)), true
+	case e.typ == 4 && len(e.value) >= 4:
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+// rationals reads RATIONAL or SRATIONAL values
+func (t tiffReader) rationals(e tiffEntry) [][2]int64 {
+	var out [][2]int64
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num, den := int64(t.order.Uint32(e.value[i:])), int64(t.order.Uint32(e.value[i+4:]))
+		if e.typ == 10 {
+			num, den = int64(int32(num)), int64(int32(den))
+		}
+		out = append(out, [2]int64{num, den})
+	}
+	return out
+}
+
+func ratio(r [2]int64) (float64, bool) {
+	if r[1] == 0 {
+		return 0, false
+	}
+	return float64(r[0]) / float64(r[1]), true
+}
+
+// parseTiffMeta reads IFD0 with its EXIF and GPS IFDs
+func parseTiffMeta(data []byte, meta *PhotoMeta) error {
+	if len(data) < 8 {
+		return errNoExif
+	}
+	t := tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return errNoExif
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return errNoExif
+	}
+	ifd0 := t.ifd(t.order.Uint32(data[4:]))
+	if e, ok := ifd0[0x010F]; ok {
+		meta.Make = t.str(e)
+	}
+	if e, ok := ifd0[0x0110]; ok {
+		meta.Model = t.str(e)
+	}
+	if e, ok := ifd0[0x0112]; ok {
+		if v, ok := t.uint(e); ok {
+			meta.Orientation = int(v)
+		}
+	}
+	taken := ""
+	if e, ok := ifd0[0x0132]; ok {
+		taken = t.str(e)
+	}
+	if e, ok := ifd0[0x8769]; ok {
+		if off, ok := t.uint(e); ok {
+			exif := t.ifd(off)
+			if e, ok := exif[0x9003]; ok {
+				taken = t.str(e)
+			}
+			if e, ok := exif[0x9011]; ok {
+				meta.Offset = t.str(e)
+			}
+			if e, ok := exif[0xA434]; ok {
+				meta.Lens = t.str(e)
+			}
+			if e, ok := exif[0x8827]; ok {
+				if v, ok := t.uint(e); ok {
+					meta.ISO = int(v)
+				}
+			}
+			if e, ok := exif[0xA002]; ok {
+				if v, ok := t.uint(e); ok {
+					meta.Width = int(v)
+				}
+			}
+			if e, ok := exif[0xA003]; ok {
+				if v, ok := t.uint(e); ok {
+					meta.Height = int(v)
+				}
+			}
+			if r := t.rationals(exif[0x829A]); len(r) > 0 && r[0][1] != 0 {
+				if r[0][0] == 1 || r[0][0] == 0 {
+					meta.Exposure = fmt.Sprintf("%d/%d", r[0][0], r[0][1])
+				} else if v, _ := ratio(r[0]); v < 1 {
+					meta.Exposure = fmt.Sprintf("1/%d", int(math.Round(1/v)))
+				} else {
+					meta.Exposure = strconv.FormatFloat(v, 'f', -1, 64)
+				}
+			}
+			if r := t.rationals(exif[0x829D]); len(r) > 0 {
+				meta.FNumber, _ = ratio(r[0])
+			}
+			if r := t.rationals(exif[0x920A]); len(r) > 0 {
+				meta.FocalLength, _ = ratio(r[0])
+			}
+		}
+	}
+	if ts, ok := parseExifTime(taken); ok {
+		meta.TakenAt = ts
+	}
+	if e, ok := ifd0[0x8825]; ok {
+		if off, ok := t.uint(e); ok {
+			gps := t.ifd(off)
+			lat, latOK := gpsCoord(t, gps[2], t.str(gps[1]), "S")
+			lon, lonOK := gpsCoord(t, gps[4], t.str(gps[3]), "W")
+			if latOK && lonOK && (lat != 0 || lon != 0) {
+				meta.Lat, meta.Lon = &lat, &lon
+			}
+			if r := t.rationals(gps[6]); len(r) > 0 {
+				if alt, ok := ratio(r[0]); ok {
+					if len(gps[5].value) > 0 && gps[5].value[0] == 1 {
+						alt = -alt
+					}
+					meta.Altitude = &alt
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// gpsCoord turns degrees, minutes and seconds into signed degrees
+func gpsCoord(t tiffReader, e tiffEntry, ref, negative string) (float64, bool) {
+	r := t.rationals(e)
+	if len(r) < 3 {
+		return 0, false
+	}
+	var v float64
+	for i, div := range []float64{1, 60, 3600} {
+		f, ok := ratio(r[i])
+		if !ok {
+			return 0, false
+		}
+		v += f / div
+	}
+	if strings.EqualFold(ref, negative) {
+		v = -v
+	}
+	if math.Abs(v) > 180 {
+		return 0, false
+	}
+	return v, true
+}
+
+// parseExifTime reads "2006:01:02 15:04:05"; cameras without a clock write
+// zeros or blanks
+func parseExifTime(s string) (int64, bool) {
+	for _, layout := range []string{"2006:01:02 15:04:05", "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if len(s) < len(layout) {
+			continue
+		}
+		if t, err := time.Parse(layout, s[:len(layout)]); err == nil && t.Year() > 1900 {
+			return t.UnixMilli(), true
+		}
+	}
+	return 0, false
+}
+
+var (
+	xmpDateRe = regexp.MustCompile(`(?:exif:DateTimeOriginal|photoshop:DateCreated|xmp:CreateDate)(?:="|>)([0-9T:\-]+)`)
+	xmpGpsRe  = regexp.MustCompile(`exif:GPS(Latitude|Longitude)(?:="|>)([0-9]+),([0-9.]+)([NSEW])`)
+)
+
+// parseXmpMeta fills in the date and position from an XMP packet when
+// EXIF had none
+func parseXmpMeta(xmp []byte, meta *PhotoMeta) {
+	if meta.TakenAt == 0 {
+		if m := xmpDateRe.FindSubmatch(xmp); m != nil {
+			if ts, ok := parseExifTime(string(m[1])); ok {
+				meta.TakenAt = ts
+			}
+		}
+	}
+	if meta.Lat != nil {
+		return
+	}
+	var lat, lon *float64
+	for _, m := range xmpGpsRe.FindAllSubmatch(xmp, 2) {
+		deg, _ := strconv.ParseFloat(string(m[2]), 64)
+		mins, _ := strconv.ParseFloat(string(m[3]), 64)
+		v := deg + mins/60
+		if m[4][0] == 'S' || m[4][0] == 'W' {
+			v = -v
+		}
+		if string(m[1]) == "Latitude" {
+			lat = &v
+		} else {
+			lon = &v
+		}
+	}
+	if lat != nil && lon != nil {
+		meta.Lat, meta.Lon = lat, lon
+	}
+}
@@ -0,0 +1,452 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Videos the browser cannot play (HEVC, AVI, ...) are transcoded by ffmpeg
+// into an HLS playlist the player can start on while later segments are
+// still being written. A session belongs to a file version and encoder
+// setting, so reopening the same video reuses it. Its random ID is the
+// only key to the segments, which are served without login because
+// players fetch them without the Authorization header.
+//
+// Transcodes nobody fetches from for hlsIdleStop are stopped, and session
+// folders are deleted KeepMinutes after their last use.
+
+const (
+	hlsDefaultMaxSessions = 2
+	hlsDefaultKeepMinutes = 60
+	hlsDefaultDevice      = "/dev/dri/renderD128"
+	hlsSegmentSeconds     = 6
+	hlsIdleStop           = 2 * time.Minute
+	hlsCleanupInterval    = time.Minute
+	// How long a playlist request waits for ffmpeg to write the first one
+	hlsStartWait = 20 * time.Second
+	hlsPlaylist  = "index.m3u8"
+)
+
+var hlsSegmentPattern = regexp.MustCompile(`^seg\d{5}\.ts$`)
+
+var errTooManyTranscodes = errors.New("Too many transcodes running")
+
+type hlsSession struct {
+	id   string
+	key  string
+	dir  string
+	done chan struct{} // Closed when ffmpeg exits
+	stop context.CancelFunc
+	err  error // Set before done is closed
+
+	mu       sync.Mutex
+	lastUsed time.Time
+}
+
+func (s *hlsSession) touch() {
+	s.mu.Lock()
+	s.lastUsed = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *hlsSession) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastUsed)
+}
+
+func (s *hlsSession) running() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+var hlsSessions = struct {
+	sync.Mutex
+	byID  map[string]*hlsSession
+	byKey map[string]*hlsSession
+}{byID: make(map[string]*hlsSession), byKey: make(map[string]*hlsSession)}
+
+// decodeTranscodeSettings reads the "transcode" field of a system config
+// update. The browser never sees the folder and device, so blank ones keep
+// the current values.
+func decodeTranscodeSettings(raw interface{}, current *models.TranscodeSettings) (*models.TranscodeSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid transcode settings")
+	}
+	settings := &models.TranscodeSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid transcode settings")
+	}
+	settings.Dir = strings.TrimSpace(settings.Dir)
+	settings.Device = strings.TrimSpace(settings.Device)
+	if current != nil {
+		if settings.Dir == "" {
+			settings.Dir = current.Dir
+		}
+		if settings.Device == "" {
+			settings.Device = current.Device
+		}
+	}
+	switch settings.HwAccel {
+	case "", "vaapi", "qsv":
+	default:
+		return nil, fmt.Errorf("Invalid hardware acceleration %q", settings.HwAccel)
+	}
+	if (settings.Dir != "" && !filepath.IsAbs(settings.Dir)) || (settings.Device != "" && !filepath.IsAbs(settings.Device)) {
+		return nil, fmt.Errorf("Transcode folder and device must be absolute paths")
+	}
+	if settings.MaxSessions < 0 || settings.KeepMinutes < 0 {
+		return nil, fmt.Errorf("Transcode limits cannot be negative")
+	}
+	return settings, nil
+}
+
+// loadTranscodeSettings returns the settings with the defaults filled in
+func loadTranscodeSettings() models.TranscodeSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	var s models.TranscodeSettings
+	if sysConfig.Transcode != nil {
+		s = *sysConfig.Transcode
+	}
+	if s.Device == "" {
+		s.Device = hlsDefaultDevice
+	}
+	if s.Dir == "" {
+		s.Dir = filepath.Join(config.DataDir, "transcode")
+	}
+	if s.MaxSessions == 0 {
+		s.MaxSessions = hlsDefaultMaxSessions
+	}
+	if s.KeepMinutes == 0 {
+		s.KeepMinutes = hlsDefaultKeepMinutes
+	}
+	return s
+}
+
+// hlsArgs builds the ffmpeg command line writing the HLS playlist of src
+// into dir
+func hlsArgs(src, dir string, s models.TranscodeSettings) []string {
+	args := []string{"-nostdin", "-loglevel", "error", "-y"}
+	var video []string
+	switch s.HwAccel {
+	case "vaapi":
+		args = append(args, "-vaapi_device", s.Device)
+		video = []string{"-vf", "format=nv12,hwupload", "-c:v", "h264_vaapi", "-qp", "24"}
+	case "qsv":
+		args = append(args, "-init_hw_device", "vaapi=va:"+s.Device, "-init_hw_device", "qsv=hw@va", "-filter_hw_device", "hw")
+		video = []string{"-vf", "hwupload=extra_hw_frames=64,format=qsv", "-c:v", "h264_qsv", "-global_quality", "24"}
+	default:
+		// Capped at 1080p so a 4K HEVC file does not keep the CPU busy for hours
+		video = []string{"-vf", "scale=-2:min(1080\\,ih)", "-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p"}
+	}
+	args = append(args, "-i", src, "-map", "0:v:0", "-map", "0:a:0?")
+	args = append(args, video...)
+	return append(args,
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+		"-c:a", "aac", "-ac", "2", "-b:a", "160k",
+		"-f", "hls", "-hls_time", strconv.Itoa(hlsSegmentSeconds), "-hls_list_size", "0",
+		"-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"),
+		filepath.Join(dir, hlsPlaylist))
+}
+
+// hlsPlaylistComplete reports whether dir holds a finished transcode
+func hlsPlaylistComplete(dir string) bool {
+	data, err := os.ReadFile(filepath.Join(dir, hlsPlaylist))
+	return err == nil && strings.Contains(string(data), "#EXT-X-ENDLIST")
+}
+
+// startHlsSession returns the session of a file, starting ffmpeg unless a
+// running or finished one exists
+func startHlsSession(full string, info os.FileInfo) (*hlsSession, error) {
+	bin, err := ffmpegPath()
+	if err != nil {
+		return nil, err
+	}
+	settings := loadTranscodeSettings()
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s", full, info.Size(), info.ModTime().UnixNano(), settings.HwAccel)))
+	key := hex.EncodeToString(sum[:16])
+
+	hlsSessions.Lock()
+	defer hlsSessions.Unlock()
+	if s := hlsSessions.byKey[key]; s != nil && (s.running() || s.err == nil) {
+		s.touch()
+		return s, nil
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	s := &hlsSession{id: hex.EncodeToString(idBytes), key: key, dir: filepath.Join(settings.Dir, key), done: make(chan struct{}), lastUsed: time.Now()}
+	if old := hlsSessions.byKey[key]; old != nil {
+		delete(hlsSessions.byID, old.id)
+	}
+
+	// Left by an earlier run of the server
+	if hlsPlaylistComplete(s.dir) {
+		s.stop = func() {}
+		close(s.done)
+		hlsSessions.byID[s.id], hlsSessions.byKey[key] = s, s
+		return s, nil
+	}
+
+	running := 0
+	var idlest *hlsSession
+	for _, other := range hlsSessions.byID {
+		if other.running() {
+			running++
+			if idlest == nil || other.idle() > idlest.idle() {
+				idlest = other
+			}
+		}
+	}
+	if running >= settings.MaxSessions {
+		// Make room only at the expense of a stream nobody is watching
+		if idlest == nil || idlest.idle() < 30*time.Second {
+			return nil, errTooManyTranscodes
+		}
+		idlest.stop()
+	}
+
+	os.RemoveAll(s.dir)
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(backgroundCtx)
+	s.stop = cancel
+	cmd := exec.CommandContext(ctx, bin, hlsArgs(full, s.dir, settings)...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	filesLog.Info("Transcode started", "file", full, "hwaccel", settings.HwAccel)
+	go func() {
+		err := cmd.Wait()
+		if err != nil && ctx.Err() == nil {
+			msg := strings.TrimSpace(stderr.String())
+			if len(msg) > 500 {
+				msg = msg[len(msg)-500:]
+			}
+			filesLog.Warn("Transcode failed", "file", full, "error", err, "output", msg)
+			s.err = err
+		} else if ctx.Err() != nil {
+			s.err = ctx.Err()
+		}
+		cancel()
+		close(s.done)
+	}()
+	hlsSessions.byID[s.id], hlsSessions.byKey[key] = s, s
+	return s, nil
+}
+
+func findHlsSession(id string) *hlsSession {
+	hlsSessions.Lock()
+	defer hlsSessions.Unlock()
+	return hlsSessions.byID[id]
+}
+
+// StartTranscode starts or reuses the HLS transcode of a share video and
+// returns its playlist URL
+func StartTranscode(c *gin.Context) {
+	var req struct {
+		Share string `json:"share"`
+		Path  string `json:"path"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	full, err := resolveSharePath(share, req.Path)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	if info.IsDir() || thumbKind(full) != "video" {
+		fileError(c, errInvalidPath, req.Path)
+		return
+	}
+	s, err := startHlsSession(full, info)
+	switch {
+	case errors.Is(err, errNoFfmpeg):
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Transcoding is not available"})
+		return
+	case errors.Is(err, errTooManyTranscodes):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		fileError(c, err, req.Path)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"id":       s.id,
+		"playlist": "/api/hls/" + s.id + "/" + hlsPlaylist,
+		"complete": !s.running(),
+	}})
+}
+
+// StopTranscode ends a transcode the player no longer needs
+func StopTranscode(c *gin.Context) {
+	hlsSessions.Lock()
+	s := hlsSessions.byID[c.Param("id")]
+	if s != nil {
+		delete(hlsSessions.byID, s.id)
+		if hlsSessions.byKey[s.key] == s {
+			delete(hlsSessions.byKey, s.key)
+		}
+	}
+	hlsSessions.Unlock()
+	if s == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	s.stop()
+	<-s.done
+	os.RemoveAll(s.dir)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ServeHls serves the playlist and segments of a transcode. The playlist
+// waits for ffmpeg to write its first segment.
+func ServeHls(c *gin.Context) {
+	s := findHlsSession(c.Param("id"))
+	if s == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	name := c.Param("file")
+	if name != hlsPlaylist && !hlsSegmentPattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
+	s.touch()
+	full := filepath.Join(s.dir, name)
+	if name == hlsPlaylist {
+		deadline := time.NewTimer(hlsStartWait)
+		defer deadline.Stop()
+		tick := time.NewTicker(200 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			if _, err := os.Stat(full); err == nil {
+				break
+			}
+			if !s.running() {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Transcoding failed"})
+				return
+			}
+			select {
+			case <-tick.C:
+			case <-deadline.C:
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Transcoding is starting"})
+				return
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+		c.Header("Cache-Control", "no-cache")
+	} else {
+		c.Header("Cache-Control", "private, max-age=3600")
+	}
+	c.Header("Content-Type", fileMime(name))
+	c.File(full)
+}
+
+// StartTranscodeCleanup stops idle transcodes and deletes old sessions
+func StartTranscodeCleanup() {
+	go func() {
+		ticker := time.NewTicker(hlsCleanupInterval)
+		defer ticker.Stop()
+		beat := registerWorker("transcode.cleanup", hlsCleanupInterval)
+		for {
+			beat()
+			cleanupTranscodes(loadTranscodeSettings())
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func cleanupTranscodes(settings models.TranscodeSettings) {
+	keep := time.Duration(settings.KeepMinutes) * time.Minute
+	live := make(map[string]bool)
+	var expired []*hlsSession
+	hlsSessions.Lock()
+	for id, s := range hlsSessions.byID {
+		idle := s.idle()
+		if s.running() && idle > hlsIdleStop {
+			s.stop()
+		}
+		if idle > keep {
+			delete(hlsSessions.byID, id)
+			if hlsSessions.byKey[s.key] == s {
+				delete(hlsSessions.byKey, s.key)
+			}
+			expired = append(expired, s)
+			continue
+		}
+		live[s.key] = true
+	}
+	hlsSessions.Unlock()
+	for _, s := range expired {
+		s.stop()
+		<-s.done
+		os.RemoveAll(s.dir)
+	}
+
+	// Folders of sessions from before a restart
+	entries, err := os.ReadDir(settings.Dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || live[e.Name()] {
+			continue
+		}
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > keep {
+			os.RemoveAll(filepath.Join(settings.Dir, e.Name()))
+		}
+	}
+}
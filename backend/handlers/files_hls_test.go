@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTranscodeHls(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	// Stands in for ffmpeg: writes one segment and the playlist, the last
+	// argument, next to it
+	fake := filepath.Join(t.TempDir(), "ffmpeg")
+	os.WriteFile(fake, []byte(`#!/bin/sh
+for last; do :; done
+dir=$(dirname "$last")
+printf ts > "$dir/seg00000.ts"
+printf '#EXTM3U\n#EXTINF:6,\nseg00000.ts\n#EXT-X-ENDLIST\n' > "$last"
+`), 0755)
+	t.Setenv("FFMPEG_PATH", fake)
+
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "movie.mkv"), []byte("hevc"), 0644)
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("x"), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	r := gin.New()
+	r.POST("/files/hls", StartTranscode)
+	r.DELETE("/files/hls/:id", StopTranscode)
+	r.GET("/api/hls/:id/:file", ServeHls)
+	start := func() map[string]interface{} {
+		var resp map[string]interface{}
+		w := serve(r, "POST", "/files/hls", `{"share":"main","path":"movie.mkv"}`)
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 {
+			t.Fatalf("start failed: %d %v", w.Code, resp)
+		}
+		return resp["data"].(map[string]interface{})
+	}
+
+	session := start()
+	playlist := session["playlist"].(string)
+	if w := serve(r, "GET", playlist, ""); w.Code != 200 || !strings.Contains(w.Body.String(), "seg00000.ts") {
+		t.Fatalf("unexpected playlist %d %q", w.Code, w.Body.String())
+	}
+	base := strings.TrimSuffix(playlist, "index.m3u8")
+	if w := serve(r, "GET", base+"seg00000.ts", ""); w.Code != 200 || w.Body.String() != "ts" || w.Header().Get("Content-Type") != "video/mp2t" {
+		t.Fatalf("unexpected segment %d %v", w.Code, w.Header())
+	}
+	if w := serve(r, "GET", base+"secret.txt", ""); w.Code != 400 {
+		t.Fatalf("expected other names to be refused, got %d", w.Code)
+	}
+	if again := start(); again["id"] != session["id"] {
+		t.Fatalf("expected the session to be reused, got %v", again)
+	}
+	if w := serve(r, "POST", "/files/hls", `{"share":"main","path":"notes.txt"}`); w.Code != 400 {
+		t.Fatalf("expected a non-video to be refused, got %d", w.Code)
+	}
+	if !strings.Contains(strings.Join(hlsArgs("in.mkv", "out", models.TranscodeSettings{HwAccel: "vaapi", Device: "/dev/dri/renderD128"}), " "), "-vaapi_device /dev/dri/renderD128") {
+		t.Fatalf("expected the VAAPI device in the ffmpeg arguments")
+	}
+
+	// Expired sessions and their folders go away
+	cleanupTranscodes(models.TranscodeSettings{Dir: filepath.Join(config.DataDir, "transcode"), KeepMinutes: -1})
+	if w := serve(r, "GET", playlist, ""); w.Code != 404 {
+		t.Fatalf("expected the session to be cleaned up, got %d", w.Code)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(config.DataDir, "transcode")); len(entries) != 0 {
+		t.Fatalf("expected the transcode folder to be emptied, got %d entries", len(entries))
+	}
+}
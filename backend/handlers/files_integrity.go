@@ -0,0 +1,591 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The integrity checker keeps a manifest of SHA-256 checksums for every
+// file of a share in DataDir/integrity and reads the whole share again on
+// a schedule. A file whose content or size changed while its mtime did
+// not was not written through the file system, so it is reported as
+// corrupted, e.g. bit rot or a failing disk, and raises an alert. Files
+// changed the normal way just get a new checksum. A corrupted file keeps
+// its old checksum, and is reported again, until it is accepted.
+
+const (
+	integrityCheckInterval  = time.Hour
+	integrityDefaultDays    = 30
+	integrityKeepReports    = 50
+	integrityMaxIssues      = 1000 // Per report, the count is always exact
+	integrityAlertListFiles = 10
+)
+
+var (
+	errIntegrityRunning    = errors.New("A check is already running")
+	errIntegrityNotRunning = errors.New("No check is running")
+	errNoIntegrityReport   = errors.New("Report not found")
+)
+
+// integrityEntry is the recorded state of one file
+type integrityEntry struct {
+	Hash    string `json:"h"`
+	Size    int64  `json:"s"`
+	ModTime int64  `json:"m"` // Unix ns
+	Checked int64  `json:"c"` // Unix ms of the last hash
+}
+
+// integrityManifest holds the checksums of a share
+type integrityManifest struct {
+	Share     string                     `json:"share"`
+	Files     map[string]*integrityEntry `json:"files"`
+	CheckedAt int64                      `json:"checkedAt"` // Last complete run
+}
+
+// IntegrityIssue is a file whose content changed behind the file system
+type IntegrityIssue struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Size     int64  `json:"size"`
+	OldSize  int64  `json:"oldSize"`
+	ModTime  int64  `json:"modTime"`
+}
+
+// IntegrityReport is the outcome of one check of a share
+type IntegrityReport struct {
+	ID         string           `json:"id"`
+	Share      string           `json:"share"`
+	StartedAt  int64            `json:"startedAt"`
+	FinishedAt int64            `json:"finishedAt"`
+	Files      int64            `json:"files"`   // Files hashed
+	Bytes      int64            `json:"bytes"`   // Bytes hashed
+	Added      int64            `json:"added"`   // New files recorded
+	Updated    int64            `json:"updated"` // Files changed the normal way
+	Missing    int64            `json:"missing"` // Recorded files that are gone
+	Errors     int64            `json:"errors"`  // Files that could not be read
+	Corrupted  int64            `json:"corrupted"`
+	Cancelled  bool             `json:"cancelled,omitempty"`
+	Issues     []IntegrityIssue `json:"issues,omitempty"`
+}
+
+// IntegrityStatus tells how far a running check is
+type IntegrityStatus struct {
+	Checking  bool  `json:"checking"`
+	Files     int64 `json:"files,omitempty"`
+	Bytes     int64 `json:"bytes,omitempty"`
+	StartedAt int64 `json:"startedAt,omitempty"`
+	CheckedAt int64 `json:"checkedAt,omitempty"`
+	Recorded  int   `json:"recorded"` // Files in the manifest
+}
+
+type integrityRun struct {
+	started time.Time
+	cancel  context.CancelFunc
+	files   atomic.Int64
+	bytes   atomic.Int64
+}
+
+var integrityJobs = struct {
+	sync.Mutex
+	running map[string]*integrityRun
+}{running: make(map[string]*integrityRun)}
+
+// integrityFiles serializes access to the manifests and reports on disk
+var integrityFiles sync.Mutex
+
+func integrityDir() string {
+	return filepath.Join(config.DataDir, "integrity")
+}
+
+func integrityManifestFile(share string) string {
+	return filepath.Join(integrityDir(), share+".json")
+}
+
+func integrityReportsFile() string {
+	return filepath.Join(integrityDir(), "reports.json")
+}
+
+func loadIntegrityManifest(share string) *integrityManifest {
+	m := &integrityManifest{}
+	if err := utils.ReadJSON(integrityManifestFile(share), m); err != nil || m.Files == nil {
+		m = &integrityManifest{Files: make(map[string]*integrityEntry)}
+	}
+	m.Share = share
+	return m
+}
+
+func saveIntegrityManifest(m *integrityManifest) error {
+	if err := os.MkdirAll(integrityDir(), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(integrityManifestFile(m.Share), data)
+}
+
+// loadIntegrityReports returns the reports, newest first
+func loadIntegrityReports() []IntegrityReport {
+	var reports []IntegrityReport
+	_ = utils.ReadJSON(integrityReportsFile(), &reports)
+	return reports
+}
+
+func addIntegrityReport(report IntegrityReport) error {
+	reports := append([]IntegrityReport{report}, loadIntegrityReports()...)
+	if len(reports) > integrityKeepReports {
+		reports = reports[:integrityKeepReports]
+	}
+	if err := os.MkdirAll(integrityDir(), 0755); err != nil {
+		return err
+	}
+	return utils.WriteJSON(integrityReportsFile(), reports)
+}
+
+func integritySettings() models.IntegritySettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.Integrity == nil {
+		return models.IntegritySettings{}
+	}
+	settings := *sysConfig.Integrity
+	if settings.IntervalDays <= 0 {
+		settings.IntervalDays = integrityDefaultDays
+	}
+	return settings
+}
+
+func decodeIntegritySettings(raw interface{}) (*models.IntegritySettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid integrity settings")
+	}
+	settings := &models.IntegritySettings{}
+	if err := json.Unmarshal(data, settings); err != nil || settings.IntervalDays < 0 {
+		return nil, fmt.Errorf("Invalid integrity settings")
+	}
+	return settings, nil
+}
+
+// startIntegrityCheck checks a share in the background and calls done, if
+// set, once it is over
+func startIntegrityCheck(share models.FileShare, done func()) (*integrityRun, error) {
+	integrityJobs.Lock()
+	defer integrityJobs.Unlock()
+	if integrityJobs.running[share.Name] != nil {
+		return nil, errIntegrityRunning
+	}
+	ctx, cancel := context.WithCancel(backgroundCtx)
+	run := &integrityRun{started: time.Now(), cancel: cancel}
+	integrityJobs.running[share.Name] = run
+	go func() {
+		defer cancel()
+		if done != nil {
+			defer done()
+		}
+		defer func() {
+			integrityJobs.Lock()
+			delete(integrityJobs.running, share.Name)
+			integrityJobs.Unlock()
+		}()
+		report, err := checkIntegrity(ctx, share, run)
+		if err != nil {
+			if backgroundCtx.Err() == nil {
+				filesLog.Warn("Integrity check failed", "share", share.Name, "error", err)
+			}
+			return
+		}
+		if report.Corrupted > 0 {
+			raiseIntegrityAlert(report)
+		}
+	}()
+	return run, nil
+}
+
+// checkIntegrity hashes every file of the share against its manifest
+func checkIntegrity(ctx context.Context, share models.FileShare, run *integrityRun) (IntegrityReport, error) {
+	report := IntegrityReport{ID: randomHexID(8), Share: share.Name, StartedAt: run.started.UnixMilli()}
+	root, err := resolveSharePath(share, "")
+	if err != nil {
+		return report, err
+	}
+	integrityFiles.Lock()
+	manifest := loadIntegrityManifest(share.Name)
+	integrityFiles.Unlock()
+
+	seen := make(map[string]bool, len(manifest.Files))
+	err = filepath.WalkDir(root, func(full string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			report.Errors++
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(root, full)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if hiddenShareDir(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		seen[rel] = true
+		before, err := d.Info()
+		if err != nil {
+			report.Errors++
+			return nil
+		}
+		hash, err := hashDupeFile(ctx, full, -1, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			report.Errors++
+			return nil
+		}
+		// Written to while it was read; it is hashed again next time
+		after, err := os.Stat(full)
+		if err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+			delete(seen, rel)
+			return nil
+		}
+		run.files.Add(1)
+		run.bytes.Add(after.Size())
+		report.Files++
+		report.Bytes += after.Size()
+
+		now := time.Now().UnixMilli()
+		entry := &integrityEntry{Hash: hash, Size: after.Size(), ModTime: after.ModTime().UnixNano(), Checked: now}
+		old := manifest.Files[rel]
+		switch {
+		case old == nil:
+			report.Added++
+		case old.ModTime != entry.ModTime:
+			report.Updated++
+		case old.Hash != entry.Hash || old.Size != entry.Size:
+			report.Corrupted++
+			if len(report.Issues) < integrityMaxIssues {
+				report.Issues = append(report.Issues, IntegrityIssue{
+					Path:     rel,
+					Expected: old.Hash,
+					Actual:   entry.Hash,
+					Size:     entry.Size,
+					OldSize:  old.Size,
+					ModTime:  after.ModTime().UnixMilli(),
+				})
+			}
+			// Keep what the file should be until the change is accepted
+			old.Checked = now
+			return nil
+		}
+		manifest.Files[rel] = entry
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		return report, err
+	}
+
+	integrityFiles.Lock()
+	defer integrityFiles.Unlock()
+	// Accepted while the check ran
+	for rel, entry := range loadIntegrityManifest(share.Name).Files {
+		if old := manifest.Files[rel]; old != nil && entry.Checked > old.Checked && entry.Hash != old.Hash {
+			manifest.Files[rel] = entry
+		}
+	}
+	if ctx.Err() != nil {
+		report.Cancelled = true
+	} else {
+		for rel := range manifest.Files {
+			if !seen[rel] {
+				delete(manifest.Files, rel)
+				report.Missing++
+			}
+		}
+		manifest.CheckedAt = time.Now().UnixMilli()
+	}
+	report.FinishedAt = time.Now().UnixMilli()
+	if err := saveIntegrityManifest(manifest); err != nil {
+		return report, err
+	}
+	if err := addIntegrityReport(report); err != nil {
+		return report, err
+	}
+	filesLog.Info("Integrity checked", "share", share.Name, "files", report.Files, "corrupted", report.Corrupted, "cancelled", report.Cancelled, "took", time.Since(run.started).Round(time.Millisecond))
+	return report, nil
+}
+
+func raiseIntegrityAlert(report IntegrityReport) {
+	paths := make([]string, 0, integrityAlertListFiles)
+	for i, issue := range report.Issues {
+		if i == integrityAlertListFiles {
+			break
+		}
+		paths = append(paths, issue.Path)
+	}
+	body := strings.Join(paths, "\n")
+	if more := report.Corrupted - int64(len(paths)); more > 0 {
+		body += "\n" + i18n.T(notifyLocale(), "notify_integrity_more", more)
+	}
+	filesLog.Warn("Files changed without a new mtime", "share", report.Share, "count", report.Corrupted, "report", report.ID)
+	sendNotification(backgroundCtx, Notification{
+		Title:  i18n.T(notifyLocale(), "notify_integrity_alert", report.Corrupted, report.Share),
+		Body:   body,
+		Source: "integrity",
+	}, integritySettings().Channels)
+	fireWebhook(WebhookIntegrityAlert, map[string]interface{}{
+		"share":     report.Share,
+		"report":    report.ID,
+		"corrupted": report.Corrupted,
+		"files":     paths,
+	})
+}
+
+// StartIntegrityChecker checks the shares whose last complete check is
+// older than the configured interval, one share at a time
+func StartIntegrityChecker() {
+	go func() {
+		ticker := time.NewTicker(integrityCheckInterval)
+		defer ticker.Stop()
+		beat := registerWorker("integrity.check", integrityCheckInterval)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			beat()
+			settings := integritySettings()
+			if !settings.Enable {
+				continue
+			}
+			interval := time.Duration(settings.IntervalDays) * 24 * time.Hour
+			for _, share := range loadFileShares() {
+				integrityFiles.Lock()
+				checked := loadIntegrityManifest(share.Name).CheckedAt
+				integrityFiles.Unlock()
+				if time.Since(time.UnixMilli(checked)) < interval {
+					continue
+				}
+				finished := make(chan struct{})
+				if _, err := startIntegrityCheck(share, func() { close(finished) }); err != nil {
+					continue
+				}
+				select {
+				case <-finished:
+				case <-backgroundCtx.Done():
+					return
+				}
+			}
+		}
+	}()
+}
+
+func integrityStatus(share string) IntegrityStatus {
+	integrityFiles.Lock()
+	manifest := loadIntegrityManifest(share)
+	integrityFiles.Unlock()
+	status := IntegrityStatus{CheckedAt: manifest.CheckedAt, Recorded: len(manifest.Files)}
+	integrityJobs.Lock()
+	defer integrityJobs.Unlock()
+	if run := integrityJobs.running[share]; run != nil {
+		status.Checking = true
+		status.Files = run.files.Load()
+		status.Bytes = run.bytes.Load()
+		status.StartedAt = run.started.UnixMilli()
+	}
+	return status
+}
+
+// GetIntegrity returns the check status of ?share= and its reports, newest
+// first and without their list of files
+func GetIntegrity(c *gin.Context) {
+	share, err := findFileShare(c.Query("share"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	integrityFiles.Lock()
+	all := loadIntegrityReports()
+	integrityFiles.Unlock()
+	reports := []IntegrityReport{}
+	for _, r := range all {
+		if r.Share == share.Name {
+			r.Issues = nil
+			reports = append(reports, r)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"status":  integrityStatus(share.Name),
+		"reports": reports,
+	}})
+}
+
+// CheckIntegrity starts a check of a share
+func CheckIntegrity(c *gin.Context) {
+	var req struct {
+		Share string `json:"share"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	if _, err := startIntegrityCheck(share, nil); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": integrityStatus(share.Name)})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": integrityStatus(share.Name)})
+}
+
+// CancelIntegrityCheck stops the check of ?share=; what was hashed so far
+// is kept
+func CancelIntegrityCheck(c *gin.Context) {
+	integrityJobs.Lock()
+	run := integrityJobs.running[c.Query("share")]
+	integrityJobs.Unlock()
+	if run == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errIntegrityNotRunning.Error()})
+		return
+	}
+	run.cancel()
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// DownloadIntegrityReport sends a report as JSON, or its files as CSV with
+// ?format=csv
+func DownloadIntegrityReport(c *gin.Context) {
+	integrityFiles.Lock()
+	reports := loadIntegrityReports()
+	integrityFiles.Unlock()
+	var report *IntegrityReport
+	for i := range reports {
+		if reports[i].ID == c.Param("id") {
+			report = &reports[i]
+			break
+		}
+	}
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoIntegrityReport.Error()})
+		return
+	}
+	name := "integrity-" + report.Share + "-" + time.UnixMilli(report.StartedAt).Format("20060102-150405")
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.json\"", name))
+		c.JSON(http.StatusOK, report)
+	case "csv":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", name))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"path", "expected", "actual", "size", "oldSize", "modTime"})
+		for _, issue := range report.Issues {
+			w.Write([]string{
+				issue.Path,
+				issue.Expected,
+				issue.Actual,
+				strconv.FormatInt(issue.Size, 10),
+				strconv.FormatInt(issue.OldSize, 10),
+				time.UnixMilli(issue.ModTime).UTC().Format(time.RFC3339),
+			})
+		}
+		w.Flush()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	}
+}
+
+// AcceptIntegrity records the current checksum of files reported as
+// corrupted, e.g. after restoring them from a backup with their old mtime
+func AcceptIntegrity(c *gin.Context) {
+	var req struct {
+		Share string   `json:"share"`
+		Paths []string `json:"paths"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Paths) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	entries := make(map[string]*integrityEntry, len(req.Paths))
+	for _, p := range req.Paths {
+		rel, err := cleanSharePath(p)
+		if err != nil || rel == "" {
+			fileError(c, errInvalidPath, p)
+			return
+		}
+		full, err := resolveSharePath(share, rel)
+		if err != nil {
+			fileError(c, err, p)
+			return
+		}
+		info, err := os.Stat(full)
+		if err == nil && !info.Mode().IsRegular() {
+			err = errInvalidPath
+		}
+		if err != nil {
+			fileError(c, err, p)
+			return
+		}
+		hash, err := hashDupeFile(c.Request.Context(), full, -1, nil)
+		if err != nil {
+			fileError(c, err, p)
+			return
+		}
+		entries[rel] = &integrityEntry{Hash: hash, Size: info.Size(), ModTime: info.ModTime().UnixNano(), Checked: time.Now().UnixMilli()}
+	}
+	integrityFiles.Lock()
+	defer integrityFiles.Unlock()
+	manifest := loadIntegrityManifest(share.Name)
+	accepted := make([]string, 0, len(entries))
+	for rel, entry := range entries {
+		manifest.Files[rel] = entry
+		accepted = append(accepted, rel)
+	}
+	if err := saveIntegrityManifest(manifest); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save", "details": err.Error()})
+		return
+	}
+	sort.Strings(accepted)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": accepted})
+}
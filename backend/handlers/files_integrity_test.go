@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIntegrityCheck(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	write := func(p, data string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, p)), 0755)
+		os.WriteFile(filepath.Join(root, p), []byte(data), 0644)
+	}
+	write("a.txt", "alpha")
+	write("sub/b.txt", "bravo")
+	write("c.txt", "charlie")
+	write(".trash/old.txt", "skipped")
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	r := gin.New()
+	r.GET("/integrity", GetIntegrity)
+	r.POST("/integrity/check", CheckIntegrity)
+	r.POST("/integrity/accept", AcceptIntegrity)
+	r.GET("/integrity/reports/:id", DownloadIntegrityReport)
+	check := func() IntegrityReport {
+		if w := serve(r, "POST", "/integrity/check", `{"share":"main"}`); w.Code != http.StatusAccepted {
+			t.Fatalf("check failed: %d %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Data struct {
+				Status  IntegrityStatus
+				Reports []IntegrityReport
+			}
+		}
+		for i := 0; ; i++ {
+			json.Unmarshal(serve(r, "GET", "/integrity?share=main", "").Body.Bytes(), &resp)
+			if !resp.Data.Status.Checking {
+				break
+			}
+			if i > 500 {
+				t.Fatalf("check did not finish")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return resp.Data.Reports[0]
+	}
+
+	if report := check(); report.Files != 3 || report.Added != 3 || report.Corrupted != 0 {
+		t.Fatalf("unexpected first report %+v", report)
+	}
+
+	// Same size and mtime, other content: rot. A normal write is an update.
+	info, _ := os.Stat(filepath.Join(root, "a.txt"))
+	write("a.txt", "alphA")
+	os.Chtimes(filepath.Join(root, "a.txt"), info.ModTime(), info.ModTime())
+	write("sub/b.txt", "bravo two")
+	os.Chtimes(filepath.Join(root, "sub/b.txt"), info.ModTime().Add(time.Hour), info.ModTime().Add(time.Hour))
+	os.Remove(filepath.Join(root, "c.txt"))
+	report := check()
+	if report.Corrupted != 1 || report.Updated != 1 || report.Missing != 1 {
+		t.Fatalf("unexpected second report %+v", report)
+	}
+	w := serve(r, "GET", "/integrity/reports/"+report.ID, "")
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if len(report.Issues) != 1 || report.Issues[0].Path != "a.txt" || report.Issues[0].Expected == report.Issues[0].Actual {
+		t.Fatalf("unexpected issues: %d %s", w.Code, w.Body.String())
+	}
+	w = serve(r, "GET", "/integrity/reports/"+report.ID+"?format=csv", "")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "a.txt,"+report.Issues[0].Expected) || !strings.Contains(w.Header().Get("Content-Disposition"), ".csv") {
+		t.Fatalf("unexpected csv: %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(r, "GET", "/integrity/reports/nope", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+
+	// Reported until accepted
+	if report := check(); report.Corrupted != 1 {
+		t.Fatalf("corruption not reported again %+v", report)
+	}
+	if w := serve(r, "POST", "/integrity/accept", `{"share":"main","paths":["missing.txt"]}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if w := serve(r, "POST", "/integrity/accept", `{"share":"main","paths":["a.txt"]}`); w.Code != 200 {
+		t.Fatalf("accept failed: %d %s", w.Code, w.Body.String())
+	}
+	if report := check(); report.Corrupted != 0 || report.Files != 2 {
+		t.Fatalf("unexpected report after accept %+v", report)
+	}
+}
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// File operations asked for with "background": true run as jobs (see
+// jobs.go). A copy or move is checked when it is queued, like one that
+// runs at once, and its paths are resolved again when the job starts.
+
+// deletePlan is a delete job
+type deletePlan struct {
+	Share     string   `json:"share"`
+	Paths     []string `json:"paths"`
+	Permanent bool     `json:"permanent,omitempty"`
+	User      string   `json:"user"` // Recorded in the recycle bin
+}
+
+// startFileJob queues a job for the request's user and answers with it
+func startFileJob(c *gin.Context, kind string, params interface{}) {
+	job, err := enqueueJob(kind, c.GetString("username"), params)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": job})
+}
+
+func runTransferJob(ctx context.Context, r *jobRun) error {
+	var plan transferPlan
+	if err := r.params(&plan); err != nil {
+		return err
+	}
+	share, err := findFileShare(plan.Share)
+	if err != nil {
+		return err
+	}
+	dstShare, err := findFileShare(plan.ToShare)
+	if err != nil {
+		return err
+	}
+	if dstShare.ReadOnly || (plan.Move && share.ReadOnly) {
+		return errShareReadOnly
+	}
+	type pair struct{ src, dst, to string }
+	var pairs []pair
+	var bytes, items int64
+	for _, item := range plan.Items {
+		dst, err := resolveShareTarget(dstShare, item.To)
+		if err != nil {
+			return err
+		}
+		src, _, err := resolveFileItem(share, item.Path)
+		if errors.Is(err, fs.ErrNotExist) && plan.Move {
+			// Moved before the job was interrupted
+			if _, err := os.Lstat(dst); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if src == dst {
+			continue
+		}
+		pairs = append(pairs, pair{src, dst, item.To})
+		n, count := treeSize(src)
+		bytes, items = bytes+n, items+count
+	}
+	r.setTotal(bytes, items)
+
+	for _, p := range pairs {
+		if _, err := os.Lstat(p.dst); err == nil && plan.Overwrite && r.job.Attempt == 1 {
+			// Later attempts merge with what the first one copied
+			keepVersion(dstShare, p.to, p.dst, r.job.User)
+			if err := os.RemoveAll(p.dst); err != nil {
+				return err
+			}
+		}
+		if plan.Move {
+			err = moveTree(ctx, r, p.src, p.dst)
+		} else {
+			err = copyTree(ctx, r, p.src, p.dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	finishTransfer(plan)
+	return nil
+}
+
+// treeSize counts the bytes of the files below p and the items, p included
+func treeSize(p string) (bytes, items int64) {
+	filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		items++
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	return bytes, items
+}
+
+// moveTree is movePath for a job: a rename, or a copy and delete across
+// file systems
+func moveTree(ctx context.Context, r *jobRun, src, dst string) error {
+	if err := r.wait(ctx); err != nil {
+		return err
+	}
+	r.at(src)
+	err := os.Rename(src, dst)
+	if err == nil {
+		r.add(treeSize(dst))
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(ctx, r, src, dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree is copyPath for a job. It counts what it copies, holds while
+// the job is paused and stops when it is cancelled. A folder already at
+// dst is merged into, and a file there with the same size and modification
+// time, copied before the job was interrupted, is kept.
+func copyTree(ctx context.Context, r *jobRun, src, dst string) error {
+	if err := r.wait(ctx); err != nil {
+		return err
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	existing, err := os.Lstat(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		if existing != nil {
+			os.Remove(dst)
+		}
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+		r.add(0, 1)
+		return nil
+	case info.IsDir():
+		if existing == nil || !existing.IsDir() {
+			if existing != nil {
+				os.Remove(dst)
+			}
+			if err := os.Mkdir(dst, info.Mode().Perm()|0700); err != nil {
+				return err
+			}
+		}
+		r.add(0, 1)
+		items, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := copyTree(ctx, r, filepath.Join(src, item.Name()), filepath.Join(dst, item.Name())); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		if existing != nil && existing.Mode().IsRegular() && existing.Size() == info.Size() && existing.ModTime().Equal(info.ModTime()) {
+			r.add(info.Size(), 1)
+			return nil
+		}
+		if existing != nil {
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+		}
+		r.at(src)
+		if err := copyJobFile(ctx, r, src, dst, info.Mode().Perm()); err != nil {
+			// A partial file would look copied if its time were set
+			os.Remove(dst)
+			return err
+		}
+		r.add(0, 1)
+	default:
+		r.add(0, 1)
+		return nil
+	}
+	return os.Chtimes(dst, time.Now(), info.ModTime())
+}
+
+func copyJobFile(ctx context.Context, r *jobRun, src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r.reader(ctx, in)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func runDeleteJob(ctx context.Context, r *jobRun) error {
+	var plan deletePlan
+	if err := r.params(&plan); err != nil {
+		return err
+	}
+	share, err := findFileShare(plan.Share)
+	if err == nil && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		return err
+	}
+	type target struct{ full, rel string }
+	var targets []target
+	var items int64
+	for _, p := range plan.Paths {
+		full, rel, err := resolveFileItem(share, p)
+		if os.IsNotExist(err) {
+			// Deleted before the job was interrupted
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target{full, rel})
+		if plan.Permanent {
+			_, count := treeSize(full)
+			items += count
+		} else {
+			items++
+		}
+	}
+	r.setTotal(0, items)
+	for _, t := range targets {
+		if err := r.wait(ctx); err != nil {
+			return err
+		}
+		r.at(t.rel)
+		if plan.Permanent {
+			err = removeTree(ctx, r, t.full)
+		} else if err = moveToTrash(share, t.full, t.rel, plan.User); err == nil {
+			r.add(0, 1)
+		}
+		if err != nil {
+			return err
+		}
+		dropFileMarks(share.Name, t.rel)
+	}
+	if plan.Permanent {
+		markQuotaStale(share.Name)
+	}
+	return nil
+}
+
+// removeTree is os.RemoveAll for a job, counting the items it removes
+func removeTree(ctx context.Context, r *jobRun, p string) error {
+	if err := r.wait(ctx); err != nil {
+		return err
+	}
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		items, err := os.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := removeTree(ctx, r, filepath.Join(p, item.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.add(0, 1)
+	return nil
+}
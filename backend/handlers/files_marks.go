@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/store"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Users tag and star files and folders for themselves. The marks are kept
+// in the database by share and path, so they need no sidecar files and
+// work on read-only shares; renames, moves and deletes made through the
+// browser carry them along.
+
+const (
+	maxFileTags  = 20
+	maxTagLength = 40
+)
+
+var errMarksUnavailable = errors.New("Tags and stars need the database")
+
+// FileTagsRequest replaces the tags of an item
+type FileTagsRequest struct {
+	Share string   `json:"share"`
+	Path  string   `json:"path"`
+	Tags  []string `json:"tags"`
+}
+
+// StarRequest stars items, or takes the star away
+type StarRequest struct {
+	Share   string   `json:"share"`
+	Paths   []string `json:"paths"`
+	Starred bool     `json:"starred"`
+}
+
+// FileTagCount is a tag and the number of items it is on
+type FileTagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// cleanFileTags trims the tags and drops repeats, whatever their case. A
+// comma is refused since searches list tags with it.
+func cleanFileTags(tags []string) ([]string, bool) {
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(tag), " ")
+		if tag == "" {
+			continue
+		}
+		if len([]rune(tag)) > maxTagLength || strings.ContainsRune(tag, ',') || strings.IndexFunc(tag, unicode.IsControl) >= 0 {
+			return nil, false
+		}
+		if key := strings.ToLower(tag); !seen[key] {
+			seen[key] = true
+			out = append(out, tag)
+		}
+	}
+	return out, len(out) <= maxFileTags
+}
+
+// splitTags reads the tags of a query, given as tag=a&tag=b or tag=a,b
+func splitTags(values []string) []string {
+	var tags []string
+	for _, v := range values {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.Join(strings.Fields(tag), " "); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// markEntries adds the tags and stars of user to the listing of the
+// folder dir
+func markEntries(user, share, dir string, entries []FileEntry) {
+	if config.Store == nil || len(entries) == 0 {
+		return
+	}
+	marks, err := config.Store.FileMarks(user, share, dir)
+	if err != nil {
+		filesLog.Warn("Failed to load file marks", "share", share, "path", dir, "error", err)
+		return
+	}
+	byPath := make(map[string]store.FileMark, len(marks))
+	for _, m := range marks {
+		byPath[m.Path] = m
+	}
+	for i := range entries {
+		if m, ok := byPath[entries[i].Path]; ok {
+			entries[i].Tags, entries[i].Starred = m.Tags, m.Starred
+		}
+	}
+}
+
+// moveFileMarks makes the marks on an item follow it to its new place
+func moveFileMarks(share, from, toShare, to string) {
+	if config.Store == nil {
+		return
+	}
+	if err := config.Store.MoveFileMarks(share, from, toShare, to); err != nil {
+		filesLog.Warn("Failed to move file marks", "share", share, "path", from, "error", err)
+	}
+}
+
+// dropFileMarks forgets the marks on an item that was deleted
+func dropFileMarks(share, p string) {
+	if config.Store == nil {
+		return
+	}
+	if err := config.Store.DeleteFileMarks(share, p); err != nil {
+		filesLog.Warn("Failed to delete file marks", "share", share, "path", p, "error", err)
+	}
+}
+
+// markedEntries lists the marked items that still exist, folders first.
+// Items removed outside the browser are left out but keep their marks, so
+// they show again if they come back.
+func markedEntries(marks []store.FileMark) []FileEntry {
+	entries := []FileEntry{}
+	for _, m := range marks {
+		share, err := findFileShare(m.Share)
+		if err != nil {
+			continue
+		}
+		full, rel, err := resolveFileItem(share, m.Path)
+		if err != nil {
+			continue
+		}
+		info, err := os.Lstat(full)
+		if err != nil {
+			continue
+		}
+		dir := path.Dir(rel)
+		if dir == "." {
+			dir = ""
+		}
+		e := listEntry(share, dir, info)
+		e.Share, e.Tags, e.Starred = share.Name, m.Tags, m.Starred
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name)
+	})
+	return entries
+}
+
+// GetFileTags lists the tags of the user with the number of items on each
+func GetFileTags(c *gin.Context) {
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errMarksUnavailable.Error()})
+		return
+	}
+	counts, err := config.Store.FileTags(c.GetString("username"))
+	if err != nil {
+		filesLog.Error("Failed to load file tags", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tags"})
+		return
+	}
+	tags := make([]FileTagCount, 0, len(counts))
+	for _, t := range counts {
+		tags = append(tags, FileTagCount{Tag: t.Tag, Count: t.Count})
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": tags})
+}
+
+// SetFileTags replaces the tags the user put on an item
+func SetFileTags(c *gin.Context) {
+	var req FileTagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	tags, ok := cleanFileTags(req.Tags)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tags"})
+		return
+	}
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errMarksUnavailable.Error()})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	_, rel, err := resolveFileItem(share, req.Path)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	if err := config.Store.SetFileTags(c.GetString("username"), share.Name, rel, tags); err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"path": rel, "tags": tags}})
+}
+
+// StarFiles stars items for the user, or takes their star away
+func StarFiles(c *gin.Context) {
+	var req StarRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Paths) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errMarksUnavailable.Error()})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	rels := make([]string, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		var rel string
+		if req.Starred {
+			_, rel, err = resolveFileItem(share, p)
+		} else {
+			// A star can be taken off an item that is gone
+			rel, err = cleanSharePath(p)
+		}
+		if err != nil {
+			fileError(c, err, p)
+			return
+		}
+		rels = append(rels, rel)
+	}
+	for _, rel := range rels {
+		if err := config.Store.StarFile(c.GetString("username"), share.Name, rel, req.Starred); err != nil {
+			fileError(c, err, rel)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ListStarred is the virtual folder of the items the user starred, across
+// shares
+func ListStarred(c *gin.Context) {
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errMarksUnavailable.Error()})
+		return
+	}
+	marks, err := config.Store.StarredFiles(c.GetString("username"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"virtual": "starred",
+		"entries": markedEntries(marks),
+	}})
+}
+
+// ListTagged is the virtual folder of the items carrying every tag given
+// as tag=a&tag=b or tag=a,b
+func ListTagged(c *gin.Context) {
+	tags := splitTags(c.QueryArray("tag"))
+	if len(tags) == 0 || len(tags) > maxFileTags {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tags"})
+		return
+	}
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errMarksUnavailable.Error()})
+		return
+	}
+	marks, err := config.Store.TaggedFiles(c.GetString("username"), tags)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"virtual": "tagged",
+		"tags":    tags,
+		"entries": markedEntries(marks),
+	}})
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFileMarks(t *testing.T) {
+	useTestConfig(t)
+	useTestJobs(t)
+	t.Cleanup(closeSearchIndexes)
+	gin.SetMode(gin.TestMode)
+
+	main, media := t.TempDir(), t.TempDir()
+	for _, root := range []string{main, media} {
+		os.MkdirAll(filepath.Join(root, "docs"), 0755)
+		os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("alpha"), 0644)
+	}
+	os.WriteFile(filepath.Join(main, "docs", "b.txt"), []byte("beta"), 0644)
+	shares := []models.FileShare{{Name: "main", Path: main}, {Name: "media", Path: media}}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: shares, EnableSearchIndex: true})
+
+	router := func(user string) *gin.Engine {
+		r := gin.New()
+		r.Use(func(c *gin.Context) { c.Set("username", user) })
+		r.GET("/list", ListFiles)
+		r.GET("/tags", GetFileTags)
+		r.PUT("/tags", SetFileTags)
+		r.POST("/star", StarFiles)
+		r.GET("/starred", ListStarred)
+		r.GET("/tagged", ListTagged)
+		r.GET("/search", SearchFiles)
+		r.POST("/rename", RenameFile)
+		r.POST("/move", MoveFiles)
+		r.POST("/delete", DeleteFiles)
+		return r
+	}
+	r := router("alice")
+	listed := func(target string) string {
+		t.Helper()
+		w := serve(r, "GET", target, "")
+		var resp struct {
+			Data struct{ Entries []FileEntry }
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 {
+			t.Fatalf("%s: %d %s", target, w.Code, w.Body.String())
+		}
+		var out []string
+		for _, e := range resp.Data.Entries {
+			item := e.Share + ":" + e.Path + "[" + strings.Join(e.Tags, ",") + "]"
+			if e.Starred {
+				item += "*"
+			}
+			out = append(out, item)
+		}
+		return strings.Join(out, " ")
+	}
+
+	w := serve(r, "PUT", "/tags", `{"share":"main","path":"docs/a.txt","tags":["Work"," work ","Urgent  today"]}`)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"tags":["Work","Urgent today"]`) {
+		t.Fatalf("set tags: %d %s", w.Code, w.Body.String())
+	}
+	serve(r, "PUT", "/tags", `{"share":"media","path":"docs/a.txt","tags":["work"]}`)
+	for body, status := range map[string]int{
+		`{"share":"main","path":"docs/none.txt","tags":["x"]}`:                            404,
+		`{"share":"main","path":"docs/a.txt","tags":["a,b"]}`:                             400,
+		`{"share":"main","path":"docs/a.txt","tags":["` + strings.Repeat("x", 41) + `"]}`: 400,
+		`{"share":"nope","path":"docs/a.txt","tags":["x"]}`:                               404,
+	} {
+		if w := serve(r, "PUT", "/tags", body); w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", body, status, w.Code)
+		}
+	}
+	if w := serve(r, "POST", "/star", `{"share":"main","paths":["docs","docs/a.txt"],"starred":true}`); w.Code != 200 {
+		t.Fatalf("star: %d %s", w.Code, w.Body.String())
+	}
+
+	if got := listed("/list?share=main&path=docs"); got != ":docs/a.txt[Urgent today,Work]* :docs/b.txt[]" {
+		t.Fatalf("unexpected listing %q", got)
+	}
+	if got := listed("/list?share=main"); got != ":docs[]*" {
+		t.Fatalf("unexpected root listing %q", got)
+	}
+	if got := listed("/starred"); got != "main:docs[]* main:docs/a.txt[Urgent today,Work]*" {
+		t.Fatalf("unexpected starred folder %q", got)
+	}
+	if got := listed("/tagged?tag=WORK"); got != "main:docs/a.txt[Urgent today,Work]* media:docs/a.txt[work]" {
+		t.Fatalf("unexpected tagged folder %q", got)
+	}
+	if got := listed("/tagged?tag=work,urgent+today"); got != "main:docs/a.txt[Urgent today,Work]*" {
+		t.Fatalf("unexpected tagged folder for two tags %q", got)
+	}
+	if w := serve(r, "GET", "/tags", ""); !strings.Contains(w.Body.String(), `[{"tag":"Urgent today","count":1},{"tag":"Work","count":2}]`) {
+		t.Fatalf("unexpected tags %s", w.Body.String())
+	}
+	// Marks are each user's own
+	if w := serve(router("bob"), "GET", "/tagged?tag=work", ""); !strings.Contains(w.Body.String(), `"entries":[]`) {
+		t.Fatalf("another user sees the tags: %s", w.Body.String())
+	}
+
+	// Search holds to the tagged items, in their own share only
+	for _, share := range shares {
+		if err := indexShare(context.Background(), share); err != nil {
+			t.Fatalf("index: %v", err)
+		}
+	}
+	search := func(query string) string {
+		w := serve(r, "GET", "/search?"+query, "")
+		var resp struct {
+			Data struct{ Hits []SearchHit }
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		var out []string
+		for _, h := range resp.Data.Hits {
+			out = append(out, h.Share+":"+h.Path)
+		}
+		return strings.Join(out, " ")
+	}
+	if got := search("tag=urgent+today"); got != "main:docs/a.txt" {
+		t.Fatalf("unexpected search by tag %q", got)
+	}
+	if got := search("q=a&tag=work&share=media"); got != "media:docs/a.txt" {
+		t.Fatalf("unexpected search by tag in a share %q", got)
+	}
+	if got := search("tag=nothing"); got != "" {
+		t.Fatalf("unexpected hits for an unused tag %q", got)
+	}
+
+	// Marks follow renames and moves, and go with deletes
+	serve(r, "POST", "/rename", `{"share":"main","paths":["docs"],"name":"papers"}`)
+	if got := listed("/starred"); got != "main:papers[]* main:papers/a.txt[Urgent today,Work]*" {
+		t.Fatalf("marks did not follow the rename: %q", got)
+	}
+	serve(r, "POST", "/move", `{"share":"main","paths":["papers/a.txt"],"toShare":"media","to":"docs","overwrite":true}`)
+	if got := listed("/tagged?tag=work"); got != "media:docs/a.txt[Urgent today,Work]*" {
+		t.Fatalf("marks did not follow the move: %q", got)
+	}
+	serve(r, "POST", "/delete", `{"share":"media","paths":["docs"]}`)
+	if got := listed("/tagged?tag=work"); got != "" {
+		t.Fatalf("marks kept after delete: %q", got)
+	}
+	serve(r, "POST", "/star", `{"share":"main","paths":["papers"],"starred":false}`)
+	if got := listed("/starred"); got != "" {
+		t.Fatalf("unexpected starred folder after unstarring %q", got)
+	}
+}
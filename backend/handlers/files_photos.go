@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/models"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/gin-gonic/gin"
+)
+
+// The photos view groups the images of the shares by day and by place
+// from the metadata the search indexer keeps, so it needs the search index
+// enabled. Photos without an EXIF date are placed by their modification
+// time.
+
+const (
+	photoDayLayout      = "2006-01-02"
+	photoDefaultDays    = 30
+	photoMaxDays        = 366
+	photoDefaultPerDay  = 200
+	photoDefaultCell    = 1.0 // Degrees
+	photoMaxClusters    = 5000
+	photoMinCellDegrees = 0.0001
+)
+
+// PhotoItem is a photo of the timeline or map
+type PhotoItem struct {
+	Share       string   `json:"share"`
+	Path        string   `json:"path"`
+	Name        string   `json:"name"`
+	Size        int64    `json:"size"`
+	TakenAt     int64    `json:"takenAt"`
+	DateSource  string   `json:"dateSource"` // exif or file
+	Make        string   `json:"make,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Width       int      `json:"width,omitempty"`
+	Height      int      `json:"height,omitempty"`
+	Orientation int      `json:"orientation,omitempty"`
+	Lat         *float64 `json:"lat,omitempty"`
+	Lon         *float64 `json:"lon,omitempty"`
+	Thumb       string   `json:"thumb"`
+	People      []string `json:"people,omitempty"` // Only in the gallery
+}
+
+// PhotoDay is the photos of one day, newest first
+type PhotoDay struct {
+	Day    string      `json:"day"`
+	Count  int         `json:"count"`
+	Photos []PhotoItem `json:"photos"`
+}
+
+// PhotoCluster is the photos taken in one cell of the map grid
+type PhotoCluster struct {
+	Lat   float64   `json:"lat"` // Mean position of the photos
+	Lon   float64   `json:"lon"`
+	Count int       `json:"count"`
+	Cover PhotoItem `json:"cover"` // The newest photo
+}
+
+// collectPhotos lists the indexed images of ?share= (all shares when
+// empty) under ?path=
+func collectPhotos(c *gin.Context) ([]PhotoItem, bool) {
+	shares := loadFileShares()
+	if name := c.Query("share"); name != "" {
+		share, err := findFileShare(name)
+		if err != nil {
+			fileError(c, err, "")
+			return nil, false
+		}
+		shares = []models.FileShare{share}
+	}
+	prefix, err := cleanSharePath(c.Query("path"))
+	if err != nil || (prefix != "" && c.Query("share") == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return nil, false
+	}
+	return indexedPhotos(shares, prefix), true
+}
+
+// indexedPhotos lists the indexed images of shares under prefix, newest
+// first
+func indexedPhotos(shares []models.FileShare, prefix string) []PhotoItem {
+	photos := []PhotoItem{}
+	images := bleve.NewTermQuery("image")
+	images.SetField("kind")
+	var q query.Query = images
+	if prefix != "" {
+		under := bleve.NewPrefixQuery(prefix + "/")
+		under.SetField("path")
+		q = bleve.NewConjunctionQuery(images, under)
+	}
+	for _, share := range shares {
+		idx, err := openSearchIndex(share.Name, false)
+		if err != nil {
+			filesLog.Warn("Failed to open search index", "share", share.Name, "error", err)
+		}
+		if idx == nil {
+			continue
+		}
+		err = eachSearchDoc(idx, q, []string{"size", "mtime", "photo"}, func(hit *search.DocumentMatch) {
+			var m *PhotoMeta
+			if data, _ := hit.Fields["photo"].(string); data != "" {
+				m = &PhotoMeta{}
+				if json.Unmarshal([]byte(data), m) != nil {
+					m = nil
+				}
+			}
+			photos = append(photos, newPhotoItem(share.Name, hit.ID, fieldNumber(hit.Fields, "size"), fieldNumber(hit.Fields, "mtime"), m))
+		})
+		if err != nil {
+			filesLog.Warn("Failed to list photos", "share", share.Name, "error", err)
+		}
+	}
+	sortPhotos(photos)
+	return photos
+}
+
+// newPhotoItem describes a photo from its size, modification time in ms
+// and metadata, which may be nil
+func newPhotoItem(share, p string, size, modTime int64, m *PhotoMeta) PhotoItem {
+	item := PhotoItem{Share: share, Path: p, Name: path.Base(p), Size: size, DateSource: "file", Thumb: thumbURL(share, p)}
+	// The modification time as wall clock time, like EXIF dates
+	_, offset := time.UnixMilli(modTime).Zone()
+	item.TakenAt = modTime + int64(offset)*1000
+	if m != nil {
+		if m.TakenAt != 0 {
+			item.TakenAt, item.DateSource = m.TakenAt, "exif"
+		}
+		item.Make, item.Model = m.Make, m.Model
+		item.Width, item.Height, item.Orientation = m.Width, m.Height, m.Orientation
+		item.Lat, item.Lon = m.Lat, m.Lon
+	}
+	return item
+}
+
+// sortPhotos puts photos newest first
+func sortPhotos(photos []PhotoItem) {
+	sort.Slice(photos, func(i, j int) bool {
+		if photos[i].TakenAt != photos[j].TakenAt {
+			return photos[i].TakenAt > photos[j].TakenAt
+		}
+		return photos[i].Share+"/"+photos[i].Path < photos[j].Share+"/"+photos[j].Path
+	})
+}
+
+func photoDay(p PhotoItem) string {
+	return time.UnixMilli(p.TakenAt).UTC().Format(photoDayLayout)
+}
+
+// GetPhotoTimeline groups photos by day, newest first. from and to
+// (YYYY-MM-DD) bound the days; days (30) days are returned at a time with
+// at most perDay (200) photos each, and next is the before= of the next
+// page.
+func GetPhotoTimeline(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", strconv.Itoa(photoDefaultDays)))
+	perDay, perr := strconv.Atoi(c.DefaultQuery("perDay", strconv.Itoa(photoDefaultPerDay)))
+	if err != nil || perr != nil || days < 1 || days > photoMaxDays || perDay < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	bounds := map[string]string{}
+	for _, name := range []string{"from", "to", "before"} {
+		if v := c.Query(name); v != "" {
+			if _, err := time.Parse(photoDayLayout, v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date"})
+				return
+			}
+			bounds[name] = v
+		}
+	}
+	photos, ok := collectPhotos(c)
+	if !ok {
+		return
+	}
+	timeline := []PhotoDay{}
+	next := ""
+	for _, p := range photos {
+		day := photoDay(p)
+		if (bounds["from"] != "" && day < bounds["from"]) || (bounds["to"] != "" && day > bounds["to"]) || (bounds["before"] != "" && day >= bounds["before"]) {
+			continue
+		}
+		if n := len(timeline); n == 0 || timeline[n-1].Day != day {
+			if n == days {
+				next = timeline[n-1].Day
+				break
+			}
+			timeline = append(timeline, PhotoDay{Day: day, Photos: []PhotoItem{}})
+		}
+		d := &timeline[len(timeline)-1]
+		d.Count++
+		if len(d.Photos) < perDay {
+			d.Photos = append(d.Photos, p)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"days": timeline, "next": next, "indexed": searchEnabled()}})
+}
+
+// parseBBox reads south,west,north,east; nil when v is empty
+func parseBBox(v string) ([]float64, bool) {
+	if v == "" {
+		return nil, true
+	}
+	var bbox []float64
+	for _, part := range strings.Split(v, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, false
+		}
+		bbox = append(bbox, f)
+	}
+	return bbox, len(bbox) == 4 && bbox[0] <= bbox[2]
+}
+
+// inBBox tells whether a position is in a box of parseBBox
+func inBBox(bbox []float64, lat, lon float64) bool {
+	// A box across the antimeridian has west > east
+	inLon := lon >= bbox[1] && lon <= bbox[3]
+	if bbox[1] > bbox[3] {
+		inLon = lon >= bbox[1] || lon <= bbox[3]
+	}
+	return lat >= bbox[0] && lat <= bbox[2] && inLon
+}
+
+// GetPhotoMap clusters the photos with a position on a grid of cell
+// degrees, within bbox=south,west,north,east when given
+func GetPhotoMap(c *gin.Context) {
+	cell, err := strconv.ParseFloat(c.DefaultQuery("cell", strconv.FormatFloat(photoDefaultCell, 'f', -1, 64)), 64)
+	if err != nil || cell < photoMinCellDegrees || cell > 90 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	bbox, ok := parseBBox(c.Query("bbox"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	photos, ok := collectPhotos(c)
+	if !ok {
+		return
+	}
+	type cellKey struct{ lat, lon int64 }
+	clusters := make(map[cellKey]*PhotoCluster)
+	var order []cellKey
+	unplaced := 0
+	for _, p := range photos {
+		if p.Lat == nil || p.Lon == nil {
+			unplaced++
+			continue
+		}
+		lat, lon := *p.Lat, *p.Lon
+		if bbox != nil && !inBBox(bbox, lat, lon) {
+			continue
+		}
+		key := cellKey{int64(math.Floor(lat / cell)), int64(math.Floor(lon / cell))}
+		cl := clusters[key]
+		if cl == nil {
+			if len(clusters) >= photoMaxClusters {
+				continue
+			}
+			// Photos come newest first, so the first is the cover
+			cl = &PhotoCluster{Cover: p}
+			clusters[key] = cl
+			order = append(order, key)
+		}
+		cl.Lat += (lat - cl.Lat) / float64(cl.Count+1)
+		cl.Lon += (lon - cl.Lon) / float64(cl.Count+1)
+		cl.Count++
+	}
+	out := make([]PhotoCluster, 0, len(order))
+	for _, k := range order {
+		out = append(out, *clusters[k])
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"clusters": out, "unplaced": unplaced, "indexed": searchEnabled()}})
+}
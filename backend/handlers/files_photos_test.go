@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exifJpeg builds a JPEG holding an EXIF block with a date, a camera and,
+// when lat is not zero, a position
+func exifJpeg(taken, model string, lat, lon float64) []byte {
+	type entry struct {
+		tag, typ uint16
+		count    uint32
+		value    []byte
+	}
+	be := binary.BigEndian
+	rational := func(vals ...float64) []byte {
+		var b []byte
+		for _, v := range vals {
+			b = be.AppendUint32(b, uint32(v*1000))
+			b = be.AppendUint32(b, 1000)
+		}
+		return b
+	}
+	dms := func(v float64) []byte {
+		v = math.Abs(v)
+		d := math.Floor(v)
+		m := math.Floor((v - d) * 60)
+		return rational(d, m, ((v-d)*60-m)*60)
+	}
+	str := func(s string) []byte { return append([]byte(s), 0) }
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	// writeIFD lays an IFD out at the end of tiff; pointer entries are
+	// patched by the caller
+	writeIFD := func(entries []entry) (start int, slots map[uint16]int) {
+		start, slots = len(tiff), map[uint16]int{}
+		data := start + 2 + len(entries)*12 + 4
+		var body, extra []byte
+		body = be.AppendUint16(body, uint16(len(entries)))
+		for _, e := range entries {
+			body = be.AppendUint16(body, e.tag)
+			body = be.AppendUint16(body, e.typ)
+			body = be.AppendUint32(body, e.count)
+			slots[e.tag] = start + len(body)
+			if len(e.value) <= 4 {
+				body = append(body, append(e.value, make([]byte, 4-len(e.value))...)...)
+			} else {
+				body = be.AppendUint32(body, uint32(data+len(extra)))
+				extra = append(extra, e.value...)
+			}
+		}
+		body = append(body, 0, 0, 0, 0)
+		tiff = append(append(tiff, body...), extra...)
+		return start, slots
+	}
+	ifd0 := []entry{{0x0110, 2, uint32(len(model) + 1), str(model)}, {0x8769, 4, 1, nil}}
+	if lat != 0 {
+		ifd0 = append(ifd0, entry{0x8825, 4, 1, nil})
+	}
+	_, slots := writeIFD(ifd0)
+	exif, _ := writeIFD([]entry{{0x9003, 2, 20, str(taken)}})
+	be.PutUint32(tiff[slots[0x8769]:], uint32(exif))
+	if lat != 0 {
+		latRef, lonRef := "N", "E"
+		if lat < 0 {
+			latRef = "S"
+		}
+		if lon < 0 {
+			lonRef = "W"
+		}
+		gps, _ := writeIFD([]entry{
+			{1, 2, 2, str(latRef)}, {2, 5, 3, dms(lat)},
+			{3, 2, 2, str(lonRef)}, {4, 5, 3, dms(lon)},
+		})
+		be.PutUint32(tiff[slots[0x8825]:], uint32(gps))
+	}
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = be.AppendUint16(out, uint16(len(app1)+2))
+	return append(append(out, app1...), 0xFF, 0xD9)
+}
+
+func TestPhotoTimeline(t *testing.T) {
+	useTestConfig(t)
+	t.Cleanup(closeSearchIndexes)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "trip"), 0755)
+	os.WriteFile(filepath.Join(root, "trip", "a.jpg"), exifJpeg("2024:05:01 09:30:00", "Pixel 8", 48.8584, 2.2945), 0644)
+	os.WriteFile(filepath.Join(root, "trip", "b.jpg"), exifJpeg("2024:05:01 18:00:00", "Pixel 8", 48.86, 2.35), 0644)
+	os.WriteFile(filepath.Join(root, "trip", "c.jpg"), exifJpeg("2024:05:03 12:00:00", "X100V", -33.8568, 151.2153), 0644)
+	os.WriteFile(filepath.Join(root, "scan.jpg"), []byte{0xFF, 0xD8, 0xFF, 0xD9}, 0644)
+	mtime := time.Date(2023, 1, 2, 12, 0, 0, 0, time.Local)
+	os.Chtimes(filepath.Join(root, "scan.jpg"), mtime, mtime)
+	share := models.FileShare{Name: "main", Path: root}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{share}, EnableSearchIndex: true})
+
+	meta, err := readPhotoMeta(filepath.Join(root, "trip", "c.jpg"))
+	if err != nil || meta.Model != "X100V" || meta.Lat == nil || math.Abs(*meta.Lat+33.8568) > 1e-3 || math.Abs(*meta.Lon-151.2153) > 1e-3 {
+		t.Fatalf("unexpected metadata %+v %v", meta, err)
+	}
+	if err := indexShare(context.Background(), share); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+
+	r := gin.New()
+	r.GET("/timeline", GetPhotoTimeline)
+	r.GET("/map", GetPhotoMap)
+	get := func(url string, v interface{}) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s failed: %d %s", url, w.Code, w.Body.String())
+		}
+		json.Unmarshal(w.Body.Bytes(), v)
+	}
+
+	var timeline struct {
+		Data struct {
+			Days []PhotoDay
+			Next string
+		}
+	}
+	get("/timeline?share=main&days=2", &timeline)
+	days := timeline.Data.Days
+	if len(days) != 2 || days[0].Day != "2024-05-03" || days[1].Day != "2024-05-01" || days[1].Count != 2 || days[1].Photos[0].Name != "b.jpg" || timeline.Data.Next != "2024-05-01" {
+		t.Fatalf("unexpected timeline %+v", timeline.Data)
+	}
+	get("/timeline?share=main&before="+timeline.Data.Next, &timeline)
+	if days := timeline.Data.Days; len(days) != 1 || days[0].Day != "2023-01-02" || days[0].Photos[0].DateSource != "file" || timeline.Data.Next != "" {
+		t.Fatalf("unexpected second page %+v", timeline.Data)
+	}
+
+	var clusters struct {
+		Data struct {
+			Clusters []PhotoCluster
+			Unplaced int
+		}
+	}
+	get("/map?cell=1", &clusters)
+	if c := clusters.Data.Clusters; len(c) != 2 || c[0].Count != 2 || c[0].Cover.Name != "b.jpg" || clusters.Data.Unplaced != 1 {
+		t.Fatalf("unexpected clusters %+v", clusters.Data)
+	}
+	get("/map?bbox=-40,150,-30,155", &clusters)
+	if c := clusters.Data.Clusters; len(c) != 1 || c[0].Cover.Name != "c.jpg" {
+		t.Fatalf("bbox not applied %+v", clusters.Data)
+	}
+}
@@ -0,0 +1,816 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/registry"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/gin-gonic/gin"
+)
+
+// The search index lets the file browser find files by name and by the
+// words in text files and PDFs without reading the shares on every query,
+// and keeps the EXIF of photos for the photos view.
+// When the system config enables it, each share has a bleve index in
+// DataDir/search-index. A share is walked once when the indexer starts;
+// after that its folders are watched and only the paths that change are
+// indexed again (see files_search_watch.go). Words are lowercased;
+// Chinese, Japanese and Korean text is indexed by characters and pairs of
+// them. PDF text comes from pdftotext ($PDFTOTEXT_PATH or pdftotext on the
+// PATH) when it is installed; otherwise PDFs are found by name only.
+
+const (
+	searchMaxRead      = 4 << 20 // Of a text file or of pdftotext's output
+	searchPdfTimeout   = time.Minute
+	searchBatchSize    = 500 // Documents written to the index at a time
+	searchPageSize     = 5000
+	searchDefaultLimit = 50
+	searchMaxLimit     = 500
+
+	searchAnalyzer     = "flatnas-words"
+	searchIndexedAtKey = "indexedAt"
+)
+
+var (
+	errSearchDisabled = errors.New("Search index is disabled")
+	errNoPdftotext    = errors.New("pdftotext not found")
+)
+
+// Extensions of text files mime does not know as text
+var searchTextExts = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".csv": true, ".tsv": true, ".log": true, ".json": true,
+	".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".conf": true, ".cfg": true, ".xml": true,
+	".html": true, ".htm": true, ".css": true, ".js": true, ".ts": true, ".go": true, ".py": true,
+	".java": true, ".c": true, ".h": true, ".cpp": true, ".rs": true, ".sh": true, ".sql": true,
+	".srt": true, ".vtt": true, ".tex": true, ".rst": true, ".org": true,
+}
+
+// Camera raw formats, TIFF based so their EXIF can be read
+var searchRawExts = map[string]bool{
+	".dng": true, ".nef": true, ".cr2": true, ".arw": true, ".orf": true, ".rw2": true, ".pef": true, ".tif": true, ".tiff": true,
+}
+
+var searchArchiveExts = map[string]bool{
+	".zip": true, ".rar": true, ".7z": true, ".tar": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+}
+
+// searchDoc is a file or folder as the index holds it. The ID is its path.
+type searchDoc struct {
+	Path    string `json:"path"`
+	Name    string `json:"name"`
+	Content string `json:"content,omitempty"`
+	Kind    string `json:"kind"`
+	IsDir   bool   `json:"dir"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Photo   string `json:"photo,omitempty"` // EXIF of images, as PhotoMeta JSON
+}
+
+// searchState is what the index knows of a file to tell whether it changed
+type searchState struct {
+	isDir   bool
+	size    int64
+	modTime int64
+}
+
+// SearchHit is a search result
+type SearchHit struct {
+	Share   string  `json:"share"`
+	Path    string  `json:"path"`
+	Name    string  `json:"name"`
+	IsDir   bool    `json:"isDir"`
+	Size    int64   `json:"size"`
+	ModTime int64   `json:"modTime"`
+	Kind    string  `json:"kind"`
+	Score   float64 `json:"score"`
+}
+
+// SearchShareStatus describes the index of a share
+type SearchShareStatus struct {
+	Share     string `json:"share"`
+	Docs      uint64 `json:"docs"`
+	IndexedAt int64  `json:"indexedAt,omitempty"`
+	Indexing  bool   `json:"indexing"`
+	Progress  int64  `json:"progress,omitempty"` // Entries walked so far
+	Watching  bool   `json:"watching"`
+}
+
+var searchIndexes = struct {
+	sync.Mutex
+	byDir    map[string]bleve.Index // Open indexes by folder
+	indexing string                 // Share being walked
+	progress atomic.Int64
+}{byDir: make(map[string]bleve.Index)}
+
+// searchRun serializes the writers of the indexes
+var searchRun sync.Mutex
+
+// searchWordAnalyzer splits names and content with searchTokens, so the
+// index and the queries agree on what a word is
+type searchWordAnalyzer struct{}
+
+func (searchWordAnalyzer) Analyze(input []byte) analysis.TokenStream {
+	var stream analysis.TokenStream
+	searchTokens(string(input), func(t string) {
+		stream = append(stream, &analysis.Token{Term: []byte(t), Position: len(stream) + 1, Type: analysis.AlphaNumeric})
+	})
+	return stream
+}
+
+func init() {
+	registry.RegisterAnalyzer(searchAnalyzer, func(map[string]interface{}, *registry.Cache) (analysis.Analyzer, error) {
+		return searchWordAnalyzer{}, nil
+	})
+}
+
+func searchEnabled() bool {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	return sysConfig.EnableSearchIndex
+}
+
+func searchIndexDir(share string) string {
+	return filepath.Join(config.DataDir, "search-index", share+".bleve")
+}
+
+// searchMapping maps searchDoc: name and content are split into words,
+// content is not stored, and the other fields are kept for filters, sorting
+// and results
+func searchMapping() mapping.IndexMapping {
+	words := bleve.NewTextFieldMapping()
+	words.Analyzer = searchAnalyzer
+	words.IncludeTermVectors = false
+	words.DocValues = false
+	content := bleve.NewTextFieldMapping()
+	*content = *words
+	content.Store = false
+	keyword := bleve.NewKeywordFieldMapping()
+	keyword.IncludeTermVectors = false
+	stored := bleve.NewTextFieldMapping()
+	stored.Index = false
+	stored.DocValues = false
+	number := bleve.NewNumericFieldMapping()
+	flag := bleve.NewBooleanFieldMapping()
+
+	doc := bleve.NewDocumentStaticMapping()
+	for _, f := range []struct {
+		name string
+		m    *mapping.FieldMapping
+	}{{"path", keyword}, {"name", words}, {"content", content}, {"kind", keyword}, {"dir", flag}, {"size", number}, {"mtime", number}, {"photo", stored}} {
+		m := *f.m
+		m.IncludeInAll = false
+		doc.AddFieldMappingsAt(f.name, &m)
+	}
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	return m
+}
+
+// openSearchIndex returns the index of a share, opening it the first time.
+// Unless create is set, nil is returned for a share never indexed; with it,
+// an index that cannot be opened is replaced by an empty one.
+func openSearchIndex(share string, create bool) (bleve.Index, error) {
+	dir := searchIndexDir(share)
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	if idx := searchIndexes.byDir[dir]; idx != nil {
+		return idx, nil
+	}
+	idx, err := bleve.Open(dir)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) && !create {
+		return nil, nil
+	}
+	if err != nil && create {
+		if !errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+			filesLog.Warn("Search index unreadable, starting over", "share", share, "error", err)
+			os.RemoveAll(dir)
+		}
+		if err = os.MkdirAll(filepath.Dir(dir), 0755); err == nil {
+			idx, err = bleve.New(dir, searchMapping())
+		}
+		// The index of older versions, words kept per file in JSON
+		os.Remove(filepath.Join(filepath.Dir(dir), share+".json"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx.SetName(share)
+	searchIndexes.byDir[dir] = idx
+	return idx, nil
+}
+
+// closeSearchIndexes closes the open indexes
+func closeSearchIndexes() {
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	for dir, idx := range searchIndexes.byDir {
+		if err := idx.Close(); err != nil {
+			filesLog.Warn("Failed to close search index", "dir", dir, "error", err)
+		}
+		delete(searchIndexes.byDir, dir)
+	}
+}
+
+// pdftotextPath finds pdftotext: $PDFTOTEXT_PATH, else on the PATH
+func pdftotextPath() (string, error) {
+	if bin := strings.TrimSpace(os.Getenv("PDFTOTEXT_PATH")); bin != "" {
+		return bin, nil
+	}
+	bin, err := exec.LookPath("pdftotext")
+	if err != nil {
+		return "", errNoPdftotext
+	}
+	return bin, nil
+}
+
+// searchKind sorts a file for the type filter
+func searchKind(name string, isDir bool) string {
+	if isDir {
+		return "folder"
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	mt := fileMime(name)
+	switch {
+	case strings.HasPrefix(mt, "image/") || searchRawExts[ext]:
+		return "image"
+	case strings.HasPrefix(mt, "video/"):
+		return "video"
+	case strings.HasPrefix(mt, "audio/"):
+		return "audio"
+	case ext == ".pdf" || ext == ".doc" || ext == ".docx" || ext == ".odt" || ext == ".xls" || ext == ".xlsx" || ext == ".ppt" || ext == ".pptx":
+		return "document"
+	case searchTextExts[ext] || strings.HasPrefix(mt, "text/"):
+		return "text"
+	case searchArchiveExts[ext]:
+		return "archive"
+	}
+	return "other"
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// searchTokens splits text into index words: runs of letters and digits of
+// two characters or more, and CJK characters alone and in pairs
+func searchTokens(text string, add func(string)) {
+	var word strings.Builder
+	var prevCJK rune
+	flush := func() {
+		if w := word.String(); utf8.RuneCountInString(w) >= 2 && len(w) <= 64 {
+			add(w)
+		}
+		word.Reset()
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flush()
+			add(string(r))
+			if prevCJK != 0 {
+				add(string(prevCJK) + string(r))
+			}
+			prevCJK = r
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(unicode.ToLower(r))
+		default:
+			flush()
+		}
+		prevCJK = 0
+	}
+	flush()
+}
+
+// searchContent returns the text of a file worth indexing, "" for others
+func searchContent(ctx context.Context, full, kind string) string {
+	if strings.EqualFold(filepath.Ext(full), ".pdf") {
+		bin, err := pdftotextPath()
+		if err != nil {
+			return ""
+		}
+		ctx, cancel := context.WithTimeout(ctx, searchPdfTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, bin, "-q", "-enc", "UTF-8", full, "-")
+		out, err := cmd.StdoutPipe()
+		if err != nil || cmd.Start() != nil {
+			return ""
+		}
+		data, _ := io.ReadAll(io.LimitReader(out, searchMaxRead))
+		cmd.Process.Kill()
+		cmd.Wait()
+		return string(data)
+	}
+	if kind != "text" {
+		return ""
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(io.LimitReader(f, searchMaxRead))
+	// A NUL early on means a binary file with a text-like name
+	if bytes.IndexByte(data[:min(len(data), 8<<10)], 0) >= 0 {
+		return ""
+	}
+	return strings.ToValidUTF8(string(data), " ")
+}
+
+// fieldNumber reads a stored numeric field of a hit
+func fieldNumber(fields map[string]interface{}, name string) int64 {
+	n, _ := fields[name].(float64)
+	return int64(n)
+}
+
+// eachSearchDoc calls fn with the documents of idx q matches, in path
+// order, with the stored fields asked for
+func eachSearchDoc(idx bleve.Index, q query.Query, fields []string, fn func(hit *search.DocumentMatch)) error {
+	var after []string
+	for {
+		req := bleve.NewSearchRequestOptions(q, searchPageSize, 0, false)
+		req.Fields = fields
+		req.SortBy([]string{"_id"})
+		if after != nil {
+			req.SetSearchAfter(after)
+		}
+		res, err := idx.Search(req)
+		if err != nil {
+			return err
+		}
+		for _, hit := range res.Hits {
+			fn(hit)
+		}
+		if len(res.Hits) < searchPageSize {
+			return nil
+		}
+		after = []string{res.Hits[len(res.Hits)-1].ID}
+	}
+}
+
+// indexedStates returns what idx holds of rel and, with below, of the
+// paths under it; "" and below is the whole share
+func indexedStates(idx bleve.Index, rel string, below bool) (map[string]searchState, error) {
+	var q query.Query = bleve.NewDocIDQuery([]string{rel})
+	if below && rel == "" {
+		q = bleve.NewMatchAllQuery()
+	} else if below {
+		under := bleve.NewPrefixQuery(rel + "/")
+		under.SetField("path")
+		q = bleve.NewDisjunctionQuery(q, under)
+	}
+	states := make(map[string]searchState)
+	err := eachSearchDoc(idx, q, []string{"dir", "size", "mtime"}, func(hit *search.DocumentMatch) {
+		isDir, _ := hit.Fields["dir"].(bool)
+		states[hit.ID] = searchState{isDir: isDir, size: fieldNumber(hit.Fields, "size"), modTime: fieldNumber(hit.Fields, "mtime")}
+	})
+	return states, err
+}
+
+// searchBatch writes documents to an index in batches
+type searchBatch struct {
+	idx   bleve.Index
+	b     *bleve.Batch
+	read  int // Files whose content or EXIF was read
+	count int // Documents written or deleted
+}
+
+func newSearchBatch(idx bleve.Index) *searchBatch {
+	return &searchBatch{idx: idx, b: idx.NewBatch()}
+}
+
+func (sb *searchBatch) flushIfFull() error {
+	if sb.b.Size() < searchBatchSize {
+		return nil
+	}
+	return sb.flush()
+}
+
+func (sb *searchBatch) flush() error {
+	if sb.b.Size() == 0 {
+		return nil
+	}
+	err := sb.idx.Batch(sb.b)
+	sb.b.Reset()
+	return err
+}
+
+func (sb *searchBatch) index(doc searchDoc) error {
+	sb.count++
+	if err := sb.b.Index(doc.Path, doc); err != nil {
+		return err
+	}
+	return sb.flushIfFull()
+}
+
+func (sb *searchBatch) delete(rel string) error {
+	sb.count++
+	sb.b.Delete(rel)
+	return sb.flushIfFull()
+}
+
+// syncSearchPath brings the index of rel, and with recursive of everything
+// below it, in line with the share folder root. Files whose size and
+// modification time are unchanged are not read again; paths gone from the
+// folder are deleted. The recycle bin and snapshots are left out.
+func syncSearchPath(ctx context.Context, idx bleve.Index, root, rel string, recursive bool, progress func()) (*searchBatch, error) {
+	sb := newSearchBatch(idx)
+	if hiddenShareDir(strings.SplitN(rel, "/", 2)[0]) {
+		return sb, nil
+	}
+	start := filepath.Join(root, filepath.FromSlash(rel))
+	if _, err := os.Lstat(start); os.IsNotExist(err) {
+		recursive = true
+	}
+	indexed, err := indexedStates(idx, rel, recursive)
+	if err != nil {
+		return sb, err
+	}
+	visit := func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if p == start && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		r := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(p, root)), "/")
+		if r == "" {
+			return nil
+		}
+		if d.IsDir() && hiddenShareDir(r) {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if progress != nil {
+			progress()
+		}
+		doc := searchDoc{Path: r, Name: d.Name(), IsDir: d.IsDir(), ModTime: info.ModTime().UnixMilli(), Kind: searchKind(d.Name(), d.IsDir())}
+		if !doc.IsDir {
+			doc.Size = info.Size()
+		}
+		prev, seen := indexed[r]
+		delete(indexed, r)
+		if seen && prev == (searchState{isDir: doc.IsDir, size: doc.Size, modTime: doc.ModTime}) {
+			return nil
+		}
+		if doc.Kind == "image" {
+			if meta, _ := readPhotoMeta(p); meta != nil {
+				data, _ := json.Marshal(meta)
+				doc.Photo = string(data)
+			}
+			sb.read++
+		} else if !doc.IsDir {
+			if doc.Content = searchContent(ctx, p, doc.Kind); doc.Content != "" {
+				sb.read++
+			}
+		}
+		return sb.index(doc)
+	}
+	if recursive {
+		err = filepath.WalkDir(start, visit)
+	} else {
+		var info fs.FileInfo
+		info, err = os.Lstat(start)
+		err = visit(start, fs.FileInfoToDirEntry(info), err)
+	}
+	if err != nil {
+		return sb, err
+	}
+	for r := range indexed {
+		if err := sb.delete(r); err != nil {
+			return sb, err
+		}
+	}
+	return sb, sb.flush()
+}
+
+// indexShare walks a whole share and brings its index up to date
+func indexShare(ctx context.Context, share models.FileShare) error {
+	searchRun.Lock()
+	defer searchRun.Unlock()
+	searchIndexes.Lock()
+	searchIndexes.indexing = share.Name
+	searchIndexes.progress.Store(0)
+	searchIndexes.Unlock()
+	defer func() {
+		searchIndexes.Lock()
+		searchIndexes.indexing = ""
+		searchIndexes.Unlock()
+	}()
+
+	root, err := filepath.EvalSymlinks(share.Path)
+	if err != nil {
+		return err
+	}
+	idx, err := openSearchIndex(share.Name, true)
+	if err != nil {
+		return err
+	}
+	sb, err := syncSearchPath(ctx, idx, root, "", true, func() { searchIndexes.progress.Add(1) })
+	if err != nil {
+		return err
+	}
+	idx.SetInternal([]byte(searchIndexedAtKey), []byte(strconv.FormatInt(time.Now().UnixMilli(), 10)))
+	if sb.count > 0 {
+		filesLog.Info("Search index updated", "share", share.Name, "changed", sb.count, "read", sb.read)
+	}
+	return nil
+}
+
+// searchQuery is a parsed search request
+type searchQuery struct {
+	terms       []string
+	kinds       map[string]bool
+	minSize     int64
+	maxSize     int64
+	after       int64
+	before      int64
+	pathPrefix  string
+	contentOnly bool
+	tags        []string
+	ids         []string // Paths carrying the tags, in any share
+}
+
+func numericRange(min, max int64) query.Query {
+	inclusive := true
+	var lo, hi *float64
+	if min > 0 {
+		v := float64(min)
+		lo = &v
+	}
+	if max > 0 {
+		v := float64(max)
+		hi = &v
+	}
+	return bleve.NewNumericRangeInclusiveQuery(lo, hi, &inclusive, &inclusive)
+}
+
+// bleveQuery builds the query of q. Every word must match as the prefix
+// of a word of the name, which weighs three times as much, or of the
+// content.
+func (q searchQuery) bleveQuery() query.Query {
+	var must []query.Query
+	for _, term := range q.terms {
+		content := bleve.NewPrefixQuery(term)
+		content.SetField("content")
+		if q.contentOnly {
+			must = append(must, content)
+			continue
+		}
+		name := bleve.NewPrefixQuery(term)
+		name.SetField("name")
+		name.SetBoost(3)
+		must = append(must, bleve.NewDisjunctionQuery(name, content))
+	}
+	if len(q.kinds) > 0 {
+		kinds := bleve.NewDisjunctionQuery()
+		for k := range q.kinds {
+			tq := bleve.NewTermQuery(k)
+			tq.SetField("kind")
+			kinds.AddQuery(tq)
+		}
+		must = append(must, kinds)
+	}
+	if q.minSize > 0 || q.maxSize > 0 {
+		size := numericRange(q.minSize, q.maxSize).(*query.NumericRangeQuery)
+		size.SetField("size")
+		must = append(must, size)
+	}
+	if q.maxSize > 0 {
+		files := bleve.NewBoolFieldQuery(false)
+		files.SetField("dir")
+		must = append(must, files)
+	}
+	if q.after > 0 || q.before > 0 {
+		mtime := numericRange(q.after, q.before).(*query.NumericRangeQuery)
+		mtime.SetField("mtime")
+		must = append(must, mtime)
+	}
+	if q.tags != nil {
+		must = append(must, bleve.NewDocIDQuery(q.ids))
+	}
+	if q.pathPrefix != "" {
+		under := bleve.NewPrefixQuery(q.pathPrefix + "/")
+		under.SetField("path")
+		must = append(must, under)
+	}
+	if len(must) == 0 {
+		return bleve.NewMatchAllQuery()
+	}
+	return bleve.NewConjunctionQuery(must...)
+}
+
+func parseSearchQuery(c *gin.Context) (searchQuery, bool) {
+	q := searchQuery{contentOnly: c.Query("in") == "content"}
+	seen := make(map[string]bool)
+	searchTokens(c.Query("q"), func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			q.terms = append(q.terms, t)
+		}
+	})
+	if kinds := c.Query("type"); kinds != "" {
+		q.kinds = make(map[string]bool)
+		for _, k := range strings.Split(kinds, ",") {
+			q.kinds[strings.TrimSpace(k)] = true
+		}
+	}
+	for name, dst := range map[string]*int64{"minSize": &q.minSize, "maxSize": &q.maxSize, "after": &q.after, "before": &q.before} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return q, false
+			}
+			*dst = n
+		}
+	}
+	if p := c.Query("path"); p != "" {
+		rel, err := cleanSharePath(p)
+		if err != nil {
+			return q, false
+		}
+		q.pathPrefix = rel
+	}
+	if tags := c.QueryArray("tag"); len(tags) > 0 {
+		if q.tags = splitTags(tags); len(q.tags) == 0 || len(q.tags) > maxFileTags {
+			return q, false
+		}
+	}
+	// Without words the filters alone would list whole shares
+	return q, len(q.terms) > 0 || len(q.kinds) > 0 || q.minSize > 0 || q.after > 0 || len(q.tags) > 0
+}
+
+// SearchFiles finds files by name and content. q holds the words, all of
+// which must match; type (comma separated kinds), minSize, maxSize (bytes),
+// after, before (ms), tag (items carrying every tag), share, path and
+// in=content narrow the results.
+func SearchFiles(c *gin.Context) {
+	q, ok := parseSearchQuery(c)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(searchDefaultLimit)))
+	offset, oerr := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if !ok || err != nil || oerr != nil || limit < 1 || limit > searchMaxLimit || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid search"})
+		return
+	}
+	shares := loadFileShares()
+	if name := c.Query("share"); name != "" {
+		share, err := findFileShare(name)
+		if err != nil {
+			fileError(c, err, "")
+			return
+		}
+		shares = []models.FileShare{share}
+	} else if q.pathPrefix != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid search"})
+		return
+	}
+	// The index has no tags, which are the user's own: the query is held
+	// to the tagged paths and the shares they are in
+	var tagged map[[2]string]bool
+	if q.tags != nil {
+		if config.Store == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": errMarksUnavailable.Error()})
+			return
+		}
+		marks, err := config.Store.TaggedFiles(c.GetString("username"), q.tags)
+		if err != nil {
+			fileError(c, err, "")
+			return
+		}
+		tagged = make(map[[2]string]bool, len(marks))
+		inShare := make(map[string]bool)
+		q.ids = []string{}
+		for _, m := range marks {
+			tagged[[2]string{m.Share, m.Path}] = true
+			inShare[m.Share] = true
+			q.ids = append(q.ids, m.Path)
+		}
+		var kept []models.FileShare
+		for _, share := range shares {
+			if inShare[share.Name] {
+				kept = append(kept, share)
+			}
+		}
+		shares = kept
+	}
+
+	alias := bleve.NewIndexAlias()
+	for _, share := range shares {
+		idx, err := openSearchIndex(share.Name, false)
+		if err != nil {
+			filesLog.Warn("Failed to open search index", "share", share.Name, "error", err)
+		}
+		if idx != nil {
+			alias.Add(idx)
+		}
+	}
+	hits := []SearchHit{}
+	total := 0
+	if len(shares) > 0 {
+		req := bleve.NewSearchRequestOptions(q.bleveQuery(), limit, offset, false)
+		req.Fields = []string{"dir", "size", "mtime", "kind"}
+		req.SortBy([]string{"-_score", "-mtime", "_id"})
+		res, err := alias.SearchInContext(c.Request.Context(), req)
+		if err != nil {
+			filesLog.Warn("Search failed", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+			return
+		}
+		for _, h := range res.Hits {
+			if tagged != nil && !tagged[[2]string{h.Index, h.ID}] {
+				// Tagged in another share only; total still counts it
+				continue
+			}
+			isDir, _ := h.Fields["dir"].(bool)
+			kind, _ := h.Fields["kind"].(string)
+			hits = append(hits, SearchHit{Share: h.Index, Path: h.ID, Name: path.Base(h.ID), IsDir: isDir, Size: fieldNumber(h.Fields, "size"), ModTime: fieldNumber(h.Fields, "mtime"), Kind: kind, Score: h.Score})
+		}
+		total = int(res.Total)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"hits": hits, "total": total}})
+}
+
+// GetSearchStatus describes the index of each share
+func GetSearchStatus(c *gin.Context) {
+	statuses := []SearchShareStatus{}
+	for _, share := range loadFileShares() {
+		s := SearchShareStatus{Share: share.Name, Watching: searchWatching(share.Name)}
+		if idx, _ := openSearchIndex(share.Name, false); idx != nil {
+			s.Docs, _ = idx.DocCount()
+			if at, _ := idx.GetInternal([]byte(searchIndexedAtKey)); at != nil {
+				s.IndexedAt, _ = strconv.ParseInt(string(at), 10, 64)
+			}
+		}
+		searchIndexes.Lock()
+		if searchIndexes.indexing == share.Name {
+			s.Indexing = true
+			s.Progress = searchIndexes.progress.Load()
+		}
+		searchIndexes.Unlock()
+		statuses = append(statuses, s)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"enabled": searchEnabled(), "shares": statuses}})
+}
+
+// ReindexSearch walks a share (or every share) now, for changes the
+// watcher could not see
+func ReindexSearch(c *gin.Context) {
+	if !searchEnabled() {
+		c.JSON(http.StatusConflict, gin.H{"error": errSearchDisabled.Error()})
+		return
+	}
+	var req struct {
+		Share string `json:"share"`
+	}
+	c.ShouldBindJSON(&req)
+	shares := loadFileShares()
+	if req.Share != "" {
+		share, err := findFileShare(req.Share)
+		if err != nil {
+			fileError(c, err, "")
+			return
+		}
+		shares = []models.FileShare{share}
+	}
+	go func() {
+		for _, share := range shares {
+			if err := indexShare(backgroundCtx, share); err != nil && backgroundCtx.Err() == nil {
+				filesLog.Warn("Search indexing failed", "share", share.Name, "error", err)
+			}
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"success": true})
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSearchIndex(t *testing.T) {
+	useTestConfig(t)
+	t.Cleanup(closeSearchIndexes)
+	gin.SetMode(gin.TestMode)
+
+	root, bin := t.TempDir(), t.TempDir()
+	write := func(p, text string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, p)), 0755)
+		os.WriteFile(filepath.Join(root, p), []byte(text), 0644)
+	}
+	write("notes/todo.md", "Buy milk tomorrow")
+	write("docs/报告.txt", "季度报告的内容")
+	write("docs/invoice.pdf", "%PDF-1.4")
+	write("photos/milk.jpg", "\xff\xd8\xff")
+	write("data.bin", "milk\x00\x01")
+	write(".trash/files/x.txt", "milk")
+	// The fake pdftotext counts its runs
+	runs := filepath.Join(bin, "runs")
+	os.WriteFile(filepath.Join(bin, "pdftotext"), []byte("#!/bin/sh\necho run >> "+runs+"\necho 'Invoice total 42 EUR'\n"), 0755)
+	t.Setenv("PDFTOTEXT_PATH", filepath.Join(bin, "pdftotext"))
+	share := models.FileShare{Name: "main", Path: root}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{share}, EnableSearchIndex: true})
+
+	r := gin.New()
+	r.GET("/search", SearchFiles)
+	search := func(query string) []SearchHit {
+		var resp struct {
+			Data struct{ Hits []SearchHit }
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/search?"+query, nil))
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 {
+			t.Fatalf("search %s failed: %d %s", query, w.Code, w.Body.String())
+		}
+		return resp.Data.Hits
+	}
+	paths := func(hits []SearchHit) string {
+		var out []string
+		for _, h := range hits {
+			out = append(out, h.Path)
+		}
+		return strings.Join(out, ",")
+	}
+
+	if err := indexShare(context.Background(), share); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	// A name match ranks above a content match; binaries and the bin are left out
+	if got := paths(search("q=milk")); got != "photos/milk.jpg,notes/todo.md" {
+		t.Fatalf("unexpected hits %q", got)
+	}
+	if got := paths(search("q=tomor")); got != "notes/todo.md" {
+		t.Fatalf("prefix search failed: %q", got)
+	}
+	if got := paths(search("q=milk&type=text")); got != "notes/todo.md" {
+		t.Fatalf("type filter failed: %q", got)
+	}
+	if got := paths(search("q=报告")); got != "docs/报告.txt" {
+		t.Fatalf("CJK search failed: %q", got)
+	}
+	if got := paths(search("q=invoice+total&in=content")); got != "docs/invoice.pdf" {
+		t.Fatalf("PDF search failed: %q", got)
+	}
+	if got := paths(search("q=milk&share=main&path=notes&minSize=5")); got != "notes/todo.md" {
+		t.Fatalf("filters failed: %q", got)
+	}
+	if got := search("q=milk&maxSize=3"); len(got) != 1 || got[0].Path != "photos/milk.jpg" {
+		t.Fatalf("size filter failed: %+v", got)
+	}
+
+	// A second run reads only what changed
+	write("notes/todo.md", "Buy bread tomorrow and more")
+	if err := indexShare(context.Background(), share); err != nil {
+		t.Fatalf("reindex: %v", err)
+	}
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run") != 1 {
+		t.Fatalf("unchanged PDF read again: %q", data)
+	}
+	if got := paths(search("q=bread")); got != "notes/todo.md" {
+		t.Fatalf("changed file not reindexed: %q", got)
+	}
+
+	// The index is read back from disk
+	closeSearchIndexes()
+	if got := paths(search("q=invoice")); got != "docs/invoice.pdf" {
+		t.Fatalf("saved index not loaded: %q", got)
+	}
+
+	// Deleted files leave the index
+	os.Remove(filepath.Join(root, "photos/milk.jpg"))
+	if err := indexShare(context.Background(), share); err != nil {
+		t.Fatalf("reindex: %v", err)
+	}
+	if got := paths(search("q=milk")); got != "" {
+		t.Fatalf("deleted file still found: %q", got)
+	}
+}
+
+func TestSearchWatch(t *testing.T) {
+	useTestConfig(t)
+	t.Cleanup(closeSearchIndexes)
+	gin.SetMode(gin.TestMode)
+	prevDelay := searchSettleDelay
+	searchSettleDelay = 100 * time.Millisecond
+	defer func() { searchSettleDelay = prevDelay }()
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "plan.txt"), []byte("quarterly plan"), 0644)
+	share := models.FileShare{Name: "main", Path: root}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{share}, EnableSearchIndex: true})
+	if err := indexShare(context.Background(), share); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	sw, err := watchShare(share)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	searchWatches.Lock()
+	searchWatches.byShare["main"] = sw
+	searchWatches.Unlock()
+	defer stopSearchWatches()
+
+	r := gin.New()
+	r.GET("/search", SearchFiles)
+	// found polls until the watched changes are indexed
+	found := func(query, want string) {
+		t.Helper()
+		var got string
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			flushSearchWatches(context.Background())
+			var resp struct {
+				Data struct{ Hits []SearchHit }
+			}
+			w := serve(r, "GET", "/search?"+query, "")
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			var out []string
+			for _, h := range resp.Data.Hits {
+				out = append(out, h.Path)
+			}
+			if got = strings.Join(out, ","); got == want {
+				return
+			}
+		}
+		t.Fatalf("search %s: got %q, want %q", query, got, want)
+	}
+
+	// A file written, a folder moved in with files, a file renamed
+	os.WriteFile(filepath.Join(root, "docs", "budget.txt"), []byte("quarterly budget"), 0644)
+	found("q=quarterly", "docs/budget.txt,docs/plan.txt")
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(outside, "trip", "day1"), 0755)
+	os.WriteFile(filepath.Join(outside, "trip", "day1", "notes.md"), []byte("ferry times"), 0644)
+	os.Rename(filepath.Join(outside, "trip"), filepath.Join(root, "trip"))
+	found("q=ferry", "trip/day1/notes.md")
+	os.WriteFile(filepath.Join(root, "trip", "day1", "extra.md"), []byte("ferry back"), 0644)
+	found("q=ferry+back", "trip/day1/extra.md")
+	os.Rename(filepath.Join(root, "trip"), filepath.Join(root, "journey"))
+	found("q=ferry+times", "journey/day1/notes.md")
+	os.RemoveAll(filepath.Join(root, "docs"))
+	found("q=quarterly", "")
+}
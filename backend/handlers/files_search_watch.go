@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"flatnasgo-backend/models"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// The indexer keeps the search indexes current from filesystem events
+// rather than by walking the shares again and again. Every folder of a
+// share is watched with fsnotify (inotify on Linux, one watch per folder);
+// the paths events name are collected and indexed once the share has been
+// quiet for searchSettleDelay, a new folder with everything in it. A share
+// is walked in full when its watch starts, which covers what changed while
+// the server was down, and again when the kernel reports lost events.
+// Folders beyond fs.inotify.max_user_watches are not watched; their
+// changes are picked up by a reindex.
+
+const searchConfigInterval = time.Minute // Shares and the setting are checked this often
+
+var searchSettleDelay = 2 * time.Second
+
+// searchWatch watches the folders of one share
+type searchWatch struct {
+	share models.FileShare
+	root  string
+	w     *fsnotify.Watcher
+
+	mu      sync.Mutex
+	dirs    map[string]bool // Watched folders
+	pending map[string]bool // Changed path -> index what is below it too
+	last    time.Time       // Of the latest event
+	rescan  bool            // Events were lost; walk the share again
+	partial bool            // Some folders could not be watched
+}
+
+var searchWatches = struct {
+	sync.Mutex
+	byShare map[string]*searchWatch
+	failed  map[string]string // Share -> why it is not watched, logged once
+}{byShare: make(map[string]*searchWatch), failed: make(map[string]string)}
+
+// watchShare starts watching the folders of a share
+func watchShare(share models.FileShare) (*searchWatch, error) {
+	root, err := filepath.EvalSymlinks(share.Path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	sw := &searchWatch{share: share, root: root, w: w, dirs: make(map[string]bool), pending: make(map[string]bool)}
+	if err := w.Add(root); err != nil {
+		w.Close()
+		return nil, err
+	}
+	sw.addTree(root)
+	go sw.run()
+	return sw, nil
+}
+
+// rel returns the share path of a file the watcher names; false for the
+// share folder itself and for the recycle bin and snapshots
+func (sw *searchWatch) rel(name string) (string, bool) {
+	rel := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(name, sw.root)), "/")
+	if rel == "" || hiddenShareDir(strings.SplitN(rel, "/", 2)[0]) {
+		return "", false
+	}
+	return rel, true
+}
+
+// addTree watches dir and the folders below it
+func (sw *searchWatch) addTree(dir string) {
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || p == sw.root {
+			return nil
+		}
+		if _, ok := sw.rel(p); !ok {
+			return filepath.SkipDir
+		}
+		err = sw.w.Add(p)
+		sw.mu.Lock()
+		defer sw.mu.Unlock()
+		if err != nil {
+			if !sw.partial {
+				filesLog.Warn("Cannot watch share folder, raise fs.inotify.max_user_watches", "share", sw.share.Name, "path", p, "error", err)
+			}
+			sw.partial = true
+			return filepath.SkipDir
+		}
+		sw.dirs[p] = true
+		return nil
+	})
+}
+
+// unwatch stops watching a folder that moved away, with those below it.
+// Watches follow the folder, so they would report its old path.
+func (sw *searchWatch) unwatch(dir string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if !sw.dirs[dir] {
+		return
+	}
+	for p := range sw.dirs {
+		if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			sw.w.Remove(p)
+			delete(sw.dirs, p)
+		}
+	}
+}
+
+func (sw *searchWatch) run() {
+	for {
+		select {
+		case ev, ok := <-sw.w.Events:
+			if !ok {
+				return
+			}
+			sw.event(ev)
+		case err, ok := <-sw.w.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				filesLog.Warn("Share events lost, walking it again", "share", sw.share.Name)
+				sw.mu.Lock()
+				sw.rescan = true
+				sw.mu.Unlock()
+			} else {
+				filesLog.Warn("Share watch error", "share", sw.share.Name, "error", err)
+			}
+		}
+	}
+}
+
+func (sw *searchWatch) event(ev fsnotify.Event) {
+	rel, ok := sw.rel(ev.Name)
+	if !ok {
+		return
+	}
+	moved := ev.Has(fsnotify.Create) || ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename)
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		sw.unwatch(ev.Name)
+	}
+	if ev.Has(fsnotify.Create) {
+		if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+			sw.addTree(ev.Name)
+		}
+	}
+	sw.mu.Lock()
+	sw.pending[rel] = sw.pending[rel] || moved
+	sw.last = time.Now()
+	sw.mu.Unlock()
+}
+
+// take returns the changed paths once the share has been quiet for
+// searchSettleDelay, leaving out those below another path taken with
+// what is below it
+func (sw *searchWatch) take() (map[string]bool, bool) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	rescan := sw.rescan
+	if len(sw.pending) == 0 && !rescan || time.Since(sw.last) < searchSettleDelay {
+		return nil, false
+	}
+	pending := sw.pending
+	sw.pending, sw.rescan = make(map[string]bool), false
+	rels := make([]string, 0, len(pending))
+	for rel := range pending {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	for i, rel := range rels {
+		for _, parent := range rels[:i] {
+			if pending[parent] && strings.HasPrefix(rel, parent+"/") {
+				delete(pending, rel)
+				break
+			}
+		}
+	}
+	return pending, rescan
+}
+
+func (sw *searchWatch) stop() {
+	sw.w.Close()
+}
+
+// searchWatching reports whether every folder of a share is watched
+func searchWatching(share string) bool {
+	searchWatches.Lock()
+	sw := searchWatches.byShare[share]
+	searchWatches.Unlock()
+	if sw == nil {
+		return false
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return !sw.partial
+}
+
+// noteSearchChanges hands the index changes the file browser saw in dir, a
+// folder of share the index does not watch itself, one over the watch
+// limit for example. rels maps the changed paths to whether what is below
+// them changed too.
+func noteSearchChanges(share, dir string, rels map[string]bool) {
+	searchWatches.Lock()
+	sw := searchWatches.byShare[share]
+	searchWatches.Unlock()
+	if sw == nil {
+		return
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if dir == sw.root || sw.dirs[dir] {
+		return
+	}
+	for rel, below := range rels {
+		sw.pending[rel] = sw.pending[rel] || below
+	}
+	sw.last = time.Now()
+}
+
+// walkShareInBackground brings the index of a share up to date with a walk
+func walkShareInBackground(share models.FileShare) {
+	done, ok := beginTask()
+	if !ok {
+		return
+	}
+	go func() {
+		defer done()
+		if err := indexShare(backgroundCtx, share); err != nil && backgroundCtx.Err() == nil {
+			filesLog.Warn("Search indexing failed", "share", share.Name, "error", err)
+		}
+	}()
+}
+
+// updateSearchWatches watches the shares while the system config enables
+// the index, following shares as they are added, moved and removed
+func updateSearchWatches() {
+	want := make(map[string]models.FileShare)
+	if searchEnabled() {
+		for _, share := range loadFileShares() {
+			want[share.Name] = share
+		}
+	}
+	searchWatches.Lock()
+	defer searchWatches.Unlock()
+	for name, sw := range searchWatches.byShare {
+		if share, ok := want[name]; !ok || share.Path != sw.share.Path {
+			sw.stop()
+			delete(searchWatches.byShare, name)
+		}
+	}
+	for name, share := range want {
+		if searchWatches.byShare[name] != nil {
+			continue
+		}
+		sw, err := watchShare(share)
+		if err != nil {
+			if searchWatches.failed[name] != err.Error() {
+				filesLog.Warn("Cannot watch share", "share", name, "error", err)
+				searchWatches.failed[name] = err.Error()
+			}
+			continue
+		}
+		delete(searchWatches.failed, name)
+		searchWatches.byShare[name] = sw
+		walkShareInBackground(share)
+	}
+}
+
+// flushSearchWatches indexes the paths that changed in the watched shares.
+// While a walk runs the changes wait for the next flush.
+func flushSearchWatches(ctx context.Context) {
+	if !searchRun.TryLock() {
+		return
+	}
+	defer searchRun.Unlock()
+	searchWatches.Lock()
+	watches := make([]*searchWatch, 0, len(searchWatches.byShare))
+	for _, sw := range searchWatches.byShare {
+		watches = append(watches, sw)
+	}
+	searchWatches.Unlock()
+
+	for _, sw := range watches {
+		pending, rescan := sw.take()
+		if rescan {
+			walkShareInBackground(sw.share)
+			continue
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		// A share not indexed yet is left to its first walk
+		idx, err := openSearchIndex(sw.share.Name, false)
+		if err != nil || idx == nil {
+			continue
+		}
+		changed := 0
+		for rel, below := range pending {
+			sb, err := syncSearchPath(ctx, idx, sw.root, rel, below, nil)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				filesLog.Warn("Search index update failed", "share", sw.share.Name, "path", rel, "error", err)
+			}
+			changed += sb.count
+		}
+		if changed > 0 {
+			filesLog.Debug("Search index followed changes", "share", sw.share.Name, "paths", len(pending), "changed", changed)
+		}
+	}
+}
+
+func stopSearchWatches() {
+	searchWatches.Lock()
+	defer searchWatches.Unlock()
+	for name, sw := range searchWatches.byShare {
+		sw.stop()
+		delete(searchWatches.byShare, name)
+	}
+}
+
+// StartSearchIndexer keeps the indexes of the shares up to date while the
+// system config enables it
+func StartSearchIndexer() {
+	go func() {
+		ticker := time.NewTicker(searchSettleDelay)
+		defer ticker.Stop()
+		beat := registerWorker("search.index", searchConfigInterval)
+		var checked time.Time
+		for {
+			if time.Since(checked) >= searchConfigInterval {
+				beat()
+				checked = time.Now()
+				updateSearchWatches()
+			}
+			flushSearchWatches(backgroundCtx)
+			select {
+			case <-backgroundCtx.Done():
+				stopSearchWatches()
+				searchRun.Lock()
+				closeSearchIndexes()
+				searchRun.Unlock()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
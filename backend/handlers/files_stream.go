@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Media types the system mime table often lacks, notably on Alpine where
+// there is no /etc/mime.types; browsers and TVs refuse to play a video
+// served as application/octet-stream
+var mediaTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mkv":  "video/x-matroska",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".wmv":  "video/x-ms-wmv",
+	".flv":  "video/x-flv",
+	".ts":   "video/mp2t",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".vtt":  "text/vtt",
+	".srt":  "application/x-subrip",
+}
+
+// StreamFile serves a share file with Range support, so players can seek
+// without downloading the whole file. The system config may cap each
+// stream's bandwidth (streamRateLimit, KiB/s); the rate query parameter
+// asks for a lower cap, e.g. to keep a remote stream from saturating an
+// uplink. download=1 saves the file instead of playing it.
+func StreamFile(c *gin.Context) {
+	share, err := findFileShare(c.Query("share"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	p := c.Query("path")
+	full, err := resolveSharePath(share, p)
+	if err != nil {
+		fileError(c, err, p)
+		return
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		fileError(c, err, p)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fileError(c, err, p)
+		return
+	}
+	if info.IsDir() {
+		fileError(c, errInvalidPath, p)
+		return
+	}
+	rate, ok := streamRate(c.Query("rate"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rate"})
+		return
+	}
+
+	disposition := "inline"
+	if c.Query("download") == "1" {
+		disposition = "attachment"
+	}
+	c.Header("Content-Type", fileMime(info.Name()))
+	c.Header("Content-Disposition", disposition+"; filename*=UTF-8''"+url.PathEscape(info.Name()))
+	c.Header("Cache-Control", "private, max-age=3600")
+
+	var content io.ReadSeeker = f
+	if rate > 0 {
+		content = &throttledReader{ctx: c.Request.Context(), r: f, rate: rate}
+	}
+	// ServeContent answers Range, If-Range and conditional requests
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), content)
+}
+
+// streamRate is the bandwidth cap of a stream in bytes per second, 0 for
+// none: the lower of the configured limit and the requested one
+func streamRate(raw string) (int64, bool) {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	limit := int64(sysConfig.StreamRateLimit)
+	if raw != "" {
+		requested, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil || requested < 0 {
+			return 0, false
+		}
+		if requested > 0 && (limit == 0 || requested < limit) {
+			limit = requested
+		}
+	}
+	return limit << 10, true
+}
+
+// throttledReader paces reads to rate bytes per second. The budget starts
+// over after a seek, which ServeContent does once per range.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.ReadSeeker
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	// Small reads keep the pace smooth instead of bursting then stalling
+	if chunk := max(t.rate/10, 1); int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if wait := due - time.Since(t.start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+func (t *throttledReader) Seek(offset int64, whence int) (int64, error) {
+	t.start, t.read = time.Time{}, 0
+	return t.r.Seek(offset, whence)
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"bytes"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStreamFile(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	video := bytes.Repeat([]byte("0123456789abcdef"), 512) // 8 KiB
+	os.WriteFile(filepath.Join(root, "clip.mkv"), video, 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	r := gin.New()
+	r.GET("/stream", StreamFile)
+	get := func(target, rangeHeader string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", target, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/stream?share=main&path=clip.mkv", "bytes=16-31")
+	if w.Code != 206 || w.Body.String() != "0123456789abcdef" || w.Header().Get("Content-Range") != "bytes 16-31/8192" {
+		t.Fatalf("unexpected range response %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "video/x-matroska" {
+		t.Fatalf("expected the matroska type, got %q", got)
+	}
+	if w := get("/stream?share=main&path=clip.mkv", "bytes=9000-"); w.Code != 416 {
+		t.Fatalf("expected 416 past the end, got %d", w.Code)
+	}
+	if w := get("/stream?share=main&path=../x", ""); w.Code != 404 && w.Code != 400 {
+		t.Fatalf("expected a path outside the share to fail, got %d", w.Code)
+	}
+
+	// 16 KiB/s for 8 KiB takes about half a second
+	start := time.Now()
+	w = get("/stream?share=main&path=clip.mkv&rate=16", "")
+	if w.Code != 200 || w.Body.Len() != len(video) {
+		t.Fatalf("throttled stream failed: %d %d", w.Code, w.Body.Len())
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected the stream to be throttled, took %v", elapsed)
+	}
+}
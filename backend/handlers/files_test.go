@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFileBrowser(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs", "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	shares, err := decodeFileShares([]interface{}{map[string]interface{}{"name": "main", "path": root}}, nil)
+	if err != nil {
+		t.Fatalf("decode shares: %v", err)
+	}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: shares})
+
+	r := gin.New()
+	r.GET("/files/list", ListFiles)
+	r.POST("/files/rename", RenameFile)
+	r.POST("/files/copy", CopyFiles)
+	r.POST("/files/move", MoveFiles)
+	r.POST("/files/delete", DeleteFiles)
+
+	code, resp := serveJSON(r, "GET", "/files/list?share=main&path=docs", "")
+	entries, _ := resp["data"].(map[string]interface{})["entries"].([]interface{})
+	if code != 200 || len(entries) != 2 || entries[0].(map[string]interface{})["name"] != "sub" {
+		t.Fatalf("unexpected listing %d %v", code, resp)
+	}
+	// ".." stops at the share root
+	if _, resp := serveJSON(r, "GET", "/files/list?share=main&path=../..", ""); resp["data"].(map[string]interface{})["path"] != "" {
+		t.Fatalf("expected the share root, got %v", resp)
+	}
+	if code, _ := serveJSON(r, "GET", "/files/list?share=main&path=escape", ""); code != 400 {
+		t.Fatalf("expected listing through a symlink out of the share to fail, got %d", code)
+	}
+	if code, _ := serveJSON(r, "POST", "/files/copy", `{"share":"main","paths":["escape/secret.txt"],"to":"docs"}`); code != 400 {
+		t.Fatalf("expected copying through a symlink out of the share to fail, got %d", code)
+	}
+
+	if code, resp := serveJSON(r, "POST", "/files/rename", `{"share":"main","paths":["docs/a.txt"],"name":"b.txt"}`); code != 200 {
+		t.Fatalf("rename failed: %d %v", code, resp)
+	}
+	if code, _ := serveJSON(r, "POST", "/files/rename", `{"share":"main","paths":["docs/b.txt"],"name":"../x"}`); code != 400 {
+		t.Fatalf("expected a name with a slash to be refused")
+	}
+	if code, resp := serveJSON(r, "POST", "/files/copy", `{"share":"main","paths":["docs/b.txt"],"to":"docs"}`); code != 200 || resp["data"].(map[string]interface{})["paths"].([]interface{})[0] != "docs/b (copy).txt" {
+		t.Fatalf("copy in place failed: %d %v", code, resp)
+	}
+	if code, _ := serveJSON(r, "POST", "/files/move", `{"share":"main","paths":["docs"],"to":"docs/sub"}`); code != 400 {
+		t.Fatalf("expected moving a folder into itself to fail, got %d", code)
+	}
+	if code, resp := serveJSON(r, "POST", "/files/move", `{"share":"main","paths":["docs/b.txt"],"to":"docs/sub"}`); code != 200 {
+		t.Fatalf("move failed: %d %v", code, resp)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "docs", "sub", "b.txt")); err != nil || string(data) != "hello" {
+		t.Fatalf("moved file missing: %q %v", data, err)
+	}
+	if code, _ := serveJSON(r, "POST", "/files/delete", `{"share":"main","paths":[""]}`); code != 400 {
+		t.Fatalf("expected deleting the share root to fail, got %d", code)
+	}
+	// Deleting a symlink removes the link, never its target
+	if code, _ := serveJSON(r, "POST", "/files/delete", `{"share":"main","paths":["escape","docs"],"permanent":true}`); code != 200 {
+		t.Fatalf("delete failed")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret.txt")); err != nil {
+		t.Fatalf("symlink target was touched: %v", err)
+	}
+	if items, _ := os.ReadDir(root); len(items) != 0 {
+		t.Fatalf("expected an empty share, got %v", items)
+	}
+}
+
+func TestFileSymlinkWrites(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root, other := t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "real.txt"), []byte("real"), 0644)
+	os.WriteFile(filepath.Join(root, "new.txt"), []byte("new"), 0644)
+	os.Symlink("real.txt", filepath.Join(root, "docs", "link.txt"))
+	shares, err := decodeFileShares([]interface{}{
+		map[string]interface{}{"name": "main", "path": root},
+		map[string]interface{}{"name": "other", "path": other},
+	}, nil)
+	if err != nil {
+		t.Fatalf("decode shares: %v", err)
+	}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: shares})
+
+	if full, err := resolveSharePath(shares[0], "docs/link.txt"); err != nil || full != filepath.Join(root, "docs", "real.txt") {
+		t.Fatalf("expected the link to resolve to its target, got %q %v", full, err)
+	}
+	if _, err := resolveShareTarget(shares[0], "docs/link.txt"); !errors.Is(err, errSymlinkLeaf) {
+		t.Fatalf("expected writing through the link to be refused, got %v", err)
+	}
+
+	r := gin.New()
+	r.POST("/files/rename", RenameFile)
+	r.POST("/files/copy", CopyFiles)
+	r.POST("/files/move", MoveFiles)
+	if code := serve(r, "POST", "/files/rename", `{"share":"main","paths":["new.txt"],"name":"docs"}`).Code; code != 409 {
+		t.Fatalf("expected rename onto a folder to conflict, got %d", code)
+	}
+	if code := serve(r, "POST", "/files/copy", `{"share":"main","paths":["new.txt"],"to":"docs","overwrite":true}`).Code; code != 200 {
+		t.Fatalf("copy failed: %d", code)
+	}
+	os.Rename(filepath.Join(root, "docs", "new.txt"), filepath.Join(root, "new.txt"))
+	os.Symlink("real.txt", filepath.Join(root, "docs", "new.txt"))
+	if code := serve(r, "POST", "/files/copy", `{"share":"main","paths":["new.txt"],"to":"docs","overwrite":true}`).Code; code != 400 {
+		t.Fatalf("expected overwriting a symlink to be refused, got %d", code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "docs", "real.txt")); string(data) != "real" {
+		t.Fatalf("symlink target was written: %q", data)
+	}
+	// Links stay in their share, within it they are moved as they are
+	if code := serve(r, "POST", "/files/copy", `{"share":"main","paths":["docs"],"to":"","toShare":"other"}`).Code; code != 400 {
+		t.Fatalf("expected copying links to another share to be refused, got %d", code)
+	}
+	if code := serve(r, "POST", "/files/move", `{"share":"main","paths":["docs"],"to":"","toShare":"other"}`).Code; code != 400 {
+		t.Fatalf("expected moving links to another share to be refused, got %d", code)
+	}
+	if items, _ := os.ReadDir(other); len(items) != 0 {
+		t.Fatalf("expected nothing in the other share, got %v", items)
+	}
+}
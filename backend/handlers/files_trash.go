@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deleting in the file browser moves items to the recycle bin of their
+// share, a .trash folder at its root holding the items under files/ and
+// where they came from under info/. The folder is hidden from listings and
+// unreachable through share paths; only the trash API works on it. Items
+// are purged after the retention period of the system config.
+
+const (
+	trashDirName        = ".trash"
+	trashDefaultDays    = 30
+	trashPurgeInterval  = time.Hour
+	trashRestoredSuffix = " (restored)"
+)
+
+var errTrashItemNotFound = errors.New("Trash item not found")
+
+// TrashItem describes one deleted file or folder
+type TrashItem struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Path      string `json:"path"` // Where it was deleted from
+	IsDir     bool   `json:"isDir"`
+	Size      int64  `json:"size"` // Folders count their files
+	DeletedAt int64  `json:"deletedAt"`
+	DeletedBy string `json:"deletedBy,omitempty"`
+}
+
+// TrashRequest names recycle bin items; no IDs empties the whole bin
+type TrashRequest struct {
+	Share string   `json:"share"`
+	IDs   []string `json:"ids"`
+}
+
+func trashFilesDir(share models.FileShare) string {
+	return filepath.Join(share.Path, trashDirName, "files")
+}
+
+func trashInfoDir(share models.FileShare) string {
+	return filepath.Join(share.Path, trashDirName, "info")
+}
+
+// validTrashID accepts the IDs moveToTrash makes
+func validTrashID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9') && !(r >= 'a' && r <= 'f') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// moveToTrash moves a resolved item into the share's recycle bin
+func moveToTrash(share models.FileShare, full, rel, username string) error {
+	info, err := os.Lstat(full)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(trashFilesDir(share), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(trashInfoDir(share), 0755); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	item := TrashItem{
+		ID:        fmt.Sprintf("%x-%s", time.Now().UnixNano(), hex.EncodeToString(suffix)),
+		Name:      info.Name(),
+		Path:      rel,
+		IsDir:     info.IsDir(),
+		Size:      info.Size(),
+		DeletedAt: time.Now().UnixMilli(),
+		DeletedBy: username,
+	}
+	if item.IsDir {
+		item.Size = 0
+		filepath.WalkDir(full, func(_ string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				if fi, err := d.Info(); err == nil {
+					item.Size += fi.Size()
+				}
+			}
+			return nil
+		})
+	}
+	// Info first: an item without one would be invisible in the bin
+	infoFile := filepath.Join(trashInfoDir(share), item.ID+".json")
+	if err := utils.WriteJSON(infoFile, item); err != nil {
+		return err
+	}
+	if err := movePath(full, filepath.Join(trashFilesDir(share), item.ID)); err != nil {
+		os.Remove(infoFile)
+		return err
+	}
+	return nil
+}
+
+// listTrash returns the items of a share's bin, newest first
+func listTrash(share models.FileShare) []TrashItem {
+	items := []TrashItem{}
+	entries, err := os.ReadDir(trashInfoDir(share))
+	if err != nil {
+		return items
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !validTrashID(id) {
+			continue
+		}
+		var item TrashItem
+		if err := utils.ReadJSON(filepath.Join(trashInfoDir(share), e.Name()), &item); err != nil || item.ID != id {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].DeletedAt != items[j].DeletedAt {
+			return items[i].DeletedAt > items[j].DeletedAt
+		}
+		return items[i].ID > items[j].ID
+	})
+	return items
+}
+
+// removeTrashItem deletes an item from the bin for good
+func removeTrashItem(share models.FileShare, id string) error {
+	if err := os.RemoveAll(filepath.Join(trashFilesDir(share), id)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(trashInfoDir(share), id+".json"))
+}
+
+// restoreTrashItem moves an item back to where it was deleted from. Its
+// folder is recreated if need be; a name taken since gets " (restored)".
+func restoreTrashItem(share models.FileShare, id string) (string, error) {
+	var item TrashItem
+	if err := utils.ReadJSON(filepath.Join(trashInfoDir(share), id+".json"), &item); err != nil {
+		if os.IsNotExist(err) {
+			return "", errTrashItemNotFound
+		}
+		return "", err
+	}
+	src := filepath.Join(trashFilesDir(share), id)
+	if _, err := os.Lstat(src); err != nil {
+		return "", errTrashItemNotFound
+	}
+	rel, err := cleanSharePath(item.Path)
+	if err != nil || rel == "" {
+		return "", errInvalidPath
+	}
+	dirRel := path.Dir(rel)
+	if dirRel == "." {
+		dirRel = ""
+	}
+	dir, err := resolveSharePath(share, dirRel)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := path.Base(rel)
+	if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + trashRestoredSuffix + ext
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			name = copyName(dir, name)
+		}
+	}
+	if err := movePath(src, filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	os.Remove(filepath.Join(trashInfoDir(share), id+".json"))
+	return path.Join(dirRel, name), nil
+}
+
+// purgeTrash deletes the items of a share's bin deleted before cutoff
+func purgeTrash(share models.FileShare, cutoff time.Time) int {
+	purged := 0
+	for _, item := range listTrash(share) {
+		if item.DeletedAt >= cutoff.UnixMilli() {
+			continue
+		}
+		if err := removeTrashItem(share, item.ID); err != nil {
+			filesLog.Warn("Trash purge failed", "share", share.Name, "item", item.Path, "error", err)
+			continue
+		}
+		purged++
+	}
+	return purged
+}
+
+// trashRetention is how long deleted items are kept
+func trashRetention() time.Duration {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	days := sysConfig.TrashDays
+	if days == 0 {
+		days = trashDefaultDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// StartTrashPurge deletes recycle bin items past the retention period
+func StartTrashPurge() {
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		beat := registerWorker("trash.purge", trashPurgeInterval)
+		for {
+			beat()
+			cutoff := time.Now().Add(-trashRetention())
+			for _, share := range browseShares() {
+				if share.ReadOnly {
+					continue
+				}
+				if n := purgeTrash(share, cutoff); n > 0 {
+					filesLog.Info("Trash purged", "share", share.Name, "items", n)
+				}
+			}
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// GetTrash lists the recycle bin of a share
+func GetTrash(c *gin.Context) {
+	share, err := findFileShare(c.Query("share"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"items":         listTrash(share),
+		"retentionDays": int(trashRetention() / (24 * time.Hour)),
+	}})
+}
+
+// bindTrashOp reads a TrashRequest for a writable share
+func bindTrashOp(c *gin.Context) (TrashRequest, models.FileShare, bool) {
+	var req TrashRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return req, models.FileShare{}, false
+	}
+	share, err := findFileShare(req.Share)
+	if err == nil && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		fileError(c, err, "")
+		return req, share, false
+	}
+	for _, id := range req.IDs {
+		if !validTrashID(id) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return req, share, false
+		}
+	}
+	c.Set("auditTarget", req.Share+":"+strings.Join(req.IDs, ","))
+	return req, share, true
+}
+
+// RestoreTrash puts items back where they were deleted from
+func RestoreTrash(c *gin.Context) {
+	req, share, ok := bindTrashOp(c)
+	if !ok {
+		return
+	}
+	if len(req.IDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	restored := []string{}
+	for _, id := range req.IDs {
+		p, err := restoreTrashItem(share, id)
+		if errors.Is(err, errTrashItemNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			fileError(c, err, "")
+			return
+		}
+		restored = append(restored, p)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"paths": restored}})
+}
+
+// EmptyTrash deletes the given items for good, or all of them
+func EmptyTrash(c *gin.Context) {
+	req, share, ok := bindTrashOp(c)
+	if !ok {
+		return
+	}
+	ids := req.IDs
+	if len(ids) == 0 {
+		for _, item := range listTrash(share) {
+			ids = append(ids, item.ID)
+		}
+	}
+	for _, id := range ids {
+		if err := removeTrashItem(share, id); err != nil && !os.IsNotExist(err) {
+			fileError(c, err, "")
+			return
+		}
+	}
+	markQuotaStale(share.Name)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"deleted": len(ids)}})
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRecycleBin(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("hello"), 0644)
+	share := models.FileShare{Name: "main", Path: root}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{share}})
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("username", "alice") })
+	r.GET("/files/list", ListFiles)
+	r.POST("/files/delete", DeleteFiles)
+	r.GET("/files/trash", GetTrash)
+	r.POST("/files/trash/restore", RestoreTrash)
+	r.POST("/files/trash/empty", EmptyTrash)
+	trash := func() []TrashItem {
+		return listTrash(share)
+	}
+
+	if code, _ := serveJSON(r, "POST", "/files/delete", `{"share":"main","paths":["docs/a.txt"]}`); code != 200 {
+		t.Fatalf("delete failed: %d", code)
+	}
+	items := trash()
+	if len(items) != 1 || items[0].Path != "docs/a.txt" || items[0].DeletedBy != "alice" || items[0].Size != 5 {
+		t.Fatalf("unexpected trash %+v", items)
+	}
+	// The bin is neither listed nor reachable as a share path
+	_, resp := serveJSON(r, "GET", "/files/list?share=main", "")
+	if entries := resp["data"].(map[string]interface{})["entries"].([]interface{}); len(entries) != 1 {
+		t.Fatalf("expected only docs in the listing, got %v", entries)
+	}
+	if code, _ := serveJSON(r, "GET", "/files/list?share=main&path=.trash/files", ""); code != 400 {
+		t.Fatalf("expected the bin to be unreachable, got %d", code)
+	}
+
+	// Restoring into a taken name keeps both
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("new"), 0644)
+	code, resp := serveJSON(r, "POST", "/files/trash/restore", `{"share":"main","ids":["`+items[0].ID+`"]}`)
+	if code != 200 || resp["data"].(map[string]interface{})["paths"].([]interface{})[0] != "docs/a (restored).txt" {
+		t.Fatalf("unexpected restore %d %v", code, resp)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "docs", "a (restored).txt")); string(data) != "hello" || len(trash()) != 0 {
+		t.Fatalf("restore did not bring the file back")
+	}
+
+	// Restoring recreates a deleted folder
+	serveJSON(r, "POST", "/files/delete", `{"share":"main","paths":["docs/a.txt"]}`)
+	serveJSON(r, "POST", "/files/delete", `{"share":"main","paths":["docs"]}`)
+	items = trash()
+	if len(items) != 2 || !items[0].IsDir {
+		t.Fatalf("unexpected trash %+v", items)
+	}
+	if code, _ := serveJSON(r, "POST", "/files/trash/restore", `{"share":"main","ids":["`+items[1].ID+`"]}`); code != 200 {
+		t.Fatalf("restore into a deleted folder failed: %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs", "a.txt")); err != nil {
+		t.Fatalf("expected the file back in a recreated folder: %v", err)
+	}
+
+	// Retention and emptying
+	if n := purgeTrash(share, time.Now().Add(time.Hour)); n != 1 || len(trash()) != 0 {
+		t.Fatalf("expected the old item purged, got %d", n)
+	}
+	serveJSON(r, "POST", "/files/delete", `{"share":"main","paths":["docs"]}`)
+	if code, _ := serveJSON(r, "POST", "/files/trash/empty", `{"share":"main"}`); code != 200 || len(trash()) != 0 {
+		t.Fatalf("empty failed: %d", code)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, ".trash", "files")); len(entries) != 0 {
+		t.Fatalf("expected the bin folder emptied, got %d entries", len(entries))
+	}
+}
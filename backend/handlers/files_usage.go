@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Disk usage of a share is found by walking it in the background, du
+// style, and kept as a tree of folder sizes in DataDir/usage-cache, so
+// browsing it is instant however large the share. Only folders are in the
+// tree; the largest files are kept in a separate list. A rescan of one
+// folder patches the tree instead of walking the whole share again, and
+// the whole share is walked again once a day. Sizes are apparent sizes,
+// symlinks are not followed and the recycle bin is left out.
+
+const (
+	usageTopFiles       = 500
+	usageRescanInterval = 24 * time.Hour
+	usageCheckInterval  = time.Hour
+	usageDefaultLimit   = 50
+	usageMaxDepth       = 5
+)
+
+var errNoUsageScan = errors.New("Share not scanned yet")
+
+// UsageNode is a folder and the totals of everything below it
+type UsageNode struct {
+	Name     string       `json:"name"`
+	Size     int64        `json:"size"`
+	Files    int64        `json:"files"`
+	Dirs     int64        `json:"dirs"`
+	ModTime  int64        `json:"modTime"`
+	Children []*UsageNode `json:"children,omitempty"`
+}
+
+// UsageFile is a file of the largest files list
+type UsageFile struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+}
+
+// UsageScan is the cached result for a share
+type UsageScan struct {
+	Share     string      `json:"share"`
+	Root      *UsageNode  `json:"root"`
+	Largest   []UsageFile `json:"largest"`
+	ScannedAt int64       `json:"scannedAt"`
+	Duration  int64       `json:"duration"` // ms, of the last full scan
+	Errors    int64       `json:"errors"`   // Entries that could not be read
+}
+
+// UsageStatus tells whether a scan of a share is running
+type UsageStatus struct {
+	Scanning  bool   `json:"scanning"`
+	Path      string `json:"path,omitempty"`
+	Items     int64  `json:"items,omitempty"` // Entries read so far
+	StartedAt int64  `json:"startedAt,omitempty"`
+	ScannedAt int64  `json:"scannedAt,omitempty"`
+}
+
+type usageRun struct {
+	path    string
+	started time.Time
+	items   atomic.Int64
+}
+
+var usageCache = struct {
+	sync.Mutex
+	scans   map[string]*UsageScan // Loaded from disk on first use
+	running map[string]*usageRun
+}{scans: make(map[string]*UsageScan), running: make(map[string]*usageRun)}
+
+func usageCacheFile(share string) string {
+	return filepath.Join(config.DataDir, "usage-cache", share+".json")
+}
+
+// loadUsageScan returns the cached scan of a share, nil when there is none.
+// Callers hold usageCache.
+func loadUsageScan(share string) *UsageScan {
+	if scan, ok := usageCache.scans[share]; ok {
+		return scan
+	}
+	var scan *UsageScan
+	if err := utils.ReadJSON(usageCacheFile(share), &scan); err != nil || scan == nil || scan.Root == nil {
+		scan = nil
+	}
+	usageCache.scans[share] = scan
+	return scan
+}
+
+func saveUsageScan(scan *UsageScan) {
+	if err := os.MkdirAll(filepath.Dir(usageCacheFile(scan.Share)), 0755); err == nil {
+		err = utils.WriteJSON(usageCacheFile(scan.Share), scan)
+		if err == nil {
+			return
+		}
+	}
+	filesLog.Warn("Failed to save disk usage", "share", scan.Share)
+}
+
+// usageHeap keeps the largest files seen, smallest on top
+type usageHeap []UsageFile
+
+func (h usageHeap) Len() int            { return len(h) }
+func (h usageHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h usageHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *usageHeap) Push(x interface{}) { *h = append(*h, x.(UsageFile)) }
+func (h *usageHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+func (h *usageHeap) offer(f UsageFile) {
+	if h.Len() < usageTopFiles {
+		heap.Push(h, f)
+	} else if f.Size > (*h)[0].Size {
+		(*h)[0] = f
+		heap.Fix(h, 0)
+	}
+}
+
+// usageWalker walks a folder into a UsageNode
+type usageWalker struct {
+	ctx     context.Context
+	run     *usageRun
+	largest usageHeap
+	errors  int64
+}
+
+// walk sizes the folder dir, rel being its path inside the share
+func (w *usageWalker) walk(dir, rel string, info os.FileInfo) *UsageNode {
+	node := &UsageNode{Name: path.Base("/" + rel), ModTime: info.ModTime().UnixMilli()}
+	if rel == "" {
+		node.Name = ""
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		w.errors++
+	}
+	for _, e := range entries {
+		if w.ctx.Err() != nil {
+			return node
+		}
+		w.run.items.Add(1)
+		if rel == "" && hiddenShareDir(e.Name()) {
+			continue
+		}
+		childRel := path.Join(rel, e.Name())
+		if e.Type()&os.ModeSymlink != 0 {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			w.errors++
+			continue
+		}
+		if e.IsDir() {
+			child := w.walk(filepath.Join(dir, e.Name()), childRel, fi)
+			node.Children = append(node.Children, child)
+			node.Size += child.Size
+			node.Files += child.Files
+			node.Dirs += child.Dirs + 1
+			continue
+		}
+		node.Size += fi.Size()
+		node.Files++
+		w.largest.offer(UsageFile{Path: childRel, Size: fi.Size(), ModTime: fi.ModTime().UnixMilli()})
+	}
+	sortUsageNodes(node.Children)
+	return node
+}
+
+func sortUsageNodes(nodes []*UsageNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Size != nodes[j].Size {
+			return nodes[i].Size > nodes[j].Size
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+}
+
+// usageParent is the path of the folder holding rel
+func usageParent(rel string) string {
+	if parent := path.Dir(rel); parent != "." {
+		return parent
+	}
+	return ""
+}
+
+// findUsageNode returns the node of rel and the chain of nodes from the
+// root down to it
+func findUsageNode(root *UsageNode, rel string) (*UsageNode, []*UsageNode) {
+	chain := []*UsageNode{root}
+	node := root
+	if rel == "" {
+		return node, chain
+	}
+	for _, name := range strings.Split(rel, "/") {
+		var next *UsageNode
+		for _, child := range node.Children {
+			if child.Name == name {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil, nil
+		}
+		node = next
+		chain = append(chain, node)
+	}
+	return node, chain
+}
+
+// startUsageScan walks rel of a share in the background, the whole share
+// when rel is empty or not yet in the cached tree. It returns false when a
+// scan of the share is already running.
+func startUsageScan(share models.FileShare, rel string) bool {
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	if usageCache.running[share.Name] != nil {
+		return false
+	}
+	if scan := loadUsageScan(share.Name); scan == nil {
+		rel = ""
+	} else if rel != "" {
+		if node, _ := findUsageNode(scan.Root, usageParent(rel)); node == nil {
+			rel = ""
+		}
+	}
+	run := &usageRun{path: rel, started: time.Now()}
+	usageCache.running[share.Name] = run
+	go runUsageScan(share, run)
+	return true
+}
+
+func runUsageScan(share models.FileShare, run *usageRun) {
+	defer func() {
+		usageCache.Lock()
+		delete(usageCache.running, share.Name)
+		usageCache.Unlock()
+	}()
+	w := &usageWalker{ctx: backgroundCtx, run: run}
+	var node *UsageNode
+	full, err := resolveSharePath(share, run.path)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(full); err == nil && info.IsDir() {
+			node = w.walk(full, run.path, info)
+		}
+	}
+	if backgroundCtx.Err() != nil {
+		return
+	}
+	// A folder that is gone is dropped from the tree; any other failure
+	// keeps what was there
+	if node == nil && (run.path == "" || !os.IsNotExist(err)) {
+		filesLog.Warn("Disk usage scan failed", "share", share.Name, "path", run.path, "error", err)
+		return
+	}
+
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	scan := loadUsageScan(share.Name)
+	if run.path == "" || scan == nil {
+		scan = &UsageScan{Share: share.Name, Root: node, Duration: time.Since(run.started).Milliseconds()}
+	} else if !patchUsageTree(scan, run.path, node) {
+		return
+	}
+	// Files under the rescanned folder are replaced by what was found now
+	largest := append(usageHeap{}, w.largest...)
+	if run.path != "" {
+		for _, f := range scan.Largest {
+			if !strings.HasPrefix(f.Path, run.path+"/") {
+				largest.offer(f)
+			}
+		}
+	}
+	sort.Slice(largest, func(i, j int) bool { return largest[i].Size > largest[j].Size })
+	scan.Largest = largest
+	scan.ScannedAt = time.Now().UnixMilli()
+	scan.Errors += w.errors
+	usageCache.scans[share.Name] = scan
+	saveUsageScan(scan)
+	filesLog.Info("Disk usage scanned", "share", share.Name, "path", run.path, "items", run.items.Load(), "took", time.Since(run.started).Round(time.Millisecond))
+}
+
+// patchUsageTree puts the rescanned folder node at rel, nil when it is
+// gone, and corrects the totals above it
+func patchUsageTree(scan *UsageScan, rel string, node *UsageNode) bool {
+	parent, chain := findUsageNode(scan.Root, usageParent(rel))
+	if parent == nil {
+		return false
+	}
+	var old *UsageNode
+	children := parent.Children[:0]
+	for _, child := range parent.Children {
+		if child.Name == path.Base(rel) {
+			old = child
+			continue
+		}
+		children = append(children, child)
+	}
+	if node != nil {
+		children = append(children, node)
+	}
+	parent.Children = children
+	var size, files, dirs int64
+	if old != nil {
+		size, files, dirs = -old.Size, -old.Files, -old.Dirs-1
+	}
+	if node != nil {
+		size, files, dirs = size+node.Size, files+node.Files, dirs+node.Dirs+1
+	}
+	for _, n := range chain {
+		n.Size += size
+		n.Files += files
+		n.Dirs += dirs
+		sortUsageNodes(n.Children)
+	}
+	return true
+}
+
+// StartUsageScanner walks again the shares whose sizes are more than a day
+// old; shares never scanned wait until someone asks
+func StartUsageScanner() {
+	go func() {
+		ticker := time.NewTicker(usageCheckInterval)
+		defer ticker.Stop()
+		beat := registerWorker("usage.scan", usageCheckInterval)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			beat()
+			for _, share := range loadFileShares() {
+				usageCache.Lock()
+				scan := loadUsageScan(share.Name)
+				usageCache.Unlock()
+				if scan != nil && time.Since(time.UnixMilli(scan.ScannedAt)) > usageRescanInterval {
+					startUsageScan(share, "")
+				}
+			}
+		}
+	}()
+}
+
+func usageStatus(share string, scan *UsageScan) UsageStatus {
+	status := UsageStatus{}
+	if scan != nil {
+		status.ScannedAt = scan.ScannedAt
+	}
+	if run := usageCache.running[share]; run != nil {
+		status.Scanning = true
+		status.Path = run.path
+		status.Items = run.items.Load()
+		status.StartedAt = run.started.UnixMilli()
+	}
+	return status
+}
+
+// usageCopy copies a node down to depth levels of folders
+func usageCopy(node *UsageNode, depth int) *UsageNode {
+	c := *node
+	c.Children = nil
+	if depth > 0 {
+		for _, child := range node.Children {
+			c.Children = append(c.Children, usageCopy(child, depth-1))
+		}
+	}
+	return &c
+}
+
+// bindUsageQuery reads ?share= and ?path=
+func bindUsageQuery(c *gin.Context) (models.FileShare, string, bool) {
+	share, err := findFileShare(c.Query("share"))
+	if err != nil {
+		fileError(c, err, "")
+		return share, "", false
+	}
+	rel, err := cleanSharePath(c.Query("path"))
+	if err != nil {
+		fileError(c, err, c.Query("path"))
+		return share, "", false
+	}
+	return share, rel, true
+}
+
+// GetDiskUsage returns a folder of the cached tree with ?depth= levels of
+// subfolders (1 by default), largest first
+func GetDiskUsage(c *gin.Context) {
+	share, rel, ok := bindUsageQuery(c)
+	if !ok {
+		return
+	}
+	depth, err := strconv.Atoi(c.DefaultQuery("depth", "1"))
+	if err != nil || depth < 0 || depth > usageMaxDepth {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid depth"})
+		return
+	}
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	scan := loadUsageScan(share.Name)
+	status := usageStatus(share.Name, scan)
+	if scan == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoUsageScan.Error(), "status": status})
+		return
+	}
+	node, _ := findUsageNode(scan.Root, rel)
+	if node == nil {
+		fileError(c, os.ErrNotExist, rel)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"path":   rel,
+		"node":   usageCopy(node, depth),
+		"total":  scan.Root.Size,
+		"errors": scan.Errors,
+		"status": status,
+	}})
+}
+
+// GetLargestUsage lists the largest files (?kind=files) or folders
+// (?kind=folders) under ?path=
+func GetLargestUsage(c *gin.Context) {
+	share, rel, ok := bindUsageQuery(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(usageDefaultLimit)))
+	if err != nil || limit < 1 || limit > usageTopFiles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	kind := c.DefaultQuery("kind", "files")
+	if kind != "files" && kind != "folders" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	scan := loadUsageScan(share.Name)
+	if scan == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoUsageScan.Error(), "status": usageStatus(share.Name, scan)})
+		return
+	}
+	node, _ := findUsageNode(scan.Root, rel)
+	if node == nil {
+		fileError(c, os.ErrNotExist, rel)
+		return
+	}
+	items := []UsageFile{}
+	if kind == "files" {
+		for _, f := range scan.Largest {
+			if rel == "" || strings.HasPrefix(f.Path, rel+"/") {
+				items = append(items, f)
+			}
+		}
+	} else {
+		var collect func(n *UsageNode, p string)
+		collect = func(n *UsageNode, p string) {
+			for _, child := range n.Children {
+				childPath := path.Join(p, child.Name)
+				items = append(items, UsageFile{Path: childPath, Size: child.Size, ModTime: child.ModTime})
+				collect(child, childPath)
+			}
+		}
+		collect(node, rel)
+		sort.Slice(items, func(i, j int) bool { return items[i].Size > items[j].Size })
+	}
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": items})
+}
+
+// ScanDiskUsage starts a scan of a share, or of one folder when path is
+// set and the share was scanned before
+func ScanDiskUsage(c *gin.Context) {
+	var req struct {
+		Share string `json:"share"`
+		Path  string `json:"path"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	rel, err := cleanSharePath(req.Path)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	started := startUsageScan(share, rel)
+	usageCache.Lock()
+	status := usageStatus(share.Name, loadUsageScan(share.Name))
+	usageCache.Unlock()
+	if !started {
+		c.JSON(http.StatusConflict, gin.H{"error": "A scan is already running", "status": status})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": status})
+}
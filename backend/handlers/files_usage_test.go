@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDiskUsage(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	write := func(p string, size int) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, p)), 0755)
+		os.WriteFile(filepath.Join(root, p), make([]byte, size), 0644)
+	}
+	write("movies/a.mkv", 5000)
+	write("movies/old/b.mkv", 3000)
+	write("docs/c.txt", 100)
+	write(".trash/files/x", 9000)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	r := gin.New()
+	r.GET("/usage", GetDiskUsage)
+	r.GET("/usage/largest", GetLargestUsage)
+	r.POST("/usage/scan", ScanDiskUsage)
+	scan := func(p string) {
+		if w := serve(r, "POST", "/usage/scan", `{"share":"main","path":"`+p+`"}`); w.Code != http.StatusAccepted {
+			t.Fatalf("scan failed: %d %s", w.Code, w.Body.String())
+		}
+		for i := 0; ; i++ {
+			usageCache.Lock()
+			running := usageCache.running["main"] != nil
+			usageCache.Unlock()
+			if !running {
+				return
+			}
+			if i > 500 {
+				t.Fatalf("scan did not finish")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	usage := func(p string) *UsageNode {
+		var resp struct{ Data struct{ Node *UsageNode } }
+		w := serve(r, "GET", "/usage?share=main&depth=2&path="+p, "")
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 {
+			t.Fatalf("usage failed: %d %s", w.Code, w.Body.String())
+		}
+		return resp.Data.Node
+	}
+
+	if w := serve(r, "GET", "/usage?share=main", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before a scan, got %d", w.Code)
+	}
+	scan("")
+	node := usage("")
+	if node.Size != 8100 || node.Files != 3 || node.Dirs != 3 || len(node.Children) != 2 || node.Children[0].Name != "movies" || len(node.Children[0].Children) != 1 {
+		t.Fatalf("unexpected tree %+v", node)
+	}
+	var files struct{ Data []UsageFile }
+	json.Unmarshal(serve(r, "GET", "/usage/largest?share=main&limit=2", "").Body.Bytes(), &files)
+	if len(files.Data) != 2 || files.Data[0].Path != "movies/a.mkv" || files.Data[1].Path != "movies/old/b.mkv" {
+		t.Fatalf("unexpected largest files %+v", files.Data)
+	}
+	json.Unmarshal(serve(r, "GET", "/usage/largest?share=main&kind=folders", "").Body.Bytes(), &files)
+	if len(files.Data) != 3 || files.Data[0].Path != "movies" || files.Data[1].Path != "movies/old" {
+		t.Fatalf("unexpected largest folders %+v", files.Data)
+	}
+
+	// Rescanning one folder patches the totals above it
+	write("docs/d.iso", 20000)
+	scan("docs")
+	if node := usage(""); node.Size != 28100 || node.Files != 4 || node.Children[0].Name != "docs" {
+		t.Fatalf("rescan not applied %+v", node)
+	}
+	os.RemoveAll(filepath.Join(root, "movies", "old"))
+	scan("movies/old")
+	if node := usage("movies"); node.Size != 5000 || node.Dirs != 0 || len(node.Children) != 0 {
+		t.Fatalf("removed folder kept %+v", node)
+	}
+	json.Unmarshal(serve(r, "GET", "/usage/largest?share=main", "").Body.Bytes(), &files)
+	if len(files.Data) != 3 || files.Data[0].Path != "docs/d.iso" {
+		t.Fatalf("unexpected largest files %+v", files.Data)
+	}
+
+	// The tree is read back from disk
+	usageCache.Lock()
+	delete(usageCache.scans, "main")
+	usageCache.Unlock()
+	if node := usage(""); node.Size != 25100 {
+		t.Fatalf("cached tree not reloaded %+v", node)
+	}
+}
@@ -0,0 +1,571 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Before a file is overwritten from the browser, the editors, WebDAV or
+// SFTP, what it held is copied into the .versions folder at the root of
+// its share: one folder per file, named after the hash of its path, with
+// the copies and an index.json listing them newest first. Like the
+// recycle bin, the folder is hidden from listings and only the versions
+// API works on it. Each share keeps as many versions per file, and for as
+// long, as the settings say; the versions of a file that is gone stay as
+// long as the recycle bin would have kept it.
+
+const (
+	versionsDirName       = ".versions"
+	versionsIndexName     = "index.json"
+	versionsDefaultKeep   = 10
+	versionsMaxKeep       = 1000
+	versionsPurgeInterval = time.Hour
+)
+
+var errVersionNotFound = errors.New("Version not found")
+
+// fileVersions serializes the changes to version folders. Saves hold it
+// while they copy, so the purge never sees a copy without its entry.
+var fileVersions sync.Mutex
+
+// FileVersion is what a file held before one of its overwrites
+type FileVersion struct {
+	ID      string `json:"id"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"` // Of the content
+	SavedAt int64  `json:"savedAt"` // When it was overwritten
+	SavedBy string `json:"savedBy,omitempty"`
+}
+
+// versionIndex lists the versions of a file, newest first
+type versionIndex struct {
+	Path     string        `json:"path"`
+	Versions []FileVersion `json:"versions"`
+}
+
+// VersionRequest names versions of a file. Restoring takes exactly one;
+// deleting none deletes them all.
+type VersionRequest struct {
+	Share string   `json:"share"`
+	Path  string   `json:"path"`
+	IDs   []string `json:"ids"`
+}
+
+func versionSettings() models.VersionSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.Versions == nil {
+		return models.VersionSettings{Keep: versionsDefaultKeep}
+	}
+	settings := *sysConfig.Versions
+	if settings.Keep == 0 {
+		settings.Keep = versionsDefaultKeep
+	}
+	return settings
+}
+
+// versionRetention is what a share keeps: its own setting, or the default
+func versionRetention(settings models.VersionSettings, share string) models.VersionRetention {
+	if retention, ok := settings.Shares[share]; ok {
+		return retention
+	}
+	return models.VersionRetention{Keep: settings.Keep, Days: settings.Days}
+}
+
+// decodeVersionSettings reads the "versions" field of a system config
+// update
+func decodeVersionSettings(raw interface{}) (*models.VersionSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid version settings")
+	}
+	settings := &models.VersionSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid version settings")
+	}
+	retentions := []models.VersionRetention{{Keep: settings.Keep, Days: settings.Days}}
+	for _, retention := range settings.Shares {
+		retentions = append(retentions, retention)
+	}
+	for _, r := range retentions {
+		if r.Keep < 0 || r.Keep > versionsMaxKeep || r.Days < 0 {
+			return nil, fmt.Errorf("Invalid version settings")
+		}
+	}
+	if settings.MaxSizeMB < 0 {
+		return nil, fmt.Errorf("Invalid version settings")
+	}
+	return settings, nil
+}
+
+// versionsDir is the folder of the versions of a file
+func versionsDir(share models.FileShare, rel string) string {
+	sum := sha1.Sum([]byte(rel))
+	return filepath.Join(share.Path, versionsDirName, hex.EncodeToString(sum[:]))
+}
+
+// validVersionID accepts the IDs keepVersion makes, which are made like
+// those of recycle bin items
+func validVersionID(id string) bool {
+	return validTrashID(id)
+}
+
+// readVersionIndex reads the versions kept of a file. Callers hold
+// fileVersions.
+func readVersionIndex(dir, rel string) versionIndex {
+	var index versionIndex
+	if err := utils.ReadJSON(filepath.Join(dir, versionsIndexName), &index); err != nil || index.Path != rel {
+		return versionIndex{Path: rel}
+	}
+	return index
+}
+
+// writeVersionIndex saves an index, or removes the folder of a file left
+// without versions. Callers hold fileVersions.
+func writeVersionIndex(dir string, index versionIndex) error {
+	if len(index.Versions) == 0 {
+		return os.RemoveAll(dir)
+	}
+	return utils.WriteJSON(filepath.Join(dir, versionsIndexName), index)
+}
+
+// pruneVersions drops the versions past what retention keeps, returning
+// the bytes freed. Callers hold fileVersions.
+func pruneVersions(dir string, index *versionIndex, retention models.VersionRetention, now time.Time) int64 {
+	var cutoff int64
+	if retention.Days > 0 {
+		cutoff = now.Add(-time.Duration(retention.Days) * 24 * time.Hour).UnixMilli()
+	}
+	var freed int64
+	kept := index.Versions[:0]
+	for i, v := range index.Versions {
+		if i < retention.Keep && v.SavedAt >= cutoff {
+			kept = append(kept, v)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, v.ID)); err != nil && !os.IsNotExist(err) {
+			filesLog.Warn("Failed to remove a file version", "path", index.Path, "version", v.ID, "error", err)
+		}
+		freed += v.Size
+	}
+	index.Versions = kept
+	return freed
+}
+
+// keepVersion copies a file that is about to be overwritten into its
+// versions, when its share keeps some. It never stands in the way of the
+// write: a failure is only logged.
+func keepVersion(share models.FileShare, rel, full, username string) {
+	settings := versionSettings()
+	retention := versionRetention(settings, share.Name)
+	if !settings.Enable || retention.Keep == 0 || share.ReadOnly || share.Remote != "" {
+		return
+	}
+	info, err := os.Lstat(full)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return
+	}
+	if settings.MaxSizeMB > 0 && info.Size() > int64(settings.MaxSizeMB)<<20 {
+		return
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	version := FileVersion{
+		ID:      fmt.Sprintf("%x-%s", time.Now().UnixNano(), hex.EncodeToString(suffix)),
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixMilli(),
+		SavedAt: time.Now().UnixMilli(),
+		SavedBy: username,
+	}
+
+	fileVersions.Lock()
+	defer fileVersions.Unlock()
+	dir := versionsDir(share, rel)
+	index := readVersionIndex(dir, rel)
+	blob := filepath.Join(dir, version.ID)
+	var freed int64
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = copyFile(full, blob, 0644)
+	}
+	if err == nil {
+		index.Versions = append([]FileVersion{version}, index.Versions...)
+		freed = pruneVersions(dir, &index, retention, time.Now())
+		err = writeVersionIndex(dir, index)
+	}
+	if err != nil {
+		os.Remove(blob)
+		filesLog.Warn("Failed to keep a file version", "share", share.Name, "path", rel, "error", err)
+		return
+	}
+	chargeShareQuota(share.Name, version.Size-freed)
+}
+
+// movedPath is where p went when from was moved to to
+func movedPath(p, from, to string) (string, bool) {
+	if p == from {
+		return to, true
+	}
+	if rest, ok := strings.CutPrefix(p, from+"/"); ok {
+		return path.Join(to, rest), true
+	}
+	return "", false
+}
+
+// moveFileVersions makes the versions of a moved item, and of the files
+// below it, follow it to its new place, where they join those of any file
+// it replaced
+func moveFileVersions(shareName, from, toShareName, to string) {
+	share, err := findFileShare(shareName)
+	if err != nil {
+		return
+	}
+	toShare, err := findFileShare(toShareName)
+	if err != nil {
+		return
+	}
+	fileVersions.Lock()
+	defer fileVersions.Unlock()
+	dirs := []string{versionsDir(share, from)}
+	// A folder has its files found by their indexes
+	if info, err := os.Lstat(filepath.Join(toShare.Path, filepath.FromSlash(to))); err == nil && info.IsDir() {
+		dirs = nil
+		entries, _ := os.ReadDir(filepath.Join(share.Path, versionsDirName))
+		for _, e := range entries {
+			dirs = append(dirs, filepath.Join(share.Path, versionsDirName, e.Name()))
+		}
+	}
+	moved := false
+	for _, dir := range dirs {
+		var index versionIndex
+		if err := utils.ReadJSON(filepath.Join(dir, versionsIndexName), &index); err != nil {
+			continue
+		}
+		rel, ok := movedPath(index.Path, from, to)
+		if !ok {
+			continue
+		}
+		if err := moveVersions(dir, index, toShare, rel); err != nil {
+			filesLog.Warn("Failed to move file versions", "share", share.Name, "path", index.Path, "error", err)
+		}
+		moved = true
+	}
+	if moved && share.Name != toShare.Name {
+		markQuotaStale(share.Name)
+		markQuotaStale(toShare.Name)
+	}
+}
+
+// moveVersions moves the versions of a file under its new path. Callers
+// hold fileVersions.
+func moveVersions(dir string, index versionIndex, toShare models.FileShare, rel string) error {
+	toDir := versionsDir(toShare, rel)
+	if toDir == dir {
+		return nil
+	}
+	target := readVersionIndex(toDir, rel)
+	if err := os.MkdirAll(toDir, 0755); err != nil {
+		return err
+	}
+	for _, v := range index.Versions {
+		if err := movePath(filepath.Join(dir, v.ID), filepath.Join(toDir, v.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		target.Versions = append(target.Versions, v)
+	}
+	sort.SliceStable(target.Versions, func(i, j int) bool {
+		return target.Versions[i].SavedAt > target.Versions[j].SavedAt
+	})
+	if err := writeVersionIndex(toDir, target); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// purgeVersions applies the retention of a share to the versions it
+// keeps. The versions of a file that is gone go once the newest is older
+// than orphans, as do copies that no index lists, left by a failed save.
+func purgeVersions(share models.FileShare, retention models.VersionRetention, orphans time.Time) int {
+	entries, err := os.ReadDir(filepath.Join(share.Path, versionsDirName))
+	if err != nil {
+		return 0
+	}
+	purged := 0
+	var freed int64
+	for _, e := range entries {
+		dir := filepath.Join(share.Path, versionsDirName, e.Name())
+		fileVersions.Lock()
+		var index versionIndex
+		if err := utils.ReadJSON(filepath.Join(dir, versionsIndexName), &index); err == nil {
+			before := len(index.Versions)
+			keep := retention
+			_, err := os.Lstat(filepath.Join(share.Path, filepath.FromSlash(index.Path)))
+			if os.IsNotExist(err) && before > 0 && index.Versions[0].SavedAt < orphans.UnixMilli() {
+				keep.Keep = 0
+			}
+			freed += pruneVersions(dir, &index, keep, time.Now())
+			purged += before - len(index.Versions)
+			listed := map[string]bool{}
+			for _, v := range index.Versions {
+				listed[v.ID] = true
+			}
+			copies, _ := os.ReadDir(dir)
+			for _, c := range copies {
+				if validVersionID(c.Name()) && !listed[c.Name()] {
+					os.Remove(filepath.Join(dir, c.Name()))
+				}
+			}
+			if err := writeVersionIndex(dir, index); err != nil {
+				filesLog.Warn("Version purge failed", "share", share.Name, "path", index.Path, "error", err)
+			}
+		}
+		fileVersions.Unlock()
+	}
+	if freed > 0 {
+		markQuotaStale(share.Name)
+	}
+	return purged
+}
+
+// StartVersionPurge drops file versions past the retention of their share
+func StartVersionPurge() {
+	go func() {
+		ticker := time.NewTicker(versionsPurgeInterval)
+		defer ticker.Stop()
+		beat := registerWorker("versions.purge", versionsPurgeInterval)
+		for {
+			beat()
+			settings := versionSettings()
+			orphans := time.Now().Add(-trashRetention())
+			for _, share := range browseShares() {
+				if share.ReadOnly || share.Remote != "" {
+					continue
+				}
+				if n := purgeVersions(share, versionRetention(settings, share.Name), orphans); n > 0 {
+					filesLog.Info("File versions purged", "share", share.Name, "versions", n)
+				}
+			}
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// versionFile finds the share and the file of a versions request. The
+// file itself may be gone.
+func versionFile(shareName, p string, write bool) (models.FileShare, string, string, error) {
+	share, err := findFileShare(shareName)
+	if err == nil && write && share.ReadOnly {
+		err = errShareReadOnly
+	}
+	if err != nil {
+		return share, "", "", err
+	}
+	rel, err := cleanSharePath(p)
+	if err == nil && rel == "" {
+		err = errInvalidPath
+	}
+	if err != nil {
+		return share, "", "", err
+	}
+	full, err := resolveShareTarget(share, rel)
+	return share, full, rel, err
+}
+
+// findVersion looks a version of a file up
+func findVersion(share models.FileShare, rel, id string) (FileVersion, string, error) {
+	fileVersions.Lock()
+	defer fileVersions.Unlock()
+	dir := versionsDir(share, rel)
+	for _, v := range readVersionIndex(dir, rel).Versions {
+		if v.ID == id {
+			return v, filepath.Join(dir, v.ID), nil
+		}
+	}
+	return FileVersion{}, "", errVersionNotFound
+}
+
+// GetFileVersions lists the versions kept of a file, newest first
+func GetFileVersions(c *gin.Context) {
+	share, _, rel, err := versionFile(c.Query("share"), c.Query("path"), false)
+	if err != nil {
+		fileError(c, err, c.Query("path"))
+		return
+	}
+	fileVersions.Lock()
+	index := readVersionIndex(versionsDir(share, rel), rel)
+	fileVersions.Unlock()
+	settings := versionSettings()
+	retention := versionRetention(settings, share.Name)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"path":    rel,
+		"items":   append([]FileVersion{}, index.Versions...),
+		"enabled": settings.Enable && retention.Keep > 0,
+		"keep":    retention.Keep,
+		"days":    retention.Days,
+	}})
+}
+
+// DownloadFileVersion serves a version of a file under the file's name
+func DownloadFileVersion(c *gin.Context) {
+	share, _, rel, err := versionFile(c.Query("share"), c.Query("path"), false)
+	if err != nil {
+		fileError(c, err, c.Query("path"))
+		return
+	}
+	version, blob, err := findVersion(share, rel, c.Query("id"))
+	var f *os.File
+	if err == nil {
+		f, err = os.Open(blob)
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errVersionNotFound.Error()})
+		return
+	}
+	defer f.Close()
+	name := path.Base(rel)
+	c.Header("Content-Type", fileMime(name))
+	c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(name))
+	http.ServeContent(c.Writer, c.Request, name, time.UnixMilli(version.ModTime), f)
+}
+
+// bindVersionOp reads a VersionRequest for a file of a writable share
+func bindVersionOp(c *gin.Context) (VersionRequest, models.FileShare, string, string, bool) {
+	var req VersionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return req, models.FileShare{}, "", "", false
+	}
+	share, full, rel, err := versionFile(req.Share, req.Path, true)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return req, share, "", "", false
+	}
+	for _, id := range req.IDs {
+		if !validVersionID(id) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return req, share, "", "", false
+		}
+	}
+	c.Set("auditTarget", share.Name+":"+rel)
+	return req, share, full, rel, true
+}
+
+// RestoreFileVersion writes a version back over its file, whose content
+// becomes a version in turn
+func RestoreFileVersion(c *gin.Context) {
+	req, share, full, rel, ok := bindVersionOp(c)
+	if !ok {
+		return
+	}
+	if len(req.IDs) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	version, blob, err := findVersion(share, rel, req.IDs[0])
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	// Opened first: keeping the current content may prune this version
+	f, err := os.Open(blob)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errVersionNotFound.Error()})
+		return
+	}
+	defer f.Close()
+
+	mode := os.FileMode(0644)
+	var oldSize int64
+	info, err := os.Stat(full)
+	switch {
+	case err == nil && !info.Mode().IsRegular():
+		fileError(c, errInvalidPath, rel)
+		return
+	case err == nil:
+		mode, oldSize = info.Mode().Perm(), info.Size()
+	case !os.IsNotExist(err):
+		fileError(c, err, rel)
+		return
+	}
+	if grow := version.Size - oldSize; grow > 0 {
+		if err := checkShareQuota(share.Name, grow); err != nil {
+			fileError(c, err, rel)
+			return
+		}
+	}
+	keepVersion(share, rel, full, c.GetString("username"))
+	n, err := replaceFile(full, f, mode)
+	if err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	chargeShareQuota(share.Name, n-oldSize)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"path": rel, "size": n}})
+}
+
+// DeleteFileVersions deletes the given versions of a file, or all of them
+func DeleteFileVersions(c *gin.Context) {
+	req, share, _, rel, ok := bindVersionOp(c)
+	if !ok {
+		return
+	}
+	fileVersions.Lock()
+	defer fileVersions.Unlock()
+	dir := versionsDir(share, rel)
+	index := readVersionIndex(dir, rel)
+	drop := map[string]bool{}
+	for _, id := range req.IDs {
+		drop[id] = true
+	}
+	kept := index.Versions[:0]
+	deleted := 0
+	var failed error
+	for _, v := range index.Versions {
+		if len(drop) > 0 && !drop[v.ID] {
+			kept = append(kept, v)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, v.ID)); err != nil && !os.IsNotExist(err) {
+			// Still listed, so it can be deleted again
+			kept = append(kept, v)
+			failed = err
+			continue
+		}
+		deleted++
+	}
+	index.Versions = kept
+	if err := writeVersionIndex(dir, index); err != nil && failed == nil {
+		failed = err
+	}
+	if failed != nil {
+		fileError(c, failed, rel)
+		return
+	}
+	markQuotaStale(share.Name)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"deleted": deleted}})
+}
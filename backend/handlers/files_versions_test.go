@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFileVersions(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root, other := t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("one"), 0644)
+	os.WriteFile(filepath.Join(other, "b.txt"), []byte("other"), 0644)
+	share := models.FileShare{Name: "main", Path: root}
+	sysConfig := models.SystemConfig{
+		Shares: []models.FileShare{share, {Name: "other", Path: other}},
+	}
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("username", "alice") })
+	r.GET("/files/list", ListFiles)
+	r.POST("/files/rename", RenameFile)
+	r.PUT("/files/text", SaveTextFile)
+	r.GET("/files/versions", GetFileVersions)
+	r.GET("/files/versions/download", DownloadFileVersion)
+	r.POST("/files/versions/restore", RestoreFileVersion)
+	r.POST("/files/versions/delete", DeleteFileVersions)
+	fsys := &shareFS{username: "bob"}
+	put := func(name, content string) {
+		t.Helper()
+		f, err := fsys.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		f.Write([]byte(content))
+		f.Close()
+	}
+	versions := func(query string) []FileVersion {
+		t.Helper()
+		w := serve(r, "GET", "/files/versions?"+query, "")
+		var resp struct {
+			Data struct{ Items []FileVersion }
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != 200 || err != nil {
+			t.Fatalf("versions %s: %d %s", query, w.Code, w.Body.String())
+		}
+		return resp.Data.Items
+	}
+	read := func(p string) string {
+		data, _ := os.ReadFile(filepath.Join(root, filepath.FromSlash(p)))
+		return string(data)
+	}
+
+	// Nothing is kept until versions are enabled
+	put("/main/docs/a.txt", "two")
+	if v := versions("share=main&path=docs/a.txt"); len(v) != 0 {
+		t.Fatalf("expected no versions while disabled, got %+v", v)
+	}
+	sysConfig.Versions = &models.VersionSettings{Enable: true, Keep: 3}
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+
+	// WebDAV writes and the editor keep what they overwrite
+	put("/main/docs/a.txt", "three")
+	text, _ := os.ReadFile(filepath.Join(root, "docs", "a.txt"))
+	body, _ := json.Marshal(TextFileRequest{Share: "main", Path: "docs/a.txt", Content: "four", ETag: textETag(text)})
+	if code, resp := serveJSON(r, "PUT", "/files/text", string(body)); code != 200 {
+		t.Fatalf("save failed: %d %v", code, resp)
+	}
+	v := versions("share=main&path=docs/a.txt")
+	if len(v) != 2 || v[0].Size != 5 || v[0].SavedBy != "alice" || v[1].Size != 3 || v[1].SavedBy != "bob" {
+		t.Fatalf("unexpected versions %+v", v)
+	}
+	if w := serve(r, "GET", "/files/versions/download?share=main&path=docs/a.txt&id="+v[1].ID, ""); w.Code != 200 || w.Body.String() != "two" {
+		t.Fatalf("unexpected download %d %q", w.Code, w.Body.String())
+	}
+	if w := serve(r, "GET", "/files/versions/download?share=main&path=docs/a.txt&id=nope", ""); w.Code != 404 {
+		t.Fatalf("expected 404 for an unknown version, got %d", w.Code)
+	}
+
+	// The folder is hidden, and the oldest versions go past the limit
+	_, resp := serveJSON(r, "GET", "/files/list?share=main", "")
+	if entries := resp["data"].(map[string]interface{})["entries"].([]interface{}); len(entries) != 1 {
+		t.Fatalf("expected only docs in the listing, got %v", entries)
+	}
+	if code, _ := serveJSON(r, "GET", "/files/list?share=main&path=.versions", ""); code != 400 {
+		t.Fatalf("expected the versions to be unreachable, got %d", code)
+	}
+	put("/main/docs/a.txt", "five")
+	put("/main/docs/a.txt", "six")
+	if v := versions("share=main&path=docs/a.txt"); len(v) != 3 || v[0].Size != 4 || v[2].Size != 5 {
+		t.Fatalf("expected the three newest versions, got %+v", v)
+	}
+
+	// Restoring keeps the current content as a version in turn
+	v = versions("share=main&path=docs/a.txt")
+	if code, resp := serveJSON(r, "POST", "/files/versions/restore", `{"share":"main","path":"docs/a.txt","ids":["`+v[2].ID+`"]}`); code != 200 {
+		t.Fatalf("restore failed: %d %v", code, resp)
+	}
+	if got := read("docs/a.txt"); got != "three" {
+		t.Fatalf("expected the old content back, got %q", got)
+	}
+	if v := versions("share=main&path=docs/a.txt"); len(v) != 3 || v[0].Size != 3 || v[0].SavedBy != "alice" {
+		t.Fatalf("expected the replaced content kept, got %+v", v)
+	}
+	for body, code := range map[string]int{
+		`{"share":"main","path":"docs/a.txt","ids":["0-abc"]}`:  404,
+		`{"share":"main","path":"docs/a.txt","ids":[]}`:         400,
+		`{"share":"main","path":"docs/a.txt","ids":["../x"]}`:   400,
+		`{"share":"main","path":".versions/x","ids":["0-abc"]}`: 400,
+	} {
+		if got, _ := serveJSON(r, "POST", "/files/versions/restore", body); got != code {
+			t.Fatalf("%s: expected %d, got %d", body, code, got)
+		}
+	}
+
+	// Versions follow renames, and renaming over a file keeps it
+	serveJSON(r, "POST", "/files/rename", `{"share":"main","paths":["docs"],"name":"papers"}`)
+	if v := versions("share=main&path=papers/a.txt"); len(v) != 3 {
+		t.Fatalf("expected the versions to follow the folder, got %+v", v)
+	}
+	put("/main/papers/.a.txt.tmp", "seven")
+	if err := fsys.Rename(context.Background(), "/main/papers/.a.txt.tmp", "/main/papers/a.txt"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if v := versions("share=main&path=papers/a.txt"); len(v) != 3 || v[0].Size != 5 || v[0].SavedBy != "bob" {
+		t.Fatalf("expected the replaced file kept, got %+v", v)
+	}
+
+	// Shares keep their own number of versions; none turns them off
+	sysConfig.Versions.Shares = map[string]models.VersionRetention{"other": {Keep: 0}}
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+	put("/other/b.txt", "changed")
+	if v := versions("share=other&path=b.txt"); len(v) != 0 {
+		t.Fatalf("expected no versions on the other share, got %+v", v)
+	}
+
+	// Versions of a deleted file go with the recycle bin's retention
+	os.Remove(filepath.Join(root, "papers", "a.txt"))
+	retention := versionRetention(versionSettings(), "main")
+	if n := purgeVersions(share, retention, time.Now().Add(-time.Hour)); n != 0 || len(versions("share=main&path=papers/a.txt")) != 3 {
+		t.Fatalf("expected recent versions of a deleted file to stay, purged %d", n)
+	}
+	if n := purgeVersions(share, retention, time.Now().Add(time.Hour)); n != 3 {
+		t.Fatalf("expected the versions of the deleted file purged, got %d", n)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, ".versions")); len(entries) != 0 {
+		t.Fatalf("expected the versions folder emptied, got %d entries", len(entries))
+	}
+
+	// Deleting one version, then the rest
+	os.WriteFile(filepath.Join(root, "c.txt"), []byte("c1"), 0644)
+	put("/main/c.txt", "c2")
+	put("/main/c.txt", "c3")
+	v = versions("share=main&path=c.txt")
+	if code, resp := serveJSON(r, "POST", "/files/versions/delete", `{"share":"main","path":"c.txt","ids":["`+v[0].ID+`"]}`); code != 200 || resp["data"].(map[string]interface{})["deleted"].(float64) != 1 {
+		t.Fatalf("delete failed: %d %v", code, resp)
+	}
+	if v := versions("share=main&path=c.txt"); len(v) != 1 {
+		t.Fatalf("expected one version left, got %+v", v)
+	}
+	if code, _ := serveJSON(r, "POST", "/files/versions/delete", `{"share":"main","path":"c.txt"}`); code != 200 || len(versions("share=main&path=c.txt")) != 0 {
+		t.Fatalf("delete all failed: %d", code)
+	}
+}
+
+func TestVersionSettings(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		`{"enable":true,"keep":5,"days":30}`:          true,
+		`{"enable":true,"shares":{"a":{"keep":0}}}`:   true,
+		`{"enable":true,"keep":-1}`:                   false,
+		`{"enable":true,"keep":100000}`:               false,
+		`{"enable":true,"shares":{"a":{"days":-1}}}`:  false,
+		`{"enable":true,"maxSizeMb":-5}`:              false,
+		`{"enable":true,"shares":{"a":{"keep":"x"}}}`: false,
+	} {
+		var payload interface{}
+		json.Unmarshal([]byte(raw), &payload)
+		if _, err := decodeVersionSettings(payload); (err == nil) != ok {
+			t.Fatalf("%s: unexpected %v", raw, err)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/models"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// The file browser follows the folders it shows. A client sends
+// "files:watch" {share, path} when it opens a folder, which joins it to the
+// room of the folder; the server watches the folder with fsnotify while
+// anyone is in the room. What changes within fileWatchDelay is sent to the
+// room as one "files:changed" event, so a copy of many files does not
+// flood the client:
+//
+//	{"share": "main", "path": "photos", "changes": [
+//		{"op": "created", "name": "a.jpg", "entry": {...}},
+//		{"op": "removed", "name": "b.jpg"}]}
+//
+// "gone" is set when the folder itself was removed or moved away, and
+// "resync" when events were lost and the folder should be listed again.
+// {enable: false} stops following. Photos and videos get their thumbnails
+// once they stop changing, and the search index hears of changes in
+// folders it does not watch itself.
+
+const (
+	fileWatchDelay = 500 * time.Millisecond
+	fileWatchSweep = 30 * time.Second // Folders no one follows any more are released this often
+	fileWatchMax   = 512              // Folders followed at once
+)
+
+var errTooManyWatches = errors.New("Too many folders are followed")
+
+// FileWatchPayload starts or stops following a folder
+type FileWatchPayload struct {
+	Token  string `json:"token"`
+	Share  string `json:"share"`
+	Path   string `json:"path"`
+	Enable *bool  `json:"enable,omitempty"` // Defaults to true
+}
+
+// FileChange is an entry of a followed folder that changed
+type FileChange struct {
+	Op    string     `json:"op"` // created, modified or removed
+	Name  string     `json:"name"`
+	Entry *FileEntry `json:"entry,omitempty"` // Not for removed entries
+}
+
+// FilesChanged is the "files:changed" event
+type FilesChanged struct {
+	Share   string       `json:"share"`
+	Path    string       `json:"path"`
+	Changes []FileChange `json:"changes,omitempty"`
+	Gone    bool         `json:"gone,omitempty"`
+	Resync  bool         `json:"resync,omitempty"`
+}
+
+// watchedDir is a followed folder of a share. Nested shares can reach the
+// same host folder, so a host folder may have several.
+type watchedDir struct {
+	share    models.FileShare
+	rel      string
+	room     string
+	changed  map[string]bool // Name -> created
+	settling map[string]bool // Photos and videos written to lately
+	gone     bool
+	resync   bool
+}
+
+var fileWatches = struct {
+	sync.Mutex
+	w     *fsnotify.Watcher
+	dirs  map[string][]*watchedDir // By host folder
+	flush *time.Timer
+}{dirs: make(map[string][]*watchedDir)}
+
+func fileWatchRoom(share, rel string) string {
+	return "files:" + share + ":" + rel
+}
+
+// followFolder watches dir, the folder rel of share, for the clients in
+// room
+func followFolder(share models.FileShare, rel, dir, room string) error {
+	fileWatches.Lock()
+	defer fileWatches.Unlock()
+	for _, wd := range fileWatches.dirs[dir] {
+		if wd.room == room {
+			return nil
+		}
+	}
+	if len(fileWatches.dirs) >= fileWatchMax {
+		releaseFolders()
+		if len(fileWatches.dirs) >= fileWatchMax {
+			return errTooManyWatches
+		}
+	}
+	if fileWatches.w == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		fileWatches.w = w
+		go runFileWatch(w)
+	}
+	if len(fileWatches.dirs[dir]) == 0 {
+		if err := fileWatches.w.Add(dir); err != nil {
+			return err
+		}
+	}
+	fileWatches.dirs[dir] = append(fileWatches.dirs[dir], &watchedDir{
+		share: share, rel: rel, room: room,
+		changed: make(map[string]bool), settling: make(map[string]bool),
+	})
+	return nil
+}
+
+// releaseFolders stops watching the folders no client follows, and the
+// watcher when none is left. fileWatches must be locked.
+func releaseFolders() {
+	for dir, list := range fileWatches.dirs {
+		var keep []*watchedDir
+		for _, wd := range list {
+			if !wd.gone && roomLen(wd.room) > 0 {
+				keep = append(keep, wd)
+			}
+		}
+		if len(keep) > 0 {
+			fileWatches.dirs[dir] = keep
+			continue
+		}
+		fileWatches.w.Remove(dir)
+		delete(fileWatches.dirs, dir)
+	}
+	if len(fileWatches.dirs) == 0 && fileWatches.w != nil {
+		fileWatches.w.Close()
+		fileWatches.w = nil
+	}
+}
+
+func runFileWatch(w *fsnotify.Watcher) {
+	sweep := time.NewTicker(fileWatchSweep)
+	defer sweep.Stop()
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			fileWatchEvent(ev)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				filesLog.Warn("Folder watch error", "error", err)
+				continue
+			}
+			fileWatches.Lock()
+			for _, list := range fileWatches.dirs {
+				for _, wd := range list {
+					wd.resync = true
+				}
+			}
+			scheduleFileWatchFlush()
+			fileWatches.Unlock()
+		case <-sweep.C:
+			fileWatches.Lock()
+			releaseFolders()
+			fileWatches.Unlock()
+		case <-backgroundCtx.Done():
+			fileWatches.Lock()
+			if fileWatches.w == w {
+				w.Close()
+				fileWatches.w = nil
+				fileWatches.dirs = make(map[string][]*watchedDir)
+			}
+			fileWatches.Unlock()
+			return
+		}
+	}
+}
+
+func fileWatchEvent(ev fsnotify.Event) {
+	dir, name := filepath.Dir(ev.Name), filepath.Base(ev.Name)
+	fileWatches.Lock()
+	defer fileWatches.Unlock()
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		// A followed folder went away; its watch would follow it elsewhere
+		for _, wd := range fileWatches.dirs[ev.Name] {
+			wd.gone = true
+		}
+	}
+	for _, wd := range fileWatches.dirs[dir] {
+		if wd.rel == "" && hiddenShareDir(name) {
+			continue
+		}
+		wd.changed[name] = wd.changed[name] || ev.Has(fsnotify.Create)
+	}
+	scheduleFileWatchFlush()
+}
+
+// scheduleFileWatchFlush sends what changed after fileWatchDelay.
+// fileWatches must be locked.
+func scheduleFileWatchFlush() {
+	if fileWatches.flush == nil {
+		fileWatches.flush = time.AfterFunc(fileWatchDelay, flushFileWatches)
+	}
+}
+
+// folderBatch is what changed in a followed folder since the last flush
+type folderBatch struct {
+	wd      *watchedDir
+	dir     string
+	changed map[string]bool
+	thumbs  []string // Photos and videos that stopped changing
+	gone    bool
+	resync  bool
+}
+
+func flushFileWatches() {
+	fileWatches.Lock()
+	fileWatches.flush = nil
+	var batches []folderBatch
+	for dir, list := range fileWatches.dirs {
+		var keep []*watchedDir
+		for _, wd := range list {
+			b := folderBatch{wd: wd, dir: dir, changed: wd.changed, gone: wd.gone, resync: wd.resync}
+			for name := range wd.settling {
+				if _, ok := wd.changed[name]; !ok {
+					b.thumbs = append(b.thumbs, path.Join(wd.rel, name))
+					delete(wd.settling, name)
+				}
+			}
+			for name := range wd.changed {
+				if thumbKind(name) != "" {
+					wd.settling[name] = true
+				}
+			}
+			if len(b.changed) > 0 || len(b.thumbs) > 0 || b.gone || b.resync {
+				batches = append(batches, b)
+			}
+			wd.changed, wd.resync = make(map[string]bool), false
+			if wd.gone {
+				continue
+			}
+			keep = append(keep, wd)
+			if len(wd.settling) > 0 {
+				// Another round finds out whether they stopped changing
+				scheduleFileWatchFlush()
+			}
+		}
+		if len(keep) > 0 {
+			fileWatches.dirs[dir] = keep
+			continue
+		}
+		fileWatches.w.Remove(dir)
+		delete(fileWatches.dirs, dir)
+	}
+	fileWatches.Unlock()
+	for _, b := range batches {
+		b.send()
+	}
+}
+
+// send tells the room of the folder what changed, then has the thumbnails
+// made and the search index updated
+func (b folderBatch) send() {
+	wd := b.wd
+	ev := FilesChanged{Share: wd.share.Name, Path: wd.rel, Gone: b.gone, Resync: b.resync && !b.gone}
+	names := make([]string, 0, len(b.changed))
+	for name := range b.changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	search := make(map[string]bool, len(names))
+	for _, name := range names {
+		rel := path.Join(wd.rel, name)
+		info, err := os.Lstat(filepath.Join(b.dir, name))
+		if err != nil {
+			ev.Changes = append(ev.Changes, FileChange{Op: "removed", Name: name})
+			search[rel] = true
+			continue
+		}
+		op := "modified"
+		if b.changed[name] {
+			op = "created"
+		}
+		e := listEntry(wd.share, wd.rel, info)
+		ev.Changes = append(ev.Changes, FileChange{Op: op, Name: name, Entry: &e})
+		search[rel] = b.changed[name]
+	}
+	if len(ev.Changes) > 0 || ev.Gone || ev.Resync {
+		broadcastRoom(wd.room, "files:changed", ev)
+	}
+	if len(b.thumbs) > 0 {
+		prefetchThumbs(wd.share, b.thumbs)
+	}
+	if len(search) > 0 {
+		noteSearchChanges(wd.share.Name, b.dir, search)
+	}
+}
+
+func BindFileWatchHandlers(server *socketio.Server) {
+	bindEvent(server, "files:watch", func(s socketio.Conn, msg FileWatchPayload) {
+		share, err := findFileShare(msg.Share)
+		if err != nil {
+			s.Emit("files:error", gin.H{"error": err.Error(), "share": msg.Share})
+			return
+		}
+		rel, err := cleanSharePath(msg.Path)
+		if err != nil {
+			s.Emit("files:error", gin.H{"error": err.Error(), "path": msg.Path})
+			return
+		}
+		room := fileWatchRoom(share.Name, rel)
+		if msg.Enable != nil && !*msg.Enable {
+			s.Leave(room)
+			return
+		}
+		if share.Remote != "" {
+			// Changes made on the remote side raise no events here
+			s.Emit("files:error", gin.H{"error": "Changes in remote mounts are not reported", "share": share.Name})
+			return
+		}
+		dir, err := resolveSharePath(share, rel)
+		if err == nil {
+			var info os.FileInfo
+			if info, err = os.Stat(dir); err == nil && !info.IsDir() {
+				err = errInvalidPath
+			}
+		}
+		if err == nil {
+			s.Join(room)
+			if err = followFolder(share, rel, dir, room); err != nil {
+				s.Leave(room)
+			}
+		}
+		if err != nil {
+			message := err.Error()
+			if os.IsNotExist(err) {
+				message = "File not found"
+			}
+			s.Emit("files:error", gin.H{"error": message, "share": share.Name, "path": rel})
+			return
+		}
+		s.Emit("files:watching", gin.H{"share": share.Name, "path": rel})
+	})
+}
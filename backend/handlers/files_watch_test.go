@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bytes"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"image"
+	"image/png"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/gorilla/websocket"
+)
+
+func TestFileWatch(t *testing.T) {
+	useTestConfig(t)
+	prevThumbs := config.ThumbCacheDir
+	config.ThumbCacheDir = t.TempDir()
+	defer func() { config.ThumbCacheDir = prevThumbs }()
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs", "old"), 0755)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+	_, token, _ := middleware.CreateApiToken("admin", "browser", []string{middleware.ScopeWrite}, 0)
+
+	server := socketio.NewServer(nil)
+	BindFileWatchHandlers(server)
+	r := gin.New()
+	r.GET("/ws", ServeWebSocket(func(string) bool { return true }))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	type event struct {
+		Event string       `json:"event"`
+		Data  FilesChanged `json:"data"`
+	}
+	// next reads events until one other than the greeting arrives
+	next := func() event {
+		t.Helper()
+		for {
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var ev event
+			if err := ws.ReadJSON(&ev); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if ev.Event != "connect" {
+				return ev
+			}
+		}
+	}
+	watch := func(path string) {
+		t.Helper()
+		ws.WriteJSON(map[string]interface{}{"event": "files:watch", "data": map[string]interface{}{"share": "main", "path": path}})
+		if ev := next(); ev.Event != "files:watching" || ev.Data.Path != path {
+			t.Fatalf("watch %s: got %+v", path, ev)
+		}
+	}
+
+	watch("docs")
+	watch("docs/old")
+	if n := roomLen(fileWatchRoom("main", "docs")); n != 1 {
+		t.Fatalf("room has %d members, want 1", n)
+	}
+
+	// A burst of files arrives as one event with their entries
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+	os.WriteFile(filepath.Join(root, "docs", "a.png"), img.Bytes(), 0644)
+	os.WriteFile(filepath.Join(root, "docs", "b.txt"), []byte("hello"), 0644)
+	ev := next()
+	if ev.Event != "files:changed" || ev.Data.Path != "docs" || len(ev.Data.Changes) != 2 {
+		t.Fatalf("got %+v, want the two new files", ev)
+	}
+	a, b := ev.Data.Changes[0], ev.Data.Changes[1]
+	if a.Op != "created" || a.Name != "a.png" || a.Entry == nil || a.Entry.Path != "docs/a.png" || a.Entry.Thumb == "" {
+		t.Fatalf("photo change = %+v", a)
+	}
+	if b.Op != "created" || b.Entry == nil || b.Entry.Size != 5 {
+		t.Fatalf("text change = %+v", b)
+	}
+
+	// The photo gets its thumbnails once it stops changing
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasFiles(config.ThumbCacheDir) {
+		if time.Now().After(deadline) {
+			t.Fatal("no thumbnail made for the new photo")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	os.WriteFile(filepath.Join(root, "docs", "b.txt"), []byte("hello again"), 0644)
+	if ev := next(); len(ev.Data.Changes) != 1 || ev.Data.Changes[0].Op != "modified" || ev.Data.Changes[0].Entry.Size != 11 {
+		t.Fatalf("got %+v, want b.txt modified", ev)
+	}
+	os.Remove(filepath.Join(root, "docs", "b.txt"))
+	if ev := next(); len(ev.Data.Changes) != 1 || ev.Data.Changes[0].Op != "removed" || ev.Data.Changes[0].Entry != nil {
+		t.Fatalf("got %+v, want b.txt removed", ev)
+	}
+
+	// A followed folder that is removed is reported gone and released
+	os.Remove(filepath.Join(root, "docs", "old"))
+	var gone, listed bool
+	for !gone || !listed {
+		ev := next()
+		switch {
+		case ev.Data.Path == "docs/old" && ev.Data.Gone:
+			gone = true
+		case ev.Data.Path == "docs" && len(ev.Data.Changes) == 1 && ev.Data.Changes[0].Name == "old":
+			listed = true
+		default:
+			t.Fatalf("unexpected %+v", ev)
+		}
+	}
+	fileWatches.Lock()
+	followed := len(fileWatches.dirs)
+	fileWatches.Unlock()
+	if followed != 1 {
+		t.Fatalf("%d folders followed, want only docs", followed)
+	}
+
+	// Folders are released once no one follows them
+	ws.WriteJSON(map[string]interface{}{"event": "files:watch", "data": map[string]interface{}{"share": "main", "path": "docs", "enable": false}})
+	ws.WriteJSON(map[string]interface{}{"event": "files:watch", "data": map[string]interface{}{"share": "main", "path": "missing"}})
+	if ev := next(); ev.Event != "files:error" {
+		t.Fatalf("got %+v, want an error for a missing folder", ev)
+	}
+	fileWatches.Lock()
+	releaseFolders()
+	followed = len(fileWatches.dirs)
+	watching := fileWatches.w != nil
+	fileWatches.Unlock()
+	if followed != 0 || watching {
+		t.Fatalf("%d folders still followed after leaving", followed)
+	}
+}
+
+// hasFiles reports whether there is a file below dir
+func hasFiles(dir string) bool {
+	found := false
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"flatnasgo-backend/models"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Folders and multi-selections download as a ZIP written straight to the
+// response, never staged on disk. The archive ends when the client goes
+// away: every file is copied under the request context, so cancelling the
+// download in the browser stops the walk.
+
+// Extensions that are compressed already; storing them saves CPU on a NAS
+// for no loss in size
+var zipStoredExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp4": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true, ".m4v": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".flac": true, ".ogg": true, ".opus": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".7z": true, ".rar": true, ".zst": true,
+}
+
+// Per-entry overhead of a streamed archive: local header, data descriptor,
+// central directory record and the two timestamp fields, without the name
+const zipEntryOverhead = 30 + 16 + 46 + 2*9
+
+// zipItem is one file or folder to put in the archive
+type zipItem struct {
+	full string // Host path
+	name string // Name inside the archive
+	info os.FileInfo
+}
+
+// ZipEstimate is the answer of EstimateZip
+type ZipEstimate struct {
+	Files   int   `json:"files"`
+	Folders int   `json:"folders"`
+	Bytes   int64 `json:"bytes"` // Sum of the file sizes
+	// Estimate is about the archive size when nothing compresses, as for
+	// photos and videos
+	Estimate int64 `json:"estimate"`
+}
+
+// zipSelection resolves the share and path query parameters of a ZIP
+// request. Each path may be a file or a folder; the root selects the whole
+// share.
+func zipSelection(c *gin.Context) (models.FileShare, []string, bool) {
+	share, err := findFileShare(c.Query("share"))
+	if err != nil {
+		fileError(c, err, "")
+		return share, nil, false
+	}
+	paths := c.QueryArray("path")
+	if len(paths) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return share, nil, false
+	}
+	return share, paths, true
+}
+
+// walkZipItems calls fn for every file and folder under the selected
+// paths. Symlinks are followed only to files inside the share; linked
+// folders are skipped so a loop cannot make the archive endless.
+func walkZipItems(ctx context.Context, share models.FileShare, paths []string, fn func(zipItem) error) error {
+	used := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		rel, err := cleanSharePath(p)
+		if err != nil {
+			return err
+		}
+		top, err := resolveSharePath(share, rel)
+		if err != nil {
+			return err
+		}
+		base := path.Base(rel)
+		if rel == "" {
+			base = share.Name
+		}
+		// Two selected items with the same name, from different folders
+		stem, ext := strings.TrimSuffix(base, path.Ext(base)), path.Ext(base)
+		for i := 2; used[base]; i++ {
+			base = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		used[base] = true
+
+		err = filepath.WalkDir(top, func(full string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			sub, _ := filepath.Rel(top, full)
+			if rel == "" && hiddenShareDir(sub) {
+				return filepath.SkipDir
+			}
+			name := path.Join(base, filepath.ToSlash(sub))
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, err := resolveSharePath(share, path.Join(rel, filepath.ToSlash(sub)))
+				if err != nil {
+					return nil
+				}
+				if info, err = os.Stat(target); err != nil || !info.Mode().IsRegular() {
+					return nil
+				}
+				return fn(zipItem{full: target, name: name, info: info})
+			}
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil
+			}
+			return fn(zipItem{full: full, name: name, info: info})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EstimateZip counts what DownloadZip would send, for the client to show
+// the size before starting
+func EstimateZip(c *gin.Context) {
+	share, paths, ok := zipSelection(c)
+	if !ok {
+		return
+	}
+	var est ZipEstimate
+	err := walkZipItems(c.Request.Context(), share, paths, func(item zipItem) error {
+		est.Estimate += zipEntryOverhead + int64(len(item.name))
+		if item.info.IsDir() {
+			est.Folders++
+			est.Estimate++ // The trailing slash
+			return nil
+		}
+		est.Files++
+		est.Bytes += item.info.Size()
+		est.Estimate += item.info.Size()
+		return nil
+	})
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	est.Estimate += 22 // End of central directory
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": est})
+}
+
+// DownloadZip streams the selected files and folders as one ZIP archive.
+// Errors before the first byte get a JSON answer; after that the archive
+// is cut short, which the client sees as a failed download.
+func DownloadZip(c *gin.Context) {
+	share, paths, ok := zipSelection(c)
+	if !ok {
+		return
+	}
+	// Check the selection before committing to a 200
+	for _, p := range paths {
+		rel, err := cleanSharePath(p)
+		if err == nil {
+			var full string
+			if full, err = resolveSharePath(share, rel); err == nil {
+				_, err = os.Stat(full)
+			}
+		}
+		if err != nil {
+			fileError(c, err, p)
+			return
+		}
+	}
+
+	name := share.Name
+	if len(paths) == 1 {
+		if rel, _ := cleanSharePath(paths[0]); rel != "" {
+			name = path.Base(rel)
+		}
+	}
+	name = strings.TrimSuffix(name, path.Ext(name)) + ".zip"
+	c.Set("auditTarget", share.Name+":"+strings.Join(paths, ","))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="download.zip"; filename*=UTF-8''`+url.PathEscape(name))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	ctx := c.Request.Context()
+	zw := zip.NewWriter(c.Writer)
+	err := walkZipItems(ctx, share, paths, func(item zipItem) error {
+		return addZipItem(ctx, zw, item)
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil && ctx.Err() == nil {
+		filesLog.Warn("ZIP download failed", "share", share.Name, "error", err)
+	}
+}
+
+func addZipItem(ctx context.Context, zw *zip.Writer, item zipItem) error {
+	return copyZipItem(zw, item, func(f io.Reader) io.Reader { return ctxReader{ctx, f} })
+}
+
+// copyZipItem adds an item, its contents read through read
+func copyZipItem(zw *zip.Writer, item zipItem, read func(io.Reader) io.Reader) error {
+	header, err := zip.FileInfoHeader(item.info)
+	if err != nil {
+		return err
+	}
+	header.Name = item.name
+	if item.info.IsDir() {
+		header.Name += "/"
+		_, err = zw.CreateHeader(header)
+		return err
+	}
+	header.Method = zip.Deflate
+	if zipStoredExts[strings.ToLower(filepath.Ext(item.name))] {
+		header.Method = zip.Store
+	}
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(item.full)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, read(f))
+	return err
+}
+
+// ctxReader stops a copy once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
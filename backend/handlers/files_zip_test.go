@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDownloadZip(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "photos", "2024"), 0755)
+	os.MkdirAll(filepath.Join(root, "other", "photos"), 0755)
+	os.WriteFile(filepath.Join(root, "photos", "2024", "a.jpg"), []byte("jpeg"), 0644)
+	os.WriteFile(filepath.Join(root, "other", "photos", "b.txt"), []byte("text"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "photos", "leak.txt"))
+	os.Symlink(filepath.Join(root, "photos"), filepath.Join(root, "photos", "loop"))
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	r := gin.New()
+	r.GET("/zip", DownloadZip)
+	r.GET("/zip/estimate", EstimateZip)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/zip?share=main&path=photos&path=other/photos", nil))
+	if w.Code != 200 || !strings.HasSuffix(w.Header().Get("Content-Disposition"), "main.zip") {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("invalid archive: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := "photos/ photos/2024/ photos/2024/a.jpg photos (2)/ photos (2)/b.txt"
+	if strings.Join(names, " ") != want {
+		t.Fatalf("expected %q, got %q", want, strings.Join(names, " "))
+	}
+	if zr.File[2].Method != zip.Store || zr.File[4].Method != zip.Deflate {
+		t.Fatalf("expected photos stored and text deflated")
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/zip/estimate?share=main&path=photos&path=other/photos", nil))
+	var resp struct {
+		Data ZipEstimate `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Data.Files != 2 || resp.Data.Folders != 3 || resp.Data.Bytes != 8 {
+		t.Fatalf("unexpected estimate %+v", resp.Data)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/zip?share=main&path=missing", nil))
+	if w.Code != 404 {
+		t.Fatalf("expected a missing path to fail before streaming, got %d", w.Code)
+	}
+}
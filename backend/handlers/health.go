@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+const (
+	// A worker whose loop has not come round for this long past its tick
+	// is reported as stalled; one pass may legitimately take minutes
+	workerStallTimeout = 15 * time.Minute
+	// Below this much free space the data volume fails readiness
+	healthMinFreeBytes = 100 << 20
+	healthDialTimeout  = 2 * time.Second
+)
+
+const (
+	healthOK   = "ok"
+	healthWarn = "warn"
+	healthFail = "fail"
+	healthSkip = "skip"
+)
+
+// HealthCheck is the result of one check of /healthz or /readyz. Only
+// "fail" makes the endpoint answer 503; "warn" is for optional
+// dependencies like the proxy.
+type HealthCheck struct {
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+	Time   int64                  `json:"time"`
+}
+
+// workerBeats records when each background loop last came round
+var workerBeats = struct {
+	sync.Mutex
+	interval map[string]time.Duration
+	last     map[string]time.Time
+}{interval: make(map[string]time.Duration), last: make(map[string]time.Time)}
+
+// registerWorker adds a background loop to the liveness check. The
+// returned func is called on every pass of the loop.
+func registerWorker(name string, interval time.Duration) func() {
+	workerBeats.Lock()
+	workerBeats.interval[name] = interval
+	workerBeats.last[name] = time.Now()
+	workerBeats.Unlock()
+	return func() {
+		workerBeats.Lock()
+		workerBeats.last[name] = time.Now()
+		workerBeats.Unlock()
+	}
+}
+
+// Healthz is the liveness probe: the process answers and its background
+// workers are not stuck
+func Healthz(c *gin.Context) {
+	writeHealth(c, map[string]func() HealthCheck{
+		"workers": checkWorkers,
+	})
+}
+
+// Readyz is the readiness probe: the instance can serve requests, i.e.
+// its data files read, the data directory is writable and the shared
+// cache answers. It fails while shutting down so load balancers drain it.
+func Readyz(c *gin.Context) {
+	writeHealth(c, map[string]func() HealthCheck{
+		"data":    checkDataFiles,
+		"disk":    checkDiskWrite,
+		"cache":   checkSharedCache,
+		"proxy":   checkProxyReachable,
+		"workers": checkWorkers,
+		"shutdown": func() HealthCheck {
+			if ShuttingDown() {
+				return HealthCheck{Status: healthFail, Detail: "shutting down"}
+			}
+			return HealthCheck{Status: healthOK}
+		},
+	})
+}
+
+func writeHealth(c *gin.Context, checks map[string]func() HealthCheck) {
+	report := runHealthChecks(checks)
+	status := http.StatusOK
+	if report.Status == healthFail {
+		status = http.StatusServiceUnavailable
+	}
+	c.Header("Cache-Control", "no-store")
+	if c.Request.Method == http.MethodHead {
+		c.Status(status)
+		return
+	}
+	c.JSON(status, report)
+}
+
+// runHealthChecks runs the checks concurrently so one slow dependency does
+// not add up with the others
+func runHealthChecks(checks map[string]func() HealthCheck) HealthReport {
+	report := HealthReport{Status: healthOK, Checks: make(map[string]HealthCheck, len(checks)), Time: time.Now().UnixMilli()}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, fn := range checks {
+		wg.Add(1)
+		go func(name string, fn func() HealthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			result := fn()
+			result.LatencyMs = time.Since(start).Milliseconds()
+			mu.Lock()
+			report.Checks[name] = result
+			mu.Unlock()
+		}(name, fn)
+	}
+	wg.Wait()
+	for _, check := range report.Checks {
+		if check.Status == healthFail {
+			report.Status = healthFail
+		} else if check.Status == healthWarn && report.Status == healthOK {
+			report.Status = healthWarn
+		}
+	}
+	return report
+}
+
+// checkDataFiles reads the system config and the dashboard data, the
+// files every request depends on
+func checkDataFiles() HealthCheck {
+	var sysConfig models.SystemConfig
+	if err := utils.ReadJSON(config.SystemConfigFile, &sysConfig); err != nil && !os.IsNotExist(err) {
+		return HealthCheck{Status: healthFail, Detail: "system config: " + err.Error()}
+	}
+	var data map[string]interface{}
+	if err := utils.ReadJSON(filepath.Join(config.DataDir, "data.json"), &data); err != nil && !os.IsNotExist(err) {
+		return HealthCheck{Status: healthFail, Detail: "data.json: " + err.Error()}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+func checkDiskWrite() HealthCheck {
+	f, err := os.CreateTemp(config.DataDir, ".healthcheck-*")
+	if err != nil {
+		return HealthCheck{Status: healthFail, Detail: err.Error()}
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	os.Remove(name)
+	if err != nil {
+		return HealthCheck{Status: healthFail, Detail: err.Error()}
+	}
+	if d, err := disk.Usage(config.DataDir); err == nil {
+		detail := fmt.Sprintf("%.1f%% used, %d MB free", d.UsedPercent, d.Free>>20)
+		if d.Free < healthMinFreeBytes {
+			return HealthCheck{Status: healthFail, Detail: detail}
+		}
+		if d.UsedPercent >= diskAlertPercent {
+			return HealthCheck{Status: healthWarn, Detail: detail}
+		}
+		return HealthCheck{Status: healthOK, Detail: detail}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+// checkSharedCache pings Redis when the widget cache is shared
+func checkSharedCache() HealthCheck {
+	if sharedWidgetCache.shared == nil {
+		return HealthCheck{Status: healthSkip, Detail: "local"}
+	}
+	if err := sharedWidgetCache.shared.Ping(); err != nil {
+		return HealthCheck{Status: healthFail, Detail: "redis: " + err.Error()}
+	}
+	return HealthCheck{Status: healthOK, Detail: "redis"}
+}
+
+// checkProxyReachable dials the configured proxies. Fetches fall back to
+// the next proxy, so only all of them being down is worth a warning.
+func checkProxyReachable() HealthCheck {
+	profiles, err := loadProxyProfiles()
+	if err != nil {
+		return HealthCheck{Status: healthWarn, Detail: err.Error()}
+	}
+	if len(profiles) == 0 {
+		return HealthCheck{Status: healthSkip, Detail: "no proxy configured"}
+	}
+	var down []string
+	for _, p := range profiles {
+		conn, err := net.DialTimeout("tcp", p.url.Host, healthDialTimeout)
+		if err != nil {
+			down = append(down, p.name)
+			continue
+		}
+		conn.Close()
+	}
+	switch {
+	case len(down) == len(profiles):
+		return HealthCheck{Status: healthWarn, Detail: fmt.Sprintf("unreachable: %v", down)}
+	case len(down) > 0:
+		return HealthCheck{Status: healthOK, Detail: fmt.Sprintf("unreachable: %v", down)}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+func checkWorkers() HealthCheck {
+	now := time.Now()
+	workerBeats.Lock()
+	var stalled []string
+	for name, interval := range workerBeats.interval {
+		if now.Sub(workerBeats.last[name]) > interval+workerStallTimeout {
+			stalled = append(stalled, name)
+		}
+	}
+	total := len(workerBeats.interval)
+	workerBeats.Unlock()
+	if len(stalled) > 0 {
+		sort.Strings(stalled)
+		return HealthCheck{Status: healthFail, Detail: fmt.Sprintf("stalled: %v", stalled)}
+	}
+	return HealthCheck{Status: healthOK, Detail: fmt.Sprintf("%d running", total)}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHealthProbes(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.GET("/healthz", Healthz)
+	r.GET("/readyz", Readyz)
+	probe := func(path string) (int, HealthReport) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var report HealthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("invalid report %q: %v", w.Body.String(), err)
+		}
+		return w.Code, report
+	}
+
+	if code, report := probe("/readyz"); code != http.StatusOK || report.Checks["disk"].Status != healthOK || report.Checks["cache"].Status != healthSkip {
+		t.Fatalf("expected ready, got %d %+v", code, report)
+	}
+
+	os.WriteFile(filepath.Join(config.DataDir, "data.json"), []byte("{broken"), 0644)
+	if code, report := probe("/readyz"); code != http.StatusServiceUnavailable || report.Checks["data"].Status != healthFail {
+		t.Fatalf("expected a broken data file to fail readiness, got %d %+v", code, report)
+	}
+
+	registerWorker("test.worker", time.Minute)
+	defer func() {
+		workerBeats.Lock()
+		delete(workerBeats.interval, "test.worker")
+		delete(workerBeats.last, "test.worker")
+		workerBeats.Unlock()
+	}()
+	if code, _ := probe("/healthz"); code != http.StatusOK {
+		t.Fatalf("expected live, got %d", code)
+	}
+	workerBeats.Lock()
+	workerBeats.last["test.worker"] = time.Now().Add(-time.Hour)
+	workerBeats.Unlock()
+	if code, report := probe("/healthz"); code != http.StatusServiceUnavailable || !strings.Contains(report.Checks["workers"].Detail, "test.worker") {
+		t.Fatalf("expected a stalled worker to fail liveness, got %d %+v", code, report)
+	}
+}
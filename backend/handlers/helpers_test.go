@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Fixtures serve feeds and APIs from httptest servers on loopback
+	os.Setenv("OUTBOUND_ALLOWLIST", "127.0.0.1")
+	os.Exit(m.Run())
+}
+
+// serve runs one request against r
+func serve(r http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// serveJSON runs one request against r and decodes the JSON answer
+func serveJSON(r http.Handler, method, target, body string) (int, map[string]interface{}) {
+	w := serve(r, method, target, body)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+// useTestConfig points the data folder, the user folder and the system
+// config at a new temporary folder for the test
+func useTestConfig(t *testing.T) {
+	prevData, prevUsers, prevSys := config.DataDir, config.UsersDir, config.SystemConfigFile
+	config.DataDir = t.TempDir()
+	config.UsersDir = filepath.Join(config.DataDir, "users")
+	config.SystemConfigFile = filepath.Join(config.DataDir, "system.json")
+	if err := os.MkdirAll(config.UsersDir, 0755); err != nil {
+		t.Fatalf("users folder: %v", err)
+	}
+	t.Cleanup(func() { config.DataDir, config.UsersDir, config.SystemConfigFile = prevData, prevUsers, prevSys })
+}
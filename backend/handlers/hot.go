@@ -28,7 +28,7 @@ var hotTTLs = map[string]time.Duration{
 }
 
 func BindHotHandlers(server *socketio.Server) {
-	server.OnEvent("/", "hot:fetch", func(s socketio.Conn, msg interface{}) {
+	bindEvent(server, "hot:fetch", func(s socketio.Conn, msg interface{}) {
 		var payload map[string]interface{}
 		if m, ok := msg.(map[string]interface{}); ok {
 			payload = m
@@ -113,7 +113,7 @@ func refreshHotAsync(server *socketio.Server, t string) {
 	if err != nil || len(items) == 0 {
 		return
 	}
-	server.BroadcastToNamespace("/", "hot:data", map[string]interface{}{
+	broadcastAll("hot:data", map[string]interface{}{
 		"type": t,
 		"data": items,
 	})
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions an inbound hook can run
+const (
+	HookActionRssRefresh = "rss.refresh" // Refresh one feed, or every scheduled feed
+	HookActionNotify     = "notify"      // Show {title, body, link} on every dashboard
+	HookActionScript     = "script"      // Run a script from DataDir/scripts
+)
+
+const (
+	inboundHookMaxBody = 1 << 20
+	hookScriptTimeout  = time.Minute
+	hookScriptOutput   = 4 << 10
+)
+
+var hookScriptPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// InboundHook is a URL, POST /api/hooks/<id>, that external systems call to
+// run an action. Callers authenticate with the hook's secret as a bearer
+// token, an X-FlatNas-Token header or a ?token= parameter. Only a hash of
+// the secret is stored.
+type InboundHook struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Action     string   `json:"action"`
+	FeedUrl    string   `json:"feedUrl,omitempty"`  // rss.refresh; empty refreshes all feeds
+	Channels   []string `json:"channels,omitempty"` // notify; also deliver to these channels
+	Script     string   `json:"script,omitempty"`   // script; a file name in DataDir/scripts
+	Enable     bool     `json:"enable"`
+	SecretHash string   `json:"secretHash,omitempty"`
+	LastUsed   int64    `json:"lastUsed,omitempty"` // Unix timestamp in ms
+}
+
+func inboundHooksFile() string {
+	return filepath.Join(config.DataDir, "inbound_hooks.json")
+}
+
+func hookScriptsDir() string {
+	return filepath.Join(config.DataDir, "scripts")
+}
+
+func hashHookSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newHookSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "fnh_" + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func loadInboundHooks() []InboundHook {
+	var hooks []InboundHook
+	if err := utils.ReadJSON(inboundHooksFile(), &hooks); err != nil && !errors.Is(err, os.ErrNotExist) {
+		notifyLog.Warn("Failed to read inbound hooks", "error", err)
+	}
+	return hooks
+}
+
+func inboundHookSecret(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token := c.GetHeader("X-FlatNas-Token"); token != "" {
+		return token
+	}
+	return c.Query("token")
+}
+
+func validateInboundHook(h InboundHook) error {
+	switch h.Action {
+	case HookActionRssRefresh, HookActionNotify:
+	case HookActionScript:
+		if !hookScriptPattern.MatchString(h.Script) {
+			return errors.New("Invalid script name")
+		}
+	default:
+		return errors.New("Unknown action")
+	}
+	return nil
+}
+
+// TriggerInboundHook runs the action of the hook named in the URL
+func TriggerInboundHook(c *gin.Context) {
+	id := c.Param("id")
+	secret := inboundHookSecret(c)
+	var hook *InboundHook
+	for _, h := range loadInboundHooks() {
+		if h.ID == id && h.Enable {
+			h := h
+			hook = &h
+			break
+		}
+	}
+	// Same answer for unknown hooks and wrong secrets
+	if hook == nil || secret == "" || subtle.ConstantTimeCompare([]byte(hashHookSecret(secret)), []byte(hook.SecretHash)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.Set("auditUser", "hook:"+hook.Name)
+	c.Set("auditDetails", map[string]string{"action": hook.Action})
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, inboundHookMaxBody))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	switch hook.Action {
+	case HookActionRssRefresh:
+		urls := []string{hook.FeedUrl}
+		if hook.FeedUrl == "" {
+			urls = urls[:0]
+			for _, entry := range rssScheduler.snapshot() {
+				urls = append(urls, entry.Url)
+			}
+		}
+		go func() {
+			for _, u := range urls {
+				if backgroundCtx.Err() != nil {
+					return
+				}
+				refreshRss(socketServer, u)
+			}
+		}()
+	case HookActionNotify:
+		var n Notification
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &n); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+				return
+			}
+		}
+		if n.Title == "" {
+			n.Title = hook.Name
+		}
+		n.Html = ""
+		n.Source = "hook"
+		if len(hook.Channels) == 0 {
+			// sendNotification treats no channels as all channels
+			n.Time = time.Now().UnixMilli()
+			broadcastAll("notification", n)
+		} else {
+			go sendNotification(backgroundCtx, n, hook.Channels)
+		}
+	case HookActionScript:
+		go runHookScript(*hook, body)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unknown action"})
+		return
+	}
+
+	markInboundHookUsed(hook.ID)
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "action": hook.Action})
+}
+
+func markInboundHookUsed(id string) {
+	var hooks []InboundHook
+	_ = utils.UpdateJSON(inboundHooksFile(), &hooks, func() error {
+		for i := range hooks {
+			if hooks[i].ID == id {
+				hooks[i].LastUsed = time.Now().UnixMilli()
+			}
+		}
+		return nil
+	})
+}
+
+// runHookScript runs a script with the request body on stdin. Scripts must
+// be placed in DataDir/scripts by the admin; hooks only name them.
+func runHookScript(hook InboundHook, body []byte) {
+	done, ok := beginTask()
+	if !ok {
+		return
+	}
+	defer done()
+	path := filepath.Join(hookScriptsDir(), hook.Script)
+	ctx, cancel := context.WithTimeout(backgroundCtx, hookScriptTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = hookScriptsDir()
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), "FLATNAS_HOOK_ID="+hook.ID, "FLATNAS_HOOK_NAME="+hook.Name)
+	out, err := cmd.CombinedOutput()
+	if len(out) > hookScriptOutput {
+		out = out[len(out)-hookScriptOutput:]
+	}
+	if err != nil {
+		notifyLog.Warn("Hook script failed", "hook", hook.Name, "script", hook.Script, "error", err, "output", string(out))
+		return
+	}
+	notifyLog.Info("Hook script finished", "hook", hook.Name, "script", hook.Script, "output", string(out))
+}
+
+// GetInboundHooks lists the inbound hooks without their secrets
+func GetInboundHooks(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	hooks := loadInboundHooks()
+	for i := range hooks {
+		hooks[i].SecretHash = ""
+	}
+	if hooks == nil {
+		hooks = []InboundHook{}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": hooks})
+}
+
+// SaveInboundHook creates a hook, or updates the one with the given id. New
+// hooks get a secret, returned only in this response.
+func SaveInboundHook(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	var req InboundHook
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+	if err := validateInboundHook(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	secret := ""
+	var hooks []InboundHook
+	err := utils.UpdateJSON(inboundHooksFile(), &hooks, func() error {
+		if req.ID == "" {
+			var err error
+			if secret, err = newHookSecret(); err != nil {
+				return err
+			}
+			req.ID = randomHexID(6)
+			req.SecretHash = hashHookSecret(secret)
+			req.LastUsed = 0
+			hooks = append(hooks, req)
+			return nil
+		}
+		for i := range hooks {
+			if hooks[i].ID == req.ID {
+				req.SecretHash = hooks[i].SecretHash
+				req.LastUsed = hooks[i].LastUsed
+				hooks[i] = req
+				return nil
+			}
+		}
+		return os.ErrNotExist
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hook not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save hook"})
+		return
+	}
+	resp := gin.H{"success": true, "id": req.ID, "url": "/api/hooks/" + req.ID}
+	if secret != "" {
+		resp["secret"] = secret
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RotateInboundHookSecret replaces a hook's secret and returns the new one
+func RotateInboundHookSecret(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	id := c.Param("id")
+	secret, err := newHookSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create secret"})
+		return
+	}
+	var hooks []InboundHook
+	err = utils.UpdateJSON(inboundHooksFile(), &hooks, func() error {
+		for i := range hooks {
+			if hooks[i].ID == id {
+				hooks[i].SecretHash = hashHookSecret(secret)
+				return nil
+			}
+		}
+		return os.ErrNotExist
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hook not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save hook"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "secret": secret})
+}
+
+// DeleteInboundHook removes a hook; its URL stops working immediately
+func DeleteInboundHook(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	id := c.Param("id")
+	var hooks []InboundHook
+	found := false
+	err := utils.UpdateJSON(inboundHooksFile(), &hooks, func() error {
+		kept := hooks[:0]
+		for _, h := range hooks {
+			if h.ID == id {
+				found = true
+				continue
+			}
+			kept = append(kept, h)
+		}
+		hooks = kept
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete hook"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hook not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
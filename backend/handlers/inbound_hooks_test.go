@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestInboundHookAuth(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	hooks := []InboundHook{{ID: "ci", Name: "CI", Action: HookActionNotify, Enable: true, SecretHash: hashHookSecret("fnh_good")}}
+	if err := utils.WriteJSON(inboundHooksFile(), hooks); err != nil {
+		t.Fatalf("write hooks: %v", err)
+	}
+	r := gin.New()
+	r.POST("/api/hooks/:id", TriggerInboundHook)
+
+	trigger := func(path, auth string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"title":"Build passed"}`))
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := trigger("/api/hooks/ci", "fnh_bad"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret: got %d", code)
+	}
+	if code := trigger("/api/hooks/other", "fnh_good"); code != http.StatusUnauthorized {
+		t.Fatalf("unknown hook: got %d", code)
+	}
+	if code := trigger("/api/hooks/ci", "fnh_good"); code != http.StatusAccepted {
+		t.Fatalf("bearer secret: got %d", code)
+	}
+	if code := trigger("/api/hooks/ci?token=fnh_good", ""); code != http.StatusAccepted {
+		t.Fatalf("query secret: got %d", code)
+	}
+	if got := loadInboundHooks(); got[0].LastUsed == 0 {
+		t.Fatalf("lastUsed not recorded")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package handlers
+
+import "os"
+
+// fileInode is the inode number of a file, 0 where there is none
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
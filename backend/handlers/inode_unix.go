@@ -0,0 +1,16 @@
+//go:build unix
+
+package handlers
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode is the inode number of a file, 0 where there is none
+func fileInode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
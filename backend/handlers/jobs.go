@@ -0,0 +1,536 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/store"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Long file operations run as jobs of a queue instead of inside the request
+// that asks for them: copying a large folder, a move across file systems,
+// deleting many files. jobWorkers jobs run at a time, in the order they
+// were queued. A running job sends its progress (bytes and items done,
+// percent, throughput and ETA) as jobs:update to the room of its user, and
+// can be paused, resumed and cancelled with the jobs:* events. Jobs are
+// kept in the database, so the queue outlives a restart: a job that was
+// running starts again and skips the work it had finished.
+
+const (
+	jobWorkers       = 2
+	jobProgressEvery = time.Second
+	jobKeepFinished  = 200
+	jobsAllRoom      = "jobs" // Every job, for the admin
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobPaused    = "paused"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+var (
+	errJobNotFound = errors.New("Job not found")
+	errJobFinished = errors.New("Job has finished")
+	errJobRunning  = errors.New("Job has not finished")
+)
+
+// Job is a queued, running or finished operation
+type Job struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"` // copy, move, delete, extract, archive, virusscan, musicscan
+	User       string          `json:"user"`
+	Params     json.RawMessage `json:"params"`
+	Status     string          `json:"status"`
+	Attempt    int             `json:"attempt"` // Runs started, more than one after a restart
+	Bytes      int64           `json:"bytes"`
+	TotalBytes int64           `json:"totalBytes"`
+	Items      int64           `json:"items"`
+	TotalItems int64           `json:"totalItems"`
+	Percent    int             `json:"percent"`
+	Speed      int64           `json:"speed"` // Bytes per second
+	Eta        int64           `json:"eta"`   // Seconds, -1 when unknown
+	Current    string          `json:"current,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  int64           `json:"createdAt"`
+	StartedAt  int64           `json:"startedAt,omitempty"`
+	FinishedAt int64           `json:"finishedAt,omitempty"`
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed || j.Status == JobCancelled
+}
+
+// jobRunner does the work of a job kind. A job resumed after a restart runs
+// again from the start, so runners skip what is already done.
+type jobRunner func(ctx context.Context, r *jobRun) error
+
+var jobRunners = map[string]jobRunner{
+	"copy":    runTransferJob,
+	"move":    runTransferJob,
+	"delete":  runDeleteJob,
+	"extract": runExtractJob,
+	"archive": runArchiveJob,
+	// Virus scans of a folder, see antivirus.go
+	"virusscan": runScanJob,
+	// Music library scans, see music_library.go
+	"musicscan": runMusicScanJob,
+}
+
+// jobRun is a job being worked on
+type jobRun struct {
+	job    *Job
+	cancel context.CancelFunc
+	gate   chan struct{} // Set while paused, closed on resume
+	sent   time.Time     // Last jobs:update
+	mark   int64         // Bytes at sent, for the speed
+}
+
+var jobs = struct {
+	sync.Mutex
+	byID    map[string]*Job
+	running map[string]*jobRun
+}{byID: make(map[string]*Job), running: make(map[string]*jobRun)}
+
+func jobRoom(username string) string {
+	return "jobs:" + username
+}
+
+// saveJob writes a job to the database; jobs are only kept in memory
+// without one. jobs must be locked.
+func saveJob(j *Job) {
+	if config.Store == nil {
+		return
+	}
+	data, err := json.Marshal(j)
+	if err == nil {
+		err = config.Store.SaveJob(store.JobRecord{ID: j.ID, Data: data, Finished: j.finished()})
+	}
+	if err != nil {
+		filesLog.Warn("Failed to save job", "job", j.ID, "error", err)
+	}
+}
+
+// publishJob sends a job to its user and to the admin. jobs must be locked.
+func publishJob(j *Job) {
+	snapshot := *j
+	broadcastRoom(jobRoom(j.User), "jobs:update", snapshot)
+	broadcastRoom(jobsAllRoom, "jobs:update", snapshot)
+}
+
+// enqueueJob queues a job for user; params are what its runner reads
+func enqueueJob(kind, user string, params interface{}) (Job, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return Job{}, err
+	}
+	j := &Job{ID: randomHexID(8), Kind: kind, User: user, Params: raw, Status: JobQueued, Eta: -1, CreatedAt: time.Now().UnixMilli()}
+	jobs.Lock()
+	defer jobs.Unlock()
+	jobs.byID[j.ID] = j
+	saveJob(j)
+	publishJob(j)
+	dispatchJobs()
+	return *j, nil
+}
+
+// dispatchJobs starts queued jobs, oldest first, while workers are free.
+// jobs must be locked.
+func dispatchJobs() {
+	var queued []*Job
+	for _, j := range jobs.byID {
+		if j.Status == JobQueued {
+			queued = append(queued, j)
+		}
+	}
+	sort.Slice(queued, func(a, b int) bool { return queued[a].CreatedAt < queued[b].CreatedAt })
+	for _, j := range queued {
+		if len(jobs.running) >= jobWorkers {
+			return
+		}
+		runner := jobRunners[j.Kind]
+		if runner == nil {
+			j.Status, j.Error, j.FinishedAt = JobFailed, "Unknown job kind", time.Now().UnixMilli()
+			saveJob(j)
+			publishJob(j)
+			continue
+		}
+		done, ok := beginTask()
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithCancel(backgroundCtx)
+		r := &jobRun{job: j, cancel: cancel, sent: time.Now()}
+		jobs.running[j.ID] = r
+		j.Status, j.Attempt, j.StartedAt, j.Error = JobRunning, j.Attempt+1, time.Now().UnixMilli(), ""
+		// A run counts again what an interrupted one had done
+		j.Bytes, j.Items, j.Percent = 0, 0, 0
+		saveJob(j)
+		publishJob(j)
+		go func() {
+			defer done()
+			finishJob(ctx, r, runner(ctx, r))
+		}()
+	}
+}
+
+func finishJob(ctx context.Context, r *jobRun, err error) {
+	defer r.cancel()
+	jobs.Lock()
+	defer jobs.Unlock()
+	delete(jobs.running, r.job.ID)
+	j := r.job
+	j.Speed, j.Current = 0, ""
+	switch {
+	case backgroundCtx.Err() != nil:
+		// Shutting down: the job runs again at the next start
+		if j.Status != JobPaused {
+			j.Status = JobQueued
+		}
+		saveJob(j)
+		return
+	case ctx.Err() != nil:
+		j.Status = JobCancelled
+	case err != nil:
+		j.Status, j.Error = JobFailed, err.Error()
+		filesLog.Warn("Job failed", "job", j.ID, "kind", j.Kind, "error", err)
+	default:
+		j.Status, j.Percent, j.Eta = JobDone, 100, 0
+	}
+	j.FinishedAt = time.Now().UnixMilli()
+	saveJob(j)
+	publishJob(j)
+	dispatchJobs()
+}
+
+// setTotal sets the work a job has to do
+func (r *jobRun) setTotal(bytes, items int64) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	r.job.TotalBytes, r.job.TotalItems = bytes, items
+	r.update(true)
+}
+
+// add counts work done: n bytes and items items
+func (r *jobRun) add(n, items int64) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	r.job.Bytes += n
+	r.job.Items += items
+	r.update(false)
+}
+
+// at names the path being worked on
+func (r *jobRun) at(current string) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	r.job.Current = current
+}
+
+// update works out percent, speed and ETA, and sends them at most every
+// jobProgressEvery unless now is set. jobs must be locked.
+func (r *jobRun) update(now bool) {
+	j := r.job
+	switch {
+	case j.TotalBytes > 0:
+		j.Percent = int(min(j.Bytes*100/j.TotalBytes, 99))
+	case j.TotalItems > 0:
+		j.Percent = int(min(j.Items*100/j.TotalItems, 99))
+	}
+	elapsed := time.Since(r.sent)
+	if !now && elapsed < jobProgressEvery {
+		return
+	}
+	if elapsed > 0 && j.Status == JobRunning {
+		speed := int64(float64(j.Bytes-r.mark) / elapsed.Seconds())
+		if j.Speed > 0 {
+			// Smoothed, so the ETA does not jump about
+			speed = (j.Speed*3 + speed) / 4
+		}
+		j.Speed = speed
+	}
+	j.Eta = -1
+	if j.Speed > 0 && j.TotalBytes > 0 {
+		j.Eta = max(j.TotalBytes-j.Bytes, 0) / j.Speed
+	}
+	r.sent, r.mark = time.Now(), j.Bytes
+	publishJob(j)
+}
+
+// wait holds the job while it is paused
+func (r *jobRun) wait(ctx context.Context) error {
+	for {
+		jobs.Lock()
+		gate := r.gate
+		jobs.Unlock()
+		if gate == nil {
+			return ctx.Err()
+		}
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reader counts what is read from src as done, holds while the job is
+// paused and fails once it is cancelled
+func (r *jobRun) reader(ctx context.Context, src io.Reader) io.Reader {
+	return &jobReader{ctx: ctx, r: r, src: src}
+}
+
+type jobReader struct {
+	ctx context.Context
+	r   *jobRun
+	src io.Reader
+}
+
+func (jr *jobReader) Read(p []byte) (int, error) {
+	if err := jr.r.wait(jr.ctx); err != nil {
+		return 0, err
+	}
+	n, err := jr.src.Read(p)
+	jr.r.add(int64(n), 0)
+	return n, err
+}
+
+// params decodes the parameters of the job
+func (r *jobRun) params(v interface{}) error {
+	return json.Unmarshal(r.job.Params, v)
+}
+
+// findJob returns a job user may act on; the admin may act on all
+func findJob(id, user string, admin bool) (*Job, error) {
+	j := jobs.byID[id]
+	if j == nil || (!admin && j.User != user) {
+		return nil, errJobNotFound
+	}
+	return j, nil
+}
+
+func pauseJob(id, user string, admin bool) (Job, error) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	j, err := findJob(id, user, admin)
+	if err != nil {
+		return Job{}, err
+	}
+	switch j.Status {
+	case JobRunning:
+		if r := jobs.running[id]; r != nil && r.gate == nil {
+			r.gate = make(chan struct{})
+		}
+	case JobQueued:
+	default:
+		return *j, errJobFinished
+	}
+	j.Status, j.Speed, j.Eta = JobPaused, 0, -1
+	saveJob(j)
+	publishJob(j)
+	return *j, nil
+}
+
+func resumeJob(id, user string, admin bool) (Job, error) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	j, err := findJob(id, user, admin)
+	if err != nil {
+		return Job{}, err
+	}
+	if j.Status != JobPaused {
+		return *j, nil
+	}
+	if r := jobs.running[id]; r != nil {
+		close(r.gate)
+		r.gate = nil
+		r.sent, r.mark = time.Now(), j.Bytes
+		j.Status = JobRunning
+	} else {
+		// Paused before it started, or before a restart
+		j.Status = JobQueued
+	}
+	saveJob(j)
+	publishJob(j)
+	dispatchJobs()
+	return *j, nil
+}
+
+func cancelJob(id, user string, admin bool) (Job, error) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	j, err := findJob(id, user, admin)
+	if err != nil {
+		return Job{}, err
+	}
+	if j.finished() {
+		return *j, errJobFinished
+	}
+	if r := jobs.running[id]; r != nil {
+		// finishJob reports it once the runner stops
+		r.cancel()
+		return *j, nil
+	}
+	j.Status, j.FinishedAt = JobCancelled, time.Now().UnixMilli()
+	saveJob(j)
+	publishJob(j)
+	return *j, nil
+}
+
+// removeJobs forgets finished jobs: one, or all those of user when id is
+// empty
+func removeJobs(id, user string, admin bool) error {
+	jobs.Lock()
+	defer jobs.Unlock()
+	var remove []*Job
+	if id != "" {
+		j, err := findJob(id, user, admin)
+		if err != nil {
+			return err
+		}
+		if !j.finished() {
+			return errJobRunning
+		}
+		remove = append(remove, j)
+	} else {
+		for _, j := range jobs.byID {
+			if j.User == user && j.finished() {
+				remove = append(remove, j)
+			}
+		}
+	}
+	for _, j := range remove {
+		delete(jobs.byID, j.ID)
+		if config.Store != nil {
+			if err := config.Store.DeleteJob(j.ID); err != nil {
+				filesLog.Warn("Failed to delete job", "job", j.ID, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// listJobs returns the jobs of user, or every job for the admin, newest
+// first
+func listJobs(user string, admin bool) []Job {
+	jobs.Lock()
+	defer jobs.Unlock()
+	list := []Job{}
+	for _, j := range jobs.byID {
+		if admin || j.User == user {
+			list = append(list, *j)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].CreatedAt > list[b].CreatedAt })
+	return list
+}
+
+// loadJobs reads the saved jobs. Those that were running are queued again.
+func loadJobs() {
+	if config.Store == nil {
+		return
+	}
+	if err := config.Store.PruneJobs(jobKeepFinished); err != nil {
+		filesLog.Warn("Failed to prune jobs", "error", err)
+	}
+	records, err := config.Store.Jobs()
+	if err != nil {
+		filesLog.Warn("Failed to read jobs", "error", err)
+		return
+	}
+	jobs.Lock()
+	defer jobs.Unlock()
+	requeued := 0
+	for _, rec := range records {
+		j := &Job{}
+		if err := json.Unmarshal(rec.Data, j); err != nil {
+			filesLog.Warn("Skipping unreadable job", "job", rec.ID, "error", err)
+			continue
+		}
+		if j.Status == JobRunning {
+			j.Status, j.Speed, j.Eta, j.Current = JobQueued, 0, -1, ""
+			requeued++
+		}
+		jobs.byID[j.ID] = j
+	}
+	if requeued > 0 {
+		filesLog.Info("Resuming interrupted jobs", "count", requeued)
+	}
+}
+
+// StartJobQueue loads the saved jobs and runs those queued
+func StartJobQueue() {
+	loadJobs()
+	jobs.Lock()
+	dispatchJobs()
+	jobs.Unlock()
+}
+
+// JobPayload names a job for jobs:pause, jobs:resume, jobs:cancel and
+// jobs:remove; jobs:watch uses Enable
+type JobPayload struct {
+	Token  string `json:"token"`
+	ID     string `json:"id,omitempty"`
+	Enable *bool  `json:"enable,omitempty"`
+}
+
+// BindJobHandlers serves the jobs:* events. jobs:watch joins the room of
+// the user's jobs, or of all jobs for the admin, and answers jobs:list.
+func BindJobHandlers(server *socketio.Server) {
+	bindEvent(server, "jobs:watch", func(s socketio.Conn, msg JobPayload) {
+		username, ok := validateSocketToken(msg.Token)
+		if !ok {
+			s.Emit("jobs:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		admin := socketAdmin(msg.Token)
+		room := jobRoom(username)
+		if admin {
+			room = jobsAllRoom
+		}
+		if msg.Enable != nil && !*msg.Enable {
+			s.Leave(room)
+			return
+		}
+		s.Join(room)
+		s.Emit("jobs:list", listJobs(username, admin))
+	})
+	bindEvent(server, "jobs:list", func(s socketio.Conn, msg JobPayload) {
+		username, _ := validateSocketToken(msg.Token)
+		s.Emit("jobs:list", listJobs(username, socketAdmin(msg.Token)))
+	})
+	actions := map[string]func(id, user string, admin bool) (Job, error){
+		"jobs:pause":  pauseJob,
+		"jobs:resume": resumeJob,
+		"jobs:cancel": cancelJob,
+	}
+	for name, action := range actions {
+		bindEvent(server, name, func(s socketio.Conn, msg JobPayload) {
+			username, _ := validateSocketToken(msg.Token)
+			j, err := action(msg.ID, username, socketAdmin(msg.Token))
+			if err != nil {
+				s.Emit("jobs:error", map[string]interface{}{"error": err.Error(), "id": msg.ID})
+				return
+			}
+			s.Emit("jobs:update", j)
+		})
+	}
+	bindEvent(server, "jobs:remove", func(s socketio.Conn, msg JobPayload) {
+		username, _ := validateSocketToken(msg.Token)
+		if err := removeJobs(msg.ID, username, socketAdmin(msg.Token)); err != nil {
+			s.Emit("jobs:error", map[string]interface{}{"error": err.Error(), "id": msg.ID})
+			return
+		}
+		s.Emit("jobs:list", listJobs(username, socketAdmin(msg.Token)))
+	})
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/store"
+	"flatnasgo-backend/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useTestJobs starts the test with no jobs and a database of its own
+func useTestJobs(t *testing.T) {
+	db, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	prevStore := config.Store
+	config.Store = db
+	reset := func() {
+		jobs.Lock()
+		jobs.byID = make(map[string]*Job)
+		jobs.Unlock()
+	}
+	reset()
+	t.Cleanup(func() {
+		jobs.Lock()
+		for _, r := range jobs.running {
+			r.cancel()
+		}
+		jobs.Unlock()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			jobs.Lock()
+			n := len(jobs.running)
+			jobs.Unlock()
+			if n == 0 {
+				break
+			}
+		}
+		reset()
+		config.Store = prevStore
+		db.Close()
+	})
+}
+
+// waitJob polls until the job has status
+func waitJob(t *testing.T, id, status string) Job {
+	t.Helper()
+	var j Job
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		jobs.Lock()
+		if p := jobs.byID[id]; p != nil {
+			j = *p
+		}
+		jobs.Unlock()
+		if j.Status == status {
+			return j
+		}
+	}
+	t.Fatalf("job %s is %s (%s), want %s", id, j.Status, j.Error, status)
+	return j
+}
+
+func TestFileJobs(t *testing.T) {
+	useTestConfig(t)
+	useTestJobs(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "photos", "2024"), 0755)
+	os.MkdirAll(filepath.Join(root, "backup"), 0755)
+	os.WriteFile(filepath.Join(root, "photos", "a.jpg"), []byte(strings.Repeat("a", 1000)), 0644)
+	os.WriteFile(filepath.Join(root, "photos", "2024", "b.jpg"), []byte(strings.Repeat("b", 500)), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("username", "alice") })
+	r.POST("/files/copy", CopyFiles)
+	r.POST("/files/move", MoveFiles)
+	r.POST("/files/delete", DeleteFiles)
+	start := func(target, body string) Job {
+		t.Helper()
+		w := serve(r, "POST", target, body)
+		var resp struct {
+			Data Job `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 202 || resp.Data.ID == "" || resp.Data.User != "alice" {
+			t.Fatalf("%s: %d %s", target, w.Code, w.Body.String())
+		}
+		return resp.Data
+	}
+
+	j := waitJob(t, start("/files/copy", `{"share":"main","paths":["photos"],"to":"backup","background":true}`).ID, JobDone)
+	if j.Bytes != 1500 || j.TotalBytes != 1500 || j.Items != 4 || j.TotalItems != 4 || j.Percent != 100 {
+		t.Fatalf("unexpected progress %+v", j)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "backup", "photos", "2024", "b.jpg")); len(data) != 500 {
+		t.Fatalf("folder not copied")
+	}
+
+	// Conflicts are refused when the job is asked for, not when it runs
+	if w := serve(r, "POST", "/files/copy", `{"share":"main","paths":["photos"],"to":"backup","background":true}`); w.Code != 409 {
+		t.Fatalf("expected 409 for an existing target, got %d", w.Code)
+	}
+
+	j = waitJob(t, start("/files/move", `{"share":"main","paths":["backup/photos"],"to":"","toShare":"main","overwrite":true,"background":true}`).ID, JobDone)
+	if _, err := os.Stat(filepath.Join(root, "backup", "photos")); !os.IsNotExist(err) {
+		t.Fatalf("moved folder still there")
+	}
+	if j.Items != 4 {
+		t.Fatalf("a move counts what it moved, got %+v", j)
+	}
+
+	waitJob(t, start("/files/delete", `{"share":"main","paths":["photos/a.jpg","photos/2024"],"permanent":true,"background":true}`).ID, JobDone)
+	if items, _ := os.ReadDir(filepath.Join(root, "photos")); len(items) != 0 {
+		t.Fatalf("expected photos emptied, got %v", items)
+	}
+	if list := listJobs("alice", false); len(list) != 3 || list[0].Kind != "delete" {
+		t.Fatalf("expected three jobs newest first, got %+v", list)
+	}
+	if list := listJobs("bob", false); len(list) != 0 {
+		t.Fatalf("bob sees alice's jobs: %+v", list)
+	}
+}
+
+func TestJobPauseAndCancel(t *testing.T) {
+	useTestJobs(t)
+	pr, pw := io.Pipe()
+	jobRunners["test"] = func(ctx context.Context, r *jobRun) error {
+		r.setTotal(10, 0)
+		_, err := io.Copy(io.Discard, r.reader(ctx, pr))
+		return err
+	}
+	defer delete(jobRunners, "test")
+
+	j, _ := enqueueJob("test", "alice", nil)
+	waitJob(t, j.ID, JobRunning)
+	pw.Write([]byte("12345"))
+	if _, err := pauseJob(j.ID, "bob", false); err != errJobNotFound {
+		t.Fatalf("bob paused alice's job: %v", err)
+	}
+	if _, err := pauseJob(j.ID, "alice", false); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+	// Paused, the job reads nothing more
+	written := make(chan struct{})
+	go func() {
+		pw.Write([]byte("67890"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatalf("a paused job kept reading")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := waitJob(t, j.ID, JobPaused); got.Bytes != 5 || got.Percent != 50 {
+		t.Fatalf("unexpected progress while paused %+v", got)
+	}
+	if _, err := resumeJob(j.ID, "admin", true); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	<-written
+	pw.Close()
+	if got := waitJob(t, j.ID, JobDone); got.Bytes != 10 {
+		t.Fatalf("unexpected progress after resuming %+v", got)
+	}
+
+	pr, pw = io.Pipe()
+	j, _ = enqueueJob("test", "alice", nil)
+	waitJob(t, j.ID, JobRunning)
+	pauseJob(j.ID, "alice", false)
+	if _, err := cancelJob(j.ID, "alice", false); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	waitJob(t, j.ID, JobCancelled)
+	if _, err := cancelJob(j.ID, "alice", false); err != errJobFinished {
+		t.Fatalf("expected errJobFinished cancelling twice, got %v", err)
+	}
+	if err := removeJobs("", "alice", false); err != nil || len(listJobs("alice", false)) != 0 {
+		t.Fatalf("finished jobs not removed: %v", err)
+	}
+}
+
+func TestJobResumesAfterRestart(t *testing.T) {
+	useTestConfig(t)
+	useTestJobs(t)
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "src"), 0755)
+	os.MkdirAll(filepath.Join(root, "dst", "src"), 0755)
+	for _, name := range []string{"a", "b"} {
+		os.WriteFile(filepath.Join(root, "src", name), []byte(strings.Repeat(name, 100)), 0644)
+	}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+	// The first run copied a and part of b before the server stopped
+	copyPath(filepath.Join(root, "src", "a"), filepath.Join(root, "dst", "src", "a"))
+	os.WriteFile(filepath.Join(root, "dst", "src", "b"), []byte("bb"), 0644)
+	params, _ := json.Marshal(transferPlan{Share: "main", ToShare: "main", Items: []transferItem{{Path: "src", To: "dst/src"}}})
+	saved, _ := json.Marshal(Job{ID: "j1", Kind: "copy", User: "alice", Params: params, Status: JobRunning, Attempt: 1, Bytes: 102})
+	config.Store.SaveJob(store.JobRecord{ID: "j1", Data: saved})
+
+	StartJobQueue()
+	j := waitJob(t, "j1", JobDone)
+	if j.Attempt != 2 || j.Bytes != 200 {
+		t.Fatalf("unexpected job after resuming %+v", j)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "dst", "src", "b")); string(data) != strings.Repeat("b", 100) {
+		t.Fatalf("partial file not copied again: %q", data)
+	}
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const ldapTimeout = 10 * time.Second
+
+const (
+	ldapDefaultUserFilter     = "(&(objectClass=person)(uid={username}))"
+	ldapDefaultUsernameAttr   = "uid"
+	ldapDefaultGroupAttribute = "cn"
+)
+
+func loadLdapSettings() *models.LdapSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	l := sysConfig.Ldap
+	if l == nil || !l.Enable || l.Url == "" || l.BaseDn == "" {
+		return nil
+	}
+	return l
+}
+
+// decodeLdapSettings reads the "ldap" field of a system config update. An
+// empty bind password keeps the stored one.
+func decodeLdapSettings(raw interface{}, current *models.LdapSettings) (*models.LdapSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ldap settings")
+	}
+	settings := &models.LdapSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid ldap settings")
+	}
+	settings.Url = strings.TrimSpace(settings.Url)
+	if settings.BindPassword == "" && current != nil && current.BindDn == settings.BindDn {
+		settings.BindPassword = current.BindPassword
+	}
+	if settings.Enable {
+		u, err := url.Parse(settings.Url)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+			return nil, fmt.Errorf("Invalid ldap url")
+		}
+		if strings.TrimSpace(settings.BaseDn) == "" {
+			return nil, fmt.Errorf("ldap baseDn is required")
+		}
+		for _, f := range []string{settings.UserFilter, settings.GroupFilter} {
+			if f == "" {
+				continue
+			}
+			probe := strings.NewReplacer("{username}", "x", "{dn}", "x").Replace(f)
+			if _, err := encodeLdapFilter(probe); err != nil {
+				return nil, fmt.Errorf("Invalid ldap filter: %v", err)
+			}
+		}
+	}
+	return settings, nil
+}
+
+func dialLdapSettings(settings *models.LdapSettings) (*ldapConn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: settings.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	return dialLdap(settings.Url, settings.StartTls, tlsConfig, ldapTimeout)
+}
+
+// ldapLogin checks a password against the directory and returns the
+// FlatNas account to sign in as. It finds the user with the service
+// account, binds as the user to verify the password, then collects groups.
+func ldapLogin(settings *models.LdapSettings, username, password string) (string, error) {
+	if password == "" {
+		return "", errLdapInvalidCredentials
+	}
+	conn, err := dialLdapSettings(settings)
+	if err != nil {
+		return "", fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.bind(settings.BindDn, settings.BindPassword); err != nil {
+		return "", fmt.Errorf("service bind: %w", err)
+	}
+
+	usernameAttr := settings.UsernameAttribute
+	if usernameAttr == "" {
+		usernameAttr = ldapDefaultUsernameAttr
+	}
+	filter := settings.UserFilter
+	if filter == "" {
+		filter = ldapDefaultUserFilter
+	}
+	filter = strings.ReplaceAll(filter, "{username}", ldapEscapeFilter(username))
+	entries, err := conn.search(settings.BaseDn, filter, []string{usernameAttr, "memberOf"}, 2)
+	if err != nil {
+		return "", fmt.Errorf("user search: %w", err)
+	}
+	if len(entries) != 1 {
+		// Unknown and ambiguous names look the same to the caller
+		return "", errLdapInvalidCredentials
+	}
+	user := entries[0]
+
+	if err := conn.bind(user.dn, password); err != nil {
+		return "", err
+	}
+
+	groups, err := ldapUserGroups(conn, settings, user)
+	if err != nil {
+		return "", fmt.Errorf("group search: %w", err)
+	}
+	name := user.first(usernameAttr)
+	if name == "" {
+		name = username
+	}
+	return mapExternalUser(name, groups, settings.AdminGroups, settings.AllowedGroups)
+}
+
+// ldapUserGroups lists the user's group names, from a group search when a
+// group filter is set and from memberOf otherwise
+func ldapUserGroups(conn *ldapConn, settings *models.LdapSettings, user ldapEntry) ([]string, error) {
+	groupAttr := settings.GroupAttribute
+	if groupAttr == "" {
+		groupAttr = ldapDefaultGroupAttribute
+	}
+	if settings.GroupFilter == "" {
+		var groups []string
+		for _, dn := range user.all("memberOf") {
+			if name := ldapDNAttribute(dn, groupAttr); name != "" {
+				groups = append(groups, name)
+			}
+		}
+		return groups, nil
+	}
+
+	// Search as the service account; users often cannot read groups
+	if err := conn.bind(settings.BindDn, settings.BindPassword); err != nil {
+		return nil, err
+	}
+	base := settings.GroupBaseDn
+	if base == "" {
+		base = settings.BaseDn
+	}
+	filter := strings.NewReplacer(
+		"{dn}", ldapEscapeFilter(user.dn),
+		"{username}", ldapEscapeFilter(user.first(settings.UsernameAttribute)),
+	).Replace(settings.GroupFilter)
+	entries, err := conn.search(base, filter, []string{groupAttr}, 500)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if name := e.first(groupAttr); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+// ldapDNAttribute returns the value of attr in the first RDN of dn, e.g.
+// "admins" for cn=admins,ou=groups,dc=example,dc=org
+func ldapDNAttribute(dn, attr string) string {
+	first := dn
+	for i := 0; i < len(dn); i++ {
+		if dn[i] == '\\' {
+			i++
+			continue
+		}
+		if dn[i] == ',' {
+			first = dn[:i]
+			break
+		}
+	}
+	eq := strings.IndexByte(first, '=')
+	if eq < 0 || !strings.EqualFold(strings.TrimSpace(first[:eq]), attr) {
+		return ""
+	}
+	return strings.ReplaceAll(strings.TrimSpace(first[eq+1:]), "\\", "")
+}
+
+// tryLdapLogin is used by Login before local accounts. handled is false when
+// LDAP is off or does not know the user, so the local password is checked.
+func tryLdapLogin(username, password string) (account string, handled bool, err error) {
+	settings := loadLdapSettings()
+	if settings == nil {
+		return "", false, nil
+	}
+	account, err = ldapLogin(settings, username, password)
+	if err != nil {
+		if errors.Is(err, errLdapInvalidCredentials) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if err := ensureSsoAccount(account); err != nil {
+		return "", true, err
+	}
+	return account, true, nil
+}
@@ -0,0 +1,565 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A small LDAPv3 client covering what authentication needs: simple bind,
+// StartTLS and subtree search (RFC 4511, BER encoded).
+
+const (
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+var errLdapInvalidCredentials = errors.New("invalid credentials")
+
+// ldapError is a non-success LDAPResult
+type ldapError struct {
+	code    int
+	message string
+}
+
+func (e *ldapError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("ldap result %d: %s", e.code, e.message)
+	}
+	return fmt.Sprintf("ldap result %d", e.code)
+}
+
+func (e *ldapError) Is(target error) bool {
+	return target == errLdapInvalidCredentials && e.code == ldapResultInvalidCredentials
+}
+
+// BER encoding
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var buf []byte
+	for n > 0 {
+		buf = append([]byte{byte(n)}, buf...)
+		n >>= 8
+	}
+	return append([]byte{0x80 | byte(len(buf))}, buf...)
+}
+
+func berTLV(tag byte, content []byte) []byte {
+	out := append([]byte{tag}, berLength(len(content))...)
+	return append(out, content...)
+}
+
+func berSeq(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, p := range parts {
+		content = append(content, p...)
+	}
+	return berTLV(tag, content)
+}
+
+func berInt(tag byte, v int) []byte {
+	var buf []byte
+	for {
+		buf = append([]byte{byte(v)}, buf...)
+		v >>= 8
+		if v == 0 && buf[0]&0x80 == 0 {
+			break
+		}
+		if v == -1 && buf[0]&0x80 != 0 {
+			break
+		}
+	}
+	return berTLV(tag, buf)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berTLV(0x01, []byte{0xff})
+	}
+	return berTLV(0x01, []byte{0x00})
+}
+
+// berElem is a decoded TLV
+type berElem struct {
+	tag     byte
+	content []byte
+}
+
+func (e berElem) children() ([]berElem, error) {
+	var out []berElem
+	rest := e.content
+	for len(rest) > 0 {
+		el, n, err := parseBer(rest)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, el)
+		rest = rest[n:]
+	}
+	return out, nil
+}
+
+func (e berElem) int() int {
+	v := 0
+	for i, b := range e.content {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+func parseBer(data []byte) (berElem, int, error) {
+	if len(data) < 2 {
+		return berElem{}, 0, io.ErrUnexpectedEOF
+	}
+	tag := data[0]
+	length, hdr := int(data[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(data) < 2+n {
+			return berElem{}, 0, errors.New("ldap: bad length")
+		}
+		length = 0
+		for _, b := range data[2 : 2+n] {
+			length = length<<8 | int(b)
+		}
+		hdr += n
+	}
+	if length < 0 || len(data) < hdr+length {
+		return berElem{}, 0, io.ErrUnexpectedEOF
+	}
+	return berElem{tag: tag, content: data[hdr : hdr+length]}, hdr + length, nil
+}
+
+func readBer(r *bufio.Reader) (berElem, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElem{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berElem{}, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return berElem{}, errors.New("ldap: bad length")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berElem{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length < 0 || length > 16<<20 {
+		return berElem{}, errors.New("ldap: message too large")
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berElem{}, err
+	}
+	return berElem{tag: tag, content: content}, nil
+}
+
+// Filters (RFC 4515)
+
+// ldapEscapeFilter escapes a value for use inside a search filter
+func ldapEscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func encodeLdapFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	out, n, err := parseLdapFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(filter) {
+		return nil, fmt.Errorf("ldap filter: unexpected %q", filter[n:])
+	}
+	return out, nil
+}
+
+// parseLdapFilter encodes the parenthesized filter at the start of s and
+// returns how many bytes it used
+func parseLdapFilter(s string) ([]byte, int, error) {
+	if len(s) < 3 || s[0] != '(' {
+		return nil, 0, errors.New("ldap filter: expected '('")
+	}
+	switch s[1] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[1] == '|' {
+			tag = 0xa1
+		}
+		var parts [][]byte
+		pos := 2
+		for pos < len(s) && s[pos] == '(' {
+			part, n, err := parseLdapFilter(s[pos:])
+			if err != nil {
+				return nil, 0, err
+			}
+			parts = append(parts, part)
+			pos += n
+		}
+		if pos >= len(s) || s[pos] != ')' {
+			return nil, 0, errors.New("ldap filter: expected ')'")
+		}
+		return berSeq(tag, parts...), pos + 1, nil
+	case '!':
+		inner, n, err := parseLdapFilter(s[2:])
+		if err != nil {
+			return nil, 0, err
+		}
+		pos := 2 + n
+		if pos >= len(s) || s[pos] != ')' {
+			return nil, 0, errors.New("ldap filter: expected ')'")
+		}
+		return berSeq(0xa2, inner), pos + 1, nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, 0, errors.New("ldap filter: expected ')'")
+	}
+	item := s[1:end]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, 0, fmt.Errorf("ldap filter: bad item %q", item)
+	}
+	attr, value, tag := item[:eq], item[eq+1:], byte(0xa3)
+	switch attr[len(attr)-1] {
+	case '>':
+		attr, tag = attr[:len(attr)-1], 0xa5
+	case '<':
+		attr, tag = attr[:len(attr)-1], 0xa6
+	case '~':
+		attr, tag = attr[:len(attr)-1], 0xa8
+	}
+	if tag == 0xa3 && value == "*" {
+		return berString(0x87, attr), end + 1, nil
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		pieces := strings.Split(value, "*")
+		var subs [][]byte
+		for i, p := range pieces {
+			if p == "" {
+				continue
+			}
+			unescaped, err := ldapUnescapeFilter(p)
+			if err != nil {
+				return nil, 0, err
+			}
+			subTag := byte(0x81)
+			if i == 0 {
+				subTag = 0x80
+			} else if i == len(pieces)-1 {
+				subTag = 0x82
+			}
+			subs = append(subs, berString(subTag, unescaped))
+		}
+		return berSeq(0xa4, berString(0x04, attr), berSeq(0x30, subs...)), end + 1, nil
+	}
+	unescaped, err := ldapUnescapeFilter(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return berSeq(tag, berString(0x04, attr), berString(0x04, unescaped)), end + 1, nil
+}
+
+func ldapUnescapeFilter(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", errors.New("ldap filter: bad escape")
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("ldap filter: bad escape")
+		}
+		b.WriteByte(byte(v))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// Connection
+
+type ldapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID int
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func (e ldapEntry) first(attr string) string {
+	for k, v := range e.attrs {
+		if strings.EqualFold(k, attr) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func (e ldapEntry) all(attr string) []string {
+	for k, v := range e.attrs {
+		if strings.EqualFold(k, attr) {
+			return v
+		}
+	}
+	return nil
+}
+
+// dialLdap connects to an ldap:// or ldaps:// URL, upgrading plain
+// connections with StartTLS when asked
+func dialLdap(rawUrl string, startTLS bool, tlsConfig *tls.Config, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	port := u.Port()
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+		cfg := tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), cfg)
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(host, port))
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	c := &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+	if u.Scheme == "ldap" && startTLS {
+		if err := c.startTLS(host, tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		_ = c.conn.SetDeadline(time.Now().Add(timeout))
+	}
+	return c, nil
+}
+
+func (c *ldapConn) Close() error {
+	c.nextID++
+	_, _ = c.conn.Write(berSeq(0x30, berInt(0x02, c.nextID), berTLV(0x42, nil)))
+	return c.conn.Close()
+}
+
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.nextID++
+	_, err := c.conn.Write(berSeq(0x30, berInt(0x02, c.nextID), op))
+	return c.nextID, err
+}
+
+// receive reads the next message for id and returns its protocol op
+func (c *ldapConn) receive(id int) (berElem, error) {
+	for {
+		msg, err := readBer(c.reader)
+		if err != nil {
+			return berElem{}, err
+		}
+		parts, err := msg.children()
+		if err != nil || len(parts) < 2 {
+			return berElem{}, errors.New("ldap: malformed message")
+		}
+		if parts[0].int() != id {
+			continue
+		}
+		return parts[1], nil
+	}
+}
+
+func ldapResult(op berElem) error {
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	if code := parts[0].int(); code != ldapResultSuccess {
+		return &ldapError{code: code, message: string(parts[2].content)}
+	}
+	return nil
+}
+
+func (c *ldapConn) startTLS(host string, tlsConfig *tls.Config) error {
+	id, err := c.send(berSeq(0x77, berString(0x80, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != 0x78 {
+		return errors.New("ldap: unexpected StartTLS response")
+	}
+	if err := ldapResult(op); err != nil {
+		return fmt.Errorf("StartTLS refused: %w", err)
+	}
+	cfg := tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(c.conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// bind performs a simple bind. Empty passwords are refused here, since
+// servers treat them as an unauthenticated bind that always succeeds.
+func (c *ldapConn) bind(dn, password string) error {
+	if dn != "" && password == "" {
+		return errLdapInvalidCredentials
+	}
+	id, err := c.send(berSeq(0x60, berInt(0x02, 3), berString(0x04, dn), berString(0x80, password)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != 0x61 {
+		return errors.New("ldap: unexpected bind response")
+	}
+	return ldapResult(op)
+}
+
+// search runs a subtree search and collects the entries
+func (c *ldapConn) search(baseDN, filter string, attrs []string, sizeLimit int) ([]ldapEntry, error) {
+	encoded, err := encodeLdapFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrList := make([][]byte, 0, len(attrs))
+	for _, a := range attrs {
+		attrList = append(attrList, berString(0x04, a))
+	}
+	id, err := c.send(berSeq(0x63,
+		berString(0x04, baseDN),
+		berInt(0x0a, 2), // wholeSubtree
+		berInt(0x0a, 0), // neverDerefAliases
+		berInt(0x02, sizeLimit),
+		berInt(0x02, 10),
+		berBool(false),
+		encoded,
+		berSeq(0x30, attrList...),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case 0x64:
+			entry, err := parseLdapEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case 0x73:
+			// Referrals to other servers are not followed
+		case 0x65:
+			if err := ldapResult(op); err != nil {
+				return entries, err
+			}
+			return entries, nil
+		default:
+			return nil, errors.New("ldap: unexpected search response")
+		}
+	}
+}
+
+func parseLdapEntry(op berElem) (ldapEntry, error) {
+	parts, err := op.children()
+	if err != nil || len(parts) < 2 {
+		return ldapEntry{}, errors.New("ldap: malformed entry")
+	}
+	entry := ldapEntry{dn: string(parts[0].content), attrs: make(map[string][]string)}
+	attrs, err := parts[1].children()
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	for _, a := range attrs {
+		fields, err := a.children()
+		if err != nil || len(fields) < 2 {
+			continue
+		}
+		vals, err := fields[1].children()
+		if err != nil {
+			continue
+		}
+		name := string(fields[0].content)
+		for _, v := range vals {
+			entry.attrs[name] = append(entry.attrs[name], string(v.content))
+		}
+	}
+	return entry, nil
+}
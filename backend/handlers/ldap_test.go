@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flatnasgo-backend/models"
+	"net"
+	"testing"
+)
+
+// fakeLdapServer answers binds for a service account and one user, and
+// returns that user for any search whose filter mentions "alice".
+func fakeLdapServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	passwords := map[string]string{"cn=svc,dc=home": "svc-pw", "uid=alice,ou=people,dc=home": "alice-pw"}
+	result := func(tag byte, code int) []byte {
+		return berSeq(tag, berInt(0x0a, code), berString(0x04, ""), berString(0x04, ""))
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					msg, err := readBer(r)
+					if err != nil {
+						return
+					}
+					parts, _ := msg.children()
+					id := parts[0].int()
+					reply := func(op []byte) { conn.Write(berSeq(0x30, berInt(0x02, id), op)) }
+					switch parts[1].tag {
+					case 0x60:
+						fields, _ := parts[1].children()
+						dn, pw := string(fields[1].content), string(fields[2].content)
+						if want, ok := passwords[dn]; ok && want == pw {
+							reply(result(0x61, 0))
+						} else {
+							reply(result(0x61, 49))
+						}
+					case 0x63:
+						if bytes.Contains(parts[1].content, []byte("alice")) {
+							reply(berSeq(0x64, berString(0x04, "uid=alice,ou=people,dc=home"), berSeq(0x30,
+								berSeq(0x30, berString(0x04, "uid"), berSeq(0x31, berString(0x04, "alice"))),
+								berSeq(0x30, berString(0x04, "memberOf"), berSeq(0x31, berString(0x04, "cn=family,ou=groups,dc=home"))),
+							)))
+						}
+						reply(result(0x65, 0))
+					case 0x42:
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func TestLdapLogin(t *testing.T) {
+	settings := &models.LdapSettings{
+		Enable: true, Url: fakeLdapServer(t), BindDn: "cn=svc,dc=home", BindPassword: "svc-pw",
+		BaseDn: "dc=home", AllowedGroups: []string{"family"},
+	}
+	if account, err := ldapLogin(settings, "alice", "alice-pw"); err != nil || account != "alice" {
+		t.Fatalf("expected alice to log in, got %q %v", account, err)
+	}
+	if _, err := ldapLogin(settings, "alice", "wrong"); !errors.Is(err, errLdapInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+	if _, err := ldapLogin(settings, "bob", "x"); !errors.Is(err, errLdapInvalidCredentials) {
+		t.Fatalf("expected unknown user to be rejected, got %v", err)
+	}
+	settings.AdminGroups = []string{"family"}
+	if account, _ := ldapLogin(settings, "alice", "alice-pw"); account != "admin" {
+		t.Fatalf("expected admin group mapping, got %q", account)
+	}
+	if _, err := encodeLdapFilter("(&(objectClass=person)(|(uid=a*b)(mail=" + ldapEscapeFilter("x)(uid=*") + ")))"); err != nil {
+		t.Fatalf("filter: %v", err)
+	}
+}
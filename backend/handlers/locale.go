@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// UserLocale is the locale a user picked in the dashboard settings
+// (appConfig.locale), "" when they did not
+func UserLocale(username string) string {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	userFile := filepath.Join(config.UsersDir, username+".json")
+	if username == "admin" && sysConfig.AuthMode == "single" {
+		userFile = filepath.Join(config.DataDir, "data.json")
+	}
+	var data struct {
+		AppConfig models.AppConfig `json:"appConfig"`
+	}
+	if err := utils.ReadJSON(userFile, &data); err != nil {
+		return ""
+	}
+	return data.AppConfig.Locale
+}
+
+// notifyLocale is the locale of notifications, which have no request to
+// negotiate with
+func notifyLocale() string {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if l := i18n.Normalize(sysConfig.Locale); l != "" {
+		return l
+	}
+	return i18n.Default
+}
+
+// localizedConn translates the "error" of events sent to a socket client,
+// like middleware.Localize does for HTTP responses
+type localizedConn struct {
+	socketio.Conn
+	token string
+}
+
+func (s localizedConn) Emit(event string, v ...interface{}) {
+	if len(v) == 1 {
+		payload, ok := v[0].(map[string]interface{})
+		if h, isH := v[0].(gin.H); isH {
+			payload, ok = h, true
+		}
+		if ok {
+			if message, ok := payload["error"].(string); ok {
+				username, _ := validateSocketToken(s.token)
+				code, text := i18n.Translate(middleware.LocaleFor(username, s.RemoteHeader().Get("Accept-Language")), message)
+				localized := make(map[string]interface{}, len(payload)+1)
+				for k, val := range payload {
+					localized[k] = val
+				}
+				localized["error"] = text
+				if _, has := payload["code"]; !has && code != "" {
+					localized["code"] = code
+				}
+				v = []interface{}{localized}
+			}
+		}
+	}
+	s.Conn.Emit(event, v...)
+}
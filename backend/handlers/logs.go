@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"flatnasgo-backend/logging"
+	"flatnasgo-backend/middleware"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+var (
+	authLog      = logging.For("auth")
+	cacheLog     = logging.For("cache")
+	dataLog      = logging.For("data")
+	diskLog      = logging.For("disks")
+	dockerLog    = logging.For("docker")
+	filesLog     = logging.For("files")
+	nfsLog       = logging.For("nfs")
+	notifyLog    = logging.For("notify")
+	proxyLog     = logging.For("proxy")
+	rssLog       = logging.For("rss")
+	sambaLog     = logging.For("samba")
+	syncLog      = logging.For("sync")
+	transferLog  = logging.For("transfer")
+	wallpaperLog = logging.For("wallpaper")
+	weatherLog   = logging.For("weather")
+)
+
+// Sockets in this room receive every new log record as logs:entry
+const logsRoom = "logs"
+
+var logStreamOnce sync.Once
+
+func logsQueryFrom(m map[string]interface{}) logging.Query {
+	q := logging.Query{
+		Level:     stringField(m, "level"),
+		Component: stringField(m, "component"),
+		Search:    stringField(m, "search"),
+	}
+	if v, ok := m["after"].(float64); ok && v > 0 {
+		q.After = uint64(v)
+	}
+	if v, ok := m["limit"].(float64); ok {
+		q.Limit = int(v)
+	}
+	return q
+}
+
+// logsAdmin reports whether a socket payload comes from the admin with a
+// token allowed to manage the system
+func logsAdmin(msg interface{}) bool {
+	token, _ := parseTokenPayload(msg)
+	return socketAdmin(token)
+}
+
+// socketAdmin reports whether token belongs to an account whose role
+// manages the system, and is scoped for it
+func socketAdmin(token string) bool {
+	username, ok := validateSocketToken(token)
+	return ok && middleware.Can(middleware.RoleOf(username), middleware.PermSystem) &&
+		socketTokenHasScope(token, middleware.PermissionScope(middleware.PermSystem))
+}
+
+func BindLogHandlers(server *socketio.Server) {
+	bindEvent(server, "logs:query", func(s socketio.Conn, msg interface{}) {
+		if !logsAdmin(msg) {
+			s.Emit("logs:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		m, _ := msg.(map[string]interface{})
+		s.Emit("logs:data", logging.Recent(logsQueryFrom(m)))
+	})
+	bindEvent(server, "logs:stream", func(s socketio.Conn, msg interface{}) {
+		if !logsAdmin(msg) {
+			s.Emit("logs:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		m, _ := msg.(map[string]interface{})
+		if enable, ok := m["enable"].(bool); ok && !enable {
+			s.Leave(logsRoom)
+			s.Emit("logs:streaming", map[string]interface{}{"enabled": false})
+			return
+		}
+		logStreamOnce.Do(func() { go streamLogs(server) })
+		s.Join(logsRoom)
+		s.Emit("logs:streaming", map[string]interface{}{"enabled": true})
+	})
+}
+
+// streamLogs forwards new records to the logs room for the life of the
+// process
+func streamLogs(server *socketio.Server) {
+	records, _ := logging.Subscribe()
+	for rec := range records {
+		if roomLen(logsRoom) == 0 {
+			continue
+		}
+		broadcastRoom(logsRoom, "logs:entry", rec)
+	}
+}
+
+// GetLogs returns recent backend log records. Query parameters are level,
+// component, search, after (a sequence number) and limit.
+func GetLogs(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	q := logging.Query{
+		Level:     c.Query("level"),
+		Component: c.Query("component"),
+		Search:    c.Query("search"),
+	}
+	q.After, _ = strconv.ParseUint(c.Query("after"), 10, 64)
+	q.Limit, _ = strconv.Atoi(c.Query("limit"))
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": logging.Recent(q)})
+}
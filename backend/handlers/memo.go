@@ -5,9 +5,10 @@ import (
 	"time"
 
 	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
 
-	socketio "github.com/googollee/go-socket.io"
 	"github.com/golang-jwt/jwt/v5"
+	socketio "github.com/googollee/go-socket.io"
 )
 
 type MemoUpdatePayload struct {
@@ -23,7 +24,7 @@ type TodoUpdatePayload struct {
 }
 
 func BindMemoHandlers(server *socketio.Server) {
-	server.OnEvent("/", "memo:update", func(s socketio.Conn, msg interface{}) {
+	bindEvent(server, "memo:update", func(s socketio.Conn, msg interface{}) {
 		token, widgetId, content, ok := parseMemoPayload(msg)
 		if !ok {
 			return
@@ -31,7 +32,7 @@ func BindMemoHandlers(server *socketio.Server) {
 		if _, ok := validateSocketToken(token); !ok {
 			return
 		}
-		server.BroadcastToNamespace("/", "memo:updated", map[string]interface{}{
+		broadcastAll("memo:updated", map[string]interface{}{
 			"widgetId": widgetId,
 			"content":  content,
 		})
@@ -39,7 +40,7 @@ func BindMemoHandlers(server *socketio.Server) {
 }
 
 func BindTodoHandlers(server *socketio.Server) {
-	server.OnEvent("/", "todo:update", func(s socketio.Conn, msg interface{}) {
+	bindEvent(server, "todo:update", func(s socketio.Conn, msg interface{}) {
 		token, widgetId, content, ok := parseTodoPayload(msg)
 		if !ok {
 			return
@@ -47,7 +48,7 @@ func BindTodoHandlers(server *socketio.Server) {
 		if _, ok := validateSocketToken(token); !ok {
 			return
 		}
-		server.BroadcastToNamespace("/", "todo:updated", map[string]interface{}{
+		broadcastAll("todo:updated", map[string]interface{}{
 			"widgetId": widgetId,
 			"content":  content,
 		})
@@ -64,7 +65,7 @@ type NetworkHeartbeatPayload struct {
 }
 
 func BindNetworkHandlers(server *socketio.Server) {
-	server.OnEvent("/", "network:mode", func(s socketio.Conn, msg interface{}) {
+	bindEvent(server, "network:mode", func(s socketio.Conn, msg interface{}) {
 		token, mode, ok := parseNetworkModePayload(msg)
 		if !ok {
 			return
@@ -76,12 +77,12 @@ func BindNetworkHandlers(server *socketio.Server) {
 		if !isValidNetworkMode(mode) {
 			return
 		}
-		server.BroadcastToNamespace("/", "network:mode", map[string]interface{}{
+		broadcastAll("network:mode", map[string]interface{}{
 			"mode":     mode,
 			"username": username,
 		})
 	})
-	server.OnEvent("/", "network:heartbeat", func(s socketio.Conn, msg interface{}) {
+	bindEvent(server, "network:heartbeat", func(s socketio.Conn, msg interface{}) {
 		token, ok := parseTokenPayload(msg)
 		if !ok {
 			return
@@ -201,11 +202,29 @@ func isValidNetworkMode(mode string) bool {
 	}
 }
 
+// socketTokenHasScope reports whether an API token grants scope. Login
+// tokens carry no scopes and are not restricted.
+func socketTokenHasScope(tokenStr, scope string) bool {
+	if !middleware.IsApiToken(tokenStr) {
+		return true
+	}
+	token, ok := middleware.LookupApiToken(tokenStr)
+	return ok && middleware.TokenHasScope(token, scope)
+}
+
 func validateSocketToken(tokenStr string) (string, bool) {
 	if tokenStr == "" {
 		return "", false
 	}
 	tokenStr = strings.TrimPrefix(tokenStr, "Bearer ")
+	if middleware.IsApiToken(tokenStr) {
+		// Socket events act on the user's data, so tokens need write access
+		token, ok := middleware.LookupApiToken(tokenStr)
+		if !ok || !middleware.TokenHasScope(token, middleware.ScopeWrite) {
+			return "", false
+		}
+		return token.Username, true
+	}
 	tok, err := jwt.Parse(
 		tokenStr,
 		func(token *jwt.Token) (interface{}, error) {
@@ -0,0 +1,766 @@
+package handlers
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/store"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The music library indexes the built-in music folder and the share
+// folders chosen in the music settings into artists, albums and tracks.
+// A musicscan job reads the tags of the files that changed since the last
+// scan and drops the tracks whose file is gone; the library is scanned
+// again every ScanHours. Tracks are streamed as they are, or transcoded
+// to MP3 or Opus by ffmpeg for players on slow links. The built-in folder
+// is kept in the database under the share name "".
+
+const (
+	musicDefaultBitRate = 192
+	musicMaxTranscodes  = 4
+	musicScanCheck      = 10 * time.Minute
+	musicDefaultLimit   = 100
+	musicMaxLimit       = 500
+	musicUnknownArtist  = "Unknown artist"
+	musicUnknownAlbum   = "Unknown album"
+)
+
+var (
+	errMusicUnavailable = errors.New("The music library needs the database")
+	errInvalidMusicPage = errors.New("Invalid offset or limit")
+)
+
+// musicCoverFiles are the pictures of a folder that stand for its album
+var musicCoverFiles = []string{"cover.jpg", "folder.jpg", "front.jpg", "cover.png", "folder.png", "front.png"}
+
+// musicTranscodes holds a slot per running transcode
+var musicTranscodes = make(chan struct{}, musicMaxTranscodes)
+
+// musicSettings returns the settings with the defaults filled in
+func musicSettings() models.MusicSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	var s models.MusicSettings
+	if sysConfig.Music != nil {
+		s = *sysConfig.Music
+	}
+	if s.MaxBitRate == 0 {
+		s.MaxBitRate = musicDefaultBitRate
+	}
+	return s
+}
+
+func decodeMusicSettings(raw interface{}) (*models.MusicSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid music settings")
+	}
+	settings := &models.MusicSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid music settings")
+	}
+	for i, f := range settings.Folders {
+		p, err := cleanSharePath(f.Path)
+		if err != nil || strings.TrimSpace(f.Share) == "" {
+			return nil, fmt.Errorf("Invalid music folder")
+		}
+		settings.Folders[i] = models.MusicFolder{Share: strings.TrimSpace(f.Share), Path: p}
+	}
+	if settings.ScanHours < 0 {
+		return nil, fmt.Errorf("Invalid music scan interval")
+	}
+	if settings.MaxBitRate != 0 && (settings.MaxBitRate < 32 || settings.MaxBitRate > 320) {
+		return nil, fmt.Errorf("Transcoding bit rate must be between 32 and 320 kbps")
+	}
+	return settings, nil
+}
+
+// musicShare is the share a track is kept under, the built-in music
+// folder for ""
+func musicShare(name string) (models.FileShare, error) {
+	if name == "" {
+		return models.FileShare{Path: config.MusicDir, ReadOnly: true}, nil
+	}
+	return findFileShare(name)
+}
+
+// musicFolders are the folders of the library: the built-in one, then
+// the configured ones whose share exists
+func musicFolders(settings models.MusicSettings) []models.MusicFolder {
+	folders := []models.MusicFolder{{}}
+	for _, f := range settings.Folders {
+		if _, err := findFileShare(f.Share); err == nil && f.Share != "" {
+			folders = append(folders, f)
+		}
+	}
+	return folders
+}
+
+// musicKey groups names whatever their case
+func musicKey(names ...string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(strings.Join(names, "\x00"))))
+	return hex.EncodeToString(sum[:8])
+}
+
+// musicTrack makes the track of a file from its tags, naming it after the
+// file when they say nothing
+func musicTrack(share, rel string, info os.FileInfo, tags *musicTags, folderCover bool) store.MusicTrack {
+	t := store.MusicTrack{
+		Share: share, Path: rel, Size: info.Size(), ModTime: info.ModTime().UnixMilli(),
+		Title: tags.Title, Artist: tags.Artist, AlbumArtist: tags.AlbumArtist, Album: tags.Album, Genre: tags.Genre,
+		Track: tags.Track, Disc: tags.Disc, Year: tags.Year, Duration: tags.Duration, BitRate: tags.BitRate,
+		Format: musicFormat(rel), Cover: tags.Picture || folderCover,
+	}
+	if t.Title == "" {
+		t.Title = strings.TrimSuffix(path.Base(rel), path.Ext(rel))
+	}
+	if t.Artist == "" {
+		t.Artist = cmp.Or(t.AlbumArtist, musicUnknownArtist)
+	}
+	if t.AlbumArtist == "" {
+		t.AlbumArtist = t.Artist
+	}
+	if t.Album == "" {
+		t.Album = musicUnknownAlbum
+	}
+	t.ArtistKey = musicKey(t.AlbumArtist)
+	t.AlbumKey = musicKey(t.AlbumArtist, t.Album)
+	return t
+}
+
+// folderCover is the cover picture of a folder, "" when it has none
+func folderCover(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	names := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names[strings.ToLower(e.Name())] = e.Name()
+		}
+	}
+	for _, name := range musicCoverFiles {
+		if found := names[name]; found != "" {
+			return filepath.Join(dir, found)
+		}
+	}
+	return ""
+}
+
+// musicFile is a file found by a scan
+type musicFile struct {
+	share string
+	rel   string
+	full  string
+	info  os.FileInfo
+}
+
+// queueMusicScan queues a scan of the library, or returns the one already
+// waiting or running
+func queueMusicScan(user string) (Job, error) {
+	jobs.Lock()
+	for _, j := range jobs.byID {
+		if j.Kind == "musicscan" && !j.finished() {
+			jobs.Unlock()
+			return *j, nil
+		}
+	}
+	jobs.Unlock()
+	return enqueueJob("musicscan", user, struct{}{})
+}
+
+func runMusicScanJob(ctx context.Context, r *jobRun) error {
+	if config.Store == nil {
+		return errMusicUnavailable
+	}
+	folders := musicFolders(musicSettings())
+	var files []musicFile
+	seen := make(map[string]map[string]bool) // Share, then path
+	failed := make(map[string]bool)          // Shares to keep as they are
+	for _, folder := range folders {
+		share, err := musicShare(folder.Share)
+		if err != nil {
+			failed[folder.Share] = true
+			continue
+		}
+		root, err := resolveSharePath(share, folder.Path)
+		if err == nil {
+			_, err = os.Stat(root)
+		}
+		if err != nil {
+			// An unplugged disk must not empty the library
+			filesLog.Warn("Music folder unavailable", "share", folder.Share, "path", folder.Path, "error", err)
+			failed[folder.Share] = true
+			continue
+		}
+		if seen[folder.Share] == nil {
+			seen[folder.Share] = make(map[string]bool)
+		}
+		filepath.WalkDir(root, func(full string, d fs.DirEntry, err error) error {
+			if err != nil {
+				failed[folder.Share] = true
+				return nil
+			}
+			sub, _ := filepath.Rel(root, full)
+			rel := path.Join(folder.Path, filepath.ToSlash(sub))
+			if d.IsDir() {
+				if rel != "." && hiddenShareDir(strings.SplitN(rel, "/", 2)[0]) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || musicFormat(d.Name()) == "" || seen[folder.Share][rel] {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			seen[folder.Share][rel] = true
+			files = append(files, musicFile{share: folder.Share, rel: rel, full: full, info: info})
+			return nil
+		})
+	}
+	r.setTotal(0, int64(len(files)))
+
+	stamps := make(map[string]map[string]store.MusicStamp)
+	covers := make(map[string]bool)
+	var added, updated int
+	for _, f := range files {
+		if err := r.wait(ctx); err != nil {
+			return err
+		}
+		if stamps[f.share] == nil {
+			s, err := config.Store.MusicStamps(f.share)
+			if err != nil {
+				return err
+			}
+			stamps[f.share] = s
+		}
+		r.at(f.rel)
+		old, known := stamps[f.share][f.rel]
+		if known && old.Size == f.info.Size() && old.ModTime == f.info.ModTime().UnixMilli() {
+			r.add(0, 1)
+			continue
+		}
+		tags, err := readMusicTags(f.full, nil)
+		if err != nil {
+			filesLog.Warn("Failed to read music tags", "path", f.rel, "error", err)
+			tags = &musicTags{}
+		}
+		dir := filepath.Dir(f.full)
+		hasCover, ok := covers[dir]
+		if !ok {
+			hasCover = folderCover(dir) != ""
+			covers[dir] = hasCover
+		}
+		if err := config.Store.SaveMusicTrack(musicTrack(f.share, f.rel, f.info, tags, hasCover)); err != nil {
+			return err
+		}
+		if known {
+			updated++
+		} else {
+			added++
+		}
+		r.add(0, 1)
+	}
+
+	// Drop the tracks whose file is gone or no longer in a library folder
+	shares, err := config.Store.MusicShares()
+	if err != nil {
+		return err
+	}
+	var gone []int64
+	for _, share := range shares {
+		if failed[share] {
+			continue
+		}
+		s := stamps[share]
+		if s == nil {
+			if s, err = config.Store.MusicStamps(share); err != nil {
+				return err
+			}
+		}
+		for p, st := range s {
+			if !seen[share][p] {
+				gone = append(gone, st.ID)
+			}
+		}
+	}
+	if err := config.Store.DeleteMusicTracks(gone); err != nil {
+		return err
+	}
+	filesLog.Info("Music library scanned", "files", len(files), "added", added, "updated", updated, "removed", len(gone))
+	return nil
+}
+
+// StartMusicScanner scans the library every ScanHours
+func StartMusicScanner() {
+	go func() {
+		ticker := time.NewTicker(musicScanCheck)
+		defer ticker.Stop()
+		beat := registerWorker("music.scan", musicScanCheck)
+		var last time.Time
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			beat()
+			settings := musicSettings()
+			if settings.ScanHours == 0 || config.Store == nil || time.Since(last) < time.Duration(settings.ScanHours)*time.Hour {
+				continue
+			}
+			if _, err := queueMusicScan("admin"); err != nil {
+				filesLog.Warn("Failed to queue music scan", "error", err)
+				continue
+			}
+			last = time.Now()
+		}
+	}()
+}
+
+// MusicTrackItem is a track as the API sends it. Duration is in ms.
+type MusicTrackItem struct {
+	ID          int64  `json:"id"`
+	Title       string `json:"title"`
+	Artist      string `json:"artist"`
+	AlbumArtist string `json:"albumArtist"`
+	Album       string `json:"album"`
+	ArtistKey   string `json:"artistKey"`
+	AlbumKey    string `json:"albumKey"`
+	Genre       string `json:"genre,omitempty"`
+	Track       int    `json:"track,omitempty"`
+	Disc        int    `json:"disc,omitempty"`
+	Year        int    `json:"year,omitempty"`
+	Duration    int64  `json:"duration"`
+	BitRate     int    `json:"bitRate,omitempty"`
+	Format      string `json:"format"`
+	Size        int64  `json:"size"`
+	Stream      string `json:"stream"`
+	Cover       string `json:"cover,omitempty"`
+}
+
+// MusicArtistItem is an album artist as the API sends it
+type MusicArtistItem struct {
+	Key    string `json:"key"`
+	Name   string `json:"name"`
+	Albums int    `json:"albums"`
+	Tracks int    `json:"tracks"`
+	Cover  string `json:"cover,omitempty"`
+}
+
+// MusicAlbumItem is an album as the API sends it
+type MusicAlbumItem struct {
+	Key       string           `json:"key"`
+	Name      string           `json:"name"`
+	Artist    string           `json:"artist"`
+	ArtistKey string           `json:"artistKey"`
+	Year      int              `json:"year,omitempty"`
+	Genre     string           `json:"genre,omitempty"`
+	Tracks    int              `json:"tracks"`
+	Duration  int64            `json:"duration"`
+	Cover     string           `json:"cover,omitempty"`
+	Songs     []MusicTrackItem `json:"songs,omitempty"`
+}
+
+func musicCoverURL(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return "/api/music/library/cover/" + strconv.FormatInt(id, 10)
+}
+
+func newMusicTrackItem(t store.MusicTrack) MusicTrackItem {
+	item := MusicTrackItem{
+		ID: t.ID, Title: t.Title, Artist: t.Artist, AlbumArtist: t.AlbumArtist, Album: t.Album, ArtistKey: t.ArtistKey,
+		AlbumKey: t.AlbumKey, Genre: t.Genre, Track: t.Track, Disc: t.Disc, Year: t.Year, Duration: t.Duration,
+		BitRate: t.BitRate, Format: t.Format, Size: t.Size, Stream: "/api/music/library/stream/" + strconv.FormatInt(t.ID, 10),
+	}
+	if t.Cover {
+		item.Cover = musicCoverURL(t.ID)
+	}
+	return item
+}
+
+func newMusicTrackItems(tracks []store.MusicTrack) []MusicTrackItem {
+	items := make([]MusicTrackItem, 0, len(tracks))
+	for _, t := range tracks {
+		items = append(items, newMusicTrackItem(t))
+	}
+	return items
+}
+
+func newMusicArtistItems(artists []store.MusicArtist) []MusicArtistItem {
+	items := make([]MusicArtistItem, 0, len(artists))
+	for _, a := range artists {
+		items = append(items, MusicArtistItem{Key: a.Key, Name: a.Name, Albums: a.Albums, Tracks: a.Tracks, Cover: musicCoverURL(a.Cover)})
+	}
+	return items
+}
+
+func newMusicAlbumItem(a store.MusicAlbum) MusicAlbumItem {
+	return MusicAlbumItem{Key: a.Key, Name: a.Name, Artist: a.Artist, ArtistKey: a.ArtistKey, Year: a.Year, Genre: a.Genre,
+		Tracks: a.Tracks, Duration: a.Duration, Cover: musicCoverURL(a.Cover)}
+}
+
+func newMusicAlbumItems(albums []store.MusicAlbum) []MusicAlbumItem {
+	items := make([]MusicAlbumItem, 0, len(albums))
+	for _, a := range albums {
+		items = append(items, newMusicAlbumItem(a))
+	}
+	return items
+}
+
+// musicPage reads offset and limit (100)
+func musicPage(c *gin.Context) (int, int, error) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, lerr := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(musicDefaultLimit)))
+	if err != nil || lerr != nil || offset < 0 || limit < 1 || limit > musicMaxLimit {
+		return 0, 0, errInvalidMusicPage
+	}
+	return offset, limit, nil
+}
+
+// musicLibrary answers 503 and returns false without the database
+func musicLibrary(c *gin.Context) bool {
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errMusicUnavailable.Error()})
+		return false
+	}
+	return true
+}
+
+func musicError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errInvalidMusicPage):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found in the music library"})
+	default:
+		fileError(c, err, "")
+	}
+}
+
+// ScanMusicLibrary queues a scan of the library
+func ScanMusicLibrary(c *gin.Context) {
+	if !musicLibrary(c) {
+		return
+	}
+	job, err := queueMusicScan(c.GetString("username"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": job})
+}
+
+// GetMusicArtists lists the album artists, those whose name holds q when
+// it is given
+func GetMusicArtists(c *gin.Context) {
+	if !musicLibrary(c) {
+		return
+	}
+	offset, limit, err := musicPage(c)
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	artists, err := config.Store.MusicArtists(strings.TrimSpace(c.Query("q")), offset, limit)
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"artists": newMusicArtistItems(artists)}})
+}
+
+// GetMusicAlbums lists albums, of an artist, of a genre or whose name
+// holds q. sort is name, artist, year, newest, recent or random.
+func GetMusicAlbums(c *gin.Context) {
+	if !musicLibrary(c) {
+		return
+	}
+	offset, limit, err := musicPage(c)
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	q := store.MusicAlbumQuery{
+		ArtistKey: c.Query("artist"), Genre: c.Query("genre"), Search: strings.TrimSpace(c.Query("q")),
+		Sort: c.DefaultQuery("sort", "name"), Offset: offset, Limit: limit,
+	}
+	switch q.Sort {
+	case "name", "artist", "year", "newest", "recent", "random":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort"})
+		return
+	}
+	albums, err := config.Store.MusicAlbums(q)
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"albums": newMusicAlbumItems(albums)}})
+}
+
+// GetMusicAlbum returns an album with its tracks
+func GetMusicAlbum(c *gin.Context) {
+	if !musicLibrary(c) {
+		return
+	}
+	a, err := config.Store.MusicAlbum(c.Param("key"))
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	tracks, err := config.Store.AlbumTracks(a.Key)
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	item := newMusicAlbumItem(a)
+	item.Songs = newMusicTrackItems(tracks)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": item})
+}
+
+// GetMusicGenres lists the genres with their number of tracks and albums
+func GetMusicGenres(c *gin.Context) {
+	if !musicLibrary(c) {
+		return
+	}
+	genres, err := config.Store.MusicGenres()
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	out := make([]gin.H, 0, len(genres))
+	for _, g := range genres {
+		out = append(out, gin.H{"name": g.Name, "tracks": g.Tracks, "albums": g.Albums})
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"genres": out}})
+}
+
+// SearchMusic finds the artists, albums and tracks matching q
+func SearchMusic(c *gin.Context) {
+	if !musicLibrary(c) {
+		return
+	}
+	text := strings.TrimSpace(c.Query("q"))
+	if text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing search text"})
+		return
+	}
+	offset, limit, err := musicPage(c)
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	artists, err := config.Store.MusicArtists(text, offset, limit)
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	albums, err := config.Store.MusicAlbums(store.MusicAlbumQuery{Search: text, Offset: offset, Limit: limit})
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	tracks, err := config.Store.SearchMusicTracks(text, offset, limit)
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"artists": newMusicArtistItems(artists),
+		"albums":  newMusicAlbumItems(albums),
+		"tracks":  newMusicTrackItems(tracks),
+	}})
+}
+
+// musicTrackByID loads a track and the host path of its file
+func musicTrackByID(id string) (store.MusicTrack, string, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return store.MusicTrack{}, "", os.ErrNotExist
+	}
+	t, err := config.Store.MusicTrack(n)
+	if err != nil {
+		return t, "", err
+	}
+	share, err := musicShare(t.Share)
+	if err != nil {
+		return t, "", err
+	}
+	full, err := resolveSharePath(share, t.Path)
+	return t, full, err
+}
+
+// StreamMusicTrack plays a track. format=mp3 or opus transcodes it at
+// bitRate kbps, at most the configured one; a track already in that
+// format at no more than that rate is sent as it is.
+func StreamMusicTrack(c *gin.Context) {
+	if !musicLibrary(c) {
+		return
+	}
+	t, full, err := musicTrackByID(c.Param("id"))
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	bitRate := 0
+	if raw := c.Query("bitRate"); raw != "" {
+		if bitRate, err = strconv.Atoi(raw); err != nil || bitRate < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bit rate"})
+			return
+		}
+	}
+	serveMusicTrack(c, t, full, c.Query("format"), bitRate, 0)
+}
+
+// serveMusicTrack sends a track as it is or transcoded. format is mp3,
+// opus, raw, or "" for the file as it is unless its bit rate is over
+// bitRate. Transcodes run at bitRate, at most the configured rate; start
+// skips that many seconds of one.
+func serveMusicTrack(c *gin.Context, t store.MusicTrack, full, format string, bitRate, start int) {
+	rate := musicSettings().MaxBitRate
+	if bitRate > 0 {
+		rate = min(rate, bitRate)
+	}
+	switch format {
+	case "":
+		if bitRate > 0 && t.BitRate > bitRate {
+			format = "mp3"
+		}
+	case "raw":
+		format = ""
+	case "mp3", "opus":
+		if format == t.Format && t.BitRate <= rate && start == 0 {
+			format = ""
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format"})
+		return
+	}
+	if format == "" {
+		f, err := os.Open(full)
+		if err != nil {
+			musicError(c, err)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			musicError(c, err)
+			return
+		}
+		c.Header("Content-Type", cmp.Or(musicContentTypes[t.Format], fileMime(full)))
+		c.Header("Cache-Control", "private, max-age=3600")
+		http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
+		return
+	}
+	transcodeMusic(c, full, format, rate, start)
+}
+
+// transcodeMusic pipes the output of ffmpeg to the player. A transcode
+// cannot seek, so the response has no length and ignores Range.
+func transcodeMusic(c *gin.Context, full, format string, bitRate, start int) {
+	bin, err := ffmpegPath()
+	if err != nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Transcoding is not available"})
+		return
+	}
+	select {
+	case musicTranscodes <- struct{}{}:
+		defer func() { <-musicTranscodes }()
+	default:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errTooManyTranscodes.Error()})
+		return
+	}
+	args := []string{"-nostdin", "-loglevel", "error"}
+	if start > 0 {
+		args = append(args, "-ss", strconv.Itoa(start))
+	}
+	args = append(args, "-i", full, "-map", "0:a:0", "-vn", "-b:a", strconv.Itoa(bitRate)+"k")
+	contentType := "audio/mpeg"
+	if format == "opus" {
+		args = append(args, "-c:a", "libopus", "-f", "ogg", "pipe:1")
+		contentType = "audio/ogg"
+	} else {
+		args = append(args, "-c:a", "libmp3lame", "-f", "mp3", "pipe:1")
+	}
+	cmd := exec.CommandContext(c.Request.Context(), bin, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	cmd.Stdout = c.Writer
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", "no-store")
+	c.Header("Accept-Ranges", "none")
+	if err := cmd.Run(); err != nil && c.Request.Context().Err() == nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 500 {
+			msg = msg[len(msg)-500:]
+		}
+		filesLog.Warn("Music transcode failed", "file", full, "error", err, "output", msg)
+		if !c.Writer.Written() {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transcoding failed"})
+		}
+	}
+}
+
+// GetMusicCover sends the picture of a track: the one in the file, else
+// the cover of its folder
+func GetMusicCover(c *gin.Context) {
+	if !musicLibrary(c) {
+		return
+	}
+	_, full, err := musicTrackByID(c.Param("id"))
+	if err != nil {
+		musicError(c, err)
+		return
+	}
+	serveMusicCover(c, full)
+}
+
+func serveMusicCover(c *gin.Context, full string) {
+	var pic musicPicture
+	if _, err := readMusicTags(full, &pic); err != nil {
+		musicError(c, err)
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=86400")
+	if pic.Data != nil {
+		c.Data(http.StatusOK, pic.MimeType, pic.Data)
+		return
+	}
+	cover := folderCover(filepath.Dir(full))
+	if cover == "" {
+		c.Header("Cache-Control", "no-store")
+		musicError(c, os.ErrNotExist)
+		return
+	}
+	c.Header("Content-Type", fileMime(cover))
+	c.File(cover)
+}
@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gin-gonic/gin"
+)
+
+var testCover = []byte("\xff\xd8\xff\xe0cover")
+
+// id3Frame is an ID3v2.3 frame, or 2.4 with its syncsafe size
+func id3Frame(version byte, id string, data []byte) []byte {
+	head := make([]byte, 10)
+	copy(head, id)
+	n := len(data)
+	if version == 4 {
+		head[4], head[5], head[6], head[7] = byte(n>>21)&0x7f, byte(n>>14)&0x7f, byte(n>>7)&0x7f, byte(n)&0x7f
+	} else {
+		binary.BigEndian.PutUint32(head[4:], uint32(n))
+	}
+	return append(head, data...)
+}
+
+func utf16Text(s string) []byte {
+	out := []byte{1, 0xFF, 0xFE}
+	for _, u := range utf16.Encode([]rune(s)) {
+		out = binary.LittleEndian.AppendUint16(out, u)
+	}
+	return out
+}
+
+// testMp3 is an ID3v2 tag of frames, then MPEG1 layer III frames at 128
+// kbps and 44.1 kHz, the first a Xing header for xingFrames when not 0,
+// and audio bytes in all
+func testMp3(version byte, frames [][]byte, xingFrames uint32, audio int) []byte {
+	var tag []byte
+	for _, f := range frames {
+		tag = append(tag, f...)
+	}
+	n := len(tag)
+	out := append([]byte{'I', 'D', '3', version, 0, 0, byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}, tag...)
+	body := make([]byte, audio)
+	copy(body, []byte{0xFF, 0xFB, 0x90, 0x00})
+	if xingFrames > 0 {
+		copy(body[36:], "Xing")
+		binary.BigEndian.PutUint32(body[40:], 1)
+		binary.BigEndian.PutUint32(body[44:], xingFrames)
+	}
+	return append(out, body...)
+}
+
+func vorbisComment(fields ...string) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, 4)
+	out = append(out, "test"...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(fields)))
+	for _, f := range fields {
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(f)))
+		out = append(out, f...)
+	}
+	return out
+}
+
+func flacPicture(data []byte) []byte {
+	be := binary.BigEndian
+	out := be.AppendUint32(nil, 3)
+	out = be.AppendUint32(out, 10)
+	out = append(out, "image/jpeg"...)
+	out = be.AppendUint32(out, 0)
+	out = append(out, make([]byte, 16)...)
+	out = be.AppendUint32(out, uint32(len(data)))
+	return append(out, data...)
+}
+
+// testFlac is a FLAC file of seconds at 44.1 kHz with comments and a
+// picture
+func testFlac(seconds int, picture []byte, fields ...string) []byte {
+	info := make([]byte, 34)
+	rate, total := uint64(44100), uint64(44100*seconds)
+	// Sample rate (20 bits), channels - 1 (3), bits - 1 (5), samples (36)
+	binary.BigEndian.PutUint64(info[10:], rate<<44|1<<41|15<<36|total)
+	block := func(kind byte, last bool, data []byte) []byte {
+		if last {
+			kind |= 0x80
+		}
+		return append([]byte{kind, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+	out := append([]byte("fLaC"), block(0, false, info)...)
+	out = append(out, block(4, picture == nil, vorbisComment(fields...))...)
+	if picture != nil {
+		out = append(out, block(6, true, flacPicture(picture))...)
+	}
+	return append(out, make([]byte, 1000)...)
+}
+
+// testOpus is an Ogg Opus file of seconds with comments
+func testOpus(seconds int, fields ...string) []byte {
+	page := func(granule uint64, packet []byte) []byte {
+		head := append([]byte("OggS"), 0, 0)
+		head = binary.LittleEndian.AppendUint64(head, granule)
+		head = append(head, make([]byte, 12)...)
+		var segments []byte
+		for n := len(packet); ; n -= 255 {
+			if n < 255 {
+				segments = append(segments, byte(n))
+				break
+			}
+			segments = append(segments, 255)
+		}
+		head = append(head, byte(len(segments)))
+		return append(append(head, segments...), packet...)
+	}
+	id := append([]byte("OpusHead"), 1, 2, 0x38, 0x01) // Pre-skip 312
+	id = append(id, make([]byte, 7)...)
+	out := page(0, id)
+	out = append(out, page(0, append([]byte("OpusTags"), vorbisComment(fields...)...))...)
+	out = append(out, page(0, make([]byte, 500))...)
+	return append(out, page(uint64(48000*seconds+312), make([]byte, 100))...)
+}
+
+// writeTestMusic fills a folder with an album of two MP3s, a FLAC and an
+// Opus file of another artist, and a file that is not music
+func writeTestMusic(t *testing.T, root string) {
+	t.Helper()
+	os.MkdirAll(filepath.Join(root, "Band", "First"), 0755)
+	os.MkdirAll(filepath.Join(root, "Solo"), 0755)
+	os.WriteFile(filepath.Join(root, "Band", "First", "01.mp3"), testMp3(3, [][]byte{
+		id3Frame(3, "TIT2", []byte("\x00Opening")),
+		id3Frame(3, "TPE1", utf16Text("Bänd")),
+		id3Frame(3, "TALB", []byte("\x00First")),
+		id3Frame(3, "TRCK", []byte("\x001/2")),
+		id3Frame(3, "TYER", []byte("\x002001")),
+		id3Frame(3, "TCON", []byte("\x00(17)")),
+		id3Frame(3, "APIC", append([]byte("\x00image/jpeg\x00\x03cover\x00"), testCover...)),
+	}, 383, 4000), 0644)
+	os.WriteFile(filepath.Join(root, "Band", "First", "02.mp3"), testMp3(4, [][]byte{
+		id3Frame(4, "TIT2", []byte("\x03Closing")),
+		id3Frame(4, "TPE1", []byte("\x03BÄND")),
+		id3Frame(4, "TALB", []byte("\x03first")),
+		id3Frame(4, "TRCK", []byte("\x032")),
+		id3Frame(4, "TDRC", []byte("\x032001-05-01")),
+	}, 0, 16000), 0644)
+	os.WriteFile(filepath.Join(root, "Solo", "song.flac"), testFlac(10, nil,
+		"TITLE=Alone", "ARTIST=Singer", "ALBUM=Solo", "TRACKNUMBER=1", "DATE=2010", "GENRE=Jazz"), 0644)
+	os.WriteFile(filepath.Join(root, "Solo", "cover.JPG"), testCover, 0644)
+	os.WriteFile(filepath.Join(root, "Solo", "live.opus"), testOpus(5,
+		"TITLE=Live", "ARTIST=Singer", "ALBUM=Solo", "TRACKNUMBER=2"), 0644)
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("x"), 0644)
+}
+
+func TestMusicTags(t *testing.T) {
+	root := t.TempDir()
+	writeTestMusic(t, root)
+	read := func(name string, pic *musicPicture) *musicTags {
+		t.Helper()
+		tags, err := readMusicTags(filepath.Join(root, filepath.FromSlash(name)), pic)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return tags
+	}
+
+	var pic musicPicture
+	tags := read("Band/First/01.mp3", &pic)
+	if tags.Title != "Opening" || tags.Artist != "Bänd" || tags.Album != "First" || tags.Track != 1 || tags.Year != 2001 ||
+		tags.Genre != "Rock" || !tags.Picture || tags.Duration != 10004 {
+		t.Fatalf("unexpected ID3v2.3 tags %+v", tags)
+	}
+	if !bytes.Equal(pic.Data, testCover) || pic.MimeType != "image/jpeg" {
+		t.Fatalf("unexpected picture %q %q", pic.Data, pic.MimeType)
+	}
+	// Without a Xing header the duration follows from the size
+	if tags := read("Band/First/02.mp3", nil); tags.Title != "Closing" || tags.Year != 2001 || tags.Duration != 1000 || tags.BitRate != 128 {
+		t.Fatalf("unexpected ID3v2.4 tags %+v", tags)
+	}
+	if tags := read("Solo/song.flac", nil); tags.Title != "Alone" || tags.Genre != "Jazz" || tags.Duration != 10000 || tags.Year != 2010 {
+		t.Fatalf("unexpected FLAC tags %+v", tags)
+	}
+	if tags := read("Solo/live.opus", nil); tags.Title != "Live" || tags.Track != 2 || tags.Duration != 5000 {
+		t.Fatalf("unexpected Opus tags %+v", tags)
+	}
+
+	// ID3v1 fills in for a file without ID3v2, and Ogg pictures come
+	// through METADATA_BLOCK_PICTURE
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[3:], "Old song")
+	copy(v1[33:], "Old band")
+	copy(v1[93:], "1999")
+	v1[126], v1[127] = 7, 8
+	os.WriteFile(filepath.Join(root, "old.mp3"), append(testMp3(3, nil, 0, 1000)[10:], v1...), 0644)
+	if tags := read("old.mp3", nil); tags.Title != "Old song" || tags.Artist != "Old band" || tags.Year != 1999 || tags.Track != 7 || tags.Genre != "Jazz" {
+		t.Fatalf("unexpected ID3v1 tags %+v", tags)
+	}
+	os.WriteFile(filepath.Join(root, "art.ogg"), []byte{}, 0644)
+	opus := testOpus(1, "TITLE=Art", "METADATA_BLOCK_PICTURE="+base64.StdEncoding.EncodeToString(flacPicture(testCover)))
+	os.WriteFile(filepath.Join(root, "art.opus"), opus, 0644)
+	pic = musicPicture{}
+	if tags := read("art.opus", &pic); !tags.Picture || !bytes.Equal(pic.Data, testCover) {
+		t.Fatalf("unexpected Ogg picture %+v %q", tags, pic.Data)
+	}
+	if tags := read("art.ogg", nil); tags.Title != "" {
+		t.Fatalf("expected nothing from an empty file, got %+v", tags)
+	}
+}
+
+func useTestMusic(t *testing.T) string {
+	prev := config.MusicDir
+	config.MusicDir = t.TempDir()
+	t.Cleanup(func() { config.MusicDir = prev })
+	return config.MusicDir
+}
+
+func TestMusicLibrary(t *testing.T) {
+	useTestConfig(t)
+	useTestJobs(t)
+	gin.SetMode(gin.TestMode)
+
+	builtin := useTestMusic(t)
+	root := t.TempDir()
+	writeTestMusic(t, root)
+	os.WriteFile(filepath.Join(builtin, "loose.wav"), []byte("RIFF"), 0644)
+	sysConfig := models.SystemConfig{
+		Shares: []models.FileShare{{Name: "main", Path: root}},
+		Music:  &models.MusicSettings{Folders: []models.MusicFolder{{Share: "main"}}},
+	}
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("username", "admin") })
+	r.POST("/scan", ScanMusicLibrary)
+	r.GET("/artists", GetMusicArtists)
+	r.GET("/albums", GetMusicAlbums)
+	r.GET("/albums/:key", GetMusicAlbum)
+	r.GET("/genres", GetMusicGenres)
+	r.GET("/search", SearchMusic)
+	r.GET("/stream/:id", StreamMusicTrack)
+	r.GET("/cover/:id", GetMusicCover)
+	r.POST("/rename", RenameFile)
+	scan := func() {
+		t.Helper()
+		code, resp := serveJSON(r, "POST", "/scan", "")
+		if code != 202 {
+			t.Fatalf("scan: %d %v", code, resp)
+		}
+		waitJob(t, resp["data"].(map[string]interface{})["id"].(string), JobDone)
+	}
+	scan()
+
+	var artists struct {
+		Data struct{ Artists []MusicArtistItem }
+	}
+	json.Unmarshal(serve(r, "GET", "/artists", "").Body.Bytes(), &artists)
+	var names []string
+	for _, a := range artists.Data.Artists {
+		names = append(names, a.Name)
+	}
+	// Names group whatever their case
+	if strings.Join(names, ",") != "BÄND,Singer,Unknown artist" || artists.Data.Artists[0].Tracks != 2 {
+		t.Fatalf("unexpected artists %+v", artists.Data.Artists)
+	}
+
+	var albums struct {
+		Data struct{ Albums []MusicAlbumItem }
+	}
+	json.Unmarshal(serve(r, "GET", "/albums?sort=year&limit=2", "").Body.Bytes(), &albums)
+	if len(albums.Data.Albums) != 2 || albums.Data.Albums[0].Name != "Unknown album" || albums.Data.Albums[1].Name != "First" {
+		t.Fatalf("unexpected albums by year %+v", albums.Data.Albums)
+	}
+	first := albums.Data.Albums[1]
+	if first.Tracks != 2 || first.Duration != 11004 || first.Cover == "" {
+		t.Fatalf("unexpected album %+v", first)
+	}
+	var album struct{ Data MusicAlbumItem }
+	json.Unmarshal(serve(r, "GET", "/albums/"+first.Key, "").Body.Bytes(), &album)
+	if len(album.Data.Songs) != 2 || album.Data.Songs[0].Title != "Opening" || album.Data.Songs[1].Title != "Closing" {
+		t.Fatalf("unexpected album tracks %+v", album.Data.Songs)
+	}
+	opening := album.Data.Songs[0]
+	for target, status := range map[string]int{
+		"/albums?sort=loudest":          400,
+		"/albums?limit=0":               400,
+		"/albums/nope":                  404,
+		"/search":                       400,
+		"/stream/9999":                  404,
+		"/stream/x":                     404,
+		"/cover/9999":                   404,
+		opening.Stream + "?format=flac": 400,
+	} {
+		if w := serve(r, "GET", strings.TrimPrefix(target, "/api/music/library"), ""); w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", target, status, w.Code)
+		}
+	}
+
+	var found struct {
+		Data struct {
+			Artists []MusicArtistItem
+			Albums  []MusicAlbumItem
+			Tracks  []MusicTrackItem
+		}
+	}
+	json.Unmarshal(serve(r, "GET", "/search?q=solo", "").Body.Bytes(), &found)
+	if len(found.Data.Albums) != 1 || len(found.Data.Tracks) != 2 || len(found.Data.Artists) != 0 {
+		t.Fatalf("unexpected search %+v", found.Data)
+	}
+	if w := serve(r, "GET", "/genres", ""); !strings.Contains(w.Body.String(), `"name":"Jazz","tracks":1`) || !strings.Contains(w.Body.String(), `"name":"Rock"`) {
+		t.Fatalf("unexpected genres %s", w.Body.String())
+	}
+
+	// Tracks stream with ranges; covers come from the file or the folder
+	stream := strings.TrimPrefix(opening.Stream, "/api/music/library")
+	req := serve(r, "GET", stream, "")
+	if req.Code != 200 || req.Header().Get("Content-Type") != "audio/mpeg" || int64(req.Body.Len()) != opening.Size {
+		t.Fatalf("unexpected stream %d %v", req.Code, req.Header())
+	}
+	rangeReq := httptest.NewRequest("GET", stream, nil)
+	rangeReq.Header.Set("Range", "bytes=0-2")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, rangeReq)
+	if w.Code != 206 || w.Body.String() != "ID3" {
+		t.Fatalf("unexpected range %d %q", w.Code, w.Body.String())
+	}
+	if w := serve(r, "GET", strings.TrimPrefix(opening.Cover, "/api/music/library"), ""); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), testCover) {
+		t.Fatalf("unexpected embedded cover %d", w.Code)
+	}
+	json.Unmarshal(serve(r, "GET", "/search?q=alone", "").Body.Bytes(), &found)
+	if w := serve(r, "GET", strings.TrimPrefix(found.Data.Tracks[0].Cover, "/api/music/library"), ""); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), testCover) {
+		t.Fatalf("unexpected folder cover %d", w.Code)
+	}
+
+	// Transcodes go through ffmpeg, which says here what it was asked
+	fake := filepath.Join(t.TempDir(), "ffmpeg")
+	os.WriteFile(fake, []byte("#!/bin/sh\necho \"$@\"\n"), 0755)
+	t.Setenv("FFMPEG_PATH", fake)
+	w = serve(r, "GET", stream+"?format=opus&bitRate=96", "")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "audio/ogg" || !strings.Contains(w.Body.String(), "-b:a 96k -c:a libopus -f ogg pipe:1") {
+		t.Fatalf("unexpected transcode %d %q", w.Code, w.Body.String())
+	}
+	if w := serve(r, "GET", stream+"?format=opus&bitRate=320", ""); !strings.Contains(w.Body.String(), "-b:a 192k -c:a libopus") {
+		t.Fatalf("expected the configured bit rate to cap the transcode, got %q", w.Body.String())
+	}
+	// An MP3 at no more than the asked rate is sent as it is
+	if w := serve(r, "GET", stream+"?format=mp3&bitRate=128", ""); w.Header().Get("Content-Type") != "audio/mpeg" || !strings.HasPrefix(w.Body.String(), "ID3") {
+		t.Fatalf("expected the file as it is, got %q", w.Body.String())
+	}
+
+	// Rescans read changed files, follow renames and drop what is gone,
+	// and keep the tracks of a folder that cannot be reached
+	time.Sleep(10 * time.Millisecond)
+	os.WriteFile(filepath.Join(root, "Solo", "song.flac"), testFlac(10, nil, "TITLE=Together", "ARTIST=Singer", "ALBUM=Solo"), 0644)
+	os.Remove(filepath.Join(root, "Solo", "live.opus"))
+	serve(r, "POST", "/rename", `{"share":"main","paths":["Band"],"name":"Bänd"}`)
+	scan()
+	json.Unmarshal(serve(r, "GET", "/search?q=o", "").Body.Bytes(), &found)
+	var titles []string
+	for _, tr := range found.Data.Tracks {
+		titles = append(titles, tr.Title)
+	}
+	if strings.Join(titles, ",") != "Closing,loose,Opening,Together" {
+		t.Fatalf("unexpected tracks after rescan %v", titles)
+	}
+	if w := serve(r, "GET", stream, ""); w.Code != 200 {
+		t.Fatalf("expected the renamed track to keep its ID, got %d", w.Code)
+	}
+	sysConfig.Shares[0].Path = filepath.Join(root, "unplugged")
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+	scan()
+	if json.Unmarshal(serve(r, "GET", "/search?q=o", "").Body.Bytes(), &found); len(found.Data.Tracks) != 4 {
+		t.Fatalf("expected an unreachable folder to keep its tracks, got %+v", found.Data.Tracks)
+	}
+	sysConfig.Music = nil
+	sysConfig.Shares[0].Path = root
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+	scan()
+	if json.Unmarshal(serve(r, "GET", "/search?q=o", "").Body.Bytes(), &found); len(found.Data.Tracks) != 1 {
+		t.Fatalf("expected tracks of a removed folder to go, got %+v", found.Data.Tracks)
+	}
+}
+
+func TestMusicSettings(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		`{"folders":[{"share":"main","path":"/Music/"}],"scanHours":6}`: true,
+		`{"folders":[{"share":"","path":"Music"}]}`:                     false,
+		`{"folders":[{"share":"main","path":".trash"}]}`:                false,
+		`{"scanHours":-1}`:    false,
+		`{"maxBitRate":1000}`: false,
+	} {
+		var v interface{}
+		json.Unmarshal([]byte(raw), &v)
+		settings, err := decodeMusicSettings(v)
+		if (err == nil) != ok {
+			t.Fatalf("%s: unexpected error %v", raw, err)
+		}
+		if ok && settings.Folders[0].Path != "Music" {
+			t.Fatalf("expected the folder path cleaned, got %q", settings.Folders[0].Path)
+		}
+	}
+}
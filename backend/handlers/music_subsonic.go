@@ -0,0 +1,801 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/store"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The music library is served to Subsonic apps (DSub, Symfonium,
+// Feishin, ...) at /rest/<method> when the music settings enable it.
+// Apps log in with the account password, plain or hex encoded as
+// "enc:...", or an API token as the password or as the OpenSubsonic
+// apiKey. The salted token login cannot work, as the server only keeps
+// password hashes. Answers are XML, or JSON for f=json.
+//
+// IDs tell what they name: "ar-<key>" is an artist, "al-<key>" an album
+// and "tr-<id>" a track. The library has a single music folder.
+
+const (
+	subsonicVersion         = "1.16.1"
+	subsonicServerVersion   = "1"
+	subsonicXmlns           = "http://subsonic.org/restapi"
+	subsonicDefaultListSize = 10
+	subsonicDefaultFound    = 20
+	subsonicMaxListSize     = 500
+)
+
+// Subsonic error codes
+const (
+	subsonicErrGeneric       = 0
+	subsonicErrMissing       = 10
+	subsonicErrLogin         = 40
+	subsonicErrTokenLogin    = 41
+	subsonicErrConflictLogin = 43
+	subsonicErrApiKey        = 44
+	subsonicErrForbidden     = 50
+	subsonicErrNotFound      = 70
+)
+
+var subsonicAttempts = newAttemptLimiter(davMaxAuthFailures, davAuthFailureWait)
+
+type subsonicResponse struct {
+	XMLName       xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns         string   `xml:"xmlns,attr" json:"-"`
+	Status        string   `xml:"status,attr" json:"status"`
+	Version       string   `xml:"version,attr" json:"version"`
+	Type          string   `xml:"type,attr" json:"type"`
+	ServerVersion string   `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error        *subsonicError        `xml:"error" json:"error,omitempty"`
+	License      *subsonicLicense      `xml:"license" json:"license,omitempty"`
+	Extensions   []subsonicExtension   `xml:"openSubsonicExtensions" json:"openSubsonicExtensions,omitempty"`
+	MusicFolders *subsonicMusicFolders `xml:"musicFolders" json:"musicFolders,omitempty"`
+	Indexes      *subsonicIndexes      `xml:"indexes" json:"indexes,omitempty"`
+	Artists      *subsonicIndexes      `xml:"artists" json:"artists,omitempty"`
+	Artist       *subsonicArtist       `xml:"artist" json:"artist,omitempty"`
+	Album        *subsonicAlbum        `xml:"album" json:"album,omitempty"`
+	Song         *subsonicChild        `xml:"song" json:"song,omitempty"`
+	Directory    *subsonicDirectory    `xml:"directory" json:"directory,omitempty"`
+	AlbumList    *subsonicAlbumList    `xml:"albumList" json:"albumList,omitempty"`
+	AlbumList2   *subsonicAlbumList2   `xml:"albumList2" json:"albumList2,omitempty"`
+	RandomSongs  *subsonicSongs        `xml:"randomSongs" json:"randomSongs,omitempty"`
+	Genres       *subsonicGenres       `xml:"genres" json:"genres,omitempty"`
+	Search2      *subsonicSearch2      `xml:"searchResult2" json:"searchResult2,omitempty"`
+	Search3      *subsonicSearch3      `xml:"searchResult3" json:"searchResult3,omitempty"`
+	User         *subsonicUser         `xml:"user" json:"user,omitempty"`
+	Playlists    *subsonicPlaylists    `xml:"playlists" json:"playlists,omitempty"`
+	Starred      *subsonicSearch2      `xml:"starred" json:"starred,omitempty"`
+	Starred2     *subsonicSearch3      `xml:"starred2" json:"starred2,omitempty"`
+}
+
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type subsonicLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type subsonicExtension struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions" json:"versions"`
+}
+
+type subsonicMusicFolders struct {
+	Folders []subsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subsonicMusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type subsonicIndexes struct {
+	LastModified    int64           `xml:"lastModified,attr" json:"lastModified"`
+	IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []subsonicIndex `xml:"index" json:"index"`
+}
+
+type subsonicIndex struct {
+	Name   string           `xml:"name,attr" json:"name"`
+	Artist []subsonicArtist `xml:"artist" json:"artist"`
+}
+
+type subsonicArtist struct {
+	ID         string          `xml:"id,attr" json:"id"`
+	Name       string          `xml:"name,attr" json:"name"`
+	CoverArt   string          `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	AlbumCount int             `xml:"albumCount,attr" json:"albumCount"`
+	Album      []subsonicAlbum `xml:"album" json:"album,omitempty"`
+}
+
+type subsonicAlbum struct {
+	ID        string          `xml:"id,attr" json:"id"`
+	Name      string          `xml:"name,attr" json:"name"`
+	Artist    string          `xml:"artist,attr" json:"artist"`
+	ArtistID  string          `xml:"artistId,attr" json:"artistId"`
+	CoverArt  string          `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int             `xml:"songCount,attr" json:"songCount"`
+	Duration  int64           `xml:"duration,attr" json:"duration"` // Seconds
+	Year      int             `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre     string          `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Created   string          `xml:"created,attr" json:"created"`
+	Song      []subsonicChild `xml:"song" json:"song,omitempty"`
+}
+
+// subsonicChild is a track, or an album in the folder-based methods
+type subsonicChild struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track       int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	Year        int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size        int64  `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Duration    int64  `xml:"duration,attr,omitempty" json:"duration,omitempty"` // Seconds
+	BitRate     int    `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"`
+	Path        string `xml:"path,attr,omitempty" json:"path,omitempty"`
+	DiscNumber  int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	AlbumID     string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID    string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type        string `xml:"type,attr,omitempty" json:"type,omitempty"`
+	Created     string `xml:"created,attr,omitempty" json:"created,omitempty"`
+}
+
+type subsonicDirectory struct {
+	ID     string          `xml:"id,attr" json:"id"`
+	Parent string          `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Name   string          `xml:"name,attr" json:"name"`
+	Child  []subsonicChild `xml:"child" json:"child"`
+}
+
+type subsonicAlbumList struct {
+	Album []subsonicChild `xml:"album" json:"album"`
+}
+
+type subsonicAlbumList2 struct {
+	Album []subsonicAlbum `xml:"album" json:"album"`
+}
+
+type subsonicSongs struct {
+	Song []subsonicChild `xml:"song" json:"song"`
+}
+
+type subsonicGenres struct {
+	Genre []subsonicGenre `xml:"genre" json:"genre"`
+}
+
+type subsonicGenre struct {
+	SongCount  int    `xml:"songCount,attr" json:"songCount"`
+	AlbumCount int    `xml:"albumCount,attr" json:"albumCount"`
+	Value      string `xml:",chardata" json:"value"`
+}
+
+type subsonicSearch2 struct {
+	Artist []subsonicArtist `xml:"artist" json:"artist,omitempty"`
+	Album  []subsonicChild  `xml:"album" json:"album,omitempty"`
+	Song   []subsonicChild  `xml:"song" json:"song,omitempty"`
+}
+
+type subsonicSearch3 struct {
+	Artist []subsonicArtist `xml:"artist" json:"artist,omitempty"`
+	Album  []subsonicAlbum  `xml:"album" json:"album,omitempty"`
+	Song   []subsonicChild  `xml:"song" json:"song,omitempty"`
+}
+
+type subsonicUser struct {
+	Username          string `xml:"username,attr" json:"username"`
+	ScrobblingEnabled bool   `xml:"scrobblingEnabled,attr" json:"scrobblingEnabled"`
+	AdminRole         bool   `xml:"adminRole,attr" json:"adminRole"`
+	SettingsRole      bool   `xml:"settingsRole,attr" json:"settingsRole"`
+	DownloadRole      bool   `xml:"downloadRole,attr" json:"downloadRole"`
+	UploadRole        bool   `xml:"uploadRole,attr" json:"uploadRole"`
+	PlaylistRole      bool   `xml:"playlistRole,attr" json:"playlistRole"`
+	CoverArtRole      bool   `xml:"coverArtRole,attr" json:"coverArtRole"`
+	CommentRole       bool   `xml:"commentRole,attr" json:"commentRole"`
+	PodcastRole       bool   `xml:"podcastRole,attr" json:"podcastRole"`
+	StreamRole        bool   `xml:"streamRole,attr" json:"streamRole"`
+	JukeboxRole       bool   `xml:"jukeboxRole,attr" json:"jukeboxRole"`
+	ShareRole         bool   `xml:"shareRole,attr" json:"shareRole"`
+	Folder            []int  `xml:"folder" json:"folder"`
+}
+
+type subsonicPlaylists struct {
+	Playlist []subsonicMusicFolder `xml:"playlist" json:"playlist"`
+}
+
+// subsonicCall is a request of a Subsonic app
+type subsonicCall struct {
+	c    *gin.Context
+	user string
+}
+
+func (s *subsonicCall) param(name string) string {
+	return strings.TrimSpace(s.c.Request.FormValue(name))
+}
+
+// intParam reads a number, def when it is missing, -1 when it is invalid
+func (s *subsonicCall) intParam(name string, def int) int {
+	raw := s.param(name)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+func (s *subsonicCall) reply(resp *subsonicResponse) {
+	resp.Xmlns, resp.Version, resp.Type, resp.ServerVersion, resp.OpenSubsonic = subsonicXmlns, subsonicVersion, "flatnas", subsonicServerVersion, true
+	if resp.Status == "" {
+		resp.Status = "ok"
+	}
+	if strings.HasPrefix(s.param("f"), "json") {
+		s.c.JSON(http.StatusOK, gin.H{"subsonic-response": resp})
+		return
+	}
+	s.c.XML(http.StatusOK, resp)
+}
+
+func (s *subsonicCall) fail(code int, message string) {
+	s.reply(&subsonicResponse{Status: "failed", Error: &subsonicError{Code: code, Message: message}})
+}
+
+// failErr answers the error of a lookup
+func (s *subsonicCall) failErr(err error) {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		s.fail(subsonicErrNotFound, "Not found")
+	default:
+		filesLog.Warn("Subsonic request failed", "method", s.c.Param("method"), "error", err)
+		s.fail(subsonicErrGeneric, "Request failed")
+	}
+}
+
+// login finds the account of the request and answers the error when
+// there is none
+func (s *subsonicCall) login() bool {
+	ip := s.c.ClientIP()
+	if subsonicAttempts.locked(ip) {
+		s.fail(subsonicErrLogin, "Too many failed logins, try again later")
+		return false
+	}
+	user, password, apiKey := s.param("u"), s.param("p"), s.param("apiKey")
+	switch {
+	case apiKey != "":
+		if user != "" || password != "" {
+			s.fail(subsonicErrConflictLogin, "Send either an API key or a username")
+			return false
+		}
+		token, found := middleware.LookupApiToken(apiKey)
+		if !found {
+			subsonicAttempts.failed(ip)
+			s.fail(subsonicErrApiKey, "Invalid API key")
+			return false
+		}
+		user = token.Username
+	case user == "":
+		s.fail(subsonicErrMissing, "Required parameter is missing: u")
+		return false
+	case password == "" && s.param("t") != "":
+		s.fail(subsonicErrTokenLogin, "Token login is not supported, send the password or an API token")
+		return false
+	default:
+		if hexed, ok := strings.CutPrefix(password, "enc:"); ok {
+			decoded, err := hex.DecodeString(hexed)
+			if err != nil {
+				s.fail(subsonicErrLogin, "Wrong username or password")
+				return false
+			}
+			password = string(decoded)
+		}
+		if _, ok := passwordLogin(user, password); password == "" || !ok {
+			subsonicAttempts.failed(ip)
+			middleware.RecordAudit(models.AuditEntry{User: user, IP: ip, Action: "login.subsonic"})
+			s.fail(subsonicErrLogin, "Wrong username or password")
+			return false
+		}
+	}
+	if !middleware.Can(middleware.RoleOf(user), middleware.PermFiles) {
+		s.fail(subsonicErrForbidden, "The account may not use the files")
+		return false
+	}
+	s.user = user
+	s.c.Set("username", user)
+	return true
+}
+
+// subsonicMethods are the methods by name, without the ".view" some apps
+// add
+var subsonicMethods = map[string]func(s *subsonicCall){
+	"ping":              func(s *subsonicCall) { s.reply(&subsonicResponse{}) },
+	"getLicense":        func(s *subsonicCall) { s.reply(&subsonicResponse{License: &subsonicLicense{Valid: true}}) },
+	"getMusicFolders":   subsonicMusicFoldersList,
+	"getIndexes":        subsonicArtistIndex,
+	"getArtists":        subsonicArtistIndex,
+	"getArtist":         subsonicGetArtist,
+	"getAlbum":          subsonicGetAlbum,
+	"getSong":           subsonicGetSong,
+	"getMusicDirectory": subsonicGetDirectory,
+	"getAlbumList":      subsonicGetAlbumList,
+	"getAlbumList2":     subsonicGetAlbumList,
+	"getRandomSongs":    subsonicRandomSongs,
+	"getGenres":         subsonicGetGenres,
+	"search2":           subsonicSearch,
+	"search3":           subsonicSearch,
+	"stream":            subsonicStream,
+	"download":          subsonicStream,
+	"getCoverArt":       subsonicCoverArt,
+	"getUser":           subsonicGetUser,
+	// Play counts, playlists and stars are not kept
+	"scrobble": func(s *subsonicCall) { s.reply(&subsonicResponse{}) },
+	"getPlaylists": func(s *subsonicCall) {
+		s.reply(&subsonicResponse{Playlists: &subsonicPlaylists{Playlist: []subsonicMusicFolder{}}})
+	},
+	"getStarred":  func(s *subsonicCall) { s.reply(&subsonicResponse{Starred: &subsonicSearch2{}}) },
+	"getStarred2": func(s *subsonicCall) { s.reply(&subsonicResponse{Starred2: &subsonicSearch3{}}) },
+}
+
+// ServeSubsonic answers the Subsonic API under /rest
+func ServeSubsonic(c *gin.Context) {
+	if !musicSettings().Subsonic {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	s := &subsonicCall{c: c}
+	method := strings.TrimSuffix(c.Param("method"), ".view")
+	if method == "getOpenSubsonicExtensions" {
+		// Apps ask before they log in
+		s.reply(&subsonicResponse{Extensions: []subsonicExtension{
+			{Name: "apiKeyAuthentication", Versions: []int{1}},
+			{Name: "formPost", Versions: []int{1}},
+			{Name: "transcodeOffset", Versions: []int{1}},
+		}})
+		return
+	}
+	if !s.login() {
+		return
+	}
+	handler := subsonicMethods[method]
+	if handler == nil {
+		s.fail(subsonicErrNotFound, "Unknown method "+method)
+		return
+	}
+	if config.Store == nil {
+		s.fail(subsonicErrGeneric, errMusicUnavailable.Error())
+		return
+	}
+	handler(s)
+}
+
+func subsonicTime(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func subsonicCover(trackID int64) string {
+	if trackID == 0 {
+		return ""
+	}
+	return "tr-" + strconv.FormatInt(trackID, 10)
+}
+
+func newSubsonicSong(t store.MusicTrack) subsonicChild {
+	song := subsonicChild{
+		ID: "tr-" + strconv.FormatInt(t.ID, 10), Parent: "al-" + t.AlbumKey, Title: t.Title, Album: t.Album, Artist: t.Artist,
+		Track: t.Track, Year: t.Year, Genre: t.Genre, Size: t.Size, ContentType: musicContentTypes[t.Format],
+		Suffix: strings.TrimPrefix(path.Ext(t.Path), "."), Duration: t.Duration / 1000, BitRate: t.BitRate,
+		Path: path.Join(t.AlbumArtist, t.Album, path.Base(t.Path)), DiscNumber: t.Disc, AlbumID: "al-" + t.AlbumKey,
+		ArtistID: "ar-" + t.ArtistKey, Type: "music", Created: subsonicTime(t.Added),
+	}
+	if t.Cover {
+		song.CoverArt = subsonicCover(t.ID)
+	}
+	return song
+}
+
+func newSubsonicSongs(tracks []store.MusicTrack) []subsonicChild {
+	songs := make([]subsonicChild, 0, len(tracks))
+	for _, t := range tracks {
+		songs = append(songs, newSubsonicSong(t))
+	}
+	return songs
+}
+
+func newSubsonicAlbum(a store.MusicAlbum) subsonicAlbum {
+	return subsonicAlbum{ID: "al-" + a.Key, Name: a.Name, Artist: a.Artist, ArtistID: "ar-" + a.ArtistKey, CoverArt: subsonicCover(a.Cover),
+		SongCount: a.Tracks, Duration: a.Duration / 1000, Year: a.Year, Genre: a.Genre, Created: subsonicTime(a.Added)}
+}
+
+func newSubsonicAlbums(albums []store.MusicAlbum) []subsonicAlbum {
+	out := make([]subsonicAlbum, 0, len(albums))
+	for _, a := range albums {
+		out = append(out, newSubsonicAlbum(a))
+	}
+	return out
+}
+
+// newSubsonicAlbumDirs are albums as the folders of the folder-based
+// methods
+func newSubsonicAlbumDirs(albums []store.MusicAlbum) []subsonicChild {
+	out := make([]subsonicChild, 0, len(albums))
+	for _, a := range albums {
+		out = append(out, subsonicChild{ID: "al-" + a.Key, Parent: "ar-" + a.ArtistKey, IsDir: true, Title: a.Name, Album: a.Name,
+			Artist: a.Artist, Year: a.Year, Genre: a.Genre, CoverArt: subsonicCover(a.Cover), Created: subsonicTime(a.Added)})
+	}
+	return out
+}
+
+func newSubsonicArtists(artists []store.MusicArtist) []subsonicArtist {
+	out := make([]subsonicArtist, 0, len(artists))
+	for _, a := range artists {
+		out = append(out, subsonicArtist{ID: "ar-" + a.Key, Name: a.Name, CoverArt: subsonicCover(a.Cover), AlbumCount: a.Albums})
+	}
+	return out
+}
+
+func subsonicMusicFoldersList(s *subsonicCall) {
+	s.reply(&subsonicResponse{MusicFolders: &subsonicMusicFolders{Folders: []subsonicMusicFolder{{ID: 1, Name: "Music"}}}})
+}
+
+// subsonicArtistIndex lists the artists by their first letter, "#" for
+// the others
+func subsonicArtistIndex(s *subsonicCall) {
+	artists, err := config.Store.MusicArtists("", 0, 0)
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	index := &subsonicIndexes{LastModified: time.Now().UnixMilli(), Index: []subsonicIndex{}}
+	for _, a := range newSubsonicArtists(artists) {
+		letter := "#"
+		if r := []rune(strings.ToUpper(a.Name)); len(r) > 0 && unicode.IsLetter(r[0]) {
+			letter = string(r[0])
+		}
+		if n := len(index.Index); n == 0 || index.Index[n-1].Name != letter {
+			index.Index = append(index.Index, subsonicIndex{Name: letter})
+		}
+		last := &index.Index[len(index.Index)-1]
+		last.Artist = append(last.Artist, a)
+	}
+	if s.c.Param("method") == "getIndexes" || s.c.Param("method") == "getIndexes.view" {
+		s.reply(&subsonicResponse{Indexes: index})
+		return
+	}
+	s.reply(&subsonicResponse{Artists: index})
+}
+
+// subsonicID reads the key of the id parameter, which names a kind
+func (s *subsonicCall) subsonicID(kind string) (string, bool) {
+	id := s.param("id")
+	if id == "" {
+		s.fail(subsonicErrMissing, "Required parameter is missing: id")
+		return "", false
+	}
+	key, ok := strings.CutPrefix(id, kind+"-")
+	if !ok || key == "" {
+		s.fail(subsonicErrNotFound, "Not found")
+		return "", false
+	}
+	return key, true
+}
+
+func subsonicGetArtist(s *subsonicCall) {
+	key, ok := s.subsonicID("ar")
+	if !ok {
+		return
+	}
+	albums, err := config.Store.MusicAlbums(store.MusicAlbumQuery{ArtistKey: key, Sort: "year"})
+	if err == nil && len(albums) == 0 {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	artist := &subsonicArtist{ID: "ar-" + key, Name: albums[0].Artist, AlbumCount: len(albums), Album: newSubsonicAlbums(albums)}
+	for _, a := range albums {
+		if a.Cover != 0 {
+			artist.CoverArt = subsonicCover(a.Cover)
+			break
+		}
+	}
+	s.reply(&subsonicResponse{Artist: artist})
+}
+
+func subsonicGetAlbum(s *subsonicCall) {
+	key, ok := s.subsonicID("al")
+	if !ok {
+		return
+	}
+	a, err := config.Store.MusicAlbum(key)
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	tracks, err := config.Store.AlbumTracks(key)
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	album := newSubsonicAlbum(a)
+	album.Song = newSubsonicSongs(tracks)
+	s.reply(&subsonicResponse{Album: &album})
+}
+
+func subsonicGetSong(s *subsonicCall) {
+	key, ok := s.subsonicID("tr")
+	if !ok {
+		return
+	}
+	t, _, err := musicTrackByID(key)
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	song := newSubsonicSong(t)
+	s.reply(&subsonicResponse{Song: &song})
+}
+
+// subsonicGetDirectory lists the albums of an artist, or the tracks of an
+// album
+func subsonicGetDirectory(s *subsonicCall) {
+	id := s.param("id")
+	if key, ok := strings.CutPrefix(id, "ar-"); ok {
+		albums, err := config.Store.MusicAlbums(store.MusicAlbumQuery{ArtistKey: key, Sort: "year"})
+		if err == nil && len(albums) == 0 {
+			err = os.ErrNotExist
+		}
+		if err != nil {
+			s.failErr(err)
+			return
+		}
+		s.reply(&subsonicResponse{Directory: &subsonicDirectory{ID: id, Name: albums[0].Artist, Child: newSubsonicAlbumDirs(albums)}})
+		return
+	}
+	key, ok := s.subsonicID("al")
+	if !ok {
+		return
+	}
+	a, err := config.Store.MusicAlbum(key)
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	tracks, err := config.Store.AlbumTracks(key)
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	s.reply(&subsonicResponse{Directory: &subsonicDirectory{ID: id, Parent: "ar-" + a.ArtistKey, Name: a.Name, Child: newSubsonicSongs(tracks)}})
+}
+
+// subsonicGetAlbumList answers getAlbumList and getAlbumList2. Without
+// play counts and stars, frequent, recent, highest and starred lists are
+// empty.
+func subsonicGetAlbumList(s *subsonicCall) {
+	size, offset := s.intParam("size", subsonicDefaultListSize), s.intParam("offset", 0)
+	if size < 0 || offset < 0 {
+		s.fail(subsonicErrGeneric, "Invalid size or offset")
+		return
+	}
+	q := store.MusicAlbumQuery{Offset: offset, Limit: min(size, subsonicMaxListSize)}
+	listType := s.param("type")
+	switch listType {
+	case "random", "newest":
+		q.Sort = listType
+	case "alphabeticalByName":
+		q.Sort = "name"
+	case "alphabeticalByArtist":
+		q.Sort = "artist"
+	case "byYear":
+		q.Sort, q.FromYear, q.ToYear = "year", s.intParam("fromYear", -1), s.intParam("toYear", -1)
+		if q.FromYear < 0 || q.ToYear < 0 {
+			s.fail(subsonicErrMissing, "Required parameter is missing: fromYear, toYear")
+			return
+		}
+	case "byGenre":
+		if q.Sort, q.Genre = "name", s.param("genre"); q.Genre == "" {
+			s.fail(subsonicErrMissing, "Required parameter is missing: genre")
+			return
+		}
+	case "frequent", "recent", "highest", "starred":
+		q.Limit = 0
+	case "":
+		s.fail(subsonicErrMissing, "Required parameter is missing: type")
+		return
+	default:
+		s.fail(subsonicErrGeneric, "Invalid list type "+listType)
+		return
+	}
+	var albums []store.MusicAlbum
+	if q.Limit > 0 {
+		var err error
+		if albums, err = config.Store.MusicAlbums(q); err != nil {
+			s.failErr(err)
+			return
+		}
+	}
+	if strings.HasPrefix(s.c.Param("method"), "getAlbumList2") {
+		s.reply(&subsonicResponse{AlbumList2: &subsonicAlbumList2{Album: newSubsonicAlbums(albums)}})
+		return
+	}
+	s.reply(&subsonicResponse{AlbumList: &subsonicAlbumList{Album: newSubsonicAlbumDirs(albums)}})
+}
+
+func subsonicRandomSongs(s *subsonicCall) {
+	size := s.intParam("size", subsonicDefaultListSize)
+	if size < 0 {
+		s.fail(subsonicErrGeneric, "Invalid size")
+		return
+	}
+	tracks, err := config.Store.RandomMusicTracks(min(size, subsonicMaxListSize), s.param("genre"))
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	s.reply(&subsonicResponse{RandomSongs: &subsonicSongs{Song: newSubsonicSongs(tracks)}})
+}
+
+func subsonicGetGenres(s *subsonicCall) {
+	genres, err := config.Store.MusicGenres()
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	out := &subsonicGenres{Genre: []subsonicGenre{}}
+	for _, g := range genres {
+		out.Genre = append(out.Genre, subsonicGenre{SongCount: g.Tracks, AlbumCount: g.Albums, Value: g.Name})
+	}
+	s.reply(&subsonicResponse{Genres: out})
+}
+
+// subsonicSearch answers search2 and search3. An empty query matches
+// everything, which apps use to sync the whole library.
+func subsonicSearch(s *subsonicCall) {
+	text := strings.Trim(s.param("query"), `"`)
+	counts := make(map[string]int)
+	for _, name := range []string{"artistCount", "artistOffset", "albumCount", "albumOffset", "songCount", "songOffset"} {
+		def := 0
+		if strings.HasSuffix(name, "Count") {
+			def = subsonicDefaultFound
+		}
+		if counts[name] = s.intParam(name, def); counts[name] < 0 {
+			s.fail(subsonicErrGeneric, "Invalid "+name)
+			return
+		}
+		counts[name] = min(counts[name], subsonicMaxListSize)
+	}
+	var artists []store.MusicArtist
+	var albums []store.MusicAlbum
+	var tracks []store.MusicTrack
+	var err error
+	if counts["artistCount"] > 0 {
+		artists, err = config.Store.MusicArtists(text, counts["artistOffset"], counts["artistCount"])
+	}
+	if err == nil && counts["albumCount"] > 0 {
+		albums, err = config.Store.MusicAlbums(store.MusicAlbumQuery{Search: text, Offset: counts["albumOffset"], Limit: counts["albumCount"]})
+	}
+	if err == nil && counts["songCount"] > 0 {
+		tracks, err = config.Store.SearchMusicTracks(text, counts["songOffset"], counts["songCount"])
+	}
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	if strings.HasPrefix(s.c.Param("method"), "search2") {
+		s.reply(&subsonicResponse{Search2: &subsonicSearch2{Artist: newSubsonicArtists(artists), Album: newSubsonicAlbumDirs(albums), Song: newSubsonicSongs(tracks)}})
+		return
+	}
+	s.reply(&subsonicResponse{Search3: &subsonicSearch3{Artist: newSubsonicArtists(artists), Album: newSubsonicAlbums(albums), Song: newSubsonicSongs(tracks)}})
+}
+
+// subsonicStream answers stream and download. Formats other than mp3 and
+// opus get the file as it is, unless maxBitRate asks for less.
+func subsonicStream(s *subsonicCall) {
+	key, ok := s.subsonicID("tr")
+	if !ok {
+		return
+	}
+	t, full, err := musicTrackByID(key)
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	if strings.HasPrefix(s.c.Param("method"), "download") {
+		s.c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(path.Base(t.Path)))
+		serveMusicTrack(s.c, t, full, "raw", 0, 0)
+		return
+	}
+	format := s.param("format")
+	if format != "raw" && format != "mp3" && format != "opus" {
+		format = ""
+	}
+	bitRate, start := s.intParam("maxBitRate", 0), s.intParam("timeOffset", 0)
+	if bitRate < 0 || start < 0 {
+		s.fail(subsonicErrGeneric, "Invalid maxBitRate or timeOffset")
+		return
+	}
+	if start > 0 && format == "" {
+		// Only a transcode can start midway
+		format = "mp3"
+	}
+	serveMusicTrack(s.c, t, full, format, bitRate, start)
+}
+
+// subsonicCoverArt sends the picture of a track, or of the track standing
+// for an album or artist
+func subsonicCoverArt(s *subsonicCall) {
+	id := s.param("id")
+	var trackID int64
+	switch {
+	case strings.HasPrefix(id, "tr-"):
+		trackID, _ = strconv.ParseInt(strings.TrimPrefix(id, "tr-"), 10, 64)
+	case strings.HasPrefix(id, "al-"):
+		if a, err := config.Store.MusicAlbum(strings.TrimPrefix(id, "al-")); err == nil {
+			trackID = a.Cover
+		}
+	case strings.HasPrefix(id, "ar-"):
+		albums, err := config.Store.MusicAlbums(store.MusicAlbumQuery{ArtistKey: strings.TrimPrefix(id, "ar-")})
+		for _, a := range albums {
+			if err == nil && a.Cover != 0 {
+				trackID = a.Cover
+				break
+			}
+		}
+	case id == "":
+		s.fail(subsonicErrMissing, "Required parameter is missing: id")
+		return
+	}
+	_, full, err := musicTrackByID(strconv.FormatInt(trackID, 10))
+	if err != nil {
+		s.failErr(err)
+		return
+	}
+	serveMusicCover(s.c, full)
+}
+
+func subsonicGetUser(s *subsonicCall) {
+	name := s.param("username")
+	if name == "" {
+		name = s.user
+	}
+	role := middleware.RoleOf(s.user)
+	if name != s.user && !middleware.Can(role, middleware.PermSystem) {
+		s.fail(subsonicErrForbidden, "Only the admin sees other accounts")
+		return
+	}
+	if _, err := os.Stat(filepath.Join(config.UsersDir, name+".json")); name != s.user && err != nil {
+		s.failErr(os.ErrNotExist)
+		return
+	}
+	nameRole := middleware.RoleOf(name)
+	s.reply(&subsonicResponse{User: &subsonicUser{
+		Username: name, AdminRole: middleware.Can(nameRole, middleware.PermSystem), DownloadRole: true, StreamRole: true, Folder: []int{1},
+	}})
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSubsonic(t *testing.T) {
+	useTestConfig(t)
+	useTestJobs(t)
+	useTestMusic(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	writeTestMusic(t, root)
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("secret"), 4)
+	utils.WriteJSON(filepath.Join(config.UsersDir, "alice.json"), models.User{Username: "alice", Password: string(hashed)})
+	sysConfig := models.SystemConfig{
+		Shares: []models.FileShare{{Name: "main", Path: root}},
+		Music:  &models.MusicSettings{Folders: []models.MusicFolder{{Share: "main"}}},
+	}
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+	job, err := queueMusicScan("admin")
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	waitJob(t, job.ID, JobDone)
+
+	r := gin.New()
+	r.Any("/rest/:method", ServeSubsonic)
+	login := "u=alice&p=secret&v=1.16.1&c=test"
+	call := func(method, query string) map[string]interface{} {
+		t.Helper()
+		w := serve(r, "GET", "/rest/"+method+"?f=json&"+query, "")
+		var resp struct {
+			Body map[string]interface{} `json:"subsonic-response"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != 200 || err != nil {
+			t.Fatalf("%s: %d %s", method, w.Code, w.Body.String())
+		}
+		return resp.Body
+	}
+	errorCode := func(resp map[string]interface{}) int {
+		if resp["status"] != "failed" {
+			return -1
+		}
+		return int(resp["error"].(map[string]interface{})["code"].(float64))
+	}
+
+	if w := serve(r, "GET", "/rest/ping?"+login, ""); w.Code != 404 {
+		t.Fatalf("expected the API off by default, got %d", w.Code)
+	}
+	sysConfig.Music.Subsonic = true
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+
+	// Passwords come plain or hex encoded; salted tokens cannot be checked
+	for query, code := range map[string]int{
+		login: -1,
+		"u=alice&p=enc:" + hex.EncodeToString([]byte("secret")): -1,
+		"u=alice&p=wrong":      40,
+		"u=alice&t=abc&s=salt": 41,
+		"p=secret":             10,
+		"u=alice&apiKey=nope":  43,
+		"apiKey=nope":          44,
+	} {
+		if got := errorCode(call("ping", query)); got != code {
+			t.Fatalf("%s: expected %d, got %d", query, code, got)
+		}
+	}
+	if resp := call("getOpenSubsonicExtensions", ""); resp["openSubsonic"] != true || !strings.Contains(mustJSON(resp), "apiKeyAuthentication") {
+		t.Fatalf("unexpected extensions %v", resp)
+	}
+
+	// XML is the default
+	w := serve(r, "GET", "/rest/ping.view?"+login, "")
+	var pong struct {
+		XMLName xml.Name `xml:"subsonic-response"`
+		Status  string   `xml:"status,attr"`
+		Version string   `xml:"version,attr"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &pong); err != nil || pong.Status != "ok" || pong.Version != subsonicVersion {
+		t.Fatalf("unexpected XML %s", w.Body.String())
+	}
+
+	// Browse by artist, album and folder
+	artists := mustJSON(call("getArtists", login))
+	if !strings.Contains(artists, `"name":"B"`) || !strings.Contains(artists, `"name":"S"`) || !strings.Contains(artists, `"name":"Singer"`) {
+		t.Fatalf("unexpected artists %s", artists)
+	}
+	singer := "ar-" + musicKey("Singer")
+	artist := call("getArtist", login+"&id="+singer)["artist"].(map[string]interface{})
+	albums := artist["album"].([]interface{})
+	if len(albums) != 1 || artist["coverArt"] == nil {
+		t.Fatalf("unexpected artist %v", artist)
+	}
+	albumID := albums[0].(map[string]interface{})["id"].(string)
+	album := call("getAlbum", login+"&id="+albumID)["album"].(map[string]interface{})
+	songs := album["song"].([]interface{})
+	if album["name"] != "Solo" || len(songs) != 2 || album["duration"].(float64) != 15 {
+		t.Fatalf("unexpected album %v", album)
+	}
+	song := songs[0].(map[string]interface{})
+	if song["title"] != "Alone" || song["suffix"] != "flac" || song["contentType"] != "audio/flac" || song["albumId"] != albumID {
+		t.Fatalf("unexpected song %v", song)
+	}
+	songID := song["id"].(string)
+	if dir := mustJSON(call("getMusicDirectory", login+"&id="+singer)); !strings.Contains(dir, `"isDir":true`) || !strings.Contains(dir, albumID) {
+		t.Fatalf("unexpected artist folder %s", dir)
+	}
+	if dir := mustJSON(call("getMusicDirectory", login+"&id="+albumID)); !strings.Contains(dir, songID) {
+		t.Fatalf("unexpected album folder %s", dir)
+	}
+	for query, code := range map[string]int{
+		"getAlbum&id=al-nope":      70,
+		"getAlbum&id=" + songID:    70,
+		"getSong":                  10,
+		"getAlbumList":             10,
+		"getAlbumList&type=byYear": 10,
+		"nothing":                  70,
+	} {
+		method, params, _ := strings.Cut(query, "&")
+		if got := errorCode(call(method, login+"&"+params)); got != code {
+			t.Fatalf("%s: expected %d, got %d", query, code, got)
+		}
+	}
+
+	// Lists and searches
+	list := call("getAlbumList2", login+"&type=byYear&fromYear=2020&toYear=2000")["albumList2"].(map[string]interface{})["album"].([]interface{})
+	if len(list) != 2 || list[0].(map[string]interface{})["name"] != "Solo" {
+		t.Fatalf("unexpected albums by year %v", list)
+	}
+	if list := mustJSON(call("getAlbumList", login+"&type=alphabeticalByName&size=1")); !strings.Contains(list, `"title":"First"`) || strings.Contains(list, "Solo") {
+		t.Fatalf("unexpected album list %s", list)
+	}
+	if list := mustJSON(call("getAlbumList2", login+"&type=starred")); !strings.Contains(list, `"album":[]`) {
+		t.Fatalf("expected no starred albums, got %s", list)
+	}
+	found := call("search3", login+"&query=clos")["searchResult3"].(map[string]interface{})
+	if found["song"] == nil || len(found["song"].([]interface{})) != 1 || found["album"] != nil {
+		t.Fatalf("unexpected search %v", found)
+	}
+	everything := call("search3", login+`&query=""&songCount=100`)["searchResult3"].(map[string]interface{})
+	if len(everything["song"].([]interface{})) != 4 || len(everything["artist"].([]interface{})) != 2 {
+		t.Fatalf("expected an empty query to match everything, got %v", everything)
+	}
+	if genres := mustJSON(call("getGenres", login)); !strings.Contains(genres, `"value":"Jazz"`) {
+		t.Fatalf("unexpected genres %s", genres)
+	}
+	if random := call("getRandomSongs", login+"&size=2")["randomSongs"].(map[string]interface{}); len(random["song"].([]interface{})) != 2 {
+		t.Fatalf("unexpected random songs %v", random)
+	}
+
+	// Streams, downloads and covers
+	flac, _ := os.ReadFile(filepath.Join(root, "Solo", "song.flac"))
+	if w := serve(r, "GET", "/rest/stream?"+login+"&id="+songID, ""); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), flac) {
+		t.Fatalf("unexpected stream %d", w.Code)
+	}
+	if w := serve(r, "GET", "/rest/download?"+login+"&id="+songID, ""); !strings.Contains(w.Header().Get("Content-Disposition"), "song.flac") {
+		t.Fatalf("unexpected download %v", w.Header())
+	}
+	fake := filepath.Join(t.TempDir(), "ffmpeg")
+	os.WriteFile(fake, []byte("#!/bin/sh\necho \"$@\"\n"), 0755)
+	t.Setenv("FFMPEG_PATH", fake)
+	if w := serve(r, "GET", "/rest/stream?"+login+"&id="+songID+"&maxBitRate=1&timeOffset=30", ""); !strings.Contains(w.Body.String(), "-ss 30 -i") || !strings.Contains(w.Body.String(), "-b:a 1k -c:a libmp3lame") {
+		t.Fatalf("unexpected transcode %q", w.Body.String())
+	}
+	if w := serve(r, "GET", "/rest/getCoverArt?"+login+"&id="+albumID, ""); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), testCover) {
+		t.Fatalf("unexpected album cover %d", w.Code)
+	}
+
+	// API tokens log in as passwords or keys; the admin alone sees others
+	_, token, err := middleware.CreateApiToken("alice", "music", []string{middleware.ScopeRead}, 0)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	if got := errorCode(call("ping", "apiKey="+token)); got != -1 {
+		t.Fatalf("expected the API key to log in, got %d", got)
+	}
+	if got := errorCode(call("ping", "u=alice&p="+token)); got != -1 {
+		t.Fatalf("expected the token as password to log in, got %d", got)
+	}
+	if user := mustJSON(call("getUser", login)); !strings.Contains(user, `"username":"alice"`) || !strings.Contains(user, `"adminRole":false`) {
+		t.Fatalf("unexpected user %s", user)
+	}
+	if got := errorCode(call("getUser", login+"&username=admin")); got != 50 {
+		t.Fatalf("expected 50 for another account, got %d", got)
+	}
+
+	// Until the account sets up the two-factor the admin requires, only
+	// its tokens log in
+	require := gin.New()
+	require.POST("/admin/users/:usr/2fa", func(c *gin.Context) { c.Set("username", "admin") }, SetUserTwoFactor)
+	if w := serve(require, "POST", "/admin/users/alice/2fa", `{"action":"require"}`); w.Code != 200 {
+		t.Fatalf("require failed: %d %s", w.Code, w.Body.String())
+	}
+	if got := errorCode(call("ping", login)); got != 40 {
+		t.Fatalf("expected the password refused until enrollment, got %d", got)
+	}
+	if got := errorCode(call("ping", "apiKey="+token)); got != -1 {
+		t.Fatalf("expected the API key to still log in, got %d", got)
+	}
+}
+
+func mustJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,693 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The music library reads the tags of MP3 (ID3v2.2 to 2.4, ID3v1), FLAC
+// and Ogg Vorbis or Opus files (Vorbis comments) itself, along with their
+// duration and bit rate. WAV files get a duration; M4A and WAV tracks are
+// named after their file.
+
+const (
+	maxMusicTagSize = 16 << 20 // Tags may hold large pictures
+	mpegSyncWindow  = 64 << 10
+	oggTailSize     = 64 << 10
+)
+
+var errNoMusicTags = errors.New("no music tags")
+
+// musicFormats are the extensions of the library, by format
+var musicFormats = map[string]string{
+	".mp3": "mp3", ".flac": "flac", ".ogg": "ogg", ".oga": "ogg", ".opus": "opus", ".m4a": "m4a", ".wav": "wav",
+}
+
+// musicContentTypes are the content types of the formats
+var musicContentTypes = map[string]string{
+	"mp3": "audio/mpeg", "flac": "audio/flac", "ogg": "audio/ogg", "opus": "audio/ogg", "m4a": "audio/mp4", "wav": "audio/wav",
+}
+
+// musicFormat is the format of a file, "" when it is not music
+func musicFormat(name string) string {
+	return musicFormats[strings.ToLower(filepath.Ext(name))]
+}
+
+// musicTags is what a file says about its track
+type musicTags struct {
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Genre       string
+	Track       int
+	Disc        int
+	Year        int
+	Duration    int64 // ms
+	BitRate     int   // kbps
+	Picture     bool
+}
+
+// musicPicture is a picture held by a file, the front cover when it has
+// one
+type musicPicture struct {
+	Data      []byte
+	MimeType  string
+	coverType bool
+}
+
+// offer keeps a picture unless a front cover was already found
+func (p *musicPicture) offer(data []byte, mime string, pictureType byte) {
+	if p == nil || len(data) == 0 || (p.Data != nil && (p.coverType || pictureType != 3)) {
+		return
+	}
+	if mime == "" || !strings.Contains(mime, "/") {
+		mime = "image/" + strings.ToLower(strings.TrimPrefix(mime, "-->"))
+		if mime == "image/jpg" || mime == "image/" {
+			mime = "image/jpeg"
+		}
+	}
+	p.Data, p.MimeType, p.coverType = data, mime, pictureType == 3
+}
+
+// readMusicTags reads the tags of a file; pic, when not nil, gets its
+// picture
+func readMusicTags(full string, pic *musicPicture) (*musicTags, error) {
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tags := &musicTags{}
+	switch musicFormat(full) {
+	case "mp3":
+		err = readMp3Tags(f, info.Size(), tags, pic)
+	case "flac":
+		err = readFlacTags(f, tags, pic)
+	case "ogg", "opus":
+		err = readOggTags(f, info.Size(), tags, pic)
+	case "wav":
+		err = readWavTags(f, tags)
+	}
+	if err != nil && !errors.Is(err, errNoMusicTags) {
+		return nil, err
+	}
+	if tags.BitRate == 0 && tags.Duration > 0 {
+		tags.BitRate = int(info.Size() * 8 / tags.Duration)
+	}
+	return tags, nil
+}
+
+// numberPair reads "3" or "3/12"
+func numberPair(s string) int {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "/")
+	n, _ := strconv.Atoi(strings.TrimSpace(s))
+	return n
+}
+
+// tagYear reads the year of "2004", "2004-05-01" or "2004-05-01T10:00"
+func tagYear(s string) int {
+	s = strings.TrimSpace(s)
+	if len(s) < 4 {
+		return 0
+	}
+	n, _ := strconv.Atoi(s[:4])
+	return n
+}
+
+// id3Genres are the genres ID3v1 numbers
+var id3Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk",
+	"Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes",
+	"Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// id3Genre reads the genre of a TCON frame: a name, "(17)", "17" or
+// "(17)Rock"
+func id3Genre(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "(") {
+		if end := strings.IndexByte(s, ')'); end > 0 {
+			if rest := strings.TrimSpace(s[end+1:]); rest != "" {
+				return rest
+			}
+			s = s[1:end]
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n >= 0 && n < len(id3Genres) {
+			return id3Genres[n]
+		}
+		return ""
+	}
+	return s
+}
+
+// id3Text decodes an ID3v2 text of encoding enc, up to its first NUL
+func id3Text(enc byte, b []byte) string {
+	var s string
+	switch enc {
+	case 1, 2:
+		bigEndian := enc == 2
+		if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+			bigEndian, b = true, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xFF && b[1] == 0xFE {
+			bigEndian, b = false, b[2:]
+		}
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			u := binary.LittleEndian.Uint16(b[i:])
+			if bigEndian {
+				u = binary.BigEndian.Uint16(b[i:])
+			}
+			if u == 0 {
+				break
+			}
+			units = append(units, u)
+		}
+		s = string(utf16.Decode(units))
+	case 3:
+		s, _, _ = strings.Cut(string(b), "\x00")
+	default:
+		b, _, _ = bytes.Cut(b, []byte{0})
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		s = string(runes)
+	}
+	return strings.TrimSpace(s)
+}
+
+// id3Terminated splits b after a text ended by the NUL of encoding enc
+func id3Terminated(enc byte, b []byte) ([]byte, []byte) {
+	if enc == 1 || enc == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// unsynchronise undoes the FF 00 escaping of ID3v2
+func unsynchronise(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xFF, 0x00}, []byte{0xFF})
+}
+
+// readMp3Tags reads the ID3v2 tag at the start, the first MPEG frame for
+// the duration and bit rate, and the ID3v1 tag at the end for what ID3v2
+// did not give
+func readMp3Tags(f io.ReadSeeker, size int64, tags *musicTags, pic *musicPicture) error {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return errNoMusicTags
+	}
+	audioStart := int64(0)
+	if string(header[:3]) == "ID3" && header[3] >= 2 && header[3] <= 4 {
+		tagSize := syncsafe(header[6:10])
+		if tagSize > maxMusicTagSize {
+			return errNoMusicTags
+		}
+		body := make([]byte, tagSize)
+		if _, err := io.ReadFull(f, body); err != nil {
+			return errNoMusicTags
+		}
+		parseID3v2(header[3], header[5], body, tags, pic)
+		audioStart = int64(10 + tagSize)
+		if header[5]&0x10 != 0 {
+			audioStart += 10 // Footer
+		}
+	}
+	if _, err := f.Seek(audioStart, io.SeekStart); err == nil {
+		window := make([]byte, mpegSyncWindow)
+		n, _ := io.ReadFull(f, window)
+		readMpegFrame(window[:n], size-audioStart, tags)
+	}
+	if size >= 128 {
+		v1 := make([]byte, 128)
+		if _, err := f.Seek(size-128, io.SeekStart); err == nil {
+			if _, err := io.ReadFull(f, v1); err == nil && string(v1[:3]) == "TAG" {
+				parseID3v1(v1, tags)
+			}
+		}
+	}
+	return nil
+}
+
+func parseID3v2(version, flags byte, body []byte, tags *musicTags, pic *musicPicture) {
+	if version < 4 && flags&0x80 != 0 {
+		body = unsynchronise(body)
+	}
+	if flags&0x40 != 0 && len(body) >= 4 {
+		// Extended header
+		skip := int(binary.BigEndian.Uint32(body)) + 4
+		if version == 4 {
+			skip = syncsafe(body)
+		}
+		if skip > len(body) {
+			return
+		}
+		body = body[skip:]
+	}
+	idLen, headLen := 4, 10
+	if version == 2 {
+		idLen, headLen = 3, 6
+	}
+	for len(body) >= headLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var frameSize int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[4:]))
+			frameFlags = binary.BigEndian.Uint16(body[8:])
+		default:
+			frameSize = syncsafe(body[4:])
+			frameFlags = binary.BigEndian.Uint16(body[8:])
+		}
+		if frameSize < 0 || headLen+frameSize > len(body) {
+			return
+		}
+		data := body[headLen : headLen+frameSize]
+		body = body[headLen+frameSize:]
+		if version == 3 && frameFlags&0x00c0 != 0 || version == 4 && frameFlags&0x000c != 0 {
+			// Compressed or encrypted
+			continue
+		}
+		if version == 4 {
+			if frameFlags&0x0001 != 0 && len(data) >= 4 {
+				data = data[4:]
+			}
+			if frameFlags&0x0002 != 0 || flags&0x80 != 0 {
+				data = unsynchronise(data)
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if id == "APIC" || id == "PIC" {
+			parseID3Picture(id, data, pic, tags)
+			continue
+		}
+		text := id3Text(data[0], data[1:])
+		switch id {
+		case "TIT2", "TT2":
+			tags.Title = text
+		case "TPE1", "TP1":
+			tags.Artist = text
+		case "TPE2", "TP2":
+			tags.AlbumArtist = text
+		case "TALB", "TAL":
+			tags.Album = text
+		case "TRCK", "TRK":
+			tags.Track = numberPair(text)
+		case "TPOS", "TPA":
+			tags.Disc = numberPair(text)
+		case "TYER", "TYE", "TDRC", "TDOR", "TORY":
+			if tags.Year == 0 {
+				tags.Year = tagYear(text)
+			}
+		case "TCON", "TCO":
+			tags.Genre = id3Genre(text)
+		case "TLEN", "TLE":
+			if ms, err := strconv.ParseInt(text, 10, 64); err == nil && ms > 0 {
+				tags.Duration = ms
+			}
+		}
+	}
+}
+
+// parseID3Picture reads APIC (encoding, MIME type, type, description,
+// data) or PIC of ID3v2.2, which has a three letter format for the MIME
+// type
+func parseID3Picture(id string, data []byte, pic *musicPicture, tags *musicTags) {
+	enc, rest := data[0], data[1:]
+	var mime string
+	if id == "PIC" {
+		if len(rest) < 3 {
+			return
+		}
+		mime, rest = string(rest[:3]), rest[3:]
+	} else {
+		var m []byte
+		m, rest = id3Terminated(0, rest)
+		mime = string(m)
+	}
+	if len(rest) < 1 {
+		return
+	}
+	pictureType := rest[0]
+	_, image := id3Terminated(enc, rest[1:])
+	if len(image) == 0 {
+		return
+	}
+	tags.Picture = true
+	pic.offer(image, strings.ToLower(mime), pictureType)
+}
+
+func parseID3v1(b []byte, tags *musicTags) {
+	field := func(s []byte) string {
+		return id3Text(0, bytes.TrimRight(s, " \x00"))
+	}
+	if tags.Title == "" {
+		tags.Title = field(b[3:33])
+	}
+	if tags.Artist == "" {
+		tags.Artist = field(b[33:63])
+	}
+	if tags.Album == "" {
+		tags.Album = field(b[63:93])
+	}
+	if tags.Year == 0 {
+		tags.Year = tagYear(field(b[93:97]))
+	}
+	if tags.Track == 0 && b[125] == 0 && b[126] != 0 {
+		tags.Track = int(b[126])
+	}
+	if tags.Genre == "" && int(b[127]) < len(id3Genres) {
+		tags.Genre = id3Genres[b[127]]
+	}
+}
+
+// MPEG audio bit rates in kbps by version (1, 2 and 2.5) and layer
+var mpegBitRates = map[[2]int][]int{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mpegSampleRates = map[int][]int{1: {44100, 48000, 32000}, 2: {22050, 24000, 16000}, 25: {11025, 12000, 8000}}
+
+// readMpegFrame finds the first MPEG audio frame in window. Its Xing,
+// Info or VBRI header gives the number of frames of a VBR file; a CBR
+// file's duration follows from its size and bit rate.
+func readMpegFrame(window []byte, audioSize int64, tags *musicTags) {
+	for i := 0; i+4 <= len(window); i++ {
+		if window[i] != 0xFF || window[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		h := window[i:]
+		version := map[byte]int{3: 1, 2: 2, 0: 25}[(h[1]>>3)&3]
+		layer := map[byte]int{3: 1, 2: 2, 1: 3}[(h[1]>>1)&3]
+		bitIndex, rateIndex := int(h[2]>>4), int((h[2]>>2)&3)
+		if version == 0 || layer == 0 || bitIndex == 0 || bitIndex == 15 || rateIndex == 3 {
+			continue
+		}
+		table := version
+		if table == 25 {
+			table = 2
+		}
+		bitRate := mpegBitRates[[2]int{table, layer}][bitIndex]
+		sampleRate := mpegSampleRates[version][rateIndex]
+		samples := 1152
+		switch {
+		case layer == 1:
+			samples = 384
+		case layer == 3 && version != 1:
+			samples = 576
+		}
+		mono := h[3]>>6 == 3
+		side := 32
+		switch {
+		case version == 1 && mono:
+			side = 17
+		case version != 1 && !mono:
+			side = 17
+		case version != 1:
+			side = 9
+		}
+		frames := 0
+		if x := 4 + side; len(h) >= x+12 && (string(h[x:x+4]) == "Xing" || string(h[x:x+4]) == "Info") {
+			if binary.BigEndian.Uint32(h[x+4:])&1 != 0 {
+				frames = int(binary.BigEndian.Uint32(h[x+8:]))
+			}
+		} else if len(h) >= 36+18 && string(h[36:40]) == "VBRI" {
+			frames = int(binary.BigEndian.Uint32(h[36+14:]))
+		}
+		audioSize -= int64(i)
+		if tags.Duration == 0 {
+			if frames > 0 {
+				tags.Duration = int64(frames) * int64(samples) * 1000 / int64(sampleRate)
+			} else {
+				tags.Duration = audioSize * 8 / int64(bitRate)
+			}
+		}
+		if frames > 0 && tags.Duration > 0 {
+			tags.BitRate = int(audioSize * 8 / tags.Duration)
+		} else {
+			tags.BitRate = bitRate
+		}
+		return
+	}
+}
+
+// parseVorbisComment reads a Vorbis comment block: the vendor, then
+// KEY=value fields, all lengths little-endian
+func parseVorbisComment(b []byte, tags *musicTags, pic *musicPicture) {
+	le := binary.LittleEndian
+	if len(b) < 8 {
+		return
+	}
+	vendor := int(le.Uint32(b))
+	if 4+vendor+4 > len(b) {
+		return
+	}
+	b = b[4+vendor:]
+	count := int(le.Uint32(b))
+	b = b[4:]
+	for i := 0; i < count && len(b) >= 4; i++ {
+		n := int(le.Uint32(b))
+		if 4+n > len(b) || n < 0 {
+			return
+		}
+		key, value, ok := strings.Cut(string(b[4:4+n]), "=")
+		b = b[4+n:]
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			tags.Title = value
+		case "ARTIST":
+			if tags.Artist == "" {
+				tags.Artist = value
+			}
+		case "ALBUMARTIST", "ALBUM ARTIST", "ALBUM_ARTIST":
+			tags.AlbumArtist = value
+		case "ALBUM":
+			tags.Album = value
+		case "TRACKNUMBER":
+			tags.Track = numberPair(value)
+		case "DISCNUMBER":
+			tags.Disc = numberPair(value)
+		case "DATE", "YEAR", "ORIGINALDATE":
+			if tags.Year == 0 {
+				tags.Year = tagYear(value)
+			}
+		case "GENRE":
+			if tags.Genre == "" {
+				tags.Genre = value
+			}
+		case "METADATA_BLOCK_PICTURE":
+			if data, err := base64.StdEncoding.DecodeString(value); err == nil {
+				parseFlacPicture(data, tags, pic)
+			}
+		}
+	}
+}
+
+// parseFlacPicture reads a FLAC PICTURE block: type, MIME type,
+// description, size and colors, then the data, lengths big-endian
+func parseFlacPicture(b []byte, tags *musicTags, pic *musicPicture) {
+	be := binary.BigEndian
+	if len(b) < 8 {
+		return
+	}
+	pictureType := be.Uint32(b)
+	n := int(be.Uint32(b[4:]))
+	if 8+n+4 > len(b) {
+		return
+	}
+	mime := string(b[8 : 8+n])
+	b = b[8+n:]
+	n = int(be.Uint32(b))
+	if 4+n+20 > len(b) {
+		return
+	}
+	b = b[4+n+16:]
+	n = int(be.Uint32(b))
+	if 4+n > len(b) || n == 0 {
+		return
+	}
+	tags.Picture = true
+	pic.offer(b[4:4+n], mime, byte(min(pictureType, 255)))
+}
+
+// readFlacTags reads the metadata blocks of a FLAC file: STREAMINFO for
+// the duration, VORBIS_COMMENT and PICTURE
+func readFlacTags(f io.Reader, tags *musicTags, pic *musicPicture) error {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != "fLaC" {
+		return errNoMusicTags
+	}
+	head := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(f, head); err != nil {
+			return nil
+		}
+		last, kind := head[0]&0x80 != 0, head[0]&0x7f
+		n := int(head[1])<<16 | int(head[2])<<8 | int(head[3])
+		if n > maxMusicTagSize {
+			return nil
+		}
+		block := make([]byte, n)
+		if _, err := io.ReadFull(f, block); err != nil {
+			return nil
+		}
+		switch kind {
+		case 0:
+			if len(block) >= 18 {
+				rate := int64(block[10])<<12 | int64(block[11])<<4 | int64(block[12])>>4
+				total := int64(block[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(block[14:]))
+				if rate > 0 {
+					tags.Duration = total * 1000 / rate
+				}
+			}
+		case 4:
+			parseVorbisComment(block, tags, pic)
+		case 6:
+			parseFlacPicture(block, tags, pic)
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// readOggTags reads the first two packets of an Ogg stream, the Vorbis or
+// Opus header and comments, and the granule position of its last page for
+// the duration
+func readOggTags(f io.ReadSeeker, size int64, tags *musicTags, pic *musicPicture) error {
+	var packets [][]byte
+	var packet []byte
+	head := make([]byte, 27)
+	for len(packets) < 2 {
+		if _, err := io.ReadFull(f, head); err != nil || string(head[:4]) != "OggS" {
+			return errNoMusicTags
+		}
+		segments := make([]byte, head[26])
+		if _, err := io.ReadFull(f, segments); err != nil {
+			return errNoMusicTags
+		}
+		for _, n := range segments {
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(f, chunk); err != nil {
+				return errNoMusicTags
+			}
+			packet = append(packet, chunk...)
+			if len(packet) > maxMusicTagSize {
+				return errNoMusicTags
+			}
+			if n < 255 {
+				packets, packet = append(packets, packet), nil
+				if len(packets) == 2 {
+					break
+				}
+			}
+		}
+	}
+	var rate, preSkip int64
+	id, comments := packets[0], packets[1]
+	switch {
+	case len(id) >= 16 && string(id[:7]) == "\x01vorbis" && len(comments) > 7 && string(comments[:7]) == "\x03vorbis":
+		rate = int64(binary.LittleEndian.Uint32(id[12:]))
+		parseVorbisComment(comments[7:], tags, pic)
+	case len(id) >= 12 && string(id[:8]) == "OpusHead" && len(comments) > 8 && string(comments[:8]) == "OpusTags":
+		rate, preSkip = 48000, int64(binary.LittleEndian.Uint16(id[10:]))
+		parseVorbisComment(comments[8:], tags, pic)
+	default:
+		return errNoMusicTags
+	}
+	tail := int64(min(size, oggTailSize))
+	if _, err := f.Seek(size-tail, io.SeekStart); err != nil || rate == 0 {
+		return nil
+	}
+	buf := make([]byte, tail)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return nil
+	}
+	if i := bytes.LastIndex(buf, []byte("OggS")); i >= 0 && i+14 <= len(buf) {
+		if granule := int64(binary.LittleEndian.Uint64(buf[i+6:])) - preSkip; granule > 0 {
+			tags.Duration = granule * 1000 / rate
+		}
+	}
+	return nil
+}
+
+// readWavTags reads the duration of a WAV file from its fmt and data
+// chunks
+func readWavTags(f io.Reader, tags *musicTags) error {
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(f, head); err != nil || string(head[:4]) != "RIFF" || string(head[8:]) != "WAVE" {
+		return errNoMusicTags
+	}
+	var byteRate int64
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(f, chunk); err != nil {
+			return nil
+		}
+		n := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		switch string(chunk[:4]) {
+		case "fmt ":
+			format := make([]byte, min(n, 16))
+			if _, err := io.ReadFull(f, format); err != nil || len(format) < 12 {
+				return nil
+			}
+			byteRate = int64(binary.LittleEndian.Uint32(format[8:]))
+			n -= int64(len(format))
+		case "data":
+			if byteRate > 0 {
+				tags.Duration = n * 1000 / byteRate
+				tags.BitRate = int(byteRate * 8 / 1000)
+			}
+			return nil
+		}
+		if _, err := io.CopyN(io.Discard, f, n+n%2); err != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The admin manages NFS exports ($NFS_EXPORTS, by default /etc/exports)
+// from the dashboard, as with the Samba shares. Comments and lines the
+// admin does not touch are kept; a changed export is written back as one
+// line. Changes take effect once applied with exportfs -ra. In Docker,
+// mount the host's /etc/exports and give the container nfs-utils.
+
+const nfsDefaultExports = "/etc/exports"
+
+var (
+	errNoNfs            = errors.New("NFS server is not installed")
+	errNfsExportMissing = errors.New("NFS export not found")
+	errInvalidNfsExport = errors.New("Invalid NFS export")
+)
+
+// nfsdClientsDir lists the NFSv4 clients of the kernel server, one
+// directory each
+var nfsdClientsDir = "/proc/fs/nfsd/clients"
+
+var (
+	nfsHostRe   = regexp.MustCompile(`^[@A-Za-z0-9*?.:_\[\]-]{1,253}(/[0-9.]{1,15})?$`)
+	nfsOptionRe = regexp.MustCompile(`^[a-z_]+(=[A-Za-z0-9:@/._-]+)?$`)
+)
+
+// Options set through the fields of NfsExportClient
+var nfsManagedOptions = map[string]bool{
+	"rw": true, "ro": true, "root_squash": true, "no_root_squash": true, "all_squash": true, "no_all_squash": true,
+}
+
+var nfsExportsMu sync.Mutex
+
+// NfsExport is a directory and the clients it is exported to
+type NfsExport struct {
+	Path    string            `json:"path"`
+	Clients []NfsExportClient `json:"clients"`
+}
+
+// NfsExportClient is a host, network (10.0.0.0/24), wildcard or @netgroup
+// and its options
+type NfsExportClient struct {
+	Host     string   `json:"host"`
+	ReadOnly bool     `json:"readOnly"`
+	Squash   string   `json:"squash"`  // root (the default), all or none
+	Options  []string `json:"options"` // Any other option, such as sync or anonuid=1000
+}
+
+// NfsClient is a client with the exports mounted
+type NfsClient struct {
+	Address string `json:"address"`
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version"`
+	Export  string `json:"export,omitempty"` // Only known for NFSv3
+}
+
+func nfsExportsPath() string {
+	if p := strings.TrimSpace(os.Getenv("NFS_EXPORTS")); p != "" {
+		return p
+	}
+	return nfsDefaultExports
+}
+
+// nfsEntry is a logical line of the exports file: its physical lines, and
+// the export on it if it is not a comment
+type nfsEntry struct {
+	raw    []string
+	export *NfsExport
+}
+
+func parseNfsExports(data []byte) []*nfsEntry {
+	var entries []*nfsEntry
+	var cur *nfsEntry
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if cur == nil {
+			cur = &nfsEntry{}
+			entries = append(entries, cur)
+		}
+		cur.raw = append(cur.raw, line)
+		if strings.HasSuffix(line, "\\") {
+			continue
+		}
+		logical := ""
+		for _, l := range cur.raw {
+			logical += strings.TrimSuffix(l, "\\") + " "
+		}
+		cur.export = parseNfsExportLine(logical)
+		cur = nil
+	}
+	return entries
+}
+
+// parseNfsExportLine reads "path [-defaults] host(options)...", nil for a
+// comment or blank line
+func parseNfsExportLine(line string) *NfsExport {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	var path string
+	if line[0] == '"' {
+		end := strings.IndexByte(line[1:], '"')
+		if end < 0 {
+			return nil
+		}
+		path, line = line[1:end+1], line[end+2:]
+	} else {
+		path = line
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			path, line = line[:i], line[i:]
+		} else {
+			line = ""
+		}
+	}
+	if before, _, found := strings.Cut(line, "#"); found {
+		line = before
+	}
+	export := &NfsExport{Path: nfsUnescape(path), Clients: []NfsExportClient{}}
+	var defaults []string
+	for _, tok := range strings.Fields(line) {
+		if strings.HasPrefix(tok, "-") {
+			defaults = append(defaults, strings.Split(tok[1:], ",")...)
+			continue
+		}
+		host, opts, _ := strings.Cut(tok, "(")
+		if host == "" {
+			host = "*"
+		}
+		options := append(append([]string{}, defaults...), strings.Split(strings.TrimSuffix(opts, ")"), ",")...)
+		export.Clients = append(export.Clients, nfsClientOf(host, options))
+	}
+	return export
+}
+
+// nfsClientOf sorts options into the fields, with the defaults of exports(5)
+func nfsClientOf(host string, options []string) NfsExportClient {
+	client := NfsExportClient{Host: host, ReadOnly: true, Squash: "root", Options: []string{}}
+	allSquash := false
+	for _, opt := range options {
+		switch opt = strings.TrimSpace(opt); opt {
+		case "":
+		case "rw":
+			client.ReadOnly = false
+		case "ro":
+			client.ReadOnly = true
+		case "root_squash":
+			client.Squash = "root"
+		case "no_root_squash":
+			client.Squash = "none"
+		case "all_squash":
+			allSquash = true
+		case "no_all_squash":
+			allSquash = false
+		default:
+			client.Options = append(client.Options, opt)
+		}
+	}
+	if allSquash {
+		client.Squash = "all"
+	}
+	return client
+}
+
+func (client NfsExportClient) String() string {
+	opts := []string{"ro"}
+	if !client.ReadOnly {
+		opts[0] = "rw"
+	}
+	switch client.Squash {
+	case "none":
+		opts = append(opts, "no_root_squash")
+	case "all":
+		opts = append(opts, "all_squash")
+	default:
+		opts = append(opts, "root_squash")
+	}
+	return client.Host + "(" + strings.Join(append(opts, client.Options...), ",") + ")"
+}
+
+func (export *NfsExport) line() string {
+	parts := []string{nfsEscape(export.Path)}
+	for _, client := range export.Clients {
+		parts = append(parts, client.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// nfsEscape writes the characters that would end a path as octal escapes,
+// which exportfs reads back
+func nfsEscape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch ch := path[i]; ch {
+		case ' ', '\t', '\\', '"', '#':
+			b.WriteString("\\" + strconv.FormatInt(int64(ch)+01000, 8)[1:])
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+func nfsUnescape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func validNfsExport(export NfsExport) bool {
+	if !filepath.IsAbs(export.Path) || strings.ContainsAny(export.Path, "\r\n\x00") || len(export.Clients) == 0 {
+		return false
+	}
+	for _, client := range export.Clients {
+		if !nfsHostRe.MatchString(client.Host) {
+			return false
+		}
+		switch client.Squash {
+		case "root", "all", "none":
+		default:
+			return false
+		}
+		for _, opt := range client.Options {
+			name, _, _ := strings.Cut(opt, "=")
+			if !nfsOptionRe.MatchString(opt) || nfsManagedOptions[name] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func readNfsExports() ([]*nfsEntry, error) {
+	data, err := os.ReadFile(nfsExportsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseNfsExports(data), nil
+}
+
+// updateNfsExports edits the exports file under a lock
+func updateNfsExports(fn func([]*nfsEntry) ([]*nfsEntry, error)) error {
+	nfsExportsMu.Lock()
+	defer nfsExportsMu.Unlock()
+	entries, err := readNfsExports()
+	if err != nil {
+		return err
+	}
+	if entries, err = fn(entries); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		for _, line := range e.raw {
+			b.WriteString(line + "\n")
+		}
+	}
+	return utils.AtomicWriteFile(nfsExportsPath(), []byte(b.String()))
+}
+
+func nfsError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNfsExportMissing):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoNfs):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		nfsLog.Error("NFS operation failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "NFS operation failed"})
+	}
+}
+
+// GetNfsExports lists the exports
+func GetNfsExports(c *gin.Context) {
+	entries, err := readNfsExports()
+	if err != nil {
+		nfsError(c, err)
+		return
+	}
+	exports := []NfsExport{}
+	for _, e := range entries {
+		if e.export != nil {
+			exports = append(exports, *e.export)
+		}
+	}
+	sort.Slice(exports, func(i, j int) bool { return exports[i].Path < exports[j].Path })
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": exports})
+}
+
+// SaveNfsExport creates the export of a path or replaces its clients
+func SaveNfsExport(c *gin.Context) {
+	var export NfsExport
+	if err := c.ShouldBindJSON(&export); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	export.Path = filepath.Clean(strings.TrimSpace(export.Path))
+	for i := range export.Clients {
+		client := &export.Clients[i]
+		client.Host = strings.TrimSpace(client.Host)
+		if client.Squash == "" {
+			client.Squash = "root"
+		}
+		if client.Options == nil {
+			client.Options = []string{}
+		}
+		// exportfs warns when neither is given
+		hasSync := false
+		for _, opt := range client.Options {
+			hasSync = hasSync || opt == "sync" || opt == "async"
+		}
+		if !hasSync {
+			client.Options = append([]string{"sync"}, client.Options...)
+		}
+	}
+	if !validNfsExport(export) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidNfsExport.Error()})
+		return
+	}
+	if info, err := os.Stat(export.Path); err != nil || !info.IsDir() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Folder not found"})
+		return
+	}
+	c.Set("auditTarget", export.Path)
+	err := updateNfsExports(func(entries []*nfsEntry) ([]*nfsEntry, error) {
+		for _, e := range entries {
+			if e.export != nil && e.export.Path == export.Path {
+				e.export, e.raw = &export, []string{export.line()}
+				return entries, nil
+			}
+		}
+		return append(entries, &nfsEntry{raw: []string{export.line()}, export: &export}), nil
+	})
+	if err != nil {
+		nfsError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": export})
+}
+
+// DeleteNfsExport removes the export of ?path=
+func DeleteNfsExport(c *gin.Context) {
+	path := filepath.Clean(c.Query("path"))
+	c.Set("auditTarget", path)
+	err := updateNfsExports(func(entries []*nfsEntry) ([]*nfsEntry, error) {
+		for i, e := range entries {
+			if e.export != nil && e.export.Path == path {
+				return append(entries[:i], entries[i+1:]...), nil
+			}
+		}
+		return nil, errNfsExportMissing
+	})
+	if err != nil {
+		nfsError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ApplyNfsExports makes the server export what the file says
+func ApplyNfsExports(c *gin.Context) {
+	out, err := systemCommand(c.Request.Context(), errNoNfs, "exportfs", "-ra")
+	if errors.Is(err, errNoNfs) {
+		nfsError(c, err)
+		return
+	}
+	if err != nil {
+		nfsLog.Warn("exportfs failed", "error", err, "output", strings.TrimSpace(string(out)))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to apply NFS exports", "details": strings.TrimSpace(string(out))})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"output": strings.TrimSpace(string(out))}})
+}
+
+// GetNfsClients lists NFSv4 clients known to the kernel and the NFSv3
+// mounts showmount reports
+func GetNfsClients(c *gin.Context) {
+	clients := nfsV4Clients()
+	if out, err := systemCommand(c.Request.Context(), errNoNfs, "showmount", "--no-headers", "-a"); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if i := strings.Index(line, ":/"); i > 0 {
+				clients = append(clients, NfsClient{Address: line[:i], Version: "3", Export: strings.TrimSpace(line[i+1:])})
+			}
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Address < clients[j].Address })
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": clients})
+}
+
+// nfsV4Clients reads the info file of each client, lines such as
+// `address: "10.0.0.2:871"` and `minor version: 2`
+func nfsV4Clients() []NfsClient {
+	clients := []NfsClient{}
+	dirs, _ := os.ReadDir(nfsdClientsDir)
+	for _, d := range dirs {
+		data, err := os.ReadFile(filepath.Join(nfsdClientsDir, d.Name(), "info"))
+		if err != nil {
+			continue
+		}
+		client := NfsClient{Version: "4"}
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			switch strings.TrimSpace(key) {
+			case "address":
+				// Drop the port
+				if i := strings.LastIndex(value, ":"); i > 0 {
+					value = strings.Trim(value[:i], "[]")
+				}
+				client.Address = value
+			case "name":
+				client.Name = value
+			case "minor version":
+				client.Version = "4." + value
+			}
+		}
+		if client.Address != "" {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
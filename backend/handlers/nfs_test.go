@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNfsExports(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir, bin, shared := t.TempDir(), t.TempDir(), t.TempDir()
+	spaced := filepath.Join(shared, "my films")
+	os.MkdirAll(spaced, 0755)
+	exports := filepath.Join(dir, "exports")
+	os.WriteFile(exports, []byte("# keep me\n/srv/old -ro 10.0.0.0/24(sync) \\\n    host1(rw,no_root_squash)\n"), 0644)
+	t.Setenv("NFS_EXPORTS", exports)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.WriteFile(filepath.Join(bin, "exportfs"), []byte("#!/bin/sh\necho \"exportfs $*\"\n"), 0755)
+	os.WriteFile(filepath.Join(bin, "showmount"), []byte("#!/bin/sh\necho '10.0.0.7:/srv/old'\n"), 0755)
+	prev := nfsdClientsDir
+	nfsdClientsDir = t.TempDir()
+	defer func() { nfsdClientsDir = prev }()
+	os.MkdirAll(filepath.Join(nfsdClientsDir, "3"), 0755)
+	os.WriteFile(filepath.Join(nfsdClientsDir, "3", "info"), []byte("clientid: 0xfe\naddress: \"10.0.0.5:871\"\nname: \"Linux NFSv4.2 laptop\"\nminor version: 2\n"), 0644)
+
+	r := gin.New()
+	r.GET("/exports", GetNfsExports)
+	r.POST("/exports", SaveNfsExport)
+	r.DELETE("/exports", DeleteNfsExport)
+	r.POST("/apply", ApplyNfsExports)
+	r.GET("/clients", GetNfsClients)
+	list := func() []NfsExport {
+		var resp struct{ Data []NfsExport }
+		json.Unmarshal(serve(r, "GET", "/exports", "").Body.Bytes(), &resp)
+		return resp.Data
+	}
+
+	got := list()
+	if len(got) != 1 || len(got[0].Clients) != 2 || !got[0].Clients[0].ReadOnly || got[0].Clients[1].ReadOnly || got[0].Clients[1].Squash != "none" {
+		t.Fatalf("unexpected exports %+v", got)
+	}
+
+	body := `{"path":"` + spaced + `","clients":[{"host":"192.168.1.0/24","readOnly":false,"squash":"all","options":["anonuid=1000"]}]}`
+	if w := serve(r, "POST", "/exports", body); w.Code != 200 {
+		t.Fatalf("save failed: %d %s", w.Code, w.Body.String())
+	}
+	data, _ := os.ReadFile(exports)
+	if !strings.Contains(string(data), "# keep me") || !strings.Contains(string(data), `my\040films 192.168.1.0/24(rw,all_squash,sync,anonuid=1000)`) {
+		t.Fatalf("unexpected exports file:\n%s", data)
+	}
+	got = list()
+	if len(got) != 2 || got[1].Path != spaced || got[1].Clients[0].Squash != "all" {
+		t.Fatalf("unexpected exports %+v", got)
+	}
+
+	for _, bad := range []string{
+		`{"path":"relative","clients":[{"host":"*"}]}`,
+		`{"path":"` + shared + `","clients":[]}`,
+		`{"path":"` + shared + `","clients":[{"host":"a b"}]}`,
+		`{"path":"` + shared + `","clients":[{"host":"*","options":["rw"]}]}`,
+		`{"path":"` + shared + `","clients":[{"host":"*","options":["x),y("]}]}`,
+	} {
+		if w := serve(r, "POST", "/exports", bad); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected %s to be refused, got %d", bad, w.Code)
+		}
+	}
+
+	if w := serve(r, "DELETE", "/exports?path=/srv/old", ""); w.Code != 200 || len(list()) != 1 {
+		t.Fatalf("delete failed: %d", w.Code)
+	}
+	if w := serve(r, "DELETE", "/exports?path=/srv/old", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if w := serve(r, "POST", "/apply", ""); w.Code != 200 || !strings.Contains(w.Body.String(), "exportfs -ra") {
+		t.Fatalf("apply failed: %d %s", w.Code, w.Body.String())
+	}
+	var clients struct{ Data []NfsClient }
+	w := serve(r, "GET", "/clients", "")
+	json.Unmarshal(w.Body.Bytes(), &clients)
+	if len(clients.Data) != 2 || clients.Data[0].Address != "10.0.0.5" || clients.Data[0].Version != "4.2" || clients.Data[1].Export != "/srv/old" {
+		t.Fatalf("unexpected clients %s", w.Body.String())
+	}
+}
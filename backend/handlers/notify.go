@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const notifyTimeout = 15 * time.Second
+
+// notifyHTTPClient posts to the channels. They are set up by the admin and
+// often on the LAN, so their requests skip the outbound guard.
+var notifyHTTPClient = &http.Client{Timeout: notifyTimeout, Transport: newProxyTransport()}
+
+// Notification is a message raised by a background job, e.g. an RSS alert
+type Notification struct {
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+	Html   string `json:"html,omitempty"` // Optional rich body, used by email channels
+	Link   string `json:"link,omitempty"`
+	Source string `json:"source,omitempty"` // What raised it, e.g. "rss"
+	Time   int64  `json:"time"`             // Unix timestamp in ms
+}
+
+// NotifyChannel is one delivery target from the "notifications" list of the
+// dashboard config. Type is "webhook" (JSON POST of the Notification),
+// "ntfy", "gotify" or "email".
+type NotifyChannel struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Url     string            `json:"url"`
+	Token   string            `json:"token,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Smtp    *SmtpSettings     `json:"smtp,omitempty"` // For email channels
+}
+
+func loadNotifyChannels() []NotifyChannel {
+	var payload struct {
+		Notifications []NotifyChannel `json:"notifications"`
+	}
+	_ = utils.ReadJSON(filepath.Join(config.DataDir, "data.json"), &payload)
+	return payload.Notifications
+}
+
+// sendNotification shows n on connected dashboards and delivers it to the
+// named channels, or to every configured channel when names is empty.
+func sendNotification(ctx context.Context, n Notification, names []string) {
+	if n.Time == 0 {
+		n.Time = time.Now().UnixMilli()
+	}
+	broadcastAll("notification", n)
+	wanted := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		wanted[strings.TrimSpace(name)] = struct{}{}
+	}
+	for _, ch := range loadNotifyChannels() {
+		if _, ok := wanted[ch.Name]; len(wanted) > 0 && !ok {
+			continue
+		}
+		if err := deliverNotification(ctx, ch, n); err != nil {
+			notifyLog.Warn("Notification failed", "channel", ch.Name, "error", err)
+		}
+	}
+}
+
+func deliverNotification(ctx context.Context, ch NotifyChannel, n Notification) error {
+	if strings.EqualFold(ch.Type, "email") {
+		return sendEmailNotification(ctx, ch.Smtp, n)
+	}
+	if strings.TrimSpace(ch.Url) == "" {
+		return fmt.Errorf("url is required")
+	}
+	var body []byte
+	contentType := "application/json"
+	headers := map[string]string{}
+	switch strings.ToLower(ch.Type) {
+	case "", "webhook":
+		body, _ = json.Marshal(n)
+	case "ntfy":
+		contentType = "text/plain; charset=utf-8"
+		body = []byte(n.Body)
+		headers["Title"] = n.Title
+		if n.Link != "" {
+			headers["Click"] = n.Link
+		}
+		if ch.Token != "" {
+			headers["Authorization"] = "Bearer " + ch.Token
+		}
+	case "gotify":
+		message := n.Body
+		if n.Link != "" {
+			message += "\n" + n.Link
+		}
+		body, _ = json.Marshal(map[string]interface{}{"title": n.Title, "message": message})
+		if ch.Token != "" {
+			headers["X-Gotify-Key"] = ch.Token
+		}
+	default:
+		return fmt.Errorf("unknown channel type %q", ch.Type)
+	}
+
+	ctx, cancel := context.WithTimeout(allowOutbound(ctx), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ch.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range ch.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := notifyHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
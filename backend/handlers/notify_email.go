@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SmtpSettings configures an email notification channel. Port 465 uses
+// implicit TLS; other ports upgrade with STARTTLS when the server offers it.
+type SmtpSettings struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// InsecureSkipVerify accepts self-signed certificates of a LAN relay
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+func sendEmailNotification(ctx context.Context, settings *SmtpSettings, n Notification) error {
+	if settings == nil || settings.Host == "" || settings.From == "" || len(settings.To) == 0 {
+		return fmt.Errorf("smtp host, from and to are required")
+	}
+	port := settings.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(settings.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: settings.Host, InsecureSkipVerify: settings.InsecureSkipVerify}
+
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	var conn net.Conn
+	var err error
+	if port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(2 * notifyTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, settings.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if settings.Username != "" {
+		auth := smtp.PlainAuth("", settings.Username, settings.Password, settings.Host)
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(settings.From); err != nil {
+		return err
+	}
+	for _, to := range settings.To {
+		if err := client.Rcpt(strings.TrimSpace(to)); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildEmailMessage(settings.From, settings.To, n)); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// buildEmailMessage renders n as a MIME message; a Notification with Html
+// becomes multipart/alternative so plain-text clients still get the body.
+func buildEmailMessage(from string, to []string, n Notification) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Title))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	text := n.Body
+	if n.Link != "" {
+		text += "\n\n" + n.Link
+	}
+	if n.Html == "" {
+		writeEmailPart(&b, "text/plain", text)
+		return b.Bytes()
+	}
+	boundary := newEmailBoundary()
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	writeEmailPart(&b, "text/plain", text)
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	writeEmailPart(&b, "text/html", n.Html)
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return b.Bytes()
+}
+
+func writeEmailPart(b *bytes.Buffer, contentType, body string) {
+	fmt.Fprintf(b, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(b)
+	_, _ = qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	_ = qp.Close()
+}
+
+func newEmailBoundary() string {
+	buf := make([]byte, 12)
+	_, _ = rand.Read(buf)
+	return "flatnas-" + hex.EncodeToString(buf)
+}
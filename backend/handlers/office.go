@@ -0,0 +1,585 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Office documents open in a WOPI client: Collabora Online or OnlyOffice
+// Docs. FlatNas is the WOPI host. The browser posts an access token to the
+// editor page the document server lists in its discovery, and the server
+// then reads and saves the file through /api/wopi/files/:id with that
+// token. The file ID is the same for every user, so people who open one
+// document edit it together, and locks are shared.
+
+const (
+	officeTokenPurpose = "wopi"
+	officeTokenTTL     = 10 * time.Hour
+	officeLockTTL      = 30 * time.Minute
+	officeDiscoveryTTL = time.Hour
+	maxOfficeFileSize  = 512 << 20
+	maxOfficeLockSize  = 1024
+)
+
+var (
+	errOfficeDisabled    = errors.New("The document server is not configured")
+	errOfficeUnsupported = errors.New("The document server cannot open this file")
+	errOfficeToken       = errors.New("Invalid access token")
+)
+
+var officeHTTPClient = &http.Client{Timeout: 10 * time.Second, Transport: newProxyTransport()}
+
+// OfficeOpenRequest asks for a session on a document
+type OfficeOpenRequest struct {
+	Share string `json:"share"`
+	Path  string `json:"path"`
+	View  bool   `json:"view,omitempty"` // Open read-only even when it could be edited
+}
+
+// OfficeSession is what the browser posts to the document server: a form
+// to URL with access_token and access_token_ttl
+type OfficeSession struct {
+	URL            string `json:"url"`
+	AccessToken    string `json:"accessToken"`
+	AccessTokenTTL int64  `json:"accessTokenTtl"` // Expiry, Unix timestamp in ms
+	Action         string `json:"action"`         // "edit" or "view"
+	FileID         string `json:"fileId"`
+}
+
+// OfficeStatus tells whether documents can be opened, and which
+type OfficeStatus struct {
+	Enabled    bool                `json:"enabled"`
+	Available  bool                `json:"available"`
+	Error      string              `json:"error,omitempty"`
+	Extensions map[string][]string `json:"extensions"` // Actions by extension
+}
+
+// OfficeClaims are the access token of a session: the file, the user as
+// subject, and whether the user may save
+type OfficeClaims struct {
+	File  string `json:"fid"`
+	Share string `json:"share"`
+	Path  string `json:"path"`
+	Write bool   `json:"write,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func officeSettings() models.OfficeSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.Office == nil {
+		return models.OfficeSettings{}
+	}
+	return *sysConfig.Office
+}
+
+func decodeOfficeSettings(raw interface{}) (*models.OfficeSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid office settings")
+	}
+	settings := &models.OfficeSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid office settings")
+	}
+	for _, u := range []*string{&settings.ServerURL, &settings.HostURL} {
+		*u = strings.TrimRight(strings.TrimSpace(*u), "/")
+		if *u == "" {
+			continue
+		}
+		parsed, err := url.Parse(*u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("Invalid office server URL")
+		}
+	}
+	if settings.Enable && settings.ServerURL == "" {
+		return nil, fmt.Errorf("Invalid office server URL")
+	}
+	return settings, nil
+}
+
+// officeDiscovery is the editor pages of the document server, by
+// extension and action
+type officeDiscovery struct {
+	server  string
+	at      time.Time
+	actions map[string]map[string]string
+	err     error
+}
+
+var officeDiscoveries = struct {
+	sync.Mutex
+	current *officeDiscovery
+}{}
+
+// urlsrc templates hold optional parameters as <name=PLACEHOLDER&>
+var wopiPlaceholder = regexp.MustCompile(`<([a-z_]+)=([A-Z_]+)&?>`)
+
+// loadOfficeDiscovery fetches the discovery of server, or returns the one
+// fetched within the last hour. A failure is kept a minute, so a server
+// that is down is not asked on every request.
+func loadOfficeDiscovery(ctx context.Context, server string) (*officeDiscovery, error) {
+	officeDiscoveries.Lock()
+	defer officeDiscoveries.Unlock()
+	if d := officeDiscoveries.current; d != nil && d.server == server {
+		ttl := officeDiscoveryTTL
+		if d.err != nil {
+			ttl = time.Minute
+		}
+		if time.Since(d.at) < ttl {
+			return d, d.err
+		}
+	}
+	d := &officeDiscovery{server: server, at: time.Now()}
+	d.actions, d.err = fetchOfficeDiscovery(ctx, server)
+	if d.err != nil {
+		filesLog.Warn("Failed to load the discovery of the document server", "server", server, "error", d.err)
+	}
+	officeDiscoveries.current = d
+	return d, d.err
+}
+
+func fetchOfficeDiscovery(ctx context.Context, server string) (map[string]map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(allowOutbound(ctx), http.MethodGet, server+"/hosting/discovery", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := officeHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d from the discovery", resp.StatusCode)
+	}
+	var doc struct {
+		Zones []struct {
+			Name string `xml:"name,attr"`
+			Apps []struct {
+				Actions []struct {
+					Name   string `xml:"name,attr"`
+					Ext    string `xml:"ext,attr"`
+					URLSrc string `xml:"urlsrc,attr"`
+				} `xml:"action"`
+			} `xml:"app"`
+		} `xml:"net-zone"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid discovery: %w", err)
+	}
+	actions := make(map[string]map[string]string)
+	for _, zone := range doc.Zones {
+		if strings.HasPrefix(zone.Name, "internal") {
+			continue
+		}
+		for _, app := range zone.Apps {
+			for _, a := range app.Actions {
+				ext := strings.ToLower(a.Ext)
+				if ext == "" || a.URLSrc == "" || (a.Name != "edit" && a.Name != "view") {
+					continue
+				}
+				if actions[ext] == nil {
+					actions[ext] = make(map[string]string)
+				}
+				if actions[ext][a.Name] == "" {
+					actions[ext][a.Name] = a.URLSrc
+				}
+			}
+		}
+	}
+	if len(actions) == 0 {
+		return nil, errors.New("the discovery lists no documents")
+	}
+	return actions, nil
+}
+
+// officeActionURL fills the urlsrc of an action for a file: the language
+// placeholders get the locale, the others are dropped, and WOPISrc is
+// added
+func officeActionURL(urlsrc, wopiSrc, locale string) string {
+	u := wopiPlaceholder.ReplaceAllStringFunc(urlsrc, func(m string) string {
+		parts := wopiPlaceholder.FindStringSubmatch(m)
+		if (parts[2] == "UI_LLCC" || parts[2] == "DC_LLCC") && locale != "" {
+			return parts[1] + "=" + url.QueryEscape(locale) + "&"
+		}
+		return ""
+	})
+	switch {
+	case !strings.Contains(u, "?"):
+		u += "?"
+	case !strings.HasSuffix(u, "?") && !strings.HasSuffix(u, "&"):
+		u += "&"
+	}
+	return u + "WOPISrc=" + url.QueryEscape(wopiSrc)
+}
+
+// officeFileID names a file in WOPI requests
+func officeFileID(share, p string) string {
+	sum := sha256.Sum256([]byte(share + "\x00" + p))
+	return hex.EncodeToString(sum[:16])
+}
+
+// officeVersion changes whenever the file does
+func officeVersion(info os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+}
+
+// officeHostURL is where the document server reaches this host: the
+// configured URL, or the one the browser used
+func officeHostURL(c *gin.Context, settings models.OfficeSettings) string {
+	if settings.HostURL != "" {
+		return settings.HostURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// GetOffice tells whether the document server can be reached and which
+// files it opens
+func GetOffice(c *gin.Context) {
+	settings := officeSettings()
+	status := OfficeStatus{Enabled: settings.Enable, Extensions: map[string][]string{}}
+	if settings.Enable {
+		d, err := loadOfficeDiscovery(c.Request.Context(), settings.ServerURL)
+		if err != nil {
+			status.Error = err.Error()
+		} else {
+			status.Available = true
+			for ext, actions := range d.actions {
+				for name := range actions {
+					status.Extensions[ext] = append(status.Extensions[ext], name)
+				}
+				sort.Strings(status.Extensions[ext])
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": status})
+}
+
+// OpenOfficeFile starts a session on a document for the user. It is
+// opened for editing when the share is writable and the document server
+// can edit the format.
+func OpenOfficeFile(c *gin.Context) {
+	var req OfficeOpenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	settings := officeSettings()
+	if !settings.Enable {
+		c.JSON(http.StatusConflict, gin.H{"error": errOfficeDisabled.Error()})
+		return
+	}
+	share, full, rel, err := textFileShare(req.Share, req.Path)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	if info, err := os.Stat(full); err != nil || info.IsDir() {
+		fileError(c, os.ErrNotExist, rel)
+		return
+	}
+	d, err := loadOfficeDiscovery(c.Request.Context(), settings.ServerURL)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The document server cannot be reached"})
+		return
+	}
+	actions := d.actions[strings.TrimPrefix(strings.ToLower(path.Ext(rel)), ".")]
+	action, urlsrc := "view", actions["view"]
+	if !req.View && !share.ReadOnly && actions["edit"] != "" {
+		action, urlsrc = "edit", actions["edit"]
+	} else if urlsrc == "" {
+		// Collabora lists most formats for editing only; the editor opens
+		// read-only when CheckFileInfo says the user cannot write
+		urlsrc = actions["edit"]
+	}
+	if urlsrc == "" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": errOfficeUnsupported.Error()})
+		return
+	}
+
+	username := c.GetString("username")
+	fileID := officeFileID(share.Name, rel)
+	expires := time.Now().Add(officeTokenTTL)
+	claims := OfficeClaims{
+		File:  fileID,
+		Share: share.Name,
+		Path:  rel,
+		Write: action == "edit",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   username,
+			ExpiresAt: jwt.NewNumericDate(expires),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Audience:  jwt.ClaimStrings{officeTokenPurpose},
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(config.DerivedKey(officeTokenPurpose))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue token"})
+		return
+	}
+	c.Set("auditTarget", share.Name+":"+rel)
+	wopiSrc := officeHostURL(c, settings) + "/api/wopi/files/" + fileID
+	locale := UserLocale(username)
+	if locale == "" {
+		locale = notifyLocale()
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": OfficeSession{
+		URL:            officeActionURL(urlsrc, wopiSrc, locale),
+		AccessToken:    signed,
+		AccessTokenTTL: expires.UnixMilli(),
+		Action:         action,
+		FileID:         fileID,
+	}})
+}
+
+// wopiFile checks the access token of a WOPI request against the file it
+// names and resolves the file
+func wopiFile(c *gin.Context) (OfficeClaims, models.FileShare, string, bool) {
+	claims := OfficeClaims{}
+	tokenStr := c.Query("access_token")
+	if tokenStr == "" {
+		tokenStr = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	tok, err := jwt.ParseWithClaims(tokenStr, &claims, func(token *jwt.Token) (interface{}, error) {
+		return config.DerivedKey(officeTokenPurpose), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(officeTokenPurpose))
+	if err != nil || !tok.Valid || claims.File != c.Param("id") || claims.File != officeFileID(claims.Share, claims.Path) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errOfficeToken.Error()})
+		return claims, models.FileShare{}, "", false
+	}
+	share, err := findFileShare(claims.Share)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return claims, share, "", false
+	}
+	full, err := resolveSharePath(share, claims.Path)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return claims, share, "", false
+	}
+	if info, err := os.Stat(full); err != nil || info.IsDir() {
+		c.Status(http.StatusNotFound)
+		return claims, share, "", false
+	}
+	if share.ReadOnly {
+		claims.Write = false
+	}
+	return claims, share, full, true
+}
+
+// WopiCheckFileInfo describes the file and what the user may do with it
+func WopiCheckFileInfo(c *gin.Context) {
+	claims, _, full, ok := wopiFile(c)
+	if !ok {
+		return
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"BaseFileName":               path.Base(claims.Path),
+		"Size":                       info.Size(),
+		"Version":                    officeVersion(info),
+		"LastModifiedTime":           info.ModTime().UTC().Format(time.RFC3339),
+		"OwnerId":                    claims.Share,
+		"UserId":                     claims.Subject,
+		"UserFriendlyName":           claims.Subject,
+		"UserCanWrite":               claims.Write,
+		"ReadOnly":                   !claims.Write,
+		"SupportsUpdate":             true,
+		"SupportsLocks":              true,
+		"SupportsGetLock":            true,
+		"SupportsExtendedLockLength": true,
+		"UserCanNotWriteRelative":    true,
+		"UserCanRename":              false,
+	})
+}
+
+// WopiGetFile sends the content of the file
+func WopiGetFile(c *gin.Context) {
+	_, _, full, ok := wopiFile(c)
+	if !ok {
+		return
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("X-WOPI-ItemVersion", officeVersion(info))
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime(), f)
+}
+
+// officeLock is the lock a document server holds on a file
+type officeLock struct {
+	id      string
+	expires time.Time
+}
+
+var officeLocks = struct {
+	sync.Mutex
+	byFile map[string]officeLock
+}{byFile: make(map[string]officeLock)}
+
+// currentOfficeLock returns the lock on a file, "" when it has none.
+// Callers hold officeLocks.
+func currentOfficeLock(fileID string) string {
+	l, ok := officeLocks.byFile[fileID]
+	if !ok || time.Now().After(l.expires) {
+		delete(officeLocks.byFile, fileID)
+		return ""
+	}
+	return l.id
+}
+
+// wopiLockConflict answers 409 with the current lock
+func wopiLockConflict(c *gin.Context, current, reason string) {
+	c.Header("X-WOPI-Lock", current)
+	c.Header("X-WOPI-LockFailureReason", reason)
+	c.Status(http.StatusConflict)
+}
+
+// WopiPutFile saves the file. It must be locked with the lock of the
+// request; an empty file may be written without one, as WOPI allows.
+func WopiPutFile(c *gin.Context) {
+	claims, share, full, ok := wopiFile(c)
+	if !ok {
+		return
+	}
+	if !claims.Write {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not allowed to save"})
+		return
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	officeLocks.Lock()
+	defer officeLocks.Unlock()
+	lock := c.GetHeader("X-WOPI-Lock")
+	current := currentOfficeLock(claims.File)
+	if current != lock || (current == "" && info.Size() > 0) {
+		wopiLockConflict(c, current, "Lock mismatch")
+		return
+	}
+	if c.Request.ContentLength > maxOfficeFileSize {
+		c.Status(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if grow := c.Request.ContentLength - info.Size(); grow > 0 {
+		if err := checkShareQuota(share.Name, grow); err != nil {
+			c.Status(http.StatusInsufficientStorage)
+			return
+		}
+	}
+	keepVersion(share, claims.Path, full, claims.Subject)
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxOfficeFileSize)
+	n, err := replaceFile(full, body, info.Mode().Perm())
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.Status(http.StatusRequestEntityTooLarge)
+			return
+		}
+		filesLog.Error("Failed to save document", "share", share.Name, "path", claims.Path, "error", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	chargeShareQuota(share.Name, n-info.Size())
+	if info, err := os.Stat(full); err == nil {
+		c.Header("X-WOPI-ItemVersion", officeVersion(info))
+	}
+	c.Status(http.StatusOK)
+}
+
+// WopiFileOperation handles the lock operations named by X-WOPI-Override.
+// Creating, renaming and other files are not offered.
+func WopiFileOperation(c *gin.Context) {
+	claims, _, full, ok := wopiFile(c)
+	if !ok {
+		return
+	}
+	override := c.GetHeader("X-WOPI-Override")
+	lock, oldLock := c.GetHeader("X-WOPI-Lock"), c.GetHeader("X-WOPI-OldLock")
+	officeLocks.Lock()
+	defer officeLocks.Unlock()
+	current := currentOfficeLock(claims.File)
+	if override == "GET_LOCK" {
+		c.Header("X-WOPI-Lock", current)
+		c.Status(http.StatusOK)
+		return
+	}
+	switch override {
+	case "LOCK", "REFRESH_LOCK", "UNLOCK":
+	default:
+		c.Status(http.StatusNotImplemented)
+		return
+	}
+	if !claims.Write {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not allowed to lock"})
+		return
+	}
+	if lock == "" || len(lock) > maxOfficeLockSize {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	expected := lock
+	if override == "LOCK" && oldLock != "" {
+		// UnlockAndRelock
+		expected = oldLock
+	}
+	switch {
+	case override == "LOCK" && oldLock == "" && current == "":
+	case current != expected:
+		wopiLockConflict(c, current, "Lock mismatch")
+		return
+	}
+	if override == "UNLOCK" {
+		delete(officeLocks.byFile, claims.File)
+	} else {
+		officeLocks.byFile[claims.File] = officeLock{id: lock, expires: time.Now().Add(officeLockTTL)}
+	}
+	if info, err := os.Stat(full); err == nil {
+		c.Header("X-WOPI-ItemVersion", officeVersion(info))
+	}
+	c.Status(http.StatusOK)
+}
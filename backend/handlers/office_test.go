@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testDiscovery = `<?xml version="1.0" encoding="utf-8"?>
+<wopi-discovery><net-zone name="external-http">
+<app name="writer">
+<action default="true" ext="odt" name="edit" urlsrc="https://office.test/browser/dist/cool.html?"/>
+<action ext="docx" name="edit" urlsrc="https://office.test/browser/dist/cool.html?"/>
+</app>
+<app name="Pdf"><action ext="pdf" name="view" urlsrc="https://office.test/view.aspx?&lt;ui=UI_LLCC&amp;&gt;&lt;rs=DC_LLCC&amp;&gt;&lt;dchat=DISABLE_CHAT&amp;&gt;"/></app>
+</net-zone></wopi-discovery>`
+
+func TestOffice(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	t.Cleanup(func() { officeDiscoveries.current = nil })
+
+	discovery := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hosting/discovery" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testDiscovery))
+	}))
+	defer discovery.Close()
+
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "report.docx"), []byte("draft"), 0640)
+	os.WriteFile(filepath.Join(root, "empty.odt"), nil, 0644)
+	os.WriteFile(filepath.Join(root, "scan.pdf"), []byte("%PDF"), 0644)
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("x"), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{
+		Shares: []models.FileShare{{Name: "main", Path: root}, {Name: "ro", Path: root, ReadOnly: true}},
+		Office: &models.OfficeSettings{Enable: true, ServerURL: discovery.URL, HostURL: "https://nas.test"},
+	})
+
+	r := gin.New()
+	authorized := r.Group("/", func(c *gin.Context) { c.Set("username", "alice") })
+	authorized.GET("/office", GetOffice)
+	authorized.POST("/office/open", OpenOfficeFile)
+	r.GET("/wopi/files/:id", WopiCheckFileInfo)
+	r.POST("/wopi/files/:id", WopiFileOperation)
+	r.GET("/wopi/files/:id/contents", WopiGetFile)
+	r.POST("/wopi/files/:id/contents", WopiPutFile)
+
+	wopi := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	open := func(share, p string) OfficeSession {
+		t.Helper()
+		w := serve(r, "POST", "/office/open", `{"share":"`+share+`","path":"`+p+`"}`)
+		if w.Code != 200 {
+			t.Fatalf("open %s:%s: %d %s", share, p, w.Code, w.Body.String())
+		}
+		var resp struct{ Data OfficeSession }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Data
+	}
+
+	if w := serve(r, "GET", "/office", ""); w.Code != 200 || !strings.Contains(w.Body.String(), `"available":true`) || !strings.Contains(w.Body.String(), `"pdf":["view"]`) {
+		t.Fatalf("unexpected status %d %s", w.Code, w.Body.String())
+	}
+
+	s := open("main", "report.docx")
+	if s.Action != "edit" || s.AccessToken == "" || s.FileID != officeFileID("main", "report.docx") {
+		t.Fatalf("unexpected session %+v", s)
+	}
+	if want := "https://office.test/browser/dist/cool.html?WOPISrc=" + url.QueryEscape("https://nas.test/api/wopi/files/"+s.FileID); s.URL != want {
+		t.Fatalf("unexpected editor URL %q", s.URL)
+	}
+	if v := open("main", "scan.pdf"); v.Action != "view" || strings.Contains(v.URL, "dchat") || !strings.Contains(v.URL, "view.aspx?ui=") {
+		t.Fatalf("unexpected view session %+v", v)
+	}
+	for body, status := range map[string]int{
+		`{"share":"main","path":"notes.txt"}`: 415,
+		`{"share":"main","path":"none.docx"}`: 404,
+		`{"share":"nope","path":"a.docx"}`:    404,
+	} {
+		if w := serve(r, "POST", "/office/open", body); w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", body, status, w.Code)
+		}
+	}
+
+	file := "/wopi/files/" + s.FileID
+	token := "?access_token=" + url.QueryEscape(s.AccessToken)
+	w := wopi("GET", file+token, "", nil)
+	var info map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if w.Code != 200 || info["BaseFileName"] != "report.docx" || info["Size"] != float64(5) || info["UserCanWrite"] != true || info["UserId"] != "alice" {
+		t.Fatalf("unexpected CheckFileInfo %d %s", w.Code, w.Body.String())
+	}
+	if w := wopi("GET", file+"/contents"+token, "", nil); w.Code != 200 || w.Body.String() != "draft" || w.Header().Get("X-WOPI-ItemVersion") != info["Version"] {
+		t.Fatalf("unexpected GetFile %d %q", w.Code, w.Body.String())
+	}
+	if w := wopi("GET", file+"/contents", "", map[string]string{"Authorization": "Bearer " + s.AccessToken}); w.Code != 200 {
+		t.Fatalf("expected a bearer token to work, got %d", w.Code)
+	}
+	other := open("main", "empty.odt")
+	for target, status := range map[string]int{
+		file:                                  401,
+		file + "?access_token=bogus":          401,
+		"/wopi/files/" + other.FileID + token: 401,
+	} {
+		if w := wopi("GET", target, "", nil); w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", target, status, w.Code)
+		}
+	}
+
+	// Saves need the lock of the session
+	if w := wopi("POST", file+"/contents"+token, "final", nil); w.Code != 409 {
+		t.Fatalf("expected 409 for an unlocked save, got %d", w.Code)
+	}
+	lock := func(override, id, old string) *httptest.ResponseRecorder {
+		return wopi("POST", file+token, "", map[string]string{"X-WOPI-Override": override, "X-WOPI-Lock": id, "X-WOPI-OldLock": old})
+	}
+	if w := lock("LOCK", "L1", ""); w.Code != 200 {
+		t.Fatalf("lock: %d", w.Code)
+	}
+	if w := lock("LOCK", "L2", ""); w.Code != 409 || w.Header().Get("X-WOPI-Lock") != "L1" {
+		t.Fatalf("expected 409 with the lock for another lock, got %d %q", w.Code, w.Header().Get("X-WOPI-Lock"))
+	}
+	if w := lock("GET_LOCK", "", ""); w.Header().Get("X-WOPI-Lock") != "L1" {
+		t.Fatalf("unexpected lock %q", w.Header().Get("X-WOPI-Lock"))
+	}
+	if w := lock("LOCK", "L2", "L1"); w.Code != 200 {
+		t.Fatalf("unlock and relock: %d", w.Code)
+	}
+	if w := lock("REFRESH_LOCK", "L1", ""); w.Code != 409 {
+		t.Fatalf("expected 409 refreshing an old lock, got %d", w.Code)
+	}
+	if w := lock("PUT_RELATIVE", "", ""); w.Code != 501 {
+		t.Fatalf("expected 501 for PutRelativeFile, got %d", w.Code)
+	}
+	if w := wopi("POST", file+"/contents"+token, "lost", map[string]string{"X-WOPI-Lock": "L1"}); w.Code != 409 {
+		t.Fatalf("expected 409 for a save with another lock, got %d", w.Code)
+	}
+	if w := wopi("POST", file+"/contents"+token, "final", map[string]string{"X-WOPI-Lock": "L2"}); w.Code != 200 {
+		t.Fatalf("save: %d %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "report.docx")); string(data) != "final" {
+		t.Fatalf("unexpected content %q", data)
+	}
+	if st, _ := os.Stat(filepath.Join(root, "report.docx")); st.Mode().Perm() != 0640 {
+		t.Fatalf("save changed the mode to %v", st.Mode().Perm())
+	}
+	if w := lock("UNLOCK", "L2", ""); w.Code != 200 {
+		t.Fatalf("unlock: %d", w.Code)
+	}
+
+	// An empty file may be written without a lock
+	if w := wopi("POST", "/wopi/files/"+other.FileID+"/contents?access_token="+url.QueryEscape(other.AccessToken), "new", nil); w.Code != 200 {
+		t.Fatalf("save of an empty file: %d", w.Code)
+	}
+
+	// Read-only shares give view sessions that cannot save or lock
+	ro := open("ro", "report.docx")
+	roToken := "?access_token=" + url.QueryEscape(ro.AccessToken)
+	if ro.Action != "view" {
+		t.Fatalf("expected a view session on a read-only share, got %q", ro.Action)
+	}
+	if w := wopi("POST", "/wopi/files/"+ro.FileID+"/contents"+roToken, "x", nil); w.Code != 401 {
+		t.Fatalf("expected 401 saving a view session, got %d", w.Code)
+	}
+	if w := wopi("POST", "/wopi/files/"+ro.FileID+roToken, "", map[string]string{"X-WOPI-Override": "LOCK", "X-WOPI-Lock": "L"}); w.Code != 401 {
+		t.Fatalf("expected 401 locking a view session, got %d", w.Code)
+	}
+}
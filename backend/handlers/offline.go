@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"path/filepath"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// These run the admin actions straight on the data directory, for the
+// flatnas CLI when the server or its web UI is down. config.Init must have
+// run first.
+
+// userDataFile is where a user's dashboard and password live
+func userDataFile(username string) string {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if username == "admin" && sysConfig.AuthMode == "single" {
+		return filepath.Join(config.DataDir, "data.json")
+	}
+	return filepath.Join(config.UsersDir, username+".json")
+}
+
+// CreateUser adds a user the way POST /api/admin/users does
+func CreateUser(username, password string) error {
+	if username == "" || password == "" {
+		return errors.New("Username and password required")
+	}
+	if username == "admin" {
+		return errors.New("Cannot add admin user manually")
+	}
+	if !validUsername(username) {
+		return errors.New("Username may only contain letters, digits, '.', '_' and '-'")
+	}
+	userFile := filepath.Join(config.UsersDir, username+".json")
+	if _, err := utils.ModTime(userFile); err == nil {
+		return errors.New("User already exists")
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return err
+	}
+	return createUserFile(userFile, username, string(hashed))
+}
+
+// SetPassword replaces a user's password, admin included, e.g. to recover
+// a forgotten admin password
+func SetPassword(username, password string) error {
+	if password == "" {
+		return errors.New("Password required")
+	}
+	if !validUsername(username) {
+		return errors.New("Invalid username")
+	}
+	userFile := userDataFile(username)
+	if _, err := utils.ModTime(userFile); err != nil {
+		return errors.New("User not found")
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return err
+	}
+	return setUserPassword(userFile, string(hashed))
+}
+
+// ExportConfig returns a user's dashboard with the system config, shaped
+// like GET /api/data but unfiltered, minus the password hash
+func ExportConfig(username string) (map[string]interface{}, error) {
+	var userData map[string]interface{}
+	if err := utils.ReadJSON(userDataFile(username), &userData); err != nil {
+		return nil, err
+	}
+	if userData == nil {
+		return nil, errors.New("User data not found")
+	}
+	delete(userData, "password")
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	userData["systemConfig"] = sysConfig.Redacted()
+	return userData, nil
+}
+
+// RssFeedUrls lists the enabled feeds of the dashboard
+func RssFeedUrls() []string {
+	var payload map[string]interface{}
+	if err := utils.ReadJSON(filepath.Join(config.DataDir, "data.json"), &payload); err != nil {
+		return nil
+	}
+	return extractRssUrls(payload)
+}
+
+// RefreshRssFeed fetches one feed into the widget cache and returns
+// "ok", "notModified", "error" or "busy". Call FlushWidgetCache after the
+// last one so the cache file is written.
+func RefreshRssFeed(urlStr string) string {
+	return refreshRss(socketServer, urlStr)
+}
+
+// BackupNow writes a backup with the scheduled backup settings
+func BackupNow(ctx context.Context) (string, error) {
+	settings := loadBackupSettings()
+	if settings == nil || len(settings.Password) < backupMinPassword {
+		return "", errors.New("Backups are not configured")
+	}
+	name, err := runScheduledBackup(ctx, settings)
+	recordBackupRun(name, err)
+	return name, err
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestOfflineAdmin(t *testing.T) {
+	useTestConfig(t)
+	utils.WriteJSON(config.SystemConfigFile, map[string]interface{}{"authMode": "single"})
+	utils.WriteJSON(filepath.Join(config.DataDir, "data.json"), map[string]interface{}{
+		"password": "old",
+		"rssFeeds": []interface{}{map[string]interface{}{"url": "https://example.com/feed", "enable": true}},
+	})
+
+	if err := CreateUser("bob", "pw"); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if err := CreateUser("bob", "pw"); err == nil {
+		t.Fatalf("expected a duplicate user to be refused")
+	}
+	if err := SetPassword("admin", "new-password"); err != nil {
+		t.Fatalf("set admin password: %v", err)
+	}
+	exported, err := ExportConfig("admin")
+	if err != nil || exported["password"] != nil || exported["systemConfig"] == nil {
+		t.Fatalf("unexpected export %v (%v)", exported, err)
+	}
+	var admin map[string]interface{}
+	utils.ReadJSON(filepath.Join(config.DataDir, "data.json"), &admin)
+	if hash, _ := admin["password"].(string); bcrypt.CompareHashAndPassword([]byte(hash), []byte("new-password")) != nil {
+		t.Fatalf("admin password was not changed")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/rss/refresh", RefreshRssFeeds)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/rss/refresh", strings.NewReader(`{"urls":["http://169.254.169.254/"]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected feeds outside the config to be refused, got %d", w.Code)
+	}
+}
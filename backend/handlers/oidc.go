@@ -0,0 +1,573 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	oidcLoginTTL     = 10 * time.Minute
+	oidcDiscoveryTTL = time.Hour
+)
+
+var oidcDefaultScopes = []string{"openid", "profile", "email", "groups"}
+
+// The issuer is set by the admin and usually lives on the LAN, so these
+// requests are exempt from the outbound guard
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second, Transport: newProxyTransport()}
+
+// oidcProvider is the discovery document of the issuer and its signing keys
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+var oidcProviders = struct {
+	sync.Mutex
+	byIssuer map[string]*oidcProvider
+}{byIssuer: make(map[string]*oidcProvider)}
+
+// oidcLogin is a login in progress, keyed by its state parameter
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	redirect string
+	expires  time.Time
+}
+
+var oidcLogins = struct {
+	sync.Mutex
+	byState map[string]oidcLogin
+}{byState: make(map[string]oidcLogin)}
+
+func loadOidcSettings() (*models.OidcSettings, error) {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	o := sysConfig.Oidc
+	if o == nil || !o.Enable {
+		return nil, errors.New("single sign-on is not enabled")
+	}
+	if o.Issuer == "" || o.ClientId == "" {
+		return nil, errors.New("single sign-on is not configured")
+	}
+	return o, nil
+}
+
+// decodeOidcSettings reads the "oidc" field of a system config update. An
+// empty client secret keeps the stored one.
+func decodeOidcSettings(raw interface{}, current *models.OidcSettings) (*models.OidcSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid oidc settings")
+	}
+	settings := &models.OidcSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid oidc settings")
+	}
+	settings.Issuer = strings.TrimRight(strings.TrimSpace(settings.Issuer), "/")
+	settings.ClientId = strings.TrimSpace(settings.ClientId)
+	if settings.ClientSecret == "" && current != nil && current.ClientId == settings.ClientId {
+		settings.ClientSecret = current.ClientSecret
+	}
+	if settings.Enable {
+		u, err := url.Parse(settings.Issuer)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid oidc issuer")
+		}
+		if settings.ClientId == "" {
+			return nil, fmt.Errorf("oidc clientId is required")
+		}
+	}
+	return settings, nil
+}
+
+func discoverOidc(ctx context.Context, issuer string) (*oidcProvider, error) {
+	oidcProviders.Lock()
+	cached := oidcProviders.byIssuer[issuer]
+	oidcProviders.Unlock()
+	if cached != nil && time.Since(cached.fetched) < oidcDiscoveryTTL {
+		return cached, nil
+	}
+
+	provider := &oidcProvider{}
+	if err := oidcGetJSON(ctx, issuer+"/.well-known/openid-configuration", provider); err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+	if strings.TrimRight(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("issuer mismatch: provider reports %q", provider.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JwksUri == "" {
+		return nil, errors.New("discovery document is incomplete")
+	}
+	if err := provider.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	oidcProviders.Lock()
+	oidcProviders.byIssuer[issuer] = provider
+	oidcProviders.Unlock()
+	return provider, nil
+}
+
+func oidcGetJSON(ctx context.Context, rawUrl string, v interface{}) error {
+	req, err := http.NewRequestWithContext(allowOutbound(ctx), http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d from %s", resp.StatusCode, rawUrl)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+type oidcJWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (p *oidcProvider) refreshKeys(ctx context.Context) error {
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := oidcGetJSON(ctx, p.JwksUri, &set); err != nil {
+		return fmt.Errorf("fetching signing keys failed: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseOidcJWK(k)
+		if err != nil {
+			authLog.Warn("Skipping OIDC key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("provider publishes no usable signing keys")
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.fetched = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+func parseOidcJWK(k oidcJWK) (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid exponent")
+		}
+		exp := 0
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (p *oidcProvider) key(kid string) interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token and returns its claims. Unknown key IDs trigger one key refresh
+// to follow key rotation.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw, clientId, nonce string) (jwt.MapClaims, error) {
+	refreshed := false
+	keyfunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := p.key(kid)
+		if key == nil && !refreshed {
+			refreshed = true
+			if err := p.refreshKeys(ctx); err != nil {
+				return nil, err
+			}
+			key = p.key(kid)
+		}
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(clientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+// oidcGroups reads the groups claim, which providers send as a list or a
+// single string. Keycloak group paths ("/admins") also match "admins".
+func oidcGroups(claims jwt.MapClaims, claim string) []string {
+	var groups []string
+	switch v := claims[claim].(type) {
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	case string:
+		groups = stringList(v)
+	}
+	for i := range groups {
+		groups[i] = strings.TrimPrefix(strings.TrimSpace(groups[i]), "/")
+	}
+	return groups
+}
+
+func inAnyGroup(groups, wanted []string) bool {
+	for _, g := range groups {
+		for _, w := range wanted {
+			if strings.EqualFold(g, strings.TrimPrefix(strings.TrimSpace(w), "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mapOidcUser picks the FlatNas account for a signed-in identity
+func mapOidcUser(settings *models.OidcSettings, claims jwt.MapClaims) (string, error) {
+	groupsClaim := settings.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	usernameClaim := settings.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+	username, _ := claims[usernameClaim].(string)
+	return mapExternalUser(username, oidcGroups(claims, groupsClaim), settings.AdminGroups, settings.AllowedGroups)
+}
+
+// mapExternalUser maps an identity from SSO or a directory to an account:
+// admin for members of an admin group, otherwise a personal account of the
+// same name. With allowed groups set, other users are refused.
+func mapExternalUser(username string, groups, adminGroups, allowedGroups []string) (string, error) {
+	if len(adminGroups) > 0 && inAnyGroup(groups, adminGroups) {
+		return "admin", nil
+	}
+	if len(allowedGroups) > 0 && !inAnyGroup(groups, allowedGroups) {
+		return "", errors.New("your account is not in an allowed group")
+	}
+	username = strings.TrimSpace(username)
+	if username == "" || strings.EqualFold(username, "admin") || !validUsername(username) {
+		return "", fmt.Errorf("username %q cannot be used", username)
+	}
+	return username, nil
+}
+
+// ensureSsoAccount creates the account of a first-time SSO or directory
+// user. It gets an unguessable local password, so it is only reachable
+// through the external login until the admin sets one.
+func ensureSsoAccount(username string) error {
+	if username == "admin" {
+		return nil
+	}
+	userFile := filepath.Join(config.UsersDir, username+".json")
+	if _, err := utils.ModTime(userFile); err == nil {
+		return nil
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(randomURLToken(24)), 10)
+	if err != nil {
+		return err
+	}
+	return createUserFile(userFile, username, string(hashed))
+}
+
+func randomURLToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func oidcRedirectURL(c *gin.Context, settings *models.OidcSettings) string {
+	if settings.RedirectUrl != "" {
+		return settings.RedirectUrl
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	host := c.Request.Host
+	if fwd := c.GetHeader("X-Forwarded-Host"); fwd != "" {
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return scheme + "://" + host + "/api/auth/oidc/callback"
+}
+
+// safeLocalRedirect only allows paths on this site after login
+func safeLocalRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	if i := strings.Index(target, "#"); i >= 0 {
+		target = target[:i]
+	}
+	return target
+}
+
+func finishSsoRedirect(c *gin.Context, target string, fragment url.Values) {
+	c.Redirect(http.StatusFound, target+"#"+fragment.Encode())
+}
+
+// GetAuthProviders tells the login page which sign-in options exist
+func GetAuthProviders(c *gin.Context) {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	oidc := gin.H{"enabled": false}
+	if o := sysConfig.Oidc; o != nil && o.Enable && o.Issuer != "" && o.ClientId != "" {
+		name := o.Name
+		if name == "" {
+			name = "SSO"
+		}
+		oidc = gin.H{"enabled": true, "name": name, "loginUrl": "/api/auth/oidc/login"}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"oidc": oidc}})
+}
+
+// OidcLogin sends the browser to the provider, using PKCE and a nonce
+func OidcLogin(c *gin.Context) {
+	settings, err := loadOidcSettings()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	provider, err := discoverOidc(c.Request.Context(), settings.Issuer)
+	if err != nil {
+		authLog.Error("OIDC discovery failed", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	state := randomURLToken(24)
+	login := oidcLogin{
+		nonce:    randomURLToken(24),
+		verifier: randomURLToken(32),
+		redirect: safeLocalRedirect(c.DefaultQuery("redirect", "/")),
+		expires:  time.Now().Add(oidcLoginTTL),
+	}
+	oidcLogins.Lock()
+	now := time.Now()
+	for k, v := range oidcLogins.byState {
+		if now.After(v.expires) {
+			delete(oidcLogins.byState, k)
+		}
+	}
+	oidcLogins.byState[state] = login
+	oidcLogins.Unlock()
+
+	scopes := settings.Scopes
+	if len(scopes) == 0 {
+		scopes = oidcDefaultScopes
+	}
+	challenge := sha256.Sum256([]byte(login.verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {settings.ClientId},
+		"redirect_uri":          {oidcRedirectURL(c, settings)},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	c.Redirect(http.StatusFound, provider.AuthorizationEndpoint+sep+q.Encode())
+}
+
+// OidcCallback completes the login and hands the FlatNas token to the
+// frontend in the URL fragment, which never reaches server logs.
+func OidcCallback(c *gin.Context) {
+	state := c.Query("state")
+	oidcLogins.Lock()
+	login, ok := oidcLogins.byState[state]
+	delete(oidcLogins.byState, state)
+	oidcLogins.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		finishSsoRedirect(c, "/", url.Values{"sso_error": {"Login expired, please try again"}})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		msg := c.DefaultQuery("error_description", e)
+		finishSsoRedirect(c, login.redirect, url.Values{"sso_error": {msg}})
+		return
+	}
+
+	username, err := completeOidcLogin(c, login)
+	if err != nil {
+		authLog.Warn("OIDC login failed", "error", err)
+		middleware.RecordAudit(models.AuditEntry{IP: c.ClientIP(), Action: "login.oidc", Details: map[string]string{"error": err.Error()}})
+		finishSsoRedirect(c, login.redirect, url.Values{"sso_error": {err.Error()}})
+		return
+	}
+	token, err := issueSessionToken(username)
+	if err != nil {
+		finishSsoRedirect(c, login.redirect, url.Values{"sso_error": {"Failed to sign token"}})
+		return
+	}
+	middleware.RecordAudit(models.AuditEntry{User: username, IP: c.ClientIP(), Action: "login.oidc", Success: true})
+	finishSsoRedirect(c, login.redirect, url.Values{"sso_token": {token}, "sso_user": {username}})
+}
+
+func completeOidcLogin(c *gin.Context, login oidcLogin) (string, error) {
+	settings, err := loadOidcSettings()
+	if err != nil {
+		return "", err
+	}
+	ctx := c.Request.Context()
+	provider, err := discoverOidc(ctx, settings.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {c.Query("code")},
+		"redirect_uri":  {oidcRedirectURL(c, settings)},
+		"client_id":     {settings.ClientId},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequestWithContext(allowOutbound(ctx), http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if settings.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(settings.ClientId), url.QueryEscape(settings.ClientSecret))
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("token response unreadable: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		if tokens.Error != "" {
+			return "", fmt.Errorf("token request refused: %s %s", tokens.Error, tokens.ErrorDescription)
+		}
+		return "", fmt.Errorf("token request failed with status %d", resp.StatusCode)
+	}
+
+	claims, err := provider.verifyIDToken(ctx, tokens.IDToken, settings.ClientId, login.nonce)
+	if err != nil {
+		return "", fmt.Errorf("invalid ID token: %w", err)
+	}
+	username, err := mapOidcUser(settings, claims)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureSsoAccount(username); err != nil {
+		return "", fmt.Errorf("creating account failed: %w", err)
+	}
+	return username, nil
+}
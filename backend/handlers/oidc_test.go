@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"flatnasgo-backend/models"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestOidcVerifyAndMapUser(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	provider := &oidcProvider{Issuer: "https://sso.example", keys: map[string]interface{}{"k1": &key.PublicKey}, fetched: time.Now()}
+	sign := func(claims jwt.MapClaims) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = "k1"
+		raw, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return raw
+	}
+	base := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "https://sso.example", "aud": "flatnas", "exp": time.Now().Add(time.Hour).Unix(),
+			"nonce": "n1", "preferred_username": "mom", "groups": []interface{}{"/family"},
+		}
+	}
+
+	claims, err := provider.verifyIDToken(context.Background(), sign(base()), "flatnas", "n1")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	settings := &models.OidcSettings{AdminGroups: []string{"admins"}, AllowedGroups: []string{"family"}}
+	if user, err := mapOidcUser(settings, claims); err != nil || user != "mom" {
+		t.Fatalf("expected mom, got %q %v", user, err)
+	}
+	settings.AllowedGroups = []string{"kids"}
+	if _, err := mapOidcUser(settings, claims); err == nil {
+		t.Fatalf("expected user outside allowed groups to be refused")
+	}
+	settings.AdminGroups = []string{"family"}
+	if user, _ := mapOidcUser(settings, claims); user != "admin" {
+		t.Fatalf("expected admin group to map to admin, got %q", user)
+	}
+
+	if _, err := provider.verifyIDToken(context.Background(), sign(base()), "flatnas", "other"); err == nil {
+		t.Fatalf("expected nonce mismatch to fail")
+	}
+	wrongAud := base()
+	wrongAud["aud"] = "someone-else"
+	if _, err := provider.verifyIDToken(context.Background(), sign(wrongAud), "flatnas", "n1"); err == nil {
+		t.Fatalf("expected wrong audience to fail")
+	}
+	if safeLocalRedirect("//evil.example") != "/" || safeLocalRedirect("/dash?x=1") != "/dash?x=1" {
+		t.Fatalf("unexpected redirect sanitizing")
+	}
+}
@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/logging"
+	"flatnasgo-backend/models"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The OpenAPI document is generated from the registered gin routes. Request
+// and response bodies come from the Go types below, so they follow the
+// structs as they change; routes without an entry get a generic JSON body.
+var openAPIRequests = map[string]interface{}{
+	"Login":              models.LoginRequest{},
+	"CreateApiToken":     CreateApiTokenRequest{},
+	"SaveMemo":           SaveMemoPayload{},
+	"UpdateSystemConfig": models.SystemConfig{},
+	"SaveWebhook":        Webhook{},
+	"SaveInboundHook":    InboundHook{},
+	"SavePlugin":         PluginConfig{},
+	"RenameFile":         FileOpRequest{},
+	"MoveFiles":          FileOpRequest{},
+	"CopyFiles":          FileOpRequest{},
+	"DeleteFiles":        FileOpRequest{},
+	"ExtractArchive":     ExtractRequest{},
+	"CreateArchive":      ArchiveRequest{},
+	"ScanFolder":         ScanRequest{},
+	"SetFileTags":        FileTagsRequest{},
+	"StarFiles":          StarRequest{},
+	"SaveTextFile":       TextFileRequest{},
+	"OpenOfficeFile":     OfficeOpenRequest{},
+	"CreateAlbum":        AlbumRequest{},
+	"UpdateAlbum":        AlbumRequest{},
+	"SetAlbumItems":      AlbumItemsRequest{},
+	"SetPhotoPeople":     PhotoPeopleRequest{},
+	"RestoreTrash":       TrashRequest{},
+	"EmptyTrash":         TrashRequest{},
+	"RestoreFileVersion": VersionRequest{},
+	"DeleteFileVersions": VersionRequest{},
+	"CreateShareLink":    CreateShareLinkRequest{},
+	"AddSftpKey":         AddSftpKeyRequest{},
+	"SaveSambaShare":     SambaShare{},
+	"SaveNfsExport":      NfsExport{},
+	"DuplicateAction":    DupeActionRequest{},
+	"SaveSyncJob":        SyncJob{},
+	"SaveRemoteMount":    RemoteMount{},
+	"RaidSyncAction":     RaidActionRequest{},
+	"AddRaidSpare":       RaidActionRequest{},
+	"ScrubPool":          ScrubRequest{},
+	"SaveScrubSchedule":  ScrubSchedule{},
+}
+
+var openAPIResponses = map[string]interface{}{
+	"GetApiTokens":         []models.ApiToken{},
+	"GetAuditLog":          []models.AuditEntry{},
+	"GetWebhookDeliveries": []WebhookDelivery{},
+	"GetInboundHooks":      []InboundHook{},
+	"GetLogs":              []logging.Record{},
+	"GetFileShares":        []models.FileShare{},
+	"GetUploads":           []UploadProgress{},
+	"UploadStatus":         UploadProgress{},
+	"EstimateZip":          ZipEstimate{},
+	"GetQuarantine":        []QuarantineEntry{},
+	"GetFileTags":          []FileTagCount{},
+	"GetTextFile":          TextFile{},
+	"GetOffice":            OfficeStatus{},
+	"OpenOfficeFile":       OfficeSession{},
+	"CreateAlbum":          PhotoAlbum{},
+	"UpdateAlbum":          PhotoAlbum{},
+	"GetPhotoPeople":       []PersonGroup{},
+	"GetMusicAlbum":        MusicAlbumItem{},
+	"GetShareLinks":        []models.ShareLink{},
+	"GetPublicShareLink":   ShareLinkInfo{},
+	"GetSambaShares":       []SambaShare{},
+	"GetSambaStatus":       SambaStatus{},
+	"GetNfsExports":        []NfsExport{},
+	"GetNfsClients":        []NfsClient{},
+	"GetLargestUsage":      []UsageFile{},
+	"ScanDiskUsage":        UsageStatus{},
+	"ScanDuplicates":       DupeStatus{},
+	"GetSearchStatus":      []SearchShareStatus{},
+	"CheckIntegrity":       IntegrityStatus{},
+	"RunSyncJob":           SyncRun{},
+	"GetSyncRuns":          []SyncRun{},
+	"GetSyncRun":           SyncRun{},
+	"GetSnapshotVolumes":   []SnapshotVolume{},
+	"GetSnapshots":         []Snapshot{},
+	"GetRemoteMounts":      []RemoteMountInfo{},
+	"SaveRemoteMount":      RemoteMountInfo{},
+	"MountRemote":          RemoteMountInfo{},
+	"GetUserQuota":         QuotaUsage{},
+	"GetSmartHistory":      []SmartHistoryPoint{},
+	"GetRaidArrays":        []RaidArray{},
+	"AddRaidSpare":         RaidArray{},
+	"GetPools":             []Zpool{},
+}
+
+var openAPIDoc struct {
+	sync.RWMutex
+	spec []byte
+}
+
+// SetOpenAPIRoutes builds the document served at /api/openapi.json. public
+// are the routes that need no login; all other /api routes take a bearer
+// token (a login JWT or an API token).
+func SetOpenAPIRoutes(routes, public gin.RoutesInfo) {
+	open := make(map[string]bool, len(public))
+	for _, r := range public {
+		open[r.Method+" "+r.Path] = true
+	}
+	spec, err := json.Marshal(buildOpenAPI(routes, open))
+	if err != nil {
+		dataLog.Error("Failed to build OpenAPI document", "error", err)
+		return
+	}
+	openAPIDoc.Lock()
+	openAPIDoc.spec = spec
+	openAPIDoc.Unlock()
+}
+
+// GetOpenAPI serves the OpenAPI 3 document of the REST API
+func GetOpenAPI(c *gin.Context) {
+	openAPIDoc.RLock()
+	spec := openAPIDoc.spec
+	openAPIDoc.RUnlock()
+	if spec == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "API description not ready"})
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", spec)
+}
+
+type openAPIBuilder struct {
+	schemas map[string]interface{}
+}
+
+func buildOpenAPI(routes gin.RoutesInfo, public map[string]bool) map[string]interface{} {
+	b := &openAPIBuilder{schemas: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+	sorted := append(gin.RoutesInfo(nil), routes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Path != sorted[j].Path {
+			return sorted[i].Path < sorted[j].Path
+		}
+		return sorted[i].Method < sorted[j].Method
+	})
+	usedIDs := make(map[string]int)
+	for _, r := range sorted {
+		if !strings.HasPrefix(r.Path, "/api/") {
+			continue
+		}
+		path, params := openAPIPath(r.Path)
+		name := handlerName(r.Handler)
+		id := name
+		if id == "" {
+			id = operationIDFromPath(r.Method, r.Path)
+		}
+		if usedIDs[id]++; usedIDs[id] > 1 {
+			id = operationIDFromPath(r.Method, r.Path)
+		}
+		op := map[string]interface{}{
+			"operationId": lowerFirst(id),
+			"summary":     splitWords(id),
+			"tags":        []string{openAPITag(r.Path)},
+			"responses":   b.responses(name),
+		}
+		if len(params) > 0 {
+			list := make([]interface{}, 0, len(params))
+			for _, p := range params {
+				list = append(list, map[string]interface{}{
+					"name":     p,
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+			op["parameters"] = list
+		}
+		if body := b.requestBody(name, r.Method); body != nil {
+			op["requestBody"] = body
+		}
+		if public[r.Method+" "+r.Path] {
+			op["security"] = []interface{}{}
+		}
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(r.Method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "FlatNas API",
+			"version": "1",
+		},
+		"paths":    paths,
+		"security": []interface{}{map[string]interface{}{"bearerAuth": []string{}}},
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+			"schemas": b.schemas,
+		},
+	}
+}
+
+func (b *openAPIBuilder) requestBody(handler, method string) map[string]interface{} {
+	schema := map[string]interface{}{"type": "object"}
+	if v, ok := openAPIRequests[handler]; ok {
+		schema = b.schema(reflect.TypeOf(v))
+	} else if method != http.MethodPost && method != http.MethodPut && method != http.MethodPatch {
+		return nil
+	}
+	return map[string]interface{}{
+		"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+	}
+}
+
+func (b *openAPIBuilder) responses(handler string) map[string]interface{} {
+	ok := map[string]interface{}{"description": "Success"}
+	if v, found := openAPIResponses[handler]; found {
+		ok["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"success": map[string]interface{}{"type": "boolean"},
+				"data":    b.schema(reflect.TypeOf(v)),
+			},
+		}}}
+	}
+	errorBody := map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+		"$ref": "#/components/schemas/Error",
+	}}}
+	b.schemas["Error"] = map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"error": map[string]interface{}{"type": "string"}},
+	}
+	return map[string]interface{}{
+		"200":     ok,
+		"default": map[string]interface{}{"description": "Error", "content": errorBody},
+	}
+}
+
+// schema describes t, adding named structs to components.schemas
+func (b *openAPIBuilder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		name := t.Name()
+		if name == "" {
+			return b.structSchema(t)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, done := b.schemas[name]; !done {
+			b.schemas[name] = map[string]interface{}{} // Placeholder for recursive types
+			b.schemas[name] = b.structSchema(t)
+		}
+		return ref
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (b *openAPIBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			for k, v := range b.structSchema(f.Type)["properties"].(map[string]interface{}) {
+				props[k] = v
+			}
+			continue
+		}
+		props[name] = b.schema(f.Type)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// openAPIPath turns gin's :param and *param into {param}
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") || strings.HasPrefix(p, "*") {
+			params = append(params, p[1:])
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+// openAPITag groups routes by their first path segment after /api (and
+// /admin)
+func openAPITag(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/api/"), "/")
+	if parts[0] == "admin" && len(parts) > 1 {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+// handlerName is the function name of a named handler, "" for closures
+func handlerName(full string) string {
+	name := full[strings.LastIndex(full, ".")+1:]
+	if strings.HasPrefix(name, "func") || name == "" {
+		return ""
+	}
+	return name
+}
+
+func operationIDFromPath(method, path string) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(method))
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if part == "api" {
+			continue
+		}
+		sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return sb.String()
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// splitWords turns GetWebhookDeliveries into "Get webhook deliveries"
+func splitWords(s string) string {
+	var sb strings.Builder
+	for i, r := range s {
+		if i > 0 && unicode.IsUpper(r) {
+			sb.WriteByte(' ')
+			r = unicode.ToLower(r)
+		}
+		if i == 0 {
+			r = unicode.ToUpper(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBuildOpenAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/login", Login)
+	public := r.Routes()
+	r.DELETE("/api/admin/webhooks/:id", DeleteWebhook)
+	r.GET("/api/admin/audit", GetAuditLog)
+	SetOpenAPIRoutes(r.Routes(), public)
+
+	w := httptest.NewRecorder()
+	GetOpenAPI(func() *gin.Context { c, _ := gin.CreateTestContext(w); return c }())
+	var doc struct {
+		Paths map[string]map[string]struct {
+			OperationID string        `json:"operationId"`
+			Security    []interface{} `json:"security"`
+			Parameters  []struct {
+				Name string `json:"name"`
+			} `json:"parameters"`
+			RequestBody *struct {
+				Content map[string]struct {
+					Schema map[string]interface{} `json:"schema"`
+				} `json:"content"`
+			} `json:"requestBody"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	login := doc.Paths["/api/login"]["post"]
+	if login.OperationID != "login" || login.Security == nil || len(login.Security) != 0 {
+		t.Fatalf("login operation = %+v, want a public operation", login)
+	}
+	if login.RequestBody == nil || login.RequestBody.Content["application/json"].Schema["$ref"] != "#/components/schemas/LoginRequest" {
+		t.Fatalf("login body not described: %+v", login.RequestBody)
+	}
+	del := doc.Paths["/api/admin/webhooks/{id}"]["delete"]
+	if del.OperationID != "deleteWebhook" || del.Security != nil || len(del.Parameters) != 1 || del.Parameters[0].Name != "id" {
+		t.Fatalf("delete operation = %+v", del)
+	}
+	if _, ok := doc.Components.Schemas["AuditEntry"]; !ok {
+		t.Fatalf("AuditEntry schema missing")
+	}
+}
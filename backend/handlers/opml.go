@@ -0,0 +1,368 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+	"golang.org/x/net/html/charset"
+)
+
+const maxOpmlSize = 5 << 20
+
+type OpmlDocument struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Head    OpmlHead      `xml:"head"`
+	Body    []OpmlOutline `xml:"body>outline"`
+}
+
+type OpmlHead struct {
+	Title       string `xml:"title"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type OpmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XmlUrl   string        `xml:"xmlUrl,attr,omitempty"`
+	HtmlUrl  string        `xml:"htmlUrl,attr,omitempty"`
+	Outlines []OpmlOutline `xml:"outline"`
+}
+
+// opmlFeed is a subscription flattened out of the outline tree
+type opmlFeed struct {
+	Title    string
+	Url      string
+	Category string
+}
+
+type OpmlImportResult struct {
+	Added      int      `json:"added"`
+	Skipped    int      `json:"skipped"`
+	Categories []string `json:"categories"`
+	Version    int64    `json:"version"`
+}
+
+func BindOpmlHandlers(server *socketio.Server) {
+	bindEvent(server, "rss:import-opml", func(s socketio.Conn, msg interface{}) {
+		m, _ := msg.(map[string]interface{})
+		token, _ := m["token"].(string)
+		username, ok := validateSocketToken(token)
+		if !ok {
+			s.Emit("rss:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		content, _ := m["opml"].(string)
+		result, err := importOpmlForUser(username, []byte(content))
+		if err != nil {
+			s.Emit("rss:error", map[string]interface{}{"error": err.Error()})
+			return
+		}
+		s.Emit("rss:opmlImported", result)
+	})
+
+	bindEvent(server, "rss:export-opml", func(s socketio.Conn, msg interface{}) {
+		token, _ := parseTokenPayload(msg)
+		username, ok := validateSocketToken(token)
+		if !ok {
+			s.Emit("rss:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		data, err := exportOpmlForUser(username)
+		if err != nil {
+			s.Emit("rss:error", map[string]interface{}{"error": err.Error()})
+			return
+		}
+		s.Emit("rss:opmlExported", map[string]interface{}{"opml": string(data)})
+	})
+}
+
+// ImportOpml accepts either a multipart "file" field or a raw OPML request body
+func ImportOpml(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var content []byte
+	if file, err := c.FormFile("file"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+			return
+		}
+		defer f.Close()
+		content, err = io.ReadAll(io.LimitReader(f, maxOpmlSize+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+			return
+		}
+	} else {
+		content, err = io.ReadAll(io.LimitReader(c.Request.Body, maxOpmlSize+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body"})
+			return
+		}
+	}
+	if len(content) > maxOpmlSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "OPML file too large"})
+		return
+	}
+
+	result, err := importOpmlForUser(username, content)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": result})
+}
+
+func ExportOpml(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	data, err := exportOpmlForUser(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=\"flatnas-subscriptions.opml\"")
+	c.Data(http.StatusOK, "text/x-opml; charset=utf-8", data)
+}
+
+func resolveUserDataFile(username string) string {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	userFile := filepath.Join(config.UsersDir, username+".json")
+	if username == "admin" && sysConfig.AuthMode == "single" {
+		userFile = filepath.Join(config.DataDir, "data.json")
+	}
+	return userFile
+}
+
+func importOpmlForUser(username string, content []byte) (*OpmlImportResult, error) {
+	feeds, err := parseOpml(content)
+	if err != nil {
+		return nil, err
+	}
+
+	userFile := resolveUserDataFile(username)
+	var result *OpmlImportResult
+	err = utils.WithFileLock(userFile, func() error {
+		var userData map[string]interface{}
+		if err := utils.ReadJSONUnlocked(userFile, &userData); err != nil {
+			return fmt.Errorf("user data not found")
+		}
+		result = mergeOpmlFeeds(userData, feeds)
+		result.Version = normalizeVersion(userData["version"]) + 1
+		userData["version"] = result.Version
+		return utils.WriteJSONUnlocked(userFile, userData)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	broadcastAll("data-updated", map[string]interface{}{
+		"username": username,
+		"version":  result.Version,
+	})
+	return result, nil
+}
+
+func exportOpmlForUser(username string) ([]byte, error) {
+	var userData map[string]interface{}
+	if err := utils.ReadJSON(resolveUserDataFile(username), &userData); err != nil {
+		return nil, fmt.Errorf("user data not found")
+	}
+	return buildOpml(userData)
+}
+
+func parseOpml(content []byte) ([]opmlFeed, error) {
+	var doc OpmlDocument
+	decoder := xml.NewDecoder(bytes.NewReader(trimXMLPreamble(content)))
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid OPML: %v", err)
+	}
+	feeds := make([]opmlFeed, 0)
+	collectOpmlFeeds(doc.Body, "", &feeds)
+	if len(feeds) == 0 {
+		return nil, fmt.Errorf("no feeds found in OPML")
+	}
+	return feeds, nil
+}
+
+// collectOpmlFeeds walks the outline tree. Outlines without an xmlUrl are
+// folders; a feed is filed under the innermost folder that contains it.
+func collectOpmlFeeds(outlines []OpmlOutline, category string, out *[]opmlFeed) {
+	for _, o := range outlines {
+		title := strings.TrimSpace(o.Title)
+		if title == "" {
+			title = strings.TrimSpace(o.Text)
+		}
+		feedUrl := strings.TrimSpace(o.XmlUrl)
+		if feedUrl != "" {
+			if title == "" {
+				title = feedUrl
+			}
+			*out = append(*out, opmlFeed{Title: title, Url: feedUrl, Category: category})
+		}
+		if len(o.Outlines) > 0 {
+			next := category
+			if feedUrl == "" && title != "" {
+				next = title
+			}
+			collectOpmlFeeds(o.Outlines, next, out)
+		}
+	}
+}
+
+func mergeOpmlFeeds(userData map[string]interface{}, feeds []opmlFeed) *OpmlImportResult {
+	existingFeeds, _ := userData["rssFeeds"].([]interface{})
+	existingCategories, _ := userData["rssCategories"].([]interface{})
+
+	knownUrls := make(map[string]struct{})
+	for _, f := range existingFeeds {
+		if fm, ok := f.(map[string]interface{}); ok {
+			if u, ok := fm["url"].(string); ok {
+				knownUrls[strings.TrimSpace(u)] = struct{}{}
+			}
+		}
+	}
+	knownCategories := make(map[string]struct{})
+	for _, c := range existingCategories {
+		if cm, ok := c.(map[string]interface{}); ok {
+			if name, ok := cm["name"].(string); ok {
+				knownCategories[name] = struct{}{}
+			}
+		}
+	}
+
+	result := &OpmlImportResult{Categories: []string{}}
+	baseID := time.Now().UnixMilli()
+	for i, feed := range feeds {
+		if _, exists := knownUrls[feed.Url]; exists {
+			result.Skipped++
+			continue
+		}
+		knownUrls[feed.Url] = struct{}{}
+		entry := map[string]interface{}{
+			"id":       strconv.FormatInt(baseID+int64(i), 10),
+			"url":      feed.Url,
+			"title":    feed.Title,
+			"enable":   true,
+			"isPublic": false,
+		}
+		if feed.Category != "" {
+			entry["category"] = feed.Category
+			if _, exists := knownCategories[feed.Category]; !exists {
+				knownCategories[feed.Category] = struct{}{}
+				existingCategories = append(existingCategories, map[string]interface{}{
+					"id":    strconv.FormatInt(baseID+int64(i), 10) + "-cat",
+					"name":  feed.Category,
+					"feeds": []interface{}{},
+				})
+				result.Categories = append(result.Categories, feed.Category)
+			}
+		}
+		existingFeeds = append(existingFeeds, entry)
+		result.Added++
+	}
+
+	if existingFeeds == nil {
+		existingFeeds = []interface{}{}
+	}
+	if existingCategories == nil {
+		existingCategories = []interface{}{}
+	}
+	userData["rssFeeds"] = existingFeeds
+	userData["rssCategories"] = existingCategories
+	return result
+}
+
+func buildOpml(userData map[string]interface{}) ([]byte, error) {
+	doc := OpmlDocument{
+		Version: "2.0",
+		Head: OpmlHead{
+			Title:       "FlatNas RSS Subscriptions",
+			DateCreated: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+
+	folders := make(map[string]*OpmlOutline)
+	order := make([]string, 0)
+	if categories, ok := userData["rssCategories"].([]interface{}); ok {
+		for _, c := range categories {
+			cm, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := cm["name"].(string)
+			if name == "" || folders[name] != nil {
+				continue
+			}
+			folders[name] = &OpmlOutline{Text: name, Title: name}
+			order = append(order, name)
+		}
+	}
+
+	loose := make([]OpmlOutline, 0)
+	feeds, _ := userData["rssFeeds"].([]interface{})
+	for _, f := range feeds {
+		fm, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		feedUrl, _ := fm["url"].(string)
+		feedUrl = strings.TrimSpace(feedUrl)
+		if feedUrl == "" {
+			continue
+		}
+		title, _ := fm["title"].(string)
+		if title == "" {
+			title = feedUrl
+		}
+		outline := OpmlOutline{Text: title, Title: title, Type: "rss", XmlUrl: feedUrl}
+		category, _ := fm["category"].(string)
+		if category == "" {
+			loose = append(loose, outline)
+			continue
+		}
+		folder := folders[category]
+		if folder == nil {
+			folder = &OpmlOutline{Text: category, Title: category}
+			folders[category] = folder
+			order = append(order, category)
+		}
+		folder.Outlines = append(folder.Outlines, outline)
+	}
+
+	for _, name := range order {
+		if len(folders[name].Outlines) > 0 {
+			doc.Body = append(doc.Body, *folders[name])
+		}
+	}
+	doc.Body = append(doc.Body, loose...)
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
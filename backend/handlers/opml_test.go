@@ -0,0 +1,52 @@
+package handlers
+
+import "testing"
+
+func TestParseOpmlNestedOutlines(t *testing.T) {
+	content := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<opml version="2.0">
+  <head><title>Feedly</title></head>
+  <body>
+    <outline text="Tech">
+      <outline text="Go Blog" type="rss" xmlUrl="https://go.dev/blog/feed.atom"/>
+      <outline text="Languages">
+        <outline title="Rust" text="rust" type="rss" xmlUrl="https://blog.rust-lang.org/feed.xml"/>
+      </outline>
+    </outline>
+    <outline text="Loose" type="rss" xmlUrl="https://example.com/rss"/>
+  </body>
+</opml>`)
+
+	feeds, err := parseOpml(content)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(feeds) != 3 {
+		t.Fatalf("expected 3 feeds, got %d", len(feeds))
+	}
+	if feeds[0].Category != "Tech" || feeds[1].Category != "Languages" || feeds[1].Title != "Rust" || feeds[2].Category != "" {
+		t.Fatalf("unexpected feeds: %+v", feeds)
+	}
+
+	userData := map[string]interface{}{
+		"rssFeeds": []interface{}{
+			map[string]interface{}{"id": "1", "url": "https://example.com/rss", "title": "Existing"},
+		},
+	}
+	result := mergeOpmlFeeds(userData, feeds)
+	if result.Added != 2 || result.Skipped != 1 || len(result.Categories) != 2 {
+		t.Fatalf("unexpected merge result: %+v", result)
+	}
+
+	exported, err := buildOpml(userData)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	roundTrip, err := parseOpml(exported)
+	if err != nil {
+		t.Fatalf("reparse: %v", err)
+	}
+	if len(roundTrip) != 3 {
+		t.Fatalf("expected 3 feeds after round trip, got %d", len(roundTrip))
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// outboundSnapshot is the network configuration every outbound client is
+// built from: proxy profiles, routing rules, the guard, and the shared
+// client made from them.
+type outboundSnapshot struct {
+	stamp      string
+	profiles   []proxyProfile
+	profileErr error
+	router     *proxyRouter
+	guard      outboundGuard
+	client     *http.Client
+	clientErr  error
+}
+
+var (
+	outboundMu      sync.Mutex
+	outboundCurrent *outboundSnapshot
+)
+
+// outboundEnvKeys are the environment variables the snapshot depends on
+var outboundEnvKeys = []string{"PROXY_URL", "HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy", "OUTBOUND_ALLOWLIST"}
+
+// outboundStamp changes whenever system.json or the environment does, so
+// edits made outside the UI are picked up too.
+func outboundStamp() string {
+	var b strings.Builder
+	if mod, err := utils.ModTime(config.SystemConfigFile); err == nil {
+		fmt.Fprintf(&b, "%d", mod.UnixNano())
+	}
+	for _, key := range outboundEnvKeys {
+		b.WriteString("|" + os.Getenv(key))
+	}
+	return b.String()
+}
+
+// currentOutbound returns the snapshot for the current settings, building a
+// new one (and new clients) when they changed.
+func currentOutbound() *outboundSnapshot {
+	stamp := outboundStamp()
+	outboundMu.Lock()
+	defer outboundMu.Unlock()
+	if outboundCurrent != nil && outboundCurrent.stamp == stamp {
+		return outboundCurrent
+	}
+	old := outboundCurrent
+	outboundCurrent = buildOutboundSnapshot(stamp)
+	if old != nil && old.client != nil {
+		old.client.CloseIdleConnections()
+	}
+	return outboundCurrent
+}
+
+func buildOutboundSnapshot(stamp string) *outboundSnapshot {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	snapshot := &outboundSnapshot{
+		stamp:  stamp,
+		router: newProxyRouter(sysConfig.ProxyRules),
+		guard:  outboundGuardFrom(&sysConfig),
+	}
+	snapshot.profiles, snapshot.profileErr = proxyProfilesFrom(&sysConfig)
+	if snapshot.profileErr != nil && len(snapshot.profiles) == 0 {
+		snapshot.clientErr = snapshot.profileErr
+		return snapshot
+	}
+	var transport http.RoundTripper = newProxyTransport()
+	if len(snapshot.profiles) > 0 {
+		failover, err := newFailoverTransport(snapshot.profiles, snapshot.router)
+		if err != nil {
+			snapshot.clientErr = err
+			return snapshot
+		}
+		transport = failover
+	}
+	snapshot.client = &http.Client{Timeout: 20 * time.Second, Transport: transport}
+	return snapshot
+}
+
+// reloadOutboundClients drops the snapshot so the next request rebuilds
+// every client from the saved settings.
+func reloadOutboundClients() {
+	outboundMu.Lock()
+	old := outboundCurrent
+	outboundCurrent = nil
+	outboundMu.Unlock()
+	if old != nil && old.client != nil {
+		old.client.CloseIdleConnections()
+	}
+	rssDirectTransport.CloseIdleConnections()
+}
+
+func BindNetworkSettingsHandlers(server *socketio.Server) {
+	bindEvent(server, "proxy:update", func(s socketio.Conn, msg interface{}) {
+		token, _ := parseTokenPayload(msg)
+		if !socketAdmin(token) {
+			s.Emit("proxy:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		payload, _ := msg.(map[string]interface{})
+		sysConfig, err := updateNetworkSettings(payload)
+		username, _ := validateSocketToken(token)
+		middleware.RecordAudit(models.AuditEntry{User: username, IP: socketClientIP(s), Action: "config.network", Success: err == nil})
+		if err != nil {
+			s.Emit("proxy:error", map[string]interface{}{"error": err.Error()})
+			return
+		}
+		broadcastAll("proxy:updated", networkSettingsView(sysConfig))
+	})
+}
+
+// updateNetworkSettings saves the network fields of payload to the system
+// config and applies them immediately.
+func updateNetworkSettings(payload map[string]interface{}) (models.SystemConfig, error) {
+	var sysConfig models.SystemConfig
+	err := utils.WithFileLock(config.SystemConfigFile, func() error {
+		if err := utils.ReadJSONUnlocked(config.SystemConfigFile, &sysConfig); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := applyNetworkSettings(&sysConfig, payload); err != nil {
+			return err
+		}
+		return utils.WriteJSONUnlocked(config.SystemConfigFile, sysConfig)
+	})
+	if err != nil {
+		return sysConfig, err
+	}
+	reloadOutboundClients()
+	proxyLog.Info("Network settings updated; outbound clients rebuilt")
+	return sysConfig, nil
+}
+
+// applyNetworkSettings copies the proxy, routing and guard fields present in
+// payload onto sysConfig.
+func applyNetworkSettings(sysConfig *models.SystemConfig, payload map[string]interface{}) error {
+	if raw, ok := payload["proxy"]; ok {
+		proxySettings, err := decodeProxySettings(raw, sysConfig.Proxy)
+		if err != nil {
+			return err
+		}
+		sysConfig.Proxy = proxySettings
+	}
+	if raw, ok := payload["proxies"]; ok {
+		proxies, err := decodeProxyList(raw, sysConfig.Proxies)
+		if err != nil {
+			return err
+		}
+		sysConfig.Proxies = proxies
+	}
+	if raw, ok := payload["outboundGuard"].(map[string]interface{}); ok {
+		disable, _ := raw["disable"].(bool)
+		sysConfig.OutboundGuard = &models.OutboundGuard{
+			Disable: disable,
+			Allow:   normalizeHostPatterns(stringList(raw["allow"])),
+		}
+	}
+	if raw, ok := payload["proxyRules"]; ok {
+		sysConfig.ProxyRules = decodeProxyRules(raw)
+	}
+	return nil
+}
+
+func networkSettingsView(sysConfig models.SystemConfig) map[string]interface{} {
+	redacted := sysConfig.Redacted()
+	return map[string]interface{}{
+		"proxy":         redacted.Proxy,
+		"proxies":       redacted.Proxies,
+		"proxyRules":    redacted.ProxyRules,
+		"outboundGuard": redacted.OutboundGuard,
+	}
+}
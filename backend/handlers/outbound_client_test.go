@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func TestUpdateNetworkSettingsReloadsClients(t *testing.T) {
+	useTestConfig(t)
+	defer reloadOutboundClients()
+	reloadOutboundClients()
+	before, _ := getSharedProxyClient()
+
+	_, err := updateNetworkSettings(map[string]interface{}{
+		"proxy": map[string]interface{}{"type": "socks5", "host": "127.0.0.1", "port": float64(1080)},
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	proxyURL, err := getProxyURL()
+	if err != nil || proxyURL == nil || proxyURL.String() != "socks5://127.0.0.1:1080" {
+		t.Fatalf("expected new proxy to apply immediately, got %v %v", proxyURL, err)
+	}
+	if after, _ := getSharedProxyClient(); after == before {
+		t.Fatalf("expected the shared client to be rebuilt")
+	}
+	if _, err := updateNetworkSettings(map[string]interface{}{"proxy": map[string]interface{}{"type": "ftp", "host": "h", "port": float64(1)}}); err == nil {
+		t.Fatalf("expected invalid proxy to be rejected")
+	}
+}
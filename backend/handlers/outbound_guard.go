@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"flatnasgo-backend/models"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// errOutboundBlocked is returned when a user-supplied URL points at the NAS
+// itself, the LAN or a cloud metadata endpoint.
+var errOutboundBlocked = errors.New("target address is not allowed")
+
+// Ranges that isBlockedIP adds to the standard library's classification
+var extraBlockedNets = mustParseCIDRs(
+	"0.0.0.0/8",     // "This" network
+	"100.64.0.0/10", // Carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // Benchmarking
+)
+
+func mustParseCIDRs(list ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// outboundGuard decides which addresses server-side fetches of user-supplied
+// URLs may reach. Allow takes host patterns, IPs and CIDR ranges (see
+// matchHostPattern) for LAN services that are meant to be fetched, such as a
+// self-hosted RSSHub.
+type outboundGuard struct {
+	disabled bool
+	allow    []string
+}
+
+func loadOutboundGuard() outboundGuard {
+	return currentOutbound().guard
+}
+
+// outboundGuardFrom reads "outboundGuard" from the system config and adds
+// OUTBOUND_ALLOWLIST (comma separated) from the environment.
+func outboundGuardFrom(sysConfig *models.SystemConfig) outboundGuard {
+	guard := outboundGuard{}
+	if g := sysConfig.OutboundGuard; g != nil {
+		guard.disabled = g.Disable
+		guard.allow = normalizeHostPatterns(g.Allow)
+	}
+	guard.allow = append(guard.allow, normalizeHostPatterns(stringList(os.Getenv("OUTBOUND_ALLOWLIST")))...)
+	return guard
+}
+
+func (g outboundGuard) permits(host string, ip net.IP) bool {
+	if g.disabled || !isBlockedIP(ip) {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return matchHostPatterns(g.allow, host) || matchHostPatterns(g.allow, ip.String())
+}
+
+type outboundAllowKey struct{}
+
+// allowOutbound marks a request as exempt from the guard, for fetches whose
+// target the server chose or an admin allowed explicitly.
+func allowOutbound(ctx context.Context) context.Context {
+	return context.WithValue(ctx, outboundAllowKey{}, true)
+}
+
+func outboundAllowed(ctx context.Context) bool {
+	allowed, _ := ctx.Value(outboundAllowKey{}).(bool)
+	return allowed
+}
+
+// checkOutboundHost resolves host and fails if any of its addresses is
+// blocked. Used before handing a request to a proxy, which resolves the
+// name itself.
+func checkOutboundHost(ctx context.Context, host string) error {
+	if outboundAllowed(ctx) {
+		return nil
+	}
+	_, err := resolveOutboundHost(ctx, loadOutboundGuard(), host)
+	return err
+}
+
+func resolveOutboundHost(ctx context.Context, guard outboundGuard, host string) ([]net.IP, error) {
+	if host == "" {
+		return nil, errOutboundBlocked
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	for _, ip := range ips {
+		if !guard.permits(host, ip) {
+			return nil, fmt.Errorf("%w: %s resolves to %s", errOutboundBlocked, host, ip)
+		}
+	}
+	return ips, nil
+}
+
+var guardedDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// guardedDialContext resolves the target once, checks every address and
+// dials the checked address, so DNS rebinding cannot swap in a LAN address
+// between the check and the connection.
+func guardedDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if outboundAllowed(ctx) {
+		return guardedDialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolveOutboundHost(ctx, loadOutboundGuard(), host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := guardedDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
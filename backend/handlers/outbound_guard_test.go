@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestOutboundGuard(t *testing.T) {
+	guard := outboundGuard{allow: []string{"rsshub.lan", "10.1.0.0/16"}}
+	cases := []struct {
+		host string
+		ip   string
+		want bool
+	}{
+		{"example.com", "93.184.216.34", true},
+		{"metadata", "169.254.169.254", false},
+		{"router", "192.168.1.1", false},
+		{"cgnat", "100.64.0.1", false},
+		{"rsshub.lan", "192.168.1.20", true},
+		{"nas", "10.1.2.3", true},
+		{"localhost", "::1", false},
+	}
+	for _, tc := range cases {
+		if got := guard.permits(tc.host, net.ParseIP(tc.ip)); got != tc.want {
+			t.Fatalf("permits(%s, %s) = %v, want %v", tc.host, tc.ip, got, tc.want)
+		}
+	}
+	if _, err := resolveOutboundHost(context.Background(), outboundGuard{}, "127.0.0.2"); !errors.Is(err, errOutboundBlocked) {
+		t.Fatalf("expected loopback to be blocked, got %v", err)
+	}
+	if !(outboundGuard{disabled: true}).permits("x", net.ParseIP("127.0.0.1")) {
+		t.Fatalf("expected disabled guard to permit everything")
+	}
+}
@@ -0,0 +1,485 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Plugins are separate processes that speak JSON over HTTP, so they can be
+// written in any language and run as sidecar containers. The backend calls
+//
+//	GET  <url>/manifest          describe the plugin (pluginManifest)
+//	POST <url>/events/<event>    a client sent plugin:call
+//	POST <url>/widgets/<widget>  a dashboard widget wants data
+//	POST <url>/jobs/<job>        a scheduled job is due
+//
+// with "Authorization: Bearer <secret>" when a secret is set. Events and jobs
+// answer with a pluginReply; widgets answer with their data.
+
+const (
+	pluginTimeout       = 15 * time.Second
+	pluginMaxBody       = 4 << 20
+	pluginSchedulerTick = 10 * time.Second
+	pluginMinJobPeriod  = 30
+)
+
+var pluginNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// PluginConfig registers one plugin
+type PluginConfig struct {
+	Name   string `json:"name"`
+	Url    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	Enable bool   `json:"enable"`
+}
+
+type pluginManifest struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version,omitempty"`
+	Events  []string    `json:"events,omitempty"`
+	Widgets []string    `json:"widgets,omitempty"`
+	Jobs    []pluginJob `json:"jobs,omitempty"`
+	// Permission an event needs beyond view, e.g. {"order": "edit"}
+	Permissions map[string]string `json:"permissions,omitempty"`
+}
+
+type pluginJob struct {
+	Name            string `json:"name"`
+	IntervalSeconds int    `json:"intervalSeconds"`
+}
+
+// pluginReply is what events and jobs answer. Event names must start with
+// "<plugin>:" so a plugin cannot impersonate the core.
+type pluginReply struct {
+	Emit      []pluginEmit `json:"emit,omitempty"`      // To the caller
+	Broadcast []pluginEmit `json:"broadcast,omitempty"` // To a room, or everyone
+	Error     string       `json:"error,omitempty"`
+}
+
+type pluginEmit struct {
+	Event string      `json:"event"`
+	Room  string      `json:"room,omitempty"`
+	Data  interface{} `json:"data"`
+}
+
+// pluginRequest is the body of every POST to a plugin
+type pluginRequest struct {
+	Username string      `json:"username,omitempty"`
+	Role     string      `json:"role,omitempty"`
+	Payload  interface{} `json:"payload,omitempty"`
+}
+
+type loadedPlugin struct {
+	config   PluginConfig
+	manifest *pluginManifest
+	err      string
+	lastRun  map[string]time.Time
+}
+
+var plugins = struct {
+	sync.Mutex
+	byName map[string]*loadedPlugin
+}{byName: make(map[string]*loadedPlugin)}
+
+var pluginHTTPClient = &http.Client{Timeout: pluginTimeout, Transport: newProxyTransport()}
+
+func pluginsFile() string {
+	return filepath.Join(config.DataDir, "plugins.json")
+}
+
+func loadPluginConfigs() ([]PluginConfig, error) {
+	var configs []PluginConfig
+	if err := utils.ReadJSON(pluginsFile(), &configs); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// callPlugin POSTs body to a plugin path (or GETs when body is nil) and
+// decodes the JSON answer into out
+func callPlugin(ctx context.Context, cfg PluginConfig, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	// Plugins are registered by the admin and usually run on the LAN
+	req, err := http.NewRequestWithContext(allowOutbound(ctx), method, strings.TrimRight(cfg.Url, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cfg.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Secret)
+	}
+	resp, err := pluginHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, pluginMaxBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("plugin answered %s", resp.Status)
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// reloadPlugins fetches the manifest of every enabled plugin
+func reloadPlugins(ctx context.Context) {
+	configs, err := loadPluginConfigs()
+	if err != nil {
+		dataLog.Error("Failed to read plugins", "error", err)
+		return
+	}
+	next := make(map[string]*loadedPlugin, len(configs))
+	for _, cfg := range configs {
+		p := &loadedPlugin{config: cfg, lastRun: make(map[string]time.Time)}
+		next[cfg.Name] = p
+		if !cfg.Enable {
+			continue
+		}
+		var manifest pluginManifest
+		if err := callPlugin(ctx, cfg, http.MethodGet, "/manifest", nil, &manifest); err != nil {
+			p.err = err.Error()
+			dataLog.Warn("Plugin unavailable", "plugin", cfg.Name, "error", err)
+			continue
+		}
+		p.manifest = &manifest
+	}
+	plugins.Lock()
+	// Keep job timing across reloads so a reload does not rerun every job
+	for name, p := range next {
+		if old, ok := plugins.byName[name]; ok {
+			p.lastRun = old.lastRun
+		}
+	}
+	plugins.byName = next
+	plugins.Unlock()
+}
+
+func findPlugin(name string) (*loadedPlugin, bool) {
+	plugins.Lock()
+	defer plugins.Unlock()
+	p, ok := plugins.byName[name]
+	if !ok || !p.config.Enable || p.manifest == nil {
+		return nil, false
+	}
+	return p, true
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverPluginReply sends a plugin's emits to the caller (when there is
+// one) and its broadcasts to the socket server
+func deliverPluginReply(name string, reply pluginReply, s socketio.Conn) {
+	prefix := name + ":"
+	if s != nil {
+		for _, e := range reply.Emit {
+			if strings.HasPrefix(e.Event, prefix) {
+				s.Emit(e.Event, e.Data)
+			}
+		}
+		if reply.Error != "" {
+			s.Emit(prefix+"error", map[string]interface{}{"error": reply.Error})
+		}
+	}
+	for _, e := range reply.Broadcast {
+		if !strings.HasPrefix(e.Event, prefix) {
+			continue
+		}
+		if e.Room != "" {
+			broadcastRoom(prefix+e.Room, e.Event, e.Data)
+		} else {
+			broadcastAll(e.Event, e.Data)
+		}
+	}
+}
+
+func BindPluginHandlers(server *socketio.Server) {
+	// {plugin, event, token, ...} is forwarded to the plugin's event
+	bindEvent(server, "plugin:call", func(s socketio.Conn, msg interface{}) {
+		m, _ := msg.(map[string]interface{})
+		name := stringField(m, "plugin")
+		event := stringField(m, "event")
+		p, ok := findPlugin(name)
+		if !ok || !containsString(p.manifest.Events, event) {
+			s.Emit("plugin:error", map[string]interface{}{"plugin": name, "error": "Unknown plugin event"})
+			return
+		}
+		token, _ := parseTokenPayload(msg)
+		username, valid := validateSocketToken(token)
+		if !valid {
+			s.Emit("plugin:error", map[string]interface{}{"plugin": name, "error": "Unauthorized"})
+			return
+		}
+		role := middleware.RoleOf(username)
+		perm := p.manifest.Permissions[event]
+		if perm == "" {
+			perm = middleware.PermView
+		}
+		if !middleware.Can(role, perm) {
+			s.Emit("plugin:error", map[string]interface{}{"plugin": name, "error": "Permission denied"})
+			return
+		}
+		payload := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			if k != "token" && k != "plugin" && k != "event" {
+				payload[k] = v
+			}
+		}
+		var reply pluginReply
+		err := callPlugin(fetchCtx, p.config, http.MethodPost, "/events/"+url.PathEscape(event), pluginRequest{Username: username, Role: role, Payload: payload}, &reply)
+		if err != nil {
+			s.Emit("plugin:error", map[string]interface{}{"plugin": name, "error": err.Error()})
+			return
+		}
+		deliverPluginReply(name, reply, s)
+	})
+	// Clients join "<plugin>:<room>" to receive a plugin's room broadcasts
+	bindEvent(server, "plugin:join", func(s socketio.Conn, msg interface{}) {
+		m, _ := msg.(map[string]interface{})
+		name := stringField(m, "plugin")
+		room := stringField(m, "room")
+		if _, ok := findPlugin(name); !ok || room == "" {
+			s.Emit("plugin:error", map[string]interface{}{"plugin": name, "error": "Unknown plugin"})
+			return
+		}
+		s.Join(name + ":" + room)
+	})
+}
+
+// GetPluginWidget returns a plugin widget's data. Query parameters are
+// passed on to the plugin.
+func GetPluginWidget(c *gin.Context) {
+	name, widget := c.Param("name"), c.Param("widget")
+	p, ok := findPlugin(name)
+	if !ok || !containsString(p.manifest.Widgets, widget) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown plugin widget"})
+		return
+	}
+	query := make(map[string]string)
+	for k, v := range c.Request.URL.Query() {
+		if len(v) > 0 {
+			query[k] = v[0]
+		}
+	}
+	username := c.GetString("username")
+	var data interface{}
+	err := callPlugin(c.Request.Context(), p.config, http.MethodPost, "/widgets/"+url.PathEscape(widget), pluginRequest{Username: username, Role: middleware.RoleOf(username), Payload: query}, &data)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": data})
+}
+
+// StartPluginScheduler loads the plugins and runs their jobs
+func StartPluginScheduler() {
+	go func() {
+		reloadPlugins(backgroundCtx)
+		ticker := time.NewTicker(pluginSchedulerTick)
+		defer ticker.Stop()
+		beat := registerWorker("plugin.scheduler", pluginSchedulerTick)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case now := <-ticker.C:
+				beat()
+				runDuePluginJobs(now)
+			}
+		}
+	}()
+}
+
+func runDuePluginJobs(now time.Time) {
+	type dueJob struct {
+		cfg PluginConfig
+		job string
+	}
+	var due []dueJob
+	plugins.Lock()
+	for _, p := range plugins.byName {
+		if !p.config.Enable || p.manifest == nil {
+			continue
+		}
+		for _, job := range p.manifest.Jobs {
+			period := job.IntervalSeconds
+			if period < pluginMinJobPeriod {
+				period = pluginMinJobPeriod
+			}
+			if now.Sub(p.lastRun[job.Name]) < time.Duration(period)*time.Second {
+				continue
+			}
+			p.lastRun[job.Name] = now
+			due = append(due, dueJob{cfg: p.config, job: job.Name})
+		}
+	}
+	plugins.Unlock()
+
+	for _, d := range due {
+		done, ok := beginTask()
+		if !ok {
+			return
+		}
+		var reply pluginReply
+		err := callPlugin(fetchCtx, d.cfg, http.MethodPost, "/jobs/"+url.PathEscape(d.job), pluginRequest{}, &reply)
+		done()
+		if err != nil {
+			dataLog.Warn("Plugin job failed", "plugin", d.cfg.Name, "job", d.job, "error", err)
+			continue
+		}
+		if reply.Error != "" {
+			dataLog.Warn("Plugin job failed", "plugin", d.cfg.Name, "job", d.job, "error", reply.Error)
+		}
+		deliverPluginReply(d.cfg.Name, reply, nil)
+	}
+}
+
+// GetPlugins lists the registered plugins with their manifests
+func GetPlugins(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	plugins.Lock()
+	list := make([]gin.H, 0, len(plugins.byName))
+	for _, p := range plugins.byName {
+		list = append(list, gin.H{
+			"name":      p.config.Name,
+			"url":       p.config.Url,
+			"enable":    p.config.Enable,
+			"hasSecret": p.config.Secret != "",
+			"manifest":  p.manifest,
+			"error":     p.err,
+		})
+	}
+	plugins.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i]["name"].(string) < list[j]["name"].(string) })
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": list})
+}
+
+// SavePlugin registers or updates a plugin and reloads the manifests. An
+// empty secret keeps the stored one.
+func SavePlugin(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	var req PluginConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	req.Url = strings.TrimSpace(req.Url)
+	if !pluginNamePattern.MatchString(req.Name) || req.Name == "plugin" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plugin name may only contain lowercase letters, digits, '_' and '-'"})
+		return
+	}
+	if u, err := url.Parse(req.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid plugin url"})
+		return
+	}
+	var configs []PluginConfig
+	err := utils.UpdateJSON(pluginsFile(), &configs, func() error {
+		for i := range configs {
+			if configs[i].Name == req.Name {
+				if req.Secret == "" {
+					req.Secret = configs[i].Secret
+				}
+				configs[i] = req
+				return nil
+			}
+		}
+		configs = append(configs, req)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save plugin"})
+		return
+	}
+	reloadPlugins(c.Request.Context())
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// DeletePlugin unregisters a plugin
+func DeletePlugin(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	name := c.Param("name")
+	var configs []PluginConfig
+	found := false
+	err := utils.UpdateJSON(pluginsFile(), &configs, func() error {
+		kept := configs[:0]
+		for _, cfg := range configs {
+			if cfg.Name == name {
+				found = true
+				continue
+			}
+			kept = append(kept, cfg)
+		}
+		configs = kept
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete plugin"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plugin not found"})
+		return
+	}
+	reloadPlugins(c.Request.Context())
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ReloadPlugins fetches every manifest again, e.g. after a plugin update
+func ReloadPlugins(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	reloadPlugins(c.Request.Context())
+	GetPlugins(c)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPluginManifestAndJobs(t *testing.T) {
+	useTestConfig(t)
+
+	var jobs int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/manifest":
+			w.Write([]byte(`{"name":"stocks","events":["quote"],"widgets":["ticker"],"jobs":[{"name":"sync","intervalSeconds":60}]}`))
+		case "/jobs/sync":
+			jobs++
+			w.Write([]byte(`{"broadcast":[{"event":"stocks:updated","data":1}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := []PluginConfig{{Name: "stocks", Url: srv.URL, Secret: "s3cret", Enable: true}}
+	if err := utils.WriteJSON(pluginsFile(), cfg); err != nil {
+		t.Fatalf("write plugins: %v", err)
+	}
+	reloadPlugins(context.Background())
+	p, ok := findPlugin("stocks")
+	if !ok || !containsString(p.manifest.Widgets, "ticker") {
+		t.Fatalf("plugin not loaded: %+v", p)
+	}
+
+	now := time.Now()
+	runDuePluginJobs(now)
+	runDuePluginJobs(now.Add(30 * time.Second))
+	if jobs != 1 {
+		t.Fatalf("job ran %d times within its interval, want 1", jobs)
+	}
+	runDuePluginJobs(now.Add(61 * time.Second))
+	if jobs != 2 {
+		t.Fatalf("job ran %d times after its interval, want 2", jobs)
+	}
+}
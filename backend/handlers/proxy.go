@@ -2,14 +2,15 @@ package handlers
 
 import (
 	"context"
+	"flatnasgo-backend/models"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -50,6 +51,15 @@ func isAllowedWallpaperHost(host string) bool {
 	return false
 }
 
+// wallpaperContext exempts whitelisted wallpaper hosts from the outbound
+// guard, matching the IsBlockedHost check done before each fetch.
+func wallpaperContext(ctx context.Context, host string) context.Context {
+	if isAllowedWallpaperHost(host) {
+		return allowOutbound(ctx)
+	}
+	return ctx
+}
+
 func ProxyWallpaper(c *gin.Context) {
 	targetURL := c.Query("url")
 	requestUUID := c.Query("uuid")
@@ -74,7 +84,7 @@ func ProxyWallpaper(c *gin.Context) {
 		return
 	}
 
-	req, err := http.NewRequest("GET", parsed.String(), nil)
+	req, err := http.NewRequestWithContext(wallpaperContext(c.Request.Context(), h), "GET", parsed.String(), nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
 		return
@@ -116,17 +126,21 @@ func ProxyWallpaper(c *gin.Context) {
 	c.Status(resp.StatusCode)
 	_, err = io.Copy(c.Writer, resp.Body)
 	if err != nil {
-		fmt.Printf("Error streaming response: %v\n", err)
+		proxyLog.Debug("Error streaming response", "error", err)
 	}
 }
 
 func GetProxyStatus(c *gin.Context) {
-	proxyURL, err := getProxyURL()
-	if err != nil || proxyURL == nil {
+	profiles, _ := loadProxyProfiles()
+	if len(profiles) == 0 {
 		c.JSON(http.StatusOK, gin.H{"available": false})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"available": true})
+	c.JSON(http.StatusOK, gin.H{
+		"available": true,
+		"active":    rankProxyProfiles(profiles)[0].name,
+		"profiles":  proxyProfileStatuses(profiles),
+	})
 }
 
 func ProxyRequest(c *gin.Context) {
@@ -193,11 +207,22 @@ func ProxyRequest(c *gin.Context) {
 	c.Status(resp.StatusCode)
 	_, err = io.Copy(c.Writer, resp.Body)
 	if err != nil {
-		fmt.Printf("Error streaming response: %v\n", err)
+		proxyLog.Debug("Error streaming response", "error", err)
 	}
 }
 
+// getProxyURL returns the proxy currently in use: the first configured
+// profile that is not cooling down after a failure.
 func getProxyURL() (*url.URL, error) {
+	profiles, err := loadProxyProfiles()
+	if len(profiles) == 0 {
+		return nil, err
+	}
+	return rankProxyProfiles(profiles)[0].url, nil
+}
+
+// getEnvProxyURL reads the proxy from the environment
+func getEnvProxyURL() (*url.URL, error) {
 	keys := []string{"PROXY_URL", "HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"}
 	var lastErr error
 	for _, key := range keys {
@@ -238,73 +263,135 @@ func parseProxyURL(value string) (*url.URL, error) {
 	}
 }
 
-var (
-	globalProxyClient *http.Client
-	globalProxyURLStr string
-	proxyClientMu     sync.RWMutex
-)
-
 func getSharedProxyClient() (*http.Client, error) {
-	proxyURL, err := getProxyURL()
-	if err != nil {
-		return nil, err
-	}
+	snapshot := currentOutbound()
+	return snapshot.client, snapshot.clientErr
+}
 
-	currentURLStr := ""
-	if proxyURL != nil {
-		currentURLStr = proxyURL.String()
+// proxySettingsURL turns the proxy settings of the system config into a
+// proxy URL, with credentials as userinfo (SOCKS5 username/password auth).
+func proxySettingsURL(settings *models.ProxySettings) (*url.URL, error) {
+	host := strings.TrimSpace(settings.Host)
+	if host == "" || settings.Port <= 0 || settings.Port > 65535 {
+		return nil, fmt.Errorf("proxy host and port are required")
 	}
-
-	proxyClientMu.RLock()
-	client := globalProxyClient
-	cachedURLStr := globalProxyURLStr
-	proxyClientMu.RUnlock()
-
-	if client != nil && cachedURLStr == currentURLStr {
-		return client, nil
+	u := &url.URL{
+		Scheme: strings.ToLower(strings.TrimSpace(settings.Type)),
+		Host:   net.JoinHostPort(host, strconv.Itoa(settings.Port)),
 	}
+	if settings.Username != "" {
+		u.User = url.UserPassword(settings.Username, settings.Password)
+	}
+	return parseProxyURL(u.String())
+}
 
-	proxyClientMu.Lock()
-	defer proxyClientMu.Unlock()
-
-	// Double check
-	if globalProxyClient != nil && globalProxyURLStr == currentURLStr {
-		return globalProxyClient, nil
+// decodeProxySettings validates the "proxy" field of a system config
+// update. A missing password keeps the stored one, since the UI never
+// receives it back.
+func decodeProxySettings(raw interface{}, current *models.ProxySettings) (*models.ProxySettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid proxy")
+	}
+	settings := &models.ProxySettings{}
+	settings.Type, _ = m["type"].(string)
+	settings.Host, _ = m["host"].(string)
+	if port, ok := m["port"].(float64); ok {
+		settings.Port = int(port)
+	}
+	settings.Username, _ = m["username"].(string)
+	if password, ok := m["password"].(string); ok && password != "" {
+		settings.Password = password
+	} else if current != nil && current.Username == settings.Username {
+		settings.Password = current.Password
+	}
+	if strings.TrimSpace(settings.Type) == "" {
+		return nil, nil
+	}
+	if _, err := proxySettingsURL(settings); err != nil {
+		return nil, fmt.Errorf("Invalid proxy: %v", err)
 	}
+	return settings, nil
+}
 
-	// Rebuild client
-	transport := &http.Transport{
+// newProxyTransport returns a direct transport whose connections pass the
+// outbound guard
+func newProxyTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:         guardedDialContext,
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 10,
 		IdleConnTimeout:     90 * time.Second,
 	}
+}
 
-	if proxyURL == nil {
-		newClient := &http.Client{Timeout: 20 * time.Second, Transport: transport}
-		globalProxyClient = newClient
-		globalProxyURLStr = ""
-		return newClient, nil
-	}
-
+// newProxiedTransport sends requests for hosts accepted by useProxy through
+// proxyURL and dials the rest directly.
+func newProxiedTransport(proxyURL *url.URL, useProxy func(host string) bool) (*http.Transport, error) {
+	transport := newProxyTransport()
 	switch proxyURL.Scheme {
 	case "http", "https":
-		transport.Proxy = http.ProxyURL(proxyURL)
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if !useProxy(req.URL.Hostname()) {
+				return nil, nil
+			}
+			return proxyURL, nil
+		}
+		// The proxy itself is configured by the admin and often on the LAN
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == proxyURL.Host {
+				return guardedDialer.DialContext(ctx, network, addr)
+			}
+			return guardedDialContext(ctx, network, addr)
+		}
 	case "socks5", "socks5h":
 		dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
 		if err != nil {
 			return nil, err
 		}
 		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, _, err := net.SplitHostPort(addr); err == nil && !useProxy(host) {
+				return guardedDialContext(ctx, network, addr)
+			}
+			if cd, ok := dialer.(proxy.ContextDialer); ok {
+				return cd.DialContext(ctx, network, addr)
+			}
 			return dialer.Dial(network, addr)
 		}
 	default:
 		return nil, fmt.Errorf("unsupported proxy protocol")
 	}
+	return transport, nil
+}
 
-	newClient := &http.Client{Timeout: 20 * time.Second, Transport: transport}
-	globalProxyClient = newClient
-	globalProxyURLStr = currentURLStr
-	return newClient, nil
+// decodeProxyList validates the "proxies" field of a system config update;
+// passwords left empty are kept from the stored profile of the same name.
+func decodeProxyList(raw interface{}, current []models.ProxySettings) ([]models.ProxySettings, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	byName := make(map[string]*models.ProxySettings, len(current))
+	for i := range current {
+		byName[current[i].Name] = &current[i]
+	}
+	proxies := make([]models.ProxySettings, 0, len(list))
+	for _, item := range list {
+		m, _ := item.(map[string]interface{})
+		name, _ := m["name"].(string)
+		settings, err := decodeProxySettings(item, byName[name])
+		if err != nil {
+			return nil, err
+		}
+		if settings != nil {
+			settings.Name = name
+			proxies = append(proxies, *settings)
+		}
+	}
+	return proxies, nil
 }
 
 func buildProxyClient() (*http.Client, error) {
@@ -337,5 +424,13 @@ func IsBlockedHost(host string) bool {
 }
 
 func isBlockedIP(ip net.IP) bool {
-	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range extraBlockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+const (
+	defaultProxyTestUrl = "https://www.gstatic.com/generate_204"
+	proxyEgressUrl      = "http://ip-api.com/json/?fields=status,query,country,city"
+	proxyTestTimeout    = 15 * time.Second
+)
+
+// ProxyTestResult reports whether a proxy works and how it looks from outside
+type ProxyTestResult struct {
+	Proxy     string `json:"proxy"` // Without credentials
+	Url       string `json:"url"`
+	Ok        bool   `json:"ok"`
+	Status    int    `json:"status,omitempty"`
+	LatencyMs int64  `json:"latencyMs,omitempty"`
+	EgressIp  string `json:"egressIp,omitempty"`
+	Country   string `json:"country,omitempty"`
+	City      string `json:"city,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func BindProxyHandlers(server *socketio.Server) {
+	bindEvent(server, "proxy:test", func(s socketio.Conn, msg interface{}) {
+		token, _ := parseTokenPayload(msg)
+		if _, ok := validateSocketToken(token); !ok {
+			s.Emit("proxy:testResult", ProxyTestResult{Error: "Unauthorized"})
+			return
+		}
+		m, _ := msg.(map[string]interface{})
+		target, _ := m["url"].(string)
+		go func() {
+			s.Emit("proxy:testResult", runProxyTest(fetchCtx, m["proxy"], target))
+		}()
+	})
+}
+
+// TestProxy checks the configured proxy, or the unsaved settings in the
+// "proxy" field of the body, against an optional "url".
+func TestProxy(c *gin.Context) {
+	var payload map[string]interface{}
+	_ = c.ShouldBindJSON(&payload)
+	target, _ := payload["url"].(string)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": runProxyTest(c.Request.Context(), payload["proxy"], target)})
+}
+
+func runProxyTest(ctx context.Context, rawSettings interface{}, target string) ProxyTestResult {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		target = defaultProxyTestUrl
+	}
+	result := ProxyTestResult{Url: target}
+
+	proxyURL, err := proxyUnderTest(rawSettings)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if proxyURL == nil {
+		result.Error = "no proxy configured"
+		return result
+	}
+	redacted := *proxyURL
+	redacted.User = nil
+	result.Proxy = redacted.String()
+
+	// Ignore the routing rules: the point is to exercise the proxy itself
+	transport, err := newProxiedTransport(proxyURL, func(string) bool { return true })
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Timeout: proxyTestTimeout, Transport: transport}
+
+	ctx, cancel := context.WithTimeout(ctx, proxyTestTimeout)
+	defer cancel()
+	start := time.Now()
+	status, err := proxyTestGet(ctx, client, target, nil)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.Status = status
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Ok = status < 500
+
+	var egress struct {
+		Status  string `json:"status"`
+		Query   string `json:"query"`
+		Country string `json:"country"`
+		City    string `json:"city"`
+	}
+	if _, err := proxyTestGet(ctx, client, proxyEgressUrl, &egress); err == nil && egress.Status == "success" {
+		result.EgressIp = egress.Query
+		result.Country = egress.Country
+		result.City = egress.City
+	}
+	return result
+}
+
+// proxyUnderTest returns the proxy from unsaved settings, falling back to
+// the stored password like a save would, or the active proxy.
+func proxyUnderTest(rawSettings interface{}) (*url.URL, error) {
+	if rawSettings == nil {
+		return getProxyURL()
+	}
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	settings, err := decodeProxySettings(rawSettings, sysConfig.Proxy)
+	if err != nil || settings == nil {
+		return nil, err
+	}
+	return proxySettingsURL(settings)
+}
+
+func proxyTestGet(ctx context.Context, client *http.Client, target string, out interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "FlatNas/1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("unexpected response: %v", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
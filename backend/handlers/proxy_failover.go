@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/models"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	proxyCooldownBase = 2 * time.Minute
+	proxyCooldownMax  = 30 * time.Minute
+	proxyHealthTick   = time.Minute
+	proxyDialTimeout  = 5 * time.Second
+)
+
+// proxyProfile is one usable proxy from the system config or environment
+type proxyProfile struct {
+	name string
+	url  *url.URL
+}
+
+// ProxyProfileStatus is the health of a proxy profile as shown in settings
+type ProxyProfileStatus struct {
+	Name      string `json:"name"`
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"failures"`
+	DownUntil int64  `json:"downUntil,omitempty"` // Unix timestamp in ms
+	LastError string `json:"lastError,omitempty"`
+}
+
+type proxyHealthEntry struct {
+	failures  int
+	downUntil time.Time
+	lastError string
+}
+
+// proxyHealthBook tracks failures per profile name. A profile that fails is
+// skipped until its cooldown ends, doubling with each consecutive failure.
+type proxyHealthBook struct {
+	mu      sync.Mutex
+	entries map[string]*proxyHealthEntry
+}
+
+var proxyHealth = &proxyHealthBook{entries: make(map[string]*proxyHealthEntry)}
+
+func (b *proxyHealthBook) markDown(name string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry := b.entries[name]
+	if entry == nil {
+		entry = &proxyHealthEntry{}
+		b.entries[name] = entry
+	}
+	entry.failures++
+	cooldown := proxyCooldownBase << uint(entry.failures-1)
+	if cooldown > proxyCooldownMax || cooldown <= 0 {
+		cooldown = proxyCooldownMax
+	}
+	entry.downUntil = time.Now().Add(cooldown)
+	entry.lastError = err.Error()
+	proxyLog.Warn("Proxy unreachable, skipping", "proxy", name, "cooldown", cooldown, "error", err)
+}
+
+func (b *proxyHealthBook) markUp(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entries, name)
+}
+
+func (b *proxyHealthBook) status(name string, now time.Time) ProxyProfileStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := ProxyProfileStatus{Name: name, Healthy: true}
+	if entry := b.entries[name]; entry != nil {
+		st.Failures = entry.failures
+		st.LastError = entry.lastError
+		if now.Before(entry.downUntil) {
+			st.Healthy = false
+			st.DownUntil = entry.downUntil.UnixMilli()
+		}
+	}
+	return st
+}
+
+func loadProxyProfiles() ([]proxyProfile, error) {
+	snapshot := currentOutbound()
+	return snapshot.profiles, snapshot.profileErr
+}
+
+// proxyProfilesFrom lists the configured proxies in order of preference:
+// the "proxies" list, then the single "proxy", else the environment.
+func proxyProfilesFrom(sysConfig *models.SystemConfig) ([]proxyProfile, error) {
+	settings := make([]models.ProxySettings, 0, len(sysConfig.Proxies)+1)
+	settings = append(settings, sysConfig.Proxies...)
+	if sysConfig.Proxy != nil && sysConfig.Proxy.Type != "" {
+		settings = append(settings, *sysConfig.Proxy)
+	}
+
+	profiles := make([]proxyProfile, 0, len(settings))
+	seen := make(map[string]struct{})
+	var lastErr error
+	for i := range settings {
+		if settings[i].Type == "" {
+			continue
+		}
+		u, err := proxySettingsURL(&settings[i])
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		name := settings[i].Name
+		if name == "" {
+			name = fmt.Sprintf("proxy-%d", i+1)
+		}
+		if _, dup := seen[name]; dup {
+			name = fmt.Sprintf("%s-%d", name, i+1)
+		}
+		seen[name] = struct{}{}
+		profiles = append(profiles, proxyProfile{name: name, url: u})
+	}
+	if len(profiles) > 0 || lastErr != nil {
+		return profiles, lastErr
+	}
+	envURL, err := getEnvProxyURL()
+	if err != nil || envURL == nil {
+		return nil, err
+	}
+	return []proxyProfile{{name: "env", url: envURL}}, nil
+}
+
+// rankProxyProfiles keeps the configured order for healthy profiles and
+// moves those cooling down to the back, soonest to recover first, so there
+// is always something to try.
+func rankProxyProfiles(profiles []proxyProfile) []proxyProfile {
+	now := time.Now()
+	type ranked struct {
+		profile proxyProfile
+		status  ProxyProfileStatus
+	}
+	list := make([]ranked, len(profiles))
+	for i, p := range profiles {
+		list[i] = ranked{p, proxyHealth.status(p.name, now)}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].status.Healthy != list[j].status.Healthy {
+			return list[i].status.Healthy
+		}
+		return list[i].status.DownUntil < list[j].status.DownUntil
+	})
+	out := make([]proxyProfile, len(list))
+	for i := range list {
+		out[i] = list[i].profile
+	}
+	return out
+}
+
+func proxyProfileStatuses(profiles []proxyProfile) []ProxyProfileStatus {
+	now := time.Now()
+	list := make([]ProxyProfileStatus, 0, len(profiles))
+	for _, p := range profiles {
+		list = append(list, proxyHealth.status(p.name, now))
+	}
+	return list
+}
+
+// failoverTransport sends proxied requests through the best profile and, when
+// a proxy cannot be reached, marks it down and retries on the next one.
+type failoverTransport struct {
+	profiles   []proxyProfile
+	transports map[string]*http.Transport
+	direct     *http.Transport
+	router     *proxyRouter
+}
+
+func newFailoverTransport(profiles []proxyProfile, router *proxyRouter) (*failoverTransport, error) {
+	t := &failoverTransport{
+		profiles:   profiles,
+		transports: make(map[string]*http.Transport, len(profiles)),
+		direct:     newProxyTransport(),
+		router:     router,
+	}
+	for _, p := range profiles {
+		transport, err := newProxiedTransport(p.url, func(string) bool { return true })
+		if err != nil {
+			return nil, err
+		}
+		t.transports[p.name] = transport
+	}
+	return t, nil
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.router.useProxy(req.URL.Hostname()) {
+		return t.direct.RoundTrip(req)
+	}
+	// The proxy resolves the name, so check the target before handing it over
+	if err := checkOutboundHost(req.Context(), req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for i, p := range rankProxyProfiles(t.profiles) {
+		if i > 0 {
+			if !replayableRequest(req) {
+				break
+			}
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					break
+				}
+				req = req.Clone(req.Context())
+				req.Body = body
+			}
+		}
+		resp, err := t.transports[p.name].RoundTrip(req)
+		if err == nil {
+			proxyHealth.markUp(p.name)
+			return resp, nil
+		}
+		lastErr = err
+		if !isProxyDialError(err) || req.Context().Err() != nil {
+			return nil, err
+		}
+		proxyHealth.markDown(p.name, err)
+	}
+	return nil, lastErr
+}
+
+func replayableRequest(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// isProxyDialError reports whether err came from reaching the proxy itself
+// rather than from the target behind it.
+func isProxyDialError(err error) bool {
+	// HTTP proxies fail with Op "proxyconnect"; the SOCKS dialer wraps the
+	// failed dial to the proxy (Op "dial") in its own "connect" error
+	for err != nil {
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) {
+			return false
+		}
+		if opErr.Op == "proxyconnect" || opErr.Op == "dial" {
+			return true
+		}
+		err = opErr.Err
+	}
+	return false
+}
+
+// StartProxyHealthChecks probes profiles that are cooling down so a proxy
+// that comes back is used again without waiting out its whole cooldown.
+func StartProxyHealthChecks() {
+	go func() {
+		ticker := time.NewTicker(proxyHealthTick)
+		defer ticker.Stop()
+		beat := registerWorker("proxy.health", proxyHealthTick)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+				beat()
+				checkProxyProfiles()
+			}
+		}
+	}()
+}
+
+func checkProxyProfiles() {
+	profiles, _ := loadProxyProfiles()
+	if len(profiles) < 2 {
+		return
+	}
+	now := time.Now()
+	for _, p := range profiles {
+		if proxyHealth.status(p.name, now).Failures == 0 {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", p.url.Host, proxyDialTimeout)
+		if err != nil {
+			proxyHealth.markDown(p.name, err)
+			continue
+		}
+		conn.Close()
+		proxyHealth.markUp(p.name)
+	}
+}
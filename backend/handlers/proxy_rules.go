@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"flatnasgo-backend/models"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// proxyRoute is the decision for one host
+type proxyRoute int
+
+const (
+	proxyRouteDefault proxyRoute = iota // No rule matched; proxy is used as usual
+	proxyRouteProxy                     // Listed under "proxied": proxy first
+	proxyRouteDirect                    // Listed under "bypass": never proxied
+)
+
+// proxyRouter applies the proxy routing rules of the system config. Patterns
+// are host names ("example.com" also covers its subdomains), wildcards
+// ("*.example.com" covers subdomains only), or IPs and CIDR ranges.
+type proxyRouter struct {
+	proxied []string
+	bypass  []string
+}
+
+func loadProxyRouter() *proxyRouter {
+	return currentOutbound().router
+}
+
+func newProxyRouter(rules *models.ProxyRules) *proxyRouter {
+	if rules == nil || (len(rules.Proxied) == 0 && len(rules.Bypass) == 0) {
+		return nil
+	}
+	return &proxyRouter{proxied: normalizeHostPatterns(rules.Proxied), bypass: normalizeHostPatterns(rules.Bypass)}
+}
+
+// decodeProxyRules reads the "proxyRules" field of a system config update
+func decodeProxyRules(raw interface{}) *models.ProxyRules {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	rules := &models.ProxyRules{
+		Proxied: normalizeHostPatterns(stringList(m["proxied"])),
+		Bypass:  normalizeHostPatterns(stringList(m["bypass"])),
+	}
+	if len(rules.Proxied) == 0 && len(rules.Bypass) == 0 {
+		return nil
+	}
+	return rules
+}
+
+// stringList accepts a JSON array of strings or a comma/newline separated string
+func stringList(raw interface{}) []string {
+	switch v := raw.(type) {
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '\n' || r == ';' })
+	}
+	return nil
+}
+
+func normalizeHostPatterns(patterns []string) []string {
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// route decides how requests to host travel. With a "proxied" list, hosts
+// outside it go direct; LAN addresses are not proxied unless a rule says so.
+func (r *proxyRouter) route(host string) proxyRoute {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if r != nil {
+		if matchHostPatterns(r.bypass, host) {
+			return proxyRouteDirect
+		}
+		if matchHostPatterns(r.proxied, host) {
+			return proxyRouteProxy
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()) {
+		return proxyRouteDirect
+	}
+	if host == "localhost" {
+		return proxyRouteDirect
+	}
+	if r != nil && len(r.proxied) > 0 {
+		return proxyRouteDirect
+	}
+	return proxyRouteDefault
+}
+
+// useProxy reports whether the shared proxy client should tunnel host
+func (r *proxyRouter) useProxy(host string) bool {
+	return r.route(host) != proxyRouteDirect
+}
+
+func matchHostPatterns(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if matchHostPattern(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHostPattern(pattern, host string) bool {
+	if strings.Contains(pattern, "/") {
+		_, cidr, err := net.ParseCIDR(pattern)
+		ip := net.ParseIP(host)
+		return err == nil && ip != nil && cidr.Contains(ip)
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	if strings.HasPrefix(pattern, ".") {
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+func hostnameOf(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
+
+// routeRssAttempts orders fetch attempts by the routing rules: hosts that
+// must be proxied start with the proxy, bypassed hosts never use it.
+func routeRssAttempts(feedUrl string, attempts []rssAttempt) []rssAttempt {
+	switch loadProxyRouter().route(hostnameOf(feedUrl)) {
+	case proxyRouteProxy:
+		ordered := make([]rssAttempt, 0, len(attempts))
+		for _, a := range attempts {
+			if a.viaProxy {
+				ordered = append(ordered, a)
+			}
+		}
+		for _, a := range attempts {
+			if !a.viaProxy {
+				ordered = append(ordered, a)
+			}
+		}
+		return ordered
+	case proxyRouteDirect:
+		direct := attempts[:0]
+		for _, a := range attempts {
+			if !a.viaProxy {
+				direct = append(direct, a)
+			}
+		}
+		return direct
+	}
+	return attempts
+}
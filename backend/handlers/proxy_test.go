@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"flatnasgo-backend/models"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxySettingsURL(t *testing.T) {
+	u, err := proxySettingsURL(&models.ProxySettings{Type: "socks5", Host: "127.0.0.1", Port: 1080, Username: "me", Password: "p@ss"})
+	if err != nil || u.Scheme != "socks5" || u.Host != "127.0.0.1:1080" || u.User.Username() != "me" {
+		t.Fatalf("unexpected proxy url: %v %v", u, err)
+	}
+	if pw, _ := u.User.Password(); pw != "p@ss" {
+		t.Fatalf("unexpected password: %q", pw)
+	}
+	if _, err := proxySettingsURL(&models.ProxySettings{Type: "ftp", Host: "h", Port: 1}); err == nil {
+		t.Fatalf("expected unsupported type to fail")
+	}
+	current := &models.ProxySettings{Type: "socks5", Host: "h", Port: 1, Username: "me", Password: "secret"}
+	next, err := decodeProxySettings(map[string]interface{}{"type": "socks5", "host": "h", "port": float64(2), "username": "me"}, current)
+	if err != nil || next.Password != "secret" || next.Port != 2 {
+		t.Fatalf("expected stored password to be kept: %+v %v", next, err)
+	}
+	if redacted := (models.SystemConfig{Proxy: current}).Redacted(); redacted.Proxy.Password != "" || current.Password != "secret" {
+		t.Fatalf("unexpected redaction")
+	}
+}
+
+func TestProxyRouter(t *testing.T) {
+	router := newProxyRouter(&models.ProxyRules{
+		Proxied: []string{"*.reddit.com", "youtube.com"},
+		Bypass:  []string{"old.reddit.com", "203.0.113.0/24"},
+	})
+	cases := map[string]proxyRoute{
+		"www.reddit.com": proxyRouteProxy,
+		"reddit.com":     proxyRouteDirect, // *. covers subdomains only
+		"youtube.com":    proxyRouteProxy,
+		"m.youtube.com":  proxyRouteProxy,
+		"old.reddit.com": proxyRouteDirect,
+		"example.com":    proxyRouteDirect,
+		"203.0.113.7":    proxyRouteDirect,
+		"192.168.1.2":    proxyRouteDirect,
+	}
+	for host, want := range cases {
+		if got := router.route(host); got != want {
+			t.Fatalf("route(%q) = %v, want %v", host, got, want)
+		}
+	}
+	var none *proxyRouter
+	if none.route("example.com") != proxyRouteDefault || !none.useProxy("example.com") {
+		t.Fatalf("expected default route without rules")
+	}
+	if got := decodeProxyRules(map[string]interface{}{"proxied": "a.com, *.b.com"}); got == nil || len(got.Proxied) != 2 {
+		t.Fatalf("unexpected decoded rules: %+v", got)
+	}
+}
+
+func TestRunProxyTest(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+	var proxied int
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		if r.URL.Host != strings.TrimPrefix(target.URL, "http://") {
+			http.Error(w, "unreachable", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxyServer.Close()
+	u, _ := url.Parse(proxyServer.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	portNum, _ := strconv.Atoi(port)
+	settings := map[string]interface{}{"type": "http", "host": host, "port": float64(portNum)}
+	result := runProxyTest(context.Background(), settings, target.URL)
+	if !result.Ok || result.Status != http.StatusNoContent || proxied == 0 {
+		t.Fatalf("unexpected proxy test result: %+v (proxied %d)", result, proxied)
+	}
+	if result := runProxyTest(context.Background(), map[string]interface{}{"type": "http", "host": host}, target.URL); result.Ok || result.Error == "" {
+		t.Fatalf("expected invalid settings to fail: %+v", result)
+	}
+}
+
+func TestFailoverTransport(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer target.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Get(r.URL.String())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}))
+	defer working.Close()
+	// A port nothing listens on
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	deadURL, _ := url.Parse("http://" + deadAddr)
+	workingURL, _ := url.Parse(working.URL)
+	profiles := []proxyProfile{{name: "dead-test", url: deadURL}, {name: "working-test", url: workingURL}}
+	defer proxyHealth.markUp("dead-test")
+	// Route the loopback target through the proxies too
+	router := &proxyRouter{proxied: []string{"127.0.0.0/8"}}
+	transport, err := newFailoverTransport(profiles, router)
+	if err != nil {
+		t.Fatalf("build transport: %v", err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(target.URL)
+	if err != nil {
+		t.Fatalf("expected failover to the working proxy: %v", err)
+	}
+	resp.Body.Close()
+	if st := proxyHealth.status("dead-test", time.Now()); st.Healthy || st.Failures != 1 {
+		t.Fatalf("expected dead proxy to cool down: %+v", st)
+	}
+	if ranked := rankProxyProfiles(profiles); ranked[0].name != "working-test" {
+		t.Fatalf("expected working proxy first, got %s", ranked[0].name)
+	}
+}
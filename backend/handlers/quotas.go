@@ -0,0 +1,441 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Quotas cap how much a share may hold and how much a user may keep in
+// the transfer area. A share's usage is counted by walking it in the
+// background, the recycle bin included, and kept current between walks
+// by adding what is written through FlatNas; writes made outside it show
+// up at the next walk. A user's usage is their transfer files plus the
+// uploads they have started. Crossing a warning threshold sends one
+// notification until usage drops below it again.
+
+const (
+	quotaTick    = 5 * time.Minute
+	quotaRescan  = time.Hour
+	quotaPercent = 100
+)
+
+var quotaDefaultWarn = []int{80, 95}
+
+var errQuotaExceeded = errors.New("Quota exceeded")
+
+// QuotaUsage is the usage of a user or share with a quota
+type QuotaUsage struct {
+	Name      string `json:"name"`
+	Limit     int64  `json:"limit"`
+	Used      int64  `json:"used"`
+	Percent   int    `json:"percent"`
+	CountedAt int64  `json:"countedAt,omitempty"` // Last walk of a share, ms
+}
+
+type shareQuotaCount struct {
+	used      int64
+	countedAt time.Time
+	stale     bool // Counted again at the next tick
+}
+
+var quotaCounts = struct {
+	sync.Mutex
+	shares map[string]*shareQuotaCount
+}{shares: make(map[string]*shareQuotaCount)}
+
+// quotaWarned serializes updates of the warning state
+var quotaWarned sync.Mutex
+
+func quotaWarningsFile() string {
+	return filepath.Join(config.DataDir, "quota-warnings.json")
+}
+
+func quotaSettings() models.QuotaSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.Quotas == nil {
+		return models.QuotaSettings{Warn: quotaDefaultWarn}
+	}
+	settings := *sysConfig.Quotas
+	if len(settings.Warn) == 0 {
+		settings.Warn = quotaDefaultWarn
+	}
+	return settings
+}
+
+// decodeQuotaSettings reads the "quotas" field of a system config update
+func decodeQuotaSettings(raw interface{}) (*models.QuotaSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid quota settings")
+	}
+	settings := &models.QuotaSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid quota settings")
+	}
+	for _, limits := range []map[string]int64{settings.Users, settings.Shares} {
+		for name, limit := range limits {
+			if limit < 0 {
+				return nil, fmt.Errorf("Invalid quota settings")
+			}
+			if limit == 0 {
+				delete(limits, name)
+			}
+		}
+	}
+	for _, p := range settings.Warn {
+		if p <= 0 || p > quotaPercent {
+			return nil, fmt.Errorf("Invalid quota settings")
+		}
+	}
+	sort.Ints(settings.Warn)
+	return settings, nil
+}
+
+func quotaPercentOf(used, limit int64) int {
+	if limit <= 0 {
+		return 0
+	}
+	return int(used * quotaPercent / limit)
+}
+
+// countShareUsage adds up the apparent size of the files of a share,
+// snapshots left out
+func countShareUsage(ctx context.Context, share models.FileShare) (int64, error) {
+	var used int64
+	err := filepath.WalkDir(share.Path, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// Unreadable entries are skipped, as by the usage scan
+			return nil
+		}
+		if d.IsDir() && filepath.Dir(p) == share.Path && (d.Name() == snapshotDirName || d.Name() == zfsControlDir) {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				used += info.Size()
+			}
+		}
+		return nil
+	})
+	return used, err
+}
+
+// shareQuota returns the limit of a share, 0 for none, and its usage when
+// it has been counted
+func shareQuota(name string) (int64, int64, bool) {
+	limit := quotaSettings().Shares[name]
+	if limit <= 0 {
+		return 0, 0, false
+	}
+	quotaCounts.Lock()
+	defer quotaCounts.Unlock()
+	count := quotaCounts.shares[name]
+	if count == nil {
+		return limit, 0, false
+	}
+	return limit, count.used, true
+}
+
+// checkShareQuota answers errQuotaExceeded when adding bytes to a share
+// would take it over its quota. A share not counted yet is let through.
+func checkShareQuota(name string, adding int64) error {
+	limit, used, ok := shareQuota(name)
+	if ok && used+adding > limit {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// chargeShareQuota adds bytes written to a share to its usage, or takes
+// away bytes removed when negative
+func chargeShareQuota(name string, n int64) {
+	quotaCounts.Lock()
+	defer quotaCounts.Unlock()
+	if count := quotaCounts.shares[name]; count != nil {
+		count.used = max(count.used+n, 0)
+	}
+}
+
+// markQuotaStale has a share counted again at the next tick, after a
+// change too costly to size up front
+func markQuotaStale(name string) {
+	quotaCounts.Lock()
+	defer quotaCounts.Unlock()
+	if count := quotaCounts.shares[name]; count != nil {
+		count.stale = true
+	}
+}
+
+// userQuotaUsage is what a user keeps in the transfer area: their files,
+// and the full size of their uploads in progress
+func userQuotaUsage(username string) int64 {
+	var used int64
+	var data models.TransferData
+	utils.ReadJSON(getTransferIndexFile(), &data)
+	for _, item := range data.Items {
+		if item.Sender == username && item.File != nil {
+			used += item.File.Size
+		}
+	}
+	for _, s := range listUploadSessions(username) {
+		used += s.Size
+	}
+	return used
+}
+
+// checkUserQuota answers errQuotaExceeded when an upload of size bytes
+// would take a user over their quota
+func checkUserQuota(username string, size int64) (int64, int64, error) {
+	limit := quotaSettings().Users[username]
+	if limit <= 0 {
+		return 0, 0, nil
+	}
+	used := userQuotaUsage(username)
+	if used+size > limit {
+		return limit, used, errQuotaExceeded
+	}
+	return limit, used, nil
+}
+
+// pathSize is the size of the files at or under p, symlinks not followed
+func pathSize(p string) int64 {
+	var size int64
+	filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// countQuotas walks the shares with a quota that are stale or were last
+// counted over quotaRescan ago, then sends the warnings due
+func countQuotas(ctx context.Context, force bool) {
+	settings := quotaSettings()
+	for _, share := range browseShares() {
+		if settings.Shares[share.Name] <= 0 || ctx.Err() != nil {
+			continue
+		}
+		quotaCounts.Lock()
+		count := quotaCounts.shares[share.Name]
+		due := force || count == nil || count.stale || time.Since(count.countedAt) > quotaRescan
+		quotaCounts.Unlock()
+		if !due {
+			continue
+		}
+		started := time.Now()
+		used, err := countShareUsage(ctx, share)
+		if err != nil {
+			filesLog.Warn("Quota count failed", "share", share.Name, "error", err)
+			continue
+		}
+		quotaCounts.Lock()
+		// Writes charged while walking may be counted twice until the
+		// next walk; that errs on the safe side
+		if count := quotaCounts.shares[share.Name]; count != nil && count.countedAt.After(started) {
+			quotaCounts.Unlock()
+			continue
+		}
+		quotaCounts.shares[share.Name] = &shareQuotaCount{used: used, countedAt: time.Now()}
+		quotaCounts.Unlock()
+	}
+	warnQuotas(settings)
+}
+
+// quotaUsages lists the users and shares with a quota
+func quotaUsages(settings models.QuotaSettings) ([]QuotaUsage, []QuotaUsage) {
+	users := make([]QuotaUsage, 0, len(settings.Users))
+	for name, limit := range settings.Users {
+		used := userQuotaUsage(name)
+		users = append(users, QuotaUsage{Name: name, Limit: limit, Used: used, Percent: quotaPercentOf(used, limit)})
+	}
+	shares := make([]QuotaUsage, 0, len(settings.Shares))
+	quotaCounts.Lock()
+	for name, limit := range settings.Shares {
+		u := QuotaUsage{Name: name, Limit: limit}
+		if count := quotaCounts.shares[name]; count != nil {
+			u.Used, u.Percent, u.CountedAt = count.used, quotaPercentOf(count.used, limit), count.countedAt.UnixMilli()
+		}
+		shares = append(shares, u)
+	}
+	quotaCounts.Unlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Name < shares[j].Name })
+	return users, shares
+}
+
+// warnQuotas notifies about the users and shares that crossed a warning
+// threshold since they were last below it
+func warnQuotas(settings models.QuotaSettings) {
+	users, shares := quotaUsages(settings)
+	quotaWarned.Lock()
+	defer quotaWarned.Unlock()
+	warned := map[string]int{}
+	_ = utils.ReadJSON(quotaWarningsFile(), &warned)
+	var due []func()
+	changed := false
+	for _, list := range []struct {
+		kind   string
+		usages []QuotaUsage
+	}{{"user", users}, {"share", shares}} {
+		for _, u := range list.usages {
+			if list.kind == "share" && u.CountedAt == 0 {
+				continue
+			}
+			level := 0
+			for _, p := range settings.Warn {
+				if u.Percent >= p {
+					level = p
+				}
+			}
+			key := list.kind + ":" + u.Name
+			if level > warned[key] {
+				kind, u := list.kind, u
+				due = append(due, func() { raiseQuotaWarning(kind, u, settings.Channels) })
+			}
+			if level != warned[key] {
+				warned[key] = level
+				changed = true
+			}
+		}
+	}
+	if changed {
+		if err := utils.WriteJSON(quotaWarningsFile(), warned); err != nil {
+			filesLog.Warn("Failed to save quota warnings", "error", err)
+		}
+	}
+	for _, warn := range due {
+		warn()
+	}
+}
+
+func raiseQuotaWarning(kind string, u QuotaUsage, channels []string) {
+	filesLog.Warn("Quota nearly used", "kind", kind, "name", u.Name, "used", u.Used, "limit", u.Limit)
+	sendNotification(backgroundCtx, Notification{
+		Title:  i18n.T(notifyLocale(), "notify_quota_"+kind, u.Name, u.Percent),
+		Body:   i18n.T(notifyLocale(), "notify_quota_body", formatSyncBytes(u.Used), formatSyncBytes(u.Limit)),
+		Source: "quota",
+	}, channels)
+	fireWebhook(WebhookQuotaWarning, map[string]interface{}{
+		"kind":    kind,
+		"name":    u.Name,
+		"used":    u.Used,
+		"limit":   u.Limit,
+		"percent": u.Percent,
+	})
+}
+
+// StartQuotaAccounting counts the usage of the shares with a quota and
+// sends the warnings
+func StartQuotaAccounting() {
+	go func() {
+		ticker := time.NewTicker(quotaTick)
+		defer ticker.Stop()
+		beat := registerWorker("quota.count", quotaTick)
+		for {
+			beat()
+			countQuotas(backgroundCtx, false)
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// quotaError answers an upload refused by a quota
+func quotaError(c *gin.Context, limit, used int64) {
+	c.JSON(http.StatusInsufficientStorage, gin.H{"error": errQuotaExceeded.Error(), "limit": limit, "used": used})
+}
+
+// GetQuotas lists the users and shares with a quota and their usage
+func GetQuotas(c *gin.Context) {
+	settings := quotaSettings()
+	users, shares := quotaUsages(settings)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"users": users, "shares": shares, "warn": settings.Warn}})
+}
+
+// RecountQuotas walks the shares with a quota again now
+func RecountQuotas(c *gin.Context) {
+	go countQuotas(backgroundCtx, true)
+	c.JSON(http.StatusAccepted, gin.H{"success": true})
+}
+
+// GetUserQuota is the transfer quota of the current user, a limit of 0
+// being none
+func GetUserQuota(c *gin.Context) {
+	username := c.GetString("username")
+	limit := quotaSettings().Users[username]
+	used := userQuotaUsage(username)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": QuotaUsage{Name: username, Limit: limit, Used: used, Percent: quotaPercentOf(used, limit)}})
+}
+
+// quotaFile counts what is written to a file of a share with a quota
+// through WebDAV or SFTP, refusing writes past the quota
+type quotaFile struct {
+	share   string
+	limit   int64
+	used    int64 // Share usage when the file was opened
+	written int64
+	start   int64 // File size when opened
+}
+
+// newQuotaFile is called before full is opened, to learn its size
+func newQuotaFile(share, full string) (*quotaFile, error) {
+	limit, used, ok := shareQuota(share)
+	if limit <= 0 {
+		return nil, nil
+	}
+	if ok && used >= limit {
+		return nil, errQuotaExceeded
+	}
+	q := &quotaFile{share: share, limit: limit, used: used}
+	if !ok {
+		q.limit = 0
+	}
+	if info, err := os.Stat(full); err == nil {
+		q.start = info.Size()
+	}
+	return q, nil
+}
+
+func (q *quotaFile) allow(n int) error {
+	if q.limit > 0 && q.used+q.written+int64(n) > q.limit {
+		return errQuotaExceeded
+	}
+	q.written += int64(n)
+	return nil
+}
+
+// closed charges the growth of the file to the share
+func (q *quotaFile) closed(f *os.File) {
+	if info, err := f.Stat(); err == nil {
+		chargeShareQuota(q.share, info.Size()-q.start)
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestQuotas(t *testing.T) {
+	useTestConfig(t)
+	prevDoc := config.DocDir
+	config.DocDir = t.TempDir()
+	defer func() { config.DocDir = prevDoc }()
+	gin.SetMode(gin.TestMode)
+
+	if _, err := decodeQuotaSettings(map[string]interface{}{"warn": []int{120}}); err == nil {
+		t.Fatalf("expected an error for a threshold over 100")
+	}
+	quotas, err := decodeQuotaSettings(map[string]interface{}{"users": map[string]int64{"bob": 50, "eve": 0}, "shares": map[string]int64{"media": 100}, "warn": []int{80}})
+	if err != nil || len(quotas.Users) != 1 {
+		t.Fatalf("unexpected quotas %+v %v", quotas, err)
+	}
+	media, other := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(media, "a.bin"), make([]byte, 60), 0644)
+	os.WriteFile(filepath.Join(other, "b.bin"), make([]byte, 30), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{
+		Shares: []models.FileShare{{Name: "media", Path: media}, {Name: "other", Path: other}},
+		Quotas: quotas,
+	})
+	quotaCounts.Lock()
+	delete(quotaCounts.shares, "media")
+	quotaCounts.Unlock()
+	countQuotas(context.Background(), false)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("username", "bob") })
+	r.POST("/files/copy", CopyFiles)
+	r.GET("/quotas", GetQuotas)
+	r.GET("/quota", GetUserQuota)
+	r.POST("/upload/init", UploadInit)
+	usage := func() QuotaUsage {
+		var resp struct{ Data struct{ Shares []QuotaUsage } }
+		json.Unmarshal(serve(r, "GET", "/quotas", "").Body.Bytes(), &resp)
+		if len(resp.Data.Shares) != 1 {
+			t.Fatalf("unexpected quotas %+v", resp.Data)
+		}
+		return resp.Data.Shares[0]
+	}
+	if u := usage(); u.Used != 60 || u.Percent != 60 || u.CountedAt == 0 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+
+	copyTo := `{"share":"other","paths":["b.bin"],"toShare":"media","to":""}`
+	if w := serve(r, "POST", "/files/copy", copyTo); w.Code != 200 {
+		t.Fatalf("copy failed: %d %s", w.Code, w.Body.String())
+	}
+	if u := usage(); u.Used != 90 {
+		t.Fatalf("copy not charged: %+v", u)
+	}
+	if w := serve(r, "POST", "/files/copy", copyTo); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507, got %d", w.Code)
+	}
+	// Crossing 80% warns once
+	countQuotas(context.Background(), false)
+	warned := map[string]int{}
+	utils.ReadJSON(quotaWarningsFile(), &warned)
+	if warned["share:media"] != 80 {
+		t.Fatalf("unexpected warnings %v", warned)
+	}
+
+	// WebDAV and SFTP writes stop at the quota
+	fsys := &shareFS{username: "bob"}
+	f, err := fsys.OpenFile(context.Background(), "/media/c.bin", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if _, err := f.Write(make([]byte, 20)); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("expected the quota error, got %v", err)
+	}
+	if _, err := f.Write(make([]byte, 5)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	f.Close()
+	if u := usage(); u.Used != 95 {
+		t.Fatalf("write not charged: %+v", u)
+	}
+
+	if w := serve(r, "POST", "/upload/init", `{"fileName":"a.jpg","size":60,"chunkSize":10}`); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507, got %d", w.Code)
+	}
+	if w := serve(r, "POST", "/upload/init", `{"fileName":"a.jpg","size":40,"chunkSize":10}`); w.Code != 200 {
+		t.Fatalf("upload init failed: %d %s", w.Code, w.Body.String())
+	}
+	// The upload in progress counts
+	if w := serve(r, "POST", "/upload/init", `{"fileName":"b.jpg","size":20,"chunkSize":10}`); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507, got %d", w.Code)
+	}
+	var mine struct{ Data QuotaUsage }
+	json.Unmarshal(serve(r, "GET", "/quota", "").Body.Bytes(), &mine)
+	if mine.Data.Limit != 50 || mine.Data.Used != 40 || mine.Data.Percent != 80 {
+		t.Fatalf("unexpected user quota %+v", mine.Data)
+	}
+}
@@ -0,0 +1,449 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Linux software RAID arrays are read from /proc/mdstat, with the state of
+// each member and the running sync action from sysfs. A check or repair
+// is started by writing to the array's sync_action; spares are added with
+// mdadm. The monitor reads mdstat every half minute and alerts as soon as
+// an array loses a disk.
+
+const raidCheckInterval = 30 * time.Second
+
+// mdstatFile lists the md arrays of the host
+var mdstatFile = "/proc/mdstat"
+
+var (
+	errRaidNotFound = errors.New("Array not found")
+	errRaidBusy     = errors.New("The array is already syncing")
+	errRaidInactive = errors.New("The array is not running")
+	errRaidMember   = errors.New("The disk is already in the array")
+	errNoMdadm      = errors.New("mdadm is not installed")
+)
+
+var (
+	raidArrayRe  = regexp.MustCompile(`^md[0-9A-Za-z_]+$`)
+	raidDeviceRe = regexp.MustCompile(`^/dev/[A-Za-z0-9][A-Za-z0-9/_.:-]*$`)
+	raidMemberRe = regexp.MustCompile(`^([^\[\s]+)\[(\d+)\]((?:\([A-Z]\))*)$`)
+	raidSlotsRe  = regexp.MustCompile(`\[(\d+)/(\d+)\]\s+\[([U_]+)\]`)
+	raidSyncRe   = regexp.MustCompile(`(recovery|resync|check|repair|reshape)\s*=\s*([\d.]+)%(?:.*?finish=([\d.]+)min)?(?:.*?speed=(\d+)K/sec)?`)
+	raidPendRe   = regexp.MustCompile(`(recovery|resync|check|repair|reshape)\s*=\s*(DELAYED|PENDING)`)
+)
+
+// raidToolError is an mdadm command that failed
+type raidToolError struct {
+	output string
+}
+
+func (e *raidToolError) Error() string { return "mdadm failed: " + e.output }
+
+// RaidArray is an md array
+type RaidArray struct {
+	Name     string       `json:"name"`
+	Level    string       `json:"level"`
+	State    string       `json:"state"`  // clean, degraded, rebuilding, resyncing, checking or inactive
+	Active   bool         `json:"active"` // Assembled and running
+	ReadOnly bool         `json:"readOnly"`
+	Size     int64        `json:"size"`    // Bytes
+	Devices  int          `json:"devices"` // Disks the array is made of
+	Working  int          `json:"working"` // Of which are in sync
+	Slots    string       `json:"slots"`   // e.g. UU_, as in mdstat
+	Members  []RaidMember `json:"members"`
+	Sync     *RaidSync    `json:"sync,omitempty"`
+}
+
+// RaidMember is a disk of an array
+type RaidMember struct {
+	Device string `json:"device"`
+	Number int    `json:"number"` // As in mdstat, not the slot in the array
+	State  string `json:"state"`  // active, spare, rebuilding or faulty
+}
+
+// RaidSync is a running or queued sync of an array
+type RaidSync struct {
+	Action   string  `json:"action"` // recovery, resync, check, repair or reshape
+	Progress float64 `json:"progress"`
+	Pending  bool    `json:"pending,omitempty"` // Waits for another array on the same disks
+	Minutes  float64 `json:"minutes,omitempty"` // Estimated time left
+	Speed    int64   `json:"speed,omitempty"`   // Bytes per second
+}
+
+// RaidActionRequest starts or stops a sync action, or adds a spare
+type RaidActionRequest struct {
+	Array  string `json:"array"`
+	Action string `json:"action,omitempty"` // check, repair or idle
+	Device string `json:"device,omitempty"` // The spare, e.g. /dev/sdf1
+}
+
+// raidAlerted is what was reported of each array since the start
+var raidAlerted = struct {
+	sync.Mutex
+	failed map[string]int // Disks out of sync
+}{failed: make(map[string]int)}
+
+func raidSettings() models.RaidSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.Raid == nil {
+		return models.RaidSettings{}
+	}
+	return *sysConfig.Raid
+}
+
+// decodeRaidSettings reads the "raid" field of a system config update
+func decodeRaidSettings(raw interface{}) (*models.RaidSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RAID settings")
+	}
+	settings := &models.RaidSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid RAID settings")
+	}
+	return settings, nil
+}
+
+// parseMdstat reads the arrays of /proc/mdstat
+func parseMdstat(data []byte) []RaidArray {
+	arrays := []RaidArray{}
+	var cur *RaidArray
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, rest, ok := strings.Cut(line, " : "); ok && raidArrayRe.MatchString(name) {
+			arrays = append(arrays, RaidArray{Name: name, Members: []RaidMember{}})
+			cur = &arrays[len(arrays)-1]
+			for _, f := range strings.Fields(rest) {
+				switch {
+				case f == "active":
+					cur.Active = true
+				case strings.Contains(f, "read-only"):
+					cur.ReadOnly = true
+				case f == "linear" || f == "multipath" || strings.HasPrefix(f, "raid"):
+					cur.Level = f
+				default:
+					if m := raidMemberRe.FindStringSubmatch(f); m != nil {
+						number, _ := strconv.Atoi(m[2])
+						member := RaidMember{Device: m[1], Number: number, State: "active"}
+						switch {
+						case strings.Contains(m[3], "(F)"):
+							member.State = "faulty"
+						case strings.Contains(m[3], "(S)"):
+							member.State = "spare"
+						}
+						cur.Members = append(cur.Members, member)
+					}
+				}
+			}
+			continue
+		}
+		if cur == nil || strings.TrimSpace(line) == "" {
+			cur = nil
+			continue
+		}
+		if blocks, _, ok := strings.Cut(strings.TrimSpace(line), " blocks"); ok {
+			if n, err := strconv.ParseInt(blocks, 10, 64); err == nil {
+				cur.Size = n * 1024
+			}
+		}
+		if m := raidSlotsRe.FindStringSubmatch(line); m != nil {
+			cur.Devices, _ = strconv.Atoi(m[1])
+			cur.Working, _ = strconv.Atoi(m[2])
+			cur.Slots = m[3]
+		}
+		if m := raidSyncRe.FindStringSubmatch(line); m != nil {
+			s := &RaidSync{Action: m[1]}
+			s.Progress, _ = strconv.ParseFloat(m[2], 64)
+			s.Minutes, _ = strconv.ParseFloat(m[3], 64)
+			if speed, err := strconv.ParseInt(m[4], 10, 64); err == nil {
+				s.Speed = speed * 1024
+			}
+			cur.Sync = s
+		} else if m := raidPendRe.FindStringSubmatch(line); m != nil {
+			cur.Sync = &RaidSync{Action: m[1], Pending: true}
+		}
+	}
+	for i := range arrays {
+		arrays[i].State = raidState(arrays[i])
+	}
+	return arrays
+}
+
+func raidState(a RaidArray) string {
+	switch {
+	case !a.Active:
+		return "inactive"
+	case a.Working < a.Devices && a.Sync != nil && a.Sync.Action == "recovery":
+		return "rebuilding"
+	case a.Working < a.Devices:
+		return "degraded"
+	case a.Sync != nil && (a.Sync.Action == "check" || a.Sync.Action == "repair"):
+		return "checking"
+	case a.Sync != nil:
+		return "resyncing"
+	}
+	return "clean"
+}
+
+// raidSysfs is the md folder of an array in sysfs
+func raidSysfs(name string) string {
+	return filepath.Join(sysBlockDir, name, "md")
+}
+
+// raidMemberStates refines the members of an array from sysfs, which
+// tells a disk being rebuilt, one out of sync that has a slot, from a
+// spare
+func raidMemberStates(a *RaidArray) {
+	for i := range a.Members {
+		m := &a.Members[i]
+		dir := filepath.Join(raidSysfs(a.Name), "dev-"+m.Device)
+		data, err := os.ReadFile(filepath.Join(dir, "state"))
+		if err != nil {
+			continue
+		}
+		states := strings.Split(strings.TrimSpace(string(data)), ",")
+		slot, _ := os.ReadFile(filepath.Join(dir, "slot"))
+		switch {
+		case slices.Contains(states, "faulty"):
+			m.State = "faulty"
+		case slices.Contains(states, "in_sync"):
+			m.State = "active"
+		case strings.TrimSpace(string(slot)) != "none" && len(slot) > 0:
+			m.State = "rebuilding"
+		default:
+			m.State = "spare"
+		}
+	}
+}
+
+func readRaidArrays() ([]RaidArray, error) {
+	data, err := os.ReadFile(mdstatFile)
+	if os.IsNotExist(err) {
+		return []RaidArray{}, nil // No md driver
+	}
+	if err != nil {
+		return nil, err
+	}
+	arrays := parseMdstat(data)
+	for i := range arrays {
+		raidMemberStates(&arrays[i])
+	}
+	return arrays, nil
+}
+
+func findRaidArray(name string) (RaidArray, error) {
+	arrays, err := readRaidArrays()
+	if err != nil {
+		return RaidArray{}, err
+	}
+	for _, a := range arrays {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return RaidArray{}, errRaidNotFound
+}
+
+// checkRaidArrays alerts on every array that lost a disk since the last
+// check
+func checkRaidArrays() {
+	arrays, err := readRaidArrays()
+	if err != nil {
+		diskLog.Error("Reading RAID arrays failed", "error", err)
+		return
+	}
+	raidAlerted.Lock()
+	defer raidAlerted.Unlock()
+	seen := make(map[string]bool, len(arrays))
+	for _, a := range arrays {
+		if !a.Active {
+			continue
+		}
+		seen[a.Name] = true
+		missing := a.Devices - a.Working
+		if missing > raidAlerted.failed[a.Name] {
+			raiseRaidAlert(a)
+		}
+		raidAlerted.failed[a.Name] = missing
+	}
+	for name := range raidAlerted.failed {
+		if !seen[name] {
+			delete(raidAlerted.failed, name)
+		}
+	}
+}
+
+func raiseRaidAlert(a RaidArray) {
+	locale := notifyLocale()
+	lines := []string{i18n.T(locale, "notify_raid_working", a.Working, a.Devices)}
+	var faulty []string
+	for _, m := range a.Members {
+		if m.State == "faulty" {
+			faulty = append(faulty, m.Device)
+		}
+	}
+	if len(faulty) > 0 {
+		lines = append(lines, i18n.T(locale, "notify_raid_faulty", strings.Join(faulty, ", ")))
+	}
+	diskLog.Warn("RAID array degraded", "array", a.Name, "working", a.Working, "devices", a.Devices, "faulty", faulty)
+	sendNotification(backgroundCtx, Notification{
+		Title:  i18n.T(locale, "notify_raid_degraded", a.Name),
+		Body:   strings.Join(lines, "\n"),
+		Source: "raid",
+	}, raidSettings().Channels)
+	fireWebhook(WebhookDiskAlert, map[string]interface{}{
+		"array":   a.Name,
+		"level":   a.Level,
+		"state":   a.State,
+		"working": a.Working,
+		"devices": a.Devices,
+		"faulty":  faulty,
+	})
+}
+
+// StartRaidMonitor watches the md arrays for lost disks
+func StartRaidMonitor() {
+	go func() {
+		ticker := time.NewTicker(raidCheckInterval)
+		defer ticker.Stop()
+		beat := registerWorker("raid.monitor", raidCheckInterval)
+		for {
+			beat()
+			checkRaidArrays()
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func raidError(c *gin.Context, err error) {
+	var toolErr *raidToolError
+	switch {
+	case errors.As(err, &toolErr):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "RAID operation failed", "details": toolErr.output})
+	case errors.Is(err, errRaidNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errRaidBusy), errors.Is(err, errRaidInactive), errors.Is(err, errRaidMember):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoMdadm):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		diskLog.Error("RAID operation failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "RAID operation failed"})
+	}
+}
+
+// GetRaidArrays lists the md arrays
+func GetRaidArrays(c *gin.Context) {
+	arrays, err := readRaidArrays()
+	if err != nil {
+		raidError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": arrays})
+}
+
+// bindRaidRequest reads a RaidActionRequest and finds its running array
+func bindRaidRequest(c *gin.Context) (RaidActionRequest, RaidArray, bool) {
+	var req RaidActionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !raidArrayRe.MatchString(req.Array) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid array"})
+		return req, RaidArray{}, false
+	}
+	a, err := findRaidArray(req.Array)
+	if err == nil && !a.Active {
+		err = errRaidInactive
+	}
+	if err != nil {
+		raidError(c, err)
+		return req, RaidArray{}, false
+	}
+	return req, a, true
+}
+
+// RaidSyncAction starts a check or repair of an array, or stops the one
+// running with "idle"
+func RaidSyncAction(c *gin.Context) {
+	req, a, ok := bindRaidRequest(c)
+	if !ok {
+		return
+	}
+	switch req.Action {
+	case "check", "repair":
+		if a.Sync != nil {
+			raidError(c, errRaidBusy)
+			return
+		}
+	case "idle":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid action"})
+		return
+	}
+	if err := os.WriteFile(filepath.Join(raidSysfs(a.Name), "sync_action"), []byte(req.Action+"\n"), 0644); err != nil {
+		raidError(c, err)
+		return
+	}
+	diskLog.Info("RAID sync action", "array", a.Name, "action", req.Action)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// AddRaidSpare adds a disk to an array as a spare; a degraded array starts
+// rebuilding onto it at once
+func AddRaidSpare(c *gin.Context) {
+	req, a, ok := bindRaidRequest(c)
+	if !ok {
+		return
+	}
+	if !raidDeviceRe.MatchString(req.Device) || strings.Contains(req.Device, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device"})
+		return
+	}
+	for _, m := range a.Members {
+		if "/dev/"+m.Device == req.Device {
+			raidError(c, errRaidMember)
+			return
+		}
+	}
+	out, err := systemCommand(c.Request.Context(), errNoMdadm, "mdadm", "--manage", "/dev/"+a.Name, "--add", req.Device)
+	if err != nil {
+		if !errors.Is(err, errNoMdadm) {
+			err = &raidToolError{output: strings.TrimSpace(string(out))}
+		}
+		raidError(c, err)
+		return
+	}
+	diskLog.Info("RAID spare added", "array", a.Name, "device", req.Device)
+	a, err = findRaidArray(a.Name)
+	if err != nil {
+		raidError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": a})
+}
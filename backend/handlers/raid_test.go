@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testMdstat = `Personalities : [raid1] [raid6] [raid5] [raid4]
+md0 : active raid1 sdb1[1] sda1[0]
+      976630464 blocks super 1.2 [2/2] [UU]
+      bitmap: 0/8 pages [0KB], 65536KB chunk
+
+md1 : active raid5 sde1[3] sdd1[1] sdc1[0] sdf1[4](S) sdg1[2](F)
+      1953260544 blocks super 1.2 level 5, 512k chunk, algorithm 2 [3/2] [UU_]
+      [=>...................]  recovery =  8.5% (83034880/976630272) finish=76.4min speed=194936K/sec
+
+md2 : active raid1 sdi1[1] sdh1[0]
+      488253440 blocks super 1.2 [2/2] [UU]
+      	resync=DELAYED
+
+md127 : inactive sdj1[0](S)
+      976630464 blocks super 1.2
+
+unused devices: <none>
+`
+
+func TestParseMdstat(t *testing.T) {
+	arrays := parseMdstat([]byte(testMdstat))
+	if len(arrays) != 4 {
+		t.Fatalf("expected four arrays, got %+v", arrays)
+	}
+	md0, md1, md2, md127 := arrays[0], arrays[1], arrays[2], arrays[3]
+	if md0.Level != "raid1" || md0.State != "clean" || md0.Size != 976630464*1024 || len(md0.Members) != 2 || md0.Sync != nil {
+		t.Fatalf("unexpected md0 %+v", md0)
+	}
+	if md1.State != "rebuilding" || md1.Devices != 3 || md1.Working != 2 || md1.Slots != "UU_" || len(md1.Members) != 5 {
+		t.Fatalf("unexpected md1 %+v", md1)
+	}
+	if s := md1.Sync; s == nil || s.Action != "recovery" || s.Progress != 8.5 || s.Minutes != 76.4 || s.Speed != 194936*1024 {
+		t.Fatalf("unexpected md1 sync %+v", md1.Sync)
+	}
+	if md1.Members[3].State != "spare" || md1.Members[4].State != "faulty" || md1.Members[4].Number != 2 {
+		t.Fatalf("unexpected md1 members %+v", md1.Members)
+	}
+	if md2.State != "resyncing" || md2.Sync == nil || !md2.Sync.Pending {
+		t.Fatalf("unexpected md2 %+v", md2)
+	}
+	if md127.Active || md127.State != "inactive" || md127.Level != "" || len(md127.Members) != 1 {
+		t.Fatalf("unexpected md127 %+v", md127)
+	}
+}
+
+func TestRaid(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	prevMdstat, prevBlock := mdstatFile, sysBlockDir
+	mdstatFile, sysBlockDir = filepath.Join(t.TempDir(), "mdstat"), t.TempDir()
+	defer func() { mdstatFile, sysBlockDir = prevMdstat, prevBlock }()
+	raidAlerted.Lock()
+	raidAlerted.failed = make(map[string]int)
+	raidAlerted.Unlock()
+
+	r := gin.New()
+	r.GET("/admin/raid", GetRaidArrays)
+	r.POST("/admin/raid/sync", RaidSyncAction)
+	r.POST("/admin/raid/spare", AddRaidSpare)
+
+	// Hosts without the md driver have no arrays
+	if code, resp := serveJSON(r, "GET", "/admin/raid", ""); code != 200 || len(resp["data"].([]interface{})) != 0 {
+		t.Fatalf("expected no arrays, got %d %v", code, resp)
+	}
+
+	os.WriteFile(mdstatFile, []byte(testMdstat), 0644)
+	md1 := filepath.Join(sysBlockDir, "md1", "md")
+	for dev, state := range map[string][2]string{
+		"sdc1": {"in_sync", "0"},
+		"sdd1": {"in_sync", "1"},
+		"sde1": {"spare", "2"},
+		"sdf1": {"spare", "none"},
+		"sdg1": {"faulty", "none"},
+	} {
+		os.MkdirAll(filepath.Join(md1, "dev-"+dev), 0755)
+		os.WriteFile(filepath.Join(md1, "dev-"+dev, "state"), []byte(state[0]+"\n"), 0644)
+		os.WriteFile(filepath.Join(md1, "dev-"+dev, "slot"), []byte(state[1]+"\n"), 0644)
+	}
+	w := serve(r, "GET", "/admin/raid", "")
+	var resp struct{ Data []RaidArray }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != 200 || err != nil || len(resp.Data) != 4 {
+		t.Fatalf("unexpected arrays %d %s", w.Code, w.Body.String())
+	}
+	// sysfs tells the disk being rebuilt from the spare
+	if m := resp.Data[1].Members; m[0].State != "rebuilding" || m[3].State != "spare" || m[4].State != "faulty" {
+		t.Fatalf("unexpected members %+v", m)
+	}
+
+	// The monitor remembers how many disks each array misses, to alert
+	// again only when it loses another
+	checkRaidArrays()
+	raidAlerted.Lock()
+	failed := raidAlerted.failed["md1"]
+	raidAlerted.Unlock()
+	if failed != 1 {
+		t.Fatalf("expected md1 reported with one disk out, got %d", failed)
+	}
+
+	// Checks need a running array that is not syncing already
+	os.MkdirAll(filepath.Join(sysBlockDir, "md0", "md"), 0755)
+	for body, code := range map[string]int{
+		`{"array":"md0","action":"check"}`:   200,
+		`{"array":"md1","action":"check"}`:   409,
+		`{"array":"md127","action":"check"}`: 409,
+		`{"array":"md9","action":"check"}`:   404,
+		`{"array":"md0","action":"frozen"}`:  400,
+		`{"array":"../md0","action":"idle"}`: 400,
+	} {
+		if got, resp := serveJSON(r, "POST", "/admin/raid/sync", body); got != code {
+			t.Fatalf("%s: expected %d, got %d %v", body, code, got, resp)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(sysBlockDir, "md0", "md", "sync_action")); string(data) != "check\n" {
+		t.Fatalf("expected a check started, got %q", data)
+	}
+
+	// Spares are added with mdadm
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.WriteFile(filepath.Join(bin, "mdadm"), []byte("#!/bin/sh\necho \"$@\" > \"$(dirname \"$0\")/mdadm.log\"\n"), 0755)
+	for body, code := range map[string]int{
+		`{"array":"md0","device":"/dev/sdk1"}`:     200,
+		`{"array":"md0","device":"/dev/sda1"}`:     409,
+		`{"array":"md0","device":"sdk1"}`:          400,
+		`{"array":"md0","device":"/dev/../etc/x"}`: 400,
+		`{"array":"md0","device":"/dev/sdk1 --x"}`: 400,
+	} {
+		if got, resp := serveJSON(r, "POST", "/admin/raid/spare", body); got != code {
+			t.Fatalf("%s: expected %d, got %d %v", body, code, got, resp)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(bin, "mdadm.log")); string(data) != "--manage /dev/md0 --add /dev/sdk1\n" {
+		t.Fatalf("unexpected mdadm call %q", data)
+	}
+	os.WriteFile(filepath.Join(bin, "mdadm"), []byte("#!/bin/sh\necho 'mdadm: Cannot open /dev/sdk1: Device or resource busy'\nexit 1\n"), 0755)
+	if code, resp := serveJSON(r, "POST", "/admin/raid/spare", `{"array":"md0","device":"/dev/sdk1"}`); code != 500 || resp["details"] == nil {
+		t.Fatalf("expected the mdadm error, got %d %v", code, resp)
+	}
+}
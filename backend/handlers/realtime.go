@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/middleware"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/gorilla/websocket"
+)
+
+// Realtime events reach clients over socket.io or over the plain WebSocket
+// endpoint /ws. Handlers broadcast through broadcastAll and broadcastRoom so
+// both kinds of client see the same events; systemConfig.realtimeTransport
+// tells the frontend which one to use.
+//
+// On /ws every text frame is one envelope, {"event": "rss:fetch", "data": ...}
+// in both directions. The server greets with a "connect" event carrying the
+// connection id. Clients join rooms with {"event": "join", "data": "<room>"},
+// which needs a token allowed in the room (see JoinRoom).
+
+const (
+	TransportSocketIO  = "socketio"
+	TransportWebSocket = "websocket"
+)
+
+const (
+	wsMaxMessage = 4 << 20
+	wsSendBuffer = 256
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 25 * time.Second
+	wsIDPrefix   = "ws-"
+)
+
+type wsEnvelope struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// broadcastAll sends an event to every connected client
+func broadcastAll(event string, data interface{}) {
+	if socketServer != nil {
+		socketServer.BroadcastToNamespace("/", event, data)
+	}
+	wsClients.broadcast("", event, data)
+}
+
+// broadcastRoom sends an event to the clients that joined room
+func broadcastRoom(room, event string, data interface{}) {
+	if socketServer != nil {
+		socketServer.BroadcastToRoom("/", room, event, data)
+	}
+	wsClients.broadcast(room, event, data)
+}
+
+// JoinRoom handles the generic "join" event. Rooms carry events meant for
+// some users only, so the connection's token must be allowed in the room;
+// rooms not listed in canJoinRoom cannot be joined this way.
+func JoinRoom(s socketio.Conn, room string) {
+	token, _ := s.Context().(string)
+	if !canJoinRoom(token, room) {
+		s.Emit("error", map[string]interface{}{"error": "Permission denied", "room": room})
+		return
+	}
+	s.Join(room)
+}
+
+func canJoinRoom(token, room string) bool {
+	switch {
+	case room == logsRoom, room == syncRoom:
+		return socketAdmin(token)
+	case strings.HasPrefix(room, uploadRoom("")):
+		username, ok := validateSocketToken(token)
+		return ok && room == uploadRoom(username)
+	}
+	return false
+}
+
+// roomLen counts the clients in room on both transports
+func roomLen(room string) int {
+	n := wsClients.roomLen(room)
+	if socketServer != nil {
+		n += socketServer.RoomLen("/", room)
+	}
+	return n
+}
+
+type wsHub struct {
+	mu    sync.Mutex
+	conns map[string]*wsConn
+	rooms map[string]map[string]*wsConn
+	next  uint64
+}
+
+var wsClients = &wsHub{conns: make(map[string]*wsConn), rooms: make(map[string]map[string]*wsConn)}
+
+func (h *wsHub) add(c *wsConn) {
+	h.mu.Lock()
+	h.conns[c.id] = c
+	h.mu.Unlock()
+}
+
+func (h *wsHub) remove(c *wsConn) {
+	h.mu.Lock()
+	delete(h.conns, c.id)
+	for room, members := range h.rooms {
+		delete(members, c.id)
+		if len(members) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *wsHub) join(c *wsConn, room string) {
+	h.mu.Lock()
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[string]*wsConn)
+	}
+	h.rooms[room][c.id] = c
+	h.mu.Unlock()
+}
+
+func (h *wsHub) leave(c *wsConn, room string) {
+	h.mu.Lock()
+	if members := h.rooms[room]; members != nil {
+		delete(members, c.id)
+		if len(members) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *wsHub) roomsOf(c *wsConn) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var rooms []string
+	for room, members := range h.rooms {
+		if _, ok := members[c.id]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+func (h *wsHub) roomLen(room string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.rooms[room])
+}
+
+// broadcast sends to a room, or to everyone when room is empty. The frame
+// is encoded once for all receivers.
+func (h *wsHub) broadcast(room, event string, data interface{}) {
+	h.mu.Lock()
+	var targets []*wsConn
+	if room == "" {
+		targets = make([]*wsConn, 0, len(h.conns))
+		for _, c := range h.conns {
+			targets = append(targets, c)
+		}
+	} else {
+		for _, c := range h.rooms[room] {
+			targets = append(targets, c)
+		}
+	}
+	h.mu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+	frame, err := encodeWsFrame(event, data)
+	if err != nil {
+		dataLog.Warn("Failed to encode realtime event", "event", event, "error", err)
+		return
+	}
+	for _, c := range targets {
+		c.send(frame)
+	}
+}
+
+func encodeWsFrame(event string, data interface{}) ([]byte, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(wsEnvelope{Event: event, Data: raw})
+}
+
+// ServeWebSocket upgrades GET /ws to the plain WebSocket transport.
+// checkOrigin is the same origin policy socket.io uses.
+func ServeWebSocket(checkOrigin func(origin string) bool) gin.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin: func(r *http.Request) bool {
+			return checkOrigin(r.Header.Get("Origin"))
+		},
+	}
+	return func(c *gin.Context) {
+		if ShuttingDown() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+			return
+		}
+		ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// The upgrader already answered
+			return
+		}
+		conn := &wsConn{
+			id:     wsIDPrefix + strconv.FormatUint(atomic.AddUint64(&wsClients.next, 1), 10),
+			ws:     ws,
+			req:    c.Request,
+			out:    make(chan []byte, wsSendBuffer),
+			closed: make(chan struct{}),
+		}
+		conn.ctx = SocketHandshakeToken(conn)
+		wsClients.add(conn)
+		SocketConnected(conn)
+		go conn.writeLoop()
+		conn.Emit("connect", map[string]interface{}{"id": conn.id})
+		conn.readLoop()
+	}
+}
+
+var _ socketio.Conn = (*wsConn)(nil)
+
+// wsConn is a plain WebSocket client. It implements socketio.Conn so the
+// handlers registered with bindEvent serve it unchanged.
+type wsConn struct {
+	id        string
+	ws        *websocket.Conn
+	req       *http.Request
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	ctx       interface{}
+}
+
+func (c *wsConn) send(frame []byte) {
+	select {
+	case <-c.closed:
+	case c.out <- frame:
+	default:
+		// A client this far behind is stuck; it reconnects and resyncs
+		c.Close()
+	}
+}
+
+func (c *wsConn) readLoop() {
+	defer func() {
+		c.Close()
+		wsClients.remove(c)
+		middleware.ForgetSocketConn(c.id)
+		SocketDisconnected(c)
+	}()
+	c.ws.SetReadLimit(wsMaxMessage)
+	c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		var env wsEnvelope
+		if err := json.Unmarshal(msg, &env); err != nil || env.Event == "" {
+			c.Emit("error", map[string]interface{}{"error": "Invalid message"})
+			continue
+		}
+		c.dispatch(env)
+	}
+}
+
+// dispatch runs one event like socket.io would: in order, on the
+// connection's goroutine
+func (c *wsConn) dispatch(env wsEnvelope) {
+	if env.Event == "join" {
+		var room string
+		if json.Unmarshal(env.Data, &room) == nil && room != "" {
+			JoinRoom(c, room)
+		}
+		return
+	}
+	socketEventsMu.RLock()
+	handler, ok := socketEvents[env.Event]
+	socketEventsMu.RUnlock()
+	if !ok {
+		return
+	}
+	arg := reflect.New(handler.arg)
+	if len(env.Data) > 0 && string(env.Data) != "null" {
+		if err := json.Unmarshal(env.Data, arg.Interface()); err != nil {
+			c.Emit("error", map[string]interface{}{"error": "Invalid payload", "event": env.Event})
+			return
+		}
+	} else if handler.arg.Kind() == reflect.Interface {
+		arg.Elem().Set(reflect.ValueOf(map[string]interface{}{}))
+	}
+	handler.fn.Call([]reflect.Value{reflect.ValueOf(socketio.Conn(c)), arg.Elem()})
+}
+
+func (c *wsConn) writeLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+			c.ws.Close()
+			return
+		case frame := <-c.out:
+			c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+				c.Close()
+			}
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				c.Close()
+			}
+		}
+	}
+}
+
+func (c *wsConn) Emit(eventName string, v ...interface{}) {
+	var data interface{}
+	if len(v) == 1 {
+		data = v[0]
+	} else if len(v) > 1 {
+		data = v
+	}
+	frame, err := encodeWsFrame(eventName, data)
+	if err != nil {
+		dataLog.Warn("Failed to encode realtime event", "event", eventName, "error", err)
+		return
+	}
+	c.send(frame)
+}
+
+func (c *wsConn) Context() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ctx
+}
+
+func (c *wsConn) SetContext(ctx interface{}) {
+	c.mu.Lock()
+	c.ctx = ctx
+	c.mu.Unlock()
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *wsConn) Namespace() string         { return "/" }
+func (c *wsConn) Join(room string)          { wsClients.join(c, room) }
+func (c *wsConn) Leave(room string)         { wsClients.leave(c, room) }
+func (c *wsConn) Rooms() []string           { return wsClients.roomsOf(c) }
+func (c *wsConn) ID() string                { return c.id }
+func (c *wsConn) URL() url.URL              { return *c.req.URL }
+func (c *wsConn) LocalAddr() net.Addr       { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr      { return c.ws.RemoteAddr() }
+func (c *wsConn) RemoteHeader() http.Header { return c.req.Header }
+
+func (c *wsConn) LeaveAll() {
+	for _, room := range c.Rooms() {
+		c.Leave(room)
+	}
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketTransport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := socketio.NewServer(nil)
+	bindEvent(server, "wstest:echo", func(s socketio.Conn, msg interface{}) {
+		m, _ := msg.(map[string]interface{})
+		s.Join("wstest")
+		s.Emit("wstest:reply", map[string]interface{}{"got": m["value"], "token": m["token"]})
+	})
+	r := gin.New()
+	r.GET("/ws", ServeWebSocket(func(string) bool { return true }))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token=abc", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	read := func() (string, map[string]interface{}) {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var env struct {
+			Event string                 `json:"event"`
+			Data  map[string]interface{} `json:"data"`
+		}
+		if err := ws.ReadJSON(&env); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return env.Event, env.Data
+	}
+	if event, data := read(); event != "connect" || data["id"] == "" {
+		t.Fatalf("greeting = %s %v", event, data)
+	}
+
+	if err := ws.WriteJSON(map[string]interface{}{"event": "wstest:echo", "data": map[string]interface{}{"value": 7}}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	event, data := read()
+	if event != "wstest:reply" || data["got"] != float64(7) || data["token"] != "abc" {
+		t.Fatalf("reply = %s %v, want the echo with the handshake token", event, data)
+	}
+
+	if n := roomLen("wstest"); n != 1 {
+		t.Fatalf("room has %d members, want 1", n)
+	}
+	broadcastRoom("wstest", "wstest:news", map[string]interface{}{"n": 1})
+	if event, _ := read(); event != "wstest:news" {
+		t.Fatalf("broadcast = %s", event)
+	}
+}
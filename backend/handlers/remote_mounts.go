@@ -0,0 +1,752 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Remote mounts put remote storage under a local folder: SMB shares of
+// another NAS through the kernel's cifs client, S3 buckets and WebDAV
+// folders through rclone mount. While a mount is up it is an extra root
+// of the file browser, named like a share. Enabled mounts are checked
+// every minute and mounted again when they dropped or stopped answering.
+// rclone is a child process, so a restart leaves a dead FUSE mount behind;
+// the first check finds it and replaces it.
+
+const (
+	RemoteMountSmb    = "smb"
+	RemoteMountS3     = "s3"
+	RemoteMountWebdav = "webdav"
+)
+
+const (
+	remoteMountCheckEvery = time.Minute
+	remoteMountTimeout    = 30 * time.Second
+	remoteMountAnswer     = 10 * time.Second // For a health check
+	remoteMountOutputMax  = 4096
+)
+
+var (
+	errRemoteMountNotFound = errors.New("Remote mount not found")
+	errMountpointNotEmpty  = errors.New("Mountpoint is not empty")
+	errMountNotMounted     = errors.New("Not mounted")
+	errMountNotResponding  = errors.New("Mount is not responding")
+	errMountTimeout        = errors.New("Mount timed out")
+	errNoCifs              = errors.New("cifs-utils is not installed")
+)
+
+var (
+	smbAddressRe  = regexp.MustCompile(`^//[A-Za-z0-9_.:\[\]-]+/[^/\x00-\x1f][^\x00-\x1f]*$`)
+	s3BucketRe    = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,62}(/[^\x00-\x1f]*)?$`)
+	s3RegionRe    = regexp.MustCompile(`^[a-z0-9-]{0,32}$`)
+	cifsOptionRe  = regexp.MustCompile(`^[a-z0-9_]+(=[A-Za-z0-9:@/._-]+)?$`)
+	cifsForbidden = map[string]bool{"user": true, "username": true, "pass": true, "password": true, "credentials": true}
+)
+
+// RemoteMount is remote storage mounted at Mountpoint. Address is the
+// SMB share (//host/share), the WebDAV URL or, for S3, the endpoint URL
+// of a provider other than AWS. Username and Password are the S3 access
+// key id and secret for S3.
+type RemoteMount struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"` // Root name in the file browser
+	Type       string   `json:"type"` // smb, s3 or webdav
+	Mountpoint string   `json:"mountpoint"`
+	Address    string   `json:"address,omitempty"`
+	Bucket     string   `json:"bucket,omitempty"` // S3: bucket or bucket/prefix
+	Region     string   `json:"region,omitempty"` // S3
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"` // Never sent back
+	Options    []string `json:"options,omitempty"`  // cifs mount options, or rclone flags
+	ReadOnly   bool     `json:"readOnly,omitempty"`
+	Enable     bool     `json:"enable"` // Kept mounted
+}
+
+// RemoteMountInfo is a mount with its state
+type RemoteMountInfo struct {
+	RemoteMount
+	Status    string `json:"status"` // mounted, unmounted or error
+	Error     string `json:"error,omitempty"`
+	Since     int64  `json:"since,omitempty"`     // When Status last changed, ms
+	CheckedAt int64  `json:"checkedAt,omitempty"` // Last health check, ms
+	Remounts  int    `json:"remounts"`            // Since the server started
+}
+
+// remoteMountToolError is a mount command that failed
+type remoteMountToolError struct {
+	output string
+}
+
+func (e *remoteMountToolError) Error() string { return "mount failed: " + e.output }
+
+type remoteMountState struct {
+	status    string
+	err       string
+	since     int64
+	checkedAt int64
+	remounts  int
+	up        bool      // Mounted since it was last unmounted on purpose
+	proc      *exec.Cmd // rclone
+	cancel    context.CancelFunc
+	exited    chan struct{}
+}
+
+var remoteMounts = struct {
+	sync.Mutex
+	states map[string]*remoteMountState // By mount id
+}{states: make(map[string]*remoteMountState)}
+
+// remoteMountOps serializes mounting, unmounting and checks
+var remoteMountOps sync.Mutex
+
+// mountOutput keeps the end of a mount process's output
+type mountOutput struct {
+	sync.Mutex
+	buf []byte
+}
+
+func (o *mountOutput) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	o.buf = append(o.buf, p...)
+	if len(o.buf) > remoteMountOutputMax {
+		o.buf = o.buf[len(o.buf)-remoteMountOutputMax:]
+	}
+	return len(p), nil
+}
+
+func (o *mountOutput) String() string {
+	o.Lock()
+	defer o.Unlock()
+	return strings.TrimSpace(string(o.buf))
+}
+
+func remoteMountsFile() string {
+	return filepath.Join(config.DataDir, "remote-mounts.json")
+}
+
+func loadRemoteMounts() []RemoteMount {
+	var mounts []RemoteMount
+	if err := utils.ReadJSON(remoteMountsFile(), &mounts); err != nil && !errors.Is(err, os.ErrNotExist) {
+		filesLog.Warn("Failed to read remote mounts", "error", err)
+	}
+	return mounts
+}
+
+func findRemoteMount(id string) (RemoteMount, error) {
+	for _, m := range loadRemoteMounts() {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return RemoteMount{}, errRemoteMountNotFound
+}
+
+// mountState returns the state of a mount, creating it. remoteMounts
+// must be locked.
+func mountState(id string) *remoteMountState {
+	state := remoteMounts.states[id]
+	if state == nil {
+		state = &remoteMountState{status: "unmounted"}
+		remoteMounts.states[id] = state
+	}
+	return state
+}
+
+// setMountStatus records the outcome of a mount, unmount or check
+func setMountStatus(id, status string, err error) {
+	remoteMounts.Lock()
+	defer remoteMounts.Unlock()
+	state := mountState(id)
+	now := time.Now().UnixMilli()
+	if state.status != status {
+		state.status, state.since = status, now
+	}
+	switch status {
+	case "mounted":
+		state.up = true
+	case "unmounted":
+		state.up = false
+	}
+	state.err = ""
+	if err != nil {
+		state.err = err.Error()
+	}
+	state.checkedAt = now
+}
+
+func remoteMountInfo(m RemoteMount) RemoteMountInfo {
+	m.Password = ""
+	remoteMounts.Lock()
+	defer remoteMounts.Unlock()
+	state := mountState(m.ID)
+	return RemoteMountInfo{RemoteMount: m, Status: state.status, Error: state.err, Since: state.since, CheckedAt: state.checkedAt, Remounts: state.remounts}
+}
+
+// remoteMountShares are the mounts that are up, as shares. A mount named
+// like a share is left out.
+func remoteMountShares(shares []models.FileShare) []models.FileShare {
+	taken := make(map[string]bool, len(shares))
+	for _, s := range shares {
+		taken[s.Name] = true
+	}
+	var list []models.FileShare
+	for _, m := range loadRemoteMounts() {
+		remoteMounts.Lock()
+		up := remoteMounts.states[m.ID] != nil && remoteMounts.states[m.ID].status == "mounted"
+		remoteMounts.Unlock()
+		if m.Enable && up && !taken[m.Name] {
+			list = append(list, models.FileShare{Name: m.Name, Path: m.Mountpoint, ReadOnly: m.ReadOnly, Remote: m.Type})
+		}
+	}
+	return list
+}
+
+// validateRemoteMount checks m against the shares and the other mounts. A
+// mount saved without a password keeps its current one.
+func validateRemoteMount(m *RemoteMount, mounts []RemoteMount) error {
+	m.Name = strings.TrimSpace(m.Name)
+	m.Address = strings.TrimSpace(m.Address)
+	m.Bucket = strings.Trim(strings.TrimSpace(m.Bucket), "/")
+	m.Mountpoint = strings.TrimSpace(m.Mountpoint)
+	if !shareNamePattern.MatchString(m.Name) {
+		return fmt.Errorf("Invalid share name %q", m.Name)
+	}
+	if !filepath.IsAbs(m.Mountpoint) || filepath.Clean(m.Mountpoint) == "/" {
+		return fmt.Errorf("Invalid mountpoint")
+	}
+	m.Mountpoint = filepath.Clean(m.Mountpoint)
+	for _, s := range loadFileShares() {
+		if s.Name == m.Name {
+			return fmt.Errorf("Duplicate share name %q", m.Name)
+		}
+		// A share around the mount would index and check the remote
+		if pathWithin(s.Path, m.Mountpoint) || pathWithin(m.Mountpoint, s.Path) {
+			return fmt.Errorf("Mountpoint overlaps share %q", s.Name)
+		}
+	}
+	for _, other := range mounts {
+		if other.ID == m.ID {
+			if m.Password == "" {
+				m.Password = other.Password
+			}
+			continue
+		}
+		if other.Name == m.Name {
+			return fmt.Errorf("Duplicate share name %q", m.Name)
+		}
+		if pathWithin(other.Mountpoint, m.Mountpoint) || pathWithin(m.Mountpoint, other.Mountpoint) {
+			return fmt.Errorf("Mountpoint overlaps share %q", other.Name)
+		}
+	}
+	if strings.ContainsAny(m.Username, ",=\x00\n\r") || strings.ContainsAny(m.Password, "\x00") {
+		return fmt.Errorf("Invalid credentials")
+	}
+	switch m.Type {
+	case RemoteMountSmb:
+		if !smbAddressRe.MatchString(m.Address) {
+			return fmt.Errorf("Invalid address")
+		}
+		for _, o := range m.Options {
+			key, _, _ := strings.Cut(o, "=")
+			if !cifsOptionRe.MatchString(o) || cifsForbidden[key] {
+				return fmt.Errorf("Invalid mount option")
+			}
+		}
+		return nil
+	case RemoteMountS3:
+		if !s3BucketRe.MatchString(m.Bucket) || !s3RegionRe.MatchString(m.Region) {
+			return fmt.Errorf("Invalid bucket")
+		}
+		if m.Address != "" && !validMountURL(m.Address) {
+			return fmt.Errorf("Invalid address")
+		}
+	case RemoteMountWebdav:
+		if !validMountURL(m.Address) {
+			return fmt.Errorf("Invalid address")
+		}
+	default:
+		return fmt.Errorf("Unknown mount type")
+	}
+	// Flags only, as with sync jobs
+	for _, f := range m.Options {
+		if !strings.HasPrefix(f, "-") || strings.ContainsAny(f, "\x00\n\r") {
+			return fmt.Errorf("Invalid mount option")
+		}
+	}
+	return nil
+}
+
+func validMountURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// mountedAt reports whether something is mounted right at p
+func mountedAt(p string) bool {
+	m, err := mountOf(p)
+	return err == nil && m.point == p
+}
+
+// checkMountpoint answers nil when p is mounted and lists within
+// remoteMountAnswer. A dead server can hang the listing for good, so it
+// is left running in the background.
+func checkMountpoint(p string) error {
+	if !mountedAt(p) {
+		return errMountNotMounted
+	}
+	done := make(chan error, 1)
+	go func() {
+		f, err := os.Open(p)
+		if err == nil {
+			_, err = f.Readdirnames(1)
+			f.Close()
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(remoteMountAnswer):
+		return errMountNotResponding
+	}
+}
+
+// mountCommand runs a mount tool with extra environment variables, for
+// secrets that must not show in the process list
+func mountCommand(ctx context.Context, env []string, name string, args ...string) error {
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteMountTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Env = append(os.Environ(), env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return errMountTimeout
+		}
+		return &remoteMountToolError{output: strings.TrimSpace(string(out))}
+	}
+	return nil
+}
+
+// mountRemote mounts m, adopting a working mount already in place
+func mountRemote(ctx context.Context, m RemoteMount) error {
+	if mountedAt(m.Mountpoint) {
+		if checkMountpoint(m.Mountpoint) == nil {
+			return nil
+		}
+		_ = unmountRemote(ctx, m)
+	}
+	if err := os.MkdirAll(m.Mountpoint, 0755); err != nil {
+		return err
+	}
+	// Mounting over files would hide them, and writes to a dropped mount
+	// would land there unnoticed
+	f, err := os.Open(m.Mountpoint)
+	if err != nil {
+		return err
+	}
+	_, err = f.Readdirnames(1)
+	f.Close()
+	if err != io.EOF {
+		if err == nil {
+			err = errMountpointNotEmpty
+		}
+		return err
+	}
+	if m.Type == RemoteMountSmb {
+		return mountCifs(ctx, m)
+	}
+	return mountRclone(ctx, m)
+}
+
+func mountCifs(ctx context.Context, m RemoteMount) error {
+	if _, err := exec.LookPath("mount.cifs"); err != nil {
+		return errNoCifs
+	}
+	options := []string{"guest"}
+	if m.Username != "" {
+		options = []string{"username=" + m.Username}
+	}
+	if m.ReadOnly {
+		options = append(options, "ro")
+	}
+	options = append(options, m.Options...)
+	// mount.cifs reads the password from PASSWD
+	return mountCommand(ctx, []string{"PASSWD=" + m.Password}, "mount", "-t", "cifs", m.Address, m.Mountpoint, "-o", strings.Join(options, ","))
+}
+
+// rcloneMountEnv configures rclone's backend through the environment, so
+// no config file is needed
+func rcloneMountEnv(ctx context.Context, bin string, m RemoteMount) (string, []string, error) {
+	if m.Type == RemoteMountS3 {
+		env := []string{"RCLONE_S3_PROVIDER=AWS"}
+		if m.Address != "" {
+			env = []string{"RCLONE_S3_PROVIDER=Other", "RCLONE_S3_ENDPOINT=" + m.Address}
+		}
+		if m.Region != "" {
+			env = append(env, "RCLONE_S3_REGION="+m.Region)
+		}
+		if m.Username != "" {
+			env = append(env, "RCLONE_S3_ACCESS_KEY_ID="+m.Username, "RCLONE_S3_SECRET_ACCESS_KEY="+m.Password)
+		} else {
+			env = append(env, "RCLONE_S3_ENV_AUTH=true")
+		}
+		return ":s3:" + m.Bucket, env, nil
+	}
+	env := []string{"RCLONE_WEBDAV_URL=" + m.Address, "RCLONE_WEBDAV_USER=" + m.Username}
+	if m.Password != "" {
+		// rclone only takes obscured passwords
+		cmd := exec.CommandContext(ctx, bin, "obscure", "-")
+		cmd.Stdin = strings.NewReader(m.Password)
+		out, err := cmd.Output()
+		if err != nil {
+			return "", nil, &remoteMountToolError{output: "rclone obscure failed"}
+		}
+		env = append(env, "RCLONE_WEBDAV_PASS="+strings.TrimSpace(string(out)))
+	}
+	return ":webdav:", env, nil
+}
+
+// mountRclone starts rclone mount and waits for the mount to appear
+func mountRclone(ctx context.Context, m RemoteMount) error {
+	bin, err := exec.LookPath(SyncToolRclone)
+	if err != nil {
+		return errNoRclone
+	}
+	remote, env, err := rcloneMountEnv(ctx, bin, m)
+	if err != nil {
+		return err
+	}
+	args := []string{"mount", remote, m.Mountpoint, "--vfs-cache-mode", "writes"}
+	if m.ReadOnly {
+		args = append(args, "--read-only")
+	}
+	args = append(args, m.Options...)
+	procCtx, cancel := context.WithCancel(backgroundCtx)
+	cmd := exec.CommandContext(procCtx, bin, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = 5 * time.Second
+	output := &mountOutput{}
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return err
+	}
+	exited := make(chan struct{})
+	remoteMounts.Lock()
+	state := mountState(m.ID)
+	state.proc, state.cancel, state.exited = cmd, cancel, exited
+	remoteMounts.Unlock()
+	go func() {
+		err := cmd.Wait()
+		cancel()
+		close(exited)
+		remoteMounts.Lock()
+		current := state.proc == cmd
+		if current {
+			state.proc, state.cancel = nil, nil
+		}
+		remoteMounts.Unlock()
+		if current {
+			filesLog.Warn("rclone mount exited", "mount", m.Name, "error", err, "output", output.String())
+			setMountStatus(m.ID, "error", &remoteMountToolError{output: output.String()})
+		}
+	}()
+	deadline := time.NewTimer(remoteMountTimeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	for !mountedAt(m.Mountpoint) {
+		select {
+		case <-exited:
+			return &remoteMountToolError{output: output.String()}
+		case <-ctx.Done():
+			stopRclone(state)
+			return ctx.Err()
+		case <-deadline.C:
+			stopRclone(state)
+			return errMountTimeout
+		case <-poll.C:
+		}
+	}
+	return nil
+}
+
+// stopRclone ends the rclone process of a mount, if any
+func stopRclone(state *remoteMountState) {
+	remoteMounts.Lock()
+	cancel, exited := state.cancel, state.exited
+	state.proc, state.cancel = nil, nil
+	remoteMounts.Unlock()
+	if cancel != nil {
+		cancel()
+		<-exited
+	}
+}
+
+// unmountRemote unmounts m lazily, so that a dead server cannot block it
+func unmountRemote(ctx context.Context, m RemoteMount) error {
+	var err error
+	if mountedAt(m.Mountpoint) {
+		if m.Type != RemoteMountSmb {
+			err = mountCommand(ctx, nil, "fusermount", "-uz", m.Mountpoint)
+		}
+		if m.Type == RemoteMountSmb || err != nil {
+			err = mountCommand(ctx, nil, "umount", "-l", m.Mountpoint)
+		}
+	}
+	remoteMounts.Lock()
+	state := mountState(m.ID)
+	remoteMounts.Unlock()
+	stopRclone(state)
+	return err
+}
+
+// applyRemoteMount mounts m, recording the outcome
+func applyRemoteMount(ctx context.Context, m RemoteMount) error {
+	err := mountRemote(ctx, m)
+	if err != nil {
+		filesLog.Warn("Remote mount failed", "mount", m.Name, "error", err)
+		setMountStatus(m.ID, "error", err)
+		return err
+	}
+	filesLog.Info("Remote mounted", "mount", m.Name, "mountpoint", m.Mountpoint)
+	setMountStatus(m.ID, "mounted", nil)
+	return nil
+}
+
+// checkRemoteMounts mounts the enabled mounts that are down and remounts
+// the ones that stopped answering
+func checkRemoteMounts(ctx context.Context) {
+	remoteMountOps.Lock()
+	defer remoteMountOps.Unlock()
+	for _, m := range loadRemoteMounts() {
+		if !m.Enable || ctx.Err() != nil {
+			continue
+		}
+		err := checkMountpoint(m.Mountpoint)
+		if err == nil {
+			setMountStatus(m.ID, "mounted", nil)
+			continue
+		}
+		remoteMounts.Lock()
+		state := mountState(m.ID)
+		dropped := state.up
+		if dropped {
+			state.remounts++
+		}
+		remoteMounts.Unlock()
+		if dropped {
+			filesLog.Warn("Remote mount is down, remounting", "mount", m.Name, "error", err)
+			_ = unmountRemote(ctx, m)
+		}
+		_ = applyRemoteMount(ctx, m)
+	}
+}
+
+// StartRemoteMounts mounts the enabled remote mounts and keeps them up
+func StartRemoteMounts() {
+	go func() {
+		ticker := time.NewTicker(remoteMountCheckEvery)
+		defer ticker.Stop()
+		beat := registerWorker("mounts.health", remoteMountCheckEvery)
+		for {
+			beat()
+			checkRemoteMounts(backgroundCtx)
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func remoteMountError(c *gin.Context, err error) {
+	var toolErr *remoteMountToolError
+	switch {
+	case errors.As(err, &toolErr):
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Mount failed", "details": toolErr.output})
+	case errors.Is(err, errRemoteMountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errMountpointNotEmpty):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errMountTimeout):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoRclone), errors.Is(err, errNoCifs):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		filesLog.Error("Remote mount failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Mount failed"})
+	}
+}
+
+// GetRemoteMounts lists the mounts with their state
+func GetRemoteMounts(c *gin.Context) {
+	mounts := loadRemoteMounts()
+	list := make([]RemoteMountInfo, 0, len(mounts))
+	for _, m := range mounts {
+		list = append(list, remoteMountInfo(m))
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": list})
+}
+
+// SaveRemoteMount creates a mount, or updates the one with the given id,
+// and mounts it again when enabled. The mount is saved even if mounting
+// fails; its state tells why and the health check retries.
+func SaveRemoteMount(c *gin.Context) {
+	var req RemoteMount
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	remoteMountOps.Lock()
+	defer remoteMountOps.Unlock()
+	if err := validateRemoteMount(&req, loadRemoteMounts()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var old *RemoteMount
+	var mounts []RemoteMount
+	err := utils.UpdateJSON(remoteMountsFile(), &mounts, func() error {
+		if req.ID == "" {
+			req.ID = randomHexID(6)
+			mounts = append(mounts, req)
+			return nil
+		}
+		for i := range mounts {
+			if mounts[i].ID == req.ID {
+				prev := mounts[i]
+				old, mounts[i] = &prev, req
+				return nil
+			}
+		}
+		return errRemoteMountNotFound
+	})
+	if err != nil {
+		remoteMountError(c, err)
+		return
+	}
+	c.Set("auditTarget", req.Name)
+	ctx := c.Request.Context()
+	if old != nil {
+		if err := unmountRemote(ctx, *old); err != nil {
+			filesLog.Warn("Remote unmount failed", "mount", old.Name, "error", err)
+		}
+		setMountStatus(req.ID, "unmounted", nil)
+	}
+	if req.Enable {
+		_ = applyRemoteMount(ctx, req)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": remoteMountInfo(req)})
+}
+
+// DeleteRemoteMount unmounts a mount and removes it
+func DeleteRemoteMount(c *gin.Context) {
+	remoteMountOps.Lock()
+	defer remoteMountOps.Unlock()
+	m, err := findRemoteMount(c.Param("id"))
+	if err != nil {
+		remoteMountError(c, err)
+		return
+	}
+	c.Set("auditTarget", m.Name)
+	if err := unmountRemote(c.Request.Context(), m); err != nil {
+		remoteMountError(c, err)
+		return
+	}
+	var mounts []RemoteMount
+	err = utils.UpdateJSON(remoteMountsFile(), &mounts, func() error {
+		for i := range mounts {
+			if mounts[i].ID == m.ID {
+				mounts = append(mounts[:i], mounts[i+1:]...)
+				return nil
+			}
+		}
+		return errRemoteMountNotFound
+	})
+	if err != nil {
+		remoteMountError(c, err)
+		return
+	}
+	remoteMounts.Lock()
+	delete(remoteMounts.states, m.ID)
+	remoteMounts.Unlock()
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// setRemoteMountEnable saves whether a mount is kept mounted
+func setRemoteMountEnable(id string, enable bool) (RemoteMount, error) {
+	var m RemoteMount
+	var mounts []RemoteMount
+	err := utils.UpdateJSON(remoteMountsFile(), &mounts, func() error {
+		for i := range mounts {
+			if mounts[i].ID == id {
+				mounts[i].Enable = enable
+				m = mounts[i]
+				return nil
+			}
+		}
+		return errRemoteMountNotFound
+	})
+	return m, err
+}
+
+// MountRemote enables a mount and mounts it now
+func MountRemote(c *gin.Context) {
+	remoteMountOps.Lock()
+	defer remoteMountOps.Unlock()
+	m, err := setRemoteMountEnable(c.Param("id"), true)
+	if err != nil {
+		remoteMountError(c, err)
+		return
+	}
+	c.Set("auditTarget", m.Name)
+	if err := applyRemoteMount(c.Request.Context(), m); err != nil {
+		remoteMountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": remoteMountInfo(m)})
+}
+
+// UnmountRemote unmounts a mount and disables it, so it stays down
+func UnmountRemote(c *gin.Context) {
+	remoteMountOps.Lock()
+	defer remoteMountOps.Unlock()
+	m, err := setRemoteMountEnable(c.Param("id"), false)
+	if err != nil {
+		remoteMountError(c, err)
+		return
+	}
+	c.Set("auditTarget", m.Name)
+	if err := unmountRemote(c.Request.Context(), m); err != nil {
+		setMountStatus(m.ID, "error", err)
+		remoteMountError(c, err)
+		return
+	}
+	setMountStatus(m.ID, "unmounted", nil)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": remoteMountInfo(m)})
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRemoteMounts(t *testing.T) {
+	useTestConfig(t)
+	prevMounts := mountInfoFile
+	mountInfoFile = filepath.Join(config.DataDir, "mountinfo")
+	defer func() { mountInfoFile = prevMounts }()
+	gin.SetMode(gin.TestMode)
+
+	media, mp, bin := t.TempDir(), filepath.Join(t.TempDir(), "nas"), t.TempDir()
+	root := "1 0 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n"
+	os.WriteFile(mountInfoFile, []byte(root), 0644)
+	t.Setenv("FAKE_MOUNTINFO", mountInfoFile)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.WriteFile(filepath.Join(bin, "mount.cifs"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(bin, "mount"), []byte(`#!/bin/sh
+dir="$(dirname "$0")"
+echo "$@" >> "$dir/mount.log"
+printf '%s' "$PASSWD" > "$dir/passwd"
+echo "40 1 0:50 / $4 rw,relatime - cifs $3 rw" >> "$FAKE_MOUNTINFO"
+`), 0755)
+	os.WriteFile(filepath.Join(bin, "umount"), []byte(`#!/bin/sh
+grep -vF " $2 " "$FAKE_MOUNTINFO" > "$FAKE_MOUNTINFO.new"; mv "$FAKE_MOUNTINFO.new" "$FAKE_MOUNTINFO"
+`), 0755)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "media", Path: media}}})
+
+	r := gin.New()
+	r.GET("/mounts", GetRemoteMounts)
+	r.POST("/mounts", SaveRemoteMount)
+	r.DELETE("/mounts/:id", DeleteRemoteMount)
+	r.POST("/mounts/:id/mount", MountRemote)
+	r.DELETE("/mounts/:id/mount", UnmountRemote)
+	r.GET("/files/shares", GetFileShares)
+	r.GET("/files/list", ListFiles)
+
+	for _, body := range []string{
+		`{"name":"nas","type":"ftp","mountpoint":"` + mp + `","address":"//nas/media"}`,
+		`{"name":"media","type":"smb","mountpoint":"` + mp + `","address":"//nas/media"}`,
+		`{"name":"nas","type":"smb","mountpoint":"` + filepath.Join(media, "nas") + `","address":"//nas/media"}`,
+		`{"name":"nas","type":"smb","mountpoint":"` + mp + `","address":"//nas/media","options":["password=x"]}`,
+	} {
+		if w := serve(r, "POST", "/mounts", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+	var saved struct{ Data RemoteMountInfo }
+	w := serve(r, "POST", "/mounts", `{"name":"nas","type":"smb","mountpoint":"`+mp+`","address":"//nas/media","username":"bob","password":"s3cret","options":["vers=3.0"],"enable":true}`)
+	json.Unmarshal(w.Body.Bytes(), &saved)
+	if w.Code != 200 || saved.Data.Status != "mounted" || saved.Data.Password != "" {
+		t.Fatalf("unexpected save %d %s", w.Code, w.Body.String())
+	}
+	id := saved.Data.ID
+	if data, _ := os.ReadFile(filepath.Join(bin, "passwd")); string(data) != "s3cret" {
+		t.Fatalf("password not passed in the environment: %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(bin, "mount.log")); !strings.Contains(string(data), "-t cifs //nas/media "+mp+" -o username=bob,vers=3.0") {
+		t.Fatalf("unexpected mount command %q", data)
+	}
+
+	var shares struct{ Data []models.FileShare }
+	json.Unmarshal(serve(r, "GET", "/files/shares", "").Body.Bytes(), &shares)
+	if len(shares.Data) != 2 || shares.Data[1].Name != "nas" || shares.Data[1].Remote != "smb" {
+		t.Fatalf("unexpected shares %+v", shares.Data)
+	}
+	if w := serve(r, "GET", "/files/list?share=nas", ""); w.Code != 200 {
+		t.Fatalf("list failed: %d %s", w.Code, w.Body.String())
+	}
+
+	// Saving without a password keeps it
+	os.Remove(filepath.Join(bin, "passwd"))
+	if w := serve(r, "POST", "/mounts", `{"id":"`+id+`","name":"nas","type":"smb","mountpoint":"`+mp+`","address":"//nas/media","username":"bob","enable":true}`); w.Code != 200 {
+		t.Fatalf("update failed: %d %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(bin, "passwd")); string(data) != "s3cret" {
+		t.Fatalf("password lost on update: %q", data)
+	}
+
+	// A dropped mount is mounted again by the check
+	os.WriteFile(mountInfoFile, []byte(root), 0644)
+	checkRemoteMounts(context.Background())
+	var list struct{ Data []RemoteMountInfo }
+	json.Unmarshal(serve(r, "GET", "/mounts", "").Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].Status != "mounted" || list.Data[0].Remounts != 1 || list.Data[0].Password != "" {
+		t.Fatalf("unexpected mounts %+v", list.Data)
+	}
+	if !mountedAt(mp) {
+		t.Fatalf("not mounted again")
+	}
+
+	if w := serve(r, "DELETE", "/mounts/"+id+"/mount", ""); w.Code != 200 {
+		t.Fatalf("unmount failed: %d %s", w.Code, w.Body.String())
+	}
+	if mountedAt(mp) {
+		t.Fatalf("still mounted")
+	}
+	if w := serve(r, "GET", "/files/list?share=nas", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unmounted share, got %d", w.Code)
+	}
+	checkRemoteMounts(context.Background())
+	if mountedAt(mp) {
+		t.Fatalf("disabled mount was mounted")
+	}
+	// Files in the mountpoint would be hidden by the mount
+	os.WriteFile(filepath.Join(mp, "local.txt"), []byte("x"), 0644)
+	if w := serve(r, "POST", "/mounts/"+id+"/mount", ""); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", w.Code)
+	}
+	if w := serve(r, "DELETE", "/mounts/"+id, ""); w.Code != 200 {
+		t.Fatalf("delete failed: %d", w.Code)
+	}
+	if w := serve(r, "DELETE", "/mounts/"+id, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
@@ -1,18 +1,21 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/xml"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	socketio "github.com/googollee/go-socket.io"
-	"golang.org/x/net/html/charset"
 )
 
 // RssPayload defines the input structure
@@ -22,56 +25,197 @@ type RssPayload struct {
 
 // Unified Item structure for frontend
 type UnifiedRssItem struct {
-	Title          string `json:"title"`
-	Link           string `json:"link"`
-	PubDate        string `json:"pubDate"`
-	ContentSnippet string `json:"contentSnippet"`
+	Guid           string          `json:"guid"`
+	Title          string          `json:"title"`
+	Link           string          `json:"link"`
+	PubDate        string          `json:"pubDate"`             // RFC 3339 when parseable, verbatim otherwise
+	Timestamp      int64           `json:"timestamp,omitempty"` // Unix ms parsed from PubDate, 0 if unknown
+	ContentSnippet string          `json:"contentSnippet"`
+	Content        string          `json:"content,omitempty"` // Extracted article text, for feeds with fullContent enabled
+	Image          string          `json:"image,omitempty"`
+	Enclosure      *RssEnclosure   `json:"enclosure,omitempty"`
+	Indexer        *RssIndexerInfo `json:"indexer,omitempty"` // Torznab/Newznab search results
+	Read           bool            `json:"read,omitempty"`    // Per user, set on emit
+	Saved          bool            `json:"saved,omitempty"`   // Per user, set on emit
+}
+
+// RssEnclosure is an attached media file, e.g. a podcast episode
+type RssEnclosure struct {
+	Url      string `json:"url"`
+	Type     string `json:"type,omitempty"`
+	Length   int64  `json:"length,omitempty"`   // Bytes
+	Duration string `json:"duration,omitempty"` // As given by itunes:duration
+}
+
+// UnifiedFeed carries feed-level metadata shared by all supported formats
+type UnifiedFeed struct {
+	Title       string           `json:"title"`
+	Description string           `json:"description"`
+	Link        string           `json:"link"`
+	Icon        string           `json:"icon"`
+	Favicon     string           `json:"favicon,omitempty"` // Site icon served from /icon-cache
+	Generator   string           `json:"generator"`
+	Type        string           `json:"type"`              // "rss2", "atom" or "rdf"
+	FeedUrl     string           `json:"feedUrl,omitempty"` // Set when discovered from an HTML page
+	Updated     string           `json:"updated"`
+	ItemCount   int              `json:"itemCount"`
+	Items       []UnifiedRssItem `json:"items,omitempty"`
+	nextUrl     string           // rel="next" page of a paginated feed
+	hubUrl      string           // WebSub hub advertised with rel="hub"
+	selfUrl     string           // Canonical topic URL advertised with rel="self"
 }
 
 var rssCacheTTL = 15 * time.Minute
 
+const (
+	// minRssCacheTTL and maxRssCacheTTL bound per-feed "cacheTTL" overrides
+	minRssCacheTTL = time.Minute
+	maxRssCacheTTL = 7 * 24 * time.Hour
+	// rssFetchTimeout bounds one feed fetch including all attempts
+	rssFetchTimeout = 45 * time.Second
+	// rssWarmupWorkers is the number of feeds fetched in parallel at startup
+	rssWarmupWorkers = 6
+	// defaultRssMaxBodyMB caps downloaded feed and article bodies unless
+	// RSS_MAX_BODY_MB says otherwise
+	defaultRssMaxBodyMB = 10
+	// maxRssItems is the number of items kept per feed; the newest come first
+	// in practically every feed
+	maxRssItems = 300
+)
+
+// errRssTooLarge is returned for bodies above maxRssBodySize
+var errRssTooLarge = errors.New("feed response too large")
+
+var errRssNoItems = errors.New("feed has no items")
+
+var maxRssBodySize = rssMaxBodySizeFromEnv()
+
+func rssMaxBodySizeFromEnv() int64 {
+	mb := defaultRssMaxBodyMB
+	if raw := strings.TrimSpace(os.Getenv("RSS_MAX_BODY_MB")); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			mb = n
+		} else {
+			rssLog.Warn("Invalid RSS_MAX_BODY_MB", "value", raw, "using", defaultRssMaxBodyMB)
+		}
+	}
+	return int64(mb) << 20
+}
+
 // RSS 2.0 Structures
 type Rss2Feed struct {
 	Channel Rss2Channel `xml:"channel"`
 }
 
 type Rss2Channel struct {
-	Items []Rss2Item `xml:"item"`
+	Title string `xml:"title"`
+	// Before Link: encoding/xml gives an element to the first field that
+	// matches, and a tag without namespace matches atom:link too
+	AtomLinks     []AtomLink `xml:"http://www.w3.org/2005/Atom link"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	Generator     string     `xml:"generator"`
+	LastBuildDate string     `xml:"lastBuildDate"`
+	PubDate       string     `xml:"pubDate"`
+	Image         Rss2Image  `xml:"image"`
+	Items         []Rss2Item `xml:"item"`
+}
+
+type Rss2Image struct {
+	Url string `xml:"url"`
 }
 
 type Rss2Item struct {
-	Title       string `xml:"title"`
-	Link        string `xml:"link"`
-	Description string `xml:"description"`
-	Guid        string `xml:"guid"`
-	Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
-	PubDate     string `xml:"pubDate"`
+	MediaRss
+	Title        string          `xml:"title"`
+	Link         string          `xml:"link"`
+	Description  string          `xml:"description"`
+	Guid         string          `xml:"guid"`
+	Content      string          `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PubDate      string          `xml:"pubDate"`
+	Enclosures   []Rss2Enclosure `xml:"enclosure"`
+	Duration     string          `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+	Size         string          `xml:"size"`
+	TorznabAttrs []IndexerAttr   `xml:"http://torznab.com/schemas/2015/feed attr"`
+	NewznabAttrs []IndexerAttr   `xml:"http://www.newznab.com/DTD/2010/feeds/attributes/ attr"`
+}
+
+type Rss2Enclosure struct {
+	Url    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length string `xml:"length,attr"`
 }
 
 // Atom Structures
 type AtomFeed struct {
-	Entries []AtomEntry `xml:"entry"`
+	Title     string      `xml:"title"`
+	Subtitle  string      `xml:"subtitle"`
+	Links     []AtomLink  `xml:"link"`
+	Icon      string      `xml:"icon"`
+	Logo      string      `xml:"logo"`
+	Generator string      `xml:"generator"`
+	Updated   string      `xml:"updated"`
+	Entries   []AtomEntry `xml:"entry"`
 }
 
 type AtomEntry struct {
-	Title   string     `xml:"title"`
-	Links   []AtomLink `xml:"link"`
-	Content string     `xml:"content"`
-	Summary string     `xml:"summary"`
-	Updated string     `xml:"updated"`
+	MediaRss
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Links     []AtomLink `xml:"link"`
+	Content   string     `xml:"content"`
+	Summary   string     `xml:"summary"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+}
+
+// Media RSS (http://search.yahoo.com/mrss/) elements shared by RSS and Atom
+// items. It is embedded first so media:content is not taken for Atom content.
+type MediaRss struct {
+	MediaThumbnails []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	MediaContents   []MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	MediaGroups     []MediaGroup     `xml:"http://search.yahoo.com/mrss/ group"`
+}
+
+type MediaGroup struct {
+	Thumbnails  []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	Contents    []MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	Description string           `xml:"http://search.yahoo.com/mrss/ description"`
+}
+
+type MediaThumbnail struct {
+	Url string `xml:"url,attr"`
+}
+
+type MediaContent struct {
+	Url        string           `xml:"url,attr"`
+	Type       string           `xml:"type,attr"`
+	Medium     string           `xml:"medium,attr"`
+	Thumbnails []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
 }
 
 type AtomLink struct {
-	Href string `xml:"href,attr"`
-	Rel  string `xml:"rel,attr"`
-	Type string `xml:"type,attr"`
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr"`
+	Type   string `xml:"type,attr"`
+	Length string `xml:"length,attr"`
 }
 
 type RdfFeed struct {
-	Items []RdfItem `xml:"item"`
+	Channel RdfChannel `xml:"channel"`
+	Image   Rss2Image  `xml:"image"`
+	Items   []RdfItem  `xml:"item"`
+}
+
+type RdfChannel struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+	Date        string `xml:"http://purl.org/dc/elements/1.1/ date"`
 }
 
 type RdfItem struct {
+	About       string `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# about,attr"`
 	Title       string `xml:"title"`
 	Link        string `xml:"link"`
 	Description string `xml:"description"`
@@ -79,16 +223,11 @@ type RdfItem struct {
 }
 
 func BindRssHandlers(server *socketio.Server) {
-	server.OnEvent("/", "rss:fetch", func(s socketio.Conn, msg interface{}) {
-		log.Println("Received rss:fetch event")
-		var urlStr string
-		if m, ok := msg.(map[string]interface{}); ok {
-			if u, ok := m["url"].(string); ok {
-				urlStr = u
-			}
-		}
-
-		urlStr = strings.TrimSpace(urlStr)
+	bindEvent(server, "rss:fetch", func(s socketio.Conn, msg interface{}) {
+		rssLog.Debug("Received rss:fetch event", "conn", s.ID())
+		urlStr := parseRssUrl(msg)
+		snippetLength := parseRssSnippetLength(msg)
+		username := rssRequestUser(msg)
 		if urlStr == "" {
 			s.Emit("rss:error", map[string]interface{}{"error": "url is required"})
 			return
@@ -98,43 +237,212 @@ func BindRssHandlers(server *socketio.Server) {
 		hasCache, isFresh, _, err := sharedWidgetCache.Get(widgetCacheKindRSS, urlStr, &cachedItems)
 		if err == nil && hasCache && len(cachedItems) > 0 {
 			s.Emit("rss:data", map[string]interface{}{
-				"url": urlStr,
-				"data": map[string]interface{}{
-					"items": cachedItems,
-				},
+				"url":  urlStr,
+				"data": buildRssDataPayload(urlStr, cachedItems, snippetLength, username),
 			})
 		}
 		if hasCache && isFresh {
 			return
 		}
 		if hasCache {
+			// The background refresh pushes fresh items to the feed's room
+			s.Join(rssRoom(urlStr))
 			go refreshRssAsync(server, urlStr)
 			return
 		}
 
-		items, err := fetchRssFeed(urlStr)
+		ctx, cancel := context.WithTimeout(fetchCtx, rssFetchTimeout)
+		defer cancel()
+		feed, err := fetchRssFeed(ctx, urlStr)
 		if err != nil {
-			log.Printf("RSS fetch failed: url=%s error=%v", urlStr, err)
+			rssLog.Warn("RSS fetch failed", "feed", redactRssUrl(urlStr), "error", err)
 			_ = sharedWidgetCache.MarkStatus(widgetCacheKindRSS, urlStr, "error")
 			s.Emit("rss:error", map[string]interface{}{"url": urlStr, "error": err.Error()})
 			return
 		}
-		if err := sharedWidgetCache.Set(widgetCacheKindRSS, urlStr, items, rssCacheTTL, "ok"); err != nil {
+		if err := storeRssFeed(urlStr, feed); err != nil {
 			s.Emit("rss:error", map[string]interface{}{"url": urlStr, "error": err.Error()})
 			return
 		}
 
 		s.Emit("rss:data", map[string]interface{}{
-			"url": urlStr,
-			"data": map[string]interface{}{
-				"items": items,
-			},
+			"url":  urlStr,
+			"data": buildRssDataPayload(urlStr, feed.Items, snippetLength, username),
+		})
+	})
+
+	bindEvent(server, "rss:refresh", func(s socketio.Conn, msg interface{}) {
+		urlStr := parseRssUrl(msg)
+		if urlStr == "" {
+			s.Emit("rss:error", map[string]interface{}{"error": "url is required"})
+			return
+		}
+		snippetLength := parseRssSnippetLength(msg)
+		username := rssRequestUser(msg)
+		invalidateRssCache(urlStr)
+		go func() {
+			status := refreshRss(server, urlStr)
+			if status == "error" {
+				health := RssFeedHealth{LastError: "refresh failed"}
+				_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSSHealth, urlStr, &health)
+				s.Emit("rss:error", map[string]interface{}{"url": urlStr, "error": health.LastError})
+				return
+			}
+			var items []UnifiedRssItem
+			if has, _, _, err := sharedWidgetCache.Get(widgetCacheKindRSS, urlStr, &items); err == nil && has {
+				s.Emit("rss:data", map[string]interface{}{
+					"url":    urlStr,
+					"status": status,
+					"data":   buildRssDataPayload(urlStr, items, snippetLength, username),
+				})
+			}
+		}()
+	})
+
+	bindEvent(server, "rss:meta", func(s socketio.Conn, msg interface{}) {
+		urlStr := parseRssUrl(msg)
+		if urlStr == "" {
+			s.Emit("rss:error", map[string]interface{}{"error": "url is required"})
+			return
+		}
+
+		var cachedMeta UnifiedFeed
+		hasCache, isFresh, _, cacheErr := sharedWidgetCache.Get(widgetCacheKindRSSMeta, urlStr, &cachedMeta)
+		if cacheErr == nil && hasCache && isFresh {
+			s.Emit("rss:metaData", map[string]interface{}{
+				"url":  urlStr,
+				"data": cachedMeta,
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(fetchCtx, rssFetchTimeout)
+		defer cancel()
+		feed, err := fetchRssFeed(ctx, urlStr)
+		if errors.Is(err, errRssNotModified) {
+			renewRssCache(urlStr)
+		}
+		if err != nil {
+			if cacheErr == nil && hasCache {
+				s.Emit("rss:metaData", map[string]interface{}{
+					"url":  urlStr,
+					"data": cachedMeta,
+				})
+				return
+			}
+			s.Emit("rss:error", map[string]interface{}{"url": urlStr, "error": err.Error()})
+			return
+		}
+		_ = storeRssFeed(urlStr, feed)
+
+		s.Emit("rss:metaData", map[string]interface{}{
+			"url":  urlStr,
+			"data": rssFeedMeta(feed),
 		})
 	})
 }
 
-func WarmRssCache(urls []string) {
+func parseRssUrl(msg interface{}) string {
+	var urlStr string
+	if m, ok := msg.(map[string]interface{}); ok {
+		if u, ok := m["url"].(string); ok {
+			urlStr = u
+		}
+	}
+	return strings.TrimSpace(urlStr)
+}
+
+// rssRequestUser returns the user behind an optional "token" field, so
+// authenticated clients get read/saved flags and an unread count.
+func rssRequestUser(msg interface{}) string {
+	m, ok := msg.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	token, _ := m["token"].(string)
+	username, _ := validateSocketToken(token)
+	return username
+}
+
+func buildRssDataPayload(urlStr string, items []UnifiedRssItem, snippetLength int, username string) map[string]interface{} {
+	items = limitRssSnippets(items, snippetLength)
+	data := map[string]interface{}{}
+	if username != "" {
+		state := loadRssState(username)
+		items, data["unread"] = applyRssState(items, &state, urlStr)
+	}
+	data["items"] = items
+	return data
+}
+
+// rssFeedMeta returns a copy of feed without its item payload
+func rssFeedMeta(feed *UnifiedFeed) UnifiedFeed {
+	meta := *feed
+	meta.ItemCount = len(feed.Items)
+	meta.Items = nil
+	return meta
+}
+
+// storeRssFeed caches the items and the metadata of a freshly fetched feed
+func storeRssFeed(urlStr string, feed *UnifiedFeed) error {
+	var prevItems []UnifiedRssItem
+	if _, _, _, err := sharedWidgetCache.Get(widgetCacheKindRSS, urlStr, &prevItems); err == nil {
+		stabilizeRssGuids(prevItems, feed.Items)
+	}
+	ttl := rssFeedTTL(findRssFeedConfig(urlStr))
+	if err := sharedWidgetCache.Set(widgetCacheKindRSSMeta, urlStr, rssFeedMeta(feed), ttl, "ok"); err != nil {
+		return err
+	}
+	if feed.hubUrl != "" {
+		rssWebSub.ensure(urlStr, feed.hubUrl, feed.selfUrl)
+	}
+	return sharedWidgetCache.Set(widgetCacheKindRSS, urlStr, feed.Items, ttl, "ok")
+}
+
+// rssFeedTTL reads a feed's optional "cacheTTL" (minutes). Without it the
+// feed's refresh interval is used, so the cache never outlives a scheduled
+// refresh; rssCacheTTL applies to unconfigured feeds.
+func rssFeedTTL(fm map[string]interface{}) time.Duration {
+	ttl := rssCacheTTL
+	if minutes, ok := fm["cacheTTL"].(float64); ok && minutes > 0 {
+		ttl = time.Duration(minutes * float64(time.Minute))
+	} else if minutes, ok := fm["refreshInterval"].(float64); ok && minutes > 0 {
+		ttl = time.Duration(minutes * float64(time.Minute))
+	}
+	if ttl < minRssCacheTTL {
+		ttl = minRssCacheTTL
+	}
+	if ttl > maxRssCacheTTL {
+		ttl = maxRssCacheTTL
+	}
+	return ttl
+}
+
+// invalidateRssCache marks a feed's cached items stale and forgets its HTTP
+// validators so the next fetch downloads the full feed.
+func invalidateRssCache(urlStr string) {
+	sharedWidgetCache.Expire(widgetCacheKindRSS, urlStr)
+	sharedWidgetCache.Expire(widgetCacheKindRSSMeta, urlStr)
+	sharedWidgetCache.Delete(widgetCacheKindRSSHTTP, urlStr)
+}
+
+// WarmRssCache fetches feeds with a bounded worker pool. It returns early
+// once ctx is cancelled; fetches in flight are aborted.
+func WarmRssCache(ctx context.Context, urls []string) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < rssWarmupWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for urlStr := range jobs {
+				warmRssFeed(ctx, urlStr)
+			}
+		}()
+	}
+
 	seen := make(map[string]struct{})
+queue:
 	for _, urlStr := range urls {
 		urlStr = strings.TrimSpace(urlStr)
 		if urlStr == "" {
@@ -144,56 +452,161 @@ func WarmRssCache(urls []string) {
 			continue
 		}
 		seen[urlStr] = struct{}{}
-		items, err := fetchRssFeed(urlStr)
-		if err != nil {
-			_ = sharedWidgetCache.MarkStatus(widgetCacheKindRSS, urlStr, "error")
-			log.Printf("RSS warmup failed: url=%s error=%v", urlStr, err)
-			continue
+		select {
+		case jobs <- urlStr:
+		case <-ctx.Done():
+			break queue
 		}
-		if len(items) == 0 {
-			continue
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func warmRssFeed(ctx context.Context, urlStr string) {
+	fetchCtx, cancel := context.WithTimeout(ctx, rssFetchTimeout)
+	defer cancel()
+	feed, err := fetchRssFeed(fetchCtx, urlStr)
+	if errors.Is(err, errRssNotModified) {
+		renewRssCache(urlStr)
+		return
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return
 		}
-		_ = sharedWidgetCache.Set(widgetCacheKindRSS, urlStr, items, rssCacheTTL, "ok")
+		_ = sharedWidgetCache.MarkStatus(widgetCacheKindRSS, urlStr, "error")
+		rssLog.Warn("RSS warmup failed", "feed", redactRssUrl(urlStr), "error", err)
+		return
 	}
+	_ = storeRssFeed(urlStr, feed)
 }
 
 func refreshRssAsync(server *socketio.Server, urlStr string) {
+	refreshRss(server, urlStr)
+}
+
+// refreshRss fetches a feed, updates the cache and pushes new items to the
+// connections subscribed to it.
+// It returns "ok", "notModified", "error", or "busy" when another refresh
+// of the same feed is already running.
+func refreshRss(server *socketio.Server, urlStr string) string {
 	tag := "rss:" + urlStr
+	done, ok := beginTask()
+	if !ok {
+		return "busy"
+	}
+	defer done()
 	if !sharedWidgetCache.StartRefresh(tag) {
-		return
+		return "busy"
 	}
 	defer sharedWidgetCache.EndRefresh(tag)
-	items, err := fetchRssFeed(urlStr)
+	status := "ok"
+	defer func() { rssScheduler.markRefreshed(urlStr, status) }()
+
+	var prevItems []UnifiedRssItem
+	_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSS, urlStr, &prevItems)
+
+	ctx, cancel := context.WithTimeout(fetchCtx, rssFetchTimeout)
+	defer cancel()
+	feed, err := fetchRssFeed(ctx, urlStr)
+	if errors.Is(err, errRssNotModified) {
+		renewRssCache(urlStr)
+		status = "notModified"
+		return status
+	}
 	if err != nil {
 		_ = sharedWidgetCache.MarkStatus(widgetCacheKindRSS, urlStr, "error")
-		return
+		status = "error"
+		return status
 	}
-	if len(items) == 0 {
-		return
+	_ = storeRssFeed(urlStr, feed)
+	fresh := newRssItems(prevItems, feed.Items)
+	newItems := len(fresh)
+	// The first fetch of a feed only seeds the cache; alerting on it would
+	// report the whole backlog
+	if len(prevItems) > 0 {
+		evaluateRssAlerts(urlStr, feed.Title, fresh)
 	}
-	_ = sharedWidgetCache.Set(widgetCacheKindRSS, urlStr, items, rssCacheTTL, "ok")
-	server.BroadcastToNamespace("/", "rss:data", map[string]interface{}{
-		"url": urlStr,
-		"data": map[string]interface{}{
-			"items": items,
-		},
-	})
+	if newItems > 0 || len(prevItems) == 0 {
+		broadcastRoom(rssRoom(urlStr), "rss:data", map[string]interface{}{
+			"url": urlStr,
+			"data": map[string]interface{}{
+				"items":    limitRssSnippets(feed.Items, defaultRssSnippetLength),
+				"newItems": newItems,
+			},
+		})
+	}
+	return status
+}
+
+// errRssNotModified is returned when the origin answers a conditional
+// request with 304; the cached copy is still current.
+var errRssNotModified = errors.New("feed not modified")
+
+// rssValidators are the HTTP cache validators of the last successful fetch
+type rssValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
 }
 
-func fetchRssFeed(feedUrl string) ([]UnifiedRssItem, error) {
+func fetchRssFeed(ctx context.Context, feedUrl string) (feed *UnifiedFeed, err error) {
 	feedUrl = strings.TrimSpace(feedUrl)
 	if feedUrl == "" {
 		return nil, fmt.Errorf("url is required")
 	}
+	start := time.Now()
+	defer func() { rssHealth.record(feedUrl, start, feed, err) }()
+	// Only ask for a 304 when there is something cached to fall back on
+	var cachedItems []UnifiedRssItem
+	hasCache, _, _, err := sharedWidgetCache.Get(widgetCacheKindRSS, feedUrl, &cachedItems)
+	feedConfig := findRssFeedConfig(feedUrl)
+	opts := rssFetchOptions{
+		conditional: err == nil && hasCache && len(cachedItems) > 0,
+		profile:     rssFetchProfileFromConfig(feedConfig),
+		apiKey:      rssFeedApiKey(feedConfig),
+		scrape:      rssScrapeRuleFromConfig(feedConfig),
+		pageDepth:   rssFeedPageDepth(feedConfig),
+	}
+	filter := loadRssItemFilter(feedConfig)
+
 	candidates := []string{feedUrl}
 	if !strings.Contains(feedUrl, "://") {
 		candidates = []string{"https://" + feedUrl, "http://" + feedUrl}
 	}
+	// Known sites are fetched through their feed variant first; the page
+	// itself stays as a fallback for autodiscovery
+	var resolved string
+	var ok bool
+	if opts.scrape == nil {
+		resolved, ok, err = resolveFeedSource(ctx, candidates[0])
+		if err != nil {
+			rssLog.Warn("RSS source resolution failed", "feed", redactRssUrl(feedUrl), "error", err)
+		}
+		if ok {
+			candidates = append([]string{resolved}, candidates...)
+		}
+	}
 	var lastErr error
 	for _, candidate := range candidates {
-		items, err := fetchRssFeedOnce(candidate)
-		if err == nil && len(items) > 0 {
-			return items, nil
+		feed, err := fetchRssFeedOnce(ctx, candidate, opts)
+		if errors.Is(err, errRssNotModified) {
+			return nil, err
+		}
+		if err == nil && len(feed.Items) > 0 {
+			if ok && candidate == resolved && feed.FeedUrl == "" {
+				feed.FeedUrl = candidate
+			}
+			feed.Items = filter.apply(feed.Items)
+			feed.ItemCount = len(feed.Items)
+			if feedWantsFullContent(feedConfig) {
+				attachFullContent(ctx, feed.Items, opts.profile)
+			}
+			site := feed.Link
+			if site == "" {
+				site = candidate
+			}
+			feed.Favicon = resolveFeedFavicon(ctx, site)
+			return feed, nil
 		}
 		if err != nil {
 			lastErr = err
@@ -205,22 +618,53 @@ func fetchRssFeed(feedUrl string) ([]UnifiedRssItem, error) {
 	return nil, fmt.Errorf("failed to parse feed")
 }
 
-func fetchRssFeedOnce(feedUrl string) ([]UnifiedRssItem, error) {
-	attempts := buildRssAttempts(feedUrl)
+// rssFetchOptions tune a single feed fetch
+type rssFetchOptions struct {
+	conditional bool             // Send cache validators from the previous fetch
+	profile     *RssFetchProfile // Per-feed headers and credentials, if configured
+	apiKey      string           // Torznab/Newznab API key, added to the request only
+	scrape      *RssScrapeRule   // Build items from HTML instead of parsing a feed
+	pageDepth   int              // Pages to read from a paginated feed, 1 for the first only
+}
+
+func fetchRssFeedOnce(ctx context.Context, feedUrl string, opts rssFetchOptions) (*UnifiedFeed, error) {
+	if opts.scrape != nil {
+		return scrapeRssFeed(ctx, feedUrl, opts.scrape, opts.profile)
+	}
+	attempts := buildRssAttempts(feedUrl, opts.profile)
+	var validators rssValidators
+	if opts.conditional {
+		_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSSHTTP, feedUrl, &validators)
+	}
 	var lastErr error
+	rateLimited := false
 	for _, attempt := range attempts {
-		body, err := fetchRssBody(attempt.client, feedUrl, attempt.headers)
-		if err != nil {
-			lastErr = err
+		// Another user agent from the same IP won't lift a rate limit
+		if rateLimited && !attempt.viaProxy {
 			continue
 		}
-		items, err := parseRssItems(body)
-		if err == nil && len(items) > 0 {
-			return items, nil
+		resp, err := fetchRssResponse(ctx, attempt.client, withIndexerApiKey(feedUrl, opts.apiKey), withRssValidators(attempt.headers, validators), true)
+		if errors.Is(err, errRssNotModified) {
+			return nil, err
 		}
 		if err != nil {
+			var httpErr *rssHTTPError
+			if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusTooManyRequests {
+				rateLimited = true
+			}
 			lastErr = err
+			continue
+		}
+		if feed := resp.feed; feed != nil {
+			storeRssValidators(feedUrl, resp.validators)
+			followRssPages(ctx, attempt, feedUrl, feed, opts.pageDepth)
+			return feed, nil
+		}
+		feed, err := fetchDiscoveredFeed(ctx, attempt, feedUrl, resp.body)
+		if err == nil {
+			return feed, nil
 		}
+		lastErr = err
 	}
 	if lastErr != nil {
 		return nil, lastErr
@@ -228,33 +672,72 @@ func fetchRssFeedOnce(feedUrl string) ([]UnifiedRssItem, error) {
 	return nil, fmt.Errorf("failed to parse feed")
 }
 
+func withRssValidators(headers map[string]string, validators rssValidators) map[string]string {
+	if validators.ETag == "" && validators.LastModified == "" {
+		return headers
+	}
+	merged := make(map[string]string, len(headers)+2)
+	for k, v := range headers {
+		merged[k] = v
+	}
+	if validators.ETag != "" {
+		merged["If-None-Match"] = validators.ETag
+	}
+	if validators.LastModified != "" {
+		merged["If-Modified-Since"] = validators.LastModified
+	}
+	return merged
+}
+
+func storeRssValidators(feedUrl string, validators rssValidators) {
+	if validators.ETag == "" && validators.LastModified == "" {
+		return
+	}
+	_ = sharedWidgetCache.Set(widgetCacheKindRSSHTTP, feedUrl, validators, rssCacheTTL, "ok")
+}
+
+// renewRssCache extends the TTL of a feed's cached items after a 304
+func renewRssCache(urlStr string) {
+	sharedWidgetCache.Touch(widgetCacheKindRSS, urlStr)
+	sharedWidgetCache.Touch(widgetCacheKindRSSMeta, urlStr)
+}
+
+// rssDirectTransport carries direct feed fetches through the outbound guard
+var rssDirectTransport = newProxyTransport()
+
 type rssAttempt struct {
-	client  *http.Client
-	headers map[string]string
+	client   *http.Client
+	headers  map[string]string
+	viaProxy bool
 }
 
-func buildRssAttempts(feedUrl string) []rssAttempt {
+func buildRssAttempts(feedUrl string, profile *RssFetchProfile) []rssAttempt {
 	referer := buildRssReferer(feedUrl)
-	headersA := buildRssHeaders(referer, "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	jar := rssCookieJar(feedUrl, profile)
+	if profile != nil {
+		return routeRssAttempts(feedUrl, buildProfileRssAttempts(referer, profile, jar))
+	}
+	headersA := buildRssHeaders(referer, defaultRssUserAgent)
 	headersB := buildRssHeaders(referer, "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.3 Safari/605.1.15")
 	attempts := []rssAttempt{
-		{client: &http.Client{Timeout: 10 * time.Second}, headers: headersA},
-		{client: &http.Client{Timeout: 10 * time.Second}, headers: headersB},
+		{client: &http.Client{Timeout: 10 * time.Second, Jar: jar, Transport: rssDirectTransport}, headers: headersA},
+		{client: &http.Client{Timeout: 10 * time.Second, Jar: jar, Transport: rssDirectTransport}, headers: headersB},
 	}
 	proxyURL, err := getProxyURL()
 	if err == nil && proxyURL != nil {
 		if proxyClient, err := buildProxyClient(); err == nil {
-			attempts = append(attempts, rssAttempt{client: proxyClient, headers: headersB})
+			attempts = append(attempts, rssAttempt{client: withCookieJar(proxyClient, jar), headers: headersB, viaProxy: true})
 		}
 	}
-	return attempts
+	return routeRssAttempts(feedUrl, attempts)
 }
 
 func buildRssHeaders(referer, userAgent string) map[string]string {
 	headers := map[string]string{
 		"User-Agent":      userAgent,
-		"Accept":          "application/rss+xml, application/xml, text/xml, */*",
+		"Accept":          "application/rss+xml, application/atom+xml, application/feed+json, application/xml, text/xml, */*",
 		"Accept-Language": "zh-CN,zh;q=0.9,en;q=0.8",
+		"Accept-Encoding": rssAcceptEncoding,
 		"Cache-Control":   "no-cache",
 	}
 	if referer != "" {
@@ -271,8 +754,63 @@ func buildRssReferer(feedUrl string) string {
 	return parsed.Scheme + "://" + parsed.Host + "/"
 }
 
-func fetchRssBody(client *http.Client, feedUrl string, headers map[string]string) ([]byte, error) {
-	req, err := http.NewRequest("GET", feedUrl, nil)
+type rssResponse struct {
+	body       []byte       // The page, unless it was read as a feed
+	feed       *UnifiedFeed // The feed, when one was asked for and found
+	validators rssValidators
+}
+
+func fetchRssBody(ctx context.Context, client *http.Client, feedUrl string, headers map[string]string) ([]byte, error) {
+	resp, err := fetchRssResponse(ctx, client, feedUrl, headers, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.body, nil
+}
+
+// fetchRssFeedBody fetches and decodes a feed; a web page is an error
+func fetchRssFeedBody(ctx context.Context, client *http.Client, feedUrl string, headers map[string]string) (*UnifiedFeed, error) {
+	resp, err := fetchRssResponse(ctx, client, feedUrl, headers, true)
+	if err != nil {
+		return nil, err
+	}
+	if resp.feed == nil {
+		return nil, fmt.Errorf("failed to parse feed: got a web page")
+	}
+	return resp.feed, nil
+}
+
+// fetchRssResponse waits for the host's rate limit slot and retries 429
+// and 5xx responses with exponential backoff. With asFeed the body is
+// decoded as a feed while it is read, unless it turns out to be a web page.
+func fetchRssResponse(ctx context.Context, client *http.Client, feedUrl string, headers map[string]string, asFeed bool) (*rssResponse, error) {
+	host := rssRequestHost(feedUrl)
+	for retry := 0; ; retry++ {
+		if err := rssLimiter.wait(ctx, host); err != nil {
+			return nil, err
+		}
+		resp, err := doRssRequest(ctx, client, feedUrl, headers, asFeed)
+		var httpErr *rssHTTPError
+		if !errors.As(err, &httpErr) || !httpErr.retryable() || retry >= rssMaxRetries {
+			return resp, err
+		}
+		delay := rssBackoff(retry, httpErr.RetryAfter)
+		if httpErr.StatusCode == http.StatusTooManyRequests {
+			rssLimiter.hold(host, delay)
+		}
+		rssLog.Info("RSS fetch retry", "feed", redactRssUrl(feedUrl), "status", httpErr.StatusCode, "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+func doRssRequest(ctx context.Context, client *http.Client, feedUrl string, headers map[string]string, asFeed bool) (*rssResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", feedUrl, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -281,80 +819,264 @@ func fetchRssBody(client *http.Client, feedUrl string, headers map[string]string
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, redactRssError(err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, errRssNotModified
+	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+		return nil, &rssHTTPError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	if resp.ContentLength > maxRssBodySize {
+		return nil, errRssTooLarge
+	}
+	body, err := decompressRssReader(newRssLimitedReader(resp.Body), resp.Header.Get("Content-Encoding"))
+	if errors.Is(err, errRssBrotli) && headers["Accept-Encoding"] != "identity" {
+		retryHeaders := make(map[string]string, len(headers)+1)
+		for k, v := range headers {
+			retryHeaders[k] = v
+		}
+		retryHeaders["Accept-Encoding"] = "identity"
+		return doRssRequest(ctx, client, feedUrl, retryHeaders, asFeed)
 	}
-	return io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decompress response: %w", err)
+	}
+	result := &rssResponse{
+		validators: rssValidators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		},
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if asFeed {
+		br := bufio.NewReaderSize(body, rssSniffSize)
+		if head, _ := br.Peek(rssSniffSize); !looksLikeHTML(head) {
+			result.feed, err = parseRssFeedReader(br, contentType)
+			if err != nil {
+				return nil, err
+			}
+			return result, nil
+		}
+		body = br
+	}
+	if result.body, err = io.ReadAll(body); err != nil {
+		return nil, err
+	}
+	if isFeedContentType(contentType) {
+		result.body = normalizeRssCharset(result.body, contentType)
+	}
+	return result, nil
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// trimXMLPreamble drops a UTF-8 byte order mark and any whitespace ahead of
+// the XML declaration. Processing instructions such as xml-stylesheet are left
+// in place; the decoder skips them while looking for the root element.
+func trimXMLPreamble(body []byte) []byte {
+	body = bytes.TrimLeft(body, " \t\r\n")
+	for bytes.HasPrefix(body, utf8BOM) {
+		body = bytes.TrimLeft(body[len(utf8BOM):], " \t\r\n")
+	}
+	return body
 }
 
 func parseRssItems(body []byte) ([]UnifiedRssItem, error) {
-	var rss2 Rss2Feed
-	decoder := xml.NewDecoder(bytes.NewReader(body))
-	decoder.CharsetReader = charset.NewReaderLabel
-	if err := decoder.Decode(&rss2); err == nil && len(rss2.Channel.Items) > 0 {
-		items := make([]UnifiedRssItem, 0, len(rss2.Channel.Items))
-		for _, item := range rss2.Channel.Items {
-			desc := cleanDescription(item.Description)
-			if desc == "" {
-				desc = cleanDescription(item.Content)
-			}
-			link := strings.TrimSpace(item.Link)
-			if link == "" {
-				link = strings.TrimSpace(item.Guid)
-			}
-			items = append(items, UnifiedRssItem{
-				Title:          item.Title,
-				Link:           link,
-				PubDate:        item.PubDate,
-				ContentSnippet: desc,
-			})
+	feed, err := parseRssFeed(body)
+	if err != nil {
+		return nil, err
+	}
+	return feed.Items, nil
+}
+
+func parseRssFeed(body []byte) (*UnifiedFeed, error) {
+	return parseRssFeedReader(bytes.NewReader(body), "")
+}
+
+// finalizeRssFeed normalizes dates, resolves images, fills missing GUIDs
+// and drops duplicates, whatever format the feed was decoded from.
+func finalizeRssFeed(feed *UnifiedFeed) *UnifiedFeed {
+	feed.Updated, _ = normalizeRssDate(feed.Updated)
+	for i := range feed.Items {
+		feed.Items[i].PubDate, feed.Items[i].Timestamp = normalizeRssDate(feed.Items[i].PubDate)
+		feed.Items[i].Image = resolveItemUrl(feed.Items[i].Link, feed.Items[i].Image)
+		if feed.Items[i].Guid == "" {
+			feed.Items[i].Guid = fallbackRssGuid(feed.Items[i])
 		}
-		return items, nil
 	}
+	feed.Items = dedupeRssItems(feed.Items)
+	if len(feed.Items) > maxRssItems {
+		feed.Items = feed.Items[:maxRssItems]
+	}
+	feed.ItemCount = len(feed.Items)
+	return feed
+}
 
-	// Try Atom
-	var atom AtomFeed
-	decoder = xml.NewDecoder(bytes.NewReader(body))
-	decoder.CharsetReader = charset.NewReaderLabel
-	if err := decoder.Decode(&atom); err == nil && len(atom.Entries) > 0 {
-		items := make([]UnifiedRssItem, 0, len(atom.Entries))
-		for _, entry := range atom.Entries {
-			desc := cleanDescription(entry.Summary)
-			if desc == "" {
-				desc = cleanDescription(entry.Content)
-			}
-			link := pickAtomLink(entry.Links)
-			items = append(items, UnifiedRssItem{
-				Title:          entry.Title,
-				Link:           link,
-				PubDate:        entry.Updated,
-				ContentSnippet: desc,
-			})
+func rss2Feed(rss2 Rss2Feed) (*UnifiedFeed, error) {
+	if len(rss2.Channel.Items) == 0 {
+		return nil, errRssNoItems
+	}
+	items := make([]UnifiedRssItem, 0, len(rss2.Channel.Items))
+	for _, item := range rss2.Channel.Items {
+		desc := cleanDescription(item.Description)
+		if desc == "" {
+			desc = cleanDescription(item.Content)
 		}
-		return items, nil
-	}
-
-	var rdf RdfFeed
-	decoder = xml.NewDecoder(bytes.NewReader(body))
-	decoder.CharsetReader = charset.NewReaderLabel
-	if err := decoder.Decode(&rdf); err == nil && len(rdf.Items) > 0 {
-		items := make([]UnifiedRssItem, 0, len(rdf.Items))
-		for _, item := range rdf.Items {
-			desc := cleanDescription(item.Description)
-			items = append(items, UnifiedRssItem{
-				Title:          item.Title,
-				Link:           item.Link,
-				PubDate:        item.Date,
-				ContentSnippet: desc,
-			})
+		link := strings.TrimSpace(item.Link)
+		if link == "" {
+			link = strings.TrimSpace(item.Guid)
 		}
-		return items, nil
+		items = append(items, UnifiedRssItem{
+			Guid:           strings.TrimSpace(item.Guid),
+			Title:          item.Title,
+			Link:           link,
+			PubDate:        item.PubDate,
+			ContentSnippet: desc,
+			Image:          pickItemImage(item.MediaRss, item.Description, item.Content),
+			Enclosure:      pickRss2Enclosure(item),
+			Indexer:        pickIndexerInfo(item),
+		})
 	}
+	ch := rss2.Channel
+	updated := strings.TrimSpace(ch.LastBuildDate)
+	if updated == "" {
+		updated = strings.TrimSpace(ch.PubDate)
+	}
+	return &UnifiedFeed{
+		Title:       strings.TrimSpace(ch.Title),
+		Description: cleanDescription(strings.TrimSpace(ch.Description)),
+		Link:        strings.TrimSpace(ch.Link),
+		Icon:        strings.TrimSpace(ch.Image.Url),
+		Generator:   strings.TrimSpace(ch.Generator),
+		Type:        "rss2",
+		Updated:     updated,
+		ItemCount:   len(items),
+		Items:       items,
+		nextUrl:     pickAtomRel(ch.AtomLinks, "next"),
+		hubUrl:      pickAtomRel(ch.AtomLinks, "hub"),
+		selfUrl:     pickAtomRel(ch.AtomLinks, "self"),
+	}, nil
+}
 
-	return nil, fmt.Errorf("failed to parse feed")
+func atomFeed(atom AtomFeed) (*UnifiedFeed, error) {
+	if len(atom.Entries) == 0 {
+		return nil, errRssNoItems
+	}
+	items := make([]UnifiedRssItem, 0, len(atom.Entries))
+	for _, entry := range atom.Entries {
+		desc := cleanDescription(entry.Summary)
+		if desc == "" {
+			desc = cleanDescription(entry.Content)
+		}
+		if desc == "" {
+			desc = cleanDescription(entry.mediaDescription())
+		}
+		link := pickAtomLink(entry.Links)
+		pubDate := entry.Published
+		if strings.TrimSpace(pubDate) == "" {
+			pubDate = entry.Updated
+		}
+		items = append(items, UnifiedRssItem{
+			Guid:           strings.TrimSpace(entry.ID),
+			Title:          entry.Title,
+			Link:           link,
+			PubDate:        pubDate,
+			ContentSnippet: desc,
+			Image:          pickItemImage(entry.MediaRss, entry.Summary, entry.Content),
+			Enclosure:      pickAtomEnclosure(entry.Links),
+		})
+	}
+	icon := strings.TrimSpace(atom.Icon)
+	if icon == "" {
+		icon = strings.TrimSpace(atom.Logo)
+	}
+	return &UnifiedFeed{
+		Title:       strings.TrimSpace(atom.Title),
+		Description: cleanDescription(strings.TrimSpace(atom.Subtitle)),
+		Link:        pickAtomLink(atom.Links),
+		Icon:        icon,
+		Generator:   strings.TrimSpace(atom.Generator),
+		Type:        "atom",
+		Updated:     strings.TrimSpace(atom.Updated),
+		ItemCount:   len(items),
+		Items:       items,
+		nextUrl:     pickAtomRel(atom.Links, "next"),
+		hubUrl:      pickAtomRel(atom.Links, "hub"),
+		selfUrl:     pickAtomRel(atom.Links, "self"),
+	}, nil
+}
+
+func rdfFeed(rdf RdfFeed) (*UnifiedFeed, error) {
+	if len(rdf.Items) == 0 {
+		return nil, errRssNoItems
+	}
+	items := make([]UnifiedRssItem, 0, len(rdf.Items))
+	for _, item := range rdf.Items {
+		desc := cleanDescription(item.Description)
+		items = append(items, UnifiedRssItem{
+			Guid:           strings.TrimSpace(item.About),
+			Title:          item.Title,
+			Link:           item.Link,
+			PubDate:        item.Date,
+			ContentSnippet: desc,
+		})
+	}
+	return &UnifiedFeed{
+		Title:       strings.TrimSpace(rdf.Channel.Title),
+		Description: cleanDescription(strings.TrimSpace(rdf.Channel.Description)),
+		Link:        strings.TrimSpace(rdf.Channel.Link),
+		Icon:        strings.TrimSpace(rdf.Image.Url),
+		Type:        "rdf",
+		Updated:     strings.TrimSpace(rdf.Channel.Date),
+		ItemCount:   len(items),
+		Items:       items,
+	}, nil
+}
+
+func pickRss2Enclosure(item Rss2Item) *RssEnclosure {
+	for _, enc := range item.Enclosures {
+		encUrl := strings.TrimSpace(enc.Url)
+		if encUrl == "" {
+			continue
+		}
+		length, _ := strconv.ParseInt(strings.TrimSpace(enc.Length), 10, 64)
+		return &RssEnclosure{
+			Url:      encUrl,
+			Type:     strings.TrimSpace(enc.Type),
+			Length:   length,
+			Duration: strings.TrimSpace(item.Duration),
+		}
+	}
+	return nil
+}
+
+func pickAtomEnclosure(links []AtomLink) *RssEnclosure {
+	for _, link := range links {
+		if link.Rel != "enclosure" || strings.TrimSpace(link.Href) == "" {
+			continue
+		}
+		length, _ := strconv.ParseInt(strings.TrimSpace(link.Length), 10, 64)
+		return &RssEnclosure{
+			Url:    strings.TrimSpace(link.Href),
+			Type:   strings.TrimSpace(link.Type),
+			Length: length,
+		}
+	}
+	return nil
+}
+
+func pickAtomRel(links []AtomLink, rel string) string {
+	for _, link := range links {
+		if link.Rel == rel && strings.TrimSpace(link.Href) != "" {
+			return strings.TrimSpace(link.Href)
+		}
+	}
+	return ""
 }
 
 func pickAtomLink(links []AtomLink) string {
@@ -378,30 +1100,3 @@ func pickAtomLink(links []AtomLink) string {
 	}
 	return ""
 }
-
-func cleanDescription(html string) string {
-	// Simple strip tags
-	// In a real app we might want a proper HTML sanitizer, but here we just strip generic tags
-	// Or just return truncated text
-
-	// Remove <![CDATA[ ... ]]> wrapper
-	if strings.HasPrefix(html, "<![CDATA[") && strings.HasSuffix(html, "]]>") {
-		html = html[9 : len(html)-3]
-	}
-
-	// Very basic tag stripping (naive)
-	// Replace <br> with space
-	html = strings.ReplaceAll(html, "<br>", " ")
-	html = strings.ReplaceAll(html, "<br/>", " ")
-
-	// Remove other tags (naive regex)
-	// Note: regex in Go for HTML is not perfect but sufficient for snippets
-	// Ideally use a library like bluemonday, but we avoid new deps
-
-	// Truncate to 100 chars
-	runes := []rune(html)
-	if len(runes) > 100 {
-		return string(runes[:100]) + "..."
-	}
-	return html
-}
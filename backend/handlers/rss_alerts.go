@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/utils"
+	"path/filepath"
+	"strings"
+)
+
+// maxRssAlertsPerRule keeps one noisy refresh from flooding the channels;
+// the remaining matches are summarised in a single notification.
+const maxRssAlertsPerRule = 5
+
+// RssAlertRule raises a notification when a new item of the listed feeds
+// (or of any feed when Feeds is empty) matches one of the patterns. Patterns
+// follow the filter syntax: /expr/i or a plain keyword.
+type RssAlertRule struct {
+	Name     string   `json:"name"`
+	Enable   *bool    `json:"enable,omitempty"`
+	Feeds    []string `json:"feeds,omitempty"`
+	Match    []string `json:"match"`
+	Channels []string `json:"channels,omitempty"` // Names from "notifications"; empty means all
+}
+
+func loadRssAlertRules() []RssAlertRule {
+	var payload map[string]interface{}
+	if err := utils.ReadJSON(filepath.Join(config.DataDir, "data.json"), &payload); err != nil {
+		return nil
+	}
+	return decodeRssAlertRules(payload["rssAlerts"])
+}
+
+func decodeRssAlertRules(raw interface{}) []RssAlertRule {
+	if raw == nil {
+		return nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil
+	}
+	var rules []RssAlertRule
+	_ = json.Unmarshal(data, &rules)
+	return rules
+}
+
+func (r RssAlertRule) appliesTo(feedUrl string) bool {
+	if r.Enable != nil && !*r.Enable {
+		return false
+	}
+	if len(r.Feeds) == 0 {
+		return true
+	}
+	for _, u := range r.Feeds {
+		if strings.TrimSpace(u) == feedUrl {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRssAlert returns the items that trigger the rule
+func matchRssAlert(rule RssAlertRule, items []UnifiedRssItem) []UnifiedRssItem {
+	matchers := compileRssMatchers(rule.Match)
+	if len(matchers) == 0 {
+		return nil
+	}
+	hits := make([]UnifiedRssItem, 0)
+	for _, item := range items {
+		if anyRssMatch(matchers, item.Title+"\n"+item.ContentSnippet) {
+			hits = append(hits, item)
+		}
+	}
+	return hits
+}
+
+// evaluateRssAlerts runs the alert rules against the items a refresh found
+// for the first time.
+func evaluateRssAlerts(feedUrl, feedTitle string, newItems []UnifiedRssItem) {
+	if len(newItems) == 0 {
+		return
+	}
+	for _, rule := range loadRssAlertRules() {
+		if !rule.appliesTo(feedUrl) {
+			continue
+		}
+		hits := matchRssAlert(rule, newItems)
+		if len(hits) == 0 {
+			continue
+		}
+		for _, n := range rssAlertNotifications(rule, feedTitle, hits) {
+			sendNotification(backgroundCtx, n, rule.Channels)
+		}
+		items := make([]map[string]interface{}, 0, len(hits))
+		for _, item := range hits {
+			items = append(items, map[string]interface{}{"title": item.Title, "link": item.Link, "pubDate": item.PubDate})
+		}
+		fireWebhook(WebhookRssAlert, map[string]interface{}{
+			"rule":    rule.Name,
+			"feed":    feedTitle,
+			"feedUrl": feedUrl,
+			"items":   items,
+		})
+	}
+}
+
+func rssAlertNotifications(rule RssAlertRule, feedTitle string, hits []UnifiedRssItem) []Notification {
+	name := rule.Name
+	if name == "" {
+		name = i18n.T(notifyLocale(), "notify_rss_alert")
+	}
+	list := make([]Notification, 0, maxRssAlertsPerRule+1)
+	for i, item := range hits {
+		if i == maxRssAlertsPerRule {
+			list = append(list, Notification{
+				Title:  name,
+				Body:   i18n.T(notifyLocale(), "notify_rss_alert_more", len(hits)-i, feedTitle),
+				Source: "rss",
+			})
+			break
+		}
+		list = append(list, Notification{
+			Title:  name + ": " + feedTitle,
+			Body:   item.Title,
+			Link:   item.Link,
+			Source: "rss",
+		})
+	}
+	return list
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// rssBridge rewrites the web URL of a known site to its feed URL. It
+// returns "" when the URL is not one it handles.
+type rssBridge func(u *url.URL, segments []string) string
+
+var rssBridges = []rssBridge{
+	redditFeedUrl,
+	githubFeedUrl,
+	mediumFeedUrl,
+	// Last: /@user paths are guessed to be Mastodon-compatible servers
+	mastodonFeedUrl,
+}
+
+// resolveFeedSource returns the feed URL behind a page the user pasted,
+// trying YouTube resolution first and then the URL rewriting bridges.
+// ok is false when the URL should be fetched as is.
+func resolveFeedSource(ctx context.Context, pageUrl string) (string, bool, error) {
+	if feedUrl, ok, err := resolveYouTubeFeed(ctx, pageUrl); ok || err != nil {
+		return feedUrl, ok, err
+	}
+	parsed, err := url.Parse(pageUrl)
+	if err != nil || parsed.Host == "" {
+		return "", false, nil
+	}
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	for _, bridge := range rssBridges {
+		if feedUrl := bridge(parsed, segments); feedUrl != "" && feedUrl != pageUrl {
+			return feedUrl, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func hostIs(u *url.URL, domain string) bool {
+	host := strings.ToLower(u.Hostname())
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func looksLikeFeedPath(path string) bool {
+	lower := strings.ToLower(path)
+	for _, suffix := range []string{".rss", ".atom", ".xml", "/feed", "/rss"} {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redditFeedUrl handles /r/<sub>, /r/<sub>/<sort> and /user/<name>
+func redditFeedUrl(u *url.URL, segments []string) string {
+	if !hostIs(u, "reddit.com") || looksLikeFeedPath(u.Path) || len(segments) < 2 {
+		return ""
+	}
+	switch segments[0] {
+	case "r", "user", "u":
+		kind := segments[0]
+		if kind == "u" {
+			kind = "user"
+		}
+		path := "/" + kind + "/" + segments[1]
+		if kind == "r" && len(segments) > 2 {
+			switch segments[2] {
+			case "new", "top", "hot", "rising":
+				path += "/" + segments[2]
+			}
+		}
+		feed := "https://www.reddit.com" + path + "/.rss"
+		if kind == "r" && len(segments) > 2 && segments[2] == "top" && u.Query().Get("t") != "" {
+			feed += "?t=" + url.QueryEscape(u.Query().Get("t"))
+		}
+		return feed
+	}
+	return ""
+}
+
+// githubFeedUrl maps a repository to its releases, tags or commits feed and
+// a user page to the user's public activity.
+func githubFeedUrl(u *url.URL, segments []string) string {
+	if strings.ToLower(u.Hostname()) != "github.com" || looksLikeFeedPath(u.Path) || segments[0] == "" {
+		return ""
+	}
+	base := "https://github.com/" + segments[0]
+	if len(segments) == 1 {
+		return base + ".atom"
+	}
+	repo := base + "/" + strings.TrimSuffix(segments[1], ".git")
+	if len(segments) > 2 {
+		switch segments[2] {
+		case "tags":
+			return repo + "/tags.atom"
+		case "commits":
+			branch := "HEAD"
+			if len(segments) > 3 {
+				branch = strings.Join(segments[3:], "/")
+			}
+			return repo + "/commits/" + branch + ".atom"
+		}
+	}
+	return repo + "/releases.atom"
+}
+
+// mediumFeedUrl maps medium.com/@user and publication pages to /feed/...
+func mediumFeedUrl(u *url.URL, segments []string) string {
+	if !hostIs(u, "medium.com") || segments[0] == "" || segments[0] == "feed" {
+		return ""
+	}
+	if strings.ToLower(u.Hostname()) != "medium.com" {
+		// Custom subdomains (name.medium.com) serve their feed at /feed
+		return "https://" + u.Host + "/feed"
+	}
+	return "https://medium.com/feed/" + segments[0]
+}
+
+// mastodonFeedUrl maps https://instance/@user to the account's RSS feed
+func mastodonFeedUrl(u *url.URL, segments []string) string {
+	if len(segments) != 1 || !strings.HasPrefix(segments[0], "@") || len(segments[0]) < 2 {
+		return ""
+	}
+	if strings.Contains(segments[0], ".") {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + "/" + segments[0] + ".rss"
+}
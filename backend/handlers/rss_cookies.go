@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// RssCookie is a cookie configured for a feed. Domain and Path default to
+// the feed URL's host and "/", so login cookies for another host (e.g. the
+// tracker's main site) can be set explicitly.
+type RssCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+var rssCookieJars sync.Map // host + cookie configuration -> http.CookieJar
+
+// rssCookieJar returns the jar used for requests to a feed's host. Cookies
+// set by the server (including during redirects) are kept for later
+// refreshes. Jars are shared by feeds on one host with the same cookie
+// configuration, and editing a feed's cookies starts a fresh session.
+func rssCookieJar(feedUrl string, profile *RssFetchProfile) http.CookieJar {
+	key := rssRequestHost(feedUrl) + "\x00" + rssCookieSeed(profile)
+	if jar, ok := rssCookieJars.Load(key); ok {
+		return jar.(http.CookieJar)
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil
+	}
+	if profile != nil {
+		seedRssCookies(jar, feedUrl, profile)
+	}
+	actual, _ := rssCookieJars.LoadOrStore(key, jar)
+	return actual.(http.CookieJar)
+}
+
+func rssCookieSeed(profile *RssFetchProfile) string {
+	if profile == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(profile.Cookie)
+	for _, c := range profile.Cookies {
+		b.WriteString("\n" + c.Domain + "|" + c.Path + "|" + c.Name + "=" + c.Value)
+	}
+	return b.String()
+}
+
+func seedRssCookies(jar http.CookieJar, feedUrl string, profile *RssFetchProfile) {
+	feed, err := url.Parse(feedUrl)
+	if err != nil || feed.Host == "" {
+		return
+	}
+	root := &url.URL{Scheme: feed.Scheme, Host: feed.Host, Path: "/"}
+
+	if header := strings.TrimSpace(profile.Cookie); header != "" {
+		parsed := (&http.Request{Header: http.Header{"Cookie": {header}}}).Cookies()
+		for _, c := range parsed {
+			c.Path = "/"
+		}
+		jar.SetCookies(root, parsed)
+	}
+	for _, c := range profile.Cookies {
+		name := strings.TrimSpace(c.Name)
+		if name == "" {
+			continue
+		}
+		target := root
+		cookie := &http.Cookie{Name: name, Value: c.Value, Path: "/"}
+		if c.Path != "" {
+			cookie.Path = c.Path
+		}
+		if domain := strings.TrimPrefix(strings.TrimSpace(c.Domain), "."); domain != "" {
+			cookie.Domain = domain
+			target = &url.URL{Scheme: feed.Scheme, Host: domain, Path: cookie.Path}
+		}
+		jar.SetCookies(target, []*http.Cookie{cookie})
+	}
+}
+
+// withCookieJar returns a copy of client that uses jar; shared clients such
+// as the proxy client are never modified.
+func withCookieJar(client *http.Client, jar http.CookieJar) *http.Client {
+	if client == nil || jar == nil {
+		return client
+	}
+	c := *client
+	c.Jar = jar
+	return &c
+}
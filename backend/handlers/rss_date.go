@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"strings"
+	"time"
+)
+
+// Layouts seen in the wild, most common first: RFC 822/1123 variants from
+// RSS 2.0, RFC 3339 from Atom and JSON Feed, then assorted sloppy forms.
+var rssDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 02 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04:05 Z",
+	"2 Jan 2006 15:04:05 -0700",
+	"02 Jan 2006 15:04:05 MST",
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+	time.ANSIC,
+	time.UnixDate,
+	"January 2, 2006",
+	"Jan 2, 2006",
+}
+
+// parseRssDate tries the known layouts and returns the zero time when none
+// of them match.
+func parseRssDate(value string) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}
+	}
+	// "Mon,  2 Jan" and trailing "(UTC)" comments appear in some feeds
+	value = strings.Join(strings.Fields(value), " ")
+	if i := strings.Index(value, " ("); i > 0 && strings.HasSuffix(value, ")") {
+		value = value[:i]
+	}
+	for _, layout := range rssDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	// Weekday names are sometimes wrong or localized; retry without them
+	if i := strings.Index(value, ", "); i > 0 && i <= 10 {
+		return parseRssDate(value[i+2:])
+	}
+	return time.Time{}
+}
+
+// normalizeRssDate returns value as RFC 3339 together with its Unix time in
+// milliseconds. Unparseable dates are returned trimmed, with a zero stamp.
+func normalizeRssDate(value string) (string, int64) {
+	t := parseRssDate(value)
+	if t.IsZero() {
+		return strings.TrimSpace(value), 0
+	}
+	return t.Format(time.RFC3339), t.UnixMilli()
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"net/url"
+	"strings"
+)
+
+// rssLinkKey normalizes an item link for duplicate detection: scheme and
+// host are lowercased, tracking parameters, fragments and trailing slashes
+// are dropped.
+func rssLinkKey(link string) string {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return ""
+	}
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Host == "" {
+		return link
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	if parsed.Scheme == "http" {
+		parsed.Scheme = "https"
+	}
+	parsed.Host = strings.TrimPrefix(strings.ToLower(parsed.Host), "www.")
+	parsed.Fragment = ""
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+	if parsed.RawQuery != "" {
+		query := parsed.Query()
+		for key := range query {
+			lower := strings.ToLower(key)
+			if strings.HasPrefix(lower, "utm_") || lower == "ref" || lower == "fbclid" || lower == "gclid" {
+				query.Del(key)
+			}
+		}
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.String()
+}
+
+// rssItemKeys returns the identities of an item: its GUID and, when
+// present, its normalized link.
+func rssItemKeys(item UnifiedRssItem) []string {
+	keys := []string{"guid:" + item.Guid}
+	if link := rssLinkKey(item.Link); link != "" {
+		keys = append(keys, "link:"+link)
+	}
+	return keys
+}
+
+// dedupeRssItems drops items sharing a GUID or link with an earlier item,
+// keeping feed order. GUIDs must already be filled in.
+func dedupeRssItems(items []UnifiedRssItem) []UnifiedRssItem {
+	seen := make(map[string]struct{}, len(items)*2)
+	out := items[:0]
+	for _, item := range items {
+		keys := rssItemKeys(item)
+		dup := false
+		for _, key := range keys {
+			if _, ok := seen[key]; ok {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		for _, key := range keys {
+			seen[key] = struct{}{}
+		}
+		out = append(out, item)
+	}
+	return out
+}
+
+// stabilizeRssGuids keeps the GUID of previously cached items that come
+// back under a new GUID but the same link, so a republished article keeps
+// its read state and is not announced as new.
+func stabilizeRssGuids(prev, next []UnifiedRssItem) {
+	if len(prev) == 0 {
+		return
+	}
+	byLink := make(map[string]string, len(prev))
+	guids := make(map[string]struct{}, len(prev))
+	for _, item := range prev {
+		guids[item.Guid] = struct{}{}
+		if link := rssLinkKey(item.Link); link != "" {
+			byLink[link] = item.Guid
+		}
+	}
+	for i := range next {
+		if _, known := guids[next[i].Guid]; known {
+			continue
+		}
+		if guid, ok := byLink[rssLinkKey(next[i].Link)]; ok {
+			next[i].Guid = guid
+		}
+	}
+}
+
+// dedupeRssTimeline removes items already present from another feed; the
+// first (newest) copy wins.
+func dedupeRssTimeline(items []RssTimelineItem) []RssTimelineItem {
+	seen := make(map[string]struct{}, len(items))
+	out := items[:0]
+	for _, item := range items {
+		link := rssLinkKey(item.Link)
+		if link == "" {
+			out = append(out, item)
+			continue
+		}
+		if _, ok := seen[link]; ok {
+			continue
+		}
+		seen[link] = struct{}{}
+		out = append(out, item)
+	}
+	return out
+}
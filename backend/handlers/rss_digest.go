@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"html"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRssDigestItems = 50
+	rssDigestTick         = time.Minute
+)
+
+// RssDigestSettings is the "rssDigest" section of the dashboard config. At
+// Time (local "HH:MM") the items published since the previous digest in
+// Feeds (all enabled feeds when empty) are sent to Channels.
+type RssDigestSettings struct {
+	Enable   bool     `json:"enable"`
+	Time     string   `json:"time"`
+	Feeds    []string `json:"feeds,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+	MaxItems int      `json:"maxItems,omitempty"`
+}
+
+// rssDigestState remembers when the last digest went out
+type rssDigestState struct {
+	LastSent int64 `json:"lastSent"` // Unix timestamp in ms
+}
+
+func rssDigestStateFile() string {
+	return filepath.Join(config.DataDir, "rss_digest.json")
+}
+
+func StartRssDigest() {
+	go func() {
+		ticker := time.NewTicker(rssDigestTick)
+		defer ticker.Stop()
+		beat := registerWorker("rss.digest", rssDigestTick)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case now := <-ticker.C:
+				beat()
+				runRssDigest(now)
+			}
+		}
+	}()
+}
+
+func loadRssDigestSettings() (RssDigestSettings, map[string]interface{}) {
+	var settings RssDigestSettings
+	var payload map[string]interface{}
+	if err := utils.ReadJSON(filepath.Join(config.DataDir, "data.json"), &payload); err != nil {
+		return settings, nil
+	}
+	if raw, ok := payload["rssDigest"]; ok {
+		data, _ := json.Marshal(raw)
+		_ = json.Unmarshal(data, &settings)
+	}
+	return settings, payload
+}
+
+func runRssDigest(now time.Time) {
+	settings, payload := loadRssDigestSettings()
+	if !settings.Enable {
+		return
+	}
+	due, ok := rssDigestDueAt(settings.Time, now)
+	if !ok || now.Before(due) {
+		return
+	}
+	var state rssDigestState
+	_ = utils.ReadJSON(rssDigestStateFile(), &state)
+	if state.LastSent >= due.UnixMilli() {
+		return
+	}
+	since := state.LastSent
+	if since == 0 {
+		since = due.Add(-24 * time.Hour).UnixMilli()
+	}
+
+	feeds := settings.Feeds
+	if len(feeds) == 0 {
+		feeds = extractRssUrls(payload)
+	}
+	limit := settings.MaxItems
+	if limit <= 0 {
+		limit = defaultRssDigestItems
+	}
+	items := collectRssDigestItems(feeds, since, limit)
+	// Mark the slot as done even when nothing is new, so a quiet day does not
+	// make the next digest cover two days
+	if err := utils.WriteJSON(rssDigestStateFile(), rssDigestState{LastSent: now.UnixMilli()}); err != nil {
+		rssLog.Error("Failed to write RSS digest state", "error", err)
+		return
+	}
+	if len(items) == 0 {
+		return
+	}
+	sendNotification(backgroundCtx, buildRssDigest(items, now), settings.Channels)
+}
+
+// rssDigestDueAt returns today's digest time in the local timezone
+func rssDigestDueAt(clock string, now time.Time) (time.Time, bool) {
+	if strings.TrimSpace(clock) == "" {
+		clock = "08:00"
+	}
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location()), true
+}
+
+// collectRssDigestItems returns cached items published after since, newest
+// first. Items without a parseable date cannot be placed and are skipped.
+func collectRssDigestItems(feeds []string, since int64, limit int) []RssTimelineItem {
+	items := make([]RssTimelineItem, 0)
+	for _, feedUrl := range feeds {
+		feedUrl = strings.TrimSpace(feedUrl)
+		var cached []UnifiedRssItem
+		if has, _, _, err := sharedWidgetCache.Get(widgetCacheKindRSS, feedUrl, &cached); !has || err != nil {
+			continue
+		}
+		var meta UnifiedFeed
+		_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSSMeta, feedUrl, &meta)
+		title := meta.Title
+		if fm := findRssFeedConfig(feedUrl); fm != nil && stringField(fm, "title") != "" {
+			title = stringField(fm, "title")
+		}
+		for _, item := range cached {
+			if item.Timestamp > since {
+				items = append(items, RssTimelineItem{UnifiedRssItem: item, FeedUrl: feedUrl, FeedTitle: title})
+			}
+		}
+	}
+	sortRssTimeline(items)
+	items = dedupeRssTimeline(items)
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
+
+// buildRssDigest groups items by feed into a plain-text and an HTML body
+func buildRssDigest(items []RssTimelineItem, now time.Time) Notification {
+	order := make([]string, 0)
+	groups := make(map[string][]RssTimelineItem)
+	for _, item := range items {
+		if _, ok := groups[item.FeedTitle]; !ok {
+			order = append(order, item.FeedTitle)
+		}
+		groups[item.FeedTitle] = append(groups[item.FeedTitle], item)
+	}
+
+	var text, rich strings.Builder
+	rich.WriteString(`<div style="font-family:sans-serif">`)
+	for _, feedTitle := range order {
+		fmt.Fprintf(&text, "%s\n", feedTitle)
+		fmt.Fprintf(&rich, "<h3>%s</h3><ul>", html.EscapeString(feedTitle))
+		for _, item := range groups[feedTitle] {
+			fmt.Fprintf(&text, "- %s\n  %s\n", item.Title, item.Link)
+			fmt.Fprintf(&rich, `<li><a href="%s">%s</a>`, html.EscapeString(item.Link), html.EscapeString(item.Title))
+			if item.ContentSnippet != "" {
+				fmt.Fprintf(&rich, "<br><small>%s</small>", html.EscapeString(truncateSnippet(item.ContentSnippet, 200)))
+			}
+			rich.WriteString("</li>")
+		}
+		text.WriteString("\n")
+		rich.WriteString("</ul>")
+	}
+	rich.WriteString("</div>")
+
+	return Notification{
+		Title:  i18n.T(notifyLocale(), "notify_rss_digest_title", now.Format("2006-01-02"), len(items)),
+		Body:   strings.TrimSpace(text.String()),
+		Html:   rich.String(),
+		Source: "rss",
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+const maxDiscoveredFeeds = 3
+
+var discoverableFeedTypes = map[string]struct{}{
+	"application/rss+xml":  {},
+	"application/atom+xml": {},
+	"application/rdf+xml":  {},
+	"application/xml":      {},
+	"text/xml":             {},
+}
+
+func looksLikeHTML(body []byte) bool {
+	head := body
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	head = bytes.ToLower(trimXMLPreamble(head))
+	return bytes.Contains(head, []byte("<!doctype html")) || bytes.Contains(head, []byte("<html"))
+}
+
+// fetchDiscoveredFeed follows the feed links advertised by an HTML page,
+// using the same client and headers that fetched the page.
+func fetchDiscoveredFeed(ctx context.Context, attempt rssAttempt, pageUrl string, page []byte) (*UnifiedFeed, error) {
+	links := discoverFeedLinks(page, pageUrl)
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no feed found on page")
+	}
+	var lastErr error
+	for _, link := range links {
+		feed, err := fetchRssFeedBody(ctx, attempt.client, link, attempt.headers)
+		if errors.Is(err, errRssNoItems) {
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rssLog.Info("RSS autodiscovery", "page", pageUrl, "feed", link)
+		feed.FeedUrl = link
+		return feed, nil
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("failed to parse feed")
+}
+
+// discoverFeedLinks returns the absolute URLs of <link rel="alternate"> feed
+// tags in document order, without duplicates.
+func discoverFeedLinks(page []byte, pageUrl string) []string {
+	base, err := url.Parse(pageUrl)
+	if err != nil {
+		return nil
+	}
+	links := make([]string, 0)
+	seen := make(map[string]struct{})
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	for len(links) < maxDiscoveredFeeds {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if token.Data == "body" {
+			break
+		}
+		if token.Data == "base" {
+			if href := attrValue(token, "href"); href != "" {
+				if ref, err := base.Parse(href); err == nil {
+					base = ref
+				}
+			}
+			continue
+		}
+		if token.Data != "link" {
+			continue
+		}
+		if !hasRelToken(attrValue(token, "rel"), "alternate") {
+			continue
+		}
+		mediaType := strings.ToLower(strings.TrimSpace(attrValue(token, "type")))
+		if i := strings.Index(mediaType, ";"); i >= 0 {
+			mediaType = strings.TrimSpace(mediaType[:i])
+		}
+		if _, ok := discoverableFeedTypes[mediaType]; !ok {
+			continue
+		}
+		href := strings.TrimSpace(attrValue(token, "href"))
+		if href == "" {
+			continue
+		}
+		ref, err := base.Parse(href)
+		if err != nil || (ref.Scheme != "http" && ref.Scheme != "https") {
+			continue
+		}
+		abs := ref.String()
+		if _, exists := seen[abs]; exists {
+			continue
+		}
+		seen[abs] = struct{}{}
+		links = append(links, abs)
+	}
+	return links
+}
+
+func attrValue(token html.Token, key string) string {
+	for _, attr := range token.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func hasRelToken(rel, want string) bool {
+	for _, part := range strings.Fields(strings.ToLower(rel)) {
+		if part == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package handlers
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultRssExportLimit = 50
+	rssExportAllID        = "all"
+)
+
+// exportRss2 is the RSS 2.0 document served by ExportRssFeed
+type exportRss2 struct {
+	XMLName xml.Name          `xml:"rss"`
+	Version string            `xml:"version,attr"`
+	Atom    string            `xml:"xmlns:atom,attr"`
+	Channel exportRss2Channel `xml:"channel"`
+}
+
+type exportRss2Channel struct {
+	Title       string           `xml:"title"`
+	Link        string           `xml:"link"`
+	Description string           `xml:"description"`
+	SelfLink    exportAtomLink   `xml:"atom:link"`
+	Generator   string           `xml:"generator"`
+	BuildDate   string           `xml:"lastBuildDate"`
+	Items       []exportRss2Item `xml:"item"`
+}
+
+type exportAtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type exportRss2Guid struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type exportRss2Enclosure struct {
+	Url    string `xml:"url,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr"`
+}
+
+type exportRss2Item struct {
+	Title       string               `xml:"title"`
+	Link        string               `xml:"link,omitempty"`
+	Guid        exportRss2Guid       `xml:"guid"`
+	PubDate     string               `xml:"pubDate,omitempty"`
+	Description string               `xml:"description,omitempty"`
+	Source      string               `xml:"source,omitempty"`
+	Category    string               `xml:"category,omitempty"`
+	Enclosure   *exportRss2Enclosure `xml:"enclosure,omitempty"`
+}
+
+// exportJsonFeed is the JSON Feed 1.1 document served by ExportRssFeed
+type exportJsonFeed struct {
+	Version     string               `json:"version"`
+	Title       string               `json:"title"`
+	HomePageUrl string               `json:"home_page_url,omitempty"`
+	FeedUrl     string               `json:"feed_url"`
+	Description string               `json:"description,omitempty"`
+	Icon        string               `json:"icon,omitempty"`
+	Items       []exportJsonFeedItem `json:"items"`
+}
+
+type exportJsonFeedItem struct {
+	ID            string                 `json:"id"`
+	Url           string                 `json:"url,omitempty"`
+	Title         string                 `json:"title,omitempty"`
+	ContentText   string                 `json:"content_text"`
+	Summary       string                 `json:"summary,omitempty"`
+	Image         string                 `json:"image,omitempty"`
+	DatePublished string                 `json:"date_published,omitempty"`
+	Tags          []string               `json:"tags,omitempty"`
+	Attachments   []exportJsonFeedAttach `json:"attachments,omitempty"`
+}
+
+type exportJsonFeedAttach struct {
+	Url         string `json:"url"`
+	MimeType    string `json:"mime_type,omitempty"`
+	SizeInBytes int64  `json:"size_in_bytes,omitempty"`
+}
+
+// rssExport is a feed, or the merged timeline, ready to be serialized
+type rssExport struct {
+	title       string
+	link        string
+	description string
+	icon        string
+	items       []RssTimelineItem
+}
+
+// ExportRssFeed serves a cached feed (by its entry id) or the merged
+// timeline ("all") as RSS 2.0 or JSON Feed, so other apps can use FlatNas
+// as a feed proxy. The format comes from ?format=rss|json or an .xml/.rss/
+// .json suffix on the id. Guests only see public feeds, as on the dashboard;
+// feed readers that cannot send headers can pass ?token=.
+func ExportRssFeed(c *gin.Context) {
+	id, format := splitRssExportID(c.Param("id"))
+	if f := strings.ToLower(strings.TrimSpace(c.Query("format"))); f != "" {
+		format = f
+	}
+	if format != "rss" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "format must be rss or json"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = defaultRssExportLimit
+	}
+	if limit > maxRssItems {
+		limit = maxRssItems
+	}
+
+	export, ok := buildRssExport(c.GetString("username"), id, strings.TrimSpace(c.Query("category")))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Feed not found"})
+		return
+	}
+	if len(export.items) > limit {
+		export.items = export.items[:limit]
+	}
+
+	selfUrl := rssExportSelfUrl(c)
+	if format == "json" {
+		data, err := json.MarshalIndent(export.jsonFeed(selfUrl), "", "  ")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "application/feed+json; charset=utf-8", data)
+		return
+	}
+	data, err := xml.MarshalIndent(export.rss2(selfUrl), "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/rss+xml; charset=utf-8", append([]byte(xml.Header), data...))
+}
+
+func splitRssExportID(raw string) (string, string) {
+	raw = strings.TrimSpace(raw)
+	for suffix, format := range map[string]string{".json": "json", ".xml": "rss", ".rss": "rss"} {
+		if strings.HasSuffix(strings.ToLower(raw), suffix) {
+			return raw[:len(raw)-len(suffix)], format
+		}
+	}
+	return raw, "rss"
+}
+
+func buildRssExport(username, id, category string) (rssExport, bool) {
+	items := collectRssTimelineItems(username, category)
+	if id == rssExportAllID {
+		sortRssTimeline(items)
+		title := "FlatNas"
+		if category != "" {
+			title += " - " + category
+		}
+		return rssExport{title: title, description: "Merged timeline of FlatNas subscriptions", items: dedupeRssTimeline(items)}, true
+	}
+
+	feedUrl, title := findRssFeedEntryByID(username, id)
+	if feedUrl == "" {
+		return rssExport{}, false
+	}
+	kept := items[:0]
+	for _, item := range items {
+		if item.FeedUrl == feedUrl {
+			kept = append(kept, item)
+		}
+	}
+	if len(kept) == 0 {
+		// Disabled, hidden from guests, or not fetched yet
+		return rssExport{}, false
+	}
+	var meta UnifiedFeed
+	_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSSMeta, feedUrl, &meta)
+	if title == "" {
+		title = meta.Title
+	}
+	return rssExport{
+		title:       title,
+		link:        meta.Link,
+		description: meta.Description,
+		icon:        kept[0].FeedIcon,
+		items:       kept,
+	}, true
+}
+
+// findRssFeedEntryByID returns the url and title of a feed entry of the
+// user's dashboard; guests look at the admin's feeds.
+func findRssFeedEntryByID(username, id string) (string, string) {
+	if username == "" {
+		username = "admin"
+	}
+	var userData map[string]interface{}
+	_ = utils.ReadJSON(resolveUserDataFile(username), &userData)
+	feeds, _ := userData["rssFeeds"].([]interface{})
+	for _, f := range feeds {
+		fm, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		entryID := stringField(fm, "id")
+		if n, ok := fm["id"].(float64); ok {
+			entryID = strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		if entryID != "" && entryID == id {
+			return strings.TrimSpace(stringField(fm, "url")), stringField(fm, "title")
+		}
+	}
+	return "", ""
+}
+
+func rssExportSelfUrl(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	// Never echo a token back into a document that may be shared
+	query := c.Request.URL.Query()
+	query.Del("token")
+	self := scheme + "://" + c.Request.Host + c.Request.URL.Path
+	if encoded := query.Encode(); encoded != "" {
+		self += "?" + encoded
+	}
+	return self
+}
+
+func rssExportText(item RssTimelineItem) string {
+	if item.Content != "" {
+		return item.Content
+	}
+	return item.ContentSnippet
+}
+
+func (e rssExport) rss2(selfUrl string) exportRss2 {
+	link := e.link
+	if link == "" {
+		link = selfUrl
+	}
+	channel := exportRss2Channel{
+		Title:       e.title,
+		Link:        link,
+		Description: e.description,
+		SelfLink:    exportAtomLink{Href: selfUrl, Rel: "self", Type: "application/rss+xml"},
+		Generator:   "FlatNas",
+		BuildDate:   time.Now().UTC().Format(time.RFC1123Z),
+		Items:       make([]exportRss2Item, 0, len(e.items)),
+	}
+	if channel.Description == "" {
+		channel.Description = e.title
+	}
+	for _, item := range e.items {
+		out := exportRss2Item{
+			Title:       item.Title,
+			Link:        item.Link,
+			Guid:        exportRss2Guid{Value: item.Guid, IsPermaLink: item.Guid == item.Link && item.Link != ""},
+			Description: rssExportText(item),
+			Source:      item.FeedTitle,
+			Category:    item.Category,
+		}
+		if item.Timestamp > 0 {
+			out.PubDate = time.UnixMilli(item.Timestamp).UTC().Format(time.RFC1123Z)
+		}
+		if item.Enclosure != nil {
+			out.Enclosure = &exportRss2Enclosure{Url: item.Enclosure.Url, Type: item.Enclosure.Type, Length: item.Enclosure.Length}
+		}
+		channel.Items = append(channel.Items, out)
+	}
+	return exportRss2{Version: "2.0", Atom: "http://www.w3.org/2005/Atom", Channel: channel}
+}
+
+func (e rssExport) jsonFeed(selfUrl string) exportJsonFeed {
+	feed := exportJsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       e.title,
+		HomePageUrl: e.link,
+		FeedUrl:     selfUrl,
+		Description: e.description,
+		Icon:        e.icon,
+		Items:       make([]exportJsonFeedItem, 0, len(e.items)),
+	}
+	for _, item := range e.items {
+		out := exportJsonFeedItem{
+			ID:          item.Guid,
+			Url:         item.Link,
+			Title:       item.Title,
+			ContentText: rssExportText(item),
+			Image:       item.Image,
+		}
+		if item.Content != "" {
+			out.Summary = item.ContentSnippet
+		}
+		if item.Timestamp > 0 {
+			out.DatePublished = time.UnixMilli(item.Timestamp).UTC().Format(time.RFC3339)
+		}
+		if item.Category != "" {
+			out.Tags = []string{item.Category}
+		}
+		if item.Enclosure != nil {
+			out.Attachments = []exportJsonFeedAttach{{Url: item.Enclosure.Url, MimeType: item.Enclosure.Type, SizeInBytes: item.Enclosure.Length}}
+		}
+		feed.Items = append(feed.Items, out)
+	}
+	return feed
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"flatnasgo-backend/config"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	rssFaviconTTL = 7 * 24 * time.Hour
+	// rssFaviconMissTTL delays another lookup for hosts without an icon
+	rssFaviconMissTTL = 24 * time.Hour
+	maxFaviconSize    = 512 << 10
+)
+
+var faviconExtensions = map[string]string{
+	"image/x-icon":             ".ico",
+	"image/vnd.microsoft.icon": ".ico",
+	"image/png":                ".png",
+	"image/gif":                ".gif",
+	"image/jpeg":               ".jpg",
+	"image/svg+xml":            ".svg",
+	"image/webp":               ".webp",
+}
+
+// resolveFeedFavicon returns a local /icon-cache URL for the icon of the
+// site behind siteUrl, or "" when none could be found. Icons are cached per
+// host, so only the first feed of a site pays for the lookup.
+func resolveFeedFavicon(ctx context.Context, siteUrl string) string {
+	site, err := url.Parse(strings.TrimSpace(siteUrl))
+	if err != nil || site.Host == "" || (site.Scheme != "http" && site.Scheme != "https") {
+		return ""
+	}
+	host := strings.ToLower(site.Host)
+	var cached string
+	if has, fresh, _, err := sharedWidgetCache.Get(widgetCacheKindRSSIcon, host, &cached); err == nil && has && fresh {
+		return cached
+	}
+
+	root := site.Scheme + "://" + site.Host + "/"
+	candidates := []string{}
+	attempt := buildRssAttempts(root, nil)[0]
+	if page, err := fetchRssBody(ctx, attempt.client, root, attempt.headers); err == nil {
+		candidates = append(candidates, discoverFaviconLinks(page, root)...)
+	}
+	candidates = append(candidates, root+"favicon.ico")
+
+	for _, candidate := range candidates {
+		if local := downloadFavicon(ctx, attempt.client, candidate, host); local != "" {
+			_ = sharedWidgetCache.Set(widgetCacheKindRSSIcon, host, local, rssFaviconTTL, "ok")
+			return local
+		}
+	}
+	_ = sharedWidgetCache.Set(widgetCacheKindRSSIcon, host, "", rssFaviconMissTTL, "error")
+	return ""
+}
+
+// discoverFaviconLinks returns icon URLs declared in the page head, plain
+// icons before touch icons.
+func discoverFaviconLinks(page []byte, pageUrl string) []string {
+	base, err := url.Parse(pageUrl)
+	if err != nil {
+		return nil
+	}
+	var icons, touchIcons []string
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	for {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt == html.EndTagToken {
+			if name, _ := tokenizer.TagName(); string(name) == "head" {
+				break
+			}
+			continue
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if token.Data != "link" {
+			continue
+		}
+		href := strings.TrimSpace(attrValue(token, "href"))
+		if href == "" || strings.HasPrefix(href, "data:") {
+			continue
+		}
+		resolved, err := base.Parse(href)
+		if err != nil {
+			continue
+		}
+		rel := attrValue(token, "rel")
+		switch {
+		case hasRelToken(rel, "icon"):
+			icons = append(icons, resolved.String())
+		case hasRelToken(rel, "apple-touch-icon"):
+			touchIcons = append(touchIcons, resolved.String())
+		}
+	}
+	return append(icons, touchIcons...)
+}
+
+// downloadFavicon stores an icon under IconCacheDir and returns its URL
+func downloadFavicon(ctx context.Context, client *http.Client, iconUrl, host string) string {
+	req, err := http.NewRequestWithContext(ctx, "GET", iconUrl, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("User-Agent", defaultRssUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFaviconSize+1))
+	if err != nil || len(data) == 0 || len(data) > maxFaviconSize {
+		return ""
+	}
+	contentType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	ext, ok := faviconExtensions[contentType]
+	if !ok {
+		// Servers often send icons as text/plain or octet-stream
+		ext, ok = faviconExtensions[http.DetectContentType(data)]
+		if !ok && bytes.HasPrefix(data, []byte{0, 0, 1, 0}) {
+			ext, ok = ".ico", true
+		}
+	}
+	if !ok {
+		return ""
+	}
+	sum := sha1.Sum([]byte(host))
+	name := "rss-" + hex.EncodeToString(sum[:8]) + ext
+	if err := os.WriteFile(filepath.Join(config.IconCacheDir, name), data, 0644); err != nil {
+		return ""
+	}
+	return "/icon-cache/" + name
+}
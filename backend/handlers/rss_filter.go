@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// RssFilterRules are include/exclude patterns matched against an item's
+// title and snippet. A pattern written as /expr/ or /expr/i is a regular
+// expression; anything else is a case-insensitive keyword.
+type RssFilterRules struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+type rssMatcher func(text string) bool
+
+type rssItemFilter struct {
+	include []rssMatcher
+	exclude []rssMatcher
+}
+
+// loadRssItemFilter combines the global "rssFilters" of the dashboard config
+// with the "filters" of the feed entry itself.
+func loadRssItemFilter(feedConfig map[string]interface{}) *rssItemFilter {
+	var payload map[string]interface{}
+	_ = utils.ReadJSON(filepath.Join(config.DataDir, "data.json"), &payload)
+	global := decodeRssFilterRules(payload["rssFilters"])
+	var feed RssFilterRules
+	if feedConfig != nil {
+		feed = decodeRssFilterRules(feedConfig["filters"])
+	}
+	return compileRssFilter(global, feed)
+}
+
+func decodeRssFilterRules(raw interface{}) RssFilterRules {
+	var rules RssFilterRules
+	if raw == nil {
+		return rules
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return rules
+	}
+	_ = json.Unmarshal(data, &rules)
+	return rules
+}
+
+func compileRssFilter(rules ...RssFilterRules) *rssItemFilter {
+	filter := &rssItemFilter{}
+	for _, r := range rules {
+		filter.include = append(filter.include, compileRssMatchers(r.Include)...)
+		filter.exclude = append(filter.exclude, compileRssMatchers(r.Exclude)...)
+	}
+	if len(filter.include) == 0 && len(filter.exclude) == 0 {
+		return nil
+	}
+	return filter
+}
+
+func compileRssMatchers(patterns []string) []rssMatcher {
+	matchers := make([]rssMatcher, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if expr, flags, ok := splitRegexLiteral(pattern); ok {
+			if strings.Contains(flags, "i") {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				rssLog.Warn("RSS filter: invalid regex", "pattern", pattern, "error", err)
+				continue
+			}
+			matchers = append(matchers, re.MatchString)
+			continue
+		}
+		keyword := strings.ToLower(pattern)
+		matchers = append(matchers, func(text string) bool {
+			return strings.Contains(strings.ToLower(text), keyword)
+		})
+	}
+	return matchers
+}
+
+// splitRegexLiteral parses "/expr/flags"
+func splitRegexLiteral(pattern string) (string, string, bool) {
+	if len(pattern) < 2 || pattern[0] != '/' {
+		return "", "", false
+	}
+	end := strings.LastIndex(pattern, "/")
+	if end <= 0 {
+		return "", "", false
+	}
+	flags := pattern[end+1:]
+	if strings.Trim(flags, "imsU") != "" {
+		return "", "", false
+	}
+	return pattern[1:end], flags, true
+}
+
+// apply keeps items that match at least one include rule (when any are
+// set) and no exclude rule.
+func (f *rssItemFilter) apply(items []UnifiedRssItem) []UnifiedRssItem {
+	if f == nil {
+		return items
+	}
+	kept := make([]UnifiedRssItem, 0, len(items))
+	for _, item := range items {
+		text := item.Title + "\n" + item.ContentSnippet
+		if len(f.include) > 0 && !anyRssMatch(f.include, text) {
+			continue
+		}
+		if anyRssMatch(f.exclude, text) {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+func anyRssMatch(matchers []rssMatcher, text string) bool {
+	for _, match := range matchers {
+		if match(text) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+const (
+	// rssHealthTTL keeps health history in the widget cache long enough to
+	// notice feeds that have been failing for weeks
+	rssHealthTTL = 90 * 24 * time.Hour
+	// rssFailingThreshold is the consecutive failure count that marks a feed failing
+	rssFailingThreshold = 3
+	// rssStaleAfter marks feeds without a successful fetch for this long
+	rssStaleAfter = 7 * 24 * time.Hour
+)
+
+// RssFeedHealth holds fetch statistics for one feed
+type RssFeedHealth struct {
+	Url                 string `json:"url"`
+	Status              string `json:"status"`      // "ok", "failing", "stale" or "unknown"
+	LastSuccess         int64  `json:"lastSuccess"` // Unix timestamp in ms
+	LastError           string `json:"lastError,omitempty"`
+	LastErrorAt         int64  `json:"lastErrorAt,omitempty"` // Unix timestamp in ms
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	AvgLatency          int64  `json:"avgLatency"` // Milliseconds, over successful fetches
+	ItemCount           int    `json:"itemCount"`
+	Fetches             int64  `json:"fetches"`
+	Failures            int64  `json:"failures"`
+}
+
+// rssHealthTracker serializes updates; entries live in the widget cache so
+// they survive restarts.
+type rssHealthTracker struct {
+	mu sync.Mutex
+}
+
+var rssHealth = &rssHealthTracker{}
+
+func BindRssHealthHandlers(server *socketio.Server) {
+	bindEvent(server, "rss:health", func(s socketio.Conn, msg interface{}) {
+		s.Emit("rss:healthData", map[string]interface{}{
+			"feeds": rssHealth.report(time.Now()),
+		})
+	})
+}
+
+// record updates the statistics after a fetch that started at start
+func (h *rssHealthTracker) record(feedUrl string, start time.Time, feed *UnifiedFeed, err error) {
+	if feedUrl == "" {
+		return
+	}
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entry := RssFeedHealth{Url: feedUrl}
+	_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSSHealth, feedUrl, &entry)
+	entry.Fetches++
+	if err != nil && !errors.Is(err, errRssNotModified) {
+		entry.Failures++
+		entry.ConsecutiveFailures++
+		entry.LastError = err.Error()
+		entry.LastErrorAt = now.UnixMilli()
+	} else {
+		entry.ConsecutiveFailures = 0
+		entry.LastSuccess = now.UnixMilli()
+		if feed != nil {
+			entry.ItemCount = len(feed.Items)
+		}
+		successes := entry.Fetches - entry.Failures
+		latency := now.Sub(start).Milliseconds()
+		entry.AvgLatency += (latency - entry.AvgLatency) / successes
+	}
+	_ = sharedWidgetCache.Set(widgetCacheKindRSSHealth, feedUrl, entry, rssHealthTTL, "ok")
+}
+
+// report returns the health of every configured feed, worst first
+func (h *rssHealthTracker) report(now time.Time) []RssFeedHealth {
+	seen := make(map[string]struct{})
+	list := make([]RssFeedHealth, 0)
+	for _, fm := range loadRssFeedConfigs() {
+		feedUrl, _ := fm["url"].(string)
+		feedUrl = strings.TrimSpace(feedUrl)
+		if feedUrl == "" {
+			continue
+		}
+		if _, exists := seen[feedUrl]; exists {
+			continue
+		}
+		seen[feedUrl] = struct{}{}
+		entry := RssFeedHealth{Url: feedUrl}
+		_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSSHealth, feedUrl, &entry)
+		entry.Status = rssHealthStatus(entry, now)
+		list = append(list, entry)
+	}
+	rank := map[string]int{"failing": 0, "stale": 1, "unknown": 2, "ok": 3}
+	sort.SliceStable(list, func(i, j int) bool {
+		if rank[list[i].Status] != rank[list[j].Status] {
+			return rank[list[i].Status] < rank[list[j].Status]
+		}
+		return list[i].Url < list[j].Url
+	})
+	return list
+}
+
+func rssHealthStatus(entry RssFeedHealth, now time.Time) string {
+	if entry.Fetches == 0 {
+		return "unknown"
+	}
+	if entry.ConsecutiveFailures >= rssFailingThreshold {
+		return "failing"
+	}
+	if entry.LastSuccess == 0 || now.UnixMilli()-entry.LastSuccess > rssStaleAfter.Milliseconds() {
+		return "stale"
+	}
+	return "ok"
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON Feed 1.0/1.1 Structures (https://www.jsonfeed.org/version/1.1/)
+type JsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageUrl string         `json:"home_page_url"`
+	FeedUrl     string         `json:"feed_url"`
+	Description string         `json:"description"`
+	Icon        string         `json:"icon"`
+	Favicon     string         `json:"favicon"`
+	NextUrl     string         `json:"next_url"`
+	Items       []JsonFeedItem `json:"items"`
+}
+
+type JsonFeedItem struct {
+	ID            json.RawMessage  `json:"id"`
+	Url           string           `json:"url"`
+	ExternalUrl   string           `json:"external_url"`
+	Title         string           `json:"title"`
+	ContentHtml   string           `json:"content_html"`
+	ContentText   string           `json:"content_text"`
+	Summary       string           `json:"summary"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Image         string           `json:"image"`
+	BannerImage   string           `json:"banner_image"`
+	Attachments   []JsonFeedAttach `json:"attachments"`
+}
+
+type JsonFeedAttach struct {
+	Url               string  `json:"url"`
+	MimeType          string  `json:"mime_type"`
+	SizeInBytes       int64   `json:"size_in_bytes"`
+	DurationInSeconds float64 `json:"duration_in_seconds"`
+}
+
+func jsonFeed(jf JsonFeed) (*UnifiedFeed, error) {
+	if !strings.HasPrefix(jf.Version, "https://jsonfeed.org/version/") {
+		return nil, fmt.Errorf("unknown JSON Feed version %q", jf.Version)
+	}
+	if len(jf.Items) == 0 {
+		return nil, errRssNoItems
+	}
+	items := make([]UnifiedRssItem, 0, len(jf.Items))
+	for _, item := range jf.Items {
+		desc := cleanDescription(item.Summary)
+		if desc == "" {
+			desc = cleanDescription(item.ContentText)
+		}
+		if desc == "" {
+			desc = cleanDescription(item.ContentHtml)
+		}
+		link := strings.TrimSpace(item.Url)
+		if link == "" {
+			link = strings.TrimSpace(item.ExternalUrl)
+		}
+		pubDate := item.DatePublished
+		if pubDate == "" {
+			pubDate = item.DateModified
+		}
+		items = append(items, UnifiedRssItem{
+			Guid:           jsonFeedItemID(item.ID),
+			Title:          item.Title,
+			Link:           link,
+			PubDate:        pubDate,
+			ContentSnippet: desc,
+			Image:          pickJsonFeedImage(item),
+			Enclosure:      pickJsonFeedEnclosure(item.Attachments),
+		})
+	}
+	icon := strings.TrimSpace(jf.Icon)
+	if icon == "" {
+		icon = strings.TrimSpace(jf.Favicon)
+	}
+	return &UnifiedFeed{
+		Title:       strings.TrimSpace(jf.Title),
+		Description: cleanDescription(strings.TrimSpace(jf.Description)),
+		Link:        strings.TrimSpace(jf.HomePageUrl),
+		Icon:        icon,
+		Type:        "json",
+		ItemCount:   len(items),
+		Items:       items,
+		nextUrl:     strings.TrimSpace(jf.NextUrl),
+	}, nil
+}
+
+func pickJsonFeedEnclosure(attachments []JsonFeedAttach) *RssEnclosure {
+	for _, att := range attachments {
+		attUrl := strings.TrimSpace(att.Url)
+		if attUrl == "" {
+			continue
+		}
+		enc := &RssEnclosure{
+			Url:    attUrl,
+			Type:   strings.TrimSpace(att.MimeType),
+			Length: att.SizeInBytes,
+		}
+		if att.DurationInSeconds > 0 {
+			enc.Duration = strconv.FormatInt(int64(att.DurationInSeconds), 10)
+		}
+		return enc
+	}
+	return nil
+}
+
+func pickJsonFeedImage(item JsonFeedItem) string {
+	if img := strings.TrimSpace(item.Image); img != "" {
+		return img
+	}
+	if img := strings.TrimSpace(item.BannerImage); img != "" {
+		return img
+	}
+	return firstInlineImage(item.ContentHtml)
+}
+
+// jsonFeedItemID accepts the spec's string ids as well as numeric ones
+func jsonFeedItemID(raw json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return strings.TrimSpace(id)
+	}
+	var num json.Number
+	if err := json.Unmarshal(raw, &num); err == nil {
+		return num.String()
+	}
+	return ""
+}
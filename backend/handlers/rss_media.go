@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// pickItemImage chooses a preview image for an item: an explicit Media RSS
+// thumbnail first, then image media:content, then the first <img> found in
+// the item's HTML.
+func pickItemImage(media MediaRss, htmlFields ...string) string {
+	thumbs := media.MediaThumbnails
+	contents := media.MediaContents
+	for _, group := range media.MediaGroups {
+		thumbs = append(thumbs, group.Thumbnails...)
+		contents = append(contents, group.Contents...)
+	}
+	for _, content := range contents {
+		thumbs = append(thumbs, content.Thumbnails...)
+	}
+	for _, thumb := range thumbs {
+		if u := strings.TrimSpace(thumb.Url); u != "" {
+			return u
+		}
+	}
+	for _, content := range contents {
+		u := strings.TrimSpace(content.Url)
+		if u == "" {
+			continue
+		}
+		if content.Medium == "image" || strings.HasPrefix(content.Type, "image/") {
+			return u
+		}
+	}
+	for _, field := range htmlFields {
+		if img := firstInlineImage(field); img != "" {
+			return img
+		}
+	}
+	return ""
+}
+
+// firstInlineImage returns the src of the first <img> in an HTML fragment,
+// skipping data URIs and tracking pixels.
+func firstInlineImage(content string) string {
+	if !strings.Contains(content, "<img") && !strings.Contains(content, "<IMG") {
+		return ""
+	}
+	tokenizer := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken {
+			return ""
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if token.Data != "img" {
+			continue
+		}
+		src := strings.TrimSpace(attrValue(token, "src"))
+		if src == "" || strings.HasPrefix(src, "data:") {
+			continue
+		}
+		if attrValue(token, "width") == "1" && attrValue(token, "height") == "1" {
+			continue
+		}
+		return src
+	}
+}
+
+// resolveItemUrl makes ref absolute relative to the item link when possible
+func resolveItemUrl(link, ref string) string {
+	if ref == "" || strings.Contains(ref, "://") {
+		return ref
+	}
+	base, err := url.Parse(link)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return ref
+	}
+	resolved, err := base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return resolved.String()
+}
+
+// mediaDescription returns the first media:group description, as used by
+// YouTube feeds in place of an Atom summary.
+func (m MediaRss) mediaDescription() string {
+	for _, group := range m.MediaGroups {
+		if d := strings.TrimSpace(group.Description); d != "" {
+			return d
+		}
+	}
+	return ""
+}
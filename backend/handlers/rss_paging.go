@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+)
+
+// maxRssPageDepth bounds the per-feed "pageDepth" setting
+const maxRssPageDepth = 10
+
+func rssFeedPageDepth(fm map[string]interface{}) int {
+	depth, _ := fm["pageDepth"].(float64)
+	if depth < 1 {
+		return 1
+	}
+	if depth > maxRssPageDepth {
+		return maxRssPageDepth
+	}
+	return int(depth)
+}
+
+// followRssPages appends the items of up to depth-1 further pages linked
+// with rel="next" (RFC 5005) or JSON Feed next_url. A failing page ends
+// paging quietly; the pages read so far are kept.
+func followRssPages(ctx context.Context, attempt rssAttempt, feedUrl string, feed *UnifiedFeed, depth int) {
+	next := feed.nextUrl
+	visited := map[string]struct{}{feedUrl: {}}
+	for page := 1; page < depth && next != "" && len(feed.Items) < maxRssItems; page++ {
+		next = resolveItemUrl(feedUrl, next)
+		if _, seen := visited[next]; seen {
+			break
+		}
+		visited[next] = struct{}{}
+		more, err := fetchRssFeedBody(ctx, attempt.client, next, attempt.headers)
+		if err != nil {
+			if !errors.Is(err, errRssNoItems) {
+				rssLog.Warn("RSS paging stopped", "feed", redactRssUrl(feedUrl), "page", page+1, "error", err)
+			}
+			break
+		}
+		feed.Items = append(feed.Items, more.Items...)
+		next = more.nextUrl
+	}
+	feed.nextUrl = ""
+	if len(visited) > 1 {
+		feed.Items = dedupeRssItems(feed.Items)
+		if len(feed.Items) > maxRssItems {
+			feed.Items = feed.Items[:maxRssItems]
+		}
+		feed.ItemCount = len(feed.Items)
+	}
+}
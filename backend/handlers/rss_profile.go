@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultRssUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// RssFetchProfile holds per-feed request settings, stored as "fetchProfile"
+// on the feed entry in the dashboard config
+type RssFetchProfile struct {
+	Headers   map[string]string `json:"headers,omitempty"`
+	Username  string            `json:"username,omitempty"`
+	Password  string            `json:"password,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty"`
+	Cookie    string            `json:"cookie,omitempty"`  // Cookie header value, scoped to the feed host
+	Cookies   []RssCookie       `json:"cookies,omitempty"` // Cookies with an explicit domain or path
+}
+
+func (p *RssFetchProfile) isEmpty() bool {
+	return len(p.Headers) == 0 && p.Username == "" && p.Password == "" && p.UserAgent == "" && p.Cookie == "" && len(p.Cookies) == 0
+}
+
+// loadRssFeedConfigs returns every feed entry from the single-user data file
+// and the per-user files, in that order.
+func loadRssFeedConfigs() []map[string]interface{} {
+	files := []string{filepath.Join(config.DataDir, "data.json")}
+	if names, err := utils.ListJSON(config.UsersDir); err == nil {
+		for _, name := range names {
+			files = append(files, filepath.Join(config.UsersDir, name))
+		}
+	}
+	feeds := make([]map[string]interface{}, 0)
+	for _, file := range files {
+		var payload map[string]interface{}
+		if err := utils.ReadJSON(file, &payload); err != nil {
+			continue
+		}
+		list, _ := payload["rssFeeds"].([]interface{})
+		for _, feed := range list {
+			if fm, ok := feed.(map[string]interface{}); ok {
+				feeds = append(feeds, fm)
+			}
+		}
+	}
+	return feeds
+}
+
+func findRssFeedConfig(feedUrl string) map[string]interface{} {
+	feedUrl = strings.TrimSpace(feedUrl)
+	for _, fm := range loadRssFeedConfigs() {
+		if u, _ := fm["url"].(string); strings.TrimSpace(u) == feedUrl {
+			return fm
+		}
+	}
+	return nil
+}
+
+func rssFetchProfileFromConfig(fm map[string]interface{}) *RssFetchProfile {
+	if fm == nil || fm["fetchProfile"] == nil {
+		return nil
+	}
+	raw, err := json.Marshal(fm["fetchProfile"])
+	if err != nil {
+		return nil
+	}
+	var profile RssFetchProfile
+	if err := json.Unmarshal(raw, &profile); err != nil || profile.isEmpty() {
+		return nil
+	}
+	return &profile
+}
+
+// buildProfileRssAttempts replaces the browser UA rotation with the feed's
+// own settings; the proxy is still tried as a fallback. Configured cookies
+// are carried by jar rather than a fixed header so redirects keep them.
+func buildProfileRssAttempts(referer string, profile *RssFetchProfile, jar http.CookieJar) []rssAttempt {
+	userAgent := strings.TrimSpace(profile.UserAgent)
+	if userAgent == "" {
+		userAgent = defaultRssUserAgent
+	}
+	headers := buildRssHeaders(referer, userAgent)
+	if profile.Username != "" || profile.Password != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(profile.Username + ":" + profile.Password))
+		headers["Authorization"] = "Basic " + cred
+	}
+	for k, v := range profile.Headers {
+		k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+		if k == "" || k == "Host" || k == "Content-Length" || k == "Cookie" {
+			continue
+		}
+		headers[k] = v
+	}
+
+	attempts := []rssAttempt{
+		{client: &http.Client{Timeout: 10 * time.Second, Jar: jar, Transport: rssDirectTransport}, headers: headers},
+	}
+	proxyURL, err := getProxyURL()
+	if err == nil && proxyURL != nil {
+		if proxyClient, err := buildProxyClient(); err == nil {
+			attempts = append(attempts, rssAttempt{client: withCookieJar(proxyClient, jar), headers: headers, viaProxy: true})
+		}
+	}
+	return attempts
+}
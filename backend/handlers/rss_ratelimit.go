@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rssHostInterval is the minimum spacing of requests to one host
+	rssHostInterval = 500 * time.Millisecond
+	// rssMaxRetries is the number of retries after a 429 or 5xx response
+	rssMaxRetries = 3
+	// rssBackoffBase is the first retry delay; it doubles on every retry
+	rssBackoffBase = time.Second
+	// rssMaxRetryAfter caps the delay a server can ask for via Retry-After
+	rssMaxRetryAfter = 30 * time.Second
+)
+
+// rssHTTPError is a non-200, non-304 response from a feed host
+type rssHTTPError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *rssHTTPError) Error() string {
+	return fmt.Sprintf("HTTP status %d", e.StatusCode)
+}
+
+func (e *rssHTTPError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// rssHostLimiter hands out request slots per host so that feeds, article
+// pages and discovery lookups on the same site are spread out in time.
+type rssHostLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]time.Time // host -> earliest time of the next request
+}
+
+var rssLimiter = &rssHostLimiter{hosts: make(map[string]time.Time)}
+
+// wait blocks until the host may be contacted again or ctx is done
+func (l *rssHostLimiter) wait(ctx context.Context, host string) error {
+	if host == "" {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	slot := l.hosts[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	l.hosts[host] = slot.Add(rssHostInterval)
+	l.mu.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hold pushes the next slot of host out by d, e.g. after a 429
+func (l *rssHostLimiter) hold(host string, d time.Duration) {
+	if host == "" || d <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := time.Now().Add(d)
+	if l.hosts[host].Before(until) {
+		l.hosts[host] = until
+	}
+}
+
+func rssRequestHost(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Host)
+}
+
+// rssBackoff returns the delay before retry n (0-based): exponential with
+// up to 50% jitter, or the server's Retry-After when it asks for longer.
+func rssBackoff(n int, retryAfter time.Duration) time.Duration {
+	delay := rssBackoffBase << uint(n)
+	delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = time.Until(t)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > rssMaxRetryAfter {
+		return rssMaxRetryAfter
+	}
+	return d
+}
@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	// rssArticleTTL is long because published articles rarely change
+	rssArticleTTL = 24 * time.Hour
+	// maxFullContentItems bounds how many items per refresh are extracted
+	// for feeds with "fullContent" enabled
+	maxFullContentItems = 10
+	// fullContentWorkers is the number of articles fetched in parallel
+	fullContentWorkers = 4
+	// maxArticleLength bounds the extracted text kept per article
+	maxArticleLength = 20000
+	// minArticleParagraph is the text length below which a <p> is ignored
+	minArticleParagraph = 25
+)
+
+// RssArticle is the readable text of an item's web page
+type RssArticle struct {
+	Url     string `json:"url"`
+	Title   string `json:"title"`
+	Image   string `json:"image,omitempty"`
+	Content string `json:"content"` // Plain text, paragraphs separated by blank lines
+}
+
+var (
+	articlePositiveHint = regexp.MustCompile(`(?i)article|body|content|entry|main|page|post|story|text`)
+	articleNegativeHint = regexp.MustCompile(`(?i)banner|comment|footer|footnote|header|menu|meta|nav|related|share|sidebar|social|sponsor|widget|promo|\bads?\b`)
+)
+
+// Elements that never hold article text
+var skippedArticleElements = map[string]struct{}{
+	"script": {}, "style": {}, "noscript": {}, "iframe": {}, "form": {},
+	"nav": {}, "aside": {}, "footer": {}, "header": {}, "svg": {}, "button": {},
+}
+
+// Elements whose text is emitted as its own paragraph
+var articleBlockElements = map[string]struct{}{
+	"p": {}, "pre": {}, "blockquote": {}, "li": {},
+	"h2": {}, "h3": {}, "h4": {}, "h5": {}, "h6": {},
+}
+
+func BindRssArticleHandlers(server *socketio.Server) {
+	bindEvent(server, "rss:article", func(s socketio.Conn, msg interface{}) {
+		m, _ := msg.(map[string]interface{})
+		link := strings.TrimSpace(stringField(m, "link"))
+		if link == "" {
+			s.Emit("rss:error", map[string]interface{}{"error": "link is required"})
+			return
+		}
+		feedUrl := parseRssUrl(msg)
+		article, err := loadRssArticle(fetchCtx, link, rssFetchProfileFromConfig(findRssFeedConfig(feedUrl)))
+		if err != nil {
+			s.Emit("rss:error", map[string]interface{}{"url": feedUrl, "link": link, "error": err.Error()})
+			return
+		}
+		s.Emit("rss:articleData", map[string]interface{}{
+			"url":  feedUrl,
+			"link": link,
+			"data": article,
+		})
+	})
+}
+
+// loadRssArticle returns the cached extraction of link, fetching and
+// extracting the page on a miss.
+func loadRssArticle(ctx context.Context, link string, profile *RssFetchProfile) (*RssArticle, error) {
+	var cached RssArticle
+	hasCache, isFresh, _, cacheErr := sharedWidgetCache.Get(widgetCacheKindRSSArticle, link, &cached)
+	if cacheErr == nil && hasCache && isFresh {
+		return &cached, nil
+	}
+
+	var lastErr error
+	for _, attempt := range buildRssAttempts(link, profile) {
+		body, err := fetchRssBody(ctx, attempt.client, link, attempt.headers)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		article, err := extractArticle(body, link)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		_ = sharedWidgetCache.Set(widgetCacheKindRSSArticle, link, article, rssArticleTTL, "ok")
+		return article, nil
+	}
+	if cacheErr == nil && hasCache {
+		return &cached, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("failed to extract article")
+	}
+	return nil, lastErr
+}
+
+// attachFullContent fills Content for the newest items of a feed that opted
+// into full-text mode. Short summaries are replaced by the article excerpt.
+func attachFullContent(ctx context.Context, items []UnifiedRssItem, profile *RssFetchProfile) {
+	limit := len(items)
+	if limit > maxFullContentItems {
+		limit = maxFullContentItems
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < fullContentWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				article, err := loadRssArticle(ctx, items[i].Link, profile)
+				if err != nil {
+					continue
+				}
+				items[i].Content = article.Content
+				if len([]rune(items[i].ContentSnippet)) < minArticleParagraph*4 {
+					items[i].ContentSnippet = truncateSnippet(collapseWhitespace(article.Content), maxRssSnippetLength)
+				}
+				if items[i].Image == "" {
+					items[i].Image = article.Image
+				}
+			}
+		}()
+	}
+queue:
+	for i := 0; i < limit; i++ {
+		if !strings.HasPrefix(items[i].Link, "http") {
+			continue
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break queue
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func feedWantsFullContent(fm map[string]interface{}) bool {
+	enabled, _ := fm["fullContent"].(bool)
+	return enabled
+}
+
+// extractArticle is a small readability-style extractor: paragraphs award
+// points to their parent and grandparent, class and id names nudge the
+// score, and the text of the best scoring container is returned.
+func extractArticle(body []byte, pageUrl string) (*RssArticle, error) {
+	encoding, _, _ := charset.DetermineEncoding(body, "")
+	utf8Body, err := encoding.NewDecoder().Bytes(body)
+	if err != nil {
+		utf8Body = body
+	}
+	doc, err := html.Parse(bytes.NewReader(utf8Body))
+	if err != nil {
+		return nil, err
+	}
+
+	article := &RssArticle{Url: pageUrl}
+	scores := make(map[*html.Node]float64)
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if _, skip := skippedArticleElements[n.Data]; skip {
+				return
+			}
+			switch n.Data {
+			case "title":
+				if article.Title == "" {
+					article.Title = collapseWhitespace(nodeText(n))
+				}
+			case "meta":
+				prop := attrOf(n, "property")
+				if prop == "" {
+					prop = attrOf(n, "name")
+				}
+				switch prop {
+				case "og:title":
+					article.Title = strings.TrimSpace(attrOf(n, "content"))
+				case "og:image":
+					article.Image = resolveItemUrl(pageUrl, strings.TrimSpace(attrOf(n, "content")))
+				}
+			case "p", "pre":
+				scoreArticleParagraph(n, scores)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	var best *html.Node
+	bestScore := 0.0
+	for n, score := range scores {
+		score *= 1 - linkDensity(n)
+		if score > bestScore {
+			best, bestScore = n, score
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no article content found")
+	}
+
+	paragraphs := make([]string, 0)
+	collectArticleText(best, &paragraphs)
+	article.Content = truncateSnippet(strings.Join(paragraphs, "\n\n"), maxArticleLength)
+	if article.Content == "" {
+		return nil, fmt.Errorf("no article content found")
+	}
+	return article, nil
+}
+
+func scoreArticleParagraph(p *html.Node, scores map[*html.Node]float64) {
+	text := collapseWhitespace(nodeText(p))
+	if len([]rune(text)) < minArticleParagraph {
+		return
+	}
+	score := 1 + float64(strings.Count(text, ",")+strings.Count(text, "，"))
+	if bonus := float64(len([]rune(text))) / 100; bonus < 3 {
+		score += bonus
+	} else {
+		score += 3
+	}
+	parent := p.Parent
+	if parent == nil || parent.Type != html.ElementNode {
+		return
+	}
+	if _, ok := scores[parent]; !ok {
+		scores[parent] = classWeight(parent)
+	}
+	scores[parent] += score
+	if grand := parent.Parent; grand != nil && grand.Type == html.ElementNode {
+		if _, ok := scores[grand]; !ok {
+			scores[grand] = classWeight(grand)
+		}
+		scores[grand] += score / 2
+	}
+}
+
+func classWeight(n *html.Node) float64 {
+	weight := 0.0
+	if n.Data == "article" || n.Data == "main" {
+		weight += 25
+	}
+	for _, hint := range []string{attrOf(n, "class"), attrOf(n, "id")} {
+		if hint == "" {
+			continue
+		}
+		if articleNegativeHint.MatchString(hint) {
+			weight -= 25
+		}
+		if articlePositiveHint.MatchString(hint) {
+			weight += 25
+		}
+	}
+	return weight
+}
+
+// linkDensity is the share of a node's text that sits inside links
+func linkDensity(n *html.Node) float64 {
+	total := len(nodeText(n))
+	if total == 0 {
+		return 0
+	}
+	linked := 0
+	var walk func(*html.Node)
+	walk = func(c *html.Node) {
+		if c.Type == html.ElementNode && c.Data == "a" {
+			linked += len(nodeText(c))
+			return
+		}
+		for child := c.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return float64(linked) / float64(total)
+}
+
+func collectArticleText(n *html.Node, out *[]string) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if _, skip := skippedArticleElements[c.Data]; skip {
+			continue
+		}
+		if articleNegativeHint.MatchString(attrOf(c, "class") + " " + attrOf(c, "id")) {
+			continue
+		}
+		if _, block := articleBlockElements[c.Data]; block {
+			if text := collapseWhitespace(nodeText(c)); text != "" {
+				*out = append(*out, text)
+			}
+			continue
+		}
+		collectArticleText(c, out)
+	}
+}
+
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(c *html.Node) {
+		if c.Type == html.TextNode {
+			b.WriteString(c.Data)
+			return
+		}
+		if c.Type == html.ElementNode {
+			if _, skip := skippedSnippetElements[c.Data]; skip {
+				return
+			}
+			if c.Data == "br" {
+				b.WriteByte(' ')
+			}
+		}
+		for child := c.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+func attrOf(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// defaultRssSnippetLength is used when a client does not ask for a length
+	defaultRssSnippetLength = 100
+	// maxRssSnippetLength bounds the text kept in the cache per item
+	maxRssSnippetLength = 1000
+)
+
+// Elements whose text is never part of a readable snippet
+var skippedSnippetElements = map[string]struct{}{
+	"script":   {},
+	"style":    {},
+	"noscript": {},
+	"iframe":   {},
+	"object":   {},
+	"embed":    {},
+	"svg":      {},
+	"template": {},
+	"head":     {},
+}
+
+// Elements that separate words when their markup is removed
+var snippetBreakElements = map[string]struct{}{
+	"br": {}, "p": {}, "div": {}, "li": {}, "tr": {}, "td": {}, "th": {},
+	"h1": {}, "h2": {}, "h3": {}, "h4": {}, "h5": {}, "h6": {},
+	"blockquote": {}, "pre": {}, "hr": {}, "section": {}, "article": {},
+}
+
+// cleanDescription turns an HTML fragment into plain text suitable for
+// ContentSnippet, keeping at most maxRssSnippetLength runes.
+func cleanDescription(content string) string {
+	content = strings.TrimSpace(content)
+	// Remove <![CDATA[ ... ]]> wrapper
+	if strings.HasPrefix(content, "<![CDATA[") && strings.HasSuffix(content, "]]>") {
+		content = content[9 : len(content)-3]
+	}
+	return truncateSnippet(htmlToText(content), maxRssSnippetLength)
+}
+
+// htmlToText strips tags, drops script/style content, decodes entities and
+// collapses whitespace.
+func htmlToText(content string) string {
+	if content == "" {
+		return ""
+	}
+	var b strings.Builder
+	skipDepth := 0
+	tokenizer := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tt := tokenizer.Next()
+		switch tt {
+		case html.ErrorToken:
+			return collapseWhitespace(b.String())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			if _, ok := skippedSnippetElements[tag]; ok && tt == html.StartTagToken {
+				skipDepth++
+				continue
+			}
+			if _, ok := snippetBreakElements[tag]; ok {
+				b.WriteByte(' ')
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			if _, ok := skippedSnippetElements[tag]; ok {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+				continue
+			}
+			if _, ok := snippetBreakElements[tag]; ok {
+				b.WriteByte(' ')
+			}
+		case html.TextToken:
+			if skipDepth == 0 {
+				b.WriteString(html.UnescapeString(string(tokenizer.Raw())))
+			}
+		}
+	}
+}
+
+func collapseWhitespace(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == ' ' {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func truncateSnippet(s string, limit int) string {
+	if limit <= 0 {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) > limit {
+		return strings.TrimRightFunc(string(runes[:limit]), unicode.IsSpace) + "..."
+	}
+	return s
+}
+
+// limitRssSnippets returns items with snippets cut to the requested length;
+// the cached slice is never modified.
+func limitRssSnippets(items []UnifiedRssItem, limit int) []UnifiedRssItem {
+	if limit <= 0 || limit >= maxRssSnippetLength {
+		return items
+	}
+	out := make([]UnifiedRssItem, len(items))
+	copy(out, items)
+	for i := range out {
+		out[i].ContentSnippet = truncateSnippet(out[i].ContentSnippet, limit)
+	}
+	return out
+}
+
+// parseRssSnippetLength reads the optional "snippetLength" field of a request
+func parseRssSnippetLength(msg interface{}) int {
+	m, ok := msg.(map[string]interface{})
+	if !ok {
+		return defaultRssSnippetLength
+	}
+	if n, ok := m["snippetLength"].(float64); ok && n > 0 {
+		if n > maxRssSnippetLength {
+			return maxRssSnippetLength
+		}
+		return int(n)
+	}
+	return defaultRssSnippetLength
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+const (
+	rssSchedulerTick      = time.Minute
+	minRssRefreshInterval = 5 * time.Minute
+	maxRssRefreshInterval = 24 * time.Hour
+)
+
+var defaultRssRefreshEvery = rssCacheTTL
+
+// RssScheduleEntry is the refresh state of one configured feed
+type RssScheduleEntry struct {
+	Url           string `json:"url"`
+	Interval      int64  `json:"interval"`      // Seconds
+	LastRefreshed int64  `json:"lastRefreshed"` // Unix timestamp in ms
+	NextRefresh   int64  `json:"nextRefresh"`   // Unix timestamp in ms
+	Status        string `json:"status"`
+	lastAttempt   int64
+}
+
+type rssFeedSchedule struct {
+	url      string
+	interval time.Duration
+}
+
+// RssScheduler refreshes each configured feed on its own interval
+type RssScheduler struct {
+	mu      sync.Mutex
+	entries map[string]*RssScheduleEntry
+}
+
+var rssScheduler = &RssScheduler{
+	entries: make(map[string]*RssScheduleEntry),
+}
+
+func BindRssSchedulerHandlers(server *socketio.Server) {
+	bindEvent(server, "rss:status", func(s socketio.Conn, msg interface{}) {
+		s.Emit("rss:statusData", map[string]interface{}{
+			"feeds": rssScheduler.snapshot(),
+		})
+	})
+}
+
+func StartRssScheduler() {
+	go func() {
+		// Leave the first pass to the startup warmup
+		ticker := time.NewTicker(rssSchedulerTick)
+		defer ticker.Stop()
+		beat := registerWorker("rss.scheduler", rssSchedulerTick)
+		for {
+			select {
+			case <-ticker.C:
+			case <-backgroundCtx.Done():
+				return
+			}
+			beat()
+			rssScheduler.tick()
+		}
+	}()
+}
+
+func (rs *RssScheduler) tick() {
+	var payload map[string]interface{}
+	if err := utils.ReadJSON(filepath.Join(config.DataDir, "data.json"), &payload); err != nil {
+		return
+	}
+	rs.sync(extractRssSchedules(payload))
+	for _, urlStr := range rs.due(time.Now()) {
+		if backgroundCtx.Err() != nil {
+			return
+		}
+		refreshRss(socketServer, urlStr)
+	}
+}
+
+// sync reconciles the tracked feeds with the current configuration
+func (rs *RssScheduler) sync(schedules []rssFeedSchedule) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	active := make(map[string]struct{}, len(schedules))
+	for _, sched := range schedules {
+		active[sched.url] = struct{}{}
+		entry := rs.entries[sched.url]
+		if entry == nil {
+			entry = &RssScheduleEntry{Url: sched.url, Status: "pending"}
+			var items []UnifiedRssItem
+			if has, _, item, _ := sharedWidgetCache.Get(widgetCacheKindRSS, sched.url, &items); has && item != nil {
+				entry.LastRefreshed = item.UpdatedAt
+				entry.Status = item.SourceStatus
+			}
+			rs.entries[sched.url] = entry
+		}
+		entry.Interval = int64(sched.interval.Seconds())
+		// Failed feeds are retried on the next interval rather than every tick
+		base := entry.LastRefreshed
+		if entry.lastAttempt > base {
+			base = entry.lastAttempt
+		}
+		entry.NextRefresh = base + sched.interval.Milliseconds()
+	}
+	for urlStr := range rs.entries {
+		if _, ok := active[urlStr]; !ok {
+			delete(rs.entries, urlStr)
+		}
+	}
+}
+
+func (rs *RssScheduler) due(now time.Time) []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	nowMs := now.UnixMilli()
+	urls := make([]string, 0)
+	for urlStr, entry := range rs.entries {
+		if entry.NextRefresh <= nowMs {
+			urls = append(urls, urlStr)
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// markRefreshed records the outcome of any refresh, scheduled or on demand,
+// and notifies clients so they can show when each feed was last updated.
+func (rs *RssScheduler) markRefreshed(urlStr, status string) {
+	now := time.Now().UnixMilli()
+	rs.mu.Lock()
+	entry := rs.entries[urlStr]
+	if entry == nil {
+		entry = &RssScheduleEntry{Url: urlStr, Interval: int64(defaultRssRefreshEvery.Seconds())}
+		rs.entries[urlStr] = entry
+	}
+	entry.Status = status
+	entry.lastAttempt = now
+	if status != "error" {
+		entry.LastRefreshed = now
+	}
+	entry.NextRefresh = now + entry.Interval*1000
+	snapshot := *entry
+	rs.mu.Unlock()
+
+	broadcastAll("rss:refreshed", snapshot)
+}
+
+func (rs *RssScheduler) snapshot() []RssScheduleEntry {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	list := make([]RssScheduleEntry, 0, len(rs.entries))
+	for _, entry := range rs.entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Url < list[j].Url })
+	return list
+}
+
+// extractRssSchedules reads enabled feeds and their optional
+// "refreshInterval" (minutes) from the dashboard config.
+func extractRssSchedules(payload map[string]interface{}) []rssFeedSchedule {
+	feeds, ok := payload["rssFeeds"].([]interface{})
+	if !ok {
+		return nil
+	}
+	schedules := make([]rssFeedSchedule, 0)
+	seen := make(map[string]struct{})
+	for _, feed := range feeds {
+		fm, ok := feed.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		enabled, _ := fm["enable"].(bool)
+		if !enabled {
+			continue
+		}
+		urlStr, _ := fm["url"].(string)
+		urlStr = strings.TrimSpace(urlStr)
+		if urlStr == "" {
+			continue
+		}
+		if _, exists := seen[urlStr]; exists {
+			continue
+		}
+		seen[urlStr] = struct{}{}
+		interval := defaultRssRefreshEvery
+		if minutes, ok := fm["refreshInterval"].(float64); ok && minutes > 0 {
+			interval = time.Duration(minutes * float64(time.Minute))
+		}
+		if interval < minRssRefreshInterval {
+			interval = minRssRefreshInterval
+		}
+		if interval > maxRssRefreshInterval {
+			interval = maxRssRefreshInterval
+		}
+		schedules = append(schedules, rssFeedSchedule{url: urlStr, interval: interval})
+	}
+	return schedules
+}
+
+// RefreshRssFeeds refreshes the given configured feeds, or all of them
+// when none are given, in the background
+func RefreshRssFeeds(c *gin.Context) {
+	var req struct {
+		Urls []string `json:"urls"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+	configured := RssFeedUrls()
+	urls := configured
+	if len(req.Urls) > 0 {
+		// Only configured feeds, so this cannot be used to fetch any URL
+		for _, u := range req.Urls {
+			if !containsString(configured, strings.TrimSpace(u)) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown feed", "url": u})
+				return
+			}
+		}
+		urls = req.Urls
+	}
+	go func() {
+		for _, u := range urls {
+			if backgroundCtx.Err() != nil {
+				return
+			}
+			refreshRss(socketServer, strings.TrimSpace(u))
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": gin.H{"feeds": len(urls)}})
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// RssScrapeRule turns an HTML page into feed items. It is stored as
+// "scrape" on a feed entry. Field selectors are relative to each item and
+// may end in "@attr" to read an attribute instead of the text, e.g.
+// "time@datetime". Empty title and link selectors fall back to the first
+// link in the item.
+type RssScrapeRule struct {
+	Item    string `json:"item"`
+	Title   string `json:"title,omitempty"`
+	Link    string `json:"link,omitempty"`
+	Date    string `json:"date,omitempty"`
+	Summary string `json:"summary,omitempty"`
+	Image   string `json:"image,omitempty"`
+}
+
+// scrapeField is a compiled field selector
+type scrapeField struct {
+	sel  cssSelector // nil selects the item itself
+	attr string
+}
+
+func rssScrapeRuleFromConfig(fm map[string]interface{}) *RssScrapeRule {
+	if fm == nil || fm["scrape"] == nil {
+		return nil
+	}
+	raw, err := json.Marshal(fm["scrape"])
+	if err != nil {
+		return nil
+	}
+	var rule RssScrapeRule
+	if err := json.Unmarshal(raw, &rule); err != nil || strings.TrimSpace(rule.Item) == "" {
+		return nil
+	}
+	return &rule
+}
+
+func scrapeRssFeed(ctx context.Context, pageUrl string, rule *RssScrapeRule, profile *RssFetchProfile) (*UnifiedFeed, error) {
+	var lastErr error
+	for _, attempt := range buildRssAttempts(pageUrl, profile) {
+		body, err := fetchRssBody(ctx, attempt.client, pageUrl, attempt.headers)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return scrapeRssPage(body, pageUrl, rule)
+	}
+	return nil, lastErr
+}
+
+// scrapeRssPage builds a feed from page using rule
+func scrapeRssPage(page []byte, pageUrl string, rule *RssScrapeRule) (*UnifiedFeed, error) {
+	itemSel, err := compileSelector(rule.Item)
+	if err != nil {
+		return nil, fmt.Errorf("item selector: %v", err)
+	}
+	fields := make(map[string]*scrapeField)
+	for name, spec := range map[string]string{
+		"title": rule.Title, "link": rule.Link, "date": rule.Date,
+		"summary": rule.Summary, "image": rule.Image,
+	} {
+		field, err := compileScrapeField(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s selector: %v", name, err)
+		}
+		fields[name] = field
+	}
+
+	encoding, _, _ := charset.DetermineEncoding(page, "")
+	if decoded, err := encoding.NewDecoder().Bytes(page); err == nil {
+		page = decoded
+	}
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &UnifiedFeed{Link: pageUrl, Type: "scrape"}
+	if titleSel, err := compileSelector("title"); err == nil {
+		if n := titleSel.selectFirst(doc); n != nil {
+			feed.Title = collapseWhitespace(nodeText(n))
+		}
+	}
+	for _, node := range itemSel.selectAll(doc) {
+		item := UnifiedRssItem{
+			Title:          fields["title"].text(node),
+			Link:           resolveItemUrl(pageUrl, fields["link"].url(node)),
+			PubDate:        fields["date"].text(node),
+			ContentSnippet: truncateSnippet(fields["summary"].text(node), maxRssSnippetLength),
+			Image:          resolveItemUrl(pageUrl, fields["image"].image(node)),
+		}
+		if item.Title == "" {
+			if a := firstLink(node); a != nil {
+				item.Title = collapseWhitespace(nodeText(a))
+			}
+		}
+		if item.Link == "" {
+			if a := firstLink(node); a != nil {
+				item.Link = resolveItemUrl(pageUrl, attrOf(a, "href"))
+			}
+		}
+		if item.Title == "" && item.Link == "" {
+			continue
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	if len(feed.Items) == 0 {
+		return nil, fmt.Errorf("scrape rule matched no items")
+	}
+	return finalizeRssFeed(feed), nil
+}
+
+func compileScrapeField(spec string) (*scrapeField, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	field := &scrapeField{}
+	if at := strings.LastIndex(spec, "@"); at >= 0 {
+		field.attr = strings.TrimSpace(spec[at+1:])
+		spec = strings.TrimSpace(spec[:at])
+	}
+	if spec != "" {
+		sel, err := compileSelector(spec)
+		if err != nil {
+			return nil, err
+		}
+		field.sel = sel
+	}
+	return field, nil
+}
+
+func (f *scrapeField) node(item *html.Node) *html.Node {
+	if f == nil {
+		return nil
+	}
+	if f.sel == nil {
+		return item
+	}
+	return f.sel.selectFirst(item)
+}
+
+func (f *scrapeField) text(item *html.Node) string {
+	n := f.node(item)
+	if n == nil {
+		return ""
+	}
+	if f.attr != "" {
+		return strings.TrimSpace(attrOf(n, f.attr))
+	}
+	return collapseWhitespace(nodeText(n))
+}
+
+// url reads href (or the configured attribute) of the matched element or
+// of the first link inside it
+func (f *scrapeField) url(item *html.Node) string {
+	n := f.node(item)
+	if n == nil {
+		return ""
+	}
+	if f.attr != "" {
+		return strings.TrimSpace(attrOf(n, f.attr))
+	}
+	if n.Data != "a" {
+		if n = firstLink(n); n == nil {
+			return ""
+		}
+	}
+	return strings.TrimSpace(attrOf(n, "href"))
+}
+
+func (f *scrapeField) image(item *html.Node) string {
+	n := f.node(item)
+	if n == nil {
+		return ""
+	}
+	if f.attr != "" {
+		return strings.TrimSpace(attrOf(n, f.attr))
+	}
+	if n.Data != "img" {
+		imgSel, _ := compileSelector("img")
+		if n = imgSel.selectFirst(n); n == nil {
+			return ""
+		}
+	}
+	if src := attrOf(n, "data-src"); src != "" {
+		return src
+	}
+	return strings.TrimSpace(attrOf(n, "src"))
+}
+
+func firstLink(n *html.Node) *html.Node {
+	if n.Data == "a" && attrOf(n, "href") != "" {
+		return n
+	}
+	linkSel, _ := compileSelector("a[href]")
+	return linkSel.selectFirst(n)
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+const (
+	defaultRssSearchLimit = 50
+	maxRssSearchLimit     = 500
+)
+
+type rssSearchQuery struct {
+	text     string
+	regex    bool
+	category string
+	feeds    map[string]struct{} // Empty means every feed
+	since    int64               // Unix ms, inclusive; 0 for no bound
+	until    int64               // Unix ms, inclusive; 0 for no bound
+	limit    int
+}
+
+type RssSearchResult struct {
+	Items []RssTimelineItem `json:"items"`
+	Total int               `json:"total"`
+}
+
+func BindRssSearchHandlers(server *socketio.Server) {
+	bindEvent(server, "rss:search", func(s socketio.Conn, msg interface{}) {
+		query, err := parseRssSearchQuery(msg)
+		if err != nil {
+			s.Emit("rss:error", map[string]interface{}{"error": err.Error()})
+			return
+		}
+		result, err := searchRssItems(rssRequestUser(msg), query)
+		if err != nil {
+			s.Emit("rss:error", map[string]interface{}{"error": err.Error()})
+			return
+		}
+		s.Emit("rss:searchData", map[string]interface{}{
+			"query": query.text,
+			"data":  result,
+		})
+	})
+}
+
+// parseRssSearchQuery reads {query, regex, category, feeds, since, until,
+// limit}; since and until accept Unix ms or any supported date string.
+func parseRssSearchQuery(msg interface{}) (rssSearchQuery, error) {
+	m, _ := msg.(map[string]interface{})
+	query := rssSearchQuery{
+		text:     strings.TrimSpace(stringField(m, "query")),
+		category: strings.TrimSpace(stringField(m, "category")),
+		feeds:    make(map[string]struct{}),
+		limit:    defaultRssSearchLimit,
+	}
+	query.regex, _ = m["regex"].(bool)
+	if query.text == "" {
+		return query, fmt.Errorf("query is required")
+	}
+	if list, ok := m["feeds"].([]interface{}); ok {
+		for _, f := range list {
+			if u, ok := f.(string); ok && strings.TrimSpace(u) != "" {
+				query.feeds[strings.TrimSpace(u)] = struct{}{}
+			}
+		}
+	}
+	query.since = parseRssSearchTime(m["since"])
+	query.until = parseRssSearchTime(m["until"])
+	if n, ok := m["limit"].(float64); ok && n > 0 {
+		query.limit = int(n)
+	}
+	if query.limit > maxRssSearchLimit {
+		query.limit = maxRssSearchLimit
+	}
+	return query, nil
+}
+
+func parseRssSearchTime(v interface{}) int64 {
+	switch value := v.(type) {
+	case float64:
+		return int64(value)
+	case string:
+		if t := parseRssDate(value); !t.IsZero() {
+			return t.UnixMilli()
+		}
+	}
+	return 0
+}
+
+// searchRssItems matches title and snippet of every cached item the user
+// can see, newest first.
+func searchRssItems(username string, query rssSearchQuery) (RssSearchResult, error) {
+	match, err := compileRssSearch(query.text, query.regex)
+	if err != nil {
+		return RssSearchResult{}, err
+	}
+	items := collectRssTimelineItems(username, query.category)
+	sortRssTimeline(items)
+
+	result := RssSearchResult{Items: []RssTimelineItem{}}
+	for _, item := range items {
+		if len(query.feeds) > 0 {
+			if _, ok := query.feeds[item.FeedUrl]; !ok {
+				continue
+			}
+		}
+		if query.since > 0 || query.until > 0 {
+			ts := rssItemTime(item.UnifiedRssItem)
+			if ts == 0 || (query.since > 0 && ts < query.since) || (query.until > 0 && ts > query.until) {
+				continue
+			}
+		}
+		if !match(item.Title) && !match(item.ContentSnippet) {
+			continue
+		}
+		result.Total++
+		if len(result.Items) < query.limit {
+			result.Items = append(result.Items, item)
+		}
+	}
+	return result, nil
+}
+
+func compileRssSearch(text string, isRegex bool) (func(string) bool, error) {
+	if isRegex {
+		re, err := regexp.Compile("(?i)" + text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+		return re.MatchString, nil
+	}
+	needle := strings.ToLower(text)
+	return func(s string) bool {
+		return strings.Contains(strings.ToLower(s), needle)
+	}, nil
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// cssSelector is a small subset of CSS selectors, enough for scraping
+// rules: type, #id, .class, [attr], [attr=v], [attr~=v], [attr^=v],
+// [attr$=v], [attr*=v], :first-child, :last-child, descendant and child
+// combinators, and comma separated groups.
+type cssSelector [][]cssStep // groups -> steps, rightmost last
+
+type cssStep struct {
+	child    bool // Combinator to the previous step is ">"
+	tag      string
+	id       string
+	classes  []string
+	attrs    []cssAttr
+	position string // "first-child" or "last-child"
+}
+
+type cssAttr struct {
+	name, op, value string
+}
+
+func compileSelector(selector string) (cssSelector, error) {
+	var groups cssSelector
+	for _, group := range strings.Split(selector, ",") {
+		steps, err := parseSelectorGroup(strings.TrimSpace(group))
+		if err != nil {
+			return nil, err
+		}
+		if len(steps) > 0 {
+			groups = append(groups, steps)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return groups, nil
+}
+
+func parseSelectorGroup(group string) ([]cssStep, error) {
+	group = strings.ReplaceAll(group, ">", " > ")
+	var steps []cssStep
+	child := false
+	for _, part := range strings.Fields(group) {
+		if part == ">" {
+			if len(steps) == 0 || child {
+				return nil, fmt.Errorf("invalid selector %q", group)
+			}
+			child = true
+			continue
+		}
+		step, err := parseSelectorStep(part)
+		if err != nil {
+			return nil, err
+		}
+		step.child = child
+		child = false
+		steps = append(steps, step)
+	}
+	if child {
+		return nil, fmt.Errorf("invalid selector %q", group)
+	}
+	return steps, nil
+}
+
+func parseSelectorStep(s string) (cssStep, error) {
+	var step cssStep
+	i := 0
+	readName := func() string {
+		start := i
+		for i < len(s) && !strings.ContainsRune(".#[:", rune(s[i])) {
+			i++
+		}
+		return s[start:i]
+	}
+	if s[0] != '.' && s[0] != '#' && s[0] != '[' && s[0] != ':' {
+		step.tag = strings.ToLower(readName())
+		if step.tag == "*" {
+			step.tag = ""
+		}
+	}
+	for i < len(s) {
+		switch s[i] {
+		case '.':
+			i++
+			step.classes = append(step.classes, readName())
+		case '#':
+			i++
+			step.id = readName()
+		case ':':
+			i++
+			pseudo := readName()
+			if pseudo != "first-child" && pseudo != "last-child" {
+				return step, fmt.Errorf("unsupported pseudo-class :%s", pseudo)
+			}
+			step.position = pseudo
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return step, fmt.Errorf("unterminated attribute selector in %q", s)
+			}
+			attr, err := parseSelectorAttr(s[i+1 : i+end])
+			if err != nil {
+				return step, err
+			}
+			step.attrs = append(step.attrs, attr)
+			i += end + 1
+		default:
+			return step, fmt.Errorf("unexpected %q in selector %q", s[i], s)
+		}
+	}
+	return step, nil
+}
+
+func parseSelectorAttr(body string) (cssAttr, error) {
+	for _, op := range []string{"~=", "^=", "$=", "*=", "="} {
+		if idx := strings.Index(body, op); idx > 0 {
+			value := strings.Trim(strings.TrimSpace(body[idx+len(op):]), `"'`)
+			return cssAttr{name: strings.ToLower(strings.TrimSpace(body[:idx])), op: op, value: value}, nil
+		}
+	}
+	name := strings.ToLower(strings.TrimSpace(body))
+	if name == "" {
+		return cssAttr{}, fmt.Errorf("empty attribute selector")
+	}
+	return cssAttr{name: name}, nil
+}
+
+// selectAll returns matching descendants of root in document order
+func (sel cssSelector) selectAll(root *html.Node) []*html.Node {
+	var out []*html.Node
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && sel.matches(c, root) {
+				out = append(out, c)
+			}
+			walk(c)
+		}
+	}
+	walk(root)
+	return out
+}
+
+func (sel cssSelector) selectFirst(root *html.Node) *html.Node {
+	if found := sel.selectAll(root); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+func (sel cssSelector) matches(n, root *html.Node) bool {
+	for _, steps := range sel {
+		if matchSteps(n, steps, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSteps matches right to left; ancestors are searched up to, but not
+// including, root so that selectors stay relative to a scraped item.
+func matchSteps(n *html.Node, steps []cssStep, root *html.Node) bool {
+	last := steps[len(steps)-1]
+	if !last.matchNode(n) {
+		return false
+	}
+	if len(steps) == 1 {
+		return true
+	}
+	rest := steps[:len(steps)-1]
+	for p := n.Parent; p != nil && p != root; p = p.Parent {
+		if p.Type != html.ElementNode {
+			continue
+		}
+		if matchSteps(p, rest, root) {
+			return true
+		}
+		if last.child {
+			return false
+		}
+	}
+	return false
+}
+
+func (step cssStep) matchNode(n *html.Node) bool {
+	if step.tag != "" && n.Data != step.tag {
+		return false
+	}
+	if step.id != "" && attrOf(n, "id") != step.id {
+		return false
+	}
+	if len(step.classes) > 0 {
+		classes := strings.Fields(attrOf(n, "class"))
+		for _, want := range step.classes {
+			found := false
+			for _, c := range classes {
+				if c == want {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	for _, attr := range step.attrs {
+		if !attr.matchNode(n) {
+			return false
+		}
+	}
+	switch step.position {
+	case "first-child":
+		for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+			if s.Type == html.ElementNode {
+				return false
+			}
+		}
+	case "last-child":
+		for s := n.NextSibling; s != nil; s = s.NextSibling {
+			if s.Type == html.ElementNode {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (attr cssAttr) matchNode(n *html.Node) bool {
+	for _, a := range n.Attr {
+		if a.Key != attr.name {
+			continue
+		}
+		switch attr.op {
+		case "":
+			return true
+		case "=":
+			return a.Val == attr.value
+		case "~=":
+			for _, f := range strings.Fields(a.Val) {
+				if f == attr.value {
+					return true
+				}
+			}
+			return false
+		case "^=":
+			return strings.HasPrefix(a.Val, attr.value)
+		case "$=":
+			return strings.HasSuffix(a.Val, attr.value)
+		case "*=":
+			return strings.Contains(a.Val, attr.value)
+		}
+	}
+	return false
+}
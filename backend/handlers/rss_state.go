@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// maxRssReadPerFeed caps how many read markers are kept per feed; the
+// oldest are dropped first since they have long left the feed window.
+const maxRssReadPerFeed = 2000
+
+// RssUserState is the per-user read/saved state, stored next to the memo files
+type RssUserState struct {
+	Read  map[string]map[string]int64 `json:"read"` // feed url -> guid -> read at (ms)
+	Saved []RssSavedItem              `json:"saved"`
+}
+
+type RssSavedItem struct {
+	FeedUrl string         `json:"feedUrl"`
+	SavedAt int64          `json:"savedAt"`
+	Item    UnifiedRssItem `json:"item"`
+}
+
+func BindRssStateHandlers(server *socketio.Server) {
+	bindEvent(server, "rss:mark-read", func(s socketio.Conn, msg interface{}) {
+		username, urlStr, ok := parseRssStatePayload(s, msg)
+		if !ok {
+			return
+		}
+		guids := parseRssGuids(msg)
+		state, err := updateRssState(username, func(state *RssUserState) {
+			markRssRead(state, urlStr, guids)
+		})
+		emitRssReadState(s, urlStr, state, err)
+	})
+
+	bindEvent(server, "rss:mark-all-read", func(s socketio.Conn, msg interface{}) {
+		username, urlStr, ok := parseRssStatePayload(s, msg)
+		if !ok {
+			return
+		}
+		var items []UnifiedRssItem
+		_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSS, urlStr, &items)
+		guids := make([]string, 0, len(items))
+		for _, item := range items {
+			guids = append(guids, item.Guid)
+		}
+		state, err := updateRssState(username, func(state *RssUserState) {
+			markRssRead(state, urlStr, guids)
+		})
+		emitRssReadState(s, urlStr, state, err)
+	})
+
+	bindEvent(server, "rss:save", func(s socketio.Conn, msg interface{}) {
+		username, urlStr, ok := parseRssStatePayload(s, msg)
+		if !ok {
+			return
+		}
+		m, _ := msg.(map[string]interface{})
+		guid, _ := m["guid"].(string)
+		guid = strings.TrimSpace(guid)
+		if guid == "" {
+			s.Emit("rss:error", map[string]interface{}{"url": urlStr, "error": "guid is required"})
+			return
+		}
+		saved := true
+		if v, ok := m["saved"].(bool); ok {
+			saved = v
+		}
+		var item *UnifiedRssItem
+		if saved {
+			item = findCachedRssItem(urlStr, guid)
+			if item == nil {
+				s.Emit("rss:error", map[string]interface{}{"url": urlStr, "error": "item not found"})
+				return
+			}
+		}
+		state, err := updateRssState(username, func(state *RssUserState) {
+			setRssSaved(state, urlStr, guid, item)
+		})
+		if err != nil {
+			s.Emit("rss:error", map[string]interface{}{"url": urlStr, "error": err.Error()})
+			return
+		}
+		s.Emit("rss:savedData", map[string]interface{}{"items": state.Saved})
+	})
+
+	bindEvent(server, "rss:saved", func(s socketio.Conn, msg interface{}) {
+		token, _ := parseTokenPayload(msg)
+		username, ok := validateSocketToken(token)
+		if !ok {
+			s.Emit("rss:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		state := loadRssState(username)
+		s.Emit("rss:savedData", map[string]interface{}{"items": state.Saved})
+	})
+
+	bindEvent(server, "rss:unread", func(s socketio.Conn, msg interface{}) {
+		token, _ := parseTokenPayload(msg)
+		username, ok := validateSocketToken(token)
+		if !ok {
+			s.Emit("rss:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		m, _ := msg.(map[string]interface{})
+		list, _ := m["urls"].([]interface{})
+		state := loadRssState(username)
+		counts := make(map[string]int)
+		for _, raw := range list {
+			urlStr, _ := raw.(string)
+			urlStr = strings.TrimSpace(urlStr)
+			if urlStr == "" {
+				continue
+			}
+			var items []UnifiedRssItem
+			_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSS, urlStr, &items)
+			_, counts[urlStr] = applyRssState(items, &state, urlStr)
+		}
+		s.Emit("rss:unreadData", map[string]interface{}{"counts": counts})
+	})
+}
+
+func parseRssStatePayload(s socketio.Conn, msg interface{}) (string, string, bool) {
+	m, _ := msg.(map[string]interface{})
+	token, _ := m["token"].(string)
+	username, ok := validateSocketToken(token)
+	if !ok {
+		s.Emit("rss:error", map[string]interface{}{"error": "Unauthorized"})
+		return "", "", false
+	}
+	urlStr := parseRssUrl(msg)
+	if urlStr == "" {
+		s.Emit("rss:error", map[string]interface{}{"error": "url is required"})
+		return "", "", false
+	}
+	return username, urlStr, true
+}
+
+func parseRssGuids(msg interface{}) []string {
+	m, _ := msg.(map[string]interface{})
+	list, _ := m["guids"].([]interface{})
+	guids := make([]string, 0, len(list))
+	for _, raw := range list {
+		if g, ok := raw.(string); ok && strings.TrimSpace(g) != "" {
+			guids = append(guids, strings.TrimSpace(g))
+		}
+	}
+	return guids
+}
+
+func emitRssReadState(s socketio.Conn, urlStr string, state *RssUserState, err error) {
+	if err != nil {
+		s.Emit("rss:error", map[string]interface{}{"url": urlStr, "error": err.Error()})
+		return
+	}
+	var items []UnifiedRssItem
+	_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSS, urlStr, &items)
+	_, unread := applyRssState(items, state, urlStr)
+	s.Emit("rss:readState", map[string]interface{}{
+		"url":    urlStr,
+		"unread": unread,
+	})
+}
+
+// fallbackRssGuid identifies items whose feed gives no guid/id
+func fallbackRssGuid(item UnifiedRssItem) string {
+	if link := strings.TrimSpace(item.Link); link != "" {
+		return link
+	}
+	sum := sha1.Sum([]byte(item.Title + "\n" + item.PubDate))
+	return "sha1:" + hex.EncodeToString(sum[:])
+}
+
+func rssStateFilePath(username string) string {
+	return filepath.Join(config.DataDir, "rss_state_"+sanitizeMemoID(username)+".json")
+}
+
+func loadRssState(username string) RssUserState {
+	var state RssUserState
+	_ = utils.ReadJSON(rssStateFilePath(username), &state)
+	if state.Read == nil {
+		state.Read = make(map[string]map[string]int64)
+	}
+	return state
+}
+
+func updateRssState(username string, fn func(state *RssUserState)) (*RssUserState, error) {
+	file := rssStateFilePath(username)
+	var state RssUserState
+	err := utils.WithFileLock(file, func() error {
+		if err := utils.ReadJSONUnlocked(file, &state); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if state.Read == nil {
+			state.Read = make(map[string]map[string]int64)
+		}
+		fn(&state)
+		return utils.WriteJSONUnlocked(file, state)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func markRssRead(state *RssUserState, urlStr string, guids []string) {
+	if len(guids) == 0 {
+		return
+	}
+	read := state.Read[urlStr]
+	if read == nil {
+		read = make(map[string]int64)
+		state.Read[urlStr] = read
+	}
+	now := time.Now().UnixMilli()
+	for _, guid := range guids {
+		if guid == "" {
+			continue
+		}
+		if _, exists := read[guid]; !exists {
+			read[guid] = now
+		}
+	}
+	if len(read) <= maxRssReadPerFeed {
+		return
+	}
+	type marker struct {
+		guid string
+		at   int64
+	}
+	markers := make([]marker, 0, len(read))
+	for guid, at := range read {
+		markers = append(markers, marker{guid, at})
+	}
+	sort.Slice(markers, func(i, j int) bool { return markers[i].at < markers[j].at })
+	for _, m := range markers[:len(markers)-maxRssReadPerFeed] {
+		delete(read, m.guid)
+	}
+}
+
+func setRssSaved(state *RssUserState, urlStr, guid string, item *UnifiedRssItem) {
+	kept := state.Saved[:0]
+	for _, saved := range state.Saved {
+		if saved.FeedUrl == urlStr && saved.Item.Guid == guid {
+			continue
+		}
+		kept = append(kept, saved)
+	}
+	state.Saved = kept
+	if item != nil {
+		snapshot := *item
+		snapshot.Read = false
+		snapshot.Saved = false
+		state.Saved = append([]RssSavedItem{{FeedUrl: urlStr, SavedAt: time.Now().UnixMilli(), Item: snapshot}}, state.Saved...)
+	}
+}
+
+func findCachedRssItem(urlStr, guid string) *UnifiedRssItem {
+	var items []UnifiedRssItem
+	if _, _, _, err := sharedWidgetCache.Get(widgetCacheKindRSS, urlStr, &items); err != nil {
+		return nil
+	}
+	for i := range items {
+		if items[i].Guid == guid {
+			return &items[i]
+		}
+	}
+	return nil
+}
+
+// applyRssState returns a copy of items flagged with the user's read/saved
+// state, and how many of them are unread.
+func applyRssState(items []UnifiedRssItem, state *RssUserState, urlStr string) ([]UnifiedRssItem, int) {
+	read := state.Read[urlStr]
+	saved := make(map[string]struct{})
+	for _, s := range state.Saved {
+		if s.FeedUrl == urlStr {
+			saved[s.Item.Guid] = struct{}{}
+		}
+	}
+	out := make([]UnifiedRssItem, len(items))
+	unread := 0
+	for i, item := range items {
+		_, item.Read = read[item.Guid]
+		_, item.Saved = saved[item.Guid]
+		if !item.Read {
+			unread++
+		}
+		out[i] = item
+	}
+	return out, unread
+}
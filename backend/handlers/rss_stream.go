@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/transform"
+)
+
+// Feeds are decoded from the response as it arrives. Only the first
+// rssSniffSize bytes are buffered, to tell feeds from web pages and to pick
+// the charset; items are decoded one at a time and the body is dropped
+// after maxRssItems of them.
+const rssSniffSize = 64 << 10
+
+// rssLimitedReader fails with errRssTooLarge once more than left bytes are
+// read, where io.LimitReader would end quietly
+type rssLimitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func newRssLimitedReader(r io.Reader) *rssLimitedReader {
+	return &rssLimitedReader{r: r, left: maxRssBodySize}
+}
+
+func (l *rssLimitedReader) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, errRssTooLarge
+	}
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n - 1, errRssTooLarge
+	}
+	return n, err
+}
+
+// parseRssFeedReader decodes and finalizes the feed read from r
+func parseRssFeedReader(r io.Reader, contentType string) (*UnifiedFeed, error) {
+	feed, err := decodeRssFeed(r, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return finalizeRssFeed(feed), nil
+}
+
+// decodeRssFeed reads an RSS 2.0, Atom, RSS 1.0 or JSON feed from r
+func decodeRssFeed(r io.Reader, contentType string) (*UnifiedFeed, error) {
+	br := bufio.NewReaderSize(r, rssSniffSize)
+	head, _ := br.Peek(rssSniffSize)
+	preamble := len(head) - len(trimXMLPreamble(head))
+	br.Discard(preamble)
+	head = head[preamble:]
+
+	body, charsetReader := rssUTF8Reader(br, head, contentType)
+	var feed *UnifiedFeed
+	var err error
+	if bytes.HasPrefix(head, []byte("{")) {
+		feed, err = decodeJsonFeed(body)
+	} else {
+		feed, err = decodeXMLFeed(body, charsetReader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse feed: %w", err)
+	}
+	return feed, nil
+}
+
+// rssUTF8Reader returns the rest of br as UTF-8 and the CharsetReader the
+// XML decoder needs for it. It judges the sniffed head the way
+// normalizeRssCharset judges a whole body: valid UTF-8 is trusted over the
+// declaration; anything else is decoded with the declared charset, then
+// the Content-Type charset, then a best guess.
+func rssUTF8Reader(br *bufio.Reader, head []byte, contentType string) (io.Reader, func(string, io.Reader) (io.Reader, error)) {
+	declared := ""
+	if m := xmlEncodingAttr.FindSubmatch(head); m != nil {
+		declared = strings.TrimSpace(string(m[2]))
+	}
+	if validUTF8Head(head, len(head) < br.Size()) {
+		if declared != "" && !isUTF8Label(declared) && hasNonASCII(head) {
+			return br, keepRssUTF8
+		}
+		return br, rssCharsetReader
+	}
+
+	candidates := []string{declared}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		candidates = append(candidates, params["charset"])
+	}
+	for _, label := range candidates {
+		if label == "" || isUTF8Label(label) {
+			continue
+		}
+		if enc, _ := charset.Lookup(label); enc != nil {
+			return transform.NewReader(br, enc.NewDecoder()), keepRssUTF8
+		}
+	}
+	enc, _, _ := charset.DetermineEncoding(head, contentType)
+	return transform.NewReader(br, enc.NewDecoder()), keepRssUTF8
+}
+
+// validUTF8Head reports whether head is valid UTF-8. Unless it is the whole
+// body, a rune cut off at its end does not count against it.
+func validUTF8Head(head []byte, whole bool) bool {
+	if utf8.Valid(head) {
+		return true
+	}
+	for cut := 1; !whole && cut < utf8.UTFMax && cut < len(head); cut++ {
+		if !utf8.FullRune(head[len(head)-cut:]) && utf8.Valid(head[:len(head)-cut]) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepRssUTF8 is the CharsetReader for input that is UTF-8 already,
+// whatever its declaration says
+func keepRssUTF8(_ string, input io.Reader) (io.Reader, error) {
+	return input, nil
+}
+
+// rssItemSplitter is an xml.TokenReader that takes the items of a feed out
+// of the token stream and hands them to collect, so the rest of the feed
+// can be decoded into its struct without holding every item twice.
+type rssItemSplitter struct {
+	d       *xml.Decoder
+	root    xml.Token // replayed first; the caller read it to pick the format
+	depth   int
+	level   int    // depth of the items below the root
+	name    string // local name of the items
+	collect func(start *xml.StartElement) error
+}
+
+func (f *rssItemSplitter) Token() (xml.Token, error) {
+	if f.root != nil {
+		tok := f.root
+		f.root = nil
+		f.depth++
+		return tok, nil
+	}
+	for {
+		tok, err := f.d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if f.depth == f.level && t.Name.Local == f.name {
+				if err := f.collect(&t); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			f.depth++
+		case xml.EndElement:
+			f.depth--
+		}
+		return tok, nil
+	}
+}
+
+// decodeXMLFeed decodes an XML feed, choosing the format by its root
+// element. Items past maxRssItems are skipped without being decoded.
+func decodeXMLFeed(r io.Reader, charsetReader func(string, io.Reader) (io.Reader, error)) (*UnifiedFeed, error) {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = charsetReader
+	var root xml.StartElement
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			root = start
+			break
+		}
+	}
+	splitter := &rssItemSplitter{d: d, root: root}
+	collect := func(decode func(start *xml.StartElement) error) func(*xml.StartElement) error {
+		count := 0
+		return func(start *xml.StartElement) error {
+			if count >= maxRssItems {
+				return d.Skip()
+			}
+			count++
+			return decode(start)
+		}
+	}
+	outer := xml.NewTokenDecoder(splitter)
+
+	switch root.Name.Local {
+	case "rss":
+		var rss2 Rss2Feed
+		splitter.level, splitter.name = 2, "item"
+		splitter.collect = collect(func(start *xml.StartElement) error {
+			var item Rss2Item
+			err := d.DecodeElement(&item, start)
+			rss2.Channel.Items = append(rss2.Channel.Items, item)
+			return err
+		})
+		if err := outer.Decode(&rss2); err != nil {
+			return nil, err
+		}
+		return rss2Feed(rss2)
+	case "feed":
+		var atom AtomFeed
+		splitter.level, splitter.name = 1, "entry"
+		splitter.collect = collect(func(start *xml.StartElement) error {
+			var entry AtomEntry
+			err := d.DecodeElement(&entry, start)
+			atom.Entries = append(atom.Entries, entry)
+			return err
+		})
+		if err := outer.Decode(&atom); err != nil {
+			return nil, err
+		}
+		return atomFeed(atom)
+	case "RDF":
+		var rdf RdfFeed
+		splitter.level, splitter.name = 1, "item"
+		splitter.collect = collect(func(start *xml.StartElement) error {
+			var item RdfItem
+			err := d.DecodeElement(&item, start)
+			rdf.Items = append(rdf.Items, item)
+			return err
+		})
+		if err := outer.Decode(&rdf); err != nil {
+			return nil, err
+		}
+		return rdfFeed(rdf)
+	}
+	return nil, fmt.Errorf("unknown root element %q", root.Name.Local)
+}
+
+// decodeJsonFeed decodes a JSON Feed, reading its items one at a time
+func decodeJsonFeed(r io.Reader) (*UnifiedFeed, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	var jf JsonFeed
+	meta := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		if key != "items" {
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			meta[key] = value
+			continue
+		}
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return nil, fmt.Errorf("items is not an array")
+		}
+		for dec.More() {
+			var item JsonFeedItem
+			if err := dec.Decode(&item); err != nil {
+				return nil, err
+			}
+			if len(jf.Items) < maxRssItems {
+				jf.Items = append(jf.Items, item)
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	items := jf.Items
+	rest, _ := json.Marshal(meta)
+	if err := json.Unmarshal(rest, &jf); err != nil {
+		return nil, err
+	}
+	jf.Items = items
+	return jsonFeed(jf)
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// rssRoom is the socket.io room of connections subscribed to a feed
+func rssRoom(urlStr string) string {
+	return "rss:" + urlStr
+}
+
+func BindRssSubscribeHandlers(server *socketio.Server) {
+	bindEvent(server, "rss:subscribe", func(s socketio.Conn, msg interface{}) {
+		urlStr := parseRssUrl(msg)
+		if urlStr == "" {
+			s.Emit("rss:error", map[string]interface{}{"error": "url is required"})
+			return
+		}
+		s.Join(rssRoom(urlStr))
+		s.Emit("rss:subscribed", map[string]interface{}{"url": urlStr})
+
+		var cachedItems []UnifiedRssItem
+		hasCache, isFresh, _, err := sharedWidgetCache.Get(widgetCacheKindRSS, urlStr, &cachedItems)
+		if err == nil && hasCache && len(cachedItems) > 0 {
+			s.Emit("rss:data", map[string]interface{}{
+				"url":  urlStr,
+				"data": buildRssDataPayload(urlStr, cachedItems, parseRssSnippetLength(msg), rssRequestUser(msg)),
+			})
+		}
+		if !hasCache || !isFresh {
+			go refreshRssAsync(server, urlStr)
+		}
+	})
+
+	bindEvent(server, "rss:unsubscribe", func(s socketio.Conn, msg interface{}) {
+		urlStr := parseRssUrl(msg)
+		if urlStr == "" {
+			s.Emit("rss:error", map[string]interface{}{"error": "url is required"})
+			return
+		}
+		s.Leave(rssRoom(urlStr))
+		s.Emit("rss:unsubscribed", map[string]interface{}{"url": urlStr})
+	})
+}
+
+// countNewRssItems returns how many items of next were not in prev
+func countNewRssItems(prev, next []UnifiedRssItem) int {
+	return len(newRssItems(prev, next))
+}
+
+// newRssItems returns the items of next that were not in prev
+func newRssItems(prev, next []UnifiedRssItem) []UnifiedRssItem {
+	known := make(map[string]struct{}, len(prev))
+	for _, item := range prev {
+		known[item.Guid] = struct{}{}
+	}
+	fresh := make([]UnifiedRssItem, 0)
+	for _, item := range next {
+		if _, ok := known[item.Guid]; !ok {
+			fresh = append(fresh, item)
+		}
+	}
+	return fresh
+}
@@ -0,0 +1,1018 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRssItemsSkipsBOMAndStylesheetPIs(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "rss_bom_xsl.xml"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	if !bytes.HasPrefix(body, utf8BOM) {
+		t.Fatalf("fixture should start with a UTF-8 BOM")
+	}
+
+	items, err := parseRssItems(body)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(items))
+	}
+	if items[0].Title != "First post" || items[0].Link != "https://example.com/posts/1" {
+		t.Fatalf("unexpected first item: %+v", items[0])
+	}
+}
+
+func TestParseRssItemsWithLeadingWhitespaceAndPIs(t *testing.T) {
+	body := []byte("\r\n\xef\xbb\xbf\n<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n" +
+		"<?xml-stylesheet type=\"text/xsl\" href=\"/atom.xsl\"?>\n" +
+		"<?xml-stylesheet type=\"text/css\" href=\"/atom.css\"?>\n" +
+		"<feed xmlns=\"http://www.w3.org/2005/Atom\"><entry><title>Entry</title>" +
+		"<link href=\"https://example.com/e\"/><updated>2024-01-01T00:00:00Z</updated></entry></feed>")
+
+	items, err := parseRssItems(body)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(items) != 1 || items[0].Link != "https://example.com/e" {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+}
+
+func TestParseRssFeedMetadata(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "rss_bom_xsl.xml"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+
+	feed, err := parseRssFeed(body)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	meta := rssFeedMeta(feed)
+	if meta.Title != "Example Feed" || meta.Type != "rss2" || meta.Link != "https://example.com/" {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+	if meta.ItemCount != 2 || meta.Items != nil {
+		t.Fatalf("expected itemCount=2 without items, got %d/%d", meta.ItemCount, len(meta.Items))
+	}
+	if len(feed.Items) != 2 {
+		t.Fatalf("metadata copy must not drop the feed items")
+	}
+}
+
+func TestDiscoverFeedLinks(t *testing.T) {
+	page := []byte(`<!DOCTYPE html>
+<html><head>
+<link rel="stylesheet" href="/style.css">
+<link rel="alternate" type="application/rss+xml" title="RSS" href="/feed.xml">
+<link rel="alternate" type="application/atom+xml; charset=utf-8" href="https://example.com/atom.xml">
+<link rel="alternate" type="application/rss+xml" href="/feed.xml">
+<link rel="alternate" hreflang="en" href="/en/">
+</head><body><link rel="alternate" type="application/rss+xml" href="/ignored.xml"></body></html>`)
+
+	if !looksLikeHTML(page) {
+		t.Fatalf("expected page to be detected as HTML")
+	}
+	links := discoverFeedLinks(page, "https://example.com/blog/")
+	if len(links) != 2 || links[0] != "https://example.com/feed.xml" || links[1] != "https://example.com/atom.xml" {
+		t.Fatalf("unexpected links: %v", links)
+	}
+}
+
+func TestParseRssItemsJsonFeed(t *testing.T) {
+	body := []byte(`{
+  "version": "https://jsonfeed.org/version/1.1",
+  "title": "JSON Blog",
+  "home_page_url": "https://example.org/",
+  "items": [
+    {"id": "1", "url": "https://example.org/1", "title": "One", "content_html": "<p>Hi</p>", "date_published": "2024-05-01T10:00:00Z"},
+    {"id": 2, "external_url": "https://other.org/2", "title": "Two", "content_text": "Plain", "date_modified": "2024-05-02T10:00:00Z"}
+  ]
+}`)
+
+	feed, err := parseRssFeed(body)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if feed.Type != "json" || feed.Title != "JSON Blog" || len(feed.Items) != 2 {
+		t.Fatalf("unexpected feed: %+v", feed)
+	}
+	if feed.Items[1].Link != "https://other.org/2" || feed.Items[1].PubDate != "2024-05-02T10:00:00Z" {
+		t.Fatalf("unexpected second item: %+v", feed.Items[1])
+	}
+}
+
+func TestFetchRssFeedOnceConditionalGet(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "rss_bom_xsl.xml"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	feed, err := fetchRssFeedOnce(context.Background(), srv.URL, rssFetchOptions{conditional: true})
+	if err != nil || len(feed.Items) != 2 {
+		t.Fatalf("first fetch: items=%v err=%v", feed, err)
+	}
+	if _, err := fetchRssFeedOnce(context.Background(), srv.URL, rssFetchOptions{conditional: true}); !errors.Is(err, errRssNotModified) {
+		t.Fatalf("expected not modified, got %v", err)
+	}
+	if _, err := fetchRssFeedOnce(context.Background(), srv.URL, rssFetchOptions{}); err != nil {
+		t.Fatalf("unconditional fetch: %v", err)
+	}
+	if hits != 3 {
+		t.Fatalf("expected 3 requests, got %d", hits)
+	}
+}
+
+func TestCleanDescriptionStripsMarkup(t *testing.T) {
+	input := `<![CDATA[<p>Tom &amp; Jerry&nbsp;return</p><script>alert("x")</script><img src="a.png"><br/>Second&#39;s <b>line</b><style>p{}</style>]]>`
+	got := cleanDescription(input)
+	want := "Tom & Jerry return Second's line"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	items := limitRssSnippets([]UnifiedRssItem{{ContentSnippet: "abcdefghij"}}, 4)
+	if items[0].ContentSnippet != "abcd..." {
+		t.Fatalf("unexpected truncation: %q", items[0].ContentSnippet)
+	}
+}
+
+func TestParseRssItemsEnclosure(t *testing.T) {
+	body := []byte(`<?xml version="1.0"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel><title>Pod</title>
+<item><title>Episode 1</title><guid>ep1</guid>
+<enclosure url="https://cdn.example.com/ep1.mp3" type="audio/mpeg" length="123456"/>
+<itunes:duration>00:42:10</itunes:duration></item>
+</channel></rss>`)
+
+	items, err := parseRssItems(body)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("parse: items=%v err=%v", items, err)
+	}
+	enc := items[0].Enclosure
+	if enc == nil || enc.Url != "https://cdn.example.com/ep1.mp3" || enc.Type != "audio/mpeg" || enc.Length != 123456 || enc.Duration != "00:42:10" {
+		t.Fatalf("unexpected enclosure: %+v", enc)
+	}
+}
+
+func TestParseRssItemsMediaImages(t *testing.T) {
+	body := []byte(`<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom" xmlns:media="http://search.yahoo.com/mrss/">
+<entry><title>Video</title><link rel="alternate" href="https://video.example.com/1"/>
+<media:group><media:content url="https://video.example.com/1.swf" type="application/x-shockwave-flash"/>
+<media:thumbnail url="https://img.example.com/1.jpg" width="480" height="360"/></media:group>
+<content type="html">Body text</content></entry>
+<entry><title>Inline</title><link href="https://example.com/2"/>
+<summary type="html">&lt;img src="https://t.example.com/p.gif" width="1" height="1"&gt;&lt;img src="/img/2.png"&gt;Text</summary></entry>
+</feed>`)
+
+	items, err := parseRssItems(body)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("parse: items=%v err=%v", items, err)
+	}
+	if items[0].Image != "https://img.example.com/1.jpg" || items[0].ContentSnippet != "Body text" {
+		t.Fatalf("unexpected first item: %+v", items[0])
+	}
+	if items[1].Image != "https://example.com/img/2.png" {
+		t.Fatalf("unexpected inline image: %q", items[1].Image)
+	}
+}
+
+func TestRssReadAndSavedState(t *testing.T) {
+	items := []UnifiedRssItem{{Guid: "a"}, {Guid: "b"}, {Guid: "c"}}
+	state := RssUserState{Read: map[string]map[string]int64{}}
+
+	markRssRead(&state, "feed", []string{"a", "c"})
+	setRssSaved(&state, "feed", "b", &items[1])
+	flagged, unread := applyRssState(items, &state, "feed")
+	if unread != 1 || !flagged[0].Read || flagged[1].Read || !flagged[1].Saved {
+		t.Fatalf("unexpected state: unread=%d items=%+v", unread, flagged)
+	}
+	if items[0].Read {
+		t.Fatalf("applyRssState must not modify the cached items")
+	}
+
+	setRssSaved(&state, "feed", "b", nil)
+	if len(state.Saved) != 0 {
+		t.Fatalf("expected item to be unsaved, got %+v", state.Saved)
+	}
+}
+
+func TestRssItemFilter(t *testing.T) {
+	items := []UnifiedRssItem{
+		{Title: "FlatNas 1.2 released"},
+		{Title: "Weekly news", ContentSnippet: "mentions flatnas briefly"},
+		{Title: "Docker tips"},
+		{Title: "FlatNas beta build"},
+	}
+	filter := compileRssFilter(
+		RssFilterRules{Include: []string{"flatnas", "/^Docker/"}},
+		RssFilterRules{Exclude: []string{"/\\bbeta\\b/i", "/[invalid/"}},
+	)
+	kept := filter.apply(items)
+	if len(kept) != 3 || kept[0].Title != "FlatNas 1.2 released" || kept[2].Title != "Docker tips" {
+		t.Fatalf("unexpected items: %+v", kept)
+	}
+	var none *rssItemFilter
+	if len(none.apply(items)) != len(items) {
+		t.Fatalf("nil filter should keep every item")
+	}
+}
+
+func TestParseRssDateAndTimelineOrder(t *testing.T) {
+	cases := map[string]int64{
+		"Mon, 02 Jan 2006 15:04:05 GMT":       1136214245,
+		"Tue, 3 Jan 2006 15:04:05 +0000":      1136300645,
+		"2006-01-04T15:04:05Z":                1136387045,
+		"Sun, 05 Jan 2006 15:04:05 +0000":     1136473445, // wrong weekday
+		"2006-01-06 15:04:05":                 1136559845,
+		"Sat, 07 Jan 2006 15:04:05 GMT (UTC)": 1136646245,
+	}
+	for value, want := range cases {
+		if got := parseRssDate(value).Unix(); got != want {
+			t.Fatalf("parseRssDate(%q) = %d, want %d", value, got, want)
+		}
+	}
+	if !parseRssDate("not a date").IsZero() {
+		t.Fatalf("expected zero time for garbage input")
+	}
+	if got, ts := normalizeRssDate("Tue, 3 Jan 2006 15:04:05 +0800"); got != "2006-01-03T15:04:05+08:00" || ts != 1136271845000 {
+		t.Fatalf("normalizeRssDate = %q, %d", got, ts)
+	}
+	if got, ts := normalizeRssDate(" 昨天 "); got != "昨天" || ts != 0 {
+		t.Fatalf("unparseable date should pass through, got %q, %d", got, ts)
+	}
+
+	items := []RssTimelineItem{
+		{UnifiedRssItem: UnifiedRssItem{Title: "undated"}},
+		{UnifiedRssItem: UnifiedRssItem{Title: "old", PubDate: "2006-01-02"}},
+		{UnifiedRssItem: UnifiedRssItem{Title: "new", PubDate: "Fri, 06 Jan 2006 00:00:00 GMT"}},
+	}
+	sortRssTimeline(items)
+	if items[0].Title != "new" || items[1].Title != "old" || items[2].Title != "undated" {
+		t.Fatalf("unexpected order: %+v", items)
+	}
+}
+
+func TestExtractArticle(t *testing.T) {
+	page := `<html><head><title>Fallback</title>
+<meta property="og:title" content="Real Title">
+<meta property="og:image" content="/img/cover.jpg"></head>
+<body><nav><p>Home, About, Contact, Archive, Tags and other links</p></nav>
+<div class="sidebar"><p>Subscribe to our newsletter, it is great, really, trust us.</p></div>
+<div class="post-content">
+<p>The first paragraph of the story, which is long enough to count, has commas.</p>
+<p>A second paragraph continues the story with more words, and more detail.</p>
+<div class="share">Share this on social media</div>
+<script>var tracking = true;</script>
+</div></body></html>`
+	article, err := extractArticle([]byte(page), "https://example.com/posts/1")
+	if err != nil {
+		t.Fatalf("extractArticle failed: %v", err)
+	}
+	if article.Title != "Real Title" {
+		t.Fatalf("unexpected title: %q", article.Title)
+	}
+	if article.Image != "https://example.com/img/cover.jpg" {
+		t.Fatalf("unexpected image: %q", article.Image)
+	}
+	want := "The first paragraph of the story, which is long enough to count, has commas.\n\n" +
+		"A second paragraph continues the story with more words, and more detail."
+	if article.Content != want {
+		t.Fatalf("unexpected content: %q", article.Content)
+	}
+	if _, err := extractArticle([]byte("<html><body>tiny</body></html>"), ""); err == nil {
+		t.Fatalf("expected error for page without content")
+	}
+}
+
+func TestRssHealthRecord(t *testing.T) {
+	feedUrl := "https://health.example/feed"
+	start := time.Now()
+	for i := 0; i < rssFailingThreshold; i++ {
+		rssHealth.record(feedUrl, start, nil, fmt.Errorf("HTTP status 503"))
+	}
+	var entry RssFeedHealth
+	if _, _, _, err := sharedWidgetCache.Get(widgetCacheKindRSSHealth, feedUrl, &entry); err != nil {
+		t.Fatalf("health not stored: %v", err)
+	}
+	if entry.ConsecutiveFailures != rssFailingThreshold || entry.LastError != "HTTP status 503" {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	if status := rssHealthStatus(entry, time.Now()); status != "failing" {
+		t.Fatalf("expected failing, got %s", status)
+	}
+
+	rssHealth.record(feedUrl, start, &UnifiedFeed{Items: make([]UnifiedRssItem, 4)}, nil)
+	_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSSHealth, feedUrl, &entry)
+	if entry.ConsecutiveFailures != 0 || entry.ItemCount != 4 || entry.Failures != 3 || entry.Fetches != 4 {
+		t.Fatalf("unexpected entry after success: %+v", entry)
+	}
+	if status := rssHealthStatus(entry, time.Now().Add(rssStaleAfter+time.Hour)); status != "stale" {
+		t.Fatalf("expected stale, got %s", status)
+	}
+}
+
+func TestWarmRssCacheCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	urls := make([]string, 0, rssWarmupWorkers*3)
+	for i := 0; i < cap(urls); i++ {
+		urls = append(urls, fmt.Sprintf("%s/feed/%d", srv.URL, i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		WarmRssCache(ctx, urls)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("warmup did not stop after cancellation")
+	}
+}
+
+func TestRssBackoffAndRetryAfter(t *testing.T) {
+	for n := 0; n < rssMaxRetries; n++ {
+		base := rssBackoffBase << uint(n)
+		if d := rssBackoff(n, 0); d < base || d > base+base/2 {
+			t.Fatalf("backoff %d out of range: %s", n, d)
+		}
+	}
+	if d := rssBackoff(0, 10*time.Second); d != 10*time.Second {
+		t.Fatalf("Retry-After should win over a shorter backoff, got %s", d)
+	}
+	if d := parseRetryAfter("120"); d != rssMaxRetryAfter {
+		t.Fatalf("Retry-After should be capped, got %s", d)
+	}
+	if d := parseRetryAfter("5"); d != 5*time.Second {
+		t.Fatalf("unexpected Retry-After: %s", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Fatalf("invalid Retry-After should be ignored, got %s", d)
+	}
+
+	limiter := &rssHostLimiter{hosts: make(map[string]time.Time)}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.wait(context.Background(), "limited.example"); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*rssHostInterval {
+		t.Fatalf("requests were not spaced out: %s", elapsed)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter.hold("limited.example", time.Minute)
+	if err := limiter.wait(ctx, "limited.example"); err == nil {
+		t.Fatalf("expected wait to honour cancellation")
+	}
+}
+
+func TestCountNewRssItems(t *testing.T) {
+	prev := []UnifiedRssItem{{Guid: "a"}, {Guid: "b"}}
+	next := []UnifiedRssItem{{Guid: "c"}, {Guid: "a"}, {Guid: "d"}}
+	if n := countNewRssItems(prev, next); n != 2 {
+		t.Fatalf("expected 2 new items, got %d", n)
+	}
+	if n := countNewRssItems(next, prev[:1]); n != 0 {
+		t.Fatalf("expected no new items, got %d", n)
+	}
+}
+
+func TestParseTorznabItems(t *testing.T) {
+	body := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:torznab="http://torznab.com/schemas/2015/feed">
+<channel><title>Indexer</title>
+<item>
+  <title>Some.Release.1080p</title>
+  <guid>https://indexer.example/details/42</guid>
+  <link>https://indexer.example/dl/42?apikey=secret</link>
+  <enclosure url="https://indexer.example/dl/42?apikey=secret" length="1234" type="application/x-bittorrent"/>
+  <torznab:attr name="size" value="4294967296"/>
+  <torznab:attr name="seeders" value="17"/>
+  <torznab:attr name="peers" value="20"/>
+  <torznab:attr name="category" value="2000"/>
+  <torznab:attr name="category" value="2040"/>
+  <torznab:attr name="infohash" value="ABCDEF"/>
+</item>
+</channel></rss>`)
+	items, err := parseRssItems(body)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("parse: %v %d", err, len(items))
+	}
+	info := items[0].Indexer
+	if info == nil || info.Size != 4294967296 || info.Seeders != 17 || info.Peers != 20 || info.InfoHash != "ABCDEF" {
+		t.Fatalf("unexpected indexer info: %+v", info)
+	}
+	if len(info.Categories) != 2 || info.Categories[1] != "2040" {
+		t.Fatalf("unexpected categories: %v", info.Categories)
+	}
+
+	if got := withIndexerApiKey("https://indexer.example/api?t=search", "k1"); got != "https://indexer.example/api?apikey=k1&t=search" {
+		t.Fatalf("unexpected api url: %s", got)
+	}
+	if got := redactRssUrl("https://indexer.example/api?apikey=k1&t=search"); got != "https://indexer.example/api?apikey=***&t=search" {
+		t.Fatalf("unexpected redacted url: %s", got)
+	}
+}
+
+func TestResolveYouTubeFeed(t *testing.T) {
+	cases := map[string]string{
+		"https://www.youtube.com/channel/UCBR8-60-B28hp2BmDPdntcQ":             youTubeFeedBase + "?channel_id=UCBR8-60-B28hp2BmDPdntcQ",
+		"https://youtube.com/playlist?list=PLbpi6ZahtOH6Blw3RGYpWkSByi_T7Rygb": youTubeFeedBase + "?playlist_id=PLbpi6ZahtOH6Blw3RGYpWkSByi_T7Rygb",
+	}
+	for pageUrl, want := range cases {
+		got, ok, err := resolveYouTubeFeed(context.Background(), pageUrl)
+		if err != nil || !ok || got != want {
+			t.Fatalf("resolveYouTubeFeed(%q) = %q, %v, %v", pageUrl, got, ok, err)
+		}
+	}
+	for _, pageUrl := range []string{"https://example.com/channel/x", youTubeFeedBase + "?channel_id=UCBR8-60-B28hp2BmDPdntcQ"} {
+		if _, ok, _ := resolveYouTubeFeed(context.Background(), pageUrl); ok {
+			t.Fatalf("%q should not be rewritten", pageUrl)
+		}
+	}
+
+	page := []byte(`<html><head><link rel="canonical" href="https://www.youtube.com/channel/UCBR8-60-B28hp2BmDPdntcQ"></head></html>`)
+	if id := extractYouTubeChannelID(page); id != "UCBR8-60-B28hp2BmDPdntcQ" {
+		t.Fatalf("unexpected channel id: %q", id)
+	}
+
+	feed, err := parseRssFeed([]byte(`<feed xmlns="http://www.w3.org/2005/Atom" xmlns:media="http://search.yahoo.com/mrss/">
+<title>Channel</title>
+<entry><id>yt:video:abc</id><title>Video</title><link rel="alternate" href="https://www.youtube.com/watch?v=abc"/>
+<published>2024-05-01T10:00:00+00:00</published>
+<media:group><media:thumbnail url="https://i.ytimg.com/vi/abc/hqdefault.jpg" width="480" height="360"/>
+<media:description>What this video is about</media:description></media:group></entry></feed>`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	item := feed.Items[0]
+	if item.ContentSnippet != "What this video is about" || item.Image != "https://i.ytimg.com/vi/abc/hqdefault.jpg" {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+}
+
+func TestResolveFeedSourceBridges(t *testing.T) {
+	cases := map[string]string{
+		"https://www.reddit.com/r/golang/":                "https://www.reddit.com/r/golang/.rss",
+		"https://old.reddit.com/r/selfhosted/top/?t=week": "https://www.reddit.com/r/selfhosted/top/.rss?t=week",
+		"https://www.reddit.com/u/spez":                   "https://www.reddit.com/user/spez/.rss",
+		"https://github.com/golang/go":                    "https://github.com/golang/go/releases.atom",
+		"https://github.com/golang/go/tags":               "https://github.com/golang/go/tags.atom",
+		"https://github.com/golang/go/commits/master":     "https://github.com/golang/go/commits/master.atom",
+		"https://github.com/torvalds":                     "https://github.com/torvalds.atom",
+		"https://medium.com/@someone":                     "https://medium.com/feed/@someone",
+		"https://mastodon.social/@Gargron":                "https://mastodon.social/@Gargron.rss",
+	}
+	for pageUrl, want := range cases {
+		got, ok, err := resolveFeedSource(context.Background(), pageUrl)
+		if err != nil || !ok || got != want {
+			t.Fatalf("resolveFeedSource(%q) = %q, %v, %v; want %q", pageUrl, got, ok, err, want)
+		}
+	}
+	for _, pageUrl := range []string{
+		"https://www.reddit.com/r/golang/.rss",
+		"https://github.com/golang/go/releases.atom",
+		"https://example.com/blog/feed",
+		"https://example.com/posts/1",
+	} {
+		if got, ok, _ := resolveFeedSource(context.Background(), pageUrl); ok {
+			t.Fatalf("%q should not be rewritten, got %q", pageUrl, got)
+		}
+	}
+}
+
+func TestRssCookieJarFollowsRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+			http.Redirect(w, r, "/feed", http.StatusFound)
+		case "/feed":
+			uid, err1 := r.Cookie("uid")
+			session, err2 := r.Cookie("session")
+			if err1 != nil || err2 != nil || uid.Value != "42" || session.Value != "abc" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`<rss><channel><item><title>Private</title><link>https://t.example/1</link></item></channel></rss>`))
+		}
+	}))
+	defer srv.Close()
+
+	profile := &RssFetchProfile{Cookie: "uid=42"}
+	attempts := buildRssAttempts(srv.URL+"/login", profile)
+	body, err := fetchRssBody(context.Background(), attempts[0].client, srv.URL+"/login", attempts[0].headers)
+	if err != nil {
+		t.Fatalf("fetch through cookie redirect: %v", err)
+	}
+	if items, err := parseRssItems(body); err != nil || len(items) != 1 {
+		t.Fatalf("unexpected feed: %v %d", err, len(items))
+	}
+}
+
+func TestDedupeRssItems(t *testing.T) {
+	items := dedupeRssItems([]UnifiedRssItem{
+		{Guid: "1", Link: "https://example.com/a?utm_source=rss"},
+		{Guid: "1", Link: "https://example.com/other"},
+		{Guid: "2", Link: "http://www.example.com/a/"},
+		{Guid: "3", Link: "https://example.com/b"},
+	})
+	if len(items) != 2 || items[0].Guid != "1" || items[1].Guid != "3" {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+
+	prev := []UnifiedRssItem{{Guid: "old-guid", Link: "https://example.com/a"}}
+	next := []UnifiedRssItem{{Guid: "new-guid", Link: "https://example.com/a#comments"}, {Guid: "x", Link: "https://example.com/c"}}
+	stabilizeRssGuids(prev, next)
+	if next[0].Guid != "old-guid" || next[1].Guid != "x" {
+		t.Fatalf("unexpected guids: %+v", next)
+	}
+	if n := countNewRssItems(prev, next); n != 1 {
+		t.Fatalf("republished item should not count as new, got %d", n)
+	}
+
+	timeline := dedupeRssTimeline([]RssTimelineItem{
+		{UnifiedRssItem: UnifiedRssItem{Link: "https://example.com/a"}, FeedUrl: "f1"},
+		{UnifiedRssItem: UnifiedRssItem{Link: "https://example.com/a/"}, FeedUrl: "f2"},
+		{UnifiedRssItem: UnifiedRssItem{Title: "no link"}, FeedUrl: "f2"},
+	})
+	if len(timeline) != 2 || timeline[0].FeedUrl != "f1" {
+		t.Fatalf("unexpected timeline: %+v", timeline)
+	}
+}
+
+func TestRssFeedTTLAndInvalidate(t *testing.T) {
+	if ttl := rssFeedTTL(nil); ttl != rssCacheTTL {
+		t.Fatalf("default ttl = %s", ttl)
+	}
+	if ttl := rssFeedTTL(map[string]interface{}{"cacheTTL": 360.0, "refreshInterval": 30.0}); ttl != 6*time.Hour {
+		t.Fatalf("cacheTTL override = %s", ttl)
+	}
+	if ttl := rssFeedTTL(map[string]interface{}{"refreshInterval": 30.0}); ttl != 30*time.Minute {
+		t.Fatalf("refreshInterval fallback = %s", ttl)
+	}
+	if ttl := rssFeedTTL(map[string]interface{}{"cacheTTL": 0.1}); ttl != minRssCacheTTL {
+		t.Fatalf("ttl should be clamped, got %s", ttl)
+	}
+
+	feedUrl := "https://invalidate.example/feed"
+	_ = sharedWidgetCache.Set(widgetCacheKindRSS, feedUrl, []UnifiedRssItem{{Guid: "1"}}, time.Hour, "ok")
+	_ = sharedWidgetCache.Set(widgetCacheKindRSSHTTP, feedUrl, rssValidators{ETag: `"v1"`}, time.Hour, "ok")
+	invalidateRssCache(feedUrl)
+	var items []UnifiedRssItem
+	has, fresh, _, _ := sharedWidgetCache.Get(widgetCacheKindRSS, feedUrl, &items)
+	if !has || fresh || len(items) != 1 {
+		t.Fatalf("items should be kept but stale: has=%v fresh=%v", has, fresh)
+	}
+	var validators rssValidators
+	if has, _, _, _ := sharedWidgetCache.Get(widgetCacheKindRSSHTTP, feedUrl, &validators); has {
+		t.Fatalf("validators should be dropped")
+	}
+}
+
+func TestFetchRssBodySizeLimit(t *testing.T) {
+	saved := maxRssBodySize
+	maxRssBodySize = 1024
+	defer func() { maxRssBodySize = saved }()
+
+	big := bytes.Repeat([]byte("x"), 4096)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// No Content-Length: the limit has to be enforced while reading
+			w.(http.Flusher).Flush()
+		}
+		w.Write(big)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, path := range []string{"/sized", "/chunked"} {
+		if _, err := fetchRssBody(context.Background(), client, srv.URL+path, nil); !errors.Is(err, errRssTooLarge) {
+			t.Fatalf("%s: expected errRssTooLarge, got %v", path, err)
+		}
+	}
+}
+
+func TestDiscoverFaviconLinks(t *testing.T) {
+	page := []byte(`<html><head>
+<link rel="apple-touch-icon" href="/touch.png">
+<link rel="stylesheet" href="/site.css">
+<link rel="shortcut icon" href="https://cdn.example.com/fav.ico">
+<link rel="icon" type="image/png" href="img/icon-32.png">
+</head><body><link rel="icon" href="/ignored.png"></body></html>`)
+	got := discoverFaviconLinks(page, "https://example.com/")
+	want := []string{"https://cdn.example.com/fav.ico", "https://example.com/img/icon-32.png", "https://example.com/touch.png"}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected icons: %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("icon %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRssSearchQuery(t *testing.T) {
+	query, err := parseRssSearchQuery(map[string]interface{}{
+		"query": "rtx 50",
+		"feeds": []interface{}{"https://a.example/feed"},
+		"since": "2024-05-01",
+		"limit": 9999.0,
+	})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if query.limit != maxRssSearchLimit || query.since != 1714521600000 || len(query.feeds) != 1 {
+		t.Fatalf("unexpected query: %+v", query)
+	}
+	if _, err := parseRssSearchQuery(map[string]interface{}{"query": "  "}); err == nil {
+		t.Fatalf("expected error for empty query")
+	}
+
+	match, err := compileRssSearch("RTX 50", false)
+	if err != nil || !match("New rtx 5090 deal") || match("RTX 4090") {
+		t.Fatalf("keyword search mismatch")
+	}
+	match, err = compileRssSearch(`cve-\d{4}-\d+`, true)
+	if err != nil || !match("Fix for CVE-2024-1234") || match("no cve here") {
+		t.Fatalf("regex search mismatch")
+	}
+	if _, err := compileRssSearch("(", true); err == nil {
+		t.Fatalf("expected invalid regex error")
+	}
+}
+
+func TestScrapeRssPage(t *testing.T) {
+	page := []byte(`<html><head><title>Local News</title></head><body>
+<ul class="news list">
+  <li class="story"><h3><a href="/2024/05/a.html">Bridge reopens</a></h3>
+    <time datetime="2024-05-02T08:00:00+02:00">2 May</time><p class="teaser">Traffic resumes.</p>
+    <img data-src="/img/a.jpg"></li>
+  <li class="story"><h3><a href="https://other.example/b">Market day</a></h3><p class="teaser">Stalls open.</p></li>
+  <li class="ad"><a href="/promo">Buy now</a></li>
+</ul>
+<div><li class="story"></li></div></body></html>`)
+	rule := &RssScrapeRule{Item: "ul.news > li.story", Title: "h3", Date: "time@datetime", Summary: "p.teaser", Image: "img"}
+	feed, err := scrapeRssPage(page, "https://news.example/index.html", rule)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	if feed.Title != "Local News" || len(feed.Items) != 2 {
+		t.Fatalf("unexpected feed: %+v", feed)
+	}
+	first := feed.Items[0]
+	if first.Title != "Bridge reopens" || first.Link != "https://news.example/2024/05/a.html" ||
+		first.PubDate != "2024-05-02T08:00:00+02:00" || first.ContentSnippet != "Traffic resumes." ||
+		first.Image != "https://news.example/img/a.jpg" || first.Guid != first.Link {
+		t.Fatalf("unexpected first item: %+v", first)
+	}
+	if feed.Items[1].Link != "https://other.example/b" {
+		t.Fatalf("unexpected second item: %+v", feed.Items[1])
+	}
+
+	for _, bad := range []string{"", "ul >", "li:hover", "[a"} {
+		if _, err := compileSelector(bad); err == nil {
+			t.Fatalf("expected error for selector %q", bad)
+		}
+	}
+}
+
+func TestFollowRssPages(t *testing.T) {
+	pages := map[string]string{
+		"/feed": `<feed xmlns="http://www.w3.org/2005/Atom"><title>Paged</title>
+<link rel="next" href="/feed?page=2"/>
+<entry><id>1</id><title>One</title><link href="https://p.example/1"/></entry></feed>`,
+		"/feed?page=2": `<feed xmlns="http://www.w3.org/2005/Atom"><title>Paged</title>
+<link rel="next" href="/feed?page=3"/>
+<entry><id>2</id><title>Two</title><link href="https://p.example/2"/></entry>
+<entry><id>1</id><title>One</title><link href="https://p.example/1"/></entry></feed>`,
+		"/feed?page=3": `<feed xmlns="http://www.w3.org/2005/Atom"><title>Paged</title>
+<link rel="next" href="/feed"/>
+<entry><id>3</id><title>Three</title><link href="https://p.example/3"/></entry></feed>`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(pages[r.URL.RequestURI()]))
+	}))
+	defer srv.Close()
+
+	for depth, want := range map[int]int{1: 1, 2: 2, 5: 3} {
+		feed, err := fetchRssFeedOnce(context.Background(), srv.URL+"/feed", rssFetchOptions{pageDepth: depth})
+		if err != nil {
+			t.Fatalf("depth %d: %v", depth, err)
+		}
+		if len(feed.Items) != want || feed.ItemCount != want {
+			t.Fatalf("depth %d: got %d items, want %d", depth, len(feed.Items), want)
+		}
+	}
+}
+
+func TestValidWebSubSignature(t *testing.T) {
+	body := []byte("<feed></feed>")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	header := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !validWebSubSignature(header, "secret", body) {
+		t.Fatalf("expected valid signature")
+	}
+	if validWebSubSignature(header, "other", body) {
+		t.Fatalf("expected signature with wrong secret to fail")
+	}
+	if validWebSubSignature("", "secret", body) {
+		t.Fatalf("expected missing signature to fail")
+	}
+}
+
+func TestRss2HubLink(t *testing.T) {
+	feed, err := parseRssFeed([]byte(`<rss xmlns:atom="http://www.w3.org/2005/Atom"><channel>
+<atom:link rel="hub" href="https://hub.example/"/>
+<atom:link rel="self" href="https://example.com/feed"/>
+<link>https://example.com/</link>
+<item><guid>1</guid><title>A</title></item>
+</channel></rss>`))
+	if err != nil || feed.hubUrl != "https://hub.example/" || feed.selfUrl != "https://example.com/feed" || feed.Link != "https://example.com/" {
+		t.Fatalf("unexpected links: hub %q self %q link %q, %v", feed.hubUrl, feed.selfUrl, feed.Link, err)
+	}
+}
+
+func TestVerifyWebSubMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prev := rssWebSub
+	defer func() { rssWebSub = prev }()
+	rssWebSub = &RssWebSub{
+		file: filepath.Join(t.TempDir(), "websub.json"),
+		subs: map[string]*RssWebSubscription{"abc": {Topic: "https://example.com/feed", Status: "active"}},
+	}
+	r := gin.New()
+	r.GET("/websub/:id", VerifyWebSub)
+	verify := func(mode string) int {
+		q := url.Values{"hub.mode": {mode}, "hub.topic": {"https://example.com/feed"}, "hub.challenge": {"x"}}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/websub/abc?"+q.Encode(), nil))
+		return w.Code
+	}
+
+	// Nothing was asked for, so nothing is confirmed
+	for _, mode := range []string{"subscribe", "unsubscribe", "denied"} {
+		if code := verify(mode); code != http.StatusNotFound {
+			t.Fatalf("%s without a pending request: got %d", mode, code)
+		}
+	}
+	if sub, _ := rssWebSub.get("abc"); sub.Status != "active" {
+		t.Fatalf("status changed to %q", sub.Status)
+	}
+
+	rssWebSub.subs["abc"].Pending = "subscribe"
+	if code := verify("unsubscribe"); code != http.StatusNotFound {
+		t.Fatalf("unsubscribe while subscribing: got %d", code)
+	}
+	if code := verify("subscribe"); code != http.StatusOK {
+		t.Fatalf("subscribe: got %d", code)
+	}
+	if sub, _ := rssWebSub.get("abc"); sub.Status != "active" || sub.Pending != "" {
+		t.Fatalf("unexpected subscription %+v", sub)
+	}
+	// A replay of the same verification is not honoured again
+	if code := verify("subscribe"); code != http.StatusNotFound {
+		t.Fatalf("replayed subscribe: got %d", code)
+	}
+}
+
+func TestMatchRssAlert(t *testing.T) {
+	items := []UnifiedRssItem{
+		{Guid: "1", Title: "RTX 5090 price drop"},
+		{Guid: "2", Title: "Weekly news"},
+		{Guid: "3", Title: "Nothing", ContentSnippet: "new rtx 5070 listing"},
+	}
+	hits := matchRssAlert(RssAlertRule{Match: []string{"/RTX 50/i"}}, items)
+	if len(hits) != 2 || hits[0].Guid != "1" || hits[1].Guid != "3" {
+		t.Fatalf("unexpected hits: %+v", hits)
+	}
+	off := false
+	rule := RssAlertRule{Enable: &off}
+	if rule.appliesTo("https://example.com/feed") {
+		t.Fatalf("expected disabled rule to be skipped")
+	}
+	rule = RssAlertRule{Feeds: []string{"https://a.example/feed"}}
+	if rule.appliesTo("https://b.example/feed") || !rule.appliesTo("https://a.example/feed") {
+		t.Fatalf("unexpected feed scoping")
+	}
+	many := make([]UnifiedRssItem, maxRssAlertsPerRule+3)
+	if got := rssAlertNotifications(rule, "Feed", many); len(got) != maxRssAlertsPerRule+1 {
+		t.Fatalf("expected %d notifications, got %d", maxRssAlertsPerRule+1, len(got))
+	}
+}
+
+func TestDecompressRssReader(t *testing.T) {
+	decompressRssBody := func(body []byte, encoding string) ([]byte, error) {
+		r, err := decompressRssReader(bytes.NewReader(body), encoding)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+	feed := []byte(`<?xml version="1.0"?><rss><channel><item><title>A</title></item></channel></rss>`)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(feed)
+	zw.Close()
+	// Compressed even though no Content-Encoding was sent
+	got, err := decompressRssBody(gz.Bytes(), "")
+	if err != nil || !bytes.Equal(got, feed) {
+		t.Fatalf("unexpected gzip result: %q %v", got, err)
+	}
+	var raw bytes.Buffer
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	fw.Write(feed)
+	fw.Close()
+	got, err = decompressRssBody(raw.Bytes(), "deflate")
+	if err != nil || !bytes.Equal(got, feed) {
+		t.Fatalf("unexpected raw deflate result: %q %v", got, err)
+	}
+	if _, err := decompressRssBody(feed, "br"); !errors.Is(err, errRssBrotli) {
+		t.Fatalf("expected brotli error, got %v", err)
+	}
+}
+
+func TestNormalizeRssCharset(t *testing.T) {
+	// GBK bytes for "中文" in a feed that claims to be UTF-8
+	gbk := append([]byte(`<?xml version="1.0" encoding="UTF-8"?><rss><channel><item><title>`), 0xD6, 0xD0, 0xCE, 0xC4)
+	gbk = append(gbk, []byte(`</title></item></channel></rss>`)...)
+	items, err := parseRssItems(normalizeRssCharset(gbk, "application/rss+xml; charset=gbk"))
+	if err != nil || len(items) != 1 || items[0].Title != "中文" {
+		t.Fatalf("unexpected GBK result: %+v %v", items, err)
+	}
+	// UTF-8 body with a stale GB2312 declaration
+	utf := []byte(`<?xml version="1.0" encoding="gb2312"?><rss><channel><item><title>中文</title></item></channel></rss>`)
+	items, err = parseRssItems(utf)
+	if err != nil || len(items) != 1 || items[0].Title != "中文" {
+		t.Fatalf("unexpected UTF-8 result: %+v %v", items, err)
+	}
+	// Unknown labels are read as UTF-8
+	bogus := []byte(`<?xml version="1.0" encoding="x-made-up"?><rss><channel><item><title>ok</title></item></channel></rss>`)
+	if items, err := parseRssItems(bogus); err != nil || len(items) != 1 {
+		t.Fatalf("unexpected bogus-label result: %+v %v", items, err)
+	}
+}
+
+// endlessFeed serves an RSS channel whose items never end
+type endlessFeed struct {
+	pending []byte
+	n       int
+}
+
+func (f *endlessFeed) Read(p []byte) (int, error) {
+	if len(f.pending) == 0 {
+		if f.n == 0 {
+			f.pending = []byte(`<rss><channel><title>Endless</title>`)
+		} else {
+			f.pending = []byte(fmt.Sprintf(`<item><guid>%d</guid><title>Item %d</title></item>`, f.n, f.n))
+		}
+		f.n++
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func TestDecodeRssFeedStream(t *testing.T) {
+	var body strings.Builder
+	body.WriteString(`<rss xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>Many</title>`)
+	for i := 0; i < maxRssItems+50; i++ {
+		fmt.Fprintf(&body, `<item><guid>%d</guid><title>Item %d</title></item>`, i, i)
+	}
+	// Channel elements after the items still count
+	body.WriteString(`<atom:link rel="hub" href="https://hub.example/"/></channel></rss>`)
+	feed, err := parseRssFeedReader(strings.NewReader(body.String()), "")
+	if err != nil || len(feed.Items) != maxRssItems || feed.Title != "Many" || feed.hubUrl != "https://hub.example/" {
+		t.Fatalf("unexpected feed: %d items, title %q, hub %q, %v", len(feed.Items), feed.Title, feed.hubUrl, err)
+	}
+
+	// GBK with no declaration, named by the Content-Type only
+	gbk := append([]byte(`<feed xmlns="http://www.w3.org/2005/Atom"><entry><id>1</id><title>`), 0xD6, 0xD0, 0xCE, 0xC4)
+	gbk = append(gbk, []byte(`</title></entry></feed>`)...)
+	feed, err = parseRssFeedReader(bytes.NewReader(gbk), "application/atom+xml; charset=gbk")
+	if err != nil || len(feed.Items) != 1 || feed.Items[0].Title != "中文" {
+		t.Fatalf("unexpected GBK result: %+v %v", feed, err)
+	}
+
+	if _, err := parseRssFeedReader(strings.NewReader(`<rss><channel><title>Empty</title></channel></rss>`), ""); !errors.Is(err, errRssNoItems) {
+		t.Fatalf("expected errRssNoItems, got %v", err)
+	}
+
+	saved := maxRssBodySize
+	maxRssBodySize = 64 << 10
+	defer func() { maxRssBodySize = saved }()
+	if _, err := parseRssFeedReader(newRssLimitedReader(&endlessFeed{}), ""); !errors.Is(err, errRssTooLarge) {
+		t.Fatalf("expected errRssTooLarge for an endless feed, got %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		io.Copy(w, io.LimitReader(&endlessFeed{}, 1<<20))
+	}))
+	defer srv.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	if _, err := fetchRssFeedBody(context.Background(), client, srv.URL, nil); !errors.Is(err, errRssTooLarge) {
+		t.Fatalf("expected errRssTooLarge fetching an endless feed, got %v", err)
+	}
+}
+
+func TestRssExportFormats(t *testing.T) {
+	if id, format := splitRssExportID("42.json"); id != "42" || format != "json" {
+		t.Fatalf("unexpected split: %s %s", id, format)
+	}
+	if id, format := splitRssExportID("all"); id != "all" || format != "rss" {
+		t.Fatalf("unexpected split: %s %s", id, format)
+	}
+	export := rssExport{title: "Feed", items: []RssTimelineItem{{
+		UnifiedRssItem: UnifiedRssItem{Guid: "g1", Title: "A & B", Link: "https://example.com/a", Timestamp: 1700000000000, ContentSnippet: "text"},
+		FeedTitle:      "Example",
+	}}}
+	data, err := xml.Marshal(export.rss2("http://nas/api/rss/export/all"))
+	if err != nil {
+		t.Fatalf("marshal rss: %v", err)
+	}
+	items, err := parseRssItems(data)
+	if err != nil || len(items) != 1 || items[0].Title != "A & B" || items[0].Timestamp != 1700000000000 {
+		t.Fatalf("exported RSS does not round-trip: %+v %v", items, err)
+	}
+	data, err = json.Marshal(export.jsonFeed("http://nas/api/rss/export/all.json"))
+	if err != nil {
+		t.Fatalf("marshal json feed: %v", err)
+	}
+	items, err = parseRssItems(data)
+	if err != nil || len(items) != 1 || items[0].Guid != "g1" {
+		t.Fatalf("exported JSON Feed does not round-trip: %+v %v", items, err)
+	}
+}
+
+func TestRssDigest(t *testing.T) {
+	now := time.Date(2024, 5, 1, 9, 30, 0, 0, time.Local)
+	due, ok := rssDigestDueAt("08:15", now)
+	if !ok || due.Hour() != 8 || due.Minute() != 15 || due.Day() != 1 {
+		t.Fatalf("unexpected due time: %v %v", due, ok)
+	}
+	if _, ok := rssDigestDueAt("25:99", now); ok {
+		t.Fatalf("expected invalid time to be rejected")
+	}
+	n := buildRssDigest([]RssTimelineItem{
+		{UnifiedRssItem: UnifiedRssItem{Title: "<b>One</b>", Link: "https://a.example/1"}, FeedTitle: "A"},
+		{UnifiedRssItem: UnifiedRssItem{Title: "Two", Link: "https://b.example/2"}, FeedTitle: "B"},
+	}, now)
+	if !strings.Contains(n.Title, "2 new items") || !strings.Contains(n.Html, "&lt;b&gt;One") || !strings.Contains(n.Body, "https://b.example/2") {
+		t.Fatalf("unexpected digest: %+v", n)
+	}
+	msg := string(buildEmailMessage("nas@example.com", []string{"me@example.com"}, n))
+	if !strings.Contains(msg, "multipart/alternative") || !strings.Contains(msg, "To: me@example.com") {
+		t.Fatalf("unexpected email message: %s", msg)
+	}
+}
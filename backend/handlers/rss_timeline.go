@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"flatnasgo-backend/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+const (
+	defaultRssTimelinePageSize = 50
+	maxRssTimelinePageSize     = 200
+)
+
+// RssTimelineItem is a feed item annotated with the feed it came from
+type RssTimelineItem struct {
+	UnifiedRssItem
+	FeedUrl   string `json:"feedUrl"`
+	FeedTitle string `json:"feedTitle"`
+	FeedIcon  string `json:"feedIcon,omitempty"`
+	Category  string `json:"category,omitempty"`
+}
+
+type RssTimelinePage struct {
+	Items    []RssTimelineItem `json:"items"`
+	Total    int               `json:"total"`
+	Page     int               `json:"page"`
+	PageSize int               `json:"pageSize"`
+	HasMore  bool              `json:"hasMore"`
+}
+
+type rssTimelineQuery struct {
+	page     int
+	pageSize int
+	category string
+	dedupe   bool // Drop items syndicated by more than one feed
+}
+
+func BindRssTimelineHandlers(server *socketio.Server) {
+	bindEvent(server, "rss:timeline", func(s socketio.Conn, msg interface{}) {
+		m, _ := msg.(map[string]interface{})
+		query := rssTimelineQuery{category: strings.TrimSpace(stringField(m, "category"))}
+		if v, ok := m["page"].(float64); ok {
+			query.page = int(v)
+		}
+		if v, ok := m["pageSize"].(float64); ok {
+			query.pageSize = int(v)
+		}
+		query.dedupe, _ = m["dedupe"].(bool)
+		s.Emit("rss:timelineData", buildRssTimeline(rssRequestUser(msg), query))
+	})
+}
+
+func GetRssTimeline(c *gin.Context) {
+	query := rssTimelineQuery{category: strings.TrimSpace(c.Query("category"))}
+	query.page, _ = strconv.Atoi(c.Query("page"))
+	query.pageSize, _ = strconv.Atoi(c.Query("pageSize"))
+	query.dedupe, _ = strconv.ParseBool(c.Query("dedupe"))
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": buildRssTimeline(c.GetString("username"), query)})
+}
+
+func stringField(m map[string]interface{}, key string) string {
+	v, _ := m[key].(string)
+	return v
+}
+
+// buildRssTimeline merges the cached items of the user's enabled feeds,
+// newest first.
+func buildRssTimeline(username string, query rssTimelineQuery) RssTimelinePage {
+	if query.page < 1 {
+		query.page = 1
+	}
+	if query.pageSize <= 0 {
+		query.pageSize = defaultRssTimelinePageSize
+	}
+	if query.pageSize > maxRssTimelinePageSize {
+		query.pageSize = maxRssTimelinePageSize
+	}
+
+	merged := collectRssTimelineItems(username, query.category)
+	sortRssTimeline(merged)
+	if query.dedupe {
+		merged = dedupeRssTimeline(merged)
+	}
+
+	page := RssTimelinePage{
+		Items:    []RssTimelineItem{},
+		Total:    len(merged),
+		Page:     query.page,
+		PageSize: query.pageSize,
+	}
+	start := (query.page - 1) * query.pageSize
+	if start < len(merged) {
+		end := start + query.pageSize
+		if end > len(merged) {
+			end = len(merged)
+		}
+		page.Items = merged[start:end]
+		page.HasMore = end < len(merged)
+	}
+	return page
+}
+
+// collectRssTimelineItems returns the cached items of the user's enabled
+// feeds, unsorted, with read/saved flags applied. Guests only see public
+// feeds of the admin dashboard.
+func collectRssTimelineItems(username, category string) []RssTimelineItem {
+	isGuest := username == ""
+	if isGuest {
+		username = "admin"
+	}
+
+	var userData map[string]interface{}
+	_ = utils.ReadJSON(resolveUserDataFile(username), &userData)
+	feeds, _ := userData["rssFeeds"].([]interface{})
+
+	var state *RssUserState
+	if !isGuest {
+		loaded := loadRssState(username)
+		state = &loaded
+	}
+
+	merged := make([]RssTimelineItem, 0)
+	seen := make(map[string]struct{})
+	for _, f := range feeds {
+		fm, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if enabled, _ := fm["enable"].(bool); !enabled {
+			continue
+		}
+		if isPublic, _ := fm["isPublic"].(bool); isGuest && !isPublic {
+			continue
+		}
+		feedCategory, _ := fm["category"].(string)
+		if category != "" && feedCategory != category {
+			continue
+		}
+		feedUrl := strings.TrimSpace(stringField(fm, "url"))
+		if feedUrl == "" {
+			continue
+		}
+		if _, exists := seen[feedUrl]; exists {
+			continue
+		}
+		seen[feedUrl] = struct{}{}
+
+		var items []UnifiedRssItem
+		if _, _, _, err := sharedWidgetCache.Get(widgetCacheKindRSS, feedUrl, &items); err != nil {
+			continue
+		}
+		if state != nil {
+			items, _ = applyRssState(items, state, feedUrl)
+		}
+		title := stringField(fm, "title")
+		var meta UnifiedFeed
+		_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSSMeta, feedUrl, &meta)
+		icon := meta.Favicon
+		if icon == "" {
+			icon = meta.Icon
+		}
+		for _, item := range items {
+			merged = append(merged, RssTimelineItem{
+				UnifiedRssItem: item,
+				FeedUrl:        feedUrl,
+				FeedTitle:      title,
+				FeedIcon:       icon,
+				Category:       feedCategory,
+			})
+		}
+	}
+	return merged
+}
+
+// sortRssTimeline orders items newest first; undated items go last in
+// their original feed order.
+func sortRssTimeline(items []RssTimelineItem) {
+	stamps := make([]int64, len(items))
+	for i := range items {
+		stamps[i] = rssItemTime(items[i].UnifiedRssItem)
+	}
+	idx := make([]int, len(items))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return stamps[idx[a]] > stamps[idx[b]]
+	})
+	sorted := make([]RssTimelineItem, len(items))
+	for i, j := range idx {
+		sorted[i] = items[j]
+	}
+	copy(items, sorted)
+}
+
+// rssItemTime returns the item's publish time in Unix ms, 0 if unknown.
+// Items cached before timestamps were stored still need parsing.
+func rssItemTime(item UnifiedRssItem) int64 {
+	if item.Timestamp != 0 {
+		return item.Timestamp
+	}
+	if t := parseRssDate(item.PubDate); !t.IsZero() {
+		return t.UnixMilli()
+	}
+	return 0
+}
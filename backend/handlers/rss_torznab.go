@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Query parameters that carry indexer credentials
+var rssSecretParams = []string{"apikey", "api_key", "passkey"}
+
+// IndexerAttr is a torznab:attr (http://torznab.com/schemas/2015/feed) or
+// newznab:attr element
+type IndexerAttr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// RssIndexerInfo carries the Torznab/Newznab attributes of a search result
+type RssIndexerInfo struct {
+	Size       int64    `json:"size,omitempty"` // Bytes
+	Seeders    int      `json:"seeders,omitempty"`
+	Peers      int      `json:"peers,omitempty"`
+	Grabs      int      `json:"grabs,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+	InfoHash   string   `json:"infoHash,omitempty"`
+	MagnetUrl  string   `json:"magnetUrl,omitempty"`
+}
+
+// pickIndexerInfo collects indexer attributes of an RSS 2.0 item; it
+// returns nil for ordinary feeds.
+func pickIndexerInfo(item Rss2Item) *RssIndexerInfo {
+	attrs := append(append([]IndexerAttr{}, item.TorznabAttrs...), item.NewznabAttrs...)
+	if len(attrs) == 0 {
+		return nil
+	}
+	info := &RssIndexerInfo{}
+	for _, attr := range attrs {
+		value := strings.TrimSpace(attr.Value)
+		switch strings.ToLower(strings.TrimSpace(attr.Name)) {
+		case "size":
+			info.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "seeders":
+			info.Seeders, _ = strconv.Atoi(value)
+		case "peers":
+			info.Peers, _ = strconv.Atoi(value)
+		case "grabs":
+			info.Grabs, _ = strconv.Atoi(value)
+		case "category":
+			if value != "" {
+				info.Categories = append(info.Categories, value)
+			}
+		case "infohash":
+			info.InfoHash = value
+		case "magneturl":
+			info.MagnetUrl = value
+		}
+	}
+	if info.Size == 0 {
+		info.Size, _ = strconv.ParseInt(strings.TrimSpace(item.Size), 10, 64)
+	}
+	if enc := pickRss2Enclosure(item); info.Size == 0 && enc != nil {
+		info.Size = enc.Length
+	}
+	return info
+}
+
+// withIndexerApiKey adds the feed's configured API key to an indexer URL.
+// Keeping the key out of the stored URL keeps it away from guests and logs.
+func withIndexerApiKey(feedUrl, apiKey string) string {
+	apiKey = strings.TrimSpace(apiKey)
+	if apiKey == "" {
+		return feedUrl
+	}
+	parsed, err := url.Parse(feedUrl)
+	if err != nil {
+		return feedUrl
+	}
+	query := parsed.Query()
+	if query.Get("apikey") != "" {
+		return feedUrl
+	}
+	query.Set("apikey", apiKey)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+func rssFeedApiKey(fm map[string]interface{}) string {
+	apiKey, _ := fm["apiKey"].(string)
+	return apiKey
+}
+
+// redactRssUrl masks credential query parameters for logs and error messages
+func redactRssUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.RawQuery == "" {
+		return rawUrl
+	}
+	query := parsed.Query()
+	changed := false
+	for key := range query {
+		for _, secret := range rssSecretParams {
+			if strings.EqualFold(key, secret) {
+				query.Set(key, "***")
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return rawUrl
+	}
+	parsed.RawQuery = strings.ReplaceAll(query.Encode(), "%2A%2A%2A", "***")
+	return parsed.String()
+}
+
+// redactRssError strips credentials from the URL embedded in client errors
+func redactRssError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactRssUrl(urlErr.URL)
+	}
+	return err
+}
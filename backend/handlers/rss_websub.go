@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// webSubLease is the lease we ask hubs for; they may grant less
+	webSubLease = 10 * 24 * time.Hour
+	// webSubRenewBefore renews a subscription this long before it expires
+	webSubRenewBefore = 24 * time.Hour
+	// webSubRetryAfter spaces out attempts for hubs that failed
+	webSubRetryAfter = 6 * time.Hour
+)
+
+// RssWebSubscription is one WebSub subscription, keyed by its callback ID
+type RssWebSubscription struct {
+	FeedUrl     string `json:"feedUrl"` // Cache key of the feed
+	Topic       string `json:"topic"`
+	Hub         string `json:"hub"`
+	Secret      string `json:"secret"`
+	Status      string `json:"status"`            // "pending", "active", "denied" or "error"
+	Pending     string `json:"pending,omitempty"` // hub.mode of the request awaiting verification
+	Expires     int64  `json:"expires"`           // Unix timestamp in ms
+	LastAttempt int64  `json:"lastAttempt"`       // Unix timestamp in ms
+}
+
+// RssWebSub manages WebSub subscriptions. They are only made when
+// WEBSUB_CALLBACK_BASE is set to the externally reachable base URL of
+// FlatNas, since hubs have to call back into the NAS.
+type RssWebSub struct {
+	mu   sync.Mutex
+	subs map[string]*RssWebSubscription
+	file string
+}
+
+var rssWebSub = &RssWebSub{}
+
+func webSubCallbackBase() string {
+	return strings.TrimRight(strings.TrimSpace(os.Getenv("WEBSUB_CALLBACK_BASE")), "/")
+}
+
+func webSubID(feedUrl string) string {
+	sum := sha1.Sum([]byte(feedUrl))
+	return hex.EncodeToString(sum[:10])
+}
+
+func (w *RssWebSub) load() {
+	if w.subs != nil {
+		return
+	}
+	w.file = filepath.Join(config.DataDir, "websub.json")
+	w.subs = make(map[string]*RssWebSubscription)
+	_ = utils.ReadJSON(w.file, &w.subs)
+	if w.subs == nil {
+		w.subs = make(map[string]*RssWebSubscription)
+	}
+}
+
+func (w *RssWebSub) saveLocked() {
+	if err := utils.WriteJSON(w.file, w.subs); err != nil {
+		rssLog.Error("Failed to write WebSub subscriptions", "error", err)
+	}
+}
+
+// ensure subscribes to the hub of a feed unless a live subscription exists
+func (w *RssWebSub) ensure(feedUrl, hub, topic string) {
+	base := webSubCallbackBase()
+	if base == "" {
+		return
+	}
+	if topic == "" {
+		topic = feedUrl
+	}
+	id := webSubID(feedUrl)
+	now := time.Now()
+
+	w.mu.Lock()
+	w.load()
+	sub := w.subs[id]
+	if sub != nil && sub.Hub == hub && sub.Topic == topic {
+		renewAt := sub.Expires - webSubRenewBefore.Milliseconds()
+		if sub.Status == "active" && now.UnixMilli() < renewAt {
+			w.mu.Unlock()
+			return
+		}
+		if now.UnixMilli()-sub.LastAttempt < webSubRetryAfter.Milliseconds() {
+			w.mu.Unlock()
+			return
+		}
+	}
+	if sub == nil || sub.Hub != hub || sub.Topic != topic {
+		sub = &RssWebSubscription{FeedUrl: feedUrl, Topic: topic, Hub: hub, Secret: newWebSubSecret()}
+		w.subs[id] = sub
+	}
+	sub.Status = "pending"
+	sub.Pending = "subscribe"
+	sub.LastAttempt = now.UnixMilli()
+	request := *sub
+	w.saveLocked()
+	w.mu.Unlock()
+
+	go func() {
+		if err := postWebSubRequest(backgroundCtx, "subscribe", request, base+"/api/rss/websub/"+id); err != nil {
+			rssLog.Warn("WebSub subscribe failed", "feed", redactRssUrl(feedUrl), "hub", hub, "error", err)
+			w.setStatus(id, "error", 0)
+		}
+	}()
+}
+
+func (w *RssWebSub) setStatus(id, status string, lease time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.load()
+	sub := w.subs[id]
+	if sub == nil {
+		return
+	}
+	sub.Status = status
+	sub.Pending = ""
+	if lease > 0 {
+		sub.Expires = time.Now().Add(lease).UnixMilli()
+	}
+	w.saveLocked()
+}
+
+// verify settles the pending request of a subscription. Only the mode we
+// asked for is honoured, so a third party cannot confirm or cancel a
+// subscription by calling the callback with another one.
+func (w *RssWebSub) verify(id, topic, mode, status string, lease time.Duration) bool {
+	w.mu.Lock()
+	pending := false
+	if w.load(); w.subs[id] != nil {
+		sub := w.subs[id]
+		pending = sub.Topic == topic && sub.Pending != "" && (mode == sub.Pending || mode == "denied")
+	}
+	w.mu.Unlock()
+	if pending {
+		w.setStatus(id, status, lease)
+	}
+	return pending
+}
+
+func (w *RssWebSub) get(id string) (RssWebSubscription, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.load()
+	sub := w.subs[id]
+	if sub == nil {
+		return RssWebSubscription{}, false
+	}
+	return *sub, true
+}
+
+func newWebSubSecret() string {
+	buf := make([]byte, 24)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func postWebSubRequest(ctx context.Context, mode string, sub RssWebSubscription, callback string) error {
+	form := url.Values{
+		"hub.mode":          {mode},
+		"hub.topic":         {sub.Topic},
+		"hub.callback":      {callback},
+		"hub.secret":        {sub.Secret},
+		"hub.lease_seconds": {strconv.Itoa(int(webSubLease.Seconds()))},
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.Hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", defaultRssUserAgent)
+	resp, err := (&http.Client{Timeout: 30 * time.Second, Transport: rssDirectTransport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hub returned HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// VerifyWebSub answers the hub's intent verification (and denials) for a
+// subscription callback
+func VerifyWebSub(c *gin.Context) {
+	id := c.Param("id")
+	sub, ok := rssWebSub.get(id)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	topic := c.Query("hub.topic")
+	if topic != sub.Topic {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	var verified bool
+	switch mode := c.Query("hub.mode"); mode {
+	case "subscribe":
+		lease, _ := strconv.Atoi(c.Query("hub.lease_seconds"))
+		if lease <= 0 {
+			lease = int(webSubLease.Seconds())
+		}
+		verified = rssWebSub.verify(id, topic, mode, "active", time.Duration(lease)*time.Second)
+	case "unsubscribe":
+		verified = rssWebSub.verify(id, topic, mode, "inactive", 0)
+	case "denied":
+		if rssWebSub.verify(id, topic, mode, "denied", 0) {
+			c.Status(http.StatusOK)
+		} else {
+			c.Status(http.StatusNotFound)
+		}
+		return
+	default:
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if !verified {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.String(http.StatusOK, c.Query("hub.challenge"))
+}
+
+// ReceiveWebSub accepts content pushed by a hub, checks its signature and
+// merges the new items into the feed's cache.
+func ReceiveWebSub(c *gin.Context) {
+	id := c.Param("id")
+	sub, ok := rssWebSub.get(id)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxRssBodySize+1))
+	if err != nil || int64(len(body)) > maxRssBodySize {
+		c.Status(http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Per the spec, invalid signatures are acknowledged but ignored
+	if !validWebSubSignature(c.GetHeader("X-Hub-Signature"), sub.Secret, body) {
+		rssLog.Warn("WebSub: ignoring unsigned or mis-signed content", "feed", redactRssUrl(sub.FeedUrl))
+		c.Status(http.StatusAccepted)
+		return
+	}
+	c.Status(http.StatusAccepted)
+
+	feed, err := parseRssFeed(body)
+	if err != nil {
+		// Fat pings are optional; fall back to fetching the feed
+		go refreshRss(socketServer, sub.FeedUrl)
+		return
+	}
+	go applyWebSubContent(sub.FeedUrl, feed)
+}
+
+// applyWebSubContent prepends pushed items to the cached ones, since hubs
+// usually deliver only what changed.
+func applyWebSubContent(feedUrl string, pushed *UnifiedFeed) {
+	var cached []UnifiedRssItem
+	_, _, _, _ = sharedWidgetCache.Get(widgetCacheKindRSS, feedUrl, &cached)
+	var meta UnifiedFeed
+	if has, _, _, _ := sharedWidgetCache.Get(widgetCacheKindRSSMeta, feedUrl, &meta); !has {
+		meta = *pushed
+	}
+	filter := loadRssItemFilter(findRssFeedConfig(feedUrl))
+	merged := dedupeRssItems(append(filter.apply(pushed.Items), cached...))
+	if len(merged) > maxRssItems {
+		merged = merged[:maxRssItems]
+	}
+	meta.Items = merged
+	meta.ItemCount = len(merged)
+	fresh := newRssItems(cached, merged)
+	newItems := len(fresh)
+	_ = storeRssFeed(feedUrl, &meta)
+	if len(cached) > 0 {
+		evaluateRssAlerts(feedUrl, meta.Title, fresh)
+	}
+	rssScheduler.markRefreshed(feedUrl, "ok")
+	if newItems > 0 {
+		broadcastRoom(rssRoom(feedUrl), "rss:data", map[string]interface{}{
+			"url": feedUrl,
+			"data": map[string]interface{}{
+				"items":    limitRssSnippets(merged, defaultRssSnippetLength),
+				"newItems": newItems,
+			},
+		})
+	}
+}
+
+// validWebSubSignature checks an X-Hub-Signature header of the form
+// "sha256=<hex>"; sha1, sha384 and sha512 are accepted as well.
+func validWebSubSignature(header, secret string, body []byte) bool {
+	method, signature, ok := strings.Cut(strings.TrimSpace(header), "=")
+	if !ok || secret == "" {
+		return false
+	}
+	var newHash func() hash.Hash
+	switch strings.ToLower(method) {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha384":
+		newHash = sha512.New384
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	youTubeFeedBase = "https://www.youtube.com/feeds/videos.xml"
+	// rssSourceTTL keeps resolved feed URLs; channel IDs never change
+	rssSourceTTL = 30 * 24 * time.Hour
+)
+
+var (
+	youTubeChannelID      = regexp.MustCompile(`^UC[0-9A-Za-z_-]{22}$`)
+	youTubeChannelPattern = []*regexp.Regexp{
+		regexp.MustCompile(`<link rel="canonical" href="https://www\.youtube\.com/channel/(UC[0-9A-Za-z_-]{22})"`),
+		regexp.MustCompile(`<meta itemprop="(?:channelId|identifier)" content="(UC[0-9A-Za-z_-]{22})"`),
+		regexp.MustCompile(`"(?:channelId|externalId|browseId)":"(UC[0-9A-Za-z_-]{22})"`),
+	}
+)
+
+func isYouTubeHost(host string) bool {
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	host = strings.TrimPrefix(host, "m.")
+	return host == "youtube.com" || host == "music.youtube.com"
+}
+
+// resolveYouTubeFeed maps a channel, handle or playlist page URL to its
+// videos.xml feed. ok is false for URLs that are not YouTube pages.
+func resolveYouTubeFeed(ctx context.Context, pageUrl string) (string, bool, error) {
+	parsed, err := url.Parse(pageUrl)
+	if err != nil || !isYouTubeHost(parsed.Host) {
+		return "", false, nil
+	}
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	switch {
+	case segments[0] == "feeds":
+		return "", false, nil
+	case parsed.Query().Get("list") != "":
+		return youTubeFeedBase + "?playlist_id=" + url.QueryEscape(parsed.Query().Get("list")), true, nil
+	case segments[0] == "channel" && len(segments) > 1 && youTubeChannelID.MatchString(segments[1]):
+		return youTubeFeedBase + "?channel_id=" + segments[1], true, nil
+	case strings.HasPrefix(segments[0], "@"), segments[0] == "c", segments[0] == "user":
+		var cached string
+		if has, _, _, err := sharedWidgetCache.Get(widgetCacheKindRSSSource, pageUrl, &cached); err == nil && has && cached != "" {
+			return cached, true, nil
+		}
+		channelID, err := fetchYouTubeChannelID(ctx, pageUrl)
+		if err != nil {
+			return "", true, err
+		}
+		feedUrl := youTubeFeedBase + "?channel_id=" + channelID
+		_ = sharedWidgetCache.Set(widgetCacheKindRSSSource, pageUrl, feedUrl, rssSourceTTL, "ok")
+		return feedUrl, true, nil
+	}
+	return "", false, nil
+}
+
+// fetchYouTubeChannelID reads the channel ID out of a channel page
+func fetchYouTubeChannelID(ctx context.Context, pageUrl string) (string, error) {
+	var lastErr error
+	for _, attempt := range buildRssAttempts(pageUrl, nil) {
+		// Skip the EU consent interstitial
+		attempt.headers["Cookie"] = "CONSENT=YES+1"
+		body, err := fetchRssBody(ctx, attempt.client, pageUrl, attempt.headers)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if id := extractYouTubeChannelID(body); id != "" {
+			return id, nil
+		}
+		lastErr = fmt.Errorf("channel id not found on page")
+	}
+	return "", lastErr
+}
+
+func extractYouTubeChannelID(page []byte) string {
+	for _, pattern := range youTubeChannelPattern {
+		if m := pattern.FindSubmatch(page); m != nil {
+			return string(m[1])
+		}
+	}
+	return ""
+}
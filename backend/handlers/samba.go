@@ -0,0 +1,567 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The admin manages the share sections of smb.conf ($SMB_CONF, by default
+// /etc/samba/smb.conf) from the dashboard. Only the keys below are
+// touched; other keys, comments and the [global], [homes] and printer
+// sections are kept as they are. Changes are checked with testparm before
+// they replace the file. In Docker, mount the host's /etc/samba and give
+// the container the Samba tools to use this.
+
+const (
+	systemCommandTimeout = 15 * time.Second
+	sambaDefaultConf     = "/etc/samba/smb.conf"
+)
+
+var (
+	errNoSamba           = errors.New("Samba is not installed")
+	errSambaShareMissing = errors.New("Samba share not found")
+	errInvalidSambaShare = errors.New("Invalid Samba share")
+)
+
+// Sections that are not file shares
+var sambaReservedSections = map[string]bool{"global": true, "homes": true, "printers": true, "print$": true}
+
+var (
+	sambaShareNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._$-]{0,79}$`)
+	sambaUserRe      = regexp.MustCompile(`^[@+&]?[A-Za-z0-9][A-Za-z0-9._\\-]{0,63}$`)
+)
+
+// Keys a parameter may be spelled as; the first is what gets written
+var (
+	sambaKeyReadOnly   = []string{"read only", "writeable", "writable", "write ok"} // All but the first mean the opposite
+	sambaKeyGuestOk    = []string{"guest ok", "public"}
+	sambaKeyBrowseable = []string{"browseable", "browsable"}
+)
+
+// sambaConfMu serializes edits of smb.conf
+var sambaConfMu sync.Mutex
+
+// SambaShare is the managed part of a share section
+type SambaShare struct {
+	Name       string   `json:"name"`
+	Path       string   `json:"path"`
+	Comment    string   `json:"comment,omitempty"`
+	ReadOnly   bool     `json:"readOnly"`
+	Browseable bool     `json:"browseable"`
+	GuestOk    bool     `json:"guestOk"`
+	ValidUsers []string `json:"validUsers"` // Users and @groups; empty allows every account
+	Recycle    bool     `json:"recycle"`    // Deleted files go to .recycle/<user>
+}
+
+// SambaStatus is what smbstatus reports
+type SambaStatus struct {
+	Sessions    []SambaSession    `json:"sessions"`
+	Connections []SambaConnection `json:"connections"`
+	OpenFiles   []SambaOpenFile   `json:"openFiles"`
+}
+
+type SambaSession struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Group    string `json:"group"`
+	Machine  string `json:"machine"`
+	Dialect  string `json:"dialect,omitempty"`
+}
+
+type SambaConnection struct {
+	Service     string `json:"service"`
+	Machine     string `json:"machine"`
+	ConnectedAt string `json:"connectedAt,omitempty"`
+}
+
+type SambaOpenFile struct {
+	Service string `json:"service"`
+	Path    string `json:"path"`
+	Opens   int    `json:"opens"`
+}
+
+func sambaConfPath() string {
+	if p := strings.TrimSpace(os.Getenv("SMB_CONF")); p != "" {
+		return p
+	}
+	return sambaDefaultConf
+}
+
+// sambaCommand runs a Samba tool, returning its combined output
+func sambaCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return systemCommand(ctx, errNoSamba, name, args...)
+}
+
+// systemCommand runs a tool of the host's file services, answering missing
+// when it is not installed
+func systemCommand(ctx context.Context, missing error, name string, args ...string) ([]byte, error) {
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return nil, missing
+	}
+	ctx, cancel := context.WithTimeout(ctx, systemCommandTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, bin, args...).CombinedOutput()
+}
+
+// smbSection is a section of smb.conf as raw lines, header excluded
+type smbSection struct {
+	name  string
+	lines []string
+}
+
+// smbConf keeps smb.conf as lines so that a rewrite changes only what it
+// must
+type smbConf struct {
+	head     []string // Before the first section
+	sections []*smbSection
+}
+
+func parseSmbConf(data []byte) *smbConf {
+	conf := &smbConf{}
+	var cur *smbSection
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			cur = &smbSection{name: strings.TrimSpace(trimmed[1 : len(trimmed)-1])}
+			conf.sections = append(conf.sections, cur)
+			continue
+		}
+		if cur == nil {
+			conf.head = append(conf.head, line)
+		} else {
+			cur.lines = append(cur.lines, line)
+		}
+	}
+	return conf
+}
+
+func (c *smbConf) bytes() []byte {
+	var b bytes.Buffer
+	for _, line := range c.head {
+		b.WriteString(line + "\n")
+	}
+	for _, s := range c.sections {
+		b.WriteString("[" + s.name + "]\n")
+		for _, line := range s.lines {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.Bytes()
+}
+
+func (c *smbConf) find(name string) *smbSection {
+	for _, s := range c.sections {
+		if strings.EqualFold(s.name, name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// smbKey splits a parameter line; Samba keys ignore case and spacing
+func smbKey(line string) (key, value string, ok bool) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+		return "", "", false
+	}
+	k, v, ok := strings.Cut(trimmed, "=")
+	if !ok {
+		return "", "", false
+	}
+	return strings.ToLower(strings.Join(strings.Fields(k), " ")), strings.TrimSpace(v), true
+}
+
+// get returns the value of the first of keys that is set
+func (s *smbSection) get(keys ...string) (string, string, bool) {
+	for _, line := range s.lines {
+		k, v, ok := smbKey(line)
+		if !ok {
+			continue
+		}
+		for _, key := range keys {
+			if k == key {
+				return key, v, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// set writes keys[0] = value in place of the first of keys, dropping the
+// other spellings; a new key goes after the last parameter
+func (s *smbSection) set(value string, keys ...string) {
+	out, done, last := s.lines[:0], false, -1
+	for _, line := range s.lines {
+		k, _, ok := smbKey(line)
+		match := false
+		for _, key := range keys {
+			match = match || (ok && k == key)
+		}
+		if match {
+			if !done {
+				out = append(out, "   "+keys[0]+" = "+value)
+				done, last = true, len(out)-1
+			}
+			continue
+		}
+		out = append(out, line)
+		if ok {
+			last = len(out) - 1
+		}
+	}
+	if !done {
+		out = append(out, "")
+		copy(out[last+2:], out[last+1:])
+		out[last+1] = "   " + keys[0] + " = " + value
+	}
+	s.lines = out
+}
+
+// del removes the given keys, and with prefix every key starting with it
+func (s *smbSection) del(prefix string, keys ...string) {
+	out := s.lines[:0]
+	for _, line := range s.lines {
+		k, _, ok := smbKey(line)
+		drop := ok && prefix != "" && strings.HasPrefix(k, prefix)
+		for _, key := range keys {
+			drop = drop || (ok && k == key)
+		}
+		if !drop {
+			out = append(out, line)
+		}
+	}
+	s.lines = out
+}
+
+func smbBool(v string) bool {
+	switch strings.ToLower(v) {
+	case "yes", "true", "1", "on":
+		return true
+	}
+	return false
+}
+
+func smbYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// sambaShareOf reads the managed keys of a section, with Samba's defaults
+func sambaShareOf(s *smbSection) SambaShare {
+	share := SambaShare{Name: s.name, ReadOnly: true, Browseable: true, ValidUsers: []string{}}
+	_, share.Path, _ = s.get("path", "directory")
+	_, share.Comment, _ = s.get("comment")
+	if key, v, ok := s.get(sambaKeyReadOnly...); ok {
+		share.ReadOnly = smbBool(v) == (key == "read only")
+	}
+	if _, v, ok := s.get(sambaKeyGuestOk...); ok {
+		share.GuestOk = smbBool(v)
+	}
+	if _, v, ok := s.get(sambaKeyBrowseable...); ok {
+		share.Browseable = smbBool(v)
+	}
+	if _, v, ok := s.get("valid users"); ok {
+		share.ValidUsers = strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	}
+	if _, v, ok := s.get("vfs objects", "vfs object"); ok {
+		for _, obj := range strings.Fields(v) {
+			share.Recycle = share.Recycle || obj == "recycle"
+		}
+	}
+	return share
+}
+
+// applySambaShare writes the managed keys of share onto its section
+func applySambaShare(s *smbSection, share SambaShare) {
+	s.set(share.Path, "path", "directory")
+	if share.Comment != "" {
+		s.set(share.Comment, "comment")
+	} else {
+		s.del("", "comment")
+	}
+	s.set(smbYesNo(share.ReadOnly), sambaKeyReadOnly...)
+	s.set(smbYesNo(share.Browseable), sambaKeyBrowseable...)
+	s.set(smbYesNo(share.GuestOk), sambaKeyGuestOk...)
+	if len(share.ValidUsers) > 0 {
+		s.set(strings.Join(share.ValidUsers, " "), "valid users")
+	} else {
+		s.del("", "valid users")
+	}
+
+	objects := []string{}
+	if _, v, ok := s.get("vfs objects", "vfs object"); ok {
+		for _, obj := range strings.Fields(v) {
+			if obj != "recycle" {
+				objects = append(objects, obj)
+			}
+		}
+	}
+	s.del("recycle:")
+	if share.Recycle {
+		objects = append(objects, "recycle")
+		s.set(".recycle/%U", "recycle:repository")
+		s.set("yes", "recycle:keeptree")
+		s.set("yes", "recycle:versions")
+		s.set("yes", "recycle:touch")
+	}
+	if len(objects) > 0 {
+		s.set(strings.Join(objects, " "), "vfs objects", "vfs object")
+	} else {
+		s.del("", "vfs objects", "vfs object")
+	}
+}
+
+// validSambaShare checks what ends up in smb.conf; a newline would let a
+// value add parameters of its own
+func validSambaShare(share SambaShare) bool {
+	if !sambaShareNameRe.MatchString(share.Name) || sambaReservedSections[strings.ToLower(share.Name)] {
+		return false
+	}
+	if !filepath.IsAbs(share.Path) || strings.ContainsAny(share.Path+share.Comment, "\r\n\x00") {
+		return false
+	}
+	for _, u := range share.ValidUsers {
+		if !sambaUserRe.MatchString(u) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateSmbConf edits smb.conf under a lock and replaces it only when
+// testparm, if installed, accepts the result
+func updateSmbConf(ctx context.Context, fn func(*smbConf) error) error {
+	sambaConfMu.Lock()
+	defer sambaConfMu.Unlock()
+	file := sambaConfPath()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	conf := parseSmbConf(data)
+	if err := fn(conf); err != nil {
+		return err
+	}
+	updated := conf.bytes()
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".smb.conf-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(updated)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if out, err := sambaCommand(ctx, "testparm", "-s", "--suppress-prompt", tmp.Name()); err != nil && !errors.Is(err, errNoSamba) {
+		return &sambaConfError{output: strings.TrimSpace(string(out))}
+	}
+	return utils.AtomicWriteFile(file, updated)
+}
+
+// sambaConfError carries testparm's complaint
+type sambaConfError struct {
+	output string
+}
+
+func (e *sambaConfError) Error() string { return "smb.conf rejected by testparm" }
+
+// sambaError answers with the status matching err
+func sambaError(c *gin.Context, err error) {
+	var confErr *sambaConfError
+	switch {
+	case errors.As(err, &confErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Samba configuration", "details": confErr.output})
+	case errors.Is(err, errSambaShareMissing):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoSamba), os.IsNotExist(err):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoSamba.Error()})
+	default:
+		sambaLog.Error("Samba operation failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Samba operation failed"})
+	}
+}
+
+// GetSambaShares lists the share sections of smb.conf
+func GetSambaShares(c *gin.Context) {
+	data, err := os.ReadFile(sambaConfPath())
+	if err != nil {
+		sambaError(c, err)
+		return
+	}
+	shares := []SambaShare{}
+	for _, s := range parseSmbConf(data).sections {
+		if !sambaReservedSections[strings.ToLower(s.name)] {
+			shares = append(shares, sambaShareOf(s))
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return strings.ToLower(shares[i].Name) < strings.ToLower(shares[j].Name) })
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": shares})
+}
+
+// SaveSambaShare creates a share or updates the one with that name
+func SaveSambaShare(c *gin.Context) {
+	var share SambaShare
+	if err := c.ShouldBindJSON(&share); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	share.Name = strings.TrimSpace(share.Name)
+	share.Path = filepath.Clean(strings.TrimSpace(share.Path))
+	share.Comment = strings.TrimSpace(share.Comment)
+	if !validSambaShare(share) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidSambaShare.Error()})
+		return
+	}
+	if info, err := os.Stat(share.Path); err != nil || !info.IsDir() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Folder not found"})
+		return
+	}
+	c.Set("auditTarget", share.Name)
+	err := updateSmbConf(c.Request.Context(), func(conf *smbConf) error {
+		s := conf.find(share.Name)
+		if s == nil {
+			s = &smbSection{name: share.Name}
+			// Keep a blank line between sections
+			if n := len(conf.sections); n > 0 {
+				if lines := conf.sections[n-1].lines; len(lines) == 0 || strings.TrimSpace(lines[len(lines)-1]) != "" {
+					conf.sections[n-1].lines = append(lines, "")
+				}
+			}
+			conf.sections = append(conf.sections, s)
+		}
+		applySambaShare(s, share)
+		return nil
+	})
+	if err != nil {
+		sambaError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": share})
+}
+
+// DeleteSambaShare removes a share section
+func DeleteSambaShare(c *gin.Context) {
+	name := c.Param("name")
+	if sambaReservedSections[strings.ToLower(name)] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidSambaShare.Error()})
+		return
+	}
+	err := updateSmbConf(c.Request.Context(), func(conf *smbConf) error {
+		for i, s := range conf.sections {
+			if strings.EqualFold(s.name, name) {
+				conf.sections = append(conf.sections[:i], conf.sections[i+1:]...)
+				return nil
+			}
+		}
+		return errSambaShareMissing
+	})
+	if err != nil {
+		sambaError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ReloadSamba makes the running smbd read smb.conf again
+func ReloadSamba(c *gin.Context) {
+	out, err := sambaCommand(c.Request.Context(), "smbcontrol", "all", "reload-config")
+	if errors.Is(err, errNoSamba) {
+		sambaError(c, err)
+		return
+	}
+	if err != nil {
+		sambaLog.Warn("Samba reload failed", "error", err, "output", strings.TrimSpace(string(out)))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Samba reload failed", "details": strings.TrimSpace(string(out))})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetSambaStatus lists sessions, share connections and open files, read
+// from smbstatus --json (Samba 4.16 and later)
+func GetSambaStatus(c *gin.Context) {
+	out, err := sambaCommand(c.Request.Context(), "smbstatus", "--json")
+	if errors.Is(err, errNoSamba) {
+		sambaError(c, err)
+		return
+	}
+	status, perr := parseSambaStatus(out)
+	if err != nil || perr != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Samba status unavailable", "details": strings.TrimSpace(string(out))})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": status})
+}
+
+func parseSambaStatus(data []byte) (SambaStatus, error) {
+	var raw struct {
+		Sessions map[string]struct {
+			SessionID     string `json:"session_id"`
+			Username      string `json:"username"`
+			Groupname     string `json:"groupname"`
+			RemoteMachine string `json:"remote_machine"`
+			Hostname      string `json:"hostname"`
+			Dialect       string `json:"session_dialect"`
+		} `json:"sessions"`
+		Tcons map[string]struct {
+			Service     string `json:"service"`
+			Machine     string `json:"machine"`
+			ConnectedAt string `json:"connected_at"`
+		} `json:"tcons"`
+		OpenFiles map[string]struct {
+			ServicePath string                     `json:"service_path"`
+			Filename    string                     `json:"filename"`
+			Opens       map[string]json.RawMessage `json:"opens"`
+		} `json:"open_files"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return SambaStatus{}, err
+	}
+	status := SambaStatus{Sessions: []SambaSession{}, Connections: []SambaConnection{}, OpenFiles: []SambaOpenFile{}}
+	for id, s := range raw.Sessions {
+		if s.SessionID != "" {
+			id = s.SessionID
+		}
+		machine := s.RemoteMachine
+		if machine == "" {
+			machine = s.Hostname
+		}
+		status.Sessions = append(status.Sessions, SambaSession{ID: id, Username: s.Username, Group: s.Groupname, Machine: machine, Dialect: s.Dialect})
+	}
+	for _, t := range raw.Tcons {
+		status.Connections = append(status.Connections, SambaConnection{Service: t.Service, Machine: t.Machine, ConnectedAt: t.ConnectedAt})
+	}
+	for key, f := range raw.OpenFiles {
+		name := f.Filename
+		if name == "" {
+			name = key
+		}
+		status.OpenFiles = append(status.OpenFiles, SambaOpenFile{Service: f.ServicePath, Path: name, Opens: len(f.Opens)})
+	}
+	sort.Slice(status.Sessions, func(i, j int) bool { return status.Sessions[i].ID < status.Sessions[j].ID })
+	sort.Slice(status.Connections, func(i, j int) bool {
+		return status.Connections[i].Service+status.Connections[i].Machine < status.Connections[j].Service+status.Connections[j].Machine
+	})
+	sort.Slice(status.OpenFiles, func(i, j int) bool { return status.OpenFiles[i].Path < status.OpenFiles[j].Path })
+	return status, nil
+}
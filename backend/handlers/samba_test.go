@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSamba(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir, bin, shared := t.TempDir(), t.TempDir(), t.TempDir()
+	conf := filepath.Join(dir, "smb.conf")
+	os.WriteFile(conf, []byte("# managed by hand\n[global]\n   workgroup = WORKGROUP\n\n[media]\n   path = /srv/media\n   writeable = yes\n   ; keep me\n   veto files = /.DS_Store/\n"), 0644)
+	t.Setenv("SMB_CONF", conf)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	// testparm refuses any file naming the share "bad"
+	os.WriteFile(filepath.Join(bin, "testparm"), []byte("#!/bin/sh\nif grep -q '^\\[bad\\]' \"$3\"; then echo 'Unknown parameter'; exit 1; fi\n"), 0755)
+	os.WriteFile(filepath.Join(bin, "smbcontrol"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(bin, "smbstatus"), []byte(`#!/bin/sh
+echo '{"sessions":{"1":{"session_id":"1","username":"alice","groupname":"users","remote_machine":"10.0.0.2"}},"tcons":{"5":{"service":"media","machine":"10.0.0.2"}},"open_files":{"/srv/media/a.mkv":{"service_path":"/srv/media","filename":"a.mkv","opens":{"1":{}}}}}'
+`), 0755)
+
+	r := gin.New()
+	r.GET("/shares", GetSambaShares)
+	r.POST("/shares", SaveSambaShare)
+	r.DELETE("/shares/:name", DeleteSambaShare)
+	r.POST("/reload", ReloadSamba)
+	r.GET("/status", GetSambaStatus)
+	shares := func() []SambaShare {
+		var resp struct{ Data []SambaShare }
+		json.Unmarshal(serve(r, "GET", "/shares", "").Body.Bytes(), &resp)
+		return resp.Data
+	}
+
+	if got := shares(); len(got) != 1 || got[0].Name != "media" || got[0].ReadOnly || !got[0].Browseable {
+		t.Fatalf("unexpected shares %+v", got)
+	}
+
+	body := `{"name":"docs","path":"` + shared + `","readOnly":false,"browseable":true,"validUsers":["alice","@staff"],"recycle":true}`
+	if w := serve(r, "POST", "/shares", body); w.Code != 200 {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(r, "POST", "/shares", `{"name":"media","path":"`+shared+`","readOnly":true,"browseable":false,"guestOk":true}`); w.Code != 200 {
+		t.Fatalf("update failed: %d %s", w.Code, w.Body.String())
+	}
+	got := shares()
+	if len(got) != 2 || got[0].Name != "docs" || !got[0].Recycle || strings.Join(got[0].ValidUsers, ",") != "alice,@staff" {
+		t.Fatalf("unexpected shares %+v", got)
+	}
+	if !got[1].ReadOnly || got[1].Browseable || !got[1].GuestOk {
+		t.Fatalf("media not updated: %+v", got[1])
+	}
+	data, _ := os.ReadFile(conf)
+	text := string(data)
+	for _, want := range []string{"# managed by hand", "workgroup = WORKGROUP", "; keep me", "veto files", "vfs objects = recycle", "recycle:repository = .recycle/%U"} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("smb.conf lost %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "writeable") {
+		t.Fatalf("expected the synonym to be replaced:\n%s", text)
+	}
+
+	for _, bad := range []string{
+		`{"name":"global","path":"` + shared + `"}`,
+		`{"name":"x","path":"relative"}`,
+		`{"name":"x","path":"` + shared + `","comment":"a\n[evil]"}`,
+		`{"name":"x","path":"` + shared + `","validUsers":["a b"]}`,
+	} {
+		if w := serve(r, "POST", "/shares", bad); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected %s to be refused, got %d", bad, w.Code)
+		}
+	}
+	if w := serve(r, "POST", "/shares", `{"name":"bad","path":"`+shared+`"}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Unknown parameter") {
+		t.Fatalf("expected testparm to refuse, got %d %s", w.Code, w.Body.String())
+	}
+	if after, _ := os.ReadFile(conf); string(after) != text {
+		t.Fatalf("a refused change was written")
+	}
+
+	if w := serve(r, "DELETE", "/shares/docs", ""); w.Code != 200 || len(shares()) != 1 {
+		t.Fatalf("delete failed: %d", w.Code)
+	}
+	if w := serve(r, "DELETE", "/shares/docs", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if w := serve(r, "POST", "/reload", ""); w.Code != 200 {
+		t.Fatalf("reload failed: %d", w.Code)
+	}
+	var status struct{ Data SambaStatus }
+	w := serve(r, "GET", "/status", "")
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if len(status.Data.Sessions) != 1 || status.Data.Sessions[0].Username != "alice" || len(status.Data.Connections) != 1 || len(status.Data.OpenFiles) != 1 || status.Data.OpenFiles[0].Opens != 1 {
+		t.Fatalf("unexpected status %s", w.Body.String())
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if w := serve(r, "POST", "/reload", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without Samba, got %d", w.Code)
+	}
+}
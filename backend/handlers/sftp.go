@@ -0,0 +1,394 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+// An optional SFTP listener serves the shares with the tree WebDAV uses.
+// Accounts log in with their password, an API token as the password (the
+// only way for accounts with two-factor login), or a public key added in
+// their settings. The files permission is required; read-only API tokens
+// get a read-only session. The host key is made on first start.
+
+const (
+	sftpDefaultPort      = 2022
+	sftpHandshakeTimeout = 30 * time.Second
+	sftpMaxAuthFailures  = 10
+	sftpAuthFailureWait  = 15 * time.Minute
+)
+
+var (
+	errSftpAuth       = errors.New("authentication failed")
+	errSftpKeyExists  = errors.New("Key already added")
+	errSftpKeyInvalid = errors.New("Invalid public key")
+)
+
+var sftpAttempts = newAttemptLimiter(sftpMaxAuthFailures, sftpAuthFailureWait)
+
+// sftpServer is the running listener, if any
+var sftpServer struct {
+	sync.Mutex
+	port     int
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+}
+
+// AddSftpKeyRequest is the body of AddSftpKey
+type AddSftpKeyRequest struct {
+	Name string `json:"name"`
+	Key  string `json:"key"` // authorized_keys line
+}
+
+func sftpHostKeyFile() string {
+	return filepath.Join(config.DataDir, "sftp_host_ed25519_key")
+}
+
+func sftpKeysFile() string {
+	return filepath.Join(config.DataDir, "sftp_keys.json")
+}
+
+// decodeSftpSettings reads the "sftp" field of a system config update
+func decodeSftpSettings(raw interface{}) (*models.SftpSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SFTP settings")
+	}
+	settings := &models.SftpSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid SFTP settings")
+	}
+	if settings.Port < 0 || settings.Port > 65535 {
+		return nil, fmt.Errorf("Invalid SFTP port")
+	}
+	return settings, nil
+}
+
+// sftpPort is the configured port, 0 when SFTP is off
+func sftpPort() int {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.Sftp == nil || !sysConfig.Sftp.Enable {
+		return 0
+	}
+	if sysConfig.Sftp.Port == 0 {
+		return sftpDefaultPort
+	}
+	return sysConfig.Sftp.Port
+}
+
+// loadSftpHostKey reads the host key, making one the first time
+func loadSftpHostKey() (ssh.Signer, error) {
+	data, err := os.ReadFile(sftpHostKeyFile())
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "flatnas")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(sftpHostKeyFile(), pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(priv)
+}
+
+// sftpPermissions records who logged in and whether they may write
+func sftpPermissions(username string, writable bool) (*ssh.Permissions, error) {
+	if !middleware.Can(middleware.RoleOf(username), middleware.PermFiles) {
+		return nil, errSftpAuth
+	}
+	perms := &ssh.Permissions{Extensions: map[string]string{"username": username}}
+	if writable {
+		perms.Extensions["writable"] = "1"
+	}
+	return perms, nil
+}
+
+func sftpServerConfig() (*ssh.ServerConfig, error) {
+	hostKey, err := loadSftpHostKey()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ssh.ServerConfig{
+		MaxAuthTries: 6,
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if sftpAttempts.locked(ip) {
+				return nil, errSftpAuth
+			}
+			username, pass := conn.User(), string(password)
+			if middleware.IsApiToken(pass) {
+				if token, ok := middleware.LookupApiToken(pass); ok && token.Username == username {
+					return sftpPermissions(username, middleware.TokenHasScope(token, middleware.ScopeWrite))
+				}
+			} else if checkAccountPassword(username, pass) {
+				return sftpPermissions(username, true)
+			}
+			sftpAttempts.failed(ip)
+			return nil, errSftpAuth
+		},
+		// Clients offer each of their keys in turn, so a key that is not
+		// known here is no failed attempt
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			id := sftpKeyID(key)
+			for _, k := range loadSftpKeys() {
+				if k.ID == id && k.Username == conn.User() {
+					return sftpPermissions(k.Username, true)
+				}
+			}
+			return nil, errSftpAuth
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	return cfg, nil
+}
+
+// reloadSftpServer starts, stops or moves the listener to match the
+// system config. Open sessions end when the listener stops or moves.
+func reloadSftpServer() {
+	port := sftpPort()
+	sftpServer.Lock()
+	defer sftpServer.Unlock()
+	if port == sftpServer.port {
+		return
+	}
+	stopSftpServerLocked()
+	if port == 0 {
+		return
+	}
+	cfg, err := sftpServerConfig()
+	if err != nil {
+		filesLog.Error("SFTP host key unavailable", "error", err)
+		return
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		filesLog.Error("SFTP listener failed", "port", port, "error", err)
+		return
+	}
+	sftpServer.port, sftpServer.listener = port, l
+	filesLog.Info("SFTP listening", "port", port)
+	go serveSftp(l, cfg)
+}
+
+func stopSftpServerLocked() {
+	if sftpServer.listener != nil {
+		sftpServer.listener.Close()
+	}
+	for conn := range sftpServer.conns {
+		conn.Close()
+	}
+	sftpServer.port, sftpServer.listener, sftpServer.conns = 0, nil, nil
+}
+
+// StartSftpServer runs the SFTP listener when the system config enables it
+func StartSftpServer() {
+	reloadSftpServer()
+	go func() {
+		<-backgroundCtx.Done()
+		sftpServer.Lock()
+		stopSftpServerLocked()
+		sftpServer.Unlock()
+	}()
+}
+
+func serveSftp(l net.Listener, cfg *ssh.ServerConfig) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		sftpServer.Lock()
+		if sftpServer.listener == l {
+			if sftpServer.conns == nil {
+				sftpServer.conns = map[net.Conn]struct{}{}
+			}
+			sftpServer.conns[conn] = struct{}{}
+		}
+		sftpServer.Unlock()
+		go func() {
+			handleSftpConn(conn, cfg)
+			sftpServer.Lock()
+			delete(sftpServer.conns, conn)
+			sftpServer.Unlock()
+		}()
+	}
+}
+
+func handleSftpConn(nConn net.Conn, cfg *ssh.ServerConfig) {
+	defer nConn.Close()
+	nConn.SetDeadline(time.Now().Add(sftpHandshakeTimeout))
+	sconn, chans, reqs, err := ssh.NewServerConn(nConn, cfg)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	nConn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(reqs)
+
+	username := sconn.Permissions.Extensions["username"]
+	writable := sconn.Permissions.Extensions["writable"] == "1"
+	filesLog.Info("SFTP login", "user", username, "remote", sconn.RemoteAddr().String(), "writable", writable)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, requests, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				// Only the sftp subsystem: no shell, exec or forwarding
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						newSftpSession(ch, &shareFS{username: username}, writable).serve()
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// sftpKeyID identifies a public key; unlike the fingerprint it is safe in
+// a URL
+func sftpKeyID(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return hex.EncodeToString(sum[:16])
+}
+
+func loadSftpKeys() []models.SftpKey {
+	keys := []models.SftpKey{}
+	utils.ReadJSON(sftpKeysFile(), &keys)
+	return keys
+}
+
+// GetSftp describes the SFTP listener and lists the caller's keys
+func GetSftp(c *gin.Context) {
+	username := c.GetString("username")
+	keys := []models.SftpKey{}
+	for _, k := range loadSftpKeys() {
+		if k.Username == username {
+			keys = append(keys, k)
+		}
+	}
+	data := gin.H{"enabled": false, "keys": keys}
+	if port := sftpPort(); port != 0 {
+		data["enabled"], data["port"] = true, port
+		if signer, err := loadSftpHostKey(); err == nil {
+			data["hostKey"] = ssh.FingerprintSHA256(signer.PublicKey())
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": data})
+}
+
+// AddSftpKey lets a public key log in as the caller
+func AddSftpKey(c *gin.Context) {
+	var req AddSftpKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(req.Key)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errSftpKeyInvalid.Error()})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = comment
+	}
+	entry := models.SftpKey{
+		ID:          sftpKeyID(key),
+		Username:    c.GetString("username"),
+		Name:        name,
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint: ssh.FingerprintSHA256(key),
+		CreatedAt:   time.Now().UnixMilli(),
+	}
+	var keys []models.SftpKey
+	err = utils.UpdateJSON(sftpKeysFile(), &keys, func() error {
+		for _, k := range keys {
+			// A key logs in to one account only
+			if k.ID == entry.ID {
+				return errSftpKeyExists
+			}
+		}
+		keys = append(keys, entry)
+		return nil
+	})
+	if errors.Is(err, errSftpKeyExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": entry})
+}
+
+// DeleteSftpKey removes one of the caller's keys; the admin may remove
+// anyone's
+func DeleteSftpKey(c *gin.Context) {
+	username := c.GetString("username")
+	id := c.Param("id")
+	found := false
+	var keys []models.SftpKey
+	err := utils.UpdateJSON(sftpKeysFile(), &keys, func() error {
+		kept := keys[:0]
+		for _, k := range keys {
+			if k.ID == id && (k.Username == username || username == "admin") {
+				found = true
+				continue
+			}
+			kept = append(kept, k)
+		}
+		keys = kept
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save key"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
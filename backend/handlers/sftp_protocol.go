@@ -0,0 +1,526 @@
+package handlers
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02), the version OpenSSH and
+// nearly every client speak. Requests are answered one at a time, in
+// order. Symlinks and extensions are not supported.
+
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// Open flags
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreat  = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+// Attribute flags
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	sftpMaxPacket     = 256*1024 + 1024 // Room for a 256 KiB write
+	sftpMaxRead       = 256 * 1024
+	sftpMaxHandles    = 256
+	sftpReaddirBatch  = 100
+	sftpTypeDir       = 0040000
+	sftpTypeRegular   = 0100000
+	sftpTypeSymlink   = 0120000
+	sftpRecentModTime = 180 * 24 * time.Hour
+)
+
+var errSftpBadMessage = errors.New("bad message")
+
+type sftpSession struct {
+	ctx      context.Context
+	rw       io.ReadWriter
+	fs       *shareFS
+	writable bool
+	handles  map[string]*sftpOpenFile
+	next     uint64
+}
+
+type sftpOpenFile struct {
+	name   string
+	file   webdav.File
+	dir    bool
+	append bool
+}
+
+// sftpAttributes is the decoded ATTRS of a request
+type sftpAttributes struct {
+	flags uint32
+	size  uint64
+	perm  uint32
+	mtime uint32
+	atime uint32
+}
+
+func newSftpSession(rw io.ReadWriter, fsys *shareFS, writable bool) *sftpSession {
+	return &sftpSession{ctx: context.Background(), rw: rw, fs: fsys, writable: writable, handles: map[string]*sftpOpenFile{}}
+}
+
+// serve answers requests until the client leaves or breaks the protocol
+func (s *sftpSession) serve() {
+	defer func() {
+		for _, h := range s.handles {
+			h.file.Close()
+		}
+	}()
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(s.rw, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length == 0 || length > sftpMaxPacket {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(s.rw, packet); err != nil {
+			return
+		}
+		if err := s.handle(packet[0], &sftpReader{b: packet[1:]}); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers one request. Only a failed write to the client ends the
+// session; bad requests get a status.
+func (s *sftpSession) handle(kind byte, r *sftpReader) error {
+	if kind == sftpInit {
+		// Any client version works: we answer 3 and it must follow
+		return s.send(sftpVersion, sftpU32(3))
+	}
+	id := r.u32()
+	if r.err {
+		return s.status(id, errSftpBadMessage)
+	}
+	switch kind {
+	case sftpOpen:
+		name, pflags, attrs := r.str(), r.u32(), r.attrs()
+		if r.err {
+			return s.status(id, errSftpBadMessage)
+		}
+		return s.open(id, name, pflags, attrs)
+	case sftpClose:
+		handle := r.str()
+		h, ok := s.handles[handle]
+		if !ok {
+			return s.status(id, os.ErrNotExist)
+		}
+		delete(s.handles, handle)
+		return s.status(id, h.file.Close())
+	case sftpRead:
+		h, offset, length := s.handleOf(r.str()), r.u64(), r.u32()
+		if h == nil || h.dir || r.err {
+			return s.status(id, errSftpBadMessage)
+		}
+		buf := make([]byte, min(length, sftpMaxRead))
+		n, err := h.file.(io.ReaderAt).ReadAt(buf, int64(offset))
+		if n == 0 && err != nil {
+			return s.status(id, err)
+		}
+		return s.send(sftpData, sftpU32(id), sftpStr(buf[:n]))
+	case sftpWrite:
+		h, offset, data := s.handleOf(r.str()), r.u64(), r.str()
+		if h == nil || h.dir || r.err {
+			return s.status(id, errSftpBadMessage)
+		}
+		var err error
+		if h.append {
+			_, err = h.file.Write([]byte(data))
+		} else {
+			_, err = h.file.(io.WriterAt).WriteAt([]byte(data), int64(offset))
+		}
+		return s.status(id, err)
+	case sftpLstat, sftpStat:
+		info, err := s.fs.Stat(s.ctx, r.str())
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.send(sftpAttrs, sftpU32(id), encodeSftpAttrs(info))
+	case sftpFstat:
+		h := s.handleOf(r.str())
+		if h == nil {
+			return s.status(id, errSftpBadMessage)
+		}
+		info, err := h.file.Stat()
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.send(sftpAttrs, sftpU32(id), encodeSftpAttrs(info))
+	case sftpSetstat, sftpFsetstat:
+		name := r.str()
+		if kind == sftpFsetstat {
+			h := s.handleOf(name)
+			if h == nil {
+				return s.status(id, errSftpBadMessage)
+			}
+			name = h.name
+		}
+		attrs := r.attrs()
+		if r.err {
+			return s.status(id, errSftpBadMessage)
+		}
+		return s.status(id, s.setstat(name, attrs))
+	case sftpOpendir:
+		name := r.str()
+		info, err := s.fs.Stat(s.ctx, name)
+		if err == nil && !info.IsDir() {
+			err = errors.New("not a directory")
+		}
+		if err != nil {
+			return s.status(id, err)
+		}
+		f, err := s.fs.OpenFile(s.ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.addHandle(id, &sftpOpenFile{name: name, file: f, dir: true})
+	case sftpReaddir:
+		h := s.handleOf(r.str())
+		if h == nil || !h.dir {
+			return s.status(id, errSftpBadMessage)
+		}
+		infos, err := h.file.Readdir(sftpReaddirBatch)
+		if len(infos) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return s.status(id, err)
+		}
+		parts := [][]byte{sftpU32(id), sftpU32(uint32(len(infos)))}
+		for _, info := range infos {
+			parts = append(parts, sftpStr([]byte(info.Name())), sftpStr([]byte(sftpLongName(info))), encodeSftpAttrs(info))
+		}
+		return s.send(sftpName, parts...)
+	case sftpRemove:
+		name := r.str()
+		if r.err {
+			return s.status(id, errSftpBadMessage)
+		}
+		if !s.writable {
+			return s.status(id, os.ErrPermission)
+		}
+		info, err := s.fs.Stat(s.ctx, name)
+		if err == nil && info.IsDir() {
+			err = errors.New("is a directory")
+		}
+		if err == nil {
+			err = s.fs.RemoveAll(s.ctx, name)
+		}
+		return s.status(id, err)
+	case sftpMkdir:
+		name, attrs := r.str(), r.attrs()
+		if r.err {
+			return s.status(id, errSftpBadMessage)
+		}
+		if !s.writable {
+			return s.status(id, os.ErrPermission)
+		}
+		perm := os.FileMode(0755)
+		if attrs.flags&sftpAttrPermissions != 0 {
+			perm = os.FileMode(attrs.perm & 0777)
+		}
+		return s.status(id, s.fs.Mkdir(s.ctx, name, perm))
+	case sftpRmdir:
+		name := r.str()
+		if r.err {
+			return s.status(id, errSftpBadMessage)
+		}
+		if !s.writable {
+			return s.status(id, os.ErrPermission)
+		}
+		full, err := s.fs.writablePath(name)
+		if err == nil {
+			// Only an empty folder goes, and it is not worth the bin
+			err = os.Remove(full)
+		}
+		return s.status(id, err)
+	case sftpRealpath:
+		p := path.Clean("/" + r.str())
+		return s.send(sftpName, sftpU32(id), sftpU32(1), sftpStr([]byte(p)), sftpStr([]byte(p)), sftpU32(0))
+	case sftpRename:
+		from, to := r.str(), r.str()
+		if r.err {
+			return s.status(id, errSftpBadMessage)
+		}
+		if !s.writable {
+			return s.status(id, os.ErrPermission)
+		}
+		// Version 3 renames never replace
+		if _, err := s.fs.Stat(s.ctx, to); err == nil {
+			return s.status(id, errFileExists)
+		}
+		return s.status(id, s.fs.Rename(s.ctx, from, to))
+	default:
+		return s.send(sftpStatus, sftpU32(id), sftpU32(sftpOpUnsupported), sftpStr([]byte("Operation unsupported")), sftpStr(nil))
+	}
+}
+
+func (s *sftpSession) open(id uint32, name string, pflags uint32, attrs sftpAttributes) error {
+	flag := os.O_RDONLY
+	switch {
+	case pflags&sftpFlagRead != 0 && pflags&sftpFlagWrite != 0:
+		flag = os.O_RDWR
+	case pflags&sftpFlagWrite != 0:
+		flag = os.O_WRONLY
+	}
+	if pflags&sftpFlagAppend != 0 {
+		flag |= os.O_APPEND
+	}
+	if pflags&sftpFlagCreat != 0 {
+		flag |= os.O_CREATE
+	}
+	if pflags&sftpFlagTrunc != 0 {
+		flag |= os.O_TRUNC
+	}
+	if pflags&sftpFlagExcl != 0 {
+		flag |= os.O_EXCL
+	}
+	if flag != os.O_RDONLY && !s.writable {
+		return s.status(id, os.ErrPermission)
+	}
+	perm := os.FileMode(0644)
+	if attrs.flags&sftpAttrPermissions != 0 {
+		perm = os.FileMode(attrs.perm & 0777)
+	}
+	f, err := s.fs.OpenFile(s.ctx, name, flag, perm)
+	if err != nil {
+		return s.status(id, err)
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return s.status(id, errors.New("is a directory"))
+	}
+	return s.addHandle(id, &sftpOpenFile{name: name, file: f, append: flag&os.O_APPEND != 0})
+}
+
+func (s *sftpSession) setstat(name string, attrs sftpAttributes) error {
+	if !s.writable {
+		return os.ErrPermission
+	}
+	full, err := s.fs.writablePath(name)
+	if err != nil {
+		return err
+	}
+	if attrs.flags&sftpAttrSize != 0 {
+		if err := os.Truncate(full, int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		if err := os.Chmod(full, os.FileMode(attrs.perm&0777)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		return os.Chtimes(full, time.Unix(int64(attrs.atime), 0), time.Unix(int64(attrs.mtime), 0))
+	}
+	// Owners are the server's business
+	return nil
+}
+
+func (s *sftpSession) addHandle(id uint32, h *sftpOpenFile) error {
+	if len(s.handles) >= sftpMaxHandles {
+		h.file.Close()
+		return s.status(id, errors.New("too many open handles"))
+	}
+	s.next++
+	handle := strconv.FormatUint(s.next, 16)
+	s.handles[handle] = h
+	return s.send(sftpHandle, sftpU32(id), sftpStr([]byte(handle)))
+}
+
+func (s *sftpSession) handleOf(handle string) *sftpOpenFile {
+	return s.handles[handle]
+}
+
+// status answers with the status matching err
+func (s *sftpSession) status(id uint32, err error) error {
+	code, message := uint32(sftpOK), "OK"
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF):
+		code, message = sftpEOF, "EOF"
+	case errors.Is(err, errSftpBadMessage):
+		code, message = sftpBadMessage, "Bad message"
+	case os.IsNotExist(err), errors.Is(err, errInvalidPath):
+		code, message = sftpNoSuchFile, "No such file"
+	case os.IsPermission(err), errors.Is(err, errShareReadOnly):
+		code, message = sftpPermissionDenied, "Permission denied"
+	default:
+		code, message = sftpFailure, err.Error()
+	}
+	return s.send(sftpStatus, sftpU32(id), sftpU32(code), sftpStr([]byte(message)), sftpStr(nil))
+}
+
+func (s *sftpSession) send(kind byte, parts ...[]byte) error {
+	length := 1
+	for _, p := range parts {
+		length += len(p)
+	}
+	out := make([]byte, 0, 4+length)
+	out = binary.BigEndian.AppendUint32(out, uint32(length))
+	out = append(out, kind)
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	_, err := s.rw.Write(out)
+	return err
+}
+
+func encodeSftpAttrs(info os.FileInfo) []byte {
+	mode := uint32(info.Mode().Perm())
+	switch {
+	case info.IsDir():
+		mode |= sftpTypeDir
+	case info.Mode()&os.ModeSymlink != 0:
+		mode |= sftpTypeSymlink
+	default:
+		mode |= sftpTypeRegular
+	}
+	mtime := uint32(info.ModTime().Unix())
+	out := sftpU32(sftpAttrSize | sftpAttrUIDGID | sftpAttrPermissions | sftpAttrACModTime)
+	out = binary.BigEndian.AppendUint64(out, uint64(info.Size()))
+	out = binary.BigEndian.AppendUint32(out, 0)
+	out = binary.BigEndian.AppendUint32(out, 0)
+	out = binary.BigEndian.AppendUint32(out, mode)
+	out = binary.BigEndian.AppendUint32(out, mtime)
+	return binary.BigEndian.AppendUint32(out, mtime)
+}
+
+// sftpLongName is the ls -l line clients show in listings
+func sftpLongName(info os.FileInfo) string {
+	stamp := info.ModTime().Format("Jan _2 15:04")
+	if time.Since(info.ModTime()) > sftpRecentModTime {
+		stamp = info.ModTime().Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 flatnas flatnas %8d %s %s", info.Mode().String(), info.Size(), stamp, info.Name())
+}
+
+func sftpU32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func sftpStr(b []byte) []byte {
+	return append(sftpU32(uint32(len(b))), b...)
+}
+
+// sftpReader decodes request fields; err records a short packet
+type sftpReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *sftpReader) u32() uint32 {
+	if len(r.b) < 4 {
+		r.err = true
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sftpReader) u64() uint64 {
+	if len(r.b) < 8 {
+		r.err = true
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *sftpReader) str() string {
+	n := r.u32()
+	if r.err || uint32(len(r.b)) < n {
+		r.err = true
+		return ""
+	}
+	v := string(r.b[:n])
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sftpReader) attrs() sftpAttributes {
+	a := sftpAttributes{flags: r.u32()}
+	if a.flags&sftpAttrSize != 0 {
+		a.size = r.u64()
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		r.u32()
+		r.u32()
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		a.perm = r.u32()
+	}
+	if a.flags&sftpAttrACModTime != 0 {
+		a.atime, a.mtime = r.u32(), r.u32()
+	}
+	if a.flags&sftpAttrExtended != 0 {
+		for n := r.u32(); n > 0 && !r.err; n-- {
+			r.str()
+			r.str()
+		}
+	}
+	return a
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSftp(t *testing.T) {
+	useTestConfig(t)
+
+	root, archive := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(archive, "old.txt"), []byte("old"), 0644)
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("secret"), 4)
+	utils.WriteJSON(filepath.Join(config.UsersDir, "alice.json"), models.User{Username: "alice", Password: string(hashed)})
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}, {Name: "archive", Path: archive, ReadOnly: true}}})
+	_, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(clientKey)
+	utils.WriteJSON(sftpKeysFile(), []models.SftpKey{{ID: sftpKeyID(signer.PublicKey()), Username: "alice"}})
+
+	cfg, err := sftpServerConfig()
+	if err != nil {
+		t.Fatalf("server config: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go serveSftp(l, cfg)
+
+	dial := func(auth ssh.AuthMethod) (*ssh.Client, error) {
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User:            "alice",
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+	if _, err := dial(ssh.Password("wrong")); err == nil {
+		t.Fatalf("expected a wrong password to fail")
+	}
+	if client, err := dial(ssh.PublicKeys(signer)); err != nil {
+		t.Fatalf("key login failed: %v", err)
+	} else {
+		client.Close()
+	}
+	client, err := dial(ssh.Password("secret"))
+	if err != nil {
+		t.Fatalf("password login failed: %v", err)
+	}
+	defer client.Close()
+	session, _ := client.NewSession()
+	defer session.Close()
+	in, _ := session.StdinPipe()
+	out, _ := session.StdoutPipe()
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatalf("subsystem: %v", err)
+	}
+
+	var id uint32
+	call := func(kind byte, parts ...[]byte) (byte, *sftpReader) {
+		id++
+		body := []byte{kind}
+		if kind != sftpInit {
+			body = append(body, sftpU32(id)...)
+		}
+		for _, p := range parts {
+			body = append(body, p...)
+		}
+		in.Write(append(sftpU32(uint32(len(body))), body...))
+		header := make([]byte, 4)
+		io.ReadFull(out, header)
+		resp := make([]byte, binary.BigEndian.Uint32(header))
+		io.ReadFull(out, resp)
+		r := &sftpReader{b: resp[1:]}
+		if resp[0] != sftpVersion {
+			if got := r.u32(); got != id {
+				t.Fatalf("reply to %d for request %d", got, id)
+			}
+		}
+		return resp[0], r
+	}
+	name := func(p string) []byte { return sftpStr([]byte(p)) }
+	statusOf := func(kind byte, r *sftpReader) uint32 {
+		if kind != sftpStatus {
+			return 0xff
+		}
+		return r.u32()
+	}
+
+	if kind, r := call(sftpInit, sftpU32(3)); kind != sftpVersion || r.u32() != 3 {
+		t.Fatalf("unexpected version reply %d", kind)
+	}
+	kind, r := call(sftpOpen, name("/main/a.txt"), sftpU32(sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc), sftpU32(0))
+	if kind != sftpHandle {
+		t.Fatalf("open failed: %d", statusOf(kind, r))
+	}
+	handle := r.str()
+	call(sftpWrite, name(handle), binary.BigEndian.AppendUint64(nil, 0), name("hello"))
+	if kind, r := call(sftpClose, name(handle)); statusOf(kind, r) != sftpOK {
+		t.Fatalf("close failed")
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "a.txt")); string(data) != "hello" {
+		t.Fatalf("unexpected file content %q", data)
+	}
+	if kind, r := call(sftpStat, name("/main/a.txt")); kind != sftpAttrs || r.attrs().size != 5 {
+		t.Fatalf("unexpected stat reply %d", kind)
+	}
+
+	// The root lists the shares
+	_, r = call(sftpOpendir, name("/"))
+	handle = r.str()
+	kind, r = call(sftpReaddir, name(handle))
+	if kind != sftpName || r.u32() != 2 || r.str() != "main" {
+		t.Fatalf("unexpected root listing %d", kind)
+	}
+	if kind, r := call(sftpReaddir, name(handle)); statusOf(kind, r) != sftpEOF {
+		t.Fatalf("expected the listing to end")
+	}
+	call(sftpClose, name(handle))
+
+	if kind, r := call(sftpOpen, name("/archive/new.txt"), sftpU32(sftpFlagWrite|sftpFlagCreat), sftpU32(0)); statusOf(kind, r) != sftpPermissionDenied {
+		t.Fatalf("expected a read-only share to refuse writes")
+	}
+	if kind, r := call(sftpStat, name("/main/../archive/../../etc/passwd")); statusOf(kind, r) != sftpNoSuchFile {
+		t.Fatalf("expected paths to stay inside the shares")
+	}
+	if kind, r := call(sftpRename, name("/main/a.txt"), name("/archive/old.txt")); statusOf(kind, r) == sftpOK {
+		t.Fatalf("expected a rename onto an existing file to fail")
+	}
+	if kind, r := call(sftpRemove, name("/main/a.txt")); statusOf(kind, r) != sftpOK {
+		t.Fatalf("remove failed")
+	}
+	if items := listTrash(models.FileShare{Name: "main", Path: root}); len(items) != 1 || items[0].DeletedBy != "alice" {
+		t.Fatalf("expected the file in the bin, got %+v", items)
+	}
+
+	// Until the account sets up the two-factor the admin requires, only
+	// its keys log in
+	updateTotpRecord("alice", func(r *totpRecord) error { r.Required = true; return nil })
+	if _, err := dial(ssh.Password("secret")); err == nil {
+		t.Fatalf("expected the password refused until enrollment")
+	}
+	if client, err := dial(ssh.PublicKeys(signer)); err != nil {
+		t.Fatalf("expected the key to still log in: %v", err)
+	} else {
+		client.Close()
+	}
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"context"
+	"flatnasgo-backend/models"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// shareFS maps /<share>/<path> onto the shares, / listing them, for the
+// file protocols (WebDAV, SFTP). Names are checked like file browser
+// paths; deleting moves items to the recycle bin.
+type shareFS struct {
+	username string
+}
+
+// resolve splits a name into its share and share path
+func (s *shareFS) resolve(name string) (models.FileShare, string, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	shareName, rest, _ := strings.Cut(name, "/")
+	share, err := findFileShare(shareName)
+	if err != nil {
+		return share, "", os.ErrNotExist
+	}
+	rel, err := cleanSharePath(rest)
+	if err != nil {
+		return share, "", os.ErrNotExist
+	}
+	return share, rel, nil
+}
+
+// isShareFSRoot reports whether name is the list of shares
+func isShareFSRoot(name string) bool {
+	return path.Clean("/"+name) == "/"
+}
+
+// writablePath resolves name for a change to the item itself, which must
+// not be a share or the root
+func (s *shareFS) writablePath(name string) (string, error) {
+	share, rel, err := s.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if share.ReadOnly || rel == "" {
+		return "", os.ErrPermission
+	}
+	full, err := resolveShareTarget(share, rel)
+	if err != nil {
+		return "", os.ErrPermission
+	}
+	return full, nil
+}
+
+func (s *shareFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if isShareFSRoot(name) {
+		return os.ErrExist
+	}
+	full, err := s.writablePath(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(full, perm)
+}
+
+func (s *shareFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if isShareFSRoot(name) {
+		if writing {
+			return nil, os.ErrPermission
+		}
+		return &shareRootDir{shares: browseShares()}, nil
+	}
+	share, rel, err := s.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if writing && (share.ReadOnly || rel == "") {
+		return nil, os.ErrPermission
+	}
+	resolve := resolveSharePath
+	if writing {
+		resolve = resolveShareTarget
+	}
+	full, err := resolve(share, rel)
+	if err != nil {
+		return nil, os.ErrPermission
+	}
+	var quota *quotaFile
+	if writing {
+		if quota, err = newQuotaFile(share.Name, full); err != nil {
+			return nil, err
+		}
+	}
+	if flag&os.O_TRUNC != 0 {
+		keepVersion(share, rel, full, s.username)
+	}
+	f, err := os.OpenFile(full, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &shareFile{File: f, shareRoot: rel == "", quota: quota}, nil
+}
+
+func (s *shareFS) RemoveAll(ctx context.Context, name string) error {
+	share, rel, err := s.resolve(name)
+	if err != nil || isShareFSRoot(name) {
+		return os.ErrPermission
+	}
+	if share.ReadOnly || rel == "" {
+		return os.ErrPermission
+	}
+	full, rel, err := resolveFileItem(share, rel)
+	if err != nil {
+		return err
+	}
+	return moveToTrash(share, full, rel, s.username)
+}
+
+func (s *shareFS) Rename(ctx context.Context, oldName, newName string) error {
+	from, fromRel, err := s.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	to, toRel, err := s.resolve(newName)
+	if err != nil {
+		return os.ErrPermission
+	}
+	if from.ReadOnly || to.ReadOnly || fromRel == "" || toRel == "" {
+		return os.ErrPermission
+	}
+	src, _, err := resolveFileItem(from, fromRel)
+	if err != nil {
+		return err
+	}
+	dir, err := resolveSharePath(to, path.Dir(toRel))
+	if err != nil {
+		return os.ErrPermission
+	}
+	dst := filepath.Join(dir, path.Base(toRel))
+	if from.Name == to.Name {
+		// Clients that save through a temporary file rename it over the
+		// file they replace
+		keepVersion(to, toRel, dst, s.username)
+		if err := movePath(src, dst); err != nil {
+			return err
+		}
+		moveFileVersions(from.Name, fromRel, to.Name, toRel)
+		return nil
+	}
+	if hasSymlink(src) {
+		return os.ErrPermission
+	}
+	size := pathSize(src)
+	if err := checkShareQuota(to.Name, size); err != nil {
+		return err
+	}
+	keepVersion(to, toRel, dst, s.username)
+	if err := movePath(src, dst); err != nil {
+		return err
+	}
+	moveFileVersions(from.Name, fromRel, to.Name, toRel)
+	chargeShareQuota(to.Name, size)
+	markQuotaStale(from.Name)
+	return nil
+}
+
+func (s *shareFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if isShareFSRoot(name) {
+		return rootDirInfo{name: "/"}, nil
+	}
+	share, rel, err := s.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	full, err := resolveSharePath(share, rel)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+	if rel == "" {
+		return shareNamedInfo{FileInfo: info, name: share.Name}, nil
+	}
+	return info, nil
+}
+
+// shareFile hides the recycle bin and snapshots in a share's root folder,
+// and keeps writes within the share's quota
+type shareFile struct {
+	*os.File
+	shareRoot bool
+	quota     *quotaFile // Set for files opened for writing in a share with a quota
+}
+
+func (f *shareFile) Write(p []byte) (int, error) {
+	if f.quota != nil {
+		if err := f.quota.allow(len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return f.File.Write(p)
+}
+
+func (f *shareFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.quota != nil {
+		if err := f.quota.allow(len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *shareFile) Close() error {
+	if f.quota != nil {
+		f.quota.closed(f.File)
+	}
+	return f.File.Close()
+}
+
+func (f *shareFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	if !f.shareRoot {
+		return infos, err
+	}
+	kept := infos[:0]
+	for _, info := range infos {
+		if !hiddenShareDir(info.Name()) {
+			kept = append(kept, info)
+		}
+	}
+	return kept, err
+}
+
+// shareRootDir is the virtual folder of the shares
+type shareRootDir struct {
+	shares []models.FileShare
+	pos    int
+}
+
+func (r *shareRootDir) Close() error                                 { return nil }
+func (r *shareRootDir) Read(p []byte) (int, error)                   { return 0, fs.ErrInvalid }
+func (r *shareRootDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (r *shareRootDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (r *shareRootDir) Stat() (os.FileInfo, error)                   { return rootDirInfo{name: "/"}, nil }
+
+func (r *shareRootDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos := []os.FileInfo{}
+	for r.pos < len(r.shares) && (count <= 0 || len(infos) < count) {
+		share := r.shares[r.pos]
+		r.pos++
+		info, err := os.Stat(share.Path)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		infos = append(infos, shareNamedInfo{FileInfo: info, name: share.Name})
+	}
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	return infos, nil
+}
+
+// shareNamedInfo shows a share's folder under the share's name
+type shareNamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i shareNamedInfo) Name() string { return i.name }
+
+// rootDirInfo describes the virtual root
+type rootDirInfo struct {
+	name string
+}
+
+func (i rootDirInfo) Name() string       { return i.name }
+func (i rootDirInfo) Size() int64        { return 0 }
+func (i rootDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (i rootDirInfo) ModTime() time.Time { return time.Time{} }
+func (i rootDirInfo) IsDir() bool        { return true }
+func (i rootDirInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,652 @@
+package handlers
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share links publish a file or folder of a file share under
+// /api/public/links/<token>. A link may need a password, expire, stop after
+// a number of downloads, and for folders let visitors upload (a file
+// request). Visitors unlock a password-protected link once and get a
+// short-lived access token to pass along as ?access= or X-Share-Access.
+
+const (
+	shareLinkAccessTTL    = time.Hour
+	shareLinkMaxFailures  = 5
+	shareLinkFailureReset = 15 * time.Minute
+)
+
+var (
+	errShareLinkNotFound = errors.New("Share link not found")
+	errShareLinkExpired  = errors.New("Share link expired")
+	errShareLinkLimit    = errors.New("Download limit reached")
+)
+
+// CreateShareLinkRequest is the body of CreateShareLink
+type CreateShareLinkRequest struct {
+	Share        string `json:"share"`
+	Path         string `json:"path"`
+	Password     string `json:"password"`
+	ExpiresAt    int64  `json:"expiresAt"` // Unix timestamp in ms, 0 = never
+	MaxDownloads int    `json:"maxDownloads"`
+	AllowUpload  bool   `json:"allowUpload"`
+}
+
+// ShareLinkInfo is what a visitor learns about a link
+type ShareLinkInfo struct {
+	Name          string      `json:"name"`
+	IsDir         bool        `json:"isDir"`
+	Size          int64       `json:"size,omitempty"`
+	NeedsPassword bool        `json:"needsPassword"`
+	ExpiresAt     int64       `json:"expiresAt,omitempty"`
+	DownloadsLeft *int        `json:"downloadsLeft,omitempty"`
+	AllowUpload   bool        `json:"allowUpload"`
+	Path          string      `json:"path,omitempty"`    // Folder shown, inside the link
+	Entries       []FileEntry `json:"entries,omitempty"` // Once unlocked
+}
+
+// Share link tokens are signed with a key of their own, so a visitor's
+// token is never a login token
+const shareLinkKeyPurpose = "share-link"
+
+// ShareLinkClaims is the access token of an unlocked link
+type ShareLinkClaims struct {
+	Link string `json:"link"`
+	jwt.RegisteredClaims
+}
+
+func shareLinksFile() string {
+	return filepath.Join(config.DataDir, "share_links.json")
+}
+
+func loadShareLinks() []models.ShareLink {
+	links := []models.ShareLink{}
+	utils.ReadJSON(shareLinksFile(), &links)
+	return links
+}
+
+func findShareLink(token string) (models.ShareLink, error) {
+	if !isValidUploadID(token) {
+		return models.ShareLink{}, errShareLinkNotFound
+	}
+	for _, l := range loadShareLinks() {
+		if l.Token == token {
+			return l, nil
+		}
+	}
+	return models.ShareLink{}, errShareLinkNotFound
+}
+
+// shareLinkActive reports why a link can no longer be used, if it cannot
+func shareLinkActive(l models.ShareLink, now time.Time) error {
+	if l.ExpiresAt > 0 && now.UnixMilli() >= l.ExpiresAt {
+		return errShareLinkExpired
+	}
+	if l.MaxDownloads > 0 && l.Downloads >= l.MaxDownloads {
+		return errShareLinkLimit
+	}
+	return nil
+}
+
+// publicShareLink hides what visitors must not see
+func publicShareLink(l models.ShareLink) models.ShareLink {
+	l.PasswordHash = ""
+	return l
+}
+
+// attemptLimiter counts failed attempts per key, to slow down guessing
+type attemptLimiter struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	failures map[string][]time.Time
+}
+
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{max: max, window: window, failures: map[string][]time.Time{}}
+}
+
+// locked reports whether key failed too often within the window
+func (a *attemptLimiter) locked(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	recent := a.failures[key][:0]
+	for _, t := range a.failures[key] {
+		if time.Since(t) < a.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(a.failures, key)
+		return false
+	}
+	a.failures[key] = recent
+	return len(recent) >= a.max
+}
+
+func (a *attemptLimiter) failed(key string) {
+	a.mu.Lock()
+	a.failures[key] = append(a.failures[key], time.Now())
+	a.mu.Unlock()
+}
+
+// Failed password attempts per link
+var shareLinkAttempts = newAttemptLimiter(shareLinkMaxFailures, shareLinkFailureReset)
+
+// shareLinkUnlocked reports whether the request may see the link's content
+func shareLinkUnlocked(c *gin.Context, l models.ShareLink) bool {
+	if l.PasswordHash == "" {
+		return true
+	}
+	tokenStr := strings.TrimSpace(c.GetHeader("X-Share-Access"))
+	if tokenStr == "" {
+		tokenStr = strings.TrimSpace(c.Query("access"))
+	}
+	if tokenStr == "" {
+		return false
+	}
+	claims := &ShareLinkClaims{}
+	tok, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		return config.DerivedKey(shareLinkKeyPurpose), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(shareLinkKeyPurpose))
+	return err == nil && tok.Valid && claims.Subject == "share-link" && claims.Link == l.Token
+}
+
+// shareLinkError answers for a link that is missing or used up
+func shareLinkError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errShareLinkNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errShareLinkExpired), errors.Is(err, errShareLinkLimit):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		fileError(c, err, "")
+	}
+}
+
+// publicLink loads the link of the request for a visitor. With content
+// set, the link must also be unlocked.
+func publicLink(c *gin.Context, content bool) (models.ShareLink, models.FileShare, bool) {
+	l, err := findShareLink(c.Param("token"))
+	if err == nil {
+		err = shareLinkActive(l, time.Now())
+	}
+	if err != nil {
+		shareLinkError(c, err)
+		return l, models.FileShare{}, false
+	}
+	share, err := findFileShare(l.Share)
+	if err != nil {
+		// The share is gone or renamed: so is the link
+		shareLinkError(c, errShareLinkNotFound)
+		return l, share, false
+	}
+	if content && !shareLinkUnlocked(c, l) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password required"})
+		return l, share, false
+	}
+	return l, share, true
+}
+
+// shareLinkPath maps a path inside a folder link to the share path. The
+// path is cleaned on its own first, so ".." cannot leave the link.
+func shareLinkPath(l models.ShareLink, p string) (string, error) {
+	sub, err := cleanSharePath(p)
+	if err != nil {
+		return "", err
+	}
+	if sub != "" && !l.IsDir {
+		return "", errInvalidPath
+	}
+	return cleanSharePath(path.Join(l.Path, sub))
+}
+
+// resolveShareLinkPath maps a path inside a link to the file on disk, and
+// returns the linked file or folder on disk too. Symlinks are followed only
+// as far as the link reaches: one pointing elsewhere in the share would
+// publish what was never shared.
+func resolveShareLinkPath(share models.FileShare, l models.ShareLink, p string) (rel, full, root string, err error) {
+	if rel, err = shareLinkPath(l, p); err != nil {
+		return "", "", "", err
+	}
+	if root, err = resolveSharePath(share, l.Path); err != nil {
+		return "", "", "", err
+	}
+	if full, err = resolveSharePath(share, rel); err != nil {
+		return "", "", "", err
+	}
+	if !pathWithin(root, full) {
+		return "", "", "", errInvalidPath
+	}
+	return rel, full, root, nil
+}
+
+// countShareLinkDownload takes one download off the link, failing when
+// none are left
+func countShareLinkDownload(token string) error {
+	var links []models.ShareLink
+	return utils.UpdateJSON(shareLinksFile(), &links, func() error {
+		for i := range links {
+			if links[i].Token != token {
+				continue
+			}
+			if err := shareLinkActive(links[i], time.Now()); err != nil {
+				return err
+			}
+			links[i].Downloads++
+			return nil
+		}
+		return errShareLinkNotFound
+	})
+}
+
+// CreateShareLink publishes a file or folder
+func CreateShareLink(c *gin.Context) {
+	var req CreateShareLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.MaxDownloads < 0 || req.ExpiresAt < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.ExpiresAt > 0 && req.ExpiresAt <= time.Now().UnixMilli() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry"})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	rel, err := cleanSharePath(req.Path)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	full, err := resolveSharePath(share, rel)
+	if err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	if req.AllowUpload && (!info.IsDir() || share.ReadOnly) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Uploads need a writable folder"})
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save share link"})
+		return
+	}
+	link := models.ShareLink{
+		Token:        hex.EncodeToString(buf),
+		Share:        share.Name,
+		Path:         rel,
+		Name:         path.Base(rel),
+		IsDir:        info.IsDir(),
+		Owner:        c.GetString("username"),
+		ExpiresAt:    req.ExpiresAt,
+		MaxDownloads: req.MaxDownloads,
+		AllowUpload:  req.AllowUpload,
+		CreatedAt:    time.Now().UnixMilli(),
+	}
+	if rel == "" {
+		link.Name = share.Name
+	}
+	if req.Password != "" {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), 10)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save share link"})
+			return
+		}
+		link.PasswordHash, link.HasPassword = string(hashed), true
+	}
+	var links []models.ShareLink
+	err = utils.UpdateJSON(shareLinksFile(), &links, func() error {
+		links = append(links, link)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save share link"})
+		return
+	}
+	c.Set("auditTarget", share.Name+":"+rel)
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": publicShareLink(link), "url": "/api/public/links/" + link.Token})
+}
+
+// GetShareLinks lists the caller's links. The admin may ask for ?all=1,
+// the links of every user that can still be used.
+func GetShareLinks(c *gin.Context) {
+	username := c.GetString("username")
+	all := c.Query("all") == "1"
+	if all && username != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	now := time.Now()
+	links := []models.ShareLink{}
+	for _, l := range loadShareLinks() {
+		if all {
+			if shareLinkActive(l, now) != nil {
+				continue
+			}
+		} else if l.Owner != username {
+			continue
+		}
+		links = append(links, publicShareLink(l))
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt > links[j].CreatedAt })
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": links})
+}
+
+// DeleteShareLink revokes a link; the admin may revoke anyone's
+func DeleteShareLink(c *gin.Context) {
+	username := c.GetString("username")
+	token := c.Param("token")
+	found := false
+	var links []models.ShareLink
+	err := utils.UpdateJSON(shareLinksFile(), &links, func() error {
+		kept := links[:0]
+		for _, l := range links {
+			if l.Token == token && (l.Owner == username || username == "admin") {
+				found = true
+				continue
+			}
+			kept = append(kept, l)
+		}
+		links = kept
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save share link"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": errShareLinkNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetPublicShareLink describes a link to a visitor; once unlocked, a
+// folder link also lists the folder given by ?path=
+func GetPublicShareLink(c *gin.Context) {
+	l, share, ok := publicLink(c, false)
+	if !ok {
+		return
+	}
+	info := ShareLinkInfo{
+		Name:          l.Name,
+		IsDir:         l.IsDir,
+		NeedsPassword: l.PasswordHash != "",
+		ExpiresAt:     l.ExpiresAt,
+		AllowUpload:   l.AllowUpload && !share.ReadOnly,
+	}
+	if l.MaxDownloads > 0 {
+		left := l.MaxDownloads - l.Downloads
+		info.DownloadsLeft = &left
+	}
+	if !shareLinkUnlocked(c, l) {
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": info})
+		return
+	}
+	rel, full, _, err := resolveShareLinkPath(share, l, c.Query("path"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	st, err := os.Stat(full)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	if !st.IsDir() {
+		info.Size = st.Size()
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": info})
+		return
+	}
+	items, err := os.ReadDir(full)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	inner := strings.TrimPrefix(strings.TrimPrefix(rel, l.Path), "/")
+	info.Path = inner
+	info.Entries = make([]FileEntry, 0, len(items))
+	for _, item := range items {
+		if rel == "" && hiddenShareDir(item.Name()) {
+			continue
+		}
+		fi, err := item.Info()
+		if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		info.Entries = append(info.Entries, fileEntry(inner, fi))
+	}
+	sort.Slice(info.Entries, func(i, j int) bool {
+		if info.Entries[i].IsDir != info.Entries[j].IsDir {
+			return info.Entries[i].IsDir
+		}
+		return strings.ToLower(info.Entries[i].Name) < strings.ToLower(info.Entries[j].Name)
+	})
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": info})
+}
+
+// UnlockShareLink checks a link's password and hands out an access token
+func UnlockShareLink(c *gin.Context) {
+	l, _, ok := publicLink(c, false)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if l.PasswordHash != "" {
+		if shareLinkAttempts.locked(l.Token) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, try again later"})
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(req.Password)) != nil {
+			shareLinkAttempts.failed(l.Token)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Wrong password"})
+			return
+		}
+	}
+	claims := ShareLinkClaims{
+		Link: l.Token,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(shareLinkAccessTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Subject:   "share-link",
+			Audience:  jwt.ClaimStrings{shareLinkKeyPurpose},
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(config.DerivedKey(shareLinkKeyPurpose))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "token": signed})
+}
+
+// DownloadShareLink sends the linked file, or a file or ZIP of a folder
+// inside a folder link. Each download counts against the limit; range
+// requests past the first byte continue one and do not.
+func DownloadShareLink(c *gin.Context) {
+	l, share, ok := publicLink(c, true)
+	if !ok {
+		return
+	}
+	rel, full, root, err := resolveShareLinkPath(share, l, c.Query("path"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	st, err := os.Stat(full)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	rangeHeader := c.GetHeader("Range")
+	if st.IsDir() || rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-") {
+		if err := countShareLinkDownload(l.Token); err != nil {
+			shareLinkError(c, err)
+			return
+		}
+	}
+	if st.IsDir() {
+		name := path.Base(rel)
+		if rel == "" {
+			name = share.Name
+		}
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", `attachment; filename="download.zip"; filename*=UTF-8''`+url.PathEscape(name+".zip"))
+		c.Header("Cache-Control", "no-store")
+		c.Status(http.StatusOK)
+		ctx := c.Request.Context()
+		zw := zip.NewWriter(c.Writer)
+		err := walkZipItems(ctx, share, []string{rel}, func(item zipItem) error {
+			if !pathWithin(root, item.full) {
+				// A symlink to a file outside the link
+				return nil
+			}
+			return addZipItem(ctx, zw, item)
+		})
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil && ctx.Err() == nil {
+			filesLog.Warn("Share link download failed", "share", share.Name, "error", err)
+		}
+		return
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	defer f.Close()
+	c.Header("Content-Type", fileMime(st.Name()))
+	c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(st.Name()))
+	c.Header("Cache-Control", "no-store")
+	http.ServeContent(c.Writer, c.Request, st.Name(), st.ModTime(), f)
+}
+
+// UploadShareLink stores a visitor's file in a folder link that allows
+// uploads, under ?path= inside it. A taken name gets a copy suffix; a
+// visitor never overwrites anything.
+func UploadShareLink(c *gin.Context) {
+	l, share, ok := publicLink(c, true)
+	if !ok {
+		return
+	}
+	if !l.AllowUpload || !l.IsDir {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Uploads are not allowed"})
+		return
+	}
+	if share.ReadOnly {
+		fileError(c, errShareReadOnly, "")
+		return
+	}
+	rel, dir, _, err := resolveShareLinkPath(share, l, c.Query("path"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		fileError(c, errInvalidPath, "")
+		return
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		return
+	}
+	name := filepath.Base(strings.ReplaceAll(file.Filename, "\\", "/"))
+	if !validFileName(name) || (rel == "" && hiddenShareDir(name)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+	if err := checkShareQuota(share.Name, file.Size); err != nil {
+		fileError(c, err, "")
+		return
+	}
+	name, err = saveNewFile(file, dir, name)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	full := filepath.Join(dir, name)
+	origin := QuarantineEntry{Name: name, Share: share.Name, Path: path.Join(rel, name), Source: "share-link", User: "link:" + l.Token[:8]}
+	if virus, err := screenUpload(c.Request.Context(), full, origin); err != nil {
+		if !errors.Is(err, errFileInfected) {
+			os.Remove(full)
+		}
+		uploadScanError(c, virus, err)
+		return
+	}
+	chargeShareQuota(share.Name, file.Size)
+	filesLog.Info("Share link upload", "share", share.Name, "path", path.Join(rel, name), "link", l.Token[:8])
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"name": name, "size": file.Size}})
+}
+
+// saveNewFile writes an uploaded file to dir under name, or a copy name
+// when name is taken. Creating the file exclusively means two uploads of
+// the same name at once never end up in the same file.
+func saveNewFile(file *multipart.FileHeader, dir, name string) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	var dst *os.File
+	for tries := 0; ; tries++ {
+		dst, err = os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) || tries >= 100 {
+			return "", err
+		}
+		name = copyName(dir, name)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestShareLinks(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(root, "secret.txt"), []byte("no"), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	r := gin.New()
+	auth := r.Group("/", func(c *gin.Context) { c.Set("username", c.GetHeader("X-User")) })
+	auth.GET("/links", GetShareLinks)
+	auth.POST("/links", CreateShareLink)
+	auth.DELETE("/links/:token", DeleteShareLink)
+	r.GET("/public/links/:token", GetPublicShareLink)
+	r.POST("/public/links/:token/unlock", UnlockShareLink)
+	r.GET("/public/links/:token/download", DownloadShareLink)
+	r.POST("/public/links/:token/upload", UploadShareLink)
+	do := func(req *http.Request, user string) *httptest.ResponseRecorder {
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	create := func(body string) models.ShareLink {
+		w := do(httptest.NewRequest("POST", "/links", strings.NewReader(body)), "alice")
+		var resp struct{ Data models.ShareLink }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 || resp.Data.Token == "" || resp.Data.PasswordHash != "" {
+			t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+		}
+		return resp.Data
+	}
+
+	// A file link with a download limit
+	file := create(`{"share":"main","path":"docs/a.txt","maxDownloads":1}`)
+	w := do(httptest.NewRequest("GET", "/public/links/"+file.Token+"/download", nil), "")
+	if w.Code != 200 || w.Body.String() != "hello" {
+		t.Fatalf("unexpected download %d %q", w.Code, w.Body.String())
+	}
+	if w := do(httptest.NewRequest("GET", "/public/links/"+file.Token+"/download", nil), ""); w.Code != http.StatusGone {
+		t.Fatalf("expected the limit to be enforced, got %d", w.Code)
+	}
+
+	// A folder link behind a password that takes uploads
+	folder := create(`{"share":"main","path":"docs","password":"pw","allowUpload":true}`)
+	w = do(httptest.NewRequest("GET", "/public/links/"+folder.Token, nil), "")
+	if w.Code != 200 || strings.Contains(w.Body.String(), "a.txt") || !strings.Contains(w.Body.String(), `"needsPassword":true`) {
+		t.Fatalf("expected a locked link, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(httptest.NewRequest("GET", "/public/links/"+folder.Token+"/download?path=a.txt", nil), ""); w.Code != 401 {
+		t.Fatalf("expected a password to be required, got %d", w.Code)
+	}
+	if w := do(httptest.NewRequest("POST", "/public/links/"+folder.Token+"/unlock", strings.NewReader(`{"password":"nope"}`)), ""); w.Code != 401 {
+		t.Fatalf("expected a wrong password to fail, got %d", w.Code)
+	}
+	w = do(httptest.NewRequest("POST", "/public/links/"+folder.Token+"/unlock", strings.NewReader(`{"password":"pw"}`)), "")
+	var unlocked struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &unlocked)
+	if w.Code != 200 || unlocked.Token == "" {
+		t.Fatalf("unlock failed: %d %s", w.Code, w.Body.String())
+	}
+	access := "access=" + unlocked.Token
+	w = do(httptest.NewRequest("GET", "/public/links/"+folder.Token+"?"+access, nil), "")
+	if !strings.Contains(w.Body.String(), `"name":"a.txt"`) {
+		t.Fatalf("expected the folder listed, got %s", w.Body.String())
+	}
+	w = do(httptest.NewRequest("GET", "/public/links/"+folder.Token+"/download?path=a.txt&"+access, nil), "")
+	if w.Code != 200 || w.Body.String() != "hello" {
+		t.Fatalf("unexpected download %d %q", w.Code, w.Body.String())
+	}
+	// Nothing outside the linked folder is reachable
+	if w := do(httptest.NewRequest("GET", "/public/links/"+folder.Token+"/download?path=../secret.txt&"+access, nil), ""); w.Code != 404 {
+		t.Fatalf("expected the path to stay inside the link, got %d", w.Code)
+	}
+	// Nor through symlinks inside the folder that point elsewhere in the share
+	os.Symlink("..", filepath.Join(root, "docs", "up"))
+	os.Symlink("../secret.txt", filepath.Join(root, "docs", "leak.txt"))
+	for _, target := range []string{"/download?path=up/secret.txt&", "/download?path=leak.txt&", "?path=up&"} {
+		if w := do(httptest.NewRequest("GET", "/public/links/"+folder.Token+target+access, nil), ""); w.Code != 400 {
+			t.Fatalf("%s: expected the symlink refused, got %d %s", target, w.Code, w.Body.String())
+		}
+	}
+	w = do(httptest.NewRequest("GET", "/public/links/"+folder.Token+"/download?"+access, nil), "")
+	if zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len())); err != nil || len(zr.File) != 2 {
+		t.Fatalf("expected a ZIP of the folder, got %d %v", w.Code, err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "a.txt")
+	part.Write([]byte("upload"))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/public/links/"+folder.Token+"/upload?"+access, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if w := do(req, ""); w.Code != 200 || !strings.Contains(w.Body.String(), `"name":"a (copy).txt"`) {
+		t.Fatalf("unexpected upload %d %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "docs", "a.txt")); string(data) != "hello" {
+		t.Fatalf("an upload must not overwrite")
+	}
+
+	// Uploads need a folder
+	if w := do(httptest.NewRequest("POST", "/links", strings.NewReader(`{"share":"main","path":"secret.txt","allowUpload":true}`)), "alice"); w.Code != 400 {
+		t.Fatalf("expected uploads to need a folder, got %d", w.Code)
+	}
+
+	// Only the admin sees everyone's active links
+	if w := do(httptest.NewRequest("GET", "/links?all=1", nil), "alice"); w.Code != 403 {
+		t.Fatalf("expected the admin view to be forbidden, got %d", w.Code)
+	}
+	w = do(httptest.NewRequest("GET", "/links?all=1", nil), "admin")
+	var all struct{ Data []models.ShareLink }
+	json.Unmarshal(w.Body.Bytes(), &all)
+	if len(all.Data) != 1 || all.Data[0].Token != folder.Token || !all.Data[0].HasPassword {
+		t.Fatalf("expected only the active link, got %+v", all.Data)
+	}
+	if w := do(httptest.NewRequest("DELETE", "/links/"+folder.Token, nil), "bob"); w.Code != 404 {
+		t.Fatalf("expected others' links to be kept, got %d", w.Code)
+	}
+	if w := do(httptest.NewRequest("DELETE", "/links/"+folder.Token, nil), "admin"); w.Code != 200 {
+		t.Fatalf("delete failed: %d", w.Code)
+	}
+	if w := do(httptest.NewRequest("GET", "/public/links/"+folder.Token, nil), ""); w.Code != 404 {
+		t.Fatalf("expected a deleted link to be gone, got %d", w.Code)
+	}
+}
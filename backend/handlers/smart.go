@@ -0,0 +1,615 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/store"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The health of the disks is read with smartctl from smartmontools. Every
+// poll scans the disks, reads their SMART data without waking sleeping
+// ones, and keeps the main counters in the store for trend graphs. An
+// alert goes out when a disk fails its own health check, a pre-fail
+// attribute reaches its threshold, the bad sector counts grow, or it gets
+// too hot. What was already reported is kept in smart_alerts.json so that
+// a restart does not report it again.
+
+const (
+	smartDefaultInterval = 30 // Minutes
+	smartMinInterval     = 5
+	smartDefaultMaxTemp  = 60
+	smartTempHysteresis  = 5 // °C below the maximum before a disk can alert again
+	smartHistoryDays     = 90
+	smartMonitorTick     = time.Minute
+)
+
+// smartctl exit status bits
+const (
+	smartExitOpenFailed = 1 << 1 // Also a disk in standby with -n standby
+)
+
+var errNoSmartctl = errors.New("smartmontools is not installed")
+
+// SmartAttribute is a row of the ATA attribute table
+type SmartAttribute struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Value     int    `json:"value"`
+	Worst     int    `json:"worst"`
+	Threshold int    `json:"threshold"`
+	Raw       int64  `json:"raw"`
+	RawString string `json:"rawString"`
+	PreFail   bool   `json:"preFail"`
+	Failing   bool   `json:"failing"` // The value is at or below the threshold
+}
+
+// SmartDisk is the last reading of a disk
+type SmartDisk struct {
+	Device        string           `json:"device"`
+	Type          string           `json:"type"`
+	Protocol      string           `json:"protocol"`
+	Model         string           `json:"model"`
+	Serial        string           `json:"serial"`
+	Firmware      string           `json:"firmware"`
+	Capacity      int64            `json:"capacity"`
+	Rotation      int              `json:"rotation"` // RPM, 0 for solid state
+	Healthy       bool             `json:"healthy"`
+	Standby       bool             `json:"standby"` // Asleep; the rest is from the last reading
+	Temperature   int              `json:"temperature"`
+	PowerOnHours  int64            `json:"powerOnHours"`
+	PowerCycles   int64            `json:"powerCycles"`
+	Reallocated   int64            `json:"reallocated"`
+	Pending       int64            `json:"pending"`
+	Uncorrectable int64            `json:"uncorrectable"`
+	MediaErrors   int64            `json:"mediaErrors"`
+	CriticalWarn  int              `json:"criticalWarning"` // NVMe
+	PercentUsed   int              `json:"percentUsed"`     // NVMe endurance
+	Attributes    []SmartAttribute `json:"attributes"`
+	Status        string           `json:"status"` // ok, warning or failing
+	Error         string           `json:"error,omitempty"`
+	CheckedAt     int64            `json:"checkedAt"`
+}
+
+// key names a disk across polls and device renames
+func (d SmartDisk) key() string {
+	if d.Serial != "" {
+		return d.Serial
+	}
+	return d.Device
+}
+
+// SmartHistoryPoint is a past reading of a disk
+type SmartHistoryPoint struct {
+	Time          int64 `json:"time"`
+	Healthy       bool  `json:"healthy"`
+	Temperature   int   `json:"temperature"`
+	Reallocated   int64 `json:"reallocated"`
+	Pending       int64 `json:"pending"`
+	Uncorrectable int64 `json:"uncorrectable"`
+	MediaErrors   int64 `json:"mediaErrors"`
+	PowerOnHours  int64 `json:"powerOnHours"`
+}
+
+// smartctlDevice is a device of smartctl --scan-open
+type smartctlDevice struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+}
+
+// smartctlOutput is the part of smartctl -a -j that is used
+type smartctlOutput struct {
+	Smartctl struct {
+		ExitStatus int `json:"exit_status"`
+		Messages   []struct {
+			String   string `json:"string"`
+			Severity string `json:"severity"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	Device       smartctlDevice `json:"device"`
+	ModelName    string         `json:"model_name"`
+	SerialNumber string         `json:"serial_number"`
+	Firmware     string         `json:"firmware_version"`
+	UserCapacity struct {
+		Bytes int64 `json:"bytes"`
+	} `json:"user_capacity"`
+	RotationRate int `json:"rotation_rate"`
+	SmartStatus  *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature struct {
+		Current int `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime struct {
+		Hours int64 `json:"hours"`
+	} `json:"power_on_time"`
+	PowerCycleCount int64 `json:"power_cycle_count"`
+	AtaAttributes   struct {
+		Table []struct {
+			ID         int    `json:"id"`
+			Name       string `json:"name"`
+			Value      int    `json:"value"`
+			Worst      int    `json:"worst"`
+			Thresh     int    `json:"thresh"`
+			WhenFailed string `json:"when_failed"`
+			Flags      struct {
+				Prefailure bool `json:"prefailure"`
+			} `json:"flags"`
+			Raw struct {
+				Value  int64  `json:"value"`
+				String string `json:"string"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NvmeLog *struct {
+		CriticalWarning int   `json:"critical_warning"`
+		PercentageUsed  int   `json:"percentage_used"`
+		MediaErrors     int64 `json:"media_errors"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+// smartAlertState is what was last reported of a disk
+type smartAlertState struct {
+	Failing       bool  `json:"failing"`
+	Hot           bool  `json:"hot"`
+	Critical      int   `json:"critical"`
+	Prefail       []int `json:"prefail"`
+	Reallocated   int64 `json:"reallocated"`
+	Pending       int64 `json:"pending"`
+	Uncorrectable int64 `json:"uncorrectable"`
+	MediaErrors   int64 `json:"mediaErrors"`
+}
+
+// smartCache holds the last poll
+var smartCache = struct {
+	sync.Mutex
+	disks   []SmartDisk
+	checked time.Time
+}{}
+
+// smartPolling keeps one poll at a time
+var smartPolling sync.Mutex
+
+func smartSettings() models.SmartSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	settings := models.SmartSettings{}
+	if sysConfig.Smart != nil {
+		settings = *sysConfig.Smart
+	}
+	if settings.IntervalMinutes == 0 {
+		settings.IntervalMinutes = smartDefaultInterval
+	}
+	if settings.MaxTemperature == 0 {
+		settings.MaxTemperature = smartDefaultMaxTemp
+	}
+	return settings
+}
+
+// decodeSmartSettings reads the "smart" field of a system config update
+func decodeSmartSettings(raw interface{}) (*models.SmartSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SMART settings")
+	}
+	settings := &models.SmartSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid SMART settings")
+	}
+	if settings.IntervalMinutes != 0 && settings.IntervalMinutes < smartMinInterval || settings.IntervalMinutes < 0 ||
+		settings.MaxTemperature < 0 || settings.MaxTemperature > 100 {
+		return nil, fmt.Errorf("Invalid SMART settings")
+	}
+	return settings, nil
+}
+
+func smartAlertsFile() string {
+	return filepath.Join(config.DataDir, "smart_alerts.json")
+}
+
+// smartctl runs smartctl; a non-zero exit status still comes with the
+// JSON output, which says what went wrong
+func smartctl(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := systemCommand(ctx, errNoSmartctl, "smartctl", args...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && json.Valid(out) {
+		return out, nil
+	}
+	return out, err
+}
+
+func scanSmartDevices(ctx context.Context) ([]smartctlDevice, error) {
+	out, err := smartctl(ctx, "--scan-open", "-j")
+	if err != nil {
+		return nil, err
+	}
+	var scan struct {
+		Devices []smartctlDevice `json:"devices"`
+	}
+	if err := json.Unmarshal(out, &scan); err != nil {
+		return nil, fmt.Errorf("smartctl scan: %w", err)
+	}
+	return scan.Devices, nil
+}
+
+// parseSmartctl turns the output of smartctl -a -j into a disk; standby
+// is true when the disk was asleep and not read
+func parseSmartctl(data []byte, dev smartctlDevice) (disk SmartDisk, standby bool, err error) {
+	var out smartctlOutput
+	if err := json.Unmarshal(data, &out); err != nil {
+		return SmartDisk{}, false, fmt.Errorf("smartctl: %w", err)
+	}
+	disk = SmartDisk{
+		Device:       dev.Name,
+		Type:         dev.Type,
+		Protocol:     dev.Protocol,
+		Model:        out.ModelName,
+		Serial:       out.SerialNumber,
+		Firmware:     out.Firmware,
+		Capacity:     out.UserCapacity.Bytes,
+		Rotation:     out.RotationRate,
+		Temperature:  out.Temperature.Current,
+		PowerOnHours: out.PowerOnTime.Hours,
+		PowerCycles:  out.PowerCycleCount,
+		Attributes:   []SmartAttribute{},
+	}
+	if out.Smartctl.ExitStatus&smartExitOpenFailed != 0 && out.SmartStatus == nil {
+		var messages []string
+		for _, m := range out.Smartctl.Messages {
+			if strings.Contains(strings.ToLower(m.String), "standby") {
+				return disk, true, nil
+			}
+			messages = append(messages, m.String)
+		}
+		if len(messages) == 0 {
+			messages = append(messages, "smartctl could not open the device")
+		}
+		return disk, false, errors.New(strings.Join(messages, "; "))
+	}
+	disk.Healthy = out.SmartStatus == nil || out.SmartStatus.Passed
+	for _, row := range out.AtaAttributes.Table {
+		attr := SmartAttribute{
+			ID:        row.ID,
+			Name:      row.Name,
+			Value:     row.Value,
+			Worst:     row.Worst,
+			Threshold: row.Thresh,
+			Raw:       row.Raw.Value,
+			RawString: row.Raw.String,
+			PreFail:   row.Flags.Prefailure,
+			Failing:   row.WhenFailed == "now" || row.Thresh > 0 && row.Value <= row.Thresh,
+		}
+		switch row.ID {
+		case 5:
+			disk.Reallocated = row.Raw.Value
+		case 197:
+			disk.Pending = row.Raw.Value
+		case 198:
+			disk.Uncorrectable = row.Raw.Value
+		}
+		disk.Attributes = append(disk.Attributes, attr)
+	}
+	if out.NvmeLog != nil {
+		disk.CriticalWarn = out.NvmeLog.CriticalWarning
+		disk.PercentUsed = out.NvmeLog.PercentageUsed
+		disk.MediaErrors = out.NvmeLog.MediaErrors
+	}
+	return disk, false, nil
+}
+
+// smartStatus sums a disk up
+func smartStatus(d SmartDisk, maxTemp int) string {
+	if !d.Healthy || d.CriticalWarn != 0 {
+		return "failing"
+	}
+	for _, a := range d.Attributes {
+		if a.PreFail && a.Failing {
+			return "failing"
+		}
+	}
+	if d.Reallocated > 0 || d.Pending > 0 || d.Uncorrectable > 0 || d.MediaErrors > 0 || d.Temperature >= maxTemp {
+		return "warning"
+	}
+	return "ok"
+}
+
+// smartAlerts compares a reading with what was last reported of the disk
+// and returns what is new, and the state to keep. A disk seen for the
+// first time reports its failures but not its counters.
+func smartAlerts(prev *smartAlertState, d SmartDisk, maxTemp int) ([]string, smartAlertState) {
+	locale := notifyLocale()
+	next := smartAlertState{
+		Failing:       !d.Healthy,
+		Critical:      d.CriticalWarn,
+		Prefail:       []int{},
+		Reallocated:   d.Reallocated,
+		Pending:       d.Pending,
+		Uncorrectable: d.Uncorrectable,
+		MediaErrors:   d.MediaErrors,
+	}
+	if prev == nil {
+		prev = &smartAlertState{Reallocated: d.Reallocated, Pending: d.Pending, Uncorrectable: d.Uncorrectable, MediaErrors: d.MediaErrors}
+	}
+	var reasons []string
+	if next.Failing && !prev.Failing {
+		reasons = append(reasons, i18n.T(locale, "notify_smart_failing"))
+	}
+	if next.Critical != 0 && next.Critical != prev.Critical {
+		reasons = append(reasons, i18n.T(locale, "notify_smart_critical", next.Critical))
+	}
+	for _, c := range []struct {
+		name    string
+		was, is int64
+	}{
+		{"smart_reallocated", prev.Reallocated, d.Reallocated},
+		{"smart_pending", prev.Pending, d.Pending},
+		{"smart_uncorrectable", prev.Uncorrectable, d.Uncorrectable},
+		{"smart_media_errors", prev.MediaErrors, d.MediaErrors},
+	} {
+		if c.is > c.was {
+			reasons = append(reasons, i18n.T(locale, "notify_smart_grew", i18n.T(locale, c.name), c.was, c.is))
+		}
+	}
+	for _, a := range d.Attributes {
+		if !a.PreFail || !a.Failing {
+			continue
+		}
+		next.Prefail = append(next.Prefail, a.ID)
+		if !slices.Contains(prev.Prefail, a.ID) {
+			reasons = append(reasons, i18n.T(locale, "notify_smart_prefail", a.Name))
+		}
+	}
+	switch {
+	case d.Temperature >= maxTemp:
+		next.Hot = true
+		if !prev.Hot {
+			reasons = append(reasons, i18n.T(locale, "notify_smart_hot", d.Temperature))
+		}
+	case prev.Hot && d.Temperature > maxTemp-smartTempHysteresis:
+		next.Hot = true
+	}
+	return reasons, next
+}
+
+func raiseSmartAlert(d SmartDisk, reasons []string) {
+	name := d.Device
+	if d.Model != "" {
+		name += " (" + d.Model + ")"
+	}
+	diskLog.Warn("Disk health alert", "device", d.Device, "serial", d.Serial, "reasons", strings.Join(reasons, "; "))
+	sendNotification(backgroundCtx, Notification{
+		Title:  i18n.T(notifyLocale(), "notify_smart_alert", name),
+		Body:   strings.Join(reasons, "\n"),
+		Source: "smart",
+	}, smartSettings().Channels)
+	fireWebhook(WebhookDiskAlert, map[string]interface{}{
+		"device":  d.Device,
+		"model":   d.Model,
+		"serial":  d.Serial,
+		"status":  d.Status,
+		"reasons": reasons,
+	})
+}
+
+// pollSmart reads every disk, records the readings and raises the alerts
+func pollSmart(ctx context.Context) ([]SmartDisk, error) {
+	smartPolling.Lock()
+	defer smartPolling.Unlock()
+	devices, err := scanSmartDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings := smartSettings()
+	smartCache.Lock()
+	last := make(map[string]SmartDisk, len(smartCache.disks))
+	for _, d := range smartCache.disks {
+		last[d.Device] = d
+	}
+	smartCache.Unlock()
+
+	var alerts map[string]smartAlertState
+	utils.ReadJSON(smartAlertsFile(), &alerts)
+	if alerts == nil {
+		alerts = make(map[string]smartAlertState)
+	}
+	now := time.Now()
+	disks := make([]SmartDisk, 0, len(devices))
+	for _, dev := range devices {
+		args := []string{"-a", "-j", "-n", "standby"}
+		if dev.Type != "" {
+			args = append(args, "-d", dev.Type)
+		}
+		out, err := smartctl(ctx, append(args, dev.Name)...)
+		var d SmartDisk
+		standby := false
+		if err == nil {
+			d, standby, err = parseSmartctl(out, dev)
+		}
+		if errors.Is(err, errNoSmartctl) || ctx.Err() != nil {
+			return nil, err
+		}
+		if standby {
+			if prev, ok := last[dev.Name]; ok {
+				d = prev
+			}
+			d.Standby = true
+			disks = append(disks, d)
+			continue
+		}
+		if err != nil {
+			diskLog.Warn("Reading SMART data failed", "device", dev.Name, "error", err)
+			d = SmartDisk{Device: dev.Name, Type: dev.Type, Protocol: dev.Protocol, Attributes: []SmartAttribute{}, Error: err.Error()}
+			disks = append(disks, d)
+			continue
+		}
+		d.CheckedAt = now.UnixMilli()
+		d.Status = smartStatus(d, settings.MaxTemperature)
+		var prev *smartAlertState
+		if state, ok := alerts[d.key()]; ok {
+			prev = &state
+		}
+		reasons, state := smartAlerts(prev, d, settings.MaxTemperature)
+		alerts[d.key()] = state
+		if len(reasons) > 0 && settings.Enable {
+			raiseSmartAlert(d, reasons)
+		}
+		if config.Store != nil {
+			if err := config.Store.AddSmartSample(store.SmartSample{
+				Disk:          d.key(),
+				Time:          d.CheckedAt,
+				Healthy:       d.Healthy,
+				Temperature:   d.Temperature,
+				Reallocated:   d.Reallocated,
+				Pending:       d.Pending,
+				Uncorrectable: d.Uncorrectable,
+				MediaErrors:   d.MediaErrors,
+				PowerOnHours:  d.PowerOnHours,
+			}); err != nil {
+				diskLog.Error("Recording SMART data failed", "device", d.Device, "error", err)
+			}
+		}
+		disks = append(disks, d)
+	}
+	if err := utils.WriteJSON(smartAlertsFile(), alerts); err != nil {
+		diskLog.Error("Saving the SMART alert state failed", "error", err)
+	}
+	smartCache.Lock()
+	smartCache.disks, smartCache.checked = disks, now
+	smartCache.Unlock()
+	return disks, nil
+}
+
+// StartSmartMonitor polls the disks at the configured interval while the
+// monitoring is on, and drops the history past 90 days
+func StartSmartMonitor() {
+	go func() {
+		ticker := time.NewTicker(smartMonitorTick)
+		defer ticker.Stop()
+		beat := registerWorker("smart.monitor", smartMonitorTick)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case now := <-ticker.C:
+				beat()
+				settings := smartSettings()
+				smartCache.Lock()
+				due := now.Sub(smartCache.checked) >= time.Duration(settings.IntervalMinutes)*time.Minute
+				smartCache.Unlock()
+				if !settings.Enable || !due {
+					continue
+				}
+				if _, err := pollSmart(backgroundCtx); err != nil && !errors.Is(err, errNoSmartctl) {
+					diskLog.Error("SMART poll failed", "error", err)
+				}
+				if config.Store != nil {
+					config.Store.PruneSmartHistory(now.AddDate(0, 0, -smartHistoryDays).UnixMilli())
+				}
+			}
+		}
+	}()
+}
+
+func smartError(c *gin.Context, err error) {
+	if errors.Is(err, errNoSmartctl) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	diskLog.Error("SMART poll failed", "error", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Reading the disks failed"})
+}
+
+func smartResponse(c *gin.Context, disks []SmartDisk) {
+	smartCache.Lock()
+	checked := smartCache.checked.UnixMilli()
+	smartCache.Unlock()
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"disks": disks, "checkedAt": checked}})
+}
+
+// GetSmart returns the last reading of every disk, polling them if they
+// were never read
+func GetSmart(c *gin.Context) {
+	smartCache.Lock()
+	disks, checked := smartCache.disks, !smartCache.checked.IsZero()
+	smartCache.Unlock()
+	if !checked {
+		var err error
+		if disks, err = pollSmart(c.Request.Context()); err != nil {
+			smartError(c, err)
+			return
+		}
+	}
+	smartResponse(c, disks)
+}
+
+// RefreshSmart reads the disks now
+func RefreshSmart(c *gin.Context) {
+	disks, err := pollSmart(c.Request.Context())
+	if err != nil {
+		smartError(c, err)
+		return
+	}
+	smartResponse(c, disks)
+}
+
+// GetSmartHistory returns the readings of ?disk= (a serial number, or a
+// device without one) over the last ?days=, 7 by default
+func GetSmartHistory(c *gin.Context) {
+	disk := c.Query("disk")
+	days := 7
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > smartHistoryDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid days"})
+			return
+		}
+		days = n
+	}
+	if disk == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing disk"})
+		return
+	}
+	if config.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "History is unavailable"})
+		return
+	}
+	samples, err := config.Store.SmartHistory(disk, time.Now().AddDate(0, 0, -days).UnixMilli())
+	if err != nil {
+		diskLog.Error("Reading the SMART history failed", "disk", disk, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Reading the history failed"})
+		return
+	}
+	points := make([]SmartHistoryPoint, 0, len(samples))
+	for _, r := range samples {
+		points = append(points, SmartHistoryPoint{
+			Time:          r.Time,
+			Healthy:       r.Healthy,
+			Temperature:   r.Temperature,
+			Reallocated:   r.Reallocated,
+			Pending:       r.Pending,
+			Uncorrectable: r.Uncorrectable,
+			MediaErrors:   r.MediaErrors,
+			PowerOnHours:  r.PowerOnHours,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": points})
+}
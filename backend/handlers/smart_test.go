@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/store"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const smartScanJSON = `{"devices":[
+	{"name":"/dev/sda","type":"sat","protocol":"ATA"},
+	{"name":"/dev/nvme0","type":"nvme","protocol":"NVMe"}
+]}`
+
+func smartAtaJSON(reallocated, value int) string {
+	return `{"smartctl":{"exit_status":0},"model_name":"WDC WD40EFRX","serial_number":"WD-1","firmware_version":"82.00A82",
+	"user_capacity":{"bytes":4000787030016},"rotation_rate":5400,"smart_status":{"passed":true},
+	"temperature":{"current":34},"power_on_time":{"hours":12000},"power_cycle_count":40,
+	"ata_smart_attributes":{"table":[
+		{"id":5,"name":"Reallocated_Sector_Ct","value":` + strconv.Itoa(value) + `,"worst":100,"thresh":10,"when_failed":"","flags":{"prefailure":true},"raw":{"value":` + strconv.Itoa(reallocated) + `,"string":"` + strconv.Itoa(reallocated) + `"}},
+		{"id":194,"name":"Temperature_Celsius","value":116,"worst":100,"thresh":0,"when_failed":"","flags":{"prefailure":false},"raw":{"value":34,"string":"34 (Min/Max 20/45)"}},
+		{"id":197,"name":"Current_Pending_Sector","value":200,"worst":200,"thresh":0,"when_failed":"","flags":{"prefailure":false},"raw":{"value":0,"string":"0"}}
+	]}}`
+}
+
+const smartNvmeJSON = `{"smartctl":{"exit_status":0},"model_name":"Samsung 980","serial_number":"S64","smart_status":{"passed":true},
+	"temperature":{"current":41},"power_on_time":{"hours":900},
+	"nvme_smart_health_information_log":{"critical_warning":0,"percentage_used":3,"media_errors":0}}`
+
+const smartStandbyJSON = `{"smartctl":{"exit_status":2,"messages":[{"string":"Device is in STANDBY mode, exit(2)","severity":"information"}]}}`
+
+func TestSmart(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	db, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	prevStore := config.Store
+	config.Store = db
+	defer func() { config.Store = prevStore; db.Close() }()
+	smartCache.Lock()
+	smartCache.disks, smartCache.checked = nil, time.Time{}
+	smartCache.Unlock()
+
+	r := gin.New()
+	r.GET("/admin/smart", GetSmart)
+	r.POST("/admin/smart/refresh", RefreshSmart)
+	r.GET("/admin/smart/history", GetSmartHistory)
+	poll := func(method, path string) []SmartDisk {
+		t.Helper()
+		w := serve(r, method, path, "")
+		var resp struct {
+			Data struct{ Disks []SmartDisk }
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != 200 || err != nil {
+			t.Fatalf("%s: %d %s", path, w.Code, w.Body.String())
+		}
+		return resp.Data.Disks
+	}
+
+	path := os.Getenv("PATH")
+	t.Setenv("PATH", t.TempDir())
+	if w := serve(r, "GET", "/admin/smart", ""); w.Code != 503 {
+		t.Fatalf("expected 503 without smartctl, got %d", w.Code)
+	}
+
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	os.WriteFile(filepath.Join(bin, "smartctl"), []byte(`#!/bin/sh
+dir="$(dirname "$0")"
+if [ "$1" = "--scan-open" ]; then cat "$dir/scan.json"; exit 0; fi
+for last; do :; done
+name="$(basename "$last")"
+cat "$dir/$name.json"
+[ -f "$dir/$name.exit" ] && exit "$(cat "$dir/$name.exit")"
+exit 0
+`), 0755)
+	write := func(name, content string) {
+		os.WriteFile(filepath.Join(bin, name), []byte(content), 0644)
+	}
+	write("scan.json", smartScanJSON)
+	write("sda.json", smartAtaJSON(0, 100))
+	write("nvme0.json", smartNvmeJSON)
+
+	disks := poll("GET", "/admin/smart")
+	if len(disks) != 2 {
+		t.Fatalf("expected two disks, got %+v", disks)
+	}
+	sda, nvme := disks[0], disks[1]
+	if sda.Serial != "WD-1" || sda.Status != "ok" || sda.Temperature != 34 || sda.Rotation != 5400 || len(sda.Attributes) != 3 || !sda.Attributes[0].PreFail {
+		t.Fatalf("unexpected ATA disk %+v", sda)
+	}
+	if nvme.Serial != "S64" || nvme.Status != "ok" || nvme.PercentUsed != 3 || len(nvme.Attributes) != 0 {
+		t.Fatalf("unexpected NVMe disk %+v", nvme)
+	}
+
+	// Reallocated sectors that grow past the threshold alert and are kept
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Smart: &models.SmartSettings{Enable: true}})
+	write("sda.json", smartAtaJSON(8, 5))
+	time.Sleep(5 * time.Millisecond)
+	disks = poll("POST", "/admin/smart/refresh")
+	if disks[0].Reallocated != 8 || disks[0].Status != "failing" || !disks[0].Attributes[0].Failing {
+		t.Fatalf("expected the disk failing, got %+v", disks[0])
+	}
+	var alerts map[string]smartAlertState
+	utils.ReadJSON(smartAlertsFile(), &alerts)
+	if a := alerts["WD-1"]; a.Reallocated != 8 || len(a.Prefail) != 1 || a.Prefail[0] != 5 {
+		t.Fatalf("unexpected alert state %+v", alerts)
+	}
+
+	// A sleeping disk is not woken and keeps its last reading
+	write("sda.json", smartStandbyJSON)
+	write("sda.exit", "2")
+	disks = poll("POST", "/admin/smart/refresh")
+	if !disks[0].Standby || disks[0].Serial != "WD-1" || disks[0].Reallocated != 8 {
+		t.Fatalf("expected the last reading of the sleeping disk, got %+v", disks[0])
+	}
+	write("sda.json", `{"smartctl":{"exit_status":2,"messages":[{"string":"Smartctl open device: /dev/sda failed: No such device","severity":"error"}]}}`)
+	disks = poll("POST", "/admin/smart/refresh")
+	if disks[0].Error == "" || !strings.Contains(disks[0].Error, "No such device") {
+		t.Fatalf("expected the open error, got %+v", disks[0])
+	}
+
+	// The readings make the history; sleeping disks add none
+	w := serve(r, "GET", "/admin/smart/history?disk=WD-1&days=7", "")
+	var history struct{ Data []SmartHistoryPoint }
+	if err := json.Unmarshal(w.Body.Bytes(), &history); w.Code != 200 || err != nil || len(history.Data) != 2 ||
+		history.Data[0].Reallocated != 0 || history.Data[1].Reallocated != 8 || history.Data[1].PowerOnHours != 12000 {
+		t.Fatalf("unexpected history %d %s", w.Code, w.Body.String())
+	}
+	for query, code := range map[string]int{"disk=WD-1&days=0": 400, "days=7": 400, "disk=WD-1&days=x": 400} {
+		if w := serve(r, "GET", "/admin/smart/history?"+query, ""); w.Code != code {
+			t.Fatalf("%s: expected %d, got %d", query, code, w.Code)
+		}
+	}
+}
+
+func TestSmartAlerts(t *testing.T) {
+	useTestConfig(t)
+	disk := SmartDisk{Device: "/dev/sda", Healthy: true, Temperature: 40, Reallocated: 3}
+
+	// A new disk reports its failures but takes its counters as they are
+	reasons, state := smartAlerts(nil, disk, 60)
+	if len(reasons) != 0 || state.Reallocated != 3 {
+		t.Fatalf("unexpected first reading %v %+v", reasons, state)
+	}
+	disk.Reallocated, disk.Pending = 5, 1
+	if reasons, state = smartAlerts(&state, disk, 60); len(reasons) != 2 || !strings.Contains(reasons[0], "3 to 5") {
+		t.Fatalf("expected the grown counters, got %v", reasons)
+	}
+	if reasons, _ = smartAlerts(&state, disk, 60); len(reasons) != 0 {
+		t.Fatalf("expected nothing new, got %v", reasons)
+	}
+
+	// Heat alerts once, and again only after cooling down
+	for _, step := range []struct {
+		temp   int
+		alerts int
+	}{{62, 1}, {65, 0}, {57, 0}, {61, 0}, {54, 0}, {60, 1}} {
+		disk.Temperature = step.temp
+		if reasons, state = smartAlerts(&state, disk, 60); len(reasons) != step.alerts {
+			t.Fatalf("%d °C: expected %d alerts, got %v", step.temp, step.alerts, reasons)
+		}
+	}
+
+	disk.Healthy = false
+	disk.Attributes = []SmartAttribute{{ID: 5, Name: "Reallocated_Sector_Ct", PreFail: true, Failing: true}}
+	if reasons, _ = smartAlerts(&state, disk, 60); len(reasons) != 2 {
+		t.Fatalf("expected the failed health check and attribute, got %v", reasons)
+	}
+
+	for raw, ok := range map[string]bool{
+		`{"enable":true,"intervalMinutes":15,"maxTemperature":55}`: true,
+		`{"enable":true}`:                     true,
+		`{"enable":true,"intervalMinutes":1}`: false,
+		`{"maxTemperature":500}`:              false,
+		`{"channels":"email"}`:                false,
+	} {
+		var payload interface{}
+		json.Unmarshal([]byte(raw), &payload)
+		if _, err := decodeSmartSettings(payload); (err == nil) != ok {
+			t.Fatalf("%s: unexpected %v", raw, err)
+		}
+	}
+}
@@ -0,0 +1,687 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Shares on Btrfs or ZFS can be snapshotted. A share's volume is the ZFS
+// dataset mounted at or above it, or the Btrfs subvolume holding it, and
+// snapshots are always of a whole volume. ZFS keeps them in the dataset's
+// .zfs/snapshot folder; Btrfs ones are read-only subvolumes this code puts
+// in a .snapshots folder of the subvolume. A snapshot is browsed as the
+// read-only share "<share>@<snapshot>", so single files are restored by
+// copying them back with the normal file operations.
+
+const (
+	snapshotDirName       = ".snapshots"
+	zfsControlDir         = ".zfs"
+	snapshotAutoPrefix    = "auto-"
+	snapshotTimeFormat    = "20060102-150405"
+	snapshotSchedulerTick = 10 * time.Minute
+	snapshotDefaultKeep   = 14
+	btrfsSubvolumeIno     = 256 // Inode of every subvolume's root folder
+)
+
+// mountInfoFile is read to find the file system of a share
+var mountInfoFile = "/proc/self/mountinfo"
+
+var snapshotNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,63}$`)
+
+var (
+	errNoSnapshots        = errors.New("Snapshots need a Btrfs or ZFS share")
+	errSnapshotNotFound   = errors.New("Snapshot not found")
+	errSnapshotExists     = errors.New("Snapshot already exists")
+	errVolumeNotFound     = errors.New("Volume not found")
+	errNewerSnapshots     = errors.New("Newer snapshots would be destroyed")
+	errRollbackMountPoint = errors.New("A mounted subvolume cannot be rolled back")
+	errNoZfs              = errors.New("ZFS tools are not installed")
+	errNoBtrfs            = errors.New("Btrfs tools are not installed")
+)
+
+// snapshotToolError is a zfs or btrfs command that failed
+type snapshotToolError struct {
+	output string
+}
+
+func (e *snapshotToolError) Error() string { return "snapshot command failed: " + e.output }
+
+// SnapshotVolume is a dataset or subvolume holding shares
+type SnapshotVolume struct {
+	ID         string            `json:"id"` // zfs:<dataset> or btrfs:<path>
+	Fs         string            `json:"fs"` // zfs or btrfs
+	Name       string            `json:"name"`
+	Path       string            `json:"path"` // Where it is mounted
+	MountPoint string            `json:"mountPoint"`
+	Shares     []string          `json:"shares"`
+	Schedule   *SnapshotSchedule `json:"schedule,omitempty"`
+}
+
+// Snapshot is a snapshot of a volume
+type Snapshot struct {
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"createdAt"`
+	Used      int64  `json:"used,omitempty"` // Bytes only this snapshot holds, ZFS only
+	Auto      bool   `json:"auto,omitempty"` // Taken by the schedule
+}
+
+// SnapshotSchedule takes a snapshot of Volume every IntervalHours and
+// keeps the last Keep of them
+type SnapshotSchedule struct {
+	Volume        string `json:"volume"`
+	IntervalHours int    `json:"intervalHours"`
+	Keep          int    `json:"keep,omitempty"` // Defaults to 14
+}
+
+// snapshotMu serializes changes to the snapshots of all volumes
+var snapshotMu sync.Mutex
+
+func snapshotSchedulesFile() string {
+	return filepath.Join(config.DataDir, "snapshot-schedules.json")
+}
+
+func loadSnapshotSchedules() []SnapshotSchedule {
+	var schedules []SnapshotSchedule
+	_ = utils.ReadJSON(snapshotSchedulesFile(), &schedules)
+	return schedules
+}
+
+type mountEntry struct {
+	point  string
+	fs     string
+	source string
+}
+
+// unescapeMount undoes the octal escapes of mountinfo, e.g. \040
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountOf returns the mount holding p, the deepest one when mounts nest
+func mountOf(p string) (mountEntry, error) {
+	f, err := os.Open(mountInfoFile)
+	if err != nil {
+		return mountEntry{}, err
+	}
+	defer f.Close()
+	var best mountEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		m := mountEntry{point: unescapeMount(fields[4]), fs: fields[sep+1], source: unescapeMount(fields[sep+2])}
+		// Later lines win for the same point: they are mounted over
+		if pathWithin(m.point, p) && len(m.point) >= len(best.point) {
+			best = m
+		}
+	}
+	if best.point == "" {
+		return best, errNoSnapshots
+	}
+	return best, scanner.Err()
+}
+
+// volumeOf finds the volume of a folder and the folder's path inside it
+func volumeOf(dir string) (SnapshotVolume, string, error) {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return SnapshotVolume{}, "", err
+	}
+	m, err := mountOf(real)
+	if err != nil {
+		return SnapshotVolume{}, "", err
+	}
+	vol := SnapshotVolume{Fs: m.fs, MountPoint: m.point}
+	switch m.fs {
+	case "zfs":
+		vol.ID, vol.Name, vol.Path = "zfs:"+m.source, m.source, m.point
+	case "btrfs":
+		for p := real; ; p = filepath.Dir(p) {
+			info, err := os.Stat(p)
+			if err != nil {
+				return vol, "", err
+			}
+			if fileInode(info) == btrfsSubvolumeIno {
+				vol.Path = p
+				break
+			}
+			if p == m.point || p == filepath.Dir(p) {
+				return vol, "", errNoSnapshots
+			}
+		}
+		vol.ID, vol.Name = "btrfs:"+vol.Path, vol.Path
+	default:
+		return vol, "", errNoSnapshots
+	}
+	rel, err := filepath.Rel(vol.Path, real)
+	if err != nil {
+		return vol, "", err
+	}
+	return vol, rel, nil
+}
+
+// snapshotVolumes lists the volumes of the shares that support snapshots
+func snapshotVolumes() []SnapshotVolume {
+	byID := make(map[string]*SnapshotVolume)
+	var ids []string
+	for _, share := range loadFileShares() {
+		vol, _, err := volumeOf(share.Path)
+		if err != nil {
+			continue
+		}
+		if byID[vol.ID] == nil {
+			vol.Shares = []string{}
+			byID[vol.ID] = &vol
+			ids = append(ids, vol.ID)
+		}
+		byID[vol.ID].Shares = append(byID[vol.ID].Shares, share.Name)
+	}
+	for _, s := range loadSnapshotSchedules() {
+		if vol := byID[s.Volume]; vol != nil {
+			s := s
+			vol.Schedule = &s
+		}
+	}
+	sort.Strings(ids)
+	vols := make([]SnapshotVolume, 0, len(ids))
+	for _, id := range ids {
+		vols = append(vols, *byID[id])
+	}
+	return vols
+}
+
+func findSnapshotVolume(id string) (SnapshotVolume, error) {
+	for _, vol := range snapshotVolumes() {
+		if vol.ID == id {
+			return vol, nil
+		}
+	}
+	return SnapshotVolume{}, errVolumeNotFound
+}
+
+// snapshotRoot is where the content of a snapshot can be read
+func snapshotRoot(vol SnapshotVolume, name string) string {
+	if vol.Fs == "zfs" {
+		return filepath.Join(vol.Path, zfsControlDir, "snapshot", name)
+	}
+	return filepath.Join(vol.Path, snapshotDirName, name)
+}
+
+// snapshotShare is the read-only share of a share as it was in a snapshot
+func snapshotShare(share models.FileShare, name string) (models.FileShare, error) {
+	if !snapshotNameRe.MatchString(name) {
+		return models.FileShare{}, errShareNotFound
+	}
+	vol, rel, err := volumeOf(share.Path)
+	if err != nil {
+		return models.FileShare{}, errShareNotFound
+	}
+	dir := filepath.Join(snapshotRoot(vol, name), rel)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return models.FileShare{}, errShareNotFound
+	}
+	return models.FileShare{Name: share.Name + "@" + name, Path: dir, ReadOnly: true}, nil
+}
+
+// snapshotCommand runs zfs or btrfs for vol
+func snapshotCommand(ctx context.Context, vol SnapshotVolume, args ...string) (string, error) {
+	missing := errNoZfs
+	if vol.Fs == "btrfs" {
+		missing = errNoBtrfs
+	}
+	out, err := systemCommand(ctx, missing, vol.Fs, args...)
+	if err != nil && !errors.Is(err, missing) {
+		return "", &snapshotToolError{output: strings.TrimSpace(string(out))}
+	}
+	return string(out), err
+}
+
+// listSnapshots returns the snapshots of vol, oldest first
+func listSnapshots(ctx context.Context, vol SnapshotVolume) ([]Snapshot, error) {
+	snaps := []Snapshot{}
+	if vol.Fs == "zfs" {
+		out, err := snapshotCommand(ctx, vol, "list", "-H", "-p", "-t", "snapshot", "-d", "1", "-o", "name,creation,used", vol.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Split(line, "\t")
+			if len(fields) < 3 {
+				continue
+			}
+			_, name, ok := strings.Cut(fields[0], "@")
+			if !ok {
+				continue
+			}
+			created, _ := strconv.ParseInt(fields[1], 10, 64)
+			used, _ := strconv.ParseInt(fields[2], 10, 64)
+			snaps = append(snaps, Snapshot{Name: name, CreatedAt: created * 1000, Used: used})
+		}
+	} else {
+		entries, err := os.ReadDir(filepath.Join(vol.Path, snapshotDirName))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !e.IsDir() {
+				continue
+			}
+			if fileInode(info) != btrfsSubvolumeIno {
+				continue
+			}
+			snaps = append(snaps, Snapshot{Name: e.Name(), CreatedAt: btrfsCreated(ctx, vol, e.Name(), info)})
+		}
+	}
+	for i := range snaps {
+		snaps[i].Auto = strings.HasPrefix(snaps[i].Name, snapshotAutoPrefix)
+	}
+	sort.SliceStable(snaps, func(i, j int) bool { return snaps[i].CreatedAt < snaps[j].CreatedAt })
+	return snaps, nil
+}
+
+// btrfsCreated reads the creation time of a Btrfs snapshot; the folder's
+// own mtime is the one of the subvolume when it was taken
+func btrfsCreated(ctx context.Context, vol SnapshotVolume, name string, info os.FileInfo) int64 {
+	out, err := snapshotCommand(ctx, vol, "subvolume", "show", snapshotRoot(vol, name))
+	if err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(line), "Creation time:"); ok {
+				if t, err := time.Parse("2006-01-02 15:04:05 -0700", strings.TrimSpace(v)); err == nil {
+					return t.UnixMilli()
+				}
+			}
+		}
+	}
+	return info.ModTime().UnixMilli()
+}
+
+func createSnapshot(ctx context.Context, vol SnapshotVolume, name string) error {
+	if vol.Fs == "zfs" {
+		_, err := snapshotCommand(ctx, vol, "snapshot", vol.Name+"@"+name)
+		return err
+	}
+	dst := snapshotRoot(vol, name)
+	if _, err := os.Lstat(dst); err == nil {
+		return errSnapshotExists
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	_, err := snapshotCommand(ctx, vol, "subvolume", "snapshot", "-r", vol.Path, dst)
+	return err
+}
+
+func deleteSnapshot(ctx context.Context, vol SnapshotVolume, name string) error {
+	if vol.Fs == "zfs" {
+		_, err := snapshotCommand(ctx, vol, "destroy", vol.Name+"@"+name)
+		return err
+	}
+	_, err := snapshotCommand(ctx, vol, "subvolume", "delete", snapshotRoot(vol, name))
+	return err
+}
+
+// rollbackSnapshot brings the whole volume back to a snapshot. On ZFS the
+// snapshots taken after it are destroyed with it, which destroyNewer must
+// allow. A Btrfs subvolume is replaced by a writable copy of the snapshot,
+// after a pre-rollback snapshot of its current state.
+func rollbackSnapshot(ctx context.Context, vol SnapshotVolume, name string, destroyNewer bool) error {
+	snaps, err := listSnapshots(ctx, vol)
+	if err != nil {
+		return err
+	}
+	target := -1
+	for i, s := range snaps {
+		if s.Name == name {
+			target = i
+		}
+	}
+	if target < 0 {
+		return errSnapshotNotFound
+	}
+	if vol.Fs == "zfs" {
+		if target < len(snaps)-1 && !destroyNewer {
+			return errNewerSnapshots
+		}
+		_, err := snapshotCommand(ctx, vol, "rollback", "-r", vol.Name+"@"+name)
+		return err
+	}
+
+	if vol.Path == vol.MountPoint {
+		return errRollbackMountPoint
+	}
+	if err := createSnapshot(ctx, vol, "pre-rollback-"+time.Now().UTC().Format(snapshotTimeFormat)); err != nil {
+		return err
+	}
+	parent, base := filepath.Dir(vol.Path), filepath.Base(vol.Path)
+	fresh := filepath.Join(parent, "."+base+".rollback")
+	old := filepath.Join(parent, "."+base+".old")
+	if _, err := snapshotCommand(ctx, vol, "subvolume", "snapshot", snapshotRoot(vol, name), fresh); err != nil {
+		return err
+	}
+	// The snapshots are subvolumes inside the volume; a snapshot only has
+	// empty folders in their place, so they are moved over
+	from, to := filepath.Join(vol.Path, snapshotDirName), filepath.Join(fresh, snapshotDirName)
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return err
+	}
+	entries, _ := os.ReadDir(from)
+	for _, e := range entries {
+		os.Remove(filepath.Join(to, e.Name()))
+		if err := os.Rename(filepath.Join(from, e.Name()), filepath.Join(to, e.Name())); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(vol.Path, old); err != nil {
+		return err
+	}
+	if err := os.Rename(fresh, vol.Path); err != nil {
+		os.Rename(old, vol.Path)
+		return err
+	}
+	if _, err := snapshotCommand(ctx, vol, "subvolume", "delete", old); err != nil {
+		filesLog.Warn("Failed to delete the rolled back subvolume", "path", old, "error", err)
+	}
+	return nil
+}
+
+// runSnapshotSchedules takes the snapshots that are due and prunes the
+// scheduled ones beyond what each schedule keeps
+func runSnapshotSchedules(ctx context.Context, now time.Time) {
+	for _, vol := range snapshotVolumes() {
+		s := vol.Schedule
+		if s == nil || s.IntervalHours <= 0 {
+			continue
+		}
+		snapshotMu.Lock()
+		err := runSnapshotSchedule(ctx, vol, *s, now)
+		snapshotMu.Unlock()
+		if err != nil {
+			filesLog.Warn("Scheduled snapshot failed", "volume", vol.ID, "error", err)
+		}
+	}
+}
+
+func runSnapshotSchedule(ctx context.Context, vol SnapshotVolume, s SnapshotSchedule, now time.Time) error {
+	snaps, err := listSnapshots(ctx, vol)
+	if err != nil {
+		return err
+	}
+	var auto []Snapshot
+	for _, snap := range snaps {
+		if snap.Auto {
+			auto = append(auto, snap)
+		}
+	}
+	if len(auto) == 0 || now.Sub(time.UnixMilli(auto[len(auto)-1].CreatedAt)) >= time.Duration(s.IntervalHours)*time.Hour {
+		name := snapshotAutoPrefix + now.UTC().Format(snapshotTimeFormat)
+		if err := createSnapshot(ctx, vol, name); err != nil {
+			return err
+		}
+		filesLog.Info("Snapshot taken", "volume", vol.ID, "name", name)
+		auto = append(auto, Snapshot{Name: name})
+	}
+	keep := s.Keep
+	if keep <= 0 {
+		keep = snapshotDefaultKeep
+	}
+	for len(auto) > keep {
+		if err := deleteSnapshot(ctx, vol, auto[0].Name); err != nil {
+			return err
+		}
+		auto = auto[1:]
+	}
+	return nil
+}
+
+// StartSnapshotScheduler runs the snapshot schedules
+func StartSnapshotScheduler() {
+	go func() {
+		ticker := time.NewTicker(snapshotSchedulerTick)
+		defer ticker.Stop()
+		beat := registerWorker("snapshot.scheduler", snapshotSchedulerTick)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case now := <-ticker.C:
+				beat()
+				runSnapshotSchedules(backgroundCtx, now)
+			}
+		}
+	}()
+}
+
+func snapshotError(c *gin.Context, err error) {
+	var toolErr *snapshotToolError
+	switch {
+	case errors.As(err, &toolErr):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Snapshot operation failed", "details": toolErr.output})
+	case errors.Is(err, errVolumeNotFound), errors.Is(err, errSnapshotNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errSnapshotExists), errors.Is(err, errNewerSnapshots), errors.Is(err, errRollbackMountPoint):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoZfs), errors.Is(err, errNoBtrfs):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		filesLog.Error("Snapshot operation failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Snapshot operation failed"})
+	}
+}
+
+// GetSnapshotVolumes lists the volumes of the shares that can be
+// snapshotted, with their schedule
+func GetSnapshotVolumes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": snapshotVolumes()})
+}
+
+// GetSnapshots lists the snapshots of ?volume=
+func GetSnapshots(c *gin.Context) {
+	vol, err := findSnapshotVolume(c.Query("volume"))
+	if err != nil {
+		snapshotError(c, err)
+		return
+	}
+	snaps, err := listSnapshots(c.Request.Context(), vol)
+	if err != nil {
+		snapshotError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": snaps})
+}
+
+type snapshotRequest struct {
+	Volume       string `json:"volume"`
+	Name         string `json:"name"`
+	DestroyNewer bool   `json:"destroyNewer,omitempty"` // For rollback
+}
+
+// bindSnapshotRequest reads a snapshotRequest; an empty name is allowed
+// when blankOk
+func bindSnapshotRequest(c *gin.Context, blankOk bool) (snapshotRequest, SnapshotVolume, bool) {
+	var req snapshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !(req.Name == "" && blankOk) && !snapshotNameRe.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid snapshot name"})
+		return req, SnapshotVolume{}, false
+	}
+	vol, err := findSnapshotVolume(req.Volume)
+	if err != nil {
+		snapshotError(c, err)
+		return req, vol, false
+	}
+	c.Set("auditTarget", req.Volume+"@"+req.Name)
+	return req, vol, true
+}
+
+// CreateSnapshot takes a snapshot of a volume, named after the time when
+// no name is given
+func CreateSnapshot(c *gin.Context) {
+	req, vol, ok := bindSnapshotRequest(c, true)
+	if !ok {
+		return
+	}
+	if req.Name == "" {
+		req.Name = "manual-" + time.Now().UTC().Format(snapshotTimeFormat)
+	}
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	if err := createSnapshot(c.Request.Context(), vol, req.Name); err != nil {
+		snapshotError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": req.Name})
+}
+
+// DeleteSnapshot destroys the snapshot ?name= of ?volume=
+func DeleteSnapshot(c *gin.Context) {
+	name := c.Query("name")
+	if !snapshotNameRe.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid snapshot name"})
+		return
+	}
+	vol, err := findSnapshotVolume(c.Query("volume"))
+	if err != nil {
+		snapshotError(c, err)
+		return
+	}
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	if vol.Fs == "btrfs" {
+		if _, err := os.Stat(snapshotRoot(vol, name)); err != nil {
+			snapshotError(c, errSnapshotNotFound)
+			return
+		}
+	}
+	if err := deleteSnapshot(c.Request.Context(), vol, name); err != nil {
+		snapshotError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// RollbackSnapshot brings a volume back to a snapshot
+func RollbackSnapshot(c *gin.Context) {
+	req, vol, ok := bindSnapshotRequest(c, false)
+	if !ok {
+		return
+	}
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	if err := rollbackSnapshot(c.Request.Context(), vol, req.Name, req.DestroyNewer); err != nil {
+		snapshotError(c, err)
+		return
+	}
+	filesLog.Warn("Volume rolled back", "volume", vol.ID, "snapshot", req.Name)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// SaveSnapshotSchedule sets the schedule of a volume; an interval of 0
+// removes it
+func SaveSnapshotSchedule(c *gin.Context) {
+	var req SnapshotSchedule
+	if err := c.ShouldBindJSON(&req); err != nil || req.IntervalHours < 0 || req.Keep < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if _, err := findSnapshotVolume(req.Volume); err != nil {
+		snapshotError(c, err)
+		return
+	}
+	var schedules []SnapshotSchedule
+	err := utils.UpdateJSON(snapshotSchedulesFile(), &schedules, func() error {
+		kept := schedules[:0]
+		for _, s := range schedules {
+			if s.Volume != req.Volume {
+				kept = append(kept, s)
+			}
+		}
+		if req.IntervalHours > 0 {
+			kept = append(kept, req)
+		}
+		schedules = kept
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetShareSnapshots lists the snapshots a share can be browsed in, each
+// with the name of its read-only share
+func GetShareSnapshots(c *gin.Context) {
+	share, err := findFileShare(c.Query("share"))
+	if err == nil && strings.Contains(share.Name, "@") {
+		err = errShareNotFound
+	}
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	vol, rel, err := volumeOf(share.Path)
+	if errors.Is(err, errNoSnapshots) {
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": []gin.H{}})
+		return
+	}
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	snaps, err := listSnapshots(c.Request.Context(), vol)
+	if err != nil {
+		snapshotError(c, err)
+		return
+	}
+	list := make([]gin.H, 0, len(snaps))
+	for i := len(snaps) - 1; i >= 0; i-- {
+		// A share made after the snapshot is not in it
+		if info, err := os.Stat(filepath.Join(snapshotRoot(vol, snaps[i].Name), rel)); err != nil || !info.IsDir() {
+			continue
+		}
+		list = append(list, gin.H{
+			"name":      snaps[i].Name,
+			"createdAt": snaps[i].CreatedAt,
+			"share":     share.Name + "@" + snaps[i].Name,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": list})
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSnapshots(t *testing.T) {
+	useTestConfig(t)
+	prevMounts := mountInfoFile
+	mountInfoFile = filepath.Join(config.DataDir, "mountinfo")
+	defer func() { mountInfoFile = prevMounts }()
+	gin.SetMode(gin.TestMode)
+
+	pool, plain, bin := t.TempDir(), t.TempDir(), t.TempDir()
+	os.WriteFile(mountInfoFile, []byte("1 0 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n"+
+		"36 1 0:32 / "+strings.ReplaceAll(pool, " ", `\040`)+" rw,relatime shared:15 - zfs tank/media rw,xattr\n"), 0644)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.WriteFile(filepath.Join(bin, "snaps"), nil, 0644)
+	// Snapshots are one hour apart, from 2023 on
+	os.WriteFile(filepath.Join(bin, "zfs"), []byte(`#!/bin/sh
+dir="$(dirname "$0")"
+echo "$@" >> "$dir/zfs.log"
+case "$1" in
+list) cat "$dir/snaps" ;;
+snapshot) n=$(wc -l < "$dir/snaps"); printf '%s\t%s\t4096\n' "$2" "$((1700000000 + n * 3600))" >> "$dir/snaps" ;;
+destroy) grep -v "^$2	" "$dir/snaps" > "$dir/snaps.new"; mv "$dir/snaps.new" "$dir/snaps" ;;
+esac
+`), 0755)
+	os.MkdirAll(filepath.Join(pool, "docs"), 0755)
+	os.WriteFile(filepath.Join(pool, "docs", "a.txt"), []byte("today"), 0644)
+	os.MkdirAll(filepath.Join(pool, ".zfs", "snapshot", "snap1", "docs"), 0755)
+	os.WriteFile(filepath.Join(pool, ".zfs", "snapshot", "snap1", "docs", "a.txt"), []byte("yesterday"), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "media", Path: pool}, {Name: "plain", Path: plain}}})
+
+	r := gin.New()
+	r.GET("/volumes", GetSnapshotVolumes)
+	r.GET("/snapshots", GetSnapshots)
+	r.POST("/snapshots", CreateSnapshot)
+	r.POST("/rollback", RollbackSnapshot)
+	r.POST("/schedule", SaveSnapshotSchedule)
+	r.GET("/files/snapshots", GetShareSnapshots)
+	r.GET("/files/list", ListFiles)
+	r.POST("/files/delete", DeleteFiles)
+	r.POST("/files/copy", CopyFiles)
+
+	var vols struct{ Data []SnapshotVolume }
+	json.Unmarshal(serve(r, "GET", "/volumes", "").Body.Bytes(), &vols)
+	if len(vols.Data) != 1 || vols.Data[0].ID != "zfs:tank/media" || len(vols.Data[0].Shares) != 1 || vols.Data[0].Shares[0] != "media" {
+		t.Fatalf("unexpected volumes %+v", vols.Data)
+	}
+	if w := serve(r, "POST", "/snapshots", `{"volume":"zfs:tank/media","name":"a/b"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if w := serve(r, "POST", "/snapshots", `{"volume":"zfs:tank/other","name":"x"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	for _, name := range []string{"snap1", "snap2"} {
+		if w := serve(r, "POST", "/snapshots", `{"volume":"zfs:tank/media","name":"`+name+`"}`); w.Code != 200 {
+			t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+		}
+	}
+	var snaps struct{ Data []Snapshot }
+	json.Unmarshal(serve(r, "GET", "/snapshots?volume=zfs:tank/media", "").Body.Bytes(), &snaps)
+	if len(snaps.Data) != 2 || snaps.Data[0].Name != "snap1" || snaps.Data[0].Used != 4096 || snaps.Data[0].CreatedAt != 1700000000000 {
+		t.Fatalf("unexpected snapshots %+v", snaps.Data)
+	}
+
+	// Only snap1 has content in this fake .zfs folder
+	var browse struct{ Data []map[string]interface{} }
+	json.Unmarshal(serve(r, "GET", "/files/snapshots?share=media", "").Body.Bytes(), &browse)
+	if len(browse.Data) != 1 || browse.Data[0]["share"] != "media@snap1" {
+		t.Fatalf("unexpected share snapshots %+v", browse.Data)
+	}
+	var list struct {
+		Data struct {
+			ReadOnly bool
+			Entries  []FileEntry
+		}
+	}
+	json.Unmarshal(serve(r, "GET", "/files/list?share=media@snap1&path=docs", "").Body.Bytes(), &list)
+	if !list.Data.ReadOnly || len(list.Data.Entries) != 1 || list.Data.Entries[0].Name != "a.txt" {
+		t.Fatalf("unexpected snapshot listing %+v", list.Data)
+	}
+	json.Unmarshal(serve(r, "GET", "/files/list?share=media", "").Body.Bytes(), &list)
+	if len(list.Data.Entries) != 1 || list.Data.Entries[0].Name != "docs" {
+		t.Fatalf(".zfs not hidden: %+v", list.Data.Entries)
+	}
+	if w := serve(r, "GET", "/files/list?share=media&path=.zfs/snapshot", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if w := serve(r, "GET", "/files/list?share=media@nope", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if w := serve(r, "POST", "/files/delete", `{"share":"media@snap1","paths":["docs/a.txt"]}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	os.Mkdir(filepath.Join(pool, "restored"), 0755)
+	if w := serve(r, "POST", "/files/copy", `{"share":"media@snap1","paths":["docs/a.txt"],"toShare":"media","to":"restored"}`); w.Code != 200 {
+		t.Fatalf("restore failed: %d %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(pool, "restored", "a.txt")); string(data) != "yesterday" {
+		t.Fatalf("unexpected restored content %q", data)
+	}
+
+	if w := serve(r, "POST", "/rollback", `{"volume":"zfs:tank/media","name":"snap1"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", w.Code)
+	}
+	if w := serve(r, "POST", "/rollback", `{"volume":"zfs:tank/media","name":"snap1","destroyNewer":true}`); w.Code != 200 {
+		t.Fatalf("rollback failed: %d %s", w.Code, w.Body.String())
+	}
+	if log, _ := os.ReadFile(filepath.Join(bin, "zfs.log")); !strings.Contains(string(log), "rollback -r tank/media@snap1\n") {
+		t.Fatalf("unexpected zfs calls %s", log)
+	}
+
+	if w := serve(r, "POST", "/schedule", `{"volume":"zfs:tank/media","intervalHours":1,"keep":2}`); w.Code != 200 {
+		t.Fatalf("schedule failed: %d", w.Code)
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		runSnapshotSchedules(context.Background(), now.Add(time.Duration(i)*time.Hour))
+	}
+	json.Unmarshal(serve(r, "GET", "/snapshots?volume=zfs:tank/media", "").Body.Bytes(), &snaps)
+	auto := 0
+	for _, s := range snaps.Data {
+		if s.Auto {
+			auto++
+		}
+	}
+	if len(snaps.Data) != 4 || auto != 2 {
+		t.Fatalf("unexpected snapshots after schedule %+v", snaps.Data)
+	}
+}
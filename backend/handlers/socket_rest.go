@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"flatnasgo-backend/middleware"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+const (
+	socketRestWait    = 15 * time.Second
+	socketRestMaxWait = 60 * time.Second
+)
+
+// Events whose handlers answer from a goroutine after returning. The HTTP
+// bridge waits for their first reply; other events reply before returning.
+var asyncSocketEvents = map[string]bool{
+	"rss:refresh": true,
+	"proxy:test":  true,
+}
+
+// Permissions socket events need beyond middleware.PermView, which every
+// connection has
+var socketEventPermissions = map[string]string{
+	"memo:update":       middleware.PermEdit,
+	"todo:update":       middleware.PermEdit,
+	"network:mode":      middleware.PermEdit,
+	"rss:import-opml":   middleware.PermEdit,
+	"rss:mark-all-read": middleware.PermEdit,
+	"rss:mark-read":     middleware.PermEdit,
+	"rss:refresh":       middleware.PermEdit,
+	"rss:save":          middleware.PermEdit,
+	"rss:subscribe":     middleware.PermEdit,
+	"rss:unsubscribe":   middleware.PermEdit,
+	"files:watch":       middleware.PermFiles,
+	"jobs:watch":        middleware.PermFiles,
+	"jobs:list":         middleware.PermFiles,
+	"jobs:pause":        middleware.PermFiles,
+	"jobs:resume":       middleware.PermFiles,
+	"jobs:cancel":       middleware.PermFiles,
+	"jobs:remove":       middleware.PermFiles,
+	"proxy:test":        middleware.PermSystem,
+	"proxy:update":      middleware.PermSystem,
+	"logs:query":        middleware.PermSystem,
+	"logs:stream":       middleware.PermSystem,
+}
+
+// Events that fetch from the network cost more of the rate limit, so a
+// client cannot tie up outbound connections by repeating them
+var socketEventCosts = map[string]int{
+	"rss:fetch":     5,
+	"rss:refresh":   10,
+	"rss:subscribe": 5,
+	"rss:search":    2,
+	"hot:fetch":     2,
+	"weather:fetch": 2,
+	"plugin:call":   3,
+	"proxy:test":    10,
+}
+
+type socketEventHandler struct {
+	fn  reflect.Value
+	arg reflect.Type
+}
+
+var (
+	socketEventsMu sync.RWMutex
+	socketEvents   = make(map[string]socketEventHandler)
+)
+
+// bindEvent registers a socket.io event handler and makes it reachable over
+// plain HTTP as well (see EmitSocketEvent). fn has the usual
+// func(socketio.Conn, T) signature. Payloads without a token get the one the
+// connection authenticated with.
+func bindEvent(server *socketio.Server, name string, fn interface{}) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.Type().NumIn() != 2 {
+		server.OnEvent("/", name, fn)
+		return
+	}
+	wrapped := reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+		arg := reflect.New(args[1].Type()).Elem()
+		arg.Set(args[1])
+		if conn, ok := args[0].Interface().(socketio.Conn); ok {
+			token, _ := conn.Context().(string)
+			s := localizedConn{Conn: conn, token: token}
+			done, ok := beginTask()
+			if !ok {
+				s.Emit(strings.SplitN(name, ":", 2)[0]+":error", map[string]interface{}{"error": "Server is shutting down"})
+				return nil
+			}
+			defer done()
+			if !allowSocketEvent(s, name) {
+				s.Emit(strings.SplitN(name, ":", 2)[0]+":error", map[string]interface{}{"error": "Too many requests"})
+				return nil
+			}
+			injectPayloadToken(arg, token)
+			if perm, ok := socketEventPermissions[name]; ok {
+				token := payloadToken(arg)
+				username, _ := validateSocketToken(token)
+				if !middleware.Can(middleware.RoleOf(username), perm) || !socketTokenHasScope(token, middleware.PermissionScope(perm)) {
+					s.Emit(strings.SplitN(name, ":", 2)[0]+":error", map[string]interface{}{"error": "Permission denied"})
+					return nil
+				}
+			}
+			// Errors the handler emits are translated for the payload's user
+			s.token = payloadToken(arg)
+			args[0] = reflect.ValueOf(socketio.Conn(s))
+		}
+		return v.Call([]reflect.Value{args[0], arg})
+	})
+	server.OnEvent("/", name, wrapped.Interface())
+	socketEventsMu.Lock()
+	socketEvents[name] = socketEventHandler{fn: wrapped, arg: v.Type().In(1)}
+	socketEventsMu.Unlock()
+}
+
+func allowSocketEvent(s socketio.Conn, name string) bool {
+	cost := socketEventCosts[name]
+	if cost == 0 {
+		cost = 1
+	}
+	connID := s.ID()
+	if _, ok := s.(*restConn); ok {
+		// HTTP callers are already limited per IP by the REST middleware
+		connID = ""
+	}
+	return middleware.AllowSocketEvent(connID, socketClientIP(s), cost)
+}
+
+// socketClientIP finds the client address like gin's ClientIP does, with
+// the same trusted proxies
+func socketClientIP(s socketio.Conn) string {
+	addr := s.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	return middleware.ClientIP(addr.String(), s.RemoteHeader())
+}
+
+// SocketHandshakeToken returns the token a client sent when connecting, as
+// ?token= or an Authorization header, so scripts need not repeat it in
+// every event. It is kept as the connection context.
+func SocketHandshakeToken(s socketio.Conn) string {
+	if auth := s.RemoteHeader().Get("Authorization"); auth != "" {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	u := s.URL()
+	return u.Query().Get("token")
+}
+
+// BindSocketEventRoutes adds POST /api/<ns>/<action> for every socket event
+// "<ns>:<action>", next to the generic POST /api/events/:name.
+func BindSocketEventRoutes(api *gin.RouterGroup) {
+	api.POST("/events/:name", EmitSocketEvent)
+	socketEventsMu.RLock()
+	defer socketEventsMu.RUnlock()
+	for name := range socketEvents {
+		event := name
+		api.POST("/"+strings.Replace(event, ":", "/", 1), func(c *gin.Context) {
+			runSocketEvent(c, event)
+		})
+	}
+}
+
+// SocketEventRecord is one reply the handler emitted
+type SocketEventRecord struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// EmitSocketEvent runs a socket event handler for an HTTP client. The JSON
+// body is the event payload; the token from the Authorization header or
+// ?token= stands in for the connection's token. Replies emitted to the caller
+// are returned in order. Broadcasts still go to connected sockets.
+func EmitSocketEvent(c *gin.Context) {
+	runSocketEvent(c, c.Param("name"))
+}
+
+func runSocketEvent(c *gin.Context, name string) {
+	socketEventsMu.RLock()
+	handler, ok := socketEvents[name]
+	socketEventsMu.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "Unknown event"})
+		return
+	}
+
+	arg := reflect.New(handler.arg)
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 4<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, arg.Interface()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "Invalid JSON payload"})
+			return
+		}
+	} else if handler.arg.Kind() == reflect.Interface {
+		arg.Elem().Set(reflect.ValueOf(map[string]interface{}{}))
+	}
+	conn := newRestConn(c.Request)
+	conn.SetContext(requestToken(c))
+	handler.fn.Call([]reflect.Value{reflect.ValueOf(conn), arg.Elem()})
+
+	if asyncSocketEvents[name] {
+		wait := socketRestWait
+		if secs, err := strconv.Atoi(c.Query("wait")); err == nil && secs >= 0 {
+			wait = time.Duration(secs) * time.Second
+			if wait > socketRestMaxWait {
+				wait = socketRestMaxWait
+			}
+		}
+		conn.waitReply(c.Request.Context(), wait)
+	}
+
+	events := conn.records()
+	if len(events) > 0 && strings.HasSuffix(events[0].Event, ":error") {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": socketErrorText(events[0].Data), "data": gin.H{"events": events}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"events": events}})
+}
+
+func requestToken(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return c.Query("token")
+}
+
+// injectPayloadToken sets the payload's token when the client left it out
+func injectPayloadToken(v reflect.Value, token string) {
+	if token == "" {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if m, ok := v.Interface().(map[string]interface{}); ok {
+			if s, _ := m["token"].(string); s == "" {
+				m["token"] = token
+			}
+		}
+	case reflect.Struct:
+		f := v.FieldByName("Token")
+		if f.IsValid() && f.CanSet() && f.Kind() == reflect.String && f.String() == "" {
+			f.SetString(token)
+		}
+	}
+}
+
+func payloadToken(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Interface:
+		token, _ := parseTokenPayload(v.Interface())
+		return token
+	case reflect.Struct:
+		if f := v.FieldByName("Token"); f.IsValid() && f.Kind() == reflect.String {
+			return f.String()
+		}
+	}
+	return ""
+}
+
+func socketErrorText(data interface{}) string {
+	raw, err := json.Marshal(data)
+	if err == nil {
+		var m map[string]interface{}
+		if json.Unmarshal(raw, &m) == nil {
+			if s, ok := m["error"].(string); ok && s != "" {
+				return s
+			}
+		}
+	}
+	return "Request failed"
+}
+
+var _ socketio.Conn = (*restConn)(nil)
+
+// restConn stands in for a socket connection during an HTTP call and
+// records what the handler emits to it.
+type restConn struct {
+	mu      sync.Mutex
+	ctx     interface{}
+	rooms   map[string]struct{}
+	events  []SocketEventRecord
+	emitted chan struct{}
+	once    sync.Once
+	req     *http.Request
+}
+
+func newRestConn(req *http.Request) *restConn {
+	return &restConn{rooms: make(map[string]struct{}), emitted: make(chan struct{}), req: req}
+}
+
+func (r *restConn) Emit(eventName string, v ...interface{}) {
+	var data interface{}
+	if len(v) == 1 {
+		data = v[0]
+	} else if len(v) > 1 {
+		data = v
+	}
+	r.mu.Lock()
+	r.events = append(r.events, SocketEventRecord{Event: eventName, Data: data})
+	r.mu.Unlock()
+	r.once.Do(func() { close(r.emitted) })
+}
+
+func (r *restConn) waitReply(ctx context.Context, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-r.emitted:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func (r *restConn) records() []SocketEventRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]SocketEventRecord, len(r.events))
+	copy(out, r.events)
+	return out
+}
+
+func (r *restConn) Context() interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ctx
+}
+
+func (r *restConn) SetContext(ctx interface{}) {
+	r.mu.Lock()
+	r.ctx = ctx
+	r.mu.Unlock()
+}
+
+func (r *restConn) Namespace() string { return "/" }
+
+func (r *restConn) Join(room string) {
+	r.mu.Lock()
+	r.rooms[room] = struct{}{}
+	r.mu.Unlock()
+}
+
+func (r *restConn) Leave(room string) {
+	r.mu.Lock()
+	delete(r.rooms, room)
+	r.mu.Unlock()
+}
+
+func (r *restConn) LeaveAll() {
+	r.mu.Lock()
+	r.rooms = make(map[string]struct{})
+	r.mu.Unlock()
+}
+
+func (r *restConn) Rooms() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rooms := make([]string, 0, len(r.rooms))
+	for room := range r.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+func (r *restConn) Close() error { return nil }
+
+func (r *restConn) ID() string { return "rest" }
+
+func (r *restConn) URL() url.URL { return *r.req.URL }
+
+func (r *restConn) LocalAddr() net.Addr { return restAddr("") }
+
+func (r *restConn) RemoteAddr() net.Addr { return restAddr(r.req.RemoteAddr) }
+
+func (r *restConn) RemoteHeader() http.Header { return r.req.Header }
+
+type restAddr string
+
+func (a restAddr) Network() string { return "tcp" }
+func (a restAddr) String() string  { return string(a) }
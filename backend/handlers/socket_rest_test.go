@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/middleware"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+func TestSocketEventOverHTTP(t *testing.T) {
+	server := socketio.NewServer(nil)
+	bindEvent(server, "test:echo", func(s socketio.Conn, msg interface{}) {
+		m, _ := msg.(map[string]interface{})
+		s.Emit("test:reply", map[string]interface{}{"token": m["token"], "text": m["text"]})
+	})
+	defer func() {
+		socketEventsMu.Lock()
+		delete(socketEvents, "test:echo")
+		socketEventsMu.Unlock()
+	}()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	BindSocketEventRoutes(r.Group("/api"))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/test/echo", strings.NewReader(`{"text":"hi"}`))
+	req.Header.Set("Authorization", "Bearer abc")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	var resp struct {
+		Success bool `json:"success"`
+		Data    struct {
+			Events []SocketEventRecord `json:"events"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || !resp.Success || len(resp.Data.Events) != 1 {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	data, _ := resp.Data.Events[0].Data.(map[string]interface{})
+	if resp.Data.Events[0].Event != "test:reply" || data["token"] != "abc" || data["text"] != "hi" {
+		t.Fatalf("unexpected reply %+v", resp.Data.Events[0])
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/events/test:missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown event, got %d", rec.Code)
+	}
+}
+
+func TestSocketEventTokenScope(t *testing.T) {
+	useTestConfig(t)
+
+	server := socketio.NewServer(nil)
+	bindEvent(server, "test:admin", func(s socketio.Conn, msg interface{}) {
+		s.Emit("test:done", map[string]interface{}{})
+	})
+	socketEventPermissions["test:admin"] = middleware.PermSystem
+	defer func() {
+		socketEventsMu.Lock()
+		delete(socketEvents, "test:admin")
+		socketEventsMu.Unlock()
+		delete(socketEventPermissions, "test:admin")
+	}()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	BindSocketEventRoutes(r.Group("/api"))
+	_, writer, _ := middleware.CreateApiToken("admin", "script", []string{middleware.ScopeWrite}, 0)
+	_, admin, _ := middleware.CreateApiToken("admin", "ops", []string{middleware.ScopeAdmin}, 0)
+	for token, want := range map[string]string{writer: "test:error", admin: "test:done"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/test/admin", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var resp struct {
+			Data struct {
+				Events []SocketEventRecord `json:"events"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		if len(resp.Data.Events) != 1 || resp.Data.Events[0].Event != want {
+			t.Fatalf("expected %s, got %d: %s", want, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,758 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Sync jobs copy or mirror a folder with rclone or rsync: between local
+// folders, or to and from any rclone remote (S3, WebDAV, Drive...) set up
+// with rclone config. The tool's own progress output is parsed and sent
+// to the sync room as sync:progress and sync:log, and the outcome is
+// kept in a history of runs and announced as a notification.
+
+const (
+	SyncToolRclone = "rclone"
+	SyncToolRsync  = "rsync"
+)
+
+const (
+	syncRoom          = "sync"
+	syncSchedulerTick = time.Minute
+	syncKeepRuns      = 100
+	syncLogLines      = 200
+	syncMaxLine       = 1000
+	syncProgressEvery = time.Second
+)
+
+var (
+	errSyncJobNotFound = errors.New("Sync job not found")
+	errSyncRunning     = errors.New("Sync job is already running")
+	errSyncNotRunning  = errors.New("Sync job is not running")
+	errNoRclone        = errors.New("rclone is not installed")
+	errNoRsync         = errors.New("rsync is not installed")
+)
+
+// An absolute local path, or remote:path for rclone remotes and rsync
+// over ssh
+var syncRemoteRe = regexp.MustCompile(`^[A-Za-z0-9_.@-]+:`)
+
+// SyncJob is a saved sync task. Mode "sync" makes Dest match Source,
+// deleting what Source lacks; "copy" only adds and updates.
+type SyncJob struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	Tool            string   `json:"tool"` // rclone or rsync
+	Mode            string   `json:"mode"` // sync or copy
+	Source          string   `json:"source"`
+	Dest            string   `json:"dest"`
+	Flags           []string `json:"flags,omitempty"`           // Extra options for the tool
+	IntervalMinutes int      `json:"intervalMinutes,omitempty"` // 0 runs only on demand
+	Notify          string   `json:"notify,omitempty"`          // always (default), failure or never
+	Channels        []string `json:"channels,omitempty"`        // Notification channels, all when empty
+	Enable          bool     `json:"enable"`
+}
+
+// SyncRun is one run of a job
+type SyncRun struct {
+	ID         string   `json:"id"`
+	JobID      string   `json:"jobId"`
+	Job        string   `json:"job"` // Name at the time of the run
+	Trigger    string   `json:"trigger"`
+	Status     string   `json:"status"` // running, success, failed or cancelled
+	StartedAt  int64    `json:"startedAt"`
+	FinishedAt int64    `json:"finishedAt,omitempty"`
+	Bytes      int64    `json:"bytes"`
+	TotalBytes int64    `json:"totalBytes,omitempty"`
+	Percent    int      `json:"percent"`
+	Speed      int64    `json:"speed"` // Bytes per second
+	Eta        int64    `json:"eta"`   // Seconds, -1 when unknown
+	Transfers  int64    `json:"transfers"`
+	Errors     int64    `json:"errors"`
+	Error      string   `json:"error,omitempty"`
+	Log        []string `json:"log,omitempty"` // Last lines of output
+}
+
+type syncRunState struct {
+	run    *SyncRun
+	cancel context.CancelFunc
+	sent   time.Time // Last sync:progress
+}
+
+var syncJobs = struct {
+	sync.Mutex
+	running map[string]*syncRunState // By job id
+}{running: make(map[string]*syncRunState)}
+
+// syncHistory serializes writes of the run history
+var syncHistory sync.Mutex
+
+func syncJobsFile() string {
+	return filepath.Join(config.DataDir, "sync-jobs.json")
+}
+
+func syncRunsFile() string {
+	return filepath.Join(config.DataDir, "sync-runs.json")
+}
+
+func loadSyncJobs() []SyncJob {
+	var jobs []SyncJob
+	if err := utils.ReadJSON(syncJobsFile(), &jobs); err != nil && !errors.Is(err, os.ErrNotExist) {
+		syncLog.Warn("Failed to read sync jobs", "error", err)
+	}
+	return jobs
+}
+
+func findSyncJob(id string) (SyncJob, error) {
+	for _, job := range loadSyncJobs() {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return SyncJob{}, errSyncJobNotFound
+}
+
+// loadSyncRuns returns the finished runs, newest first
+func loadSyncRuns() []SyncRun {
+	var runs []SyncRun
+	_ = utils.ReadJSON(syncRunsFile(), &runs)
+	return runs
+}
+
+func addSyncRun(run SyncRun) {
+	syncHistory.Lock()
+	defer syncHistory.Unlock()
+	runs := append([]SyncRun{run}, loadSyncRuns()...)
+	if len(runs) > syncKeepRuns {
+		runs = runs[:syncKeepRuns]
+	}
+	if err := utils.WriteJSON(syncRunsFile(), runs); err != nil {
+		syncLog.Warn("Failed to save sync run", "job", run.Job, "error", err)
+	}
+}
+
+// syncFlags are the extra options a job may pass, by tool. Options that
+// name a file to read or a command to run, like rsync -e or rclone
+// --config, would let a job definition run anything and are left out.
+// true marks options taking a value, which must be given as --name=value.
+var syncFlags = map[string]map[string]bool{
+	SyncToolRsync: {
+		"-c": false, "--checksum": false,
+		"-z": false, "--compress": false,
+		"-u": false, "--update": false,
+		"-n": false, "--dry-run": false,
+		"-H": false, "--hard-links": false,
+		"-A": false, "--acls": false,
+		"-X": false, "--xattrs": false,
+		"-S": false, "--sparse": false,
+		"--partial": false, "--inplace": false, "--whole-file": false,
+		"--size-only": false, "--ignore-existing": false, "--existing": false,
+		"--delete-excluded": false, "--numeric-ids": false, "--no-perms": false,
+		"--no-owner": false, "--no-group": false, "--prune-empty-dirs": false,
+		"--exclude": true, "--include": true, "--bwlimit": true, "--timeout": true,
+		"--max-size": true, "--min-size": true, "--max-delete": true, "--modify-window": true,
+	},
+	SyncToolRclone: {
+		"--fast-list": false, "--checksum": false, "--size-only": false,
+		"--update": false, "--dry-run": false, "--ignore-existing": false,
+		"--ignore-case": false, "--delete-excluded": false, "--track-renames": false,
+		"--create-empty-src-dirs": false, "--no-update-modtime": false, "--copy-links": false,
+		"--exclude": true, "--include": true, "--filter": true, "--bwlimit": true,
+		"--transfers": true, "--checkers": true, "--retries": true, "--low-level-retries": true,
+		"--timeout": true, "--contimeout": true, "--tpslimit": true, "--buffer-size": true,
+		"--max-size": true, "--min-size": true, "--max-age": true, "--min-age": true,
+		"--max-transfer": true, "--max-delete": true, "--multi-thread-streams": true,
+	},
+}
+
+// allowedSyncFlag reports whether flag is in the tool's syncFlags
+func allowedSyncFlag(tool, flag string) bool {
+	if strings.ContainsAny(flag, "\x00\n\r") {
+		return false
+	}
+	name, value, hasValue := strings.Cut(flag, "=")
+	takesValue, ok := syncFlags[tool][name]
+	if !ok || takesValue != hasValue {
+		return false
+	}
+	return !hasValue || value != ""
+}
+
+// validSyncEndpoint accepts an absolute path or remote:path
+func validSyncEndpoint(p string) bool {
+	if p == "" || strings.HasPrefix(p, "-") || strings.ContainsAny(p, "\x00\n\r") {
+		return false
+	}
+	return filepath.IsAbs(p) || syncRemoteRe.MatchString(p)
+}
+
+func validateSyncJob(job *SyncJob) error {
+	job.Name = strings.TrimSpace(job.Name)
+	job.Source = strings.TrimSpace(job.Source)
+	job.Dest = strings.TrimSpace(job.Dest)
+	if job.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if job.Tool != SyncToolRclone && job.Tool != SyncToolRsync {
+		return fmt.Errorf("Unknown sync tool")
+	}
+	if job.Mode != "sync" && job.Mode != "copy" {
+		return fmt.Errorf("Invalid sync mode")
+	}
+	if !validSyncEndpoint(job.Source) || !validSyncEndpoint(job.Dest) || job.Source == job.Dest {
+		return fmt.Errorf("Invalid sync path")
+	}
+	for _, f := range job.Flags {
+		if !allowedSyncFlag(job.Tool, f) {
+			return fmt.Errorf("Sync flag %s is not allowed", f)
+		}
+	}
+	if job.IntervalMinutes < 0 {
+		return fmt.Errorf("Invalid interval")
+	}
+	switch job.Notify {
+	case "", "always", "failure", "never":
+	default:
+		return fmt.Errorf("Invalid request")
+	}
+	return nil
+}
+
+// syncCommand is the command line of a job
+func syncCommand(job SyncJob) (string, []string, error) {
+	bin, err := exec.LookPath(job.Tool)
+	if err != nil {
+		if job.Tool == SyncToolRclone {
+			return "", nil, errNoRclone
+		}
+		return "", nil, errNoRsync
+	}
+	if job.Tool == SyncToolRclone {
+		args := []string{job.Mode, "--use-json-log", "--stats=1s", "--stats-log-level=NOTICE", "-v"}
+		args = append(args, job.Flags...)
+		return bin, append(args, job.Source, job.Dest), nil
+	}
+	args := []string{"-a", "--info=progress2", "--no-inc-recursive", "--outbuf=L"}
+	if job.Mode == "sync" {
+		args = append(args, "--delete")
+	}
+	args = append(args, job.Flags...)
+	// Like rclone: the contents of Source go into Dest
+	src := job.Source
+	if !strings.HasSuffix(src, "/") {
+		src += "/"
+	}
+	return bin, append(args, src, job.Dest), nil
+}
+
+// rcloneLogLine is a line of rclone --use-json-log
+type rcloneLogLine struct {
+	Level  string `json:"level"`
+	Msg    string `json:"msg"`
+	Object string `json:"object"`
+	Stats  *struct {
+		Bytes          int64    `json:"bytes"`
+		TotalBytes     int64    `json:"totalBytes"`
+		Speed          float64  `json:"speed"`
+		Eta            *float64 `json:"eta"`
+		Transfers      int64    `json:"transfers"`
+		TotalTransfers int64    `json:"totalTransfers"`
+		Errors         int64    `json:"errors"`
+	} `json:"stats"`
+}
+
+// A line of rsync --info=progress2, e.g.
+// "1,234,567  45%  1.23MB/s  0:00:12 (xfr#3, to-chk=5/10)"
+var rsyncProgressRe = regexp.MustCompile(`^\s*([\d,]+)\s+(\d+)%\s+([\d.]+)([kMGT]?)B/s\s+(\d+):(\d{2}):(\d{2})(?:\s+\(xfr#(\d+))?`)
+
+// parseSyncLine updates run from a line of output and returns the line to
+// log, "" for progress lines
+func parseSyncLine(tool string, run *SyncRun, line string) string {
+	if tool == SyncToolRclone {
+		var l rcloneLogLine
+		if json.Unmarshal([]byte(line), &l) != nil {
+			return line
+		}
+		if s := l.Stats; s != nil {
+			run.Bytes, run.TotalBytes = s.Bytes, s.TotalBytes
+			run.Speed = int64(s.Speed)
+			run.Transfers, run.Errors = s.Transfers, s.Errors
+			run.Eta = -1
+			if s.Eta != nil {
+				run.Eta = int64(*s.Eta)
+			}
+			if s.TotalBytes > 0 {
+				run.Percent = int(s.Bytes * 100 / s.TotalBytes)
+			}
+			return ""
+		}
+		msg := strings.TrimSpace(l.Msg)
+		if l.Object != "" {
+			msg = l.Object + ": " + msg
+		}
+		if l.Level == "error" {
+			run.Errors++
+		}
+		return l.Level + ": " + msg
+	}
+	m := rsyncProgressRe.FindStringSubmatch(line)
+	if m == nil {
+		return line
+	}
+	run.Bytes, _ = strconv.ParseInt(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+	run.Percent, _ = strconv.Atoi(m[2])
+	if run.Percent > 0 {
+		run.TotalBytes = run.Bytes * 100 / int64(run.Percent)
+	}
+	speed, _ := strconv.ParseFloat(m[3], 64)
+	switch m[4] {
+	case "k":
+		speed *= 1 << 10
+	case "M":
+		speed *= 1 << 20
+	case "G":
+		speed *= 1 << 30
+	case "T":
+		speed *= 1 << 40
+	}
+	run.Speed = int64(speed)
+	h, _ := strconv.ParseInt(m[5], 10, 64)
+	min, _ := strconv.ParseInt(m[6], 10, 64)
+	sec, _ := strconv.ParseInt(m[7], 10, 64)
+	run.Eta = h*3600 + min*60 + sec
+	if m[8] != "" {
+		run.Transfers, _ = strconv.ParseInt(m[8], 10, 64)
+	}
+	return ""
+}
+
+// scanSyncLines splits output on \n and on the \r of progress updates
+func scanSyncLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// syncSnapshot copies a run without its log. Callers hold syncJobs.
+func syncSnapshot(run *SyncRun) SyncRun {
+	s := *run
+	s.Log = nil
+	return s
+}
+
+// startSyncJob runs a job in the background
+func startSyncJob(job SyncJob, trigger string) (SyncRun, error) {
+	bin, args, err := syncCommand(job)
+	if err != nil {
+		return SyncRun{}, err
+	}
+	syncJobs.Lock()
+	defer syncJobs.Unlock()
+	if syncJobs.running[job.ID] != nil {
+		return SyncRun{}, errSyncRunning
+	}
+	ctx, cancel := context.WithCancel(backgroundCtx)
+	state := &syncRunState{
+		run:    &SyncRun{ID: randomHexID(8), JobID: job.ID, Job: job.Name, Trigger: trigger, Status: "running", StartedAt: time.Now().UnixMilli(), Eta: -1},
+		cancel: cancel,
+	}
+	syncJobs.running[job.ID] = state
+	go runSyncJob(ctx, job, state, bin, args)
+	return syncSnapshot(state.run), nil
+}
+
+func runSyncJob(ctx context.Context, job SyncJob, state *syncRunState, bin string, args []string) {
+	defer state.cancel()
+	syncLog.Info("Sync job started", "job", job.Name, "trigger", state.run.Trigger)
+	cmd := exec.CommandContext(ctx, bin, args...)
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	// rsync's helper processes may hold the output open after a cancel
+	cmd.WaitDelay = 5 * time.Second
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			scanner := bufio.NewScanner(pr)
+			scanner.Buffer(make([]byte, 64<<10), 1<<20)
+			scanner.Split(scanSyncLines)
+			for scanner.Scan() {
+				syncOutput(job, state, scanner.Text())
+			}
+			io.Copy(io.Discard, pr)
+		}()
+		err = cmd.Wait()
+		pw.Close()
+		<-done
+	}
+
+	syncJobs.Lock()
+	final := *state.run
+	final.Log = append([]string(nil), state.run.Log...)
+	syncJobs.Unlock()
+	final.FinishedAt = time.Now().UnixMilli()
+	switch {
+	case ctx.Err() != nil:
+		final.Status = "cancelled"
+	case err != nil:
+		final.Status = "failed"
+		final.Error = err.Error()
+		// The last thing the tool said is usually why
+		if n := len(final.Log); n > 0 {
+			final.Error = final.Log[n-1]
+		}
+	default:
+		final.Status = "success"
+		final.Percent = 100
+		final.Eta = 0
+	}
+	syncLog.Info("Sync job finished", "job", job.Name, "status", final.Status, "bytes", final.Bytes, "took", time.Duration(final.FinishedAt-final.StartedAt)*time.Millisecond)
+	fireWebhook(WebhookSyncFinished, map[string]interface{}{
+		"job":    job.Name,
+		"jobId":  job.ID,
+		"run":    final.ID,
+		"status": final.Status,
+		"bytes":  final.Bytes,
+		"error":  final.Error,
+	})
+	if backgroundCtx.Err() == nil {
+		notifySyncRun(job, final)
+	}
+	// The run stays "running" until it is in the history
+	addSyncRun(final)
+	syncJobs.Lock()
+	delete(syncJobs.running, job.ID)
+	syncJobs.Unlock()
+	broadcastRoom(syncRoom, "sync:finished", syncSnapshot(&final))
+}
+
+// syncOutput takes a line the tool wrote
+func syncOutput(job SyncJob, state *syncRunState, line string) {
+	line = strings.TrimRight(line, " \t")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if len(line) > syncMaxLine {
+		line = line[:syncMaxLine]
+	}
+	syncJobs.Lock()
+	defer syncJobs.Unlock()
+	run := state.run
+	if logLine := parseSyncLine(job.Tool, run, line); logLine != "" {
+		run.Log = append(run.Log, logLine)
+		if len(run.Log) > syncLogLines {
+			run.Log = run.Log[len(run.Log)-syncLogLines:]
+		}
+		broadcastRoom(syncRoom, "sync:log", map[string]interface{}{"jobId": job.ID, "runId": run.ID, "line": logLine})
+		return
+	}
+	if time.Since(state.sent) >= syncProgressEvery {
+		state.sent = time.Now()
+		broadcastRoom(syncRoom, "sync:progress", syncSnapshot(run))
+	}
+}
+
+func notifySyncRun(job SyncJob, run SyncRun) {
+	var n Notification
+	switch {
+	case run.Status == "success" && (job.Notify == "" || job.Notify == "always"):
+		n = Notification{
+			Title: i18n.T(notifyLocale(), "notify_sync_success", job.Name),
+			Body:  i18n.T(notifyLocale(), "notify_sync_success_body", run.Transfers, formatSyncBytes(run.Bytes)),
+		}
+	case run.Status == "failed" && job.Notify != "never":
+		n = Notification{
+			Title: i18n.T(notifyLocale(), "notify_sync_failed", job.Name),
+			Body:  run.Error,
+		}
+	default:
+		return
+	}
+	n.Source = "sync"
+	sendNotification(backgroundCtx, n, job.Channels)
+}
+
+// formatSyncBytes writes n in KiB, MiB... for notifications
+func formatSyncBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, unit := float64(n), 0
+	for size >= 1024 && unit < 4 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, " KMGT"[unit])
+}
+
+// StartSyncScheduler runs the enabled jobs that have an interval once it
+// has passed since their last run
+func StartSyncScheduler() {
+	go func() {
+		ticker := time.NewTicker(syncSchedulerTick)
+		defer ticker.Stop()
+		beat := registerWorker("sync.scheduler", syncSchedulerTick)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case now := <-ticker.C:
+				beat()
+				last := make(map[string]int64)
+				for _, run := range loadSyncRuns() {
+					if run.StartedAt > last[run.JobID] {
+						last[run.JobID] = run.StartedAt
+					}
+				}
+				for _, job := range loadSyncJobs() {
+					if !job.Enable || job.IntervalMinutes <= 0 {
+						continue
+					}
+					if now.Sub(time.UnixMilli(last[job.ID])) < time.Duration(job.IntervalMinutes)*time.Minute {
+						continue
+					}
+					if _, err := startSyncJob(job, "schedule"); err != nil && !errors.Is(err, errSyncRunning) {
+						syncLog.Warn("Sync job not started", "job", job.Name, "error", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// BindSyncHandlers lets the admin follow runs: sync:watch joins the sync
+// room and answers sync:running with the runs in progress
+func BindSyncHandlers(server *socketio.Server) {
+	bindEvent(server, "sync:watch", func(s socketio.Conn, msg interface{}) {
+		if !logsAdmin(msg) {
+			s.Emit("sync:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		m, _ := msg.(map[string]interface{})
+		if enable, ok := m["enable"].(bool); ok && !enable {
+			s.Leave(syncRoom)
+			return
+		}
+		s.Join(syncRoom)
+		s.Emit("sync:running", runningSyncRuns())
+	})
+}
+
+func runningSyncRuns() []SyncRun {
+	syncJobs.Lock()
+	defer syncJobs.Unlock()
+	runs := make([]SyncRun, 0, len(syncJobs.running))
+	for _, state := range syncJobs.running {
+		runs = append(runs, syncSnapshot(state.run))
+	}
+	return runs
+}
+
+func syncError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errSyncJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errSyncRunning), errors.Is(err, errSyncNotRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoRclone), errors.Is(err, errNoRsync):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Sync job failed", "details": err.Error()})
+	}
+}
+
+// GetSyncJobs lists the jobs with their run in progress or last run
+func GetSyncJobs(c *gin.Context) {
+	jobs := loadSyncJobs()
+	last := make(map[string]SyncRun)
+	for _, run := range loadSyncRuns() {
+		if _, ok := last[run.JobID]; !ok {
+			run.Log = nil
+			last[run.JobID] = run
+		}
+	}
+	syncJobs.Lock()
+	defer syncJobs.Unlock()
+	list := make([]gin.H, 0, len(jobs))
+	for _, job := range jobs {
+		item := gin.H{"job": job}
+		if state := syncJobs.running[job.ID]; state != nil {
+			item["running"] = syncSnapshot(state.run)
+		}
+		if run, ok := last[job.ID]; ok {
+			item["lastRun"] = run
+		}
+		list = append(list, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": list})
+}
+
+// SaveSyncJob creates a job, or updates the one with the given id
+func SaveSyncJob(c *gin.Context) {
+	var req SyncJob
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if err := validateSyncJob(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var jobs []SyncJob
+	err := utils.UpdateJSON(syncJobsFile(), &jobs, func() error {
+		if req.ID == "" {
+			req.ID = randomHexID(6)
+			jobs = append(jobs, req)
+			return nil
+		}
+		for i := range jobs {
+			if jobs[i].ID == req.ID {
+				jobs[i] = req
+				return nil
+			}
+		}
+		return errSyncJobNotFound
+	})
+	if err != nil {
+		syncError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": req})
+}
+
+// DeleteSyncJob removes a job that is not running
+func DeleteSyncJob(c *gin.Context) {
+	id := c.Param("id")
+	syncJobs.Lock()
+	running := syncJobs.running[id] != nil
+	syncJobs.Unlock()
+	if running {
+		syncError(c, errSyncRunning)
+		return
+	}
+	var jobs []SyncJob
+	err := utils.UpdateJSON(syncJobsFile(), &jobs, func() error {
+		for i := range jobs {
+			if jobs[i].ID == id {
+				jobs = append(jobs[:i], jobs[i+1:]...)
+				return nil
+			}
+		}
+		return errSyncJobNotFound
+	})
+	if err != nil {
+		syncError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// RunSyncJob starts a job now
+func RunSyncJob(c *gin.Context) {
+	job, err := findSyncJob(c.Param("id"))
+	if err != nil {
+		syncError(c, err)
+		return
+	}
+	run, err := startSyncJob(job, "manual")
+	if err != nil {
+		syncError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": run})
+}
+
+// CancelSyncJob stops the run of a job
+func CancelSyncJob(c *gin.Context) {
+	syncJobs.Lock()
+	state := syncJobs.running[c.Param("id")]
+	syncJobs.Unlock()
+	if state == nil {
+		syncError(c, errSyncNotRunning)
+		return
+	}
+	state.cancel()
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetSyncRuns lists finished runs, newest first, of ?job= or of every job.
+// Logs are left out; GetSyncRun has them.
+func GetSyncRuns(c *gin.Context) {
+	jobID := c.Query("job")
+	runs := []SyncRun{}
+	for _, run := range loadSyncRuns() {
+		if jobID == "" || run.JobID == jobID {
+			run.Log = nil
+			runs = append(runs, run)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": runs})
+}
+
+// GetSyncRun returns a run with its log, finished or in progress
+func GetSyncRun(c *gin.Context) {
+	id := c.Param("id")
+	syncJobs.Lock()
+	for _, state := range syncJobs.running {
+		if state.run.ID == id {
+			run := *state.run
+			run.Log = append([]string(nil), state.run.Log...)
+			syncJobs.Unlock()
+			c.JSON(http.StatusOK, gin.H{"success": true, "data": run})
+			return
+		}
+	}
+	syncJobs.Unlock()
+	for _, run := range loadSyncRuns() {
+		if run.ID == id {
+			c.JSON(http.StatusOK, gin.H{"success": true, "data": run})
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+}
+
+// GetSyncRemotes lists the remotes of rclone's config
+func GetSyncRemotes(c *gin.Context) {
+	out, err := systemCommand(c.Request.Context(), errNoRclone, "rclone", "listremotes")
+	if err != nil {
+		if errors.Is(err, errNoRclone) {
+			syncError(c, err)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list remotes", "details": strings.TrimSpace(string(out))})
+		return
+	}
+	remotes := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			remotes = append(remotes, line)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": remotes})
+}
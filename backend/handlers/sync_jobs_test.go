@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSyncJobs(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.WriteFile(filepath.Join(bin, "rclone"), []byte(`#!/bin/sh
+echo "$@" > "$(dirname "$0")/rclone.args"
+echo '{"level":"info","msg":"Copied (new)","object":"a.txt"}' >&2
+echo '{"level":"notice","msg":"stats","stats":{"bytes":2048,"totalBytes":4096,"speed":1024,"eta":2,"transfers":1,"errors":0}}' >&2
+echo '{"level":"notice","msg":"stats","stats":{"bytes":4096,"totalBytes":4096,"speed":2048,"eta":0,"transfers":2,"errors":0}}' >&2
+`), 0755)
+	os.WriteFile(filepath.Join(bin, "rsync"), []byte(`#!/bin/sh
+printf '      1,024  25%%    1.00MB/s    0:00:03 (xfr#1, to-chk=3/4)\r      2,048  50%%    1.00MB/s    0:00:02 (xfr#2, to-chk=2/4)\r'
+echo 'rsync: [receiver] mkstemp "/dst/b.txt" failed: Permission denied (13)' >&2
+exit 23
+`), 0755)
+
+	r := gin.New()
+	r.GET("/jobs", GetSyncJobs)
+	r.POST("/jobs", SaveSyncJob)
+	r.DELETE("/jobs/:id", DeleteSyncJob)
+	r.POST("/jobs/:id/run", RunSyncJob)
+	r.GET("/runs", GetSyncRuns)
+	r.GET("/runs/:id", GetSyncRun)
+	for _, body := range []string{
+		`{"name":"x","tool":"curl","mode":"sync","source":"/a","dest":"/b"}`,
+		`{"name":"x","tool":"rsync","mode":"sync","source":"relative","dest":"/b"}`,
+		`{"name":"x","tool":"rsync","mode":"sync","source":"/a","dest":"-e sh"}`,
+		`{"name":"x","tool":"rsync","mode":"copy","source":"/a","dest":"/b","flags":["/etc"]}`,
+		`{"name":"x","tool":"rsync","mode":"copy","source":"/a","dest":"/b","flags":["-e","sh -c id"]}`,
+		`{"name":"x","tool":"rsync","mode":"copy","source":"/a","dest":"/b","flags":["--rsh=sh -c id"]}`,
+		`{"name":"x","tool":"rclone","mode":"copy","source":"/a","dest":"/b","flags":["--config=/tmp/x"]}`,
+		`{"name":"x","tool":"rclone","mode":"copy","source":"/a","dest":"/b","flags":["--rc-addr=:5572"]}`,
+		`{"name":"x","tool":"rclone","mode":"copy","source":"/a","dest":"/b","flags":["--transfers"]}`,
+	} {
+		if w := serve(r, "POST", "/jobs", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+	save := func(body string) SyncJob {
+		var resp struct{ Data SyncJob }
+		w := serve(r, "POST", "/jobs", body)
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 || resp.Data.ID == "" {
+			t.Fatalf("save failed: %d %s", w.Code, w.Body.String())
+		}
+		return resp.Data
+	}
+	cloud := save(`{"name":"To S3","tool":"rclone","mode":"sync","source":"/srv/photos","dest":"s3:bucket/photos","flags":["--fast-list","--transfers=8"],"notify":"never"}`)
+	local := save(`{"name":"Mirror","tool":"rsync","mode":"copy","source":"/srv/a","dest":"/srv/b","notify":"never"}`)
+
+	run := func(job SyncJob) SyncRun {
+		var started struct{ Data SyncRun }
+		w := serve(r, "POST", "/jobs/"+job.ID+"/run", "")
+		json.Unmarshal(w.Body.Bytes(), &started)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("run failed: %d %s", w.Code, w.Body.String())
+		}
+		for i := 0; i < 500; i++ {
+			var resp struct{ Data SyncRun }
+			json.Unmarshal(serve(r, "GET", "/runs/"+started.Data.ID, "").Body.Bytes(), &resp)
+			if resp.Data.Status != "running" && resp.Data.FinishedAt > 0 {
+				return resp.Data
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("run did not finish")
+		return SyncRun{}
+	}
+	got := run(cloud)
+	if got.Status != "success" || got.Bytes != 4096 || got.Transfers != 2 || got.Speed != 2048 || got.Percent != 100 || len(got.Log) != 1 || got.Log[0] != "info: a.txt: Copied (new)" {
+		t.Fatalf("unexpected rclone run %+v", got)
+	}
+	args, _ := os.ReadFile(filepath.Join(bin, "rclone.args"))
+	if !strings.HasPrefix(string(args), "sync --use-json-log") || !strings.HasSuffix(strings.TrimSpace(string(args)), "--fast-list --transfers=8 /srv/photos s3:bucket/photos") {
+		t.Fatalf("unexpected rclone args %q", args)
+	}
+
+	got = run(local)
+	if got.Status != "failed" || got.Bytes != 2048 || got.Percent != 50 || got.Speed != 1<<20 || got.Eta != 2 || got.Transfers != 2 || !strings.Contains(got.Error, "Permission denied") {
+		t.Fatalf("unexpected rsync run %+v", got)
+	}
+
+	var runs struct{ Data []SyncRun }
+	json.Unmarshal(serve(r, "GET", "/runs?job="+cloud.ID, "").Body.Bytes(), &runs)
+	if len(runs.Data) != 1 || runs.Data[0].Log != nil {
+		t.Fatalf("unexpected runs %+v", runs.Data)
+	}
+	if w := serve(r, "DELETE", "/jobs/"+local.ID, ""); w.Code != 200 {
+		t.Fatalf("delete failed: %d", w.Code)
+	}
+	if w := serve(r, "POST", "/jobs/"+local.ID+"/run", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
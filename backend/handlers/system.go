@@ -43,6 +43,55 @@ var (
 	cpuMutex     sync.Mutex
 )
 
+// Disk usage that raises a disk.alert webhook, and the level it must drop
+// below before another alert
+const (
+	diskAlertPercent  = 90
+	diskRearmPercent  = 85
+	diskCheckInterval = 5 * time.Minute
+)
+
+// baseVolume is the volume holding BaseDir
+func baseVolume() string {
+	volume := filepath.VolumeName(config.BaseDir)
+	if volume == "" {
+		return "/"
+	}
+	return volume + "\\"
+}
+
+// StartDiskMonitor fires a disk.alert webhook when the data volume fills up
+func StartDiskMonitor() {
+	go func() {
+		alerted := false
+		ticker := time.NewTicker(diskCheckInterval)
+		defer ticker.Stop()
+		beat := registerWorker("disk.monitor", diskCheckInterval)
+		for {
+			beat()
+			if d, err := disk.Usage(baseVolume()); err == nil {
+				switch {
+				case !alerted && d.UsedPercent >= diskAlertPercent:
+					alerted = true
+					fireWebhook(WebhookDiskAlert, map[string]interface{}{
+						"path":        d.Path,
+						"usedPercent": d.UsedPercent,
+						"free":        d.Free,
+						"total":       d.Total,
+					})
+				case alerted && d.UsedPercent < diskRearmPercent:
+					alerted = false
+				}
+			}
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
 func calculateTotalTime(t cpu.TimesStat) float64 {
 	return t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal + t.Guest + t.GuestNice
 }
@@ -72,14 +121,7 @@ func GetSystemStats(c *gin.Context) {
 	}
 	cpuMutex.Unlock()
 
-	// Use the volume of BaseDir
-	volume := filepath.VolumeName(config.BaseDir)
-	if volume == "" {
-		volume = "/"
-	} else {
-		volume = volume + "\\"
-	}
-	d, _ := disk.Usage(volume)
+	d, _ := disk.Usage(baseVolume())
 
 	// Network Stats Calculation
 	currentNet, _ := net.IOCounters(true)
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+// The dashboard graphs the host live. A client sends "system:stats"
+// {token, interval} to join the room of that interval, in seconds; the
+// server samples the host while anyone is in the room and sends each
+// sample to it as a "system:stats" event: CPU load overall and per core,
+// memory, and the throughput of each network interface and disk since the
+// previous sample. The first sample comes one interval after the first
+// client joins, as rates need two readings. {enable: false} stops.
+
+const (
+	statsDefaultInterval = 2
+	statsMaxInterval     = 60
+)
+
+// SystemStatsPayload starts or stops the live stats of a client
+type SystemStatsPayload struct {
+	Token    string `json:"token"`
+	Interval int    `json:"interval,omitempty"` // Seconds, defaults to 2
+	Enable   *bool  `json:"enable,omitempty"`   // Defaults to true
+}
+
+// SystemStatsSample is the "system:stats" event
+type SystemStatsSample struct {
+	Time     int64         `json:"time"`
+	Interval int           `json:"interval"`
+	CPU      CPUStats      `json:"cpu"`
+	Memory   MemoryStats   `json:"memory"`
+	Network  []NetworkStat `json:"network"`
+	Disks    []DiskIOStat  `json:"disks"`
+}
+
+// CPUStats are percentages of the time since the previous sample
+type CPUStats struct {
+	Load   float64   `json:"load"`
+	User   float64   `json:"user"`
+	System float64   `json:"system"`
+	Iowait float64   `json:"iowait"`
+	Cores  []float64 `json:"cores"`
+}
+
+// MemoryStats are in bytes
+type MemoryStats struct {
+	Total     uint64 `json:"total"`
+	Used      uint64 `json:"used"`
+	Available uint64 `json:"available"`
+	Cached    uint64 `json:"cached"`
+	SwapTotal uint64 `json:"swapTotal"`
+	SwapUsed  uint64 `json:"swapUsed"`
+}
+
+// DiskIOStat is the I/O of a disk per second; Busy is the percentage of
+// the time it was working
+type DiskIOStat struct {
+	Name     string  `json:"name"`
+	ReadSec  uint64  `json:"readSec"`
+	WriteSec uint64  `json:"writeSec"`
+	ReadOps  uint64  `json:"readOps"`
+	WriteOps uint64  `json:"writeOps"`
+	Busy     float64 `json:"busy"`
+}
+
+// statsReading is what the host counters said at one time
+type statsReading struct {
+	at    time.Time
+	cpu   []cpu.TimesStat // The total, then each core
+	net   []net.IOCountersStat
+	disks map[string]disk.IOCountersStat
+}
+
+// sysBlockDir lists the disks of a Linux host
+var sysBlockDir = "/sys/block"
+
+// statsSamplers are the intervals sampled at the moment
+var statsSamplers = struct {
+	sync.Mutex
+	running map[int]bool
+}{running: make(map[int]bool)}
+
+func statsRoom(interval int) string {
+	return "system:stats:" + strconv.Itoa(interval)
+}
+
+func readStats() statsReading {
+	r := statsReading{at: time.Now()}
+	if total, err := cpu.Times(false); err == nil && len(total) > 0 {
+		cores, _ := cpu.Times(true)
+		r.cpu = append(total[:1], cores...)
+	}
+	r.net, _ = net.IOCounters(true)
+	r.disks, _ = disk.IOCounters()
+	return r
+}
+
+// wholeDisk tells disks from their partitions and from loop and RAM
+// devices, where the kernel says which is which
+func wholeDisk(name string) bool {
+	if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+		return false
+	}
+	if _, err := os.Stat(sysBlockDir); err != nil {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(sysBlockDir, name))
+	return err == nil
+}
+
+// cpuPercents is how busy a CPU was between two readings
+func cpuPercents(prev, cur cpu.TimesStat) (load, user, system, iowait float64) {
+	total := calculateTotalTime(cur) - calculateTotalTime(prev)
+	if total <= 0 {
+		return 0, 0, 0, 0
+	}
+	percent := func(a, b float64) float64 {
+		return max(0, min(100, (b-a)/total*100))
+	}
+	idle := percent(prev.Idle, cur.Idle)
+	return 100 - idle, percent(prev.User, cur.User), percent(prev.System, cur.System), percent(prev.Iowait, cur.Iowait)
+}
+
+// counterRate is how much a counter grew per second; one that went back,
+// as after a wrap or a reset, gives 0
+func counterRate(prev, cur uint64, seconds float64) uint64 {
+	if cur < prev || seconds <= 0 {
+		return 0
+	}
+	return uint64(float64(cur-prev) / seconds)
+}
+
+// statsSample compares two readings
+func statsSample(prev, cur statsReading, interval int) SystemStatsSample {
+	seconds := cur.at.Sub(prev.at).Seconds()
+	sample := SystemStatsSample{
+		Time:     cur.at.UnixMilli(),
+		Interval: interval,
+		Network:  []NetworkStat{},
+		Disks:    []DiskIOStat{},
+	}
+	if len(prev.cpu) > 0 && len(cur.cpu) == len(prev.cpu) {
+		c := &sample.CPU
+		c.Load, c.User, c.System, c.Iowait = cpuPercents(prev.cpu[0], cur.cpu[0])
+		for i := 1; i < len(cur.cpu); i++ {
+			load, _, _, _ := cpuPercents(prev.cpu[i], cur.cpu[i])
+			c.Cores = append(c.Cores, load)
+		}
+	}
+	if v, err := mem.VirtualMemory(); err == nil {
+		sample.Memory = MemoryStats{Total: v.Total, Used: v.Used, Available: v.Available, Cached: v.Cached}
+	}
+	if s, err := mem.SwapMemory(); err == nil {
+		sample.Memory.SwapTotal, sample.Memory.SwapUsed = s.Total, s.Used
+	}
+
+	lastNet := make(map[string]net.IOCountersStat, len(prev.net))
+	for _, n := range prev.net {
+		lastNet[n.Name] = n
+	}
+	for _, n := range cur.net {
+		last, ok := lastNet[n.Name]
+		if !ok {
+			continue
+		}
+		sample.Network = append(sample.Network, NetworkStat{
+			Iface: n.Name,
+			RxSec: counterRate(last.BytesRecv, n.BytesRecv, seconds),
+			TxSec: counterRate(last.BytesSent, n.BytesSent, seconds),
+		})
+	}
+	sort.Slice(sample.Network, func(i, j int) bool { return sample.Network[i].Iface < sample.Network[j].Iface })
+
+	for name, d := range cur.disks {
+		last, ok := prev.disks[name]
+		if !ok || !wholeDisk(name) {
+			continue
+		}
+		busy := 0.0
+		if seconds > 0 && d.IoTime >= last.IoTime {
+			busy = min(100, float64(d.IoTime-last.IoTime)/(seconds*10))
+		}
+		sample.Disks = append(sample.Disks, DiskIOStat{
+			Name:     name,
+			ReadSec:  counterRate(last.ReadBytes, d.ReadBytes, seconds),
+			WriteSec: counterRate(last.WriteBytes, d.WriteBytes, seconds),
+			ReadOps:  counterRate(last.ReadCount, d.ReadCount, seconds),
+			WriteOps: counterRate(last.WriteCount, d.WriteCount, seconds),
+			Busy:     busy,
+		})
+	}
+	sort.Slice(sample.Disks, func(i, j int) bool { return sample.Disks[i].Name < sample.Disks[j].Name })
+	return sample
+}
+
+// startStatsSampler samples the host every interval seconds while anyone
+// is in the room of the interval
+func startStatsSampler(interval int) {
+	statsSamplers.Lock()
+	defer statsSamplers.Unlock()
+	if statsSamplers.running[interval] {
+		return
+	}
+	statsSamplers.running[interval] = true
+	go func() {
+		room := statsRoom(interval)
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		prev := readStats()
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				statsSamplers.Lock()
+				delete(statsSamplers.running, interval)
+				statsSamplers.Unlock()
+				return
+			case <-ticker.C:
+			}
+			statsSamplers.Lock()
+			if roomLen(room) == 0 {
+				delete(statsSamplers.running, interval)
+				statsSamplers.Unlock()
+				return
+			}
+			statsSamplers.Unlock()
+			cur := readStats()
+			broadcastRoom(room, "system:stats", statsSample(prev, cur, interval))
+			prev = cur
+		}
+	}()
+}
+
+func BindSystemStatsHandlers(server *socketio.Server) {
+	bindEvent(server, "system:stats", func(s socketio.Conn, msg SystemStatsPayload) {
+		if _, ok := validateSocketToken(msg.Token); !ok {
+			s.Emit("system:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		interval := msg.Interval
+		if interval == 0 {
+			interval = statsDefaultInterval
+		}
+		if interval < 1 || interval > statsMaxInterval {
+			s.Emit("system:error", map[string]interface{}{"error": "Invalid interval"})
+			return
+		}
+		// One interval at a time per client
+		for _, room := range s.Rooms() {
+			if strings.HasPrefix(room, "system:stats:") {
+				s.Leave(room)
+			}
+		}
+		if msg.Enable != nil && !*msg.Enable {
+			return
+		}
+		s.Join(statsRoom(interval))
+		startStatsSampler(interval)
+		s.Emit("system:streaming", map[string]interface{}{"interval": interval})
+	})
+}
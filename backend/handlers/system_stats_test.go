@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/middleware"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/gorilla/websocket"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+func TestStatsSample(t *testing.T) {
+	prevBlock := sysBlockDir
+	sysBlockDir = t.TempDir()
+	defer func() { sysBlockDir = prevBlock }()
+	os.Mkdir(filepath.Join(sysBlockDir, "sda"), 0755)
+
+	at := time.Now()
+	prev := statsReading{
+		at:  at,
+		cpu: []cpu.TimesStat{{User: 10, System: 10, Idle: 80}, {User: 5, Idle: 45}, {User: 5, System: 10, Idle: 35}},
+		net: []net.IOCountersStat{{Name: "eth0", BytesRecv: 1000, BytesSent: 5000}},
+		disks: map[string]disk.IOCountersStat{
+			"sda":  {WriteBytes: 4096, ReadCount: 10, IoTime: 100},
+			"sda1": {WriteBytes: 4096},
+		},
+	}
+	cur := statsReading{
+		at:  at.Add(2 * time.Second),
+		cpu: []cpu.TimesStat{{User: 40, System: 20, Idle: 140}, {User: 35, Idle: 65}, {User: 5, System: 20, Idle: 75}},
+		net: []net.IOCountersStat{
+			{Name: "eth0", BytesRecv: 3000, BytesSent: 1000},
+			{Name: "wg0", BytesRecv: 100},
+		},
+		disks: map[string]disk.IOCountersStat{
+			"sda":   {ReadBytes: 2048, WriteBytes: 12288, ReadCount: 30, IoTime: 1100},
+			"sda1":  {WriteBytes: 12288},
+			"loop0": {ReadBytes: 100},
+		},
+	}
+	sample := statsSample(prev, cur, 2)
+
+	c := sample.CPU
+	if c.Load != 40 || c.User != 30 || c.System != 10 || len(c.Cores) != 2 || c.Cores[0] != 60 || c.Cores[1] != 20 {
+		t.Fatalf("unexpected CPU %+v", c)
+	}
+	// Interfaces seen once have no rate yet; a counter that went back gives 0
+	if len(sample.Network) != 1 || sample.Network[0] != (NetworkStat{Iface: "eth0", RxSec: 1000, TxSec: 0}) {
+		t.Fatalf("unexpected network %+v", sample.Network)
+	}
+	// Partitions and loop devices are left out
+	if len(sample.Disks) != 1 || sample.Disks[0] != (DiskIOStat{Name: "sda", ReadSec: 1024, WriteSec: 4096, ReadOps: 10, Busy: 50}) {
+		t.Fatalf("unexpected disks %+v", sample.Disks)
+	}
+}
+
+func TestSystemStatsStream(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	_, token, _ := middleware.CreateApiToken("alice", "dashboard", []string{middleware.ScopeWrite}, 0)
+
+	server := socketio.NewServer(nil)
+	BindSystemStatsHandlers(server)
+	r := gin.New()
+	r.GET("/ws", ServeWebSocket(func(string) bool { return true }))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	type event struct {
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data"`
+	}
+	next := func() event {
+		t.Helper()
+		for {
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var ev event
+			if err := ws.ReadJSON(&ev); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if ev.Event != "connect" {
+				return ev
+			}
+		}
+	}
+	send := func(data map[string]interface{}) {
+		ws.WriteJSON(map[string]interface{}{"event": "system:stats", "data": data})
+	}
+
+	send(map[string]interface{}{"token": "bogus"})
+	if ev := next(); ev.Event != "system:error" {
+		t.Fatalf("expected an error without a token, got %+v", ev)
+	}
+	send(map[string]interface{}{"token": token, "interval": 3600})
+	if ev := next(); ev.Event != "system:error" {
+		t.Fatalf("expected an error for a long interval, got %+v", ev)
+	}
+	send(map[string]interface{}{"token": token, "interval": 1})
+	if ev := next(); ev.Event != "system:streaming" {
+		t.Fatalf("expected the stream to start, got %+v", ev)
+	}
+	ev := next()
+	var sample SystemStatsSample
+	if err := json.Unmarshal(ev.Data, &sample); ev.Event != "system:stats" || err != nil || sample.Interval != 1 || sample.Network == nil {
+		t.Fatalf("unexpected sample %s %s", ev.Event, ev.Data)
+	}
+
+	// Another interval leaves the first room
+	send(map[string]interface{}{"token": token, "interval": 5})
+	for next().Event != "system:streaming" {
+	}
+	if roomLen(statsRoom(1)) != 0 || roomLen(statsRoom(5)) != 1 {
+		t.Fatalf("expected the client in the room of 5s only")
+	}
+	send(map[string]interface{}{"token": token, "enable": false})
+	deadline := time.Now().Add(2 * time.Second)
+	for roomLen(statsRoom(5)) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if roomLen(statsRoom(5)) != 0 {
+		t.Fatalf("expected the client to leave")
+	}
+}
@@ -0,0 +1,411 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Thumbnails of share files are made in every size at once and cached
+// under ThumbCacheDir by a hash of the file's content, so a photo copied
+// or moved to another folder keeps its thumbnails and an edited one gets
+// new ones. Video thumbnails are a keyframe taken with ffmpeg, when it is
+// installed ($FFMPEG_PATH or ffmpeg on the PATH).
+
+var thumbSizes = []int{128, 256, 512, 1024}
+
+const (
+	thumbDefaultSize = 256
+	// The content hash covers the size and this much of the head and tail
+	// of the file; hashing whole videos would take longer than the thumbnail
+	thumbHashSpan  = 64 << 10
+	thumbFfmpegMax = 30 * time.Second
+	// Seek this far into a video so the frame is not a black intro
+	thumbVideoSeek   = "3"
+	thumbMaxHashMemo = 20000
+)
+
+var (
+	thumbImageExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+	thumbVideoExts = map[string]bool{".mp4": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true, ".m4v": true, ".wmv": true, ".flv": true, ".ts": true}
+)
+
+var errNoFfmpeg = errors.New("ffmpeg not found")
+
+// thumbKind is "image", "video" or "" when no thumbnail can be made
+func thumbKind(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case thumbImageExts[ext]:
+		return "image"
+	case thumbVideoExts[ext]:
+		return "video"
+	}
+	return ""
+}
+
+// thumbURL is where the browser loads the thumbnail of a share file
+func thumbURL(share, p string) string {
+	return "/api/thumb?share=" + url.QueryEscape(share) + "&path=" + url.QueryEscape(p)
+}
+
+func thumbCacheFile(hash string, size int) string {
+	return filepath.Join(config.ThumbCacheDir, hash[:2], hash+"-"+strconv.Itoa(size)+".jpg")
+}
+
+// Content hashes by path, size and mtime, so a folder of thumbnails does
+// not read every file again on each visit
+var thumbHashes = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+func thumbHash(full string, info os.FileInfo) (string, error) {
+	memo := fmt.Sprintf("%s|%d|%d", full, info.Size(), info.ModTime().UnixNano())
+	thumbHashes.Lock()
+	hash, ok := thumbHashes.m[memo]
+	thumbHashes.Unlock()
+	if ok {
+		return hash, nil
+	}
+
+	f, err := os.Open(full)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", info.Size())
+	if _, err := io.CopyN(h, f, thumbHashSpan); err != nil && err != io.EOF {
+		return "", err
+	}
+	if info.Size() > 2*thumbHashSpan {
+		if _, err := f.Seek(-thumbHashSpan, io.SeekEnd); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+
+	thumbHashes.Lock()
+	if len(thumbHashes.m) >= thumbMaxHashMemo {
+		thumbHashes.m = make(map[string]string)
+	}
+	thumbHashes.m[memo] = hash
+	thumbHashes.Unlock()
+	return hash, nil
+}
+
+// thumbJob is a running generation; requests for the same file wait on it
+// instead of starting their own
+type thumbJob struct {
+	done chan struct{}
+	err  error
+}
+
+// thumbnailer runs at most one generation per two CPUs, as decoding large
+// photos and running ffmpeg is heavy on small NAS boxes
+var thumbnailer = struct {
+	sync.Mutex
+	jobs  map[string]*thumbJob
+	slots chan struct{}
+}{jobs: make(map[string]*thumbJob), slots: make(chan struct{}, max(1, runtime.NumCPU()/2))}
+
+// ensureThumbs makes the thumbnails of a file unless they are cached, and
+// waits for them until ctx is done
+func ensureThumbs(ctx context.Context, full, kind, hash string) error {
+	if _, err := os.Stat(thumbCacheFile(hash, thumbSizes[len(thumbSizes)-1])); err == nil {
+		return nil
+	}
+	thumbnailer.Lock()
+	job := thumbnailer.jobs[hash]
+	if job == nil {
+		job = &thumbJob{done: make(chan struct{})}
+		thumbnailer.jobs[hash] = job
+		go runThumbJob(job, full, kind, hash)
+	}
+	thumbnailer.Unlock()
+	select {
+	case <-job.done:
+		return job.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func runThumbJob(job *thumbJob, full, kind, hash string) {
+	defer func() {
+		thumbnailer.Lock()
+		delete(thumbnailer.jobs, hash)
+		thumbnailer.Unlock()
+		close(job.done)
+	}()
+	select {
+	case thumbnailer.slots <- struct{}{}:
+	case <-backgroundCtx.Done():
+		job.err = backgroundCtx.Err()
+		return
+	}
+	defer func() { <-thumbnailer.slots }()
+	job.err = generateThumbs(full, kind, hash)
+	if job.err != nil && !errors.Is(job.err, errNoFfmpeg) {
+		filesLog.Warn("Thumbnail generation failed", "path", full, "error", job.err)
+	}
+}
+
+func generateThumbs(full, kind, hash string) error {
+	var src image.Image
+	var err error
+	if kind == "video" {
+		src, err = videoFrame(full)
+	} else {
+		src, err = decodeImageFile(full)
+	}
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(thumbCacheFile(hash, thumbDefaultSize))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Largest last: its presence marks the set complete
+	for _, size := range thumbSizes {
+		dst := image.NewRGBA(calcThumbBounds(src, size))
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), xdraw.Over, nil)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 82}); err != nil {
+			return err
+		}
+		if err := writeThumbFile(thumbCacheFile(hash, size), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeImageFile(full string) (image.Image, error) {
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	return src, err
+}
+
+// videoFrame grabs a keyframe a few seconds in, or the first one of a
+// shorter video
+func videoFrame(full string) (image.Image, error) {
+	bin, err := ffmpegPath()
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, seek := range []string{thumbVideoSeek, "0"} {
+		ctx, cancel := context.WithTimeout(backgroundCtx, thumbFfmpegMax)
+		cmd := exec.CommandContext(ctx, bin, "-nostdin", "-loglevel", "error",
+			"-skip_frame", "nokey", "-ss", seek, "-i", full,
+			"-frames:v", "1", "-f", "image2pipe", "-vcodec", "mjpeg", "pipe:1")
+		out, err := cmd.Output()
+		cancel()
+		if err == nil && len(out) > 0 {
+			return jpeg.Decode(bytes.NewReader(out))
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no video frame")
+	}
+	return nil, lastErr
+}
+
+// ffmpegPath finds ffmpeg: $FFMPEG_PATH, else on the PATH
+func ffmpegPath() (string, error) {
+	if bin := strings.TrimSpace(os.Getenv("FFMPEG_PATH")); bin != "" {
+		return bin, nil
+	}
+	bin, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", errNoFfmpeg
+	}
+	return bin, nil
+}
+
+// writeThumbFile writes through a temporary file so a reader never sees a
+// half-written thumbnail
+func writeThumbFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// resolveThumbFile finds a share file that can have a thumbnail
+func resolveThumbFile(share models.FileShare, p string) (string, os.FileInfo, string, error) {
+	full, err := resolveSharePath(share, p)
+	if err != nil {
+		return "", nil, "", err
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		return "", nil, "", err
+	}
+	kind := thumbKind(full)
+	if info.IsDir() || kind == "" {
+		return "", nil, "", errInvalidPath
+	}
+	return full, info, kind, nil
+}
+
+// ServeThumbnail returns the thumbnail of a share file. size is one of
+// thumbSizes; the nearest larger one is used otherwise.
+func ServeThumbnail(c *gin.Context) {
+	share, err := findFileShare(c.Query("share"))
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	p := c.Query("path")
+	full, info, kind, err := resolveThumbFile(share, p)
+	if err != nil {
+		fileError(c, err, p)
+		return
+	}
+	size := thumbDefaultSize
+	if raw := c.Query("size"); raw != "" {
+		want, err := strconv.Atoi(raw)
+		if err != nil || want <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid size"})
+			return
+		}
+		size = thumbSizes[len(thumbSizes)-1]
+		for i := len(thumbSizes) - 1; i >= 0 && thumbSizes[i] >= want; i-- {
+			size = thumbSizes[i]
+		}
+	}
+	hash, err := thumbHash(full, info)
+	if err != nil {
+		fileError(c, err, p)
+		return
+	}
+
+	etag := `"` + hash[:16] + "-" + strconv.Itoa(size) + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, max-age=604800")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	if err := ensureThumbs(c.Request.Context(), full, kind, hash); err != nil {
+		if c.Request.Context().Err() == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Thumbnail not available"})
+		}
+		return
+	}
+	c.File(thumbCacheFile(hash, size))
+}
+
+// prefetchThumbs makes the thumbnails of share files one after the other
+// in the background. It is false when the server is shutting down.
+func prefetchThumbs(share models.FileShare, files []string) bool {
+	done, ok := beginTask()
+	if !ok {
+		return false
+	}
+	go func() {
+		defer done()
+		for _, p := range files {
+			full, info, kind, err := resolveThumbFile(share, p)
+			if err != nil {
+				continue
+			}
+			hash, err := thumbHash(full, info)
+			if err != nil {
+				continue
+			}
+			if err := ensureThumbs(backgroundCtx, full, kind, hash); errors.Is(err, context.Canceled) {
+				return
+			}
+		}
+	}()
+	return true
+}
+
+// PrefetchThumbnails makes the thumbnails of a folder's photos and videos
+// in the background, so a gallery opens with them ready
+func PrefetchThumbnails(c *gin.Context) {
+	var req struct {
+		Share string `json:"share"`
+		Path  string `json:"path"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	share, err := findFileShare(req.Share)
+	if err != nil {
+		fileError(c, err, "")
+		return
+	}
+	rel, err := cleanSharePath(req.Path)
+	if err != nil {
+		fileError(c, err, req.Path)
+		return
+	}
+	dir, err := resolveSharePath(share, rel)
+	if err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		fileError(c, err, rel)
+		return
+	}
+	var files []string
+	for _, item := range items {
+		if !item.IsDir() && thumbKind(item.Name()) != "" {
+			files = append(files, path.Join(rel, item.Name()))
+		}
+	}
+	if !prefetchThumbs(share, files) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": gin.H{"queued": len(files)}})
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestThumbnails(t *testing.T) {
+	useTestConfig(t)
+	prevThumbs := config.ThumbCacheDir
+	config.ThumbCacheDir = t.TempDir()
+	defer func() { config.ThumbCacheDir = prevThumbs }()
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 800, 400))
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	os.WriteFile(filepath.Join(root, "a.png"), buf.Bytes(), 0644)
+	os.WriteFile(filepath.Join(root, "copy.png"), buf.Bytes(), 0644)
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("x"), 0644)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}}})
+
+	r := gin.New()
+	r.GET("/thumb", ServeThumbnail)
+	r.GET("/files/list", ListFiles)
+	get := func(target, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", target, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/thumb?share=main&path=a.png&size=200", "")
+	if w.Code != 200 {
+		t.Fatalf("thumbnail failed: %d %s", w.Code, w.Body.String())
+	}
+	thumb, err := jpeg.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil || thumb.Bounds().Dx() != 256 || thumb.Bounds().Dy() != 128 {
+		t.Fatalf("expected a 256x128 thumbnail, got %v %v", thumb, err)
+	}
+	if w := get("/thumb?share=main&path=a.png&size=200", w.Header().Get("ETag")); w.Code != 304 {
+		t.Fatalf("expected 304 for a known ETag, got %d", w.Code)
+	}
+	// A copy has the same content and reuses the cached set
+	cached, _ := filepath.Glob(filepath.Join(config.ThumbCacheDir, "*", "*.jpg"))
+	get("/thumb?share=main&path=copy.png", "")
+	again, _ := filepath.Glob(filepath.Join(config.ThumbCacheDir, "*", "*.jpg"))
+	if len(cached) != len(thumbSizes) || len(again) != len(cached) {
+		t.Fatalf("expected one cached set, got %d then %d files", len(cached), len(again))
+	}
+	if w := get("/thumb?share=main&path=notes.txt", ""); w.Code != 400 {
+		t.Fatalf("expected no thumbnail for text, got %d", w.Code)
+	}
+
+	var list struct {
+		Data struct {
+			Entries []FileEntry `json:"entries"`
+		} `json:"data"`
+	}
+	json.Unmarshal(get("/files/list?share=main", "").Body.Bytes(), &list)
+	if len(list.Data.Entries) != 3 || list.Data.Entries[0].Thumb == "" || list.Data.Entries[2].Thumb != "" {
+		t.Fatalf("unexpected thumbnail URLs %+v", list.Data.Entries)
+	}
+}
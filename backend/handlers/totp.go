@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // Steps accepted either side of now
+	totpIssuer        = "FlatNas"
+	totpRecoveryCount = 10
+	totpEnrollPurpose = "2fa-enroll"
+	totpEnrollTTL     = 15 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpRecord is a user's second factor. Recovery codes are stored hashed.
+type totpRecord struct {
+	Secret        string   `json:"secret,omitempty"`
+	Enabled       bool     `json:"enabled"`
+	Pending       string   `json:"pending,omitempty"` // Secret awaiting its first code
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	LastStep      int64    `json:"lastStep,omitempty"` // Last accepted step, to stop replays
+	Required      bool     `json:"required,omitempty"` // Set by the admin
+}
+
+func totpFile() string {
+	return filepath.Join(config.DataDir, "totp.json")
+}
+
+func loadTotpRecords() (map[string]*totpRecord, error) {
+	records := make(map[string]*totpRecord)
+	if err := utils.ReadJSONUnlocked(totpFile(), &records); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return records, nil
+}
+
+// updateTotpRecord runs fn on username's record under the file lock and
+// saves the result. A record left empty is removed.
+func updateTotpRecord(username string, fn func(r *totpRecord) error) error {
+	return utils.WithFileLock(totpFile(), func() error {
+		records, err := loadTotpRecords()
+		if err != nil {
+			return err
+		}
+		record := records[username]
+		if record == nil {
+			record = &totpRecord{}
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+		if !record.Enabled && !record.Required && record.Pending == "" {
+			delete(records, username)
+		} else {
+			records[username] = record
+		}
+		return utils.WriteJSONUnlocked(totpFile(), records)
+	})
+}
+
+func getTotpRecord(username string) totpRecord {
+	var record totpRecord
+	_ = utils.WithFileLock(totpFile(), func() error {
+		records, err := loadTotpRecords()
+		if err == nil && records[username] != nil {
+			record = *records[username]
+		}
+		return err
+	})
+	return record
+}
+
+// totpCode computes the RFC 6238 code for a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// matchTotp returns the step code matches, or 0. Steps at or before
+// lastStep are refused so a code works only once.
+func matchTotp(secret, code string, now time.Time, lastStep int64) int64 {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0
+	}
+	current := now.Unix() / totpPeriod
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		step := current + d
+		if step <= lastStep {
+			continue
+		}
+		want, err := totpCode(secret, step)
+		if err == nil && subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecoveryCodes() (plain, hashed []string) {
+	for i := 0; i < totpRecoveryCount; i++ {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		code := hex.EncodeToString(buf)
+		plain = append(plain, code[:5]+"-"+code[5:])
+		hashed = append(hashed, hashRecoveryCode(code))
+	}
+	return plain, hashed
+}
+
+// consumeSecondFactor accepts a current TOTP code or an unused recovery
+// code for username. Recovery codes are single use.
+func consumeSecondFactor(username, code string) bool {
+	ok := false
+	_ = updateTotpRecord(username, func(r *totpRecord) error {
+		if !r.Enabled {
+			return nil
+		}
+		if step := matchTotp(r.Secret, code, time.Now(), r.LastStep); step > 0 {
+			r.LastStep = step
+			ok = true
+			return nil
+		}
+		hash := hashRecoveryCode(code)
+		for i, h := range r.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				r.RecoveryCodes = append(r.RecoveryCodes[:i], r.RecoveryCodes[i+1:]...)
+				ok = true
+				return nil
+			}
+		}
+		return nil
+	})
+	return ok
+}
+
+// What a password login of an account still needs besides the password
+const (
+	factorNone   = iota
+	factorCode   // The account has a second factor to check
+	factorEnroll // The admin requires one the account has not set up yet
+)
+
+// secondFactor is the one place deciding whether a password is enough for
+// an account, shared by Login and the protocols that only take a password
+func secondFactor(account string) int {
+	record := getTotpRecord(account)
+	switch {
+	case record.Enabled:
+		return factorCode
+	case record.Required:
+		return factorEnroll
+	}
+	return factorNone
+}
+
+// finishLogin issues the session token once the password has been checked,
+// asking for the second factor first when the account has one. An account
+// the admin requires to enroll gets an enrollment token instead, good for
+// the setup routes only.
+func finishLogin(c *gin.Context, account, code string) {
+	switch secondFactor(account) {
+	case factorCode:
+		if strings.TrimSpace(code) == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Two-factor code required", "twoFactorRequired": true})
+			return
+		}
+		if !consumeSecondFactor(account, code) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code", "twoFactorRequired": true})
+			return
+		}
+	case factorEnroll:
+		enrollToken, err := issueEnrollmentToken(account)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+			return
+		}
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":                  "Two-factor authentication must be set up first",
+			"twoFactorSetupRequired": true,
+			"enrollmentToken":        enrollToken,
+			"username":               account,
+		})
+		return
+	}
+	tokenString, err := issueSessionToken(account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "token": tokenString, "username": account})
+}
+
+// issueEnrollmentToken signs the short-lived token that lets a user who
+// must enroll reach the setup routes. It has a key of its own, so it never
+// passes as a session token.
+func issueEnrollmentToken(username string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"enroll": username,
+		"aud":    totpEnrollPurpose,
+		"exp":    time.Now().Add(totpEnrollTTL).Unix(),
+	})
+	return token.SignedString(config.DerivedKey(totpEnrollPurpose))
+}
+
+func parseEnrollmentToken(raw string) (string, bool) {
+	tok, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		return config.DerivedKey(totpEnrollPurpose), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(totpEnrollPurpose), jwt.WithExpirationRequired())
+	if err != nil || !tok.Valid {
+		return "", false
+	}
+	claims, _ := tok.Claims.(jwt.MapClaims)
+	username, _ := claims["enroll"].(string)
+	return username, username != ""
+}
+
+// TwoFactorSetupAuth guards /2fa/setup and /2fa/enable, which accept a
+// session token or the enrollment token of a login that was held back
+func TwoFactorSetupAuth() gin.HandlerFunc {
+	sessionAuth := middleware.AuthMiddleware()
+	return func(c *gin.Context) {
+		raw := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if username, ok := parseEnrollmentToken(raw); ok {
+			c.Set("username", username)
+			c.Set("twoFactorEnrollment", true)
+			c.Next()
+			return
+		}
+		sessionAuth(c)
+	}
+}
+
+// GetTwoFactorStatus reports whether the caller has TOTP set up
+func GetTwoFactorStatus(c *gin.Context) {
+	record := getTotpRecord(c.GetString("username"))
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"enabled":       record.Enabled,
+		"required":      record.Required,
+		"recoveryCodes": len(record.RecoveryCodes),
+	}})
+}
+
+// SetupTwoFactor starts enrollment with a new secret. The otpauth URI is
+// what authenticator apps read from the QR code.
+func SetupTwoFactor(c *gin.Context) {
+	username := c.GetString("username")
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create secret"})
+		return
+	}
+	secret := totpEncoding.EncodeToString(buf)
+	err := updateTotpRecord(username, func(r *totpRecord) error {
+		if r.Enabled {
+			return errors.New("Two-factor authentication is already enabled")
+		}
+		r.Pending = secret
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	label := url.PathEscape(totpIssuer + ":" + username)
+	q := url.Values{
+		"secret": {secret},
+		"issuer": {totpIssuer},
+		"digits": {fmt.Sprint(totpDigits)},
+		"period": {fmt.Sprint(totpPeriod)},
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"secret": secret,
+		"uri":    "otpauth://totp/" + label + "?" + q.Encode(),
+	}})
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// EnableTwoFactor confirms enrollment with a code from the app and returns
+// the recovery codes, which are not shown again
+func EnableTwoFactor(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	var codes []string
+	err := updateTotpRecord(c.GetString("username"), func(r *totpRecord) error {
+		if r.Pending == "" {
+			return errors.New("Start the setup first")
+		}
+		step := matchTotp(r.Pending, req.Code, time.Now(), 0)
+		if step == 0 {
+			return errors.New("Invalid two-factor code")
+		}
+		plain, hashed := newRecoveryCodes()
+		codes = plain
+		r.Secret, r.Pending = r.Pending, ""
+		r.Enabled = true
+		r.LastStep = step
+		r.RecoveryCodes = hashed
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The password alone no longer logs in over WebDAV
+	forgetDavAuth(c.GetString("username"))
+	data := gin.H{"recoveryCodes": codes}
+	if c.GetBool("twoFactorEnrollment") {
+		// Enrollment completes the login that was held back
+		tokenString, err := issueSessionToken(c.GetString("username"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+			return
+		}
+		data["token"] = tokenString
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": data})
+}
+
+// DisableTwoFactor turns TOTP off for the caller after one more code
+func DisableTwoFactor(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	username := c.GetString("username")
+	record := getTotpRecord(username)
+	if !record.Enabled {
+		c.JSON(http.StatusOK, gin.H{"success": true})
+		return
+	}
+	if record.Required {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The administrator requires two-factor authentication"})
+		return
+	}
+	if !consumeSecondFactor(username, req.Code) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return
+	}
+	if err := updateTotpRecord(username, func(r *totpRecord) error {
+		*r = totpRecord{Required: r.Required}
+		return nil
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetUsersTwoFactor lists the TOTP state of every account for the admin
+func GetUsersTwoFactor(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	var list []gin.H
+	_ = utils.WithFileLock(totpFile(), func() error {
+		records, err := loadTotpRecords()
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(records))
+		for name := range records {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			r := records[name]
+			list = append(list, gin.H{"username": name, "enabled": r.Enabled, "required": r.Required})
+		}
+		return nil
+	})
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": list})
+}
+
+type UserTwoFactorRequest struct {
+	Action string `json:"action"` // "reset", "require" or "optional"
+}
+
+// SetUserTwoFactor lets the admin reset a lost second factor or require
+// users to enroll
+func SetUserTwoFactor(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	username := c.Param("usr")
+	if !validUsername(username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+		return
+	}
+	var req UserTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	err := updateTotpRecord(username, func(r *totpRecord) error {
+		switch req.Action {
+		case "reset":
+			*r = totpRecord{Required: r.Required}
+		case "require":
+			r.Required = true
+		case "optional":
+			r.Required = false
+		default:
+			return errors.New("Invalid action")
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	forgetDavAuth(username)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTotpCodes(t *testing.T) {
+	// RFC 6238 test secret; at T=59 the 8-digit code is 94287082
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	if code, err := totpCode(secret, 1); err != nil || code != "287082" {
+		t.Fatalf("expected 287082, got %q %v", code, err)
+	}
+	now := time.Unix(59, 0)
+	step := matchTotp(secret, "287 082", now, 0)
+	if step != 1 {
+		t.Fatalf("expected code to match step 1, got %d", step)
+	}
+	if matchTotp(secret, "287082", now, step) != 0 {
+		t.Fatalf("expected a used code to be refused")
+	}
+	if matchTotp(secret, "000000", now, 0) != 0 {
+		t.Fatalf("expected wrong code to be refused")
+	}
+
+	useTestConfig(t)
+	plain, hashed := newRecoveryCodes()
+	if err := updateTotpRecord("mom", func(r *totpRecord) error {
+		r.Secret, r.Enabled, r.RecoveryCodes = secret, true, hashed
+		return nil
+	}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if !consumeSecondFactor("mom", strings.ToUpper(plain[0])) {
+		t.Fatalf("expected recovery code to be accepted")
+	}
+	if consumeSecondFactor("mom", plain[0]) {
+		t.Fatalf("expected recovery code to work only once")
+	}
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	useTestConfig(t)
+	config.SecretKey = []byte("test-secret")
+	gin.SetMode(gin.TestMode)
+	updateTotpRecord("mom", func(r *totpRecord) error {
+		r.Required = true
+		return nil
+	})
+
+	r := gin.New()
+	r.POST("/login", func(c *gin.Context) { finishLogin(c, "mom", "") })
+	r.POST("/2fa/setup", TwoFactorSetupAuth(), SetupTwoFactor)
+	r.POST("/2fa/enable", TwoFactorSetupAuth(), EnableTwoFactor)
+	r.GET("/data", middleware.AuthMiddleware(), func(c *gin.Context) { c.String(200, c.GetString("username")) })
+	do := func(target, token, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", target, strings.NewReader(body))
+		if strings.HasPrefix(target, "/data") {
+			req.Method = "GET"
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, resp := do("/login", "", "")
+	enroll, _ := resp["enrollmentToken"].(string)
+	if code != 403 || resp["token"] != nil || enroll == "" {
+		t.Fatalf("expected the login to be held back for enrollment, got %d %v", code, resp)
+	}
+	if code, _ := do("/data", enroll, ""); code != 401 {
+		t.Fatalf("expected the enrollment token to be refused elsewhere, got %d", code)
+	}
+	code, resp = do("/2fa/setup", enroll, "")
+	if code != 200 {
+		t.Fatalf("setup failed: %d %v", code, resp)
+	}
+	secret := resp["data"].(map[string]interface{})["secret"].(string)
+	totp, _ := totpCode(secret, time.Now().Unix()/totpPeriod)
+	code, resp = do("/2fa/enable", enroll, `{"code":"`+totp+`"}`)
+	session, _ := resp["data"].(map[string]interface{})["token"].(string)
+	if code != 200 || session == "" {
+		t.Fatalf("enable failed: %d %v", code, resp)
+	}
+	if code, _ := do("/data", session, ""); code != 200 {
+		t.Fatalf("expected the session token to work, got %d", code)
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"image/jpeg"
 	_ "image/png"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -325,7 +324,10 @@ type UploadSession struct {
 	ChunkSize   int64  `json:"chunkSize"`
 	TotalChunks int    `json:"totalChunks"`
 	CreatedAt   int64  `json:"createdAt"`
+	UpdatedAt   int64  `json:"updatedAt"`
 	Uploaded    []int  `json:"uploaded"`
+	// Checksums holds the sha256 of each received chunk by index
+	Checksums map[string]string `json:"checksums,omitempty"`
 }
 
 func UploadInit(c *gin.Context) {
@@ -340,16 +342,40 @@ func UploadInit(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
 		return
 	}
-	if req.ChunkSize <= 0 || req.Size <= 0 {
+	if req.ChunkSize <= 0 || req.ChunkSize > uploadMaxChunkSize || req.Size <= 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chunk size or file size"})
 		return
 	}
 
 	username := c.GetString("username")
+
+	// The same file again resumes its open session
+	if req.FileKey != "" {
+		for _, s := range listUploadSessions(username) {
+			if s.FileKey == req.FileKey && s.Size == req.Size && s.ChunkSize == req.ChunkSize {
+				c.JSON(http.StatusOK, gin.H{
+					"success":     true,
+					"uploadId":    s.UploadID,
+					"chunkSize":   s.ChunkSize,
+					"totalChunks": s.TotalChunks,
+					"uploaded":    s.progress().Uploaded,
+					"resumed":     true,
+				})
+				return
+			}
+		}
+	}
+
+	if limit, used, err := checkUserQuota(username, req.Size); err != nil {
+		quotaError(c, limit, used)
+		return
+	}
+
 	uploadId := fmt.Sprintf("%x", time.Now().UnixNano()) // Simple ID
 
 	totalChunks := int((req.Size + req.ChunkSize - 1) / req.ChunkSize)
 
+	now := time.Now().UnixMilli()
 	session := UploadSession{
 		UploadID:    uploadId,
 		Username:    username,
@@ -359,7 +385,8 @@ func UploadInit(c *gin.Context) {
 		Mime:        req.Mime,
 		ChunkSize:   req.ChunkSize,
 		TotalChunks: totalChunks,
-		CreatedAt:   time.Now().UnixMilli(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
 		Uploaded:    []int{},
 	}
 
@@ -380,6 +407,9 @@ func UploadInit(c *gin.Context) {
 	})
 }
 
+// UploadChunk stores one chunk. The optional sha256 form field is the hex
+// digest of the chunk; a mismatch is rejected so the client resends it.
+// Sending a chunk again replaces it.
 func UploadChunk(c *gin.Context) {
 	uploadId := c.PostForm("uploadId")
 	indexStr := c.PostForm("index")
@@ -420,13 +450,20 @@ func UploadChunk(c *gin.Context) {
 
 	chunkDir := filepath.Join(userDir, uploadId+"_chunks")
 	ensureDir(chunkDir)
-	chunkPath := filepath.Join(chunkDir, fmt.Sprintf("%d", index))
-
-	if err := c.SaveUploadedFile(file, chunkPath); err != nil {
+	sum, err := saveUploadChunk(file, chunkDir, index, session.chunkLength(index), c.PostForm("sha256"))
+	switch {
+	case errors.Is(err, errUploadChecksum):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Chunk checksum mismatch"})
+		return
+	case errors.Is(err, errUploadChunkSize):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chunk size mismatch"})
+		return
+	case err != nil:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Save failed"})
 		return
 	}
 
+	var progress UploadProgress
 	err = utils.WithFileLock(sessionFile, func() error {
 		var current UploadSession
 		if err := utils.ReadJSONUnlocked(sessionFile, &current); err != nil {
@@ -448,6 +485,12 @@ func UploadChunk(c *gin.Context) {
 			current.Uploaded = append(current.Uploaded, v)
 		}
 		sort.Ints(current.Uploaded)
+		if current.Checksums == nil {
+			current.Checksums = make(map[string]string)
+		}
+		current.Checksums[strconv.Itoa(index)] = sum
+		current.UpdatedAt = time.Now().UnixMilli()
+		progress = current.progress()
 		return utils.WriteJSONUnlocked(sessionFile, current)
 	})
 	if err != nil {
@@ -462,8 +505,9 @@ func UploadChunk(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
 		return
 	}
+	broadcastRoom(uploadRoom(username), "transfer:progress", progress)
 
-	c.JSON(http.StatusOK, gin.H{"success": true})
+	c.JSON(http.StatusOK, gin.H{"success": true, "sha256": sum, "received": progress.Received})
 }
 
 func UploadComplete(c *gin.Context) {
@@ -496,6 +540,11 @@ func UploadComplete(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload session"})
 		return
 	}
+	if missing := session.missingChunks(); len(missing) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload incomplete", "missing": missing})
+		return
+	}
+	c.Set("auditTarget", session.FileName)
 
 	// Assemble
 	chunkDir := filepath.Join(userDir, req.UploadId+"_chunks")
@@ -524,7 +573,7 @@ func UploadComplete(c *gin.Context) {
 		if err != nil {
 			outFile.Close()
 			os.Remove(finalPath)
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Missing chunk %d", i)})
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload incomplete", "missing": []int{i}})
 			return
 		}
 		_, err = io.Copy(outFile, in)
@@ -541,6 +590,16 @@ func UploadComplete(c *gin.Context) {
 	os.RemoveAll(chunkDir)
 	os.Remove(sessionFile)
 
+	outFile.Close()
+	origin := QuarantineEntry{Name: session.FileName, Source: "upload", User: username}
+	if virus, err := screenUpload(c.Request.Context(), finalPath, origin); err != nil {
+		if !errors.Is(err, errFileInfected) {
+			os.Remove(finalPath)
+		}
+		uploadScanError(c, virus, err)
+		return
+	}
+
 	// Add to index
 	item := models.TransferItem{
 		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
@@ -558,7 +617,7 @@ func UploadComplete(c *gin.Context) {
 	if strings.HasPrefix(strings.ToLower(session.Mime), "image/") {
 		thumbs, err := generateTransferThumbs(finalPath, finalName, []int{64, 128, 256})
 		if err != nil {
-			log.Printf("transfer thumb generation failed for %s: %v", finalName, err)
+			transferLog.Warn("Thumbnail generation failed", "file", finalName, "error", err)
 		}
 		if len(thumbs) > 0 {
 			item.File.Thumbs = thumbs
@@ -575,6 +634,18 @@ func UploadComplete(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save item"})
 		return
 	}
+	fireWebhook(WebhookTransferCompleted, map[string]interface{}{
+		"user": username,
+		"name": session.FileName,
+		"size": session.Size,
+		"type": session.Mime,
+		"url":  item.File.Url,
+	})
+
+	broadcastRoom(uploadRoom(username), "transfer:complete", map[string]interface{}{
+		"uploadId": req.UploadId,
+		"item":     item,
+	})
 
 	c.JSON(http.StatusOK, gin.H{"success": true, "item": item})
 }
@@ -752,7 +823,7 @@ func GenerateThumb(c *gin.Context) {
 
 	thumbs, err := generateTransferThumbs(filePath, filename, []int{size})
 	if err != nil {
-		log.Printf("Failed to generate thumbnail for %s: %v", filename, err)
+		transferLog.Warn("Failed to generate thumbnail", "file", filename, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate thumbnail"})
 		return
 	}
@@ -762,7 +833,7 @@ func GenerateThumb(c *gin.Context) {
 
 	var data models.TransferData
 	if err := utils.ReadJSON(getTransferIndexFile(), &data); err != nil {
-		log.Printf("Failed to read transfer index: %v", err)
+		transferLog.Error("Failed to read transfer index", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update index"})
 		return
 	}
@@ -786,7 +857,7 @@ func GenerateThumb(c *gin.Context) {
 
 	if updated {
 		if err := utils.WriteJSON(getTransferIndexFile(), data); err != nil {
-			log.Printf("Failed to write transfer index: %v", err)
+			transferLog.Error("Failed to write transfer index", "error", err)
 		}
 	}
 
@@ -943,7 +1014,7 @@ func syncThumbs() {
 		if len(sizesToGenerate) > 0 {
 			thumbs, err := generateTransferThumbs(filePath, filename, sizesToGenerate)
 			if err != nil {
-				log.Printf("Thumb sync failed for %s: %v", filename, err)
+				transferLog.Warn("Thumb sync failed", "file", filename, "error", err)
 				continue
 			}
 
@@ -959,9 +1030,9 @@ func syncThumbs() {
 
 	if generated > 0 {
 		if err := utils.WriteJSON(getTransferIndexFile(), data); err != nil {
-			log.Printf("Failed to save transfer index after sync: %v", err)
+			transferLog.Error("Failed to save transfer index after sync", "error", err)
 		} else {
-			log.Printf("Thumb sync: generated %d thumbnails", generated)
+			transferLog.Info("Thumb sync finished", "generated", generated)
 		}
 	}
 }
@@ -1,6 +1,22 @@
 package handlers
 
-import "testing"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
 
 func TestIsValidUploadID(t *testing.T) {
 	cases := []struct {
@@ -20,3 +36,85 @@ func TestIsValidUploadID(t *testing.T) {
 		}
 	}
 }
+
+func TestResumableUpload(t *testing.T) {
+	prevDoc := config.DocDir
+	config.DocDir = t.TempDir()
+	defer func() { config.DocDir = prevDoc }()
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("username", "alice") })
+	r.POST("/init", UploadInit)
+	r.POST("/chunk", UploadChunk)
+	r.POST("/complete", UploadComplete)
+	r.GET("/upload/:id", UploadStatus)
+	do := func(req *http.Request) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	initUpload := func() map[string]interface{} {
+		_, resp := do(httptest.NewRequest("POST", "/init", strings.NewReader(`{"fileName":"a.bin","size":10,"fileKey":"a.bin|10|1","chunkSize":4}`)))
+		return resp
+	}
+	chunk := func(id string, index int, data, sum string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("uploadId", id)
+		mw.WriteField("index", strconv.Itoa(index))
+		if sum != "" {
+			mw.WriteField("sha256", sum)
+		}
+		fw, _ := mw.CreateFormFile("chunk", "a.bin.part")
+		fw.Write([]byte(data))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/chunk", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		code, _ := do(req)
+		return code
+	}
+	sha := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	first := initUpload()
+	id, _ := first["uploadId"].(string)
+	if id == "" || first["totalChunks"] != float64(3) {
+		t.Fatalf("unexpected init %v", first)
+	}
+	if code := chunk(id, 0, "abcd", sha("abcd")); code != 200 {
+		t.Fatalf("chunk 0 failed: %d", code)
+	}
+	if code := chunk(id, 1, "efgh", sha("wrong")); code != 422 {
+		t.Fatalf("expected a checksum mismatch, got %d", code)
+	}
+	if code := chunk(id, 2, "ijkl", ""); code != 400 {
+		t.Fatalf("expected the short last chunk to be enforced, got %d", code)
+	}
+
+	// Initialising the same file again resumes the session
+	resumed := initUpload()
+	if resumed["uploadId"] != id || len(resumed["uploaded"].([]interface{})) != 1 {
+		t.Fatalf("expected to resume %s, got %v", id, resumed)
+	}
+	if code, resp := do(httptest.NewRequest("POST", "/complete", strings.NewReader(`{"uploadId":"`+id+`"}`))); code != 409 || len(resp["missing"].([]interface{})) != 2 {
+		t.Fatalf("expected the missing chunks, got %d %v", code, resp)
+	}
+	chunk(id, 1, "efgh", sha("efgh"))
+	chunk(id, 2, "ij", "")
+	if _, resp := do(httptest.NewRequest("GET", "/upload/"+id, nil)); resp["data"].(map[string]interface{})["received"] != float64(10) {
+		t.Fatalf("unexpected status %v", resp)
+	}
+	code, resp := do(httptest.NewRequest("POST", "/complete", strings.NewReader(`{"uploadId":"`+id+`"}`)))
+	if code != 200 {
+		t.Fatalf("complete failed: %d %v", code, resp)
+	}
+	name := filepath.Base(resp["item"].(map[string]interface{})["file"].(map[string]interface{})["url"].(string))
+	if got, _ := os.ReadFile(filepath.Join(getUploadsDir(), name)); string(got) != "abcdefghij" {
+		t.Fatalf("unexpected assembled file %q", got)
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Chunked uploads keep their session and received chunks under the user's
+// uploads dir until complete, so a client that lost its connection asks for
+// the session again (by upload ID, or by its file key on init) and only
+// sends the chunks that are missing.
+
+const (
+	uploadMaxChunkSize = 64 << 20
+	// Sessions untouched for this long are dropped on the user's next init
+	uploadSessionTTL = 7 * 24 * time.Hour
+)
+
+var errUploadChecksum = errors.New("upload chunk checksum mismatch")
+var errUploadChunkSize = errors.New("upload chunk size mismatch")
+
+// uploadRoom is the socket room of a user's upload progress events
+func uploadRoom(username string) string {
+	return "transfer:" + username
+}
+
+// UploadProgress is sent as transfer:progress and returned by UploadStatus
+type UploadProgress struct {
+	UploadID    string `json:"uploadId"`
+	FileName    string `json:"fileName"`
+	Size        int64  `json:"size"`
+	Received    int64  `json:"received"`
+	ChunkSize   int64  `json:"chunkSize"`
+	TotalChunks int    `json:"totalChunks"`
+	Uploaded    []int  `json:"uploaded"`
+	UpdatedAt   int64  `json:"updatedAt"`
+}
+
+func (s UploadSession) progress() UploadProgress {
+	var received int64
+	for _, i := range s.Uploaded {
+		received += s.chunkLength(i)
+	}
+	uploaded := s.Uploaded
+	if uploaded == nil {
+		uploaded = []int{}
+	}
+	return UploadProgress{
+		UploadID:    s.UploadID,
+		FileName:    s.FileName,
+		Size:        s.Size,
+		Received:    received,
+		ChunkSize:   s.ChunkSize,
+		TotalChunks: s.TotalChunks,
+		Uploaded:    uploaded,
+		UpdatedAt:   s.UpdatedAt,
+	}
+}
+
+// chunkLength is the size chunk i must have; only the last one is short
+func (s UploadSession) chunkLength(i int) int64 {
+	if i == s.TotalChunks-1 {
+		return s.Size - int64(i)*s.ChunkSize
+	}
+	return s.ChunkSize
+}
+
+// missingChunks lists the chunks not received yet, in order
+func (s UploadSession) missingChunks() []int {
+	have := make(map[int]bool, len(s.Uploaded))
+	for _, i := range s.Uploaded {
+		have[i] = true
+	}
+	missing := []int{}
+	for i := 0; i < s.TotalChunks; i++ {
+		if !have[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+func uploadSessionFile(username, uploadID string) string {
+	return filepath.Join(getUserUploadsDir(username), uploadID+".json")
+}
+
+func uploadChunkDir(username, uploadID string) string {
+	return filepath.Join(getUserUploadsDir(username), uploadID+"_chunks")
+}
+
+func removeUploadSession(username, uploadID string) {
+	os.RemoveAll(uploadChunkDir(username, uploadID))
+	os.Remove(uploadSessionFile(username, uploadID))
+}
+
+// listUploadSessions returns the user's open sessions, newest first, and
+// removes the ones past uploadSessionTTL
+func listUploadSessions(username string) []UploadSession {
+	entries, err := os.ReadDir(getUserUploadsDir(username))
+	if err != nil {
+		return nil
+	}
+	cutoff := time.Now().Add(-uploadSessionTTL).UnixMilli()
+	sessions := []UploadSession{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() || !isValidUploadID(id) {
+			continue
+		}
+		var s UploadSession
+		if err := utils.ReadJSON(filepath.Join(getUserUploadsDir(username), e.Name()), &s); err != nil || s.Username != username {
+			continue
+		}
+		if max(s.CreatedAt, s.UpdatedAt) < cutoff {
+			removeUploadSession(username, id)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt > sessions[j].CreatedAt })
+	return sessions
+}
+
+// saveUploadChunk writes the chunk next to its final name while hashing it,
+// checks its length and, when the client sent one, its sha256, and only
+// then moves it into place. A failed or repeated chunk never leaves a
+// partial file behind.
+func saveUploadChunk(file *multipart.FileHeader, dir string, index int, length int64, want string) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(dir, fmt.Sprintf("%d.*.part", index))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	if n != length {
+		return "", errUploadChunkSize
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if want != "" && !strings.EqualFold(want, sum) {
+		return "", errUploadChecksum
+	}
+	return sum, os.Rename(tmp.Name(), filepath.Join(dir, fmt.Sprintf("%d", index)))
+}
+
+// UploadStatus returns what the server has of an upload, for the client to
+// resume it
+func UploadStatus(c *gin.Context) {
+	uploadID := c.Param("id")
+	if !isValidUploadID(uploadID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload ID"})
+		return
+	}
+	username := c.GetString("username")
+	var session UploadSession
+	if err := utils.ReadJSON(uploadSessionFile(username, uploadID), &session); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if session.Username != username {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": session.progress()})
+}
+
+// GetUploads lists the user's unfinished uploads
+func GetUploads(c *gin.Context) {
+	progress := []UploadProgress{}
+	for _, s := range listUploadSessions(c.GetString("username")) {
+		progress = append(progress, s.progress())
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": progress})
+}
+
+// UploadAbort discards an upload and the chunks received so far
+func UploadAbort(c *gin.Context) {
+	uploadID := c.Param("id")
+	if !isValidUploadID(uploadID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload ID"})
+		return
+	}
+	username := c.GetString("username")
+	if _, err := os.Stat(uploadSessionFile(username, uploadID)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	removeUploadSession(username, uploadID)
+	broadcastRoom(uploadRoom(username), "transfer:aborted", map[string]interface{}{"uploadId": uploadID})
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// BindTransferHandlers lets clients follow their uploads, including ones
+// running on another device
+func BindTransferHandlers(server *socketio.Server) {
+	bindEvent(server, "transfer:subscribe", func(s socketio.Conn, msg interface{}) {
+		token, _ := parseTokenPayload(msg)
+		username, ok := validateSocketToken(token)
+		if !ok {
+			s.Emit("transfer:error", map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		s.Join(uploadRoom(username))
+		progress := []UploadProgress{}
+		for _, session := range listUploadSessions(username) {
+			progress = append(progress, session.progress())
+		}
+		s.Emit("transfer:uploads", progress)
+	})
+}
@@ -44,7 +44,12 @@ func ResolveWallpaper(c *gin.Context) {
 	if err != nil {
 		client = &http.Client{Timeout: 10 * time.Second}
 	}
-	resp, err := client.Head(parsed.String())
+	headReq, err := http.NewRequestWithContext(wallpaperContext(c.Request.Context(), parsed.Hostname()), "HEAD", parsed.String(), nil)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"url": req.URL})
+		return
+	}
+	resp, err := client.Do(headReq)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{"url": req.URL})
 		return
@@ -62,14 +67,13 @@ type WallpaperFetchRequest struct {
 }
 
 func FetchWallpaper(c *gin.Context) {
-	fmt.Println("DEBUG: FetchWallpaper called")
 	var req WallpaperFetchRequest
 	if err := c.BindJSON(&req); err != nil {
-		fmt.Printf("DEBUG: BindJSON error: %v\n", err)
+		wallpaperLog.Debug("Invalid wallpaper fetch request", "error", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
-	fmt.Printf("DEBUG: FetchWallpaper URL: %s, Type: %s\n", req.URL, req.Type)
+	wallpaperLog.Debug("Fetching wallpaper", "url", req.URL, "type", req.Type)
 
 	parsed, err := url.Parse(req.URL)
 	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
@@ -86,7 +90,12 @@ func FetchWallpaper(c *gin.Context) {
 	if err != nil {
 		client = &http.Client{Timeout: 30 * time.Second}
 	}
-	resp, err := client.Get(req.URL)
+	getReq, err := http.NewRequestWithContext(wallpaperContext(c.Request.Context(), parsed.Hostname()), "GET", req.URL, nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid URL"})
+		return
+	}
+	resp, err := client.Do(getReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download image"})
 		return
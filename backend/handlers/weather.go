@@ -112,7 +112,7 @@ type AmapResponse struct {
 }
 
 func BindWeatherHandlers(server *socketio.Server) {
-	server.OnEvent("/", "weather:fetch", func(s socketio.Conn, msg WeatherPayload) {
+	bindEvent(server, "weather:fetch", func(s socketio.Conn, msg WeatherPayload) {
 		payload := normalizeWeatherPayload(msg)
 		if strings.TrimSpace(payload.City) == "" {
 			s.Emit("weather:error", gin.H{"city": msg.City, "error": "city is required"})
@@ -376,13 +376,13 @@ func refreshWeatherAsync(server *socketio.Server, p WeatherPayload) {
 		return
 	}
 	_ = sharedWidgetCache.Set(widgetCacheKindWeather, buildWeatherCacheKey(p), data, weatherTTL(p), "ok")
-	server.BroadcastToNamespace("/", "weather:data", gin.H{"city": p.City, "data": data})
+	broadcastAll("weather:data", gin.H{"city": p.City, "data": data})
 }
 
 func fetchOpenMeteo(city string) (*WeatherData, error) {
 	// 1. Geocoding
 	geoURL := fmt.Sprintf("https://geocoding-api.open-meteo.com/v1/search?name=%s&count=10&language=zh&format=json", url.QueryEscape(city))
-	fmt.Printf("[Weather] Geocoding: %s\n", geoURL)
+	weatherLog.Debug("Geocoding", "url", geoURL)
 
 	client, err := getSharedProxyClient()
 	if err != nil {
@@ -439,12 +439,12 @@ func fetchOpenMeteo(city string) (*WeatherData, error) {
 	if strings.EqualFold(cityName, bestMatch.Country) ||
 		strings.EqualFold(cityName, "China") ||
 		strings.EqualFold(cityName, "中国") {
-		fmt.Printf("[Weather] Warning: Geocoding resolved to country-level name '%s' for input '%s'\n", cityName, city)
+		weatherLog.Warn("Geocoding resolved to a country-level name", "name", cityName, "city", city)
 	}
 
 	// 2. Weather Data
 	weatherURL := fmt.Sprintf("https://api.open-meteo.com/v1/forecast?latitude=%f&longitude=%f&current=temperature_2m,relative_humidity_2m,weather_code&daily=weather_code,temperature_2m_max,temperature_2m_min&timezone=auto", lat, lon)
-	fmt.Printf("[Weather] Fetching OpenMeteo: %s\n", weatherURL)
+	weatherLog.Debug("Fetching OpenMeteo", "url", weatherURL)
 
 	respWeather, err := client.Get(weatherURL)
 	if err != nil {
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+)
+
+// The shares are served over WebDAV at /dav/<share>/<path> when the system
+// config enables it, for desktops and phones to mount. Clients log in with
+// HTTP Basic auth: the account password, or an API token as the password
+// for accounts with two-factor login. The files permission is required,
+// and read-only API tokens and shares refuse writes. Deleting moves items
+// to the recycle bin, as in the file browser.
+
+const (
+	davPrefix          = "/dav"
+	davAuthCacheTTL    = 5 * time.Minute
+	davMaxAuthFailures = 10
+	davAuthFailureWait = 15 * time.Minute
+)
+
+var (
+	davLocks    = webdav.NewMemLS()
+	davAttempts = newAttemptLimiter(davMaxAuthFailures, davAuthFailureWait)
+	// Clients send the password with every request; checking a bcrypt
+	// hash each time would make a folder listing crawl
+	davAuthCache sync.Map // sha256 of user and password -> davAuthEntry
+)
+
+type davAuthEntry struct {
+	username string
+	expiry   time.Time
+}
+
+// forgetDavAuth drops the cached logins of username, so an old password
+// stops working as soon as it is changed
+func forgetDavAuth(username string) {
+	davAuthCache.Range(func(key, value interface{}) bool {
+		if value.(davAuthEntry).username == username {
+			davAuthCache.Delete(key)
+		}
+		return true
+	})
+}
+
+// davReadMethods do not change anything
+var davReadMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true, "PROPFIND": true,
+}
+
+// DavReadMethod reports whether a WebDAV method only reads. Writes are
+// audited; reads would flood the audit log.
+func DavReadMethod(method string) bool {
+	return davReadMethods[method]
+}
+
+func webdavEnabled() bool {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	return sysConfig.EnableWebDAV
+}
+
+// davAuthenticate returns the account of a request's Basic credentials.
+// writable is false for API tokens without the write scope.
+func davAuthenticate(r *http.Request) (username string, writable, ok bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username == "" || password == "" {
+		return "", false, false
+	}
+	if writable, ok = passwordLogin(username, password); !ok {
+		return "", false, false
+	}
+	return username, writable, true
+}
+
+// passwordLogin checks the password or API token of clients that send it
+// with every request, WebDAV and Subsonic apps. Passwords that passed are
+// remembered for davAuthCacheTTL, so bcrypt does not run for each one.
+func passwordLogin(username, password string) (writable, ok bool) {
+	if middleware.IsApiToken(password) {
+		token, found := middleware.LookupApiToken(password)
+		if !found || token.Username != username {
+			return false, false
+		}
+		return middleware.TokenHasScope(token, middleware.ScopeWrite), true
+	}
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+	if entry, found := davAuthCache.Load(key); found && time.Now().Before(entry.(davAuthEntry).expiry) {
+		return true, true
+	}
+	if !checkAccountPassword(username, password) {
+		return false, false
+	}
+	davAuthCache.Store(key, davAuthEntry{username: username, expiry: time.Now().Add(davAuthCacheTTL)})
+	return true, true
+}
+
+// ServeWebDAV answers every request under /dav
+func ServeWebDAV(c *gin.Context) {
+	if !webdavEnabled() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	ip := c.ClientIP()
+	if davAttempts.locked(ip) {
+		c.Status(http.StatusTooManyRequests)
+		return
+	}
+	username, writable, ok := davAuthenticate(c.Request)
+	if !ok {
+		if user, _, sent := c.Request.BasicAuth(); sent {
+			davAttempts.failed(ip)
+			middleware.RecordAudit(models.AuditEntry{User: user, IP: ip, Action: "login.dav"})
+		}
+		c.Header("WWW-Authenticate", `Basic realm="FlatNas", charset="UTF-8"`)
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	if !middleware.Can(middleware.RoleOf(username), middleware.PermFiles) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	c.Set("username", username)
+	c.Set("auditTarget", c.Request.Method+" "+strings.TrimPrefix(c.Request.URL.Path, davPrefix))
+	fsys := &shareFS{username: username}
+	if !davReadMethods[c.Request.Method] {
+		// The webdav package answers most file system errors of a write
+		// with 404; refuse up front what would fail. A copy only reads its
+		// source, its destination is checked as it is written.
+		share, _, err := fsys.resolve(strings.TrimPrefix(c.Request.URL.Path, davPrefix))
+		if !writable || (err == nil && share.ReadOnly && c.Request.Method != "COPY") {
+			c.Status(http.StatusForbidden)
+			return
+		}
+	}
+	h := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: fsys,
+		LockSystem: davLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				filesLog.Debug("WebDAV request failed", "method", r.Method, "path", r.URL.Path, "user", username, "error", err)
+			}
+		},
+	}
+	h.ServeHTTP(c.Writer, c.Request)
+}
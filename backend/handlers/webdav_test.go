@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestWebDAV(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+
+	root, archive := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(archive, "old.txt"), []byte("old"), 0644)
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("secret"), 4)
+	utils.WriteJSON(filepath.Join(config.UsersDir, "alice.json"), models.User{Username: "alice", Password: string(hashed)})
+	sysConfig := models.SystemConfig{Shares: []models.FileShare{{Name: "main", Path: root}, {Name: "archive", Path: archive, ReadOnly: true}}}
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+
+	r := gin.New()
+	for _, method := range []string{"GET", "PUT", "DELETE", "PROPFIND", "MKCOL"} {
+		r.Handle(method, "/dav/*path", ServeWebDAV)
+	}
+	do := func(method, target, password, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if password != "" {
+			req.SetBasicAuth("alice", password)
+		}
+		req.Header.Set("Depth", "1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("PROPFIND", "/dav/", "secret", ""); w.Code != 404 {
+		t.Fatalf("expected WebDAV off by default, got %d", w.Code)
+	}
+	sysConfig.EnableWebDAV = true
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+
+	if w := do("PROPFIND", "/dav/", "", ""); w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected a Basic challenge, got %d", w.Code)
+	}
+	if w := do("PROPFIND", "/dav/", "wrong", ""); w.Code != 401 {
+		t.Fatalf("expected a wrong password to fail, got %d", w.Code)
+	}
+	w := do("PROPFIND", "/dav/", "secret", "")
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "/dav/main/") || !strings.Contains(w.Body.String(), "/dav/archive/") {
+		t.Fatalf("expected the shares listed, got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := do("MKCOL", "/dav/main/docs", "secret", ""); w.Code != http.StatusCreated {
+		t.Fatalf("mkcol failed: %d", w.Code)
+	}
+	if w := do("PUT", "/dav/main/docs/a.txt", "secret", "hello"); w.Code != http.StatusCreated {
+		t.Fatalf("put failed: %d", w.Code)
+	}
+	if w := do("GET", "/dav/main/docs/a.txt", "secret", ""); w.Code != 200 || w.Body.String() != "hello" {
+		t.Fatalf("unexpected get %d %q", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/dav/archive/new.txt", "secret", "x"); w.Code != http.StatusForbidden {
+		t.Fatalf("expected a read-only share to refuse writes, got %d", w.Code)
+	}
+
+	// Deleting goes to the recycle bin, which stays hidden
+	if w := do("DELETE", "/dav/main/docs/a.txt", "secret", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete failed: %d", w.Code)
+	}
+	if items := listTrash(models.FileShare{Name: "main", Path: root}); len(items) != 1 || items[0].DeletedBy != "alice" {
+		t.Fatalf("expected the file in the bin, got %+v", items)
+	}
+	if w := do("PROPFIND", "/dav/main/", "secret", ""); strings.Contains(w.Body.String(), ".trash") {
+		t.Fatalf("expected the bin hidden, got %s", w.Body.String())
+	}
+	if w := do("GET", "/dav/main/.trash/info/", "secret", ""); w.Code != 404 {
+		t.Fatalf("expected the bin unreachable, got %d", w.Code)
+	}
+
+	// A new password takes effect at once despite the login cache
+	reset := gin.New()
+	reset.POST("/admin/users/:usr/password", func(c *gin.Context) { c.Set("username", "admin") }, ResetUserPassword)
+	reset.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/users/alice/password", strings.NewReader(`{"password":"changed"}`)))
+	if w := do("PROPFIND", "/dav/", "secret", ""); w.Code != 401 {
+		t.Fatalf("expected the old password to stop working, got %d", w.Code)
+	}
+	if w := do("PROPFIND", "/dav/", "changed", ""); w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected the new password to work, got %d", w.Code)
+	}
+
+	// An account required to set up two-factor is held back like at /login,
+	// cached login or not
+	require := gin.New()
+	require.POST("/admin/users/:usr/2fa", func(c *gin.Context) { c.Set("username", "admin") }, SetUserTwoFactor)
+	if w := serve(require, "POST", "/admin/users/alice/2fa", `{"action":"require"}`); w.Code != 200 {
+		t.Fatalf("require failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PROPFIND", "/dav/", "changed", ""); w.Code != 401 {
+		t.Fatalf("expected the password refused until enrollment, got %d", w.Code)
+	}
+}
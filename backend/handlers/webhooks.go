@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Events a webhook can subscribe to. "*" subscribes to all of them.
+const (
+	WebhookRssAlert          = "rss.alert"          // An RSS alert rule matched new items
+	WebhookDiskAlert         = "disk.alert"         // A disk is nearly full or unhealthy
+	WebhookTransferCompleted = "transfer.completed" // An upload finished
+	WebhookLoginFailed       = "login.failed"       // A login attempt was rejected
+	WebhookIntegrityAlert    = "integrity.alert"    // A file changed without a new mtime
+	WebhookSyncFinished      = "sync.finished"      // A sync job run ended
+	WebhookQuotaWarning      = "quota.warning"      // A user or share crossed a quota threshold
+	WebhookVirusFound        = "virus.found"        // An upload or folder scan found malware
+	WebhookTest              = "webhook.test"       // Sent by the test button
+)
+
+const (
+	webhookTimeout       = 15 * time.Second
+	webhookMaxDeliveries = 100
+)
+
+// Wait before each attempt; a delivery is given up after the last one
+var webhookRetryDelays = []time.Duration{0, 10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute}
+
+// Webhook posts events to a URL, e.g. an n8n or Node-RED flow. Without a
+// template the body is the webhookEnvelope as JSON; a template is a Go
+// text/template over the envelope that must produce JSON. Requests carry
+// X-FlatNas-Signature-256: sha256=<hex HMAC of the body> when a secret is set.
+type Webhook struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Url      string            `json:"url"`
+	Events   []string          `json:"events"`
+	Secret   string            `json:"secret,omitempty"`
+	Template string            `json:"template,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Enable   bool              `json:"enable"`
+}
+
+type webhookEnvelope struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  int64       `json:"time"` // Unix timestamp in ms
+	Data  interface{} `json:"data"`
+}
+
+// WebhookDelivery is the state of one event sent to one webhook
+type WebhookDelivery struct {
+	ID         string `json:"id"`
+	WebhookID  string `json:"webhookId"`
+	Event      string `json:"event"`
+	Time       int64  `json:"time"` // Unix timestamp in ms
+	Attempts   int    `json:"attempts"`
+	Status     string `json:"status"` // pending, delivered or failed
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+var webhookDeliveries = struct {
+	sync.Mutex
+	list []*WebhookDelivery
+}{}
+
+var webhookHTTPClient = &http.Client{Timeout: webhookTimeout, Transport: newProxyTransport()}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func webhooksFile() string {
+	return filepath.Join(config.DataDir, "webhooks.json")
+}
+
+func loadWebhooks() []Webhook {
+	var hooks []Webhook
+	if err := utils.ReadJSON(webhooksFile(), &hooks); err != nil && !errors.Is(err, os.ErrNotExist) {
+		notifyLog.Warn("Failed to read webhooks", "error", err)
+	}
+	return hooks
+}
+
+func (w Webhook) wants(event string) bool {
+	if !w.Enable {
+		return false
+	}
+	for _, e := range w.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func randomHexID(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// renderWebhookBody builds the request body for an envelope
+func renderWebhookBody(w Webhook, env webhookEnvelope) ([]byte, error) {
+	if strings.TrimSpace(w.Template) == "" {
+		return json.Marshal(env)
+	}
+	tmpl, err := template.New("webhook").Funcs(webhookFuncs).Option("missingkey=zero").Parse(w.Template)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	// Templates see plain maps, so {{.data.title}} works like in JSON
+	var view map[string]interface{}
+	raw, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &view); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, view); err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template did not produce valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook makes one attempt. retry reports whether a later attempt may
+// succeed.
+func postWebhook(ctx context.Context, w Webhook, env webhookEnvelope, body []byte) (status int, retry bool, err error) {
+	ctx, cancel := context.WithTimeout(allowOutbound(ctx), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "FlatNas-Webhook")
+	req.Header.Set("X-FlatNas-Event", env.Event)
+	req.Header.Set("X-FlatNas-Delivery", env.ID)
+	if w.Secret != "" {
+		req.Header.Set("X-FlatNas-Signature-256", signWebhookBody(w.Secret, body))
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return resp.StatusCode, retry, fmt.Errorf("HTTP status %d", resp.StatusCode)
+}
+
+func trackWebhookDelivery(d *WebhookDelivery) {
+	webhookDeliveries.Lock()
+	webhookDeliveries.list = append(webhookDeliveries.list, d)
+	if len(webhookDeliveries.list) > webhookMaxDeliveries {
+		webhookDeliveries.list = webhookDeliveries.list[len(webhookDeliveries.list)-webhookMaxDeliveries:]
+	}
+	webhookDeliveries.Unlock()
+}
+
+func updateWebhookDelivery(d *WebhookDelivery, fn func(d *WebhookDelivery)) {
+	webhookDeliveries.Lock()
+	fn(d)
+	webhookDeliveries.Unlock()
+}
+
+// deliverWebhook sends env to w, retrying with webhookRetryDelays until it
+// succeeds, fails for good or the server shuts down
+func deliverWebhook(w Webhook, env webhookEnvelope) *WebhookDelivery {
+	d := &WebhookDelivery{ID: env.ID, WebhookID: w.ID, Event: env.Event, Time: env.Time, Status: "pending"}
+	trackWebhookDelivery(d)
+	body, err := renderWebhookBody(w, env)
+	if err != nil {
+		updateWebhookDelivery(d, func(d *WebhookDelivery) { d.Status, d.Error = "failed", err.Error() })
+		notifyLog.Warn("Webhook failed", "webhook", w.Name, "event", env.Event, "error", err)
+		return d
+	}
+	for i, delay := range webhookRetryDelays {
+		if delay > 0 {
+			select {
+			case <-backgroundCtx.Done():
+				updateWebhookDelivery(d, func(d *WebhookDelivery) { d.Status = "failed" })
+				return d
+			case <-time.After(delay):
+			}
+		}
+		done, ok := beginTask()
+		if !ok {
+			updateWebhookDelivery(d, func(d *WebhookDelivery) { d.Status = "failed" })
+			return d
+		}
+		status, retry, err := postWebhook(fetchCtx, w, env, body)
+		done()
+		updateWebhookDelivery(d, func(d *WebhookDelivery) {
+			d.Attempts = i + 1
+			d.StatusCode = status
+			d.Error = ""
+			if err != nil {
+				d.Error = err.Error()
+			}
+		})
+		if err == nil {
+			updateWebhookDelivery(d, func(d *WebhookDelivery) { d.Status = "delivered" })
+			return d
+		}
+		if !retry {
+			break
+		}
+	}
+	updateWebhookDelivery(d, func(d *WebhookDelivery) { d.Status = "failed" })
+	notifyLog.Warn("Webhook failed", "webhook", w.Name, "event", env.Event, "error", d.Error)
+	return d
+}
+
+// fireWebhook sends an event to every webhook subscribed to it. Delivery
+// runs in the background so callers never wait on slow receivers.
+func fireWebhook(event string, data interface{}) {
+	for _, w := range loadWebhooks() {
+		if !w.wants(event) {
+			continue
+		}
+		env := webhookEnvelope{ID: randomHexID(8), Event: event, Time: time.Now().UnixMilli(), Data: data}
+		go deliverWebhook(w, env)
+	}
+}
+
+// StartWebhooks connects webhooks to events raised outside this package
+func StartWebhooks() {
+	middleware.OnAudit(func(e models.AuditEntry) {
+		if e.Success || (e.Action != "login" && !strings.HasPrefix(e.Action, "login.")) {
+			return
+		}
+		fireWebhook(WebhookLoginFailed, map[string]interface{}{
+			"user":   e.User,
+			"ip":     e.IP,
+			"method": e.Action,
+		})
+	})
+}
+
+// GetWebhooks lists the webhooks. Secrets are never returned.
+func GetWebhooks(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	hooks := loadWebhooks()
+	list := make([]gin.H, 0, len(hooks))
+	for _, w := range hooks {
+		list = append(list, gin.H{
+			"id":        w.ID,
+			"name":      w.Name,
+			"url":       w.Url,
+			"events":    w.Events,
+			"template":  w.Template,
+			"headers":   w.Headers,
+			"enable":    w.Enable,
+			"hasSecret": w.Secret != "",
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": list})
+}
+
+// SaveWebhook creates a webhook, or updates the one with the given id. An
+// empty secret keeps the stored one.
+func SaveWebhook(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	var req Webhook
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	req.Url = strings.TrimSpace(req.Url)
+	if u, err := url.Parse(req.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook url"})
+		return
+	}
+	if len(req.Events) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Select at least one event"})
+		return
+	}
+	// Catch template mistakes now rather than at the first event
+	sample := webhookEnvelope{ID: "sample", Event: WebhookTest, Time: time.Now().UnixMilli(), Data: map[string]interface{}{}}
+	if _, err := renderWebhookBody(req, sample); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var hooks []Webhook
+	err := utils.UpdateJSON(webhooksFile(), &hooks, func() error {
+		if req.ID == "" {
+			req.ID = randomHexID(6)
+			hooks = append(hooks, req)
+			return nil
+		}
+		for i := range hooks {
+			if hooks[i].ID == req.ID {
+				if req.Secret == "" {
+					req.Secret = hooks[i].Secret
+				}
+				hooks[i] = req
+				return nil
+			}
+		}
+		return os.ErrNotExist
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save webhook"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "id": req.ID})
+}
+
+// DeleteWebhook removes a webhook
+func DeleteWebhook(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	id := c.Param("id")
+	var hooks []Webhook
+	found := false
+	err := utils.UpdateJSON(webhooksFile(), &hooks, func() error {
+		kept := hooks[:0]
+		for _, w := range hooks {
+			if w.ID == id {
+				found = true
+				continue
+			}
+			kept = append(kept, w)
+		}
+		hooks = kept
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// TestWebhook sends a webhook.test event once, without retries, and reports
+// the result
+func TestWebhook(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	id := c.Param("id")
+	for _, w := range loadWebhooks() {
+		if w.ID != id {
+			continue
+		}
+		env := webhookEnvelope{
+			ID:    randomHexID(8),
+			Event: WebhookTest,
+			Time:  time.Now().UnixMilli(),
+			Data:  map[string]interface{}{"message": "Test event from FlatNas"},
+		}
+		body, err := renderWebhookBody(w, env)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		status, _, err := postWebhook(c.Request.Context(), w, env, body)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "statusCode": status})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "statusCode": status})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+}
+
+// GetWebhookDeliveries returns the most recent deliveries, newest first
+func GetWebhookDeliveries(c *gin.Context) {
+	if c.GetString("username") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	webhookDeliveries.Lock()
+	list := make([]WebhookDelivery, 0, len(webhookDeliveries.list))
+	for i := len(webhookDeliveries.list) - 1; i >= 0; i-- {
+		list = append(list, *webhookDeliveries.list[i])
+	}
+	webhookDeliveries.Unlock()
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": list})
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	prevDelays := webhookRetryDelays
+	webhookRetryDelays = []time.Duration{0, time.Millisecond, time.Millisecond}
+	defer func() { webhookRetryDelays = prevDelays }()
+
+	var attempts int
+	var body []byte
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get("X-FlatNas-Signature-256")
+	}))
+	defer srv.Close()
+
+	hook := Webhook{
+		ID:       "h1",
+		Name:     "n8n",
+		Url:      srv.URL,
+		Events:   []string{WebhookLoginFailed},
+		Secret:   "k",
+		Template: `{"text": {{json (printf "Failed login for %s" .data.user)}}, "event": "{{.event}}"}`,
+		Enable:   true,
+	}
+	env := webhookEnvelope{ID: "d1", Event: WebhookLoginFailed, Time: 1, Data: map[string]interface{}{"user": "bob"}}
+	d := deliverWebhook(hook, env)
+	if d.Status != "delivered" || d.Attempts != 2 {
+		t.Fatalf("delivery = %+v, want delivered on the second attempt", d)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(body, &got); err != nil || got["text"] != "Failed login for bob" || got["event"] != WebhookLoginFailed {
+		t.Fatalf("body = %s (%v)", body, err)
+	}
+	if signature != signWebhookBody("k", body) {
+		t.Fatalf("signature %q does not match the body", signature)
+	}
+
+	// Client errors are not retried
+	attempts = 0
+	hook.Url = srv.URL + "/gone"
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusNotFound)
+	})
+	if d := deliverWebhook(hook, env); d.Status != "failed" || attempts != 1 {
+		t.Fatalf("delivery = %+v after %d attempts, want one failed attempt", d, attempts)
+	}
+
+	hook.Template = `{"broken": {{.event}}}`
+	if _, err := renderWebhookBody(hook, env); err == nil {
+		t.Fatalf("expected invalid JSON from template to be rejected")
+	}
+}
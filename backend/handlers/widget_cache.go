@@ -3,17 +3,22 @@ package handlers
 import (
 	"encoding/json"
 	"flatnasgo-backend/config"
-	"log"
-	"os"
-	"path/filepath"
+	"flatnasgo-backend/redis"
+	"flatnasgo-backend/store"
 	"sync"
 	"time"
 )
 
 const (
-	widgetCacheKindRSS     = "rss"
-	widgetCacheKindHot     = "hot"
-	widgetCacheKindWeather = "weather"
+	widgetCacheKindRSS        = "rss"
+	widgetCacheKindRSSMeta    = "rssMeta"
+	widgetCacheKindRSSHTTP    = "rssHttp"
+	widgetCacheKindRSSArticle = "rssArticle"
+	widgetCacheKindRSSHealth  = "rssHealth"
+	widgetCacheKindRSSSource  = "rssSource"
+	widgetCacheKindRSSIcon    = "rssIcon"
+	widgetCacheKindHot        = "hot"
+	widgetCacheKindWeather    = "weather"
 )
 
 type WidgetCacheItem struct {
@@ -23,61 +28,193 @@ type WidgetCacheItem struct {
 	SourceStatus string      `json:"sourceStatus"`
 }
 
-// WidgetCache manages the unified cache file
+const (
+	// widgetCacheSaveDelay coalesces bursts of Set calls (e.g. warmup) into a single write
+	widgetCacheSaveDelay = 2 * time.Second
+	// Items that went stale this long ago are dropped when the cache loads
+	widgetCacheStaleKeep = 7 * 24 * time.Hour
+)
+
+// WidgetCache manages the unified widget cache. The in-memory map is the
+// read path; changed items are written to the database shortly after, so
+// cached items and their TTL metadata survive restarts.
 type WidgetCache struct {
 	mu          sync.RWMutex
-	filePath    string
+	db          *store.Store
 	refreshLock sync.Mutex
 	refreshing  map[string]bool
+	saveMu      sync.Mutex
+	saveTimer   *time.Timer
 	// Structure: kind -> key -> item
 	cache map[string]map[string]*WidgetCacheItem
+	// Items changed since the last save, kind -> key
+	dirty map[string]map[string]bool
+	// Redis, when REDIS_URL is set; see widget_cache_shared.go
+	shared *redis.Client
 }
 
 var sharedWidgetCache = &WidgetCache{
 	cache:      make(map[string]map[string]*WidgetCacheItem),
+	dirty:      make(map[string]map[string]bool),
 	refreshing: make(map[string]bool),
 }
 
 func InitWidgetCache() {
-	sharedWidgetCache.filePath = filepath.Join(config.DataDir, "widget_cache.json")
+	sharedWidgetCache.db = config.Store
 	sharedWidgetCache.load()
+	sharedWidgetCache.openSharedCache()
 }
 
 func (c *WidgetCache) load() {
+	if c.db == nil {
+		return
+	}
+	entries, err := c.db.CacheEntries(widgetCacheStaleKeep)
+	if err != nil {
+		cacheLog.Error("Failed to read widget cache", "error", err)
+		return
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.cache = make(map[string]map[string]*WidgetCacheItem)
+	c.dirty = make(map[string]map[string]bool)
+	for _, e := range entries {
+		if c.cache[e.Kind] == nil {
+			c.cache[e.Kind] = make(map[string]*WidgetCacheItem)
+		}
+		c.cache[e.Kind][e.Key] = &WidgetCacheItem{
+			Data:         json.RawMessage(e.Data),
+			UpdatedAt:    e.UpdatedAt,
+			TTL:          e.TTL,
+			SourceStatus: e.Status,
+		}
+	}
+}
 
-	if _, err := os.Stat(c.filePath); os.IsNotExist(err) {
+// markDirty records a changed item for the next save; c.mu must be held
+func (c *WidgetCache) markDirty(kind, key string) {
+	if c.dirty[kind] == nil {
+		c.dirty[kind] = make(map[string]bool)
+	}
+	c.dirty[kind][key] = true
+}
+
+// saveAsync schedules a write of the changed items, merging calls that
+// arrive within widgetCacheSaveDelay of each other.
+func (c *WidgetCache) saveAsync() {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	if c.saveTimer != nil {
 		return
 	}
+	c.saveTimer = time.AfterFunc(widgetCacheSaveDelay, func() {
+		c.saveMu.Lock()
+		c.saveTimer = nil
+		c.saveMu.Unlock()
+		c.save()
+	})
+}
 
-	data, err := os.ReadFile(c.filePath)
-	if err != nil {
-		log.Printf("Failed to read widget cache: %v", err)
+// Flush writes any pending changes to disk immediately
+func (c *WidgetCache) Flush() {
+	c.saveMu.Lock()
+	pending := c.saveTimer != nil && c.saveTimer.Stop()
+	c.saveTimer = nil
+	c.saveMu.Unlock()
+	if pending {
+		c.save()
+	}
+}
+
+func (c *WidgetCache) save() {
+	if c.db == nil {
+		return
+	}
+	var put, remove []store.CacheEntry
+	c.mu.Lock()
+	dirty := c.dirty
+	c.dirty = make(map[string]map[string]bool)
+	for kind, keys := range dirty {
+		for key := range keys {
+			item := c.cache[kind][key]
+			if item == nil {
+				remove = append(remove, store.CacheEntry{Kind: kind, Key: key})
+				continue
+			}
+			data, err := json.Marshal(item.Data)
+			if err != nil {
+				cacheLog.Error("Failed to marshal widget cache item", "kind", kind, "error", err)
+				continue
+			}
+			put = append(put, store.CacheEntry{Kind: kind, Key: key, Data: data,
+				UpdatedAt: item.UpdatedAt, TTL: item.TTL, Status: item.SourceStatus})
+		}
+	}
+	c.mu.Unlock()
+	if len(put) == 0 && len(remove) == 0 {
 		return
 	}
 
-	if err := json.Unmarshal(data, &c.cache); err != nil {
-		log.Printf("Failed to unmarshal widget cache: %v", err)
+	if err := c.db.SaveCache(put, remove); err != nil {
+		cacheLog.Error("Failed to write widget cache", "error", err)
+		// Try again with the next save
+		c.mu.Lock()
+		for kind, keys := range dirty {
+			for key := range keys {
+				c.markDirty(kind, key)
+			}
+		}
+		c.mu.Unlock()
+		c.saveAsync()
 	}
 }
 
-func (c *WidgetCache) saveAsync() {
+// snapshot returns the cache as the JSON that widget_cache.json used to
+// hold, for backups
+func (c *WidgetCache) snapshot() ([]byte, error) {
 	c.mu.RLock()
-	data, err := json.MarshalIndent(c.cache, "", "  ")
-	c.mu.RUnlock()
+	defer c.mu.RUnlock()
+	return json.Marshal(c.cache)
+}
 
-	if err != nil {
-		log.Printf("Failed to marshal widget cache: %v", err)
-		return
+// restore replaces the cache with a snapshot
+func (c *WidgetCache) restore(data []byte) error {
+	cache := make(map[string]map[string]*WidgetCacheItem)
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return err
 	}
-
-	if err := os.WriteFile(c.filePath, data, 0644); err != nil {
-		log.Printf("Failed to write widget cache: %v", err)
+	c.mu.Lock()
+	for kind, items := range c.cache {
+		for key := range items {
+			c.markDirty(kind, key)
+		}
 	}
+	for kind, items := range cache {
+		for key := range items {
+			c.markDirty(kind, key)
+		}
+	}
+	c.cache = cache
+	c.mu.Unlock()
+	c.save()
+	return nil
+}
+
+func FlushWidgetCache() {
+	sharedWidgetCache.Flush()
 }
 
 func (c *WidgetCache) Get(kind, key string, out interface{}) (bool, bool, *WidgetCacheItem, error) {
+	if c.shared != nil {
+		item, ok, err := c.sharedGet(kind, key)
+		if err == nil {
+			if !ok {
+				return false, false, nil, nil
+			}
+			return readWidgetCacheItem(item, out)
+		}
+	}
+
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
@@ -90,7 +227,10 @@ func (c *WidgetCache) Get(kind, key string, out interface{}) (bool, bool, *Widge
 	if !ok {
 		return false, false, nil, nil
 	}
+	return readWidgetCacheItem(item, out)
+}
 
+func readWidgetCacheItem(item *WidgetCacheItem, out interface{}) (bool, bool, *WidgetCacheItem, error) {
 	// Check TTL
 	now := time.Now().UnixMilli()
 	isFresh := (now - item.UpdatedAt) < (item.TTL * 1000)
@@ -110,31 +250,101 @@ func (c *WidgetCache) Set(kind, key string, data interface{}, ttl time.Duration,
 		c.cache[kind] = make(map[string]*WidgetCacheItem)
 	}
 
-	c.cache[kind][key] = &WidgetCacheItem{
+	item := &WidgetCacheItem{
 		Data:         data,
 		UpdatedAt:    time.Now().UnixMilli(),
 		TTL:          int64(ttl.Seconds()),
 		SourceStatus: status,
 	}
+	c.cache[kind][key] = item
+	c.markDirty(kind, key)
 	c.mu.Unlock()
 
-	go c.saveAsync()
+	if c.shared != nil {
+		c.sharedPut(kind, key, item)
+	}
+
+	c.saveAsync()
 	return nil
 }
 
 func (c *WidgetCache) MarkStatus(kind, key, status string) error {
+	if c.shared != nil {
+		c.sharedUpdate(kind, key, func(item *WidgetCacheItem) { item.SourceStatus = status })
+	}
 	c.mu.Lock()
 	if c.cache[kind] == nil || c.cache[kind][key] == nil {
 		c.mu.Unlock()
 		return nil
 	}
 	c.cache[kind][key].SourceStatus = status
+	c.markDirty(kind, key)
 	c.mu.Unlock()
 
-	go c.saveAsync()
+	c.saveAsync()
 	return nil
 }
 
+// Touch renews an entry's TTL without replacing its data
+func (c *WidgetCache) Touch(kind, key string) bool {
+	touched := false
+	if c.shared != nil {
+		touched = c.sharedUpdate(kind, key, func(item *WidgetCacheItem) {
+			item.UpdatedAt = time.Now().UnixMilli()
+			item.SourceStatus = "ok"
+		})
+	}
+	c.mu.Lock()
+	if c.cache[kind] == nil || c.cache[kind][key] == nil {
+		c.mu.Unlock()
+		return touched
+	}
+	c.cache[kind][key].UpdatedAt = time.Now().UnixMilli()
+	c.cache[kind][key].SourceStatus = "ok"
+	c.markDirty(kind, key)
+	c.mu.Unlock()
+
+	c.saveAsync()
+	return true
+}
+
+// Expire marks an entry stale while keeping its data as a fallback
+func (c *WidgetCache) Expire(kind, key string) bool {
+	expired := false
+	if c.shared != nil {
+		expired = c.sharedUpdate(kind, key, func(item *WidgetCacheItem) { item.UpdatedAt = 0 })
+	}
+	c.mu.Lock()
+	if c.cache[kind] == nil || c.cache[kind][key] == nil {
+		c.mu.Unlock()
+		return expired
+	}
+	c.cache[kind][key].UpdatedAt = 0
+	c.markDirty(kind, key)
+	c.mu.Unlock()
+
+	c.saveAsync()
+	return true
+}
+
+func (c *WidgetCache) Delete(kind, key string) {
+	if c.shared != nil {
+		if err := c.shared.Del(sharedCacheKey(kind, key)); err != nil {
+			logSharedCacheError("delete", err)
+		}
+	}
+	c.mu.Lock()
+	if c.cache[kind] == nil || c.cache[kind][key] == nil {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.cache[kind], key)
+	c.markDirty(kind, key)
+	c.mu.Unlock()
+
+	c.saveAsync()
+}
+
 func (c *WidgetCache) StartRefresh(tag string) bool {
 	c.refreshLock.Lock()
 	defer c.refreshLock.Unlock()
@@ -142,6 +352,10 @@ func (c *WidgetCache) StartRefresh(tag string) bool {
 	if c.refreshing[tag] {
 		return false
 	}
+	// Another replica may be refreshing the same source
+	if c.shared != nil && !c.sharedLock(tag) {
+		return false
+	}
 	c.refreshing[tag] = true
 	return true
 }
@@ -150,4 +364,7 @@ func (c *WidgetCache) EndRefresh(tag string) {
 	c.refreshLock.Lock()
 	defer c.refreshLock.Unlock()
 	delete(c.refreshing, tag)
+	if c.shared != nil {
+		c.sharedUnlock(tag)
+	}
 }
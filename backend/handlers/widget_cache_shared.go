@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/redis"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With REDIS_URL set, replicas behind a load balancer share the widget
+// cache and refresh locks through Redis. The local map and its database
+// copy stay as a fallback for when Redis is unreachable.
+const (
+	sharedCachePrefix = "flatnas:cache:"
+	sharedLockPrefix  = "flatnas:refresh:"
+	// Expired entries are kept this long as a fallback for failing sources
+	sharedCacheStaleKeep = 7 * 24 * time.Hour
+	// A refresh lock outlives a crashed replica by at most this long
+	sharedLockTTL = 2 * time.Minute
+	// Redis errors are logged at most this often
+	sharedErrorLogEvery = time.Minute
+)
+
+var sharedCacheErrors struct {
+	sync.Mutex
+	last time.Time
+}
+
+// openSharedCache connects to REDIS_URL, once
+func (c *WidgetCache) openSharedCache() {
+	raw := strings.TrimSpace(os.Getenv("REDIS_URL"))
+	if raw == "" || c.shared != nil {
+		return
+	}
+	client, err := redis.Open(raw)
+	if err != nil {
+		cacheLog.Error("Redis unavailable, using the local cache only", "error", err)
+		return
+	}
+	c.shared = client
+	cacheLog.Info("Sharing the widget cache through Redis")
+}
+
+func sharedCacheKey(kind, key string) string {
+	return sharedCachePrefix + kind + ":" + key
+}
+
+func logSharedCacheError(op string, err error) {
+	sharedCacheErrors.Lock()
+	defer sharedCacheErrors.Unlock()
+	if time.Since(sharedCacheErrors.last) < sharedErrorLogEvery {
+		return
+	}
+	sharedCacheErrors.last = time.Now()
+	cacheLog.Warn("Redis cache operation failed, using the local cache", "op", op, "error", err)
+}
+
+// sharedGet reads an item from Redis. ok is false for a miss; err means
+// Redis could not answer and the caller should fall back to the local map.
+func (c *WidgetCache) sharedGet(kind, key string) (item *WidgetCacheItem, ok bool, err error) {
+	raw, found, err := c.shared.Get(sharedCacheKey(kind, key))
+	if err != nil {
+		logSharedCacheError("get", err)
+		return nil, false, err
+	}
+	if !found {
+		return nil, false, nil
+	}
+	item = &WidgetCacheItem{}
+	if err := json.Unmarshal(raw, item); err != nil {
+		return nil, false, nil
+	}
+	return item, true, nil
+}
+
+func (c *WidgetCache) sharedPut(kind, key string, item *WidgetCacheItem) {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+	ttl := time.Duration(item.TTL)*time.Second + sharedCacheStaleKeep
+	if err := c.shared.Set(sharedCacheKey(kind, key), raw, ttl); err != nil {
+		logSharedCacheError("set", err)
+	}
+}
+
+// sharedUpdate applies fn to the stored item and reports whether it existed
+func (c *WidgetCache) sharedUpdate(kind, key string, fn func(item *WidgetCacheItem)) bool {
+	item, ok, err := c.sharedGet(kind, key)
+	if err != nil || !ok {
+		return false
+	}
+	fn(item)
+	c.sharedPut(kind, key, item)
+	return true
+}
+
+// sharedLock takes the cluster wide refresh lock for tag. Without Redis,
+// or when it fails, the local lock alone decides.
+func (c *WidgetCache) sharedLock(tag string) bool {
+	ok, err := c.shared.SetNX(sharedLockPrefix+tag, []byte(instanceID()), sharedLockTTL)
+	if err != nil {
+		logSharedCacheError("lock", err)
+		return true
+	}
+	return ok
+}
+
+func (c *WidgetCache) sharedUnlock(tag string) {
+	if err := c.shared.Del(sharedLockPrefix + tag); err != nil {
+		logSharedCacheError("unlock", err)
+	}
+}
+
+var (
+	instanceIDOnce  sync.Once
+	instanceIDValue string
+)
+
+// instanceID names this replica in Redis locks
+func instanceID() string {
+	instanceIDOnce.Do(func() {
+		host, _ := os.Hostname()
+		instanceIDValue = host + "-" + randomHexID(4)
+	})
+	return instanceIDValue
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"flatnasgo-backend/store"
+	"testing"
+	"time"
+)
+
+func TestWidgetCachePersists(t *testing.T) {
+	db, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer db.Close()
+	newCache := func() *WidgetCache {
+		c := &WidgetCache{db: db, refreshing: make(map[string]bool)}
+		c.load()
+		return c
+	}
+
+	c := newCache()
+	c.Set(widgetCacheKindRSS, "https://a.example/feed", []UnifiedRssItem{{Guid: "1", Title: "A"}}, time.Hour, "ok")
+	c.Set(widgetCacheKindWeather, "Paris", map[string]int{"temp": 20}, time.Hour, "ok")
+	c.Flush()
+
+	c = newCache()
+	var items []UnifiedRssItem
+	has, fresh, _, err := c.Get(widgetCacheKindRSS, "https://a.example/feed", &items)
+	if !has || !fresh || err != nil || len(items) != 1 || items[0].Title != "A" {
+		t.Fatalf("expected the feed back after a reload: has=%v fresh=%v %+v %v", has, fresh, items, err)
+	}
+
+	c.Delete(widgetCacheKindWeather, "Paris")
+	c.Expire(widgetCacheKindRSS, "https://a.example/feed")
+	c.Flush()
+	c = newCache()
+	var weather map[string]int
+	if has, _, _, _ := c.Get(widgetCacheKindWeather, "Paris", &weather); has {
+		t.Fatalf("deleted item came back")
+	}
+	if has, fresh, _, _ := c.Get(widgetCacheKindRSS, "https://a.example/feed", &items); !has || fresh {
+		t.Fatalf("expired item should be kept stale: has=%v fresh=%v", has, fresh)
+	}
+
+	snapshot, err := c.snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	c.Set(widgetCacheKindHot, "weibo", []string{"x"}, time.Hour, "ok")
+	if err := c.restore(snapshot); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	c = newCache()
+	var hot []string
+	if has, _, _, _ := c.Get(widgetCacheKindHot, "weibo", &hot); has {
+		t.Fatalf("restore should replace the cache")
+	}
+	if has, _, _, _ := c.Get(widgetCacheKindRSS, "https://a.example/feed", &items); !has {
+		t.Fatalf("restored item missing")
+	}
+}
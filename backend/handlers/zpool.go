@@ -0,0 +1,568 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/i18n"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ZFS pools are read with zpool list and zpool status: health, capacity,
+// fragmentation, the devices and the last or running scrub or resilver.
+// Scrubs can be started by hand or on a schedule of every so many days,
+// counted from the end of the last one. The monitor alerts when a pool
+// leaves the ONLINE state, and again when it changes state after that.
+
+const (
+	poolCheckInterval   = time.Minute
+	scrubSchedulerTick  = time.Hour
+	scrubRetryAfter     = 6 * time.Hour // After a scheduled scrub failed to start
+	zpoolStatusTimeFmt  = "Mon Jan 2 15:04:05 2006"
+	zpoolHealthyState   = "ONLINE"
+	scrubMaxIntervalDay = 365
+)
+
+var (
+	errPoolNotFound = errors.New("Pool not found")
+	errPoolScanning = errors.New("The pool is already being scrubbed or resilvered")
+)
+
+var (
+	zpoolNameRe     = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.:-]{0,254}$`)
+	zpoolKeyRe      = regexp.MustCompile(`^\s{0,8}([a-z]+):(?:\s(.*))?$`)
+	zpoolDoneRe     = regexp.MustCompile(`^(scrub repaired|resilvered) (\S+) in (.+?) with (\d+) errors on (.+)$`)
+	zpoolRunningRe  = regexp.MustCompile(`^(scrub|resilver) (in progress|paused) since (.+)$`)
+	zpoolCanceledRe = regexp.MustCompile(`^(scrub|resilver) canceled on (.+)$`)
+	zpoolProgressRe = regexp.MustCompile(`([\d.]+)% done`)
+	zpoolToGoRe     = regexp.MustCompile(`(\S+) to go`)
+	zpoolRepairedRe = regexp.MustCompile(`(\S+) (?:repaired|resilvered),`)
+)
+
+// zpoolToolError is a zpool command that failed
+type zpoolToolError struct {
+	output string
+}
+
+func (e *zpoolToolError) Error() string { return "zpool failed: " + e.output }
+
+// Zpool is a ZFS pool
+type Zpool struct {
+	Name          string         `json:"name"`
+	Health        string         `json:"health"` // ONLINE, DEGRADED, FAULTED, ...
+	Size          int64          `json:"size"`
+	Allocated     int64          `json:"allocated"`
+	Free          int64          `json:"free"`
+	Capacity      int            `json:"capacity"`      // Percent used
+	Fragmentation int            `json:"fragmentation"` // Percent, -1 when unknown
+	Status        string         `json:"status,omitempty"`
+	Action        string         `json:"action,omitempty"`
+	Errors        string         `json:"errors,omitempty"`
+	Scan          *ZpoolScan     `json:"scan,omitempty"`
+	LastScrub     int64          `json:"lastScrub,omitempty"` // End of the last complete scrub, ms
+	Devices       []ZpoolDevice  `json:"devices"`
+	Schedule      *ScrubSchedule `json:"schedule,omitempty"`
+}
+
+// ZpoolScan is the last or running scrub or resilver of a pool
+type ZpoolScan struct {
+	Function string  `json:"function"` // scrub or resilver
+	State    string  `json:"state"`    // scanning, paused, finished or canceled
+	Start    int64   `json:"start,omitempty"`
+	End      int64   `json:"end,omitempty"`
+	Progress float64 `json:"progress"`
+	ToGo     string  `json:"toGo,omitempty"`
+	Repaired string  `json:"repaired,omitempty"`
+	Errors   int64   `json:"errors"`
+}
+
+// ZpoolDevice is a row of the config of zpool status; Depth 0 is the pool
+type ZpoolDevice struct {
+	Name     string `json:"name"`
+	Depth    int    `json:"depth"`
+	State    string `json:"state,omitempty"`
+	Read     int64  `json:"read"`
+	Write    int64  `json:"write"`
+	Checksum int64  `json:"checksum"`
+}
+
+// ScrubSchedule scrubs Pool every IntervalDays
+type ScrubSchedule struct {
+	Pool         string `json:"pool"`
+	IntervalDays int    `json:"intervalDays"`
+}
+
+// ScrubRequest starts or stops the scrub of a pool
+type ScrubRequest struct {
+	Pool string `json:"pool"`
+	Stop bool   `json:"stop,omitempty"`
+}
+
+// poolAlerted is the state last reported of each pool
+var poolAlerted = struct {
+	sync.Mutex
+	health map[string]string
+}{health: make(map[string]string)}
+
+// scrubAttempts are the scheduled scrubs that failed to start
+var scrubAttempts = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+func zpoolSettings() models.ZpoolSettings {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.Zpool == nil {
+		return models.ZpoolSettings{}
+	}
+	return *sysConfig.Zpool
+}
+
+// decodeZpoolSettings reads the "zpool" field of a system config update
+func decodeZpoolSettings(raw interface{}) (*models.ZpoolSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ZFS pool settings")
+	}
+	settings := &models.ZpoolSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("Invalid ZFS pool settings")
+	}
+	return settings, nil
+}
+
+func scrubSchedulesFile() string {
+	return filepath.Join(config.DataDir, "scrub-schedules.json")
+}
+
+func loadScrubSchedules() []ScrubSchedule {
+	var schedules []ScrubSchedule
+	_ = utils.ReadJSON(scrubSchedulesFile(), &schedules)
+	return schedules
+}
+
+func zpoolCommand(ctx context.Context, args ...string) (string, error) {
+	out, err := systemCommand(ctx, errNoZfs, "zpool", args...)
+	if err != nil && !errors.Is(err, errNoZfs) {
+		return "", &zpoolToolError{output: strings.TrimSpace(string(out))}
+	}
+	return string(out), err
+}
+
+// parseZpoolTime reads a time as zpool status prints it
+func parseZpoolTime(s string) int64 {
+	t, err := time.ParseInLocation(zpoolStatusTimeFmt, strings.Join(strings.Fields(s), " "), time.Local)
+	if err != nil {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// parseZpoolScan reads the scan: lines of zpool status
+func parseZpoolScan(lines []string) *ZpoolScan {
+	if len(lines) == 0 {
+		return nil
+	}
+	first := strings.TrimSpace(lines[0])
+	rest := strings.Join(lines[1:], " ")
+	var scan *ZpoolScan
+	if m := zpoolDoneRe.FindStringSubmatch(first); m != nil {
+		scan = &ZpoolScan{Function: "scrub", State: "finished", Progress: 100, Repaired: m[2], End: parseZpoolTime(m[5])}
+		if m[1] == "resilvered" {
+			scan.Function = "resilver"
+		}
+		scan.Errors, _ = strconv.ParseInt(m[4], 10, 64)
+		if d, err := parseZpoolDuration(m[3]); err == nil && scan.End > 0 {
+			scan.Start = scan.End - d.Milliseconds()
+		}
+	} else if m := zpoolRunningRe.FindStringSubmatch(first); m != nil {
+		scan = &ZpoolScan{Function: m[1], State: "scanning", Start: parseZpoolTime(m[3])}
+		if m[2] == "paused" {
+			scan.State = "paused"
+		}
+		if p := zpoolProgressRe.FindStringSubmatch(rest); p != nil {
+			scan.Progress, _ = strconv.ParseFloat(p[1], 64)
+		}
+		if p := zpoolToGoRe.FindStringSubmatch(rest); p != nil {
+			scan.ToGo = p[1]
+		}
+		if p := zpoolRepairedRe.FindStringSubmatch(rest); p != nil {
+			scan.Repaired = p[1]
+		}
+	} else if m := zpoolCanceledRe.FindStringSubmatch(first); m != nil {
+		scan = &ZpoolScan{Function: m[1], State: "canceled", End: parseZpoolTime(m[2])}
+	}
+	return scan
+}
+
+// parseZpoolDuration reads the length of a scan, e.g. 00:10:15 or
+// 1 days 02:03:04
+func parseZpoolDuration(s string) (time.Duration, error) {
+	var days, h, m, sec int
+	if d, rest, ok := strings.Cut(s, " days "); ok {
+		n, err := strconv.Atoi(d)
+		if err != nil {
+			return 0, err
+		}
+		days, s = n, rest
+	}
+	if _, err := fmt.Sscanf(s, "%d:%d:%d", &h, &m, &sec); err != nil {
+		return 0, err
+	}
+	return time.Duration(days*24+h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second, nil
+}
+
+// parseZpoolStatus fills a pool from the output of zpool status -p
+func parseZpoolStatus(out string, pool *Zpool) {
+	sections := make(map[string][]string)
+	var key string
+	for _, line := range strings.Split(out, "\n") {
+		if m := zpoolKeyRe.FindStringSubmatch(line); m != nil && !strings.HasPrefix(line, "\t") {
+			key = m[1]
+			if m[2] != "" {
+				sections[key] = append(sections[key], m[2])
+			}
+			continue
+		}
+		if key != "" && strings.TrimSpace(line) != "" {
+			sections[key] = append(sections[key], line)
+		}
+	}
+	join := func(k string) string {
+		parts := make([]string, 0, len(sections[k]))
+		for _, l := range sections[k] {
+			parts = append(parts, strings.TrimSpace(l))
+		}
+		return strings.Join(parts, " ")
+	}
+	if state := join("state"); state != "" {
+		pool.Health = state
+	}
+	pool.Status, pool.Action, pool.Errors = join("status"), join("action"), join("errors")
+	pool.Scan = parseZpoolScan(sections["scan"])
+	if pool.Scan != nil && pool.Scan.Function == "scrub" && pool.Scan.State == "finished" {
+		pool.LastScrub = pool.Scan.End
+	}
+	pool.Devices = []ZpoolDevice{}
+	for _, line := range sections["config"] {
+		// Rows are a tab, then two spaces per level
+		row := strings.TrimPrefix(line, "\t")
+		fields := strings.Fields(row)
+		if len(fields) == 0 || fields[0] == "NAME" {
+			continue
+		}
+		dev := ZpoolDevice{Name: fields[0], Depth: (len(row) - len(strings.TrimLeft(row, " "))) / 2}
+		if len(fields) > 1 {
+			dev.State = fields[1]
+		}
+		if len(fields) > 4 {
+			dev.Read, _ = strconv.ParseInt(fields[2], 10, 64)
+			dev.Write, _ = strconv.ParseInt(fields[3], 10, 64)
+			dev.Checksum, _ = strconv.ParseInt(fields[4], 10, 64)
+		}
+		pool.Devices = append(pool.Devices, dev)
+	}
+}
+
+// listPools reads every pool with its status
+func listPools(ctx context.Context) ([]Zpool, error) {
+	out, err := zpoolCommand(ctx, "list", "-H", "-p", "-o", "name,size,allocated,free,fragmentation,capacity,health")
+	if err != nil {
+		return nil, err
+	}
+	schedules := make(map[string]ScrubSchedule)
+	for _, s := range loadScrubSchedules() {
+		schedules[s.Pool] = s
+	}
+	pools := []Zpool{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			continue
+		}
+		pool := Zpool{Name: fields[0], Health: fields[6], Fragmentation: -1, Devices: []ZpoolDevice{}}
+		pool.Size, _ = strconv.ParseInt(fields[1], 10, 64)
+		pool.Allocated, _ = strconv.ParseInt(fields[2], 10, 64)
+		pool.Free, _ = strconv.ParseInt(fields[3], 10, 64)
+		if frag, err := strconv.Atoi(strings.TrimSuffix(fields[4], "%")); err == nil {
+			pool.Fragmentation = frag
+		}
+		pool.Capacity, _ = strconv.Atoi(strings.TrimSuffix(fields[5], "%"))
+		if s, ok := schedules[pool.Name]; ok {
+			pool.Schedule = &s
+		}
+		status, err := zpoolCommand(ctx, "status", "-p", pool.Name)
+		if err != nil {
+			return nil, err
+		}
+		parseZpoolStatus(status, &pool)
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+func findPool(ctx context.Context, name string) (Zpool, error) {
+	if !zpoolNameRe.MatchString(name) {
+		return Zpool{}, errPoolNotFound
+	}
+	pools, err := listPools(ctx)
+	if err != nil {
+		return Zpool{}, err
+	}
+	for _, p := range pools {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return Zpool{}, errPoolNotFound
+}
+
+// scanning is true while a scrub or resilver runs or is paused
+func (p Zpool) scanning() bool {
+	return p.Scan != nil && (p.Scan.State == "scanning" || p.Scan.State == "paused")
+}
+
+// checkPools alerts on the pools that left the ONLINE state or changed
+// state since
+func checkPools(ctx context.Context) {
+	pools, err := listPools(ctx)
+	if err != nil {
+		if !errors.Is(err, errNoZfs) {
+			diskLog.Error("Reading ZFS pools failed", "error", err)
+		}
+		return
+	}
+	poolAlerted.Lock()
+	defer poolAlerted.Unlock()
+	seen := make(map[string]bool, len(pools))
+	for _, p := range pools {
+		seen[p.Name] = true
+		last, known := poolAlerted.health[p.Name]
+		if p.Health != zpoolHealthyState && (!known || last != p.Health) {
+			raisePoolAlert(p)
+		}
+		poolAlerted.health[p.Name] = p.Health
+	}
+	for name := range poolAlerted.health {
+		if !seen[name] {
+			delete(poolAlerted.health, name)
+		}
+	}
+}
+
+func raisePoolAlert(p Zpool) {
+	locale := notifyLocale()
+	var lines, devices []string
+	if p.Status != "" {
+		lines = append(lines, p.Status)
+	}
+	for _, d := range p.Devices {
+		if d.Depth > 0 && d.State != "" && d.State != zpoolHealthyState && d.State != "AVAIL" && d.State != "INUSE" {
+			devices = append(devices, d.Name+" "+d.State)
+		}
+	}
+	if len(devices) > 0 {
+		lines = append(lines, i18n.T(locale, "notify_pool_devices", strings.Join(devices, ", ")))
+	}
+	diskLog.Warn("ZFS pool unhealthy", "pool", p.Name, "health", p.Health, "devices", devices)
+	sendNotification(backgroundCtx, Notification{
+		Title:  i18n.T(locale, "notify_pool_alert", p.Name, p.Health),
+		Body:   strings.Join(lines, "\n"),
+		Source: "zpool",
+	}, zpoolSettings().Channels)
+	fireWebhook(WebhookDiskAlert, map[string]interface{}{
+		"pool":    p.Name,
+		"health":  p.Health,
+		"status":  p.Status,
+		"devices": devices,
+	})
+}
+
+// StartPoolMonitor watches the health of the ZFS pools
+func StartPoolMonitor() {
+	go func() {
+		ticker := time.NewTicker(poolCheckInterval)
+		defer ticker.Stop()
+		beat := registerWorker("zpool.monitor", poolCheckInterval)
+		for {
+			beat()
+			checkPools(backgroundCtx)
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runScrubSchedules starts the scrubs that are due: the last one ended
+// IntervalDays ago, or none is known
+func runScrubSchedules(ctx context.Context, now time.Time) {
+	schedules := loadScrubSchedules()
+	if len(schedules) == 0 {
+		return
+	}
+	pools, err := listPools(ctx)
+	if err != nil {
+		if !errors.Is(err, errNoZfs) {
+			diskLog.Warn("Reading ZFS pools failed", "error", err)
+		}
+		return
+	}
+	byName := make(map[string]Zpool, len(pools))
+	for _, p := range pools {
+		byName[p.Name] = p
+	}
+	for _, s := range schedules {
+		p, ok := byName[s.Pool]
+		if !ok || s.IntervalDays <= 0 || p.scanning() {
+			continue
+		}
+		last := p.LastScrub
+		if p.Scan != nil && p.Scan.Function == "scrub" && p.Scan.End > last {
+			last = p.Scan.End // A canceled scrub waits for the next turn too
+		}
+		if now.Sub(time.UnixMilli(last)) < time.Duration(s.IntervalDays)*24*time.Hour {
+			continue
+		}
+		scrubAttempts.Lock()
+		failed, retried := scrubAttempts.last[p.Name]
+		scrubAttempts.Unlock()
+		if retried && now.Sub(failed) < scrubRetryAfter {
+			continue
+		}
+		if _, err := zpoolCommand(ctx, "scrub", p.Name); err != nil {
+			diskLog.Warn("Scheduled scrub failed", "pool", p.Name, "error", err)
+			scrubAttempts.Lock()
+			scrubAttempts.last[p.Name] = now
+			scrubAttempts.Unlock()
+			continue
+		}
+		scrubAttempts.Lock()
+		delete(scrubAttempts.last, p.Name)
+		scrubAttempts.Unlock()
+		diskLog.Info("Scheduled scrub started", "pool", p.Name)
+	}
+}
+
+// StartScrubScheduler runs the scrub schedules
+func StartScrubScheduler() {
+	go func() {
+		ticker := time.NewTicker(scrubSchedulerTick)
+		defer ticker.Stop()
+		beat := registerWorker("zpool.scrub", scrubSchedulerTick)
+		for {
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case now := <-ticker.C:
+				beat()
+				runScrubSchedules(backgroundCtx, now)
+			}
+		}
+	}()
+}
+
+func poolError(c *gin.Context, err error) {
+	var toolErr *zpoolToolError
+	switch {
+	case errors.As(err, &toolErr):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Pool operation failed", "details": toolErr.output})
+	case errors.Is(err, errPoolNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errPoolScanning):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoZfs):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		diskLog.Error("Pool operation failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Pool operation failed"})
+	}
+}
+
+// GetPools lists the ZFS pools with their health, scan and schedule
+func GetPools(c *gin.Context) {
+	pools, err := listPools(c.Request.Context())
+	if err != nil {
+		poolError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": pools})
+}
+
+// ScrubPool starts the scrub of a pool, or stops the running one
+func ScrubPool(c *gin.Context) {
+	var req ScrubRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	pool, err := findPool(c.Request.Context(), req.Pool)
+	if err == nil && !req.Stop && pool.scanning() {
+		err = errPoolScanning
+	}
+	if err != nil {
+		poolError(c, err)
+		return
+	}
+	args := []string{"scrub", pool.Name}
+	if req.Stop {
+		args = []string{"scrub", "-s", pool.Name}
+	}
+	if _, err := zpoolCommand(c.Request.Context(), args...); err != nil {
+		poolError(c, err)
+		return
+	}
+	diskLog.Info("Scrub", "pool", pool.Name, "stop", req.Stop)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// SaveScrubSchedule sets the scrub schedule of a pool; an interval of 0
+// removes it
+func SaveScrubSchedule(c *gin.Context) {
+	var req ScrubSchedule
+	if err := c.ShouldBindJSON(&req); err != nil || req.IntervalDays < 0 || req.IntervalDays > scrubMaxIntervalDay {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if _, err := findPool(c.Request.Context(), req.Pool); err != nil {
+		poolError(c, err)
+		return
+	}
+	var schedules []ScrubSchedule
+	err := utils.UpdateJSON(scrubSchedulesFile(), &schedules, func() error {
+		kept := schedules[:0]
+		for _, s := range schedules {
+			if s.Pool != req.Pool {
+				kept = append(kept, s)
+			}
+		}
+		if req.IntervalDays > 0 {
+			kept = append(kept, req)
+		}
+		schedules = kept
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
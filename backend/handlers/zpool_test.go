@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testZpoolDegraded = `  pool: tank
+ state: DEGRADED
+status: One or more devices could not be used because the label is missing or
+	invalid.  Sufficient replicas exist for the pool to continue
+	functioning in a degraded state.
+action: Replace the device using 'zpool replace'.
+   see: https://openzfs.github.io/openzfs-docs/msg/ZFS-8000-4J
+  scan: resilver in progress since Sun Oct 11 10:00:00 2026
+	1.23T scanned at 1.02G/s, 512G issued at 425M/s, 3.50T total
+	500G resilvered, 14.29% done, 02:03:04 to go
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	tank        DEGRADED     0     0     0
+	  raidz1-0  DEGRADED     0     0     0
+	    sda     ONLINE       0     0     0
+	    sdb     UNAVAIL      3     1     0  was /dev/sdb1
+	    sdc     ONLINE       0     0     2
+	spares
+	  sdd       AVAIL
+
+errors: No known data errors
+`
+
+const testZpoolScrubbed = `  pool: tank
+ state: ONLINE
+  scan: scrub repaired 0B in 1 days 02:00:00 with 0 errors on Sun Oct  4 02:00:00 2026
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	tank        ONLINE       0     0     0
+	  mirror-0  ONLINE       0     0     0
+	    sda     ONLINE       0     0     0
+	    sdb     ONLINE       0     0     0
+
+errors: No known data errors
+`
+
+func TestParseZpoolStatus(t *testing.T) {
+	var pool Zpool
+	parseZpoolStatus(testZpoolDegraded, &pool)
+	if pool.Health != "DEGRADED" || !strings.HasPrefix(pool.Status, "One or more devices") || !strings.HasSuffix(pool.Status, "degraded state.") ||
+		pool.Action != "Replace the device using 'zpool replace'." || pool.Errors != "No known data errors" || pool.LastScrub != 0 {
+		t.Fatalf("unexpected pool %+v", pool)
+	}
+	if s := pool.Scan; s == nil || s.Function != "resilver" || s.State != "scanning" || s.Progress != 14.29 || s.ToGo != "02:03:04" || s.Repaired != "500G" ||
+		s.Start != time.Date(2026, 10, 11, 10, 0, 0, 0, time.Local).UnixMilli() {
+		t.Fatalf("unexpected scan %+v", pool.Scan)
+	}
+	if len(pool.Devices) != 7 || pool.Devices[3] != (ZpoolDevice{Name: "sdb", Depth: 2, State: "UNAVAIL", Read: 3, Write: 1}) ||
+		pool.Devices[5] != (ZpoolDevice{Name: "spares"}) || pool.Devices[6] != (ZpoolDevice{Name: "sdd", Depth: 1, State: "AVAIL"}) {
+		t.Fatalf("unexpected devices %+v", pool.Devices)
+	}
+
+	pool = Zpool{}
+	parseZpoolStatus(testZpoolScrubbed, &pool)
+	end := time.Date(2026, 10, 4, 2, 0, 0, 0, time.Local).UnixMilli()
+	if s := pool.Scan; s == nil || s.Function != "scrub" || s.State != "finished" || s.End != end || s.Start != end-26*3600*1000 || pool.LastScrub != end {
+		t.Fatalf("unexpected scrub %+v", pool.Scan)
+	}
+	if scan := parseZpoolScan([]string{"scrub canceled on Mon Oct  5 09:00:00 2026"}); scan == nil || scan.State != "canceled" || scan.End == 0 {
+		t.Fatalf("unexpected canceled scrub %+v", scan)
+	}
+	if scan := parseZpoolScan([]string{"none requested"}); scan != nil {
+		t.Fatalf("expected no scan, got %+v", scan)
+	}
+}
+
+func TestZpools(t *testing.T) {
+	useTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	poolAlerted.Lock()
+	poolAlerted.health = make(map[string]string)
+	poolAlerted.Unlock()
+
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.WriteFile(filepath.Join(bin, "zpool"), []byte(`#!/bin/sh
+dir="$(dirname "$0")"
+case "$1" in
+list) printf 'tank\t4000000\t1000000\t3000000\t12\t25\tONLINE\nbackup\t2000000\t100\t1999900\t-\t0\tONLINE\n' ;;
+status) cat "$dir/$3.status" ;;
+*) echo "$@" >> "$dir/zpool.log" ;;
+esac
+`), 0755)
+	write := func(name, content string) {
+		os.WriteFile(filepath.Join(bin, name), []byte(content), 0644)
+	}
+	// The table loops below run in no set order, so the calls are sorted
+	calls := func() string {
+		log, _ := os.ReadFile(filepath.Join(bin, "zpool.log"))
+		os.Remove(filepath.Join(bin, "zpool.log"))
+		lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+		sort.Strings(lines)
+		return strings.Join(lines, ";")
+	}
+	write("tank.status", testZpoolScrubbed)
+	write("backup.status", strings.ReplaceAll(strings.ReplaceAll(testZpoolScrubbed, "tank", "backup"),
+		"scrub repaired 0B in 1 days 02:00:00 with 0 errors on Sun Oct  4 02:00:00 2026", "none requested"))
+
+	r := gin.New()
+	r.GET("/admin/zpools", GetPools)
+	r.POST("/admin/zpools/scrub", ScrubPool)
+	r.POST("/admin/zpools/schedule", SaveScrubSchedule)
+	pools := func() []Zpool {
+		t.Helper()
+		w := serve(r, "GET", "/admin/zpools", "")
+		var resp struct{ Data []Zpool }
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != 200 || err != nil {
+			t.Fatalf("pools: %d %s", w.Code, w.Body.String())
+		}
+		return resp.Data
+	}
+	p := pools()
+	if len(p) != 2 || p[0].Name != "tank" || p[0].Size != 4000000 || p[0].Fragmentation != 12 || p[0].Capacity != 25 || p[0].LastScrub == 0 ||
+		p[1].Fragmentation != -1 || p[1].Scan != nil {
+		t.Fatalf("unexpected pools %+v", p)
+	}
+
+	// Scrubs start and stop by hand
+	for body, code := range map[string]int{
+		`{"pool":"tank"}`:             200,
+		`{"pool":"tank","stop":true}`: 200,
+		`{"pool":"nope"}`:             404,
+		`{"pool":"-x"}`:               404,
+	} {
+		if got, resp := serveJSON(r, "POST", "/admin/zpools/scrub", body); got != code {
+			t.Fatalf("%s: expected %d, got %d %v", body, code, got, resp)
+		}
+	}
+	if log := calls(); log != "scrub -s tank;scrub tank" {
+		t.Fatalf("unexpected zpool calls %q", log)
+	}
+
+	// Scheduled scrubs start once the last one is old enough; a pool never
+	// scrubbed starts at once
+	for body, code := range map[string]int{
+		`{"pool":"tank","intervalDays":30}`:  200,
+		`{"pool":"backup","intervalDays":7}`: 200,
+		`{"pool":"tank","intervalDays":-1}`:  400,
+		`{"pool":"nope","intervalDays":7}`:   404,
+	} {
+		if got, resp := serveJSON(r, "POST", "/admin/zpools/schedule", body); got != code {
+			t.Fatalf("%s: expected %d, got %d %v", body, code, got, resp)
+		}
+	}
+	if p := pools(); p[0].Schedule == nil || p[0].Schedule.IntervalDays != 30 {
+		t.Fatalf("expected the schedule with the pool, got %+v", p[0].Schedule)
+	}
+	runScrubSchedules(context.Background(), time.Date(2026, 10, 20, 0, 0, 0, 0, time.Local))
+	if log := calls(); log != "scrub backup" {
+		t.Fatalf("expected only backup scrubbed, got %q", log)
+	}
+	// The fake backup pool still reports no scrub, so it goes again
+	runScrubSchedules(context.Background(), time.Date(2026, 11, 4, 0, 0, 0, 0, time.Local))
+	if log := calls(); log != "scrub backup;scrub tank" {
+		t.Fatalf("expected tank scrubbed after 30 days, got %q", log)
+	}
+
+	// A running resilver blocks a scrub, and the monitor records the state
+	write("tank.status", testZpoolDegraded)
+	if code, _ := serveJSON(r, "POST", "/admin/zpools/scrub", `{"pool":"tank"}`); code != 409 {
+		t.Fatalf("expected a conflict while resilvering, got %d", code)
+	}
+	checkPools(context.Background())
+	poolAlerted.Lock()
+	health := poolAlerted.health["tank"]
+	poolAlerted.Unlock()
+	if health != "DEGRADED" {
+		t.Fatalf("expected the degraded pool recorded, got %q", health)
+	}
+}
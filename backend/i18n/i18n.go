@@ -0,0 +1,133 @@
+// Package i18n localizes the messages the backend sends to users. Every
+// message has a stable code; handlers keep emitting the English text and
+// the response layer looks the code up from it, so a message added without
+// a catalog entry is still shown, just untranslated.
+package i18n
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	En = "en"
+	Zh = "zh"
+)
+
+// Default is used when neither the user nor the browser picks a locale
+const Default = En
+
+// Supported lists the locales the catalog has text for
+var Supported = []string{En, Zh}
+
+type message struct {
+	code string
+	text map[string]string
+}
+
+var (
+	byCode    = make(map[string]*message)
+	byEnglish = make(map[string]*message)
+)
+
+func init() {
+	for _, m := range catalog {
+		m := m
+		if _, dup := byCode[m.code]; dup {
+			panic("i18n: duplicate code " + m.code)
+		}
+		byCode[m.code] = &m
+		byEnglish[strings.ToLower(m.text[En])] = &m
+	}
+}
+
+// Normalize maps a locale tag like "zh-CN" or "en_US" to a supported
+// locale, or "" when it is not supported
+func Normalize(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	for _, l := range Supported {
+		if tag == l {
+			return l
+		}
+	}
+	return ""
+}
+
+// Negotiate picks the best supported locale from an Accept-Language
+// header, "" when none matches
+func Negotiate(header string) string {
+	type choice struct {
+		locale string
+		q      float64
+		order  int
+	}
+	var choices []choice
+	for i, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		locale := Normalize(fields[0])
+		if locale == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(f), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{locale, q, i})
+		}
+	}
+	if len(choices) == 0 {
+		return ""
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	return choices[0].locale
+}
+
+// Code returns the code of an English message, "" when it is not in the
+// catalog
+func Code(english string) string {
+	if m := byEnglish[strings.ToLower(strings.TrimSpace(english))]; m != nil {
+		return m.code
+	}
+	return ""
+}
+
+// Translate returns the code of an English message and its text in locale.
+// Unknown messages come back unchanged with an empty code.
+func Translate(locale, english string) (code, text string) {
+	m := byEnglish[strings.ToLower(strings.TrimSpace(english))]
+	if m == nil {
+		return "", english
+	}
+	return m.code, m.textIn(locale)
+}
+
+// T formats the message with the given code in locale. args fill the
+// fmt verbs of the text.
+func T(locale, code string, args ...interface{}) string {
+	m := byCode[code]
+	if m == nil {
+		return code
+	}
+	text := m.textIn(locale)
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+func (m *message) textIn(locale string) string {
+	if t, ok := m.text[locale]; ok {
+		return t
+	}
+	return m.text[En]
+}
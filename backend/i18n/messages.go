@@ -0,0 +1,317 @@
+package i18n
+
+func msg(code, en, zh string) message {
+	return message{code: code, text: map[string]string{En: en, Zh: zh}}
+}
+
+// catalog holds every message with its code. The English text must match
+// what the handlers emit (case aside), since responses are looked up by it.
+var catalog = []message{
+	// Generic
+	msg("bad_request", "Bad Request", "请求错误"),
+	msg("internal_error", "Internal Server Error", "服务器内部错误"),
+	msg("invalid_request", "Invalid request", "无效的请求"),
+	msg("invalid_json", "Invalid JSON", "无效的 JSON"),
+	msg("invalid_json_payload", "Invalid JSON payload", "无效的 JSON 数据"),
+	msg("invalid_payload", "Invalid payload", "无效的数据"),
+	msg("invalid_message", "Invalid message", "无效的消息"),
+	msg("failed_to_parse_json", "Failed to parse JSON", "解析 JSON 失败"),
+	msg("failed_to_read_body", "Failed to read body", "读取请求内容失败"),
+	msg("missing_params", "Missing params", "缺少参数"),
+	msg("unsupported_method", "Unsupported method", "不支持的请求方法"),
+	msg("unsupported_type", "unsupported type", "不支持的类型"),
+	msg("invalid_action", "Invalid action", "无效的操作"),
+	msg("unknown_action", "Unknown action", "未知的操作"),
+	msg("unknown_event", "Unknown event", "未知的事件"),
+	msg("invalid_id", "Invalid ID", "无效的 ID"),
+	msg("missing_id", "Missing ID", "缺少 ID"),
+	msg("id_required", "ID is required", "ID 不能为空"),
+	msg("invalid_name", "Invalid name", "无效的名称"),
+	msg("name_required", "Name is required", "名称不能为空"),
+	msg("name_required_short", "Name required", "名称不能为空"),
+	msg("invalid_index", "Invalid index", "无效的索引"),
+	msg("invalid_size", "Invalid size", "无效的大小"),
+	msg("invalid_expiry", "Invalid expiry", "无效的有效期"),
+	msg("invalid_filename", "Invalid filename", "无效的文件名"),
+	msg("save_failed", "Save failed", "保存失败"),
+	msg("failed_to_save", "Failed to save", "保存失败"),
+	msg("failed_to_delete", "Failed to delete", "删除失败"),
+	msg("server_shutting_down", "Server is shutting down", "服务器正在关闭"),
+	msg("too_many_requests", "Too many requests", "请求过于频繁"),
+	msg("api_description_not_ready", "API description not ready", "API 描述尚未就绪"),
+	msg("invalid_locale", "Invalid locale", "无效的语言"),
+	msg("version_conflict", "Version conflict", "版本冲突，请刷新后重试"),
+	msg("failed_to_create_request", "Failed to create request", "创建请求失败"),
+	msg("failed_to_read_response", "Failed to read response body", "读取响应内容失败"),
+
+	// Authentication and permissions
+	msg("unauthorized", "Unauthorized", "未登录或登录已过期"),
+	msg("forbidden", "Forbidden", "禁止访问"),
+	msg("permission_denied", "Permission denied", "没有权限"),
+	msg("token_scope_denied", "Token scope does not allow this request", "令牌的权限范围不允许此请求"),
+	msg("password_incorrect", "Password incorrect", "密码错误"),
+	msg("password_required", "Password required", "请输入密码"),
+	msg("user_or_password_incorrect", "User not found or password incorrect", "用户不存在或密码错误"),
+	msg("username_password_required", "Username and password required", "请输入用户名和密码"),
+	msg("invalid_username", "Invalid username", "无效的用户名"),
+	msg("username_chars", "Username may only contain letters, digits, '.', '_' and '-'", "用户名只能包含字母、数字、“.”、“_”和“-”"),
+	msg("user_exists", "User already exists", "用户已存在"),
+	msg("user_not_found", "User not found", "用户不存在"),
+	msg("user_data_not_found", "User data not found", "找不到用户数据"),
+	msg("cannot_add_admin", "Cannot add admin user manually", "不能手动添加 admin 用户"),
+	msg("failed_to_hash_password", "Failed to hash password", "密码加密失败"),
+	msg("failed_to_save_user", "Failed to save user", "保存用户失败"),
+	msg("failed_to_delete_user", "Failed to delete user", "删除用户失败"),
+	msg("failed_to_create_default_user", "Failed to create default user", "创建默认用户失败"),
+	msg("failed_to_read_users", "Failed to read users directory", "读取用户目录失败"),
+	msg("failed_to_sign_token", "Failed to sign token", "签发令牌失败"),
+	msg("failed_to_issue_token", "Failed to issue token", "签发令牌失败"),
+	msg("two_factor_required", "Two-factor code required", "需要两步验证码"),
+	msg("two_factor_invalid", "Invalid two-factor code", "两步验证码错误"),
+	msg("two_factor_enforced", "The administrator requires two-factor authentication", "管理员要求启用两步验证"),
+	msg("failed_to_create_secret", "Failed to create secret", "生成密钥失败"),
+	msg("identity_provider_unavailable", "Identity provider unavailable", "身份提供方不可用"),
+	msg("session_not_found", "Session not found", "会话不存在"),
+	msg("failed_to_update_session", "Failed to update session", "更新会话失败"),
+	msg("invalid_scopes", "Invalid scopes", "无效的权限范围"),
+	msg("token_not_found", "Token not found", "令牌不存在"),
+	msg("failed_to_read_tokens", "Failed to read tokens", "读取令牌失败"),
+	msg("failed_to_save_token", "Failed to save token", "保存令牌失败"),
+	msg("failed_to_save_tokens", "Failed to save tokens", "保存令牌失败"),
+	msg("failed_to_read_audit_log", "Failed to read audit log", "读取审计日志失败"),
+
+	// Dashboard data
+	msg("failed_to_save_data", "Failed to save data", "保存数据失败"),
+	msg("failed_to_reset_data", "Failed to reset data", "重置数据失败"),
+	msg("failed_to_update_system_config", "Failed to update system config", "更新系统设置失败"),
+	msg("default_template_not_found", "Default template not found", "找不到默认模板"),
+	msg("failed_to_save_default_template", "Failed to save default template", "保存默认模板失败"),
+	msg("failed_to_save_custom_scripts", "Failed to save custom scripts", "保存自定义脚本失败"),
+	msg("failed_to_save_license", "Failed to save license", "保存许可证失败"),
+	msg("failed_to_save_visitor_stats", "Failed to save visitor stats", "保存访客统计失败"),
+	msg("widget_id_required", "Widget ID is required", "缺少组件 ID"),
+	msg("widget_not_found", "Widget not found", "组件不存在"),
+	msg("widgets_not_found", "Widgets not found", "找不到组件"),
+	msg("failed_to_read_memo", "Failed to read memo", "读取备忘录失败"),
+	msg("failed_to_save_memo", "Failed to save memo", "保存备忘录失败"),
+	msg("version_not_found", "Version not found", "版本不存在"),
+	msg("failed_to_save_version", "Failed to save version", "保存版本失败"),
+	msg("failed_to_restore_version", "Failed to restore version", "恢复版本失败"),
+	msg("failed_to_delete_version", "Failed to delete version", "删除版本失败"),
+	msg("failed_to_read_versions", "Failed to read versions directory", "读取版本目录失败"),
+	msg("mode_simple_or_rich", "mode must be simple or rich", "mode 只能是 simple 或 rich"),
+
+	// Backups and logs
+	msg("backups_not_configured", "Backups are not configured", "未配置备份"),
+	msg("backup_too_large", "Backup too large", "备份文件过大"),
+	msg("no_backup_file", "No backup file", "没有备份文件"),
+	msg("failed_to_build_backup", "Failed to build backup", "生成备份失败"),
+	msg("failed_to_encrypt_backup", "Failed to encrypt backup", "加密备份失败"),
+	msg("failed_to_read_backup", "Failed to read backup", "读取备份失败"),
+	msg("failed_to_export_logs", "Failed to export logs", "导出日志失败"),
+
+	// Files and transfers
+	msg("no_file", "No file", "没有文件"),
+	msg("file_not_found", "File not found", "文件不存在"),
+	msg("original_file_not_found", "Original file not found", "找不到原文件"),
+	msg("create_file_failed", "Create file failed", "创建文件失败"),
+	msg("failed_to_create_file", "Failed to create file", "创建文件失败"),
+	msg("failed_to_read_file", "Failed to read file", "读取文件失败"),
+	msg("failed_to_save_file", "Failed to save file", "保存文件失败"),
+	msg("failed_to_assemble_file", "Failed to assemble file", "合并文件失败"),
+	msg("failed_to_generate_thumbnail", "Failed to generate thumbnail", "生成缩略图失败"),
+	msg("failed_to_initialize_upload", "Failed to initialize upload", "初始化上传失败"),
+	msg("failed_to_finalize_upload", "Failed to finalize upload", "完成上传失败"),
+	msg("invalid_upload_id", "Invalid upload ID", "无效的上传 ID"),
+	msg("invalid_upload_session", "Invalid upload session", "无效的上传会话"),
+	msg("invalid_chunk_size", "Invalid chunk size or file size", "无效的分片大小或文件大小"),
+	msg("chunk_checksum_mismatch", "Chunk checksum mismatch", "分片校验和不匹配"),
+	msg("chunk_size_mismatch", "Chunk size mismatch", "分片大小不正确"),
+	msg("upload_incomplete", "Upload incomplete", "上传未完成"),
+	msg("failed_to_read_transfer_index", "Failed to read transfer index", "读取传输记录失败"),
+	msg("failed_to_save_index", "Failed to save index", "保存索引失败"),
+	msg("failed_to_update_index", "Failed to update index", "更新索引失败"),
+	msg("failed_to_save_item", "Failed to save item", "保存条目失败"),
+	msg("share_not_found", "Share not found", "共享目录不存在"),
+	msg("share_read_only", "Share is read-only", "共享目录为只读"),
+	msg("invalid_path", "Invalid path", "无效的路径"),
+	msg("file_exists", "File already exists", "文件已存在"),
+	msg("file_operation_failed", "File operation failed", "文件操作失败"),
+	msg("folder_into_itself", "Cannot put a folder inside itself", "不能把文件夹放到它自身里面"),
+	msg("invalid_shares", "Invalid shares", "无效的共享目录设置"),
+	msg("invalid_rate", "Invalid rate", "无效的速率"),
+	msg("transcoding_not_available", "Transcoding is not available", "转码不可用"),
+	msg("too_many_transcodes", "Too many transcodes running", "正在进行的转码过多"),
+	msg("transcoding_failed", "Transcoding failed", "转码失败"),
+	msg("transcoding_starting", "Transcoding is starting", "转码正在启动"),
+	msg("trash_item_not_found", "Trash item not found", "回收站中没有该项目"),
+	msg("share_link_not_found", "Share link not found", "分享链接不存在"),
+	msg("share_link_expired", "Share link expired", "分享链接已过期"),
+	msg("download_limit_reached", "Download limit reached", "已达到下载次数上限"),
+	msg("failed_to_save_share_link", "Failed to save share link", "保存分享链接失败"),
+	msg("uploads_need_writable_folder", "Uploads need a writable folder", "上传需要可写的文件夹"),
+	msg("uploads_not_allowed", "Uploads are not allowed", "不允许上传"),
+	msg("wrong_password", "Wrong password", "密码错误"),
+	msg("too_many_attempts", "Too many attempts, try again later", "尝试次数过多，请稍后再试"),
+	msg("invalid_sftp_settings", "Invalid SFTP settings", "无效的 SFTP 设置"),
+	msg("invalid_sftp_port", "Invalid SFTP port", "无效的 SFTP 端口"),
+	msg("invalid_public_key", "Invalid public key", "无效的公钥"),
+	msg("key_already_added", "Key already added", "该公钥已添加"),
+	msg("failed_to_save_key", "Failed to save key", "保存公钥失败"),
+	msg("key_not_found", "Key not found", "公钥不存在"),
+	msg("folder_not_found", "Folder not found", "文件夹不存在"),
+	msg("samba_not_installed", "Samba is not installed", "未安装 Samba"),
+	msg("samba_share_not_found", "Samba share not found", "Samba 共享不存在"),
+	msg("invalid_samba_share", "Invalid Samba share", "无效的 Samba 共享"),
+	msg("invalid_samba_configuration", "Invalid Samba configuration", "无效的 Samba 配置"),
+	msg("samba_operation_failed", "Samba operation failed", "Samba 操作失败"),
+	msg("samba_reload_failed", "Samba reload failed", "Samba 重新加载失败"),
+	msg("samba_status_unavailable", "Samba status unavailable", "无法获取 Samba 状态"),
+	msg("nfs_not_installed", "NFS server is not installed", "未安装 NFS 服务"),
+	msg("nfs_export_not_found", "NFS export not found", "NFS 导出不存在"),
+	msg("invalid_nfs_export", "Invalid NFS export", "无效的 NFS 导出"),
+	msg("nfs_operation_failed", "NFS operation failed", "NFS 操作失败"),
+	msg("failed_to_apply_nfs_exports", "Failed to apply NFS exports", "应用 NFS 导出失败"),
+	msg("share_not_scanned", "Share not scanned yet", "该共享尚未扫描"),
+	msg("scan_already_running", "A scan is already running", "扫描正在进行中"),
+	msg("invalid_depth", "Invalid depth", "无效的层级"),
+	msg("invalid_limit", "Invalid limit", "无效的数量限制"),
+	msg("file_changed_since_scan", "File changed since the scan", "文件在扫描后已被修改"),
+	msg("file_not_duplicate", "File is not a duplicate", "该文件不是重复文件"),
+	msg("every_copy_selected", "Every copy is selected", "所有副本都被选中了"),
+	msg("no_scan_running", "No scan is running", "没有正在进行的扫描"),
+	msg("invalid_search", "Invalid search", "无效的搜索"),
+	msg("search_index_disabled", "Search index is disabled", "搜索索引未启用"),
+	msg("invalid_date", "Invalid date", "无效的日期"),
+	msg("check_already_running", "A check is already running", "检查正在进行中"),
+	msg("no_check_running", "No check is running", "没有正在进行的检查"),
+	msg("report_not_found", "Report not found", "未找到报告"),
+	msg("invalid_integrity_settings", "Invalid integrity settings", "无效的完整性检查设置"),
+	msg("sync_job_not_found", "Sync job not found", "未找到同步任务"),
+	msg("sync_job_running", "Sync job is already running", "同步任务正在运行"),
+	msg("sync_job_not_running", "Sync job is not running", "同步任务未在运行"),
+	msg("rclone_not_installed", "rclone is not installed", "未安装 rclone"),
+	msg("rsync_not_installed", "rsync is not installed", "未安装 rsync"),
+	msg("unknown_sync_tool", "Unknown sync tool", "未知的同步工具"),
+	msg("invalid_sync_mode", "Invalid sync mode", "无效的同步模式"),
+	msg("invalid_sync_path", "Invalid sync path", "无效的同步路径"),
+	msg("invalid_sync_flag", "Invalid sync flag", "无效的同步参数"),
+	msg("sync_job_failed", "Sync job failed", "同步任务失败"),
+	msg("run_not_found", "Run not found", "未找到运行记录"),
+	msg("failed_to_list_remotes", "Failed to list remotes", "获取远程存储列表失败"),
+	msg("invalid_interval", "Invalid interval", "无效的间隔"),
+	msg("snapshots_unsupported", "Snapshots need a Btrfs or ZFS share", "快照需要 Btrfs 或 ZFS 共享"),
+	msg("snapshot_not_found", "Snapshot not found", "未找到快照"),
+	msg("snapshot_exists", "Snapshot already exists", "快照已存在"),
+	msg("volume_not_found", "Volume not found", "未找到卷"),
+	msg("newer_snapshots", "Newer snapshots would be destroyed", "将会删除更新的快照"),
+	msg("rollback_mount_point", "A mounted subvolume cannot be rolled back", "无法回滚已挂载的子卷"),
+	msg("zfs_not_installed", "ZFS tools are not installed", "未安装 ZFS 工具"),
+	msg("btrfs_not_installed", "Btrfs tools are not installed", "未安装 Btrfs 工具"),
+	msg("snapshot_operation_failed", "Snapshot operation failed", "快照操作失败"),
+	msg("invalid_snapshot_name", "Invalid snapshot name", "无效的快照名称"),
+	msg("smartctl_not_installed", "smartmontools is not installed", "未安装 smartmontools"),
+	msg("reading_disks_failed", "Reading the disks failed", "读取磁盘信息失败"),
+	msg("missing_disk", "Missing disk", "缺少磁盘"),
+	msg("invalid_days", "Invalid days", "无效的天数"),
+	msg("raid_not_found", "Array not found", "未找到阵列"),
+	msg("raid_busy", "The array is already syncing", "阵列正在同步"),
+	msg("raid_inactive", "The array is not running", "阵列未运行"),
+	msg("raid_member", "The disk is already in the array", "该磁盘已在阵列中"),
+	msg("mdadm_not_installed", "mdadm is not installed", "未安装 mdadm"),
+	msg("raid_operation_failed", "RAID operation failed", "RAID 操作失败"),
+	msg("invalid_array", "Invalid array", "无效的阵列"),
+	msg("invalid_device", "Invalid device", "无效的设备"),
+	msg("pool_not_found", "Pool not found", "未找到存储池"),
+	msg("pool_scanning", "The pool is already being scrubbed or resilvered", "存储池正在校验或重建"),
+	msg("pool_operation_failed", "Pool operation failed", "存储池操作失败"),
+	msg("remote_mount_not_found", "Remote mount not found", "未找到远程挂载"),
+	msg("mountpoint_not_empty", "Mountpoint is not empty", "挂载点不为空"),
+	msg("mount_not_responding", "Mount is not responding", "挂载无响应"),
+	msg("mount_timed_out", "Mount timed out", "挂载超时"),
+	msg("cifs_not_installed", "cifs-utils is not installed", "未安装 cifs-utils"),
+	msg("mount_failed", "Mount failed", "挂载失败"),
+	msg("invalid_mountpoint", "Invalid mountpoint", "无效的挂载点"),
+	msg("invalid_mount_address", "Invalid address", "无效的地址"),
+	msg("invalid_bucket", "Invalid bucket", "无效的存储桶"),
+	msg("invalid_mount_option", "Invalid mount option", "无效的挂载选项"),
+	msg("unknown_mount_type", "Unknown mount type", "未知的挂载类型"),
+	msg("invalid_credentials", "Invalid credentials", "无效的凭据"),
+	msg("quota_exceeded", "Quota exceeded", "超出配额"),
+	msg("invalid_quota_settings", "Invalid quota settings", "无效的配额设置"),
+	msg("thumbnail_not_available", "Thumbnail not available", "无法生成缩略图"),
+	msg("opml_too_large", "OPML file too large", "OPML 文件过大"),
+
+	// Outbound requests
+	msg("url_required", "url is required", "请输入 URL"),
+	msg("missing_url", "Missing url parameter", "缺少 url 参数"),
+	msg("invalid_url", "Invalid URL", "无效的 URL"),
+	msg("unsupported_protocol", "Unsupported protocol", "不支持的协议"),
+	msg("target_not_allowed", "Target host is not allowed", "不允许访问目标主机"),
+	msg("upstream_non_200", "Upstream returned non-200 status", "上游服务返回了错误状态"),
+	msg("failed_to_fetch_upstream", "Failed to fetch upstream URL", "请求上游地址失败"),
+	msg("proxy_unavailable", "Proxy unavailable", "代理不可用"),
+	msg("ping_failed", "Ping failed", "连接测试失败"),
+	msg("could_not_parse_latency", "Could not parse latency", "无法解析延迟"),
+	msg("failed_to_download_image", "Failed to download image", "下载图片失败"),
+	msg("failed_to_fetch_icon", "Failed to fetch icon", "获取图标失败"),
+	msg("failed_to_fetch_icons", "Failed to fetch icons from upstream", "从上游获取图标失败"),
+	msg("city_required", "city is required", "请输入城市"),
+	msg("docker_not_available", "Docker not available", "Docker 不可用"),
+
+	// RSS
+	msg("guid_required", "guid is required", "缺少 guid"),
+	msg("link_required", "link is required", "缺少链接"),
+	msg("item_not_found", "item not found", "条目不存在"),
+	msg("unknown_feed", "Unknown feed", "未知的订阅源"),
+	msg("server_ts_required", "server_ts is required", "缺少 server_ts"),
+
+	// Webhooks, hooks and plugins
+	msg("webhook_not_found", "Webhook not found", "Webhook 不存在"),
+	msg("invalid_webhook_url", "Invalid webhook url", "无效的 Webhook 地址"),
+	msg("select_an_event", "Select at least one event", "请至少选择一个事件"),
+	msg("failed_to_save_webhook", "Failed to save webhook", "保存 Webhook 失败"),
+	msg("failed_to_delete_webhook", "Failed to delete webhook", "删除 Webhook 失败"),
+	msg("hook_not_found", "Hook not found", "钩子不存在"),
+	msg("failed_to_save_hook", "Failed to save hook", "保存钩子失败"),
+	msg("failed_to_delete_hook", "Failed to delete hook", "删除钩子失败"),
+	msg("plugin_not_found", "Plugin not found", "插件不存在"),
+	msg("invalid_plugin_url", "Invalid plugin url", "无效的插件地址"),
+	msg("plugin_name_chars", "Plugin name may only contain lowercase letters, digits, '_' and '-'", "插件名称只能包含小写字母、数字、“_”和“-”"),
+	msg("failed_to_save_plugin", "Failed to save plugin", "保存插件失败"),
+	msg("failed_to_delete_plugin", "Failed to delete plugin", "删除插件失败"),
+	msg("unknown_plugin", "Unknown plugin", "未知的插件"),
+	msg("unknown_plugin_event", "Unknown plugin event", "未知的插件事件"),
+	msg("unknown_plugin_widget", "Unknown plugin widget", "未知的插件组件"),
+
+	// Notifications
+	msg("notify_rss_alert", "RSS alert", "RSS 提醒"),
+	msg("notify_rss_alert_more", "%d more matching items in %s", "%[2]s 中还有 %[1]d 条匹配的内容"),
+	msg("notify_rss_digest_title", "FlatNas digest %s: %d new items", "FlatNas 摘要 %s：%d 条新内容"),
+	msg("notify_integrity_alert", "%d files changed without a new mtime in %s", "%[2]s 中有 %[1]d 个文件在修改时间未变的情况下内容发生变化"),
+	msg("notify_integrity_more", "and %d more, see the report", "还有 %d 个，详见报告"),
+	msg("notify_sync_success", "Sync job %s finished", "同步任务 %s 已完成"),
+	msg("notify_sync_success_body", "%d files transferred, %s", "已传输 %d 个文件，%s"),
+	msg("notify_sync_failed", "Sync job %s failed", "同步任务 %s 失败"),
+	msg("notify_quota_user", "%s has used %d%% of the upload quota", "%s 已使用上传配额的 %d%%"),
+	msg("notify_quota_share", "Share %s is %d%% full", "共享 %s 已使用配额的 %d%%"),
+	msg("notify_quota_body", "%s of %s used", "已使用 %s / %s"),
+	msg("notify_virus_upload", "Infected upload quarantined: %s", "已隔离受感染的上传文件：%s"),
+	msg("notify_virus_scan", "%d infected files found in %s", "在 %[2]s 中发现 %[1]d 个受感染的文件"),
+	msg("notify_virus_more", "and %d more, see the report", "还有 %d 个，详见报告"),
+	msg("notify_smart_alert", "Disk %s needs attention", "磁盘 %s 需要注意"),
+	msg("notify_smart_failing", "The drive's own health assessment failed", "磁盘自检的健康评估未通过"),
+	msg("notify_smart_critical", "NVMe critical warning %#x", "NVMe 严重警告 %#x"),
+	msg("notify_smart_grew", "%s rose from %d to %d", "%s 从 %d 增加到 %d"),
+	msg("notify_smart_prefail", "Pre-fail attribute %s reached its threshold", "预失效属性 %s 已达到阈值"),
+	msg("notify_smart_hot", "Temperature is %d °C", "温度为 %d °C"),
+	msg("notify_raid_degraded", "RAID array %s is degraded", "RAID 阵列 %s 已降级"),
+	msg("notify_raid_working", "%d of %d disks are working", "%d/%d 块磁盘正常工作"),
+	msg("notify_raid_faulty", "Faulty: %s", "故障磁盘：%s"),
+	msg("notify_pool_alert", "ZFS pool %s is %s", "ZFS 存储池 %s 状态为 %s"),
+	msg("notify_pool_devices", "Devices: %s", "设备：%s"),
+	msg("smart_reallocated", "Reallocated sectors", "重新分配扇区数"),
+	msg("smart_pending", "Pending sectors", "待映射扇区数"),
+	msg("smart_uncorrectable", "Uncorrectable sectors", "无法校正的扇区数"),
+	msg("smart_media_errors", "Media errors", "介质错误数"),
+}
@@ -0,0 +1,317 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bufferSize     = 2000
+	maxFileSize    = 10 << 20
+	keptFiles      = 3
+	defaultQuery   = 200
+	subscriberSize = 256
+)
+
+// Record is one log line as kept in memory and returned by the query API
+type Record struct {
+	Seq       uint64                 `json:"seq"`
+	Time      time.Time              `json:"time"`
+	Level     string                 `json:"level"`
+	Component string                 `json:"component,omitempty"`
+	Message   string                 `json:"message"`
+	Attrs     map[string]interface{} `json:"attrs,omitempty"`
+}
+
+// Query selects records from the buffer. Level is the minimum level, After
+// a sequence number to continue from.
+type Query struct {
+	Level     string
+	Component string
+	Search    string
+	After     uint64
+	Limit     int
+}
+
+var (
+	level  = new(slog.LevelVar)
+	out    = &output{stderr: os.Stderr}
+	buffer = &ring{records: make([]Record, bufferSize)}
+)
+
+// The handler is installed at package init so loggers made in package vars
+// (see For) already write to the buffer; Init only adds the file.
+func init() {
+	text := slog.NewTextHandler(out, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(&handler{text: text}))
+}
+
+// Init sets the level from LOG_LEVEL (debug, info, warn or error) and
+// starts writing dir/flatnas.log, keeping a few rotated files.
+func Init(dir string) error {
+	if raw := strings.TrimSpace(os.Getenv("LOG_LEVEL")); raw != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(raw)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q", raw)
+		}
+		level.Set(l)
+	}
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := openRotatingFile(filepath.Join(dir, "flatnas.log"))
+	if err != nil {
+		return err
+	}
+	out.setFile(f)
+	return nil
+}
+
+// For returns the logger of one part of the backend, e.g. "rss"
+func For(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// Recent returns the buffered records matching q, oldest first
+func Recent(q Query) []Record {
+	min := slog.LevelDebug
+	if q.Level != "" {
+		min.UnmarshalText([]byte(q.Level))
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQuery
+	}
+	if limit > bufferSize {
+		limit = bufferSize
+	}
+	search := strings.ToLower(q.Search)
+
+	var matched []Record
+	for _, r := range buffer.snapshot() {
+		if r.Seq <= q.After || levelOf(r.Level) < min {
+			continue
+		}
+		if q.Component != "" && r.Component != q.Component {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(r.Message), search) {
+			continue
+		}
+		matched = append(matched, r)
+	}
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	return matched
+}
+
+// Subscribe delivers new records until cancel is called. Records are
+// dropped when the receiver falls behind rather than blocking logging.
+func Subscribe() (<-chan Record, func()) {
+	return buffer.subscribe()
+}
+
+func levelOf(name string) slog.Level {
+	var l slog.Level
+	l.UnmarshalText([]byte(name))
+	return l
+}
+
+type handler struct {
+	text  slog.Handler
+	attrs []slog.Attr
+	group string
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	rec := Record{Time: r.Time, Level: r.Level.String(), Message: r.Message}
+	add := func(a slog.Attr) {
+		if a.Key == "component" && h.group == "" {
+			rec.Component = a.Value.String()
+			return
+		}
+		if rec.Attrs == nil {
+			rec.Attrs = make(map[string]interface{})
+		}
+		rec.Attrs[a.Key] = a.Value.Resolve().Any()
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		add(a)
+		return true
+	})
+	buffer.add(rec)
+	return h.text.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := &handler{text: h.text.WithAttrs(attrs), group: h.group}
+	next.attrs = append(next.attrs, h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		next.attrs = append(next.attrs, a)
+	}
+	return next
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	group := name
+	if h.group != "" {
+		group = h.group + "." + name
+	}
+	return &handler{text: h.text.WithGroup(name), attrs: h.attrs, group: group}
+}
+
+// ring keeps the last bufferSize records
+type ring struct {
+	mu      sync.Mutex
+	records []Record
+	next    uint64
+	subs    map[chan Record]struct{}
+}
+
+func (b *ring) add(r Record) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.next++
+	r.Seq = b.next
+	b.records[(b.next-1)%bufferSize] = r
+	for ch := range b.subs {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+}
+
+func (b *ring) snapshot() []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.next
+	if n > bufferSize {
+		n = bufferSize
+	}
+	out := make([]Record, 0, n)
+	for seq := b.next - n + 1; seq <= b.next; seq++ {
+		out = append(out, b.records[(seq-1)%bufferSize])
+	}
+	return out
+}
+
+func (b *ring) subscribe() (<-chan Record, func()) {
+	ch := make(chan Record, subscriberSize)
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan Record]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// output writes text lines to stderr and, once Init ran, the log file
+type output struct {
+	mu     sync.Mutex
+	stderr io.Writer
+	file   *rotatingFile
+}
+
+func (o *output) setFile(f *rotatingFile) {
+	o.mu.Lock()
+	old := o.file
+	o.file = f
+	o.mu.Unlock()
+	if old != nil && old.f != nil {
+		old.f.Close()
+	}
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stderr.Write(p)
+	if o.file != nil {
+		o.file.write(p)
+	}
+	return len(p), nil
+}
+
+// rotatingFile moves flatnas.log to flatnas.log.1 (and so on) once it
+// reaches maxFileSize
+type rotatingFile struct {
+	path string
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, f: f, size: info.Size()}, nil
+}
+
+func (r *rotatingFile) write(p []byte) {
+	if r.f == nil {
+		return
+	}
+	if r.size+int64(len(p)) > maxFileSize && r.size > 0 {
+		if r.rotate(); r.f == nil {
+			return
+		}
+	}
+	n, _ := r.f.Write(p)
+	r.size += int64(n)
+}
+
+func (r *rotatingFile) rotate() {
+	r.f.Close()
+	for i := keptFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	os.Rename(r.path, r.path+".1")
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		// Keep logging to stderr only rather than failing writes
+		r.f = nil
+		return
+	}
+	r.f = f
+	r.size = 0
+}
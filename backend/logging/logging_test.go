@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecentAndFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(dir); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	defer out.setFile(nil)
+
+	rss := For("rss")
+	rss.Info("fetched", "feed", "https://example.org/feed")
+	rss.Warn("fetch failed", "feed", "https://example.org/bad")
+	For("auth").Error("login failed", "user", "bob")
+
+	got := Recent(Query{Component: "rss"})
+	if len(got) != 2 || got[1].Message != "fetch failed" || got[1].Attrs["feed"] != "https://example.org/bad" {
+		t.Fatalf("unexpected rss records: %+v", got)
+	}
+	got = Recent(Query{Level: "warn"})
+	if len(got) != 2 || got[0].Component != "rss" || got[1].Component != "auth" {
+		t.Fatalf("unexpected warn records: %+v", got)
+	}
+	if again := Recent(Query{After: got[1].Seq}); len(again) != 0 {
+		t.Fatalf("expected nothing after the last record, got %d", len(again))
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "flatnas.log"))
+	if err != nil || len(data) == 0 {
+		t.Fatalf("expected log file to be written: %v", err)
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"flatnasgo-backend/config"
 	"flatnasgo-backend/handlers"
+	"flatnasgo-backend/logging"
 	"flatnasgo-backend/middleware"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -24,13 +29,45 @@ import (
 func main() {
 	fmt.Println("Backend process started")
 	config.Init()
+	if err := logging.Init(filepath.Join(config.DataDir, "logs")); err != nil {
+		log.Printf("Logging to file disabled: %v", err)
+	}
+	serverLog := logging.For("server")
 	handlers.InitWidgetCache()
 	handlers.InitDocker()
 	handlers.StartIPFetcher()
 	handlers.StartDataWarmup()
+	handlers.StartRssScheduler()
+	handlers.StartRssDigest()
+	handlers.StartBackupScheduler()
+	handlers.StartPluginScheduler()
+	handlers.StartWebhooks()
+	handlers.StartDiskMonitor()
+	handlers.StartSmartMonitor()
+	handlers.StartRaidMonitor()
+	handlers.StartPoolMonitor()
+	handlers.StartScrubScheduler()
+	handlers.StartProxyHealthChecks()
 	handlers.StartThumbSync()
+	handlers.StartTranscodeCleanup()
+	handlers.StartTrashPurge()
+	handlers.StartVersionPurge()
+	handlers.StartUsageScanner()
+	handlers.StartSearchIndexer()
+	handlers.StartIntegrityChecker()
+	handlers.StartMusicScanner()
+	handlers.StartSyncScheduler()
+	handlers.StartSnapshotScheduler()
+	handlers.StartRemoteMounts()
+	handlers.StartQuotaAccounting()
+	handlers.StartSftpServer()
+	handlers.StartJobQueue()
 
 	r := gin.New()
+	// Forwarding headers only count from the configured proxies
+	if err := r.SetTrustedProxies(middleware.LoadTrustedProxies()); err != nil {
+		serverLog.Warn("Invalid trusted proxies", "error", err)
+	}
 	r.Use(gin.Logger())
 	r.Use(middleware.RecoveryMiddleware())
 
@@ -81,26 +118,53 @@ func main() {
 		},
 	})
 	server.OnConnect("/", func(s socketio.Conn) error {
-		s.SetContext("")
+		if handlers.ShuttingDown() {
+			return fmt.Errorf("server is shutting down")
+		}
+		s.SetContext(handlers.SocketHandshakeToken(s))
+		handlers.SocketConnected(s)
 		return nil
 	})
 	server.OnDisconnect("/", func(s socketio.Conn, reason string) {
+		middleware.ForgetSocketConn(s.ID())
+		handlers.SocketDisconnected(s)
 	})
-	server.OnEvent("/", "join", func(s socketio.Conn, room string) {
-		s.Join(room)
-	})
+	server.OnEvent("/", "join", handlers.JoinRoom)
 	handlers.BindHotHandlers(server)
 	handlers.BindWeatherHandlers(server)
 	handlers.BindRssHandlers(server) // Added RSS handlers
+	handlers.BindOpmlHandlers(server)
+	handlers.BindRssSchedulerHandlers(server)
+	handlers.BindRssStateHandlers(server)
+	handlers.BindRssTimelineHandlers(server)
+	handlers.BindRssArticleHandlers(server)
+	handlers.BindRssHealthHandlers(server)
+	handlers.BindRssSubscribeHandlers(server)
+	handlers.BindRssSearchHandlers(server)
+	handlers.BindProxyHandlers(server)
+	handlers.BindNetworkSettingsHandlers(server)
 	handlers.BindMemoHandlers(server)
 	handlers.BindTodoHandlers(server)
 	handlers.BindNetworkHandlers(server)
+	handlers.BindLogHandlers(server)
+	handlers.BindPluginHandlers(server)
+	handlers.BindTransferHandlers(server)
+	handlers.BindSyncHandlers(server)
+	handlers.BindFileWatchHandlers(server)
+	handlers.BindJobHandlers(server)
+	handlers.BindSystemStatsHandlers(server)
 	handlers.SetSocketServer(server)
 	go server.Serve()
 	defer server.Close()
 
 	r.GET("/socket.io/*any", gin.WrapH(server))
 	r.POST("/socket.io/*any", gin.WrapH(server))
+	r.GET("/ws", handlers.ServeWebSocket(allowOriginFunc))
+	// Probes for container orchestrators and uptime monitors
+	r.GET("/healthz", handlers.Healthz)
+	r.HEAD("/healthz", handlers.Healthz)
+	r.GET("/readyz", handlers.Readyz)
+	r.HEAD("/readyz", handlers.Readyz)
 
 	// Static Files
 	r.Static("/assets", filepath.Join(config.PublicDir, "assets"))
@@ -113,7 +177,19 @@ func main() {
 	r.Static("/mobile_backgrounds", config.MobileBackgroundsDir)
 	r.Static("/icon-cache", config.IconCacheDir)
 	r.Static("/public", config.PublicDir)
-	r.Any("/proxy", handlers.ProxyRequest)
+	r.Any("/proxy", middleware.Localize(), middleware.RateLimitMiddleware(), handlers.ProxyRequest)
+	// WebDAV; gin's Any does not cover the WebDAV methods
+	for _, method := range []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE", "PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"} {
+		chain := []gin.HandlerFunc{middleware.RateLimitMiddleware()}
+		if !handlers.DavReadMethod(method) {
+			chain = append(chain, middleware.Audit("file.dav"))
+		}
+		chain = append(chain, handlers.ServeWebDAV)
+		r.Handle(method, "/dav", chain...)
+		r.Handle(method, "/dav/*path", chain...)
+	}
+	// Subsonic API for music apps, which log in with every request
+	r.Any("/rest/:method", middleware.RateLimitMiddleware(), handlers.ServeSubsonic)
 
 	// Middleware to serve static files from config.PublicDir if they exist
 	r.Use(func(c *gin.Context) {
@@ -142,16 +218,20 @@ func main() {
 	})
 
 	// API Routes
-	api := r.Group("/api")
+	middleware.SetUserLocale(handlers.UserLocale)
+	api := r.Group("/api", middleware.Localize(), middleware.RateLimitMiddleware())
 	{
-		api.POST("/login", handlers.Login)
+		api.POST("/login", middleware.Audit("login"), handlers.Login)
+		api.POST("/hooks/:id", middleware.Audit("hook.trigger"), handlers.TriggerInboundHook)
+		api.GET("/auth/providers", handlers.GetAuthProviders)
+		api.GET("/auth/oidc/login", handlers.OidcLogin)
+		api.GET("/auth/oidc/callback", handlers.OidcCallback)
 		api.GET("/data", middleware.OptionalAuthMiddleware(), handlers.GetData)
 		api.GET("/system-config", handlers.GetSystemConfig)
 		api.GET("/ip", handlers.GetIP)                                                             // Added GetIP
 		api.GET("/weather", handlers.GetWeather)                                                   // Added Weather
 		api.GET("/custom-scripts", middleware.OptionalAuthMiddleware(), handlers.GetCustomScripts) // Added Custom Scripts
 		api.GET("/docker-status", handlers.GetDockerStatus)                                        // Added Docker Status
-		api.GET("/docker/debug", handlers.GetDockerDebug)
 		api.GET("/config/proxy-status", handlers.GetProxyStatus)
 		api.GET("/widgets/:id", handlers.GetWidget) // Added Widget Data
 		api.GET("/memo/:id", middleware.AuthMiddleware(), handlers.GetMemo)
@@ -168,75 +248,298 @@ func main() {
 		api.GET("/rtt", handlers.RTT)                     // Added RTT for frontend latency check
 		api.POST("/visitor/track", handlers.TrackVisitor) // Public endpoint
 		api.GET("/transfer/file/:filename", middleware.OptionalAuthMiddleware(), handlers.ServeFile)
+		// The random session ID authorizes the segments; players do not send the login token
+		api.GET("/hls/:id/:file", handlers.ServeHls)
+		api.GET("/public/links/:token", handlers.GetPublicShareLink)
+		api.POST("/public/links/:token/unlock", handlers.UnlockShareLink)
+		api.GET("/public/links/:token/download", handlers.DownloadShareLink)
+		api.POST("/public/links/:token/upload", handlers.UploadShareLink)
+		// The document server calls these with the WOPI access token of the session
+		api.GET("/wopi/files/:id", handlers.WopiCheckFileInfo)
+		api.POST("/wopi/files/:id", handlers.WopiFileOperation)
+		api.GET("/wopi/files/:id/contents", handlers.WopiGetFile)
+		api.POST("/wopi/files/:id/contents", handlers.WopiPutFile)
 		api.GET("/transfer/thumb/:filename/:size", middleware.OptionalAuthMiddleware(), handlers.ServeThumb)
 		api.GET("/music-list", handlers.GetMusicList) // Added Music List
+		api.GET("/rss/timeline", middleware.OptionalAuthMiddleware(), handlers.GetRssTimeline)
+		api.GET("/rss/export/:id", middleware.OptionalAuthMiddleware(), handlers.ExportRssFeed)
+		api.GET("/rss/websub/:id", handlers.VerifyWebSub)   // Called by WebSub hubs
+		api.POST("/rss/websub/:id", handlers.ReceiveWebSub) // Called by WebSub hubs
+		api.GET("/transfer/items", handlers.GetTransferItems)
+		api.GET("/openapi.json", handlers.GetOpenAPI)
+		handlers.BindSocketEventRoutes(api) // HTTP mirror of the socket events
+		publicRoutes := r.Routes()
+		// Reachable with the enrollment token of a login that needs 2FA set up
+		api.POST("/2fa/setup", handlers.TwoFactorSetupAuth(), middleware.RequireScope(middleware.ScopeAdmin), handlers.SetupTwoFactor)
+		api.POST("/2fa/enable", middleware.Audit("2fa.enable"), handlers.TwoFactorSetupAuth(), middleware.RequireScope(middleware.ScopeAdmin), handlers.EnableTwoFactor)
 
 		// Protected Routes
 		authorized := api.Group("/")
 		authorized.Use(middleware.AuthMiddleware())
+		can := middleware.RequirePermission // Role check, see middleware/roles.go
+		audit := middleware.Audit           // Audit log entry, see middleware/audit.go
+		scope := middleware.RequireScope    // Token scope for account management, see middleware/api_tokens.go
 		{
 			// User Management
-			authorized.GET("/admin/users", handlers.GetUsers)
-			authorized.POST("/admin/users", handlers.AddUser)
-			authorized.DELETE("/admin/users/:usr", handlers.DeleteUser)
-			authorized.POST("/admin/license", handlers.UploadLicense)
-
-			authorized.POST("/save", handlers.SaveData) // Added SaveData
-			authorized.PUT("/memo/:id", handlers.SaveMemo)
-			authorized.POST("/system-config", handlers.UpdateSystemConfig) // Added SystemConfig Update
-			authorized.POST("/data/import", handlers.ImportData)           // Added ImportData
-			authorized.POST("/default/save", handlers.SaveDefault)
-			authorized.POST("/reset", handlers.ResetData)
+			authorized.GET("/admin/users", can(middleware.PermSystem), handlers.GetUsers)
+			authorized.POST("/admin/users", audit("user.create"), can(middleware.PermSystem), handlers.AddUser)
+			authorized.DELETE("/admin/users/:usr", audit("user.delete"), can(middleware.PermSystem), handlers.DeleteUser)
+			authorized.GET("/admin/roles", can(middleware.PermSystem), handlers.GetRoles)
+			authorized.GET("/admin/logs", can(middleware.PermSystem), handlers.GetLogs)
+			authorized.GET("/admin/audit", can(middleware.PermSystem), handlers.GetAuditLog)
+			authorized.GET("/admin/smart", can(middleware.PermSystem), handlers.GetSmart)
+			authorized.POST("/admin/smart/refresh", audit("smart.refresh"), can(middleware.PermSystem), handlers.RefreshSmart)
+			authorized.GET("/admin/smart/history", can(middleware.PermSystem), handlers.GetSmartHistory)
+			authorized.GET("/admin/raid", can(middleware.PermSystem), handlers.GetRaidArrays)
+			authorized.POST("/admin/raid/sync", audit("raid.sync"), can(middleware.PermSystem), handlers.RaidSyncAction)
+			authorized.POST("/admin/raid/spare", audit("raid.spare"), can(middleware.PermSystem), handlers.AddRaidSpare)
+			authorized.GET("/admin/zpools", can(middleware.PermSystem), handlers.GetPools)
+			authorized.POST("/admin/zpools/scrub", audit("zpool.scrub"), can(middleware.PermSystem), handlers.ScrubPool)
+			authorized.POST("/admin/zpools/schedule", audit("zpool.schedule"), can(middleware.PermSystem), handlers.SaveScrubSchedule)
+			authorized.GET("/admin/backup", can(middleware.PermSystem), handlers.GetBackupStatus)
+			authorized.POST("/admin/backup/export", audit("backup.export"), can(middleware.PermSystem), handlers.ExportBackup)
+			authorized.POST("/admin/backup/restore", audit("backup.restore"), can(middleware.PermSystem), handlers.RestoreBackup)
+			authorized.POST("/admin/backup/run", audit("backup.run"), can(middleware.PermSystem), handlers.RunBackup)
+			authorized.GET("/admin/webhooks", can(middleware.PermSystem), handlers.GetWebhooks)
+			authorized.POST("/admin/webhooks", audit("webhook.save"), can(middleware.PermSystem), handlers.SaveWebhook)
+			authorized.GET("/admin/webhooks/deliveries", can(middleware.PermSystem), handlers.GetWebhookDeliveries)
+			authorized.DELETE("/admin/webhooks/:id", audit("webhook.delete"), can(middleware.PermSystem), handlers.DeleteWebhook)
+			authorized.POST("/admin/webhooks/:id/test", can(middleware.PermSystem), handlers.TestWebhook)
+			authorized.GET("/admin/inbound-hooks", can(middleware.PermSystem), handlers.GetInboundHooks)
+			authorized.POST("/admin/inbound-hooks", audit("hook.save"), can(middleware.PermSystem), handlers.SaveInboundHook)
+			authorized.POST("/admin/inbound-hooks/:id/rotate", audit("hook.rotate"), can(middleware.PermSystem), handlers.RotateInboundHookSecret)
+			authorized.DELETE("/admin/inbound-hooks/:id", audit("hook.delete"), can(middleware.PermSystem), handlers.DeleteInboundHook)
+			authorized.GET("/admin/plugins", can(middleware.PermSystem), handlers.GetPlugins)
+			authorized.POST("/admin/plugins", audit("plugin.save"), can(middleware.PermSystem), handlers.SavePlugin)
+			authorized.DELETE("/admin/plugins/:name", audit("plugin.delete"), can(middleware.PermSystem), handlers.DeletePlugin)
+			authorized.POST("/admin/plugins/reload", can(middleware.PermSystem), handlers.ReloadPlugins)
+			authorized.GET("/plugins/:name/widgets/:widget", can(middleware.PermView), handlers.GetPluginWidget)
+			authorized.POST("/admin/users/:usr/role", audit("user.role"), can(middleware.PermSystem), handlers.SetUserRole)
+			authorized.POST("/admin/users/:usr/password", audit("user.password.reset"), can(middleware.PermSystem), handlers.ResetUserPassword)
+			authorized.POST("/user/password", audit("user.password"), handlers.ChangePassword)
+			authorized.GET("/2fa", scope(middleware.ScopeAdmin), handlers.GetTwoFactorStatus)
+			authorized.POST("/2fa/disable", audit("2fa.disable"), scope(middleware.ScopeAdmin), handlers.DisableTwoFactor)
+			authorized.GET("/admin/2fa", can(middleware.PermSystem), handlers.GetUsersTwoFactor)
+			authorized.POST("/admin/users/:usr/2fa", audit("user.2fa"), can(middleware.PermSystem), handlers.SetUserTwoFactor)
+			authorized.POST("/admin/license", audit("license.upload"), can(middleware.PermSystem), handlers.UploadLicense)
+			authorized.GET("/admin/samba/shares", can(middleware.PermSystem), handlers.GetSambaShares)
+			authorized.POST("/admin/samba/shares", audit("samba.share.save"), can(middleware.PermSystem), handlers.SaveSambaShare)
+			authorized.DELETE("/admin/samba/shares/:name", audit("samba.share.delete"), can(middleware.PermSystem), handlers.DeleteSambaShare)
+			authorized.POST("/admin/samba/reload", audit("samba.reload"), can(middleware.PermSystem), handlers.ReloadSamba)
+			authorized.GET("/admin/samba/status", can(middleware.PermSystem), handlers.GetSambaStatus)
+			authorized.GET("/admin/nfs/exports", can(middleware.PermSystem), handlers.GetNfsExports)
+			authorized.POST("/admin/nfs/exports", audit("nfs.export.save"), can(middleware.PermSystem), handlers.SaveNfsExport)
+			authorized.DELETE("/admin/nfs/exports", audit("nfs.export.delete"), can(middleware.PermSystem), handlers.DeleteNfsExport)
+			authorized.POST("/admin/nfs/apply", audit("nfs.apply"), can(middleware.PermSystem), handlers.ApplyNfsExports)
+			authorized.GET("/admin/nfs/clients", can(middleware.PermSystem), handlers.GetNfsClients)
+			authorized.GET("/admin/sync/jobs", can(middleware.PermSystem), handlers.GetSyncJobs)
+			authorized.POST("/admin/sync/jobs", audit("sync.job.save"), can(middleware.PermSystem), handlers.SaveSyncJob)
+			authorized.DELETE("/admin/sync/jobs/:id", audit("sync.job.delete"), can(middleware.PermSystem), handlers.DeleteSyncJob)
+			authorized.POST("/admin/sync/jobs/:id/run", audit("sync.job.run"), can(middleware.PermSystem), handlers.RunSyncJob)
+			authorized.DELETE("/admin/sync/jobs/:id/run", can(middleware.PermSystem), handlers.CancelSyncJob)
+			authorized.GET("/admin/sync/runs", can(middleware.PermSystem), handlers.GetSyncRuns)
+			authorized.GET("/admin/sync/runs/:id", can(middleware.PermSystem), handlers.GetSyncRun)
+			authorized.GET("/admin/sync/remotes", can(middleware.PermSystem), handlers.GetSyncRemotes)
+			authorized.GET("/admin/snapshots/volumes", can(middleware.PermSystem), handlers.GetSnapshotVolumes)
+			authorized.GET("/admin/snapshots", can(middleware.PermSystem), handlers.GetSnapshots)
+			authorized.POST("/admin/snapshots", audit("snapshot.create"), can(middleware.PermSystem), handlers.CreateSnapshot)
+			authorized.DELETE("/admin/snapshots", audit("snapshot.delete"), can(middleware.PermSystem), handlers.DeleteSnapshot)
+			authorized.POST("/admin/snapshots/rollback", audit("snapshot.rollback"), can(middleware.PermSystem), handlers.RollbackSnapshot)
+			authorized.POST("/admin/snapshots/schedule", audit("snapshot.schedule"), can(middleware.PermSystem), handlers.SaveSnapshotSchedule)
+			authorized.GET("/admin/mounts", can(middleware.PermSystem), handlers.GetRemoteMounts)
+			authorized.POST("/admin/mounts", audit("mount.save"), can(middleware.PermSystem), handlers.SaveRemoteMount)
+			authorized.DELETE("/admin/mounts/:id", audit("mount.delete"), can(middleware.PermSystem), handlers.DeleteRemoteMount)
+			authorized.POST("/admin/mounts/:id/mount", audit("mount.mount"), can(middleware.PermSystem), handlers.MountRemote)
+			authorized.DELETE("/admin/mounts/:id/mount", audit("mount.unmount"), can(middleware.PermSystem), handlers.UnmountRemote)
+			authorized.GET("/admin/quotas", can(middleware.PermSystem), handlers.GetQuotas)
+			authorized.POST("/admin/quotas/recount", can(middleware.PermSystem), handlers.RecountQuotas)
+
+			authorized.POST("/save", audit("config.save"), can(middleware.PermEdit), handlers.SaveData) // Added SaveData
+			authorized.PUT("/memo/:id", can(middleware.PermEdit), handlers.SaveMemo)
+			authorized.POST("/system-config", audit("config.system"), can(middleware.PermSystem), handlers.UpdateSystemConfig)                   // Added SystemConfig Update
+			authorized.POST("/data/import", audit("config.import"), scope(middleware.ScopeAdmin), can(middleware.PermEdit), handlers.ImportData) // Added ImportData
+			authorized.POST("/default/save", audit("config.default"), can(middleware.PermSystem), handlers.SaveDefault)
+			authorized.POST("/reset", audit("config.reset"), scope(middleware.ScopeAdmin), can(middleware.PermEdit), handlers.ResetData)
 			authorized.GET("/system/stats", handlers.GetSystemStats)
-			authorized.GET("/docker/containers", handlers.ListContainers)
-			authorized.GET("/docker/info", handlers.GetDockerInfo)
-			authorized.GET("/docker/export-logs", handlers.ExportDockerLogs)
-			authorized.GET("/docker/container/:id/inspect-lite", handlers.ContainerInspectLite)
-			authorized.POST("/docker/check-updates", handlers.TriggerUpdateCheck)
-			authorized.POST("/docker/container/:id/:action", handlers.ContainerAction)
-			authorized.POST("/custom-scripts", handlers.SaveCustomScripts)
+			authorized.GET("/docker/debug", can(middleware.PermDocker), handlers.GetDockerDebug)
+			authorized.GET("/docker/containers", can(middleware.PermDocker), handlers.ListContainers)
+			authorized.GET("/docker/info", can(middleware.PermDocker), handlers.GetDockerInfo)
+			authorized.GET("/docker/export-logs", can(middleware.PermDocker), handlers.ExportDockerLogs)
+			authorized.GET("/docker/container/:id/inspect-lite", can(middleware.PermDocker), handlers.ContainerInspectLite)
+			authorized.POST("/docker/check-updates", can(middleware.PermDocker), handlers.TriggerUpdateCheck)
+			authorized.POST("/docker/container/:id/:action", audit("docker.container"), can(middleware.PermDocker), handlers.ContainerAction)
+			authorized.POST("/custom-scripts", audit("config.scripts"), can(middleware.PermSystem), handlers.SaveCustomScripts)
+			authorized.POST("/config/proxy-test", can(middleware.PermSystem), handlers.TestProxy)
+			authorized.GET("/tokens", scope(middleware.ScopeAdmin), handlers.GetApiTokens)
+			authorized.POST("/tokens", audit("token.create"), scope(middleware.ScopeAdmin), handlers.CreateApiToken)
+			authorized.DELETE("/tokens/:id", audit("token.delete"), scope(middleware.ScopeAdmin), handlers.DeleteApiToken)
+
+			// RSS Subscriptions
+			authorized.POST("/rss/opml/import", can(middleware.PermEdit), handlers.ImportOpml)
+			authorized.GET("/rss/opml/export", handlers.ExportOpml)
+			authorized.POST("/rss/refresh", can(middleware.PermEdit), handlers.RefreshRssFeeds)
 
 			// Wallpaper
-			authorized.GET("/wallpaper/proxy", handlers.ProxyWallpaper)
-			authorized.POST("/wallpaper/resolve", handlers.ResolveWallpaper)
-			authorized.POST("/wallpaper/fetch", handlers.FetchWallpaper)
+			authorized.GET("/wallpaper/proxy", can(middleware.PermFiles), handlers.ProxyWallpaper)
+			authorized.POST("/wallpaper/resolve", can(middleware.PermFiles), handlers.ResolveWallpaper)
+			authorized.POST("/wallpaper/fetch", can(middleware.PermFiles), handlers.FetchWallpaper)
 
 			// Backgrounds Management
 			authorized.GET("/backgrounds", handlers.ListBackgrounds)
 			authorized.GET("/mobile_backgrounds", handlers.ListMobileBackgrounds)
-			authorized.DELETE("/backgrounds/:name", handlers.DeleteBackground)
-			authorized.DELETE("/mobile_backgrounds/:name", handlers.DeleteMobileBackground)
-			authorized.POST("/backgrounds/upload", handlers.UploadBackground)
-			authorized.POST("/mobile_backgrounds/upload", handlers.UploadMobileBackground)
-			authorized.POST("/music/upload", handlers.UploadMusic) // Added Music Upload
+			authorized.DELETE("/backgrounds/:name", audit("file.delete"), can(middleware.PermFiles), handlers.DeleteBackground)
+			authorized.DELETE("/mobile_backgrounds/:name", audit("file.delete"), can(middleware.PermFiles), handlers.DeleteMobileBackground)
+			authorized.POST("/backgrounds/upload", audit("file.upload"), can(middleware.PermFiles), handlers.UploadBackground)
+			authorized.POST("/mobile_backgrounds/upload", audit("file.upload"), can(middleware.PermFiles), handlers.UploadMobileBackground)
+			authorized.POST("/music/upload", audit("file.upload"), can(middleware.PermFiles), handlers.UploadMusic) // Added Music Upload
+			authorized.GET("/music/library/artists", can(middleware.PermFiles), handlers.GetMusicArtists)
+			authorized.GET("/music/library/albums", can(middleware.PermFiles), handlers.GetMusicAlbums)
+			authorized.GET("/music/library/albums/:key", can(middleware.PermFiles), handlers.GetMusicAlbum)
+			authorized.GET("/music/library/genres", can(middleware.PermFiles), handlers.GetMusicGenres)
+			authorized.GET("/music/library/search", can(middleware.PermFiles), handlers.SearchMusic)
+			authorized.GET("/music/library/stream/:id", can(middleware.PermFiles), handlers.StreamMusicTrack)
+			authorized.GET("/music/library/cover/:id", can(middleware.PermFiles), handlers.GetMusicCover)
+			authorized.POST("/music/library/scan", audit("music.scan"), can(middleware.PermSystem), handlers.ScanMusicLibrary)
 
-		// Transfer
-		api.GET("/transfer/items", handlers.GetTransferItems)
-		authorized.POST("/transfer/text", handlers.SendText)
-		authorized.POST("/transfer/upload/init", handlers.UploadInit)
-		authorized.POST("/transfer/upload/chunk", handlers.UploadChunk)
-		authorized.POST("/transfer/upload/complete", handlers.UploadComplete)
-		authorized.POST("/transfer/download-token", handlers.DownloadToken)
-		authorized.DELETE("/transfer/items/:id", handlers.DeleteItem)
-		authorized.POST("/transfer/generate-thumb/:filename/:size", handlers.GenerateThumb)
-		authorized.POST("/transfer/regenerate-thumbs", handlers.RegenerateThumbs)
+			// Transfer
+			authorized.POST("/transfer/text", can(middleware.PermFiles), handlers.SendText)
+			authorized.POST("/transfer/upload/init", can(middleware.PermFiles), handlers.UploadInit)
+			authorized.POST("/transfer/upload/chunk", can(middleware.PermFiles), handlers.UploadChunk)
+			authorized.POST("/transfer/upload/complete", audit("file.upload"), can(middleware.PermFiles), handlers.UploadComplete)
+			authorized.GET("/transfer/uploads", can(middleware.PermFiles), handlers.GetUploads)
+			authorized.GET("/transfer/quota", can(middleware.PermFiles), handlers.GetUserQuota)
+			authorized.GET("/transfer/upload/:id", can(middleware.PermFiles), handlers.UploadStatus)
+			authorized.DELETE("/transfer/upload/:id", can(middleware.PermFiles), handlers.UploadAbort)
+			authorized.POST("/transfer/download-token", can(middleware.PermFiles), handlers.DownloadToken)
+			authorized.DELETE("/transfer/items/:id", audit("file.delete"), can(middleware.PermFiles), handlers.DeleteItem)
+			authorized.POST("/transfer/generate-thumb/:filename/:size", can(middleware.PermFiles), handlers.GenerateThumb)
+			authorized.POST("/transfer/regenerate-thumbs", can(middleware.PermFiles), handlers.RegenerateThumbs)
+
+			// File browser, on the shares of the system config
+			authorized.GET("/files/shares", can(middleware.PermFiles), handlers.GetFileShares)
+			authorized.GET("/files/list", can(middleware.PermFiles), handlers.ListFiles)
+			authorized.POST("/files/rename", audit("file.rename"), can(middleware.PermFiles), handlers.RenameFile)
+			authorized.POST("/files/move", audit("file.move"), can(middleware.PermFiles), handlers.MoveFiles)
+			authorized.POST("/files/copy", audit("file.copy"), can(middleware.PermFiles), handlers.CopyFiles)
+			authorized.POST("/files/delete", audit("file.delete"), can(middleware.PermFiles), handlers.DeleteFiles)
+			authorized.GET("/files/trash", can(middleware.PermFiles), handlers.GetTrash)
+			authorized.POST("/files/trash/restore", audit("file.restore"), can(middleware.PermFiles), handlers.RestoreTrash)
+			authorized.POST("/files/trash/empty", audit("file.purge"), can(middleware.PermFiles), handlers.EmptyTrash)
+			authorized.GET("/files/versions", can(middleware.PermFiles), handlers.GetFileVersions)
+			authorized.GET("/files/versions/download", can(middleware.PermFiles), handlers.DownloadFileVersion)
+			authorized.POST("/files/versions/restore", audit("file.version.restore"), can(middleware.PermFiles), handlers.RestoreFileVersion)
+			authorized.POST("/files/versions/delete", audit("file.version.delete"), can(middleware.PermFiles), handlers.DeleteFileVersions)
+			authorized.GET("/links", can(middleware.PermFiles), handlers.GetShareLinks)
+			authorized.POST("/links", audit("link.create"), can(middleware.PermFiles), handlers.CreateShareLink)
+			authorized.DELETE("/links/:token", audit("link.delete"), can(middleware.PermFiles), handlers.DeleteShareLink)
+			authorized.GET("/sftp", can(middleware.PermFiles), handlers.GetSftp)
+			authorized.POST("/sftp/keys", audit("sftp.key.add"), can(middleware.PermFiles), handlers.AddSftpKey)
+			authorized.DELETE("/sftp/keys/:id", audit("sftp.key.delete"), can(middleware.PermFiles), handlers.DeleteSftpKey)
+			authorized.GET("/files/text", can(middleware.PermFiles), handlers.GetTextFile)
+			authorized.PUT("/files/text", audit("file.edit"), can(middleware.PermFiles), handlers.SaveTextFile)
+			authorized.GET("/files/office", can(middleware.PermFiles), handlers.GetOffice)
+			authorized.POST("/files/office/open", audit("file.office.open"), can(middleware.PermFiles), handlers.OpenOfficeFile)
+			authorized.GET("/files/zip", audit("file.download"), can(middleware.PermFiles), handlers.DownloadZip)
+			authorized.GET("/files/zip/estimate", can(middleware.PermFiles), handlers.EstimateZip)
+			authorized.POST("/files/extract", audit("file.extract"), can(middleware.PermFiles), handlers.ExtractArchive)
+			authorized.POST("/files/archive", audit("file.archive"), can(middleware.PermFiles), handlers.CreateArchive)
+			authorized.GET("/files/usage", can(middleware.PermFiles), handlers.GetDiskUsage)
+			authorized.GET("/files/usage/largest", can(middleware.PermFiles), handlers.GetLargestUsage)
+			authorized.POST("/files/usage/scan", can(middleware.PermFiles), handlers.ScanDiskUsage)
+			authorized.GET("/files/tags", can(middleware.PermFiles), handlers.GetFileTags)
+			authorized.PUT("/files/tags", can(middleware.PermFiles), handlers.SetFileTags)
+			authorized.POST("/files/star", can(middleware.PermFiles), handlers.StarFiles)
+			authorized.GET("/files/starred", can(middleware.PermFiles), handlers.ListStarred)
+			authorized.GET("/files/tagged", can(middleware.PermFiles), handlers.ListTagged)
+			authorized.GET("/files/search", can(middleware.PermFiles), handlers.SearchFiles)
+			authorized.GET("/files/search/status", can(middleware.PermFiles), handlers.GetSearchStatus)
+			authorized.POST("/files/search/reindex", can(middleware.PermFiles), handlers.ReindexSearch)
+			authorized.GET("/files/photos/timeline", can(middleware.PermFiles), handlers.GetPhotoTimeline)
+			authorized.GET("/files/photos/map", can(middleware.PermFiles), handlers.GetPhotoMap)
+			authorized.GET("/files/photos/gallery", can(middleware.PermFiles), handlers.GetPhotoGallery)
+			authorized.GET("/files/photos/auto", can(middleware.PermFiles), handlers.GetAutoAlbums)
+			authorized.GET("/files/photos/albums", can(middleware.PermFiles), handlers.ListAlbums)
+			authorized.POST("/files/photos/albums", can(middleware.PermFiles), handlers.CreateAlbum)
+			authorized.PUT("/files/photos/albums/:id", can(middleware.PermFiles), handlers.UpdateAlbum)
+			authorized.DELETE("/files/photos/albums/:id", can(middleware.PermFiles), handlers.DeleteAlbum)
+			authorized.POST("/files/photos/albums/:id/items", can(middleware.PermFiles), handlers.SetAlbumItems)
+			authorized.GET("/files/photos/people", can(middleware.PermFiles), handlers.GetPhotoPeople)
+			authorized.PUT("/files/photos/people", can(middleware.PermFiles), handlers.SetPhotoPeople)
+			authorized.GET("/files/snapshots", can(middleware.PermFiles), handlers.GetShareSnapshots)
+			authorized.GET("/files/integrity", can(middleware.PermFiles), handlers.GetIntegrity)
+			authorized.POST("/files/integrity/check", can(middleware.PermFiles), handlers.CheckIntegrity)
+			authorized.DELETE("/files/integrity/check", can(middleware.PermFiles), handlers.CancelIntegrityCheck)
+			authorized.POST("/files/integrity/accept", audit("file.integrity.accept"), can(middleware.PermFiles), handlers.AcceptIntegrity)
+			authorized.GET("/files/integrity/reports/:id", can(middleware.PermFiles), handlers.DownloadIntegrityReport)
+			authorized.GET("/files/antivirus", can(middleware.PermFiles), handlers.GetAntivirus)
+			authorized.POST("/files/antivirus/scan", audit("file.scan"), can(middleware.PermFiles), handlers.ScanFolder)
+			authorized.GET("/files/antivirus/reports/:id", can(middleware.PermFiles), handlers.DownloadScanReport)
+			authorized.GET("/files/antivirus/quarantine", can(middleware.PermSystem), handlers.GetQuarantine)
+			authorized.POST("/files/antivirus/quarantine/:id/restore", audit("file.quarantine.restore"), can(middleware.PermSystem), handlers.RestoreQuarantine)
+			authorized.DELETE("/files/antivirus/quarantine/:id", audit("file.quarantine.delete"), can(middleware.PermSystem), handlers.DeleteQuarantine)
+			authorized.GET("/files/dupes", can(middleware.PermFiles), handlers.GetDuplicates)
+			authorized.POST("/files/dupes/scan", can(middleware.PermFiles), handlers.ScanDuplicates)
+			authorized.DELETE("/files/dupes/scan", can(middleware.PermFiles), handlers.CancelDuplicateScan)
+			authorized.POST("/files/dupes/action", audit("file.dedupe"), can(middleware.PermFiles), handlers.DuplicateAction)
+			authorized.GET("/files/stream", can(middleware.PermFiles), handlers.StreamFile)
+			authorized.POST("/files/hls", can(middleware.PermFiles), handlers.StartTranscode)
+			authorized.DELETE("/files/hls/:id", can(middleware.PermFiles), handlers.StopTranscode)
+			authorized.GET("/thumb", can(middleware.PermFiles), handlers.ServeThumbnail)
+			authorized.POST("/thumb/prefetch", can(middleware.PermFiles), handlers.PrefetchThumbnails)
 
 			// Config Versions
 			authorized.GET("/config-versions", handlers.GetConfigVersions)
-			authorized.POST("/config-versions", handlers.SaveConfigVersion)
-			authorized.POST("/config-versions/restore", handlers.RestoreConfigVersion)
-			authorized.DELETE("/config-versions/:id", handlers.DeleteConfigVersion)
+			authorized.POST("/config-versions", can(middleware.PermEdit), handlers.SaveConfigVersion)
+			authorized.POST("/config-versions/restore", audit("config.version.restore"), can(middleware.PermEdit), handlers.RestoreConfigVersion)
+			authorized.DELETE("/config-versions/:id", audit("config.version.delete"), can(middleware.PermEdit), handlers.DeleteConfigVersion)
 		}
+		handlers.SetOpenAPIRoutes(r.Routes(), publicRoutes)
 	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
 	}
-	log.Printf("Server starting on :%s", port)
-	if err := r.Run(":" + port); err != nil {
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		<-quit
+		timeout := shutdownTimeout()
+		serverLog.Info("Shutting down, draining requests and background tasks", "timeout", timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		// Stop accepting connections while running requests finish
+		httpDone := make(chan error, 1)
+		go func() { httpDone <- srv.Shutdown(ctx) }()
+		if err := handlers.StopBackgroundTasks(ctx); err != nil {
+			serverLog.Warn("Background tasks did not finish in time", "error", err)
+		}
+		// Closing the sockets ends long-polling requests Shutdown waits for
+		handlers.CloseSockets()
+		server.Close()
+		if err := <-httpDone; err != nil {
+			serverLog.Warn("HTTP requests did not finish in time", "error", err)
+		}
+		handlers.FlushWidgetCache()
+	}()
+
+	serverLog.Info("Server starting", "port", port)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal("Server failed to start: ", err)
 	}
-	log.Println("Server stopped")
-	select {}
+	<-stopped
+	serverLog.Info("Server stopped")
+}
+
+// shutdownTimeout is SHUTDOWN_TIMEOUT in seconds, 8 by default so shutdown
+// finishes within the 10 seconds docker stop allows
+func shutdownTimeout() time.Duration {
+	if secs, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return 8 * time.Second
 }
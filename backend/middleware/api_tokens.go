@@ -0,0 +1,273 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ApiTokenPrefix marks personal access tokens, so they are told apart from
+// login JWTs without a lookup.
+const ApiTokenPrefix = "fnat_"
+
+// Token scopes. Each one includes the ones before it.
+const (
+	ScopeRead  = "read"  // GET requests
+	ScopeWrite = "write" // Any request and socket events
+	ScopeAdmin = "admin" // Also user, token and system management
+)
+
+// Only record use once a minute so busy scripts do not rewrite the file
+const apiTokenTouchInterval = time.Minute
+
+func apiTokensFile() string {
+	return filepath.Join(config.DataDir, "api_tokens.json")
+}
+
+func loadApiTokens() ([]models.ApiToken, error) {
+	var tokens []models.ApiToken
+	if err := utils.ReadJSONUnlocked(apiTokensFile(), &tokens); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func hashApiToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsApiToken reports whether raw looks like a personal access token
+func IsApiToken(raw string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(raw, "Bearer "), ApiTokenPrefix)
+}
+
+// NormalizeScopes drops unknown scopes and duplicates. Only accounts whose
+// role manages the system may hand out the admin scope.
+func NormalizeScopes(scopes []string, username string) []string {
+	out := make([]string, 0, len(scopes))
+	seen := make(map[string]bool)
+	for _, s := range scopes {
+		s = strings.ToLower(strings.TrimSpace(s))
+		switch s {
+		case ScopeRead, ScopeWrite:
+		case ScopeAdmin:
+			if !Can(RoleOf(username), PermSystem) {
+				continue
+			}
+		default:
+			continue
+		}
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// TokenHasScope reports whether the token grants scope, directly or through
+// a broader one.
+func TokenHasScope(token models.ApiToken, scope string) bool {
+	rank := map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3}
+	for _, s := range token.Scopes {
+		if rank[s] >= rank[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateApiToken stores a new token for username and returns it together
+// with the secret, which cannot be recovered later.
+func CreateApiToken(username, name string, scopes []string, ttl time.Duration) (models.ApiToken, string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return models.ApiToken{}, "", err
+	}
+	secret := ApiTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	idBuf := make([]byte, 6)
+	if _, err := rand.Read(idBuf); err != nil {
+		return models.ApiToken{}, "", err
+	}
+	now := time.Now()
+	token := models.ApiToken{
+		ID:        hex.EncodeToString(idBuf),
+		Name:      name,
+		Username:  username,
+		Scopes:    scopes,
+		Hash:      hashApiToken(secret),
+		Hint:      secret[len(secret)-4:],
+		CreatedAt: now.UnixMilli(),
+	}
+	if ttl > 0 {
+		token.ExpiresAt = now.Add(ttl).UnixMilli()
+	}
+	err := utils.WithFileLock(apiTokensFile(), func() error {
+		tokens, err := loadApiTokens()
+		if err != nil {
+			return err
+		}
+		return utils.WriteJSONUnlocked(apiTokensFile(), append(tokens, token))
+	})
+	if err != nil {
+		return models.ApiToken{}, "", err
+	}
+	token.Hash = ""
+	return token, secret, nil
+}
+
+// ListApiTokens returns the tokens of username without their hashes
+func ListApiTokens(username string) ([]models.ApiToken, error) {
+	var list []models.ApiToken
+	err := utils.WithFileLock(apiTokensFile(), func() error {
+		tokens, err := loadApiTokens()
+		if err != nil {
+			return err
+		}
+		list = make([]models.ApiToken, 0, len(tokens))
+		for _, t := range tokens {
+			if t.Username == username {
+				t.Hash = ""
+				list = append(list, t)
+			}
+		}
+		return nil
+	})
+	return list, err
+}
+
+// RevokeApiToken deletes a token of username. It reports whether one was found.
+func RevokeApiToken(username, id string) (bool, error) {
+	found := false
+	err := utils.WithFileLock(apiTokensFile(), func() error {
+		tokens, err := loadApiTokens()
+		if err != nil {
+			return err
+		}
+		kept := tokens[:0]
+		for _, t := range tokens {
+			if t.ID == id && t.Username == username {
+				found = true
+				continue
+			}
+			kept = append(kept, t)
+		}
+		if !found {
+			return nil
+		}
+		return utils.WriteJSONUnlocked(apiTokensFile(), kept)
+	})
+	return found, err
+}
+
+// RevokeUserApiTokens deletes every token of username, for removed accounts
+func RevokeUserApiTokens(username string) error {
+	return utils.WithFileLock(apiTokensFile(), func() error {
+		tokens, err := loadApiTokens()
+		if err != nil {
+			return err
+		}
+		kept := tokens[:0]
+		for _, t := range tokens {
+			if t.Username != username {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == len(tokens) {
+			return nil
+		}
+		return utils.WriteJSONUnlocked(apiTokensFile(), kept)
+	})
+}
+
+// LookupApiToken finds the unexpired token for raw and records its use
+func LookupApiToken(raw string) (models.ApiToken, bool) {
+	raw = strings.TrimPrefix(raw, "Bearer ")
+	if !strings.HasPrefix(raw, ApiTokenPrefix) {
+		return models.ApiToken{}, false
+	}
+	hash := hashApiToken(raw)
+	var match models.ApiToken
+	found := false
+	_ = utils.WithFileLock(apiTokensFile(), func() error {
+		tokens, err := loadApiTokens()
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixMilli()
+		for i := range tokens {
+			if subtle.ConstantTimeCompare([]byte(tokens[i].Hash), []byte(hash)) != 1 {
+				continue
+			}
+			if tokens[i].ExpiresAt > 0 && tokens[i].ExpiresAt <= now {
+				return nil
+			}
+			found = true
+			if now-tokens[i].LastUsedAt >= apiTokenTouchInterval.Milliseconds() {
+				tokens[i].LastUsedAt = now
+				_ = utils.WriteJSONUnlocked(apiTokensFile(), tokens)
+			}
+			match = tokens[i]
+			return nil
+		}
+		return nil
+	})
+	match.Hash = ""
+	return match, found
+}
+
+// apiTokenPermits checks the token's scopes against the request method.
+// Routes that need more ask for it with RequireScope or RequirePermission.
+func apiTokenPermits(token models.ApiToken, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return TokenHasScope(token, ScopeRead)
+	}
+	return TokenHasScope(token, ScopeWrite)
+}
+
+// PermissionScope is the token scope perm needs on top of the one for the
+// request method: managing the system takes the admin scope.
+func PermissionScope(perm string) string {
+	if perm == PermSystem {
+		return ScopeAdmin
+	}
+	return ScopeRead
+}
+
+// tokenAllows reports whether the request may use scope. Logins are not
+// scoped; for personal access tokens the token decides.
+func tokenAllows(c *gin.Context, scope string) bool {
+	v, ok := c.Get("apiTokenScopes")
+	if !ok {
+		return true
+	}
+	scopes, _ := v.([]string)
+	return TokenHasScope(models.ApiToken{Scopes: scopes}, scope)
+}
+
+// RequireScope refuses personal access tokens without scope, for routes
+// that manage the account itself, like tokens and 2FA. It runs after
+// AuthMiddleware.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tokenAllows(c, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token scope does not allow this request"})
+			return
+		}
+		c.Next()
+	}
+}
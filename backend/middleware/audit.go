@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/logging"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The audit log is JSON lines; once it passes this size it becomes
+// audit.jsonl.1, replacing the previous one
+const auditMaxSize = 5 << 20
+
+// Cap on entries one query returns
+const auditMaxQuery = 1000
+
+var auditLog = logging.For("audit")
+
+var auditHooks struct {
+	sync.Mutex
+	fns []func(models.AuditEntry)
+}
+
+// OnAudit calls fn with every entry recorded from now on, e.g. to fire
+// webhooks on failed logins. fn runs on the request goroutine.
+func OnAudit(fn func(models.AuditEntry)) {
+	auditHooks.Lock()
+	auditHooks.fns = append(auditHooks.fns, fn)
+	auditHooks.Unlock()
+}
+
+func auditFile() string {
+	return filepath.Join(config.DataDir, "audit.jsonl")
+}
+
+// RecordAudit appends an entry to the audit log. Failures are logged, not
+// returned, so auditing never breaks the action itself.
+func RecordAudit(entry models.AuditEntry) {
+	if entry.Time == 0 {
+		entry.Time = time.Now().UnixMilli()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	path := auditFile()
+	err = utils.WithFileLock(path, func() error {
+		if info, err := os.Stat(path); err == nil && info.Size()+int64(len(line)) > auditMaxSize {
+			if err := os.Rename(path, path+".1"); err != nil {
+				return err
+			}
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(append(line, '\n'))
+		return err
+	})
+	if err != nil {
+		auditLog.Error("Failed to write audit log", "action", entry.Action, "error", err)
+	}
+	auditHooks.Lock()
+	fns := auditHooks.fns
+	auditHooks.Unlock()
+	for _, fn := range fns {
+		fn(entry)
+	}
+}
+
+// AuditQuery filters the audit log. Action matches a prefix, so "user"
+// finds "user.delete" and "user.role". Since and Until are Unix ms.
+type AuditQuery struct {
+	User    string
+	Action  string
+	Since   int64
+	Until   int64
+	Success *bool
+	Limit   int
+}
+
+// QueryAudit returns matching entries, newest first
+func QueryAudit(q AuditQuery) ([]models.AuditEntry, error) {
+	limit := q.Limit
+	if limit <= 0 || limit > auditMaxQuery {
+		limit = auditMaxQuery
+	}
+	var entries []models.AuditEntry
+	path := auditFile()
+	err := utils.WithFileLock(path, func() error {
+		for _, p := range []string{path + ".1", path} {
+			if err := readAuditFile(p, q, &entries); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time > entries[j].Time })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func readAuditFile(path string, q AuditQuery, entries *[]models.AuditEntry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e models.AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if q.User != "" && e.User != q.User {
+			continue
+		}
+		if q.Action != "" && e.Action != q.Action && !strings.HasPrefix(e.Action, q.Action+".") {
+			continue
+		}
+		if (q.Since > 0 && e.Time < q.Since) || (q.Until > 0 && e.Time > q.Until) {
+			continue
+		}
+		if q.Success != nil && e.Success != *q.Success {
+			continue
+		}
+		*entries = append(*entries, e)
+	}
+	return scanner.Err()
+}
+
+// Audit records action once the handler has run. The user is the logged in
+// account, or for logins the name the handler stored as "auditUser"; the
+// target is "auditTarget" if the handler set one, else the route parameters.
+func Audit(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		user := c.GetString("username")
+		if user == "" {
+			user = c.GetString("auditUser")
+		}
+		entry := models.AuditEntry{
+			User:    user,
+			IP:      c.ClientIP(),
+			Action:  action,
+			Target:  c.GetString("auditTarget"),
+			Success: c.Writer.Status() < 400,
+		}
+		if entry.Target == "" {
+			var target []string
+			for _, p := range c.Params {
+				target = append(target, p.Key+"="+p.Value)
+			}
+			entry.Target = strings.Join(target, " ")
+		}
+		if details, ok := c.Get("auditDetails"); ok {
+			entry.Details, _ = details.(map[string]string)
+		}
+		RecordAudit(entry)
+	}
+}
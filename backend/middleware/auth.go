@@ -10,13 +10,7 @@ import (
 )
 
 func parseToken(c *gin.Context) (*jwt.Token, error) {
-	tokenString := c.GetHeader("Authorization")
-	if tokenString == "" {
-		tokenString = c.Query("token")
-	} else {
-		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-	}
-
+	tokenString := rawToken(c)
 	if tokenString == "" {
 		return nil, nil
 	}
@@ -30,29 +24,87 @@ func parseToken(c *gin.Context) (*jwt.Token, error) {
 	)
 }
 
+// tokenUsername is the user a valid login token was issued to. Tokens
+// without a username, like those of other services signed with the same
+// secret, are not login tokens.
+func tokenUsername(token *jwt.Token) (string, bool) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+	username, ok := claims["username"].(string)
+	return username, ok && username != ""
+}
+
+func rawToken(c *gin.Context) string {
+	tokenString := c.GetHeader("Authorization")
+	if tokenString == "" {
+		return c.Query("token")
+	}
+	return strings.TrimPrefix(tokenString, "Bearer ")
+}
+
+// authenticateApiToken handles personal access tokens. ok is false for an
+// unknown or expired token; permitted is false when its scopes do not cover
+// the request.
+func authenticateApiToken(c *gin.Context) (username string, ok, permitted bool) {
+	token, ok := LookupApiToken(rawToken(c))
+	if !ok {
+		return "", false, false
+	}
+	c.Set("apiTokenId", token.ID)
+	c.Set("apiTokenScopes", token.Scopes)
+	return token.Username, true, apiTokenPermits(token, c.Request)
+}
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if IsApiToken(rawToken(c)) {
+			username, ok, permitted := authenticateApiToken(c)
+			if !ok {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+				return
+			}
+			if !permitted {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token scope does not allow this request"})
+				return
+			}
+			c.Set("username", username)
+			c.Next()
+			return
+		}
+
 		token, err := parseToken(c)
 
 		if err != nil || token == nil || !token.Valid {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			return
 		}
-
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			c.Set("username", claims["username"])
+		username, ok := tokenUsername(token)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
 		}
+		c.Set("username", username)
 		c.Next()
 	}
 }
 
 func OptionalAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if IsApiToken(rawToken(c)) {
+			if username, ok, permitted := authenticateApiToken(c); ok && permitted {
+				c.Set("username", username)
+			}
+			c.Next()
+			return
+		}
+
 		token, err := parseToken(c)
 
 		if err == nil && token != nil && token.Valid {
-			if claims, ok := token.Claims.(jwt.MapClaims); ok {
-				c.Set("username", claims["username"])
+			if username, ok := tokenUsername(token); ok {
+				c.Set("username", username)
 			}
 		}
 		c.Next()
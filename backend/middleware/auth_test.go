@@ -1,10 +1,16 @@
 package middleware
 
 import (
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -59,3 +65,245 @@ func TestParseTokenAcceptsHS256(t *testing.T) {
 		t.Fatalf("expected valid token, got err=%v", err)
 	}
 }
+
+func TestAuthMiddlewareNeedsUsername(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config.SecretKey = []byte("test-secret")
+
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.GET("/", func(c *gin.Context) { c.String(200, c.GetString("username")) })
+	for claims, want := range map[string]int{`{"username":"alice"}`: 200, `{"link":"abc","sub":"share-link"}`: 401, `{"username":""}`: 401} {
+		var m jwt.MapClaims
+		json.Unmarshal([]byte(claims), &m)
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, m).SignedString([]byte(config.GetSecretKeyString()))
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+signed)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("claims %s: expected %d, got %d", claims, want, w.Code)
+		}
+	}
+}
+
+func TestApiTokenScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prev := config.DataDir
+	config.DataDir = t.TempDir()
+	defer func() { config.DataDir = prev }()
+
+	_, secret, err := CreateApiToken("admin", "ha", []string{ScopeRead}, 0)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.GET("/api/data", func(c *gin.Context) { c.String(200, c.GetString("username")) })
+	r.POST("/api/save", func(c *gin.Context) { c.String(200, "ok") })
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	if w := do("GET", "/api/data", secret); w.Code != 200 || w.Body.String() != "admin" {
+		t.Fatalf("expected read token to pass GET, got %d %q", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/save", secret); w.Code != 403 {
+		t.Fatalf("expected read token to be refused for POST, got %d", w.Code)
+	}
+	if w := do("GET", "/api/data", secret+"x"); w.Code != 401 {
+		t.Fatalf("expected unknown token to be rejected, got %d", w.Code)
+	}
+
+	// Managing the system takes the admin scope, whatever the path
+	r.POST("/api/widgets/system", RequirePermission(PermSystem), func(c *gin.Context) { c.String(200, "ok") })
+	r.GET("/api/tokens", RequireScope(ScopeAdmin), func(c *gin.Context) { c.String(200, "ok") })
+	_, writer, _ := CreateApiToken("admin", "script", []string{ScopeWrite}, 0)
+	_, admin, _ := CreateApiToken("admin", "ops", NormalizeScopes([]string{ScopeAdmin}, "admin"), 0)
+	for token, want := range map[string]int{writer: 403, admin: 200} {
+		if w := do("POST", "/api/widgets/system", token); w.Code != want {
+			t.Fatalf("system permission: expected %d, got %d", want, w.Code)
+		}
+		if w := do("GET", "/api/tokens", token); w.Code != want {
+			t.Fatalf("admin scope route: expected %d, got %d", want, w.Code)
+		}
+	}
+	if scopes := NormalizeScopes([]string{ScopeAdmin, ScopeRead}, "mom"); len(scopes) != 1 || scopes[0] != ScopeRead {
+		t.Fatalf("expected a user without the system permission to lose the admin scope, got %v", scopes)
+	}
+
+	tokens, _ := ListApiTokens("admin")
+	if len(tokens) != 3 || tokens[0].Hash != "" {
+		t.Fatalf("expected three listed tokens without hash, got %+v", tokens)
+	}
+	if ok, _ := RevokeApiToken("admin", tokens[0].ID); !ok {
+		t.Fatalf("expected revoke to find the token")
+	}
+	if w := do("GET", "/api/data", secret); w.Code != 401 {
+		t.Fatalf("expected revoked token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prev := config.DataDir
+	config.DataDir = t.TempDir()
+	defer func() { config.DataDir = prev }()
+
+	if RoleOf("") != RoleGuest || RoleOf("admin") != RoleAdmin || RoleOf("kid") != RoleUser {
+		t.Fatalf("unexpected default roles")
+	}
+	if err := SetRole("kid", RoleGuest); err != nil {
+		t.Fatalf("set role: %v", err)
+	}
+	if err := SetRole("admin", RoleGuest); err == nil {
+		t.Fatalf("expected admin role to be fixed")
+	}
+
+	r := gin.New()
+	r.POST("/files", func(c *gin.Context) { c.Set("username", c.Query("u")) }, RequirePermission(PermFiles), func(c *gin.Context) { c.String(200, "ok") })
+	for user, want := range map[string]int{"kid": 403, "mom": 200, "": 403, "admin": 200} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/files?u="+user, nil))
+		if w.Code != want {
+			t.Fatalf("user %q: expected %d, got %d", user, want, w.Code)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := NewRateLimiter(60, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("1.2.3.4", 1); !ok {
+			t.Fatalf("request %d should fit in the burst", i)
+		}
+	}
+	ok, wait := l.Allow("1.2.3.4", 1)
+	if ok || wait != time.Second {
+		t.Fatalf("expected refusal with 1s wait, got %v %v", ok, wait)
+	}
+	if ok, _ := l.Allow("5.6.7.8", 1); !ok {
+		t.Fatalf("other keys have their own bucket")
+	}
+	now = now.Add(2 * time.Second)
+	if ok, _ := l.Allow("1.2.3.4", 2); !ok {
+		t.Fatalf("expected bucket to refill")
+	}
+	if ok, _ := l.Allow("1.2.3.4", 5); ok {
+		t.Fatalf("expected expensive call to be refused on an empty bucket")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	prev := config.SystemConfigFile
+	config.SystemConfigFile = filepath.Join(t.TempDir(), "system.json")
+	defer func() {
+		config.SystemConfigFile = prev
+		LoadTrustedProxies()
+	}()
+
+	header := http.Header{"X-Forwarded-For": {"1.1.1.1, 10.0.0.7"}, "X-Real-Ip": {"2.2.2.2"}}
+	if ip := ClientIP("10.0.0.5:4000", header); ip != "10.0.0.5" {
+		t.Fatalf("expected forwarding headers to be ignored by default, got %s", ip)
+	}
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{TrustedProxies: []string{"10.0.0.0/24", "bogus"}})
+	if list := LoadTrustedProxies(); len(list) != 1 {
+		t.Fatalf("expected the invalid entry to be dropped, got %v", list)
+	}
+	if ip := ClientIP("10.0.0.5:4000", header); ip != "1.1.1.1" {
+		t.Fatalf("expected the first untrusted hop, got %s", ip)
+	}
+	if ip := ClientIP("8.8.8.8:4000", header); ip != "8.8.8.8" {
+		t.Fatalf("expected an untrusted peer to be the client, got %s", ip)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prev := config.DataDir
+	config.DataDir = t.TempDir()
+	defer func() { config.DataDir = prev }()
+
+	r := gin.New()
+	r.DELETE("/users/:usr", func(c *gin.Context) { c.Set("username", c.Query("u")) }, Audit("user.delete"), func(c *gin.Context) {
+		if c.GetString("username") != "admin" {
+			c.AbortWithStatus(403)
+		}
+	})
+	r.POST("/login", Audit("login"), func(c *gin.Context) { c.Set("auditUser", "bob") })
+	for _, target := range []string{"/users/bob?u=admin", "/users/carol?u=mallory"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", target, nil))
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil))
+
+	entries, err := QueryAudit(AuditQuery{Action: "user"})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 user entries, got %d (%v)", len(entries), err)
+	}
+	failed := false
+	denied, _ := QueryAudit(AuditQuery{Success: &failed})
+	if len(denied) != 1 || denied[0].User != "mallory" || denied[0].Target != "usr=carol" {
+		t.Fatalf("unexpected failed entries: %+v", denied)
+	}
+	logins, _ := QueryAudit(AuditQuery{User: "bob"})
+	if len(logins) != 1 || logins[0].Action != "login" || !logins[0].Success {
+		t.Fatalf("unexpected login entries: %+v", logins)
+	}
+}
+
+func TestLocalizeErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	SetUserLocale(func(username string) string {
+		if username == "alice" {
+			return "zh"
+		}
+		return ""
+	})
+	defer SetUserLocale(nil)
+
+	r := gin.New()
+	r.Use(Localize())
+	r.GET("/fail", func(c *gin.Context) {
+		c.Set("username", c.Query("u"))
+		c.JSON(400, gin.H{"error": "url is required"})
+	})
+	r.GET("/ok", func(c *gin.Context) { c.JSON(200, gin.H{"error": "url is required"}) })
+	r.GET("/other", func(c *gin.Context) { c.JSON(500, gin.H{"error": "disk on fire"}) })
+
+	get := func(target, lang string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept-Language", lang)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid body %q: %v", w.Body.String(), err)
+		}
+		return w.Code, body
+	}
+
+	if code, body := get("/fail", "zh-CN,zh;q=0.9,en;q=0.8"); code != 400 || body["error"] != "请输入 URL" || body["code"] != "url_required" {
+		t.Fatalf("unexpected zh response %d %v", code, body)
+	}
+	if _, body := get("/fail", "fr-FR, en;q=0.5"); body["error"] != "url is required" || body["code"] != "url_required" {
+		t.Fatalf("unexpected en response %v", body)
+	}
+	// The user's own setting wins over the browser
+	if _, body := get("/fail?u=alice", "en-US"); body["error"] != "请输入 URL" {
+		t.Fatalf("expected the user locale, got %v", body)
+	}
+	if _, body := get("/ok", "zh"); body["error"] != "url is required" || body["code"] != nil {
+		t.Fatalf("success responses must pass through, got %v", body)
+	}
+	if _, body := get("/other", "zh"); body["error"] != "disk on fire" || body["code"] != nil {
+		t.Fatalf("unknown messages must pass through, got %v", body)
+	}
+}
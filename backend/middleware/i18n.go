@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"flatnasgo-backend/i18n"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var userLocale struct {
+	sync.RWMutex
+	fn func(username string) string
+}
+
+// SetUserLocale installs the lookup of a user's chosen locale, which wins
+// over the browser's Accept-Language
+func SetUserLocale(fn func(username string) string) {
+	userLocale.Lock()
+	userLocale.fn = fn
+	userLocale.Unlock()
+}
+
+// LocaleFor picks the locale for a user and an Accept-Language header
+func LocaleFor(username, acceptLanguage string) string {
+	if username != "" {
+		userLocale.RLock()
+		fn := userLocale.fn
+		userLocale.RUnlock()
+		if fn != nil {
+			if l := i18n.Normalize(fn(username)); l != "" {
+				return l
+			}
+		}
+	}
+	if l := i18n.Negotiate(acceptLanguage); l != "" {
+		return l
+	}
+	return i18n.Default
+}
+
+// RequestLocale is the locale responses to c are written in
+func RequestLocale(c *gin.Context) string {
+	return LocaleFor(c.GetString("username"), c.GetHeader("Accept-Language"))
+}
+
+// Localize translates the "error" of JSON error responses into the
+// request's locale and adds its stable "code", so clients can match on the
+// code whatever the language. Other responses pass through untouched.
+func Localize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w := &localizeWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		// Restore the writer even on panic so the recovery handler can answer
+		defer func() { c.Writer = w.ResponseWriter }()
+		c.Next()
+		if w.buffering {
+			w.ResponseWriter.Write(localizeErrorBody(w.buf.Bytes(), RequestLocale(c)))
+		}
+	}
+}
+
+// localizeWriter holds back JSON bodies of error responses until the
+// handler is done; the locale may depend on the user the handler saw
+type localizeWriter struct {
+	gin.ResponseWriter
+	buf       bytes.Buffer
+	buffering bool
+}
+
+func (w *localizeWriter) shouldBuffer() bool {
+	return w.buffering || (w.Status() >= http.StatusBadRequest &&
+		strings.HasPrefix(w.Header().Get("Content-Type"), "application/json"))
+}
+
+func (w *localizeWriter) Write(data []byte) (int, error) {
+	if !w.shouldBuffer() {
+		return w.ResponseWriter.Write(data)
+	}
+	w.buffering = true
+	return w.buf.Write(data)
+}
+
+func (w *localizeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func localizeErrorBody(body []byte, locale string) []byte {
+	var payload map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return body
+	}
+	message, ok := payload["error"].(string)
+	if !ok {
+		return body
+	}
+	code, text := i18n.Translate(locale, message)
+	payload["error"] = text
+	if _, has := payload["code"]; !has && code != "" {
+		payload["code"] = code
+	}
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return body
+	}
+	return out
+}
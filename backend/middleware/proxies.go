@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	trustedProxiesMu sync.RWMutex
+	trustedProxies   []*net.IPNet
+)
+
+// LoadTrustedProxies reads systemConfig.trustedProxies, the addresses or
+// CIDR ranges of reverse proxies whose X-Forwarded-For and X-Real-Ip
+// headers name the client. It is empty by default, so the peer address is
+// the client and a client cannot pick the IP its rate limit is keyed on.
+// The list is also what gin's SetTrustedProxies takes.
+func LoadTrustedProxies() []string {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	var list []string
+	var nets []*net.IPNet
+	for _, entry := range sysConfig.TrustedProxies {
+		entry = strings.TrimSpace(entry)
+		ipNet := parseProxyNet(entry)
+		if ipNet == nil {
+			continue
+		}
+		list = append(list, entry)
+		nets = append(nets, ipNet)
+	}
+	trustedProxiesMu.Lock()
+	trustedProxies = nets
+	trustedProxiesMu.Unlock()
+	return list
+}
+
+func parseProxyNet(entry string) *net.IPNet {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	_, ipNet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil
+	}
+	return ipNet
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	trustedProxiesMu.RLock()
+	defer trustedProxiesMu.RUnlock()
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP finds the client of a connection the way gin's ClientIP does:
+// the peer address, unless the peer is a trusted proxy, in which case the
+// last X-Forwarded-For hop that is not a trusted proxy, or X-Real-Ip.
+func ClientIP(remoteAddr string, header http.Header) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !isTrustedProxy(peer) {
+		return host
+	}
+	if fwd := header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(ip) {
+				return ip.String()
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(header.Get("X-Real-Ip"))); ip != nil {
+		return ip.String()
+	}
+	return host
+}
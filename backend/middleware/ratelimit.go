@@ -0,0 +1,187 @@
+package middleware
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default limits. The dashboard makes a burst of requests on load and then
+// only a few a minute, so these leave plenty of room for several tabs.
+var defaultRateLimits = models.RateLimitSettings{
+	RestPerMinute:     600,
+	RestBurst:         120,
+	SocketPerMinute:   120,
+	SocketBurst:       40,
+	SocketIPPerMinute: 300,
+	SocketIPBurst:     80,
+}
+
+// Buckets idle this long are full again and can be dropped
+const rateLimitSweepInterval = 5 * time.Minute
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a set of token buckets, one per key
+type RateLimiter struct {
+	mu        sync.Mutex
+	perSecond float64
+	burst     float64
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	l := &RateLimiter{buckets: make(map[string]*rateBucket), now: time.Now}
+	l.SetLimits(perMinute, burst)
+	return l
+}
+
+// SetLimits changes the rate and bucket size, keeping the current buckets
+func (l *RateLimiter) SetLimits(perMinute, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perSecond = float64(perMinute) / 60
+	l.burst = float64(burst)
+}
+
+// Allow takes cost tokens from key's bucket. When there are not enough it
+// returns false and how long until there will be.
+func (l *RateLimiter) Allow(key string, cost int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	want := math.Min(float64(cost), l.burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.perSecond)
+		b.last = now
+	}
+	if b.tokens >= want {
+		b.tokens -= want
+		return true, 0
+	}
+	if l.perSecond <= 0 {
+		return false, time.Minute
+	}
+	return false, time.Duration((want - b.tokens) / l.perSecond * float64(time.Second))
+}
+
+// Forget drops key's bucket, e.g. when a socket disconnects
+func (l *RateLimiter) Forget(key string) {
+	l.mu.Lock()
+	delete(l.buckets, key)
+	l.mu.Unlock()
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.perSecond >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+var (
+	rateLimitMu     sync.Mutex
+	rateLimitLoaded bool
+	rateLimitStamp  string
+	rateLimitConfig models.RateLimitSettings
+	restLimiter     = NewRateLimiter(defaultRateLimits.RestPerMinute, defaultRateLimits.RestBurst)
+	socketLimiter   = NewRateLimiter(defaultRateLimits.SocketPerMinute, defaultRateLimits.SocketBurst)
+	socketIPLimiter = NewRateLimiter(defaultRateLimits.SocketIPPerMinute, defaultRateLimits.SocketIPBurst)
+)
+
+// currentRateLimits returns the limits from system.json with defaults
+// filled in, rereading the file only when it changed.
+func currentRateLimits() models.RateLimitSettings {
+	stamp := ""
+	if mod, err := utils.ModTime(config.SystemConfigFile); err == nil {
+		stamp = fmt.Sprint(mod.UnixNano())
+	}
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	if rateLimitLoaded && stamp == rateLimitStamp {
+		return rateLimitConfig
+	}
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	limits := defaultRateLimits
+	if r := sysConfig.RateLimit; r != nil {
+		limits.Disable = r.Disable
+		pick := func(dst *int, v int) {
+			if v > 0 {
+				*dst = v
+			}
+		}
+		pick(&limits.RestPerMinute, r.RestPerMinute)
+		pick(&limits.RestBurst, r.RestBurst)
+		pick(&limits.SocketPerMinute, r.SocketPerMinute)
+		pick(&limits.SocketBurst, r.SocketBurst)
+		pick(&limits.SocketIPPerMinute, r.SocketIPPerMinute)
+		pick(&limits.SocketIPBurst, r.SocketIPBurst)
+	}
+	restLimiter.SetLimits(limits.RestPerMinute, limits.RestBurst)
+	socketLimiter.SetLimits(limits.SocketPerMinute, limits.SocketBurst)
+	socketIPLimiter.SetLimits(limits.SocketIPPerMinute, limits.SocketIPBurst)
+	rateLimitLoaded = true
+	rateLimitStamp = stamp
+	rateLimitConfig = limits
+	return limits
+}
+
+// RateLimitMiddleware answers 429 once a source IP uses up its bucket
+func RateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if currentRateLimits().Disable {
+			c.Next()
+			return
+		}
+		if ok, wait := restLimiter.Allow(c.ClientIP(), 1); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// AllowSocketEvent charges an event to its connection and source IP. connID
+// may be empty for callers without a lasting connection.
+func AllowSocketEvent(connID, ip string, cost int) bool {
+	if currentRateLimits().Disable {
+		return true
+	}
+	if ok, _ := socketIPLimiter.Allow(ip, cost); !ok {
+		return false
+	}
+	if connID == "" {
+		return true
+	}
+	ok, _ := socketLimiter.Allow(connID, cost)
+	return ok
+}
+
+// ForgetSocketConn drops a closed connection's bucket
+func ForgetSocketConn(connID string) {
+	socketLimiter.Forget(connID)
+}
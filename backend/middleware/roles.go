@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles. The admin account is always admin; other accounts are users unless
+// the admin makes them guests. Requests without a login are guests too.
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+	RoleGuest = "guest"
+)
+
+// Permissions checked by routes and socket events
+const (
+	PermView   = "view"   // Dashboards, widgets and feeds
+	PermEdit   = "edit"   // Change one's own layout, memos and feed state
+	PermFiles  = "files"  // Upload, delete and transfer files
+	PermDocker = "docker" // Manage containers
+	PermSystem = "system" // Users, system settings and network
+)
+
+var rolePermissions = map[string]map[string]bool{
+	RoleAdmin: {PermView: true, PermEdit: true, PermFiles: true, PermDocker: true, PermSystem: true},
+	RoleUser:  {PermView: true, PermEdit: true, PermFiles: true},
+	RoleGuest: {PermView: true},
+}
+
+func rolesFile() string {
+	return filepath.Join(config.DataDir, "roles.json")
+}
+
+func loadRoles() map[string]string {
+	roles := make(map[string]string)
+	if err := utils.ReadJSON(rolesFile(), &roles); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}
+	}
+	return roles
+}
+
+// RoleOf returns the role of an account; "" is an anonymous guest
+func RoleOf(username string) string {
+	switch username {
+	case "":
+		return RoleGuest
+	case "admin":
+		return RoleAdmin
+	}
+	if loadRoles()[username] == RoleGuest {
+		return RoleGuest
+	}
+	return RoleUser
+}
+
+// Roles returns the roles of every account that is not a plain user
+func Roles() map[string]string {
+	return loadRoles()
+}
+
+// SetRole makes an account a user or a guest
+func SetRole(username, role string) error {
+	if username == "" || username == "admin" {
+		return errors.New("the admin role cannot be changed")
+	}
+	if role != RoleUser && role != RoleGuest {
+		return errors.New("role must be user or guest")
+	}
+	return utils.WithFileLock(rolesFile(), func() error {
+		roles := make(map[string]string)
+		if err := utils.ReadJSONUnlocked(rolesFile(), &roles); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if role == RoleUser {
+			delete(roles, username)
+		} else {
+			roles[username] = role
+		}
+		return utils.WriteJSONUnlocked(rolesFile(), roles)
+	})
+}
+
+// Can reports whether role grants perm
+func Can(role, perm string) bool {
+	return rolePermissions[role][perm]
+}
+
+// RequirePermission refuses requests whose account lacks perm, or whose
+// personal access token lacks the scope for it. It runs after
+// AuthMiddleware or OptionalAuthMiddleware.
+func RequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !Can(RoleOf(c.GetString("username")), perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			return
+		}
+		if !tokenAllows(c, PermissionScope(perm)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token scope does not allow this request"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -69,6 +69,9 @@ type AppConfig struct {
 	Theme                 string          `json:"theme,omitempty"`
 	CustomCss             string          `json:"customCss,omitempty"`
 	CustomJs              string          `json:"customJs,omitempty"`
+	// Locale of error messages for this user, e.g. "zh"; empty follows the
+	// browser's Accept-Language
+	Locale string `json:"locale,omitempty"`
 }
 
 type WallpaperConfig struct {
@@ -82,11 +85,373 @@ type SystemConfig struct {
 	AuthMode     string `json:"authMode"` // "single" or "multi"
 	EnableDocker bool   `json:"enableDocker"`
 	DockerHost   string `json:"dockerHost,omitempty"`
+	// Proxy for outbound fetches; takes precedence over PROXY_URL/HTTP_PROXY
+	Proxy *ProxySettings `json:"proxy,omitempty"`
+	// Proxies are tried in order; a failing one is skipped for a cooldown
+	Proxies []ProxySettings `json:"proxies,omitempty"`
+	// ProxyRules limits which hosts go through the proxy
+	ProxyRules *ProxyRules `json:"proxyRules,omitempty"`
+	// OutboundGuard controls which addresses user-supplied URLs may reach
+	OutboundGuard *OutboundGuard `json:"outboundGuard,omitempty"`
+	// Oidc enables single sign-on through an OpenID Connect provider
+	Oidc *OidcSettings `json:"oidc,omitempty"`
+	// Ldap lets directory users log in with their directory password
+	Ldap *LdapSettings `json:"ldap,omitempty"`
+	// RateLimit caps how fast one client may call the API and emit events
+	RateLimit *RateLimitSettings `json:"rateLimit,omitempty"`
+	// TrustedProxies are the reverse proxies, as IPs or CIDR ranges, allowed
+	// to name the client in X-Forwarded-For. Read at startup.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// Backup schedules encrypted configuration backups
+	Backup *BackupSettings `json:"backup,omitempty"`
+	// RealtimeTransport is "socketio" (default) or "websocket", the plain
+	// WebSocket endpoint /ws for setups where socket.io drops connections
+	RealtimeTransport string `json:"realtimeTransport,omitempty"`
+	// Locale of notifications and other messages sent outside a request
+	Locale string `json:"locale,omitempty"`
+	// Shares are the host folders the file browser may reach
+	Shares []FileShare `json:"shares,omitempty"`
+	// TrashDays is how long deleted files stay in a share's recycle bin,
+	// defaults to 30
+	TrashDays int `json:"trashDays,omitempty"`
+	// StreamRateLimit caps each media stream in KiB/s; 0 is unlimited
+	StreamRateLimit int `json:"streamRateLimit,omitempty"`
+	// Transcode configures HLS transcoding of videos browsers cannot play
+	Transcode *TranscodeSettings `json:"transcode,omitempty"`
+	// EnableWebDAV serves the shares over WebDAV at /dav
+	EnableWebDAV bool `json:"enableWebdav,omitempty"`
+	// EnableSearchIndex indexes the shares for file search
+	EnableSearchIndex bool `json:"enableSearchIndex,omitempty"`
+	// Sftp runs an SFTP listener for the shares
+	Sftp *SftpSettings `json:"sftp,omitempty"`
+	// Integrity schedules checksum verification of the shares
+	Integrity *IntegritySettings `json:"integrity,omitempty"`
+	// Quotas limit the size of shares and of each user's transfer files
+	Quotas *QuotaSettings `json:"quotas,omitempty"`
+	// Antivirus scans uploads and folders with ClamAV's clamd
+	Antivirus *AntivirusSettings `json:"antivirus,omitempty"`
+	// Office opens documents in Collabora Online or OnlyOffice over WOPI
+	Office *OfficeSettings `json:"office,omitempty"`
+	// Music indexes folders into a library for the player and Subsonic apps
+	Music *MusicSettings `json:"music,omitempty"`
+	// Versions keep the previous contents of files when they are overwritten
+	Versions *VersionSettings `json:"versions,omitempty"`
+	// Smart polls the health of the disks with smartctl
+	Smart *SmartSettings `json:"smart,omitempty"`
+	// Raid sends the alerts of the md arrays
+	Raid *RaidSettings `json:"raid,omitempty"`
+	// Zpool sends the alerts of the ZFS pools
+	Zpool *ZpoolSettings `json:"zpool,omitempty"`
+}
+
+// RaidSettings control the alerts of degraded RAID arrays
+type RaidSettings struct {
+	Channels []string `json:"channels,omitempty"` // Alert channels, all when empty
+}
+
+// ZpoolSettings control the alerts of unhealthy ZFS pools
+type ZpoolSettings struct {
+	Channels []string `json:"channels,omitempty"` // Alert channels, all when empty
+}
+
+// SmartSettings control the disk health checks
+type SmartSettings struct {
+	Enable          bool     `json:"enable"`
+	IntervalMinutes int      `json:"intervalMinutes,omitempty"` // Defaults to 30
+	MaxTemperature  int      `json:"maxTemperature,omitempty"`  // °C that raises an alert, defaults to 60
+	Channels        []string `json:"channels,omitempty"`        // Alert channels, all when empty
+}
+
+// VersionSettings keep what a file held before it was overwritten from
+// the browser, the editors, WebDAV or SFTP. Shares override the retention
+// by share name.
+type VersionSettings struct {
+	Enable    bool                        `json:"enable"`
+	Keep      int                         `json:"keep,omitempty"`      // Versions per file, defaults to 10
+	Days      int                         `json:"days,omitempty"`      // Age at which versions go, never when 0
+	MaxSizeMB int                         `json:"maxSizeMb,omitempty"` // Larger files get no versions, no limit when 0
+	Shares    map[string]VersionRetention `json:"shares,omitempty"`
+}
+
+// VersionRetention is how many versions a share keeps per file, none when
+// Keep is 0, and for how long
+type VersionRetention struct {
+	Keep int `json:"keep"`
+	Days int `json:"days,omitempty"`
+}
+
+// MusicSettings choose the folders of the music library, on top of the
+// built-in music folder, and how tracks are served
+type MusicSettings struct {
+	Folders   []MusicFolder `json:"folders,omitempty"`
+	ScanHours int           `json:"scanHours,omitempty"` // Between rescans, none when 0
+	// Subsonic serves the library to Subsonic apps under /rest
+	Subsonic   bool `json:"subsonic,omitempty"`
+	MaxBitRate int  `json:"maxBitRate,omitempty"` // Transcoding in kbps, defaults to 192
+}
+
+// MusicFolder is a folder of a share in the music library
+type MusicFolder struct {
+	Share string `json:"share"`
+	Path  string `json:"path,omitempty"`
+}
+
+// OfficeSettings point at a WOPI document server. HostURL is where that
+// server reaches FlatNas, when it differs from the address the browser
+// uses, e.g. http://192.168.1.10:3000 behind a public domain.
+type OfficeSettings struct {
+	Enable    bool   `json:"enable"`
+	ServerURL string `json:"serverUrl,omitempty"` // e.g. https://office.example.com
+	HostURL   string `json:"hostUrl,omitempty"`
+}
+
+// AntivirusSettings connect to clamd. Address is a unix socket path, or
+// host:port for its TCP listener.
+type AntivirusSettings struct {
+	Enable      bool   `json:"enable"`
+	Address     string `json:"address,omitempty"`     // Defaults to /var/run/clamav/clamd.ctl
+	ScanUploads bool   `json:"scanUploads,omitempty"` // Transfer and share link uploads
+	// FailClosed refuses uploads while clamd cannot be reached; by default
+	// they are kept unscanned
+	FailClosed bool     `json:"failClosed,omitempty"`
+	Channels   []string `json:"channels,omitempty"` // Alert channels, all when empty
+}
+
+// IntegritySettings control the scheduled checksum verification
+type IntegritySettings struct {
+	Enable       bool     `json:"enable"`
+	IntervalDays int      `json:"intervalDays,omitempty"` // Defaults to 30
+	Channels     []string `json:"channels,omitempty"`     // Alert channels, all when empty
+}
+
+// QuotaSettings are limits in bytes, by username for the transfer area and
+// by share name; a missing entry is no limit
+type QuotaSettings struct {
+	Users    map[string]int64 `json:"users,omitempty"`
+	Shares   map[string]int64 `json:"shares,omitempty"`
+	Warn     []int            `json:"warn,omitempty"`     // Warning thresholds in percent, defaults to 80 and 95
+	Channels []string         `json:"channels,omitempty"` // Warning channels, all when empty
+}
+
+// SftpSettings control the SFTP listener
+type SftpSettings struct {
+	Enable bool `json:"enable"`
+	Port   int  `json:"port,omitempty"` // Defaults to 2022
+}
+
+// TranscodeSettings control the ffmpeg HLS transcoder. Zero fields use the
+// defaults.
+type TranscodeSettings struct {
+	HwAccel     string `json:"hwAccel,omitempty"`     // "", "vaapi" or "qsv"
+	Device      string `json:"device,omitempty"`      // Defaults to /dev/dri/renderD128
+	Dir         string `json:"dir,omitempty"`         // Defaults to data/transcode
+	MaxSessions int    `json:"maxSessions,omitempty"` // Running transcodes, defaults to 2
+	// Finished sessions are deleted this long after their last use,
+	// defaults to 60
+	KeepMinutes int `json:"keepMinutes,omitempty"`
+}
+
+// FileShare is a host folder exposed in the file browser under Name. No
+// path outside Path can be reached through it.
+type FileShare struct {
+	Name     string `json:"name"`
+	Path     string `json:"path,omitempty"` // Absolute; hidden from the browser
+	ReadOnly bool   `json:"readOnly,omitempty"`
+	Remote   string `json:"remote,omitempty"` // Type of a remote mount, set by the server
+}
+
+// BackupSettings schedules encrypted backups of the data directory to a
+// folder and, optionally, a remote URL each archive is PUT to (a WebDAV
+// folder, for example).
+type BackupSettings struct {
+	Enable         bool   `json:"enable"`
+	IntervalHours  int    `json:"intervalHours,omitempty"` // Defaults to 24
+	Dir            string `json:"dir,omitempty"`           // Defaults to data/backups/scheduled
+	Keep           int    `json:"keep,omitempty"`          // Archives kept in Dir, defaults to 7
+	Password       string `json:"password,omitempty"`
+	IncludeCaches  bool   `json:"includeCaches,omitempty"`
+	RemoteUrl      string `json:"remoteUrl,omitempty"`
+	RemoteUsername string `json:"remoteUsername,omitempty"`
+	RemotePassword string `json:"remotePassword,omitempty"`
+}
+
+// RateLimitSettings are token buckets: PerMinute is the refill rate and
+// Burst the bucket size. Zero fields use the defaults.
+type RateLimitSettings struct {
+	Disable           bool `json:"disable,omitempty"`
+	RestPerMinute     int  `json:"restPerMinute,omitempty"` // Per source IP
+	RestBurst         int  `json:"restBurst,omitempty"`
+	SocketPerMinute   int  `json:"socketPerMinute,omitempty"` // Per socket connection
+	SocketBurst       int  `json:"socketBurst,omitempty"`
+	SocketIPPerMinute int  `json:"socketIpPerMinute,omitempty"` // All connections from one IP
+	SocketIPBurst     int  `json:"socketIpBurst,omitempty"`
+}
+
+// LdapSettings configures password login against an LDAP or Active
+// Directory server. Filters use {username} and, for groups, {dn}.
+type LdapSettings struct {
+	Enable             bool     `json:"enable"`
+	Url                string   `json:"url"` // ldap://host:389 or ldaps://host:636
+	StartTls           bool     `json:"startTls,omitempty"`
+	InsecureSkipVerify bool     `json:"insecureSkipVerify,omitempty"`
+	BindDn             string   `json:"bindDn,omitempty"` // Service account; empty binds anonymously
+	BindPassword       string   `json:"bindPassword,omitempty"`
+	BaseDn             string   `json:"baseDn"`
+	UserFilter         string   `json:"userFilter,omitempty"`        // Defaults to (&(objectClass=person)(uid={username}))
+	UsernameAttribute  string   `json:"usernameAttribute,omitempty"` // Defaults to uid; sAMAccountName for AD
+	GroupBaseDn        string   `json:"groupBaseDn,omitempty"`       // Defaults to BaseDn
+	GroupFilter        string   `json:"groupFilter,omitempty"`       // e.g. (member={dn}); empty reads memberOf
+	GroupAttribute     string   `json:"groupAttribute,omitempty"`    // Group name attribute, defaults to cn
+	AdminGroups        []string `json:"adminGroups,omitempty"`
+	AllowedGroups      []string `json:"allowedGroups,omitempty"`
+}
+
+// OidcSettings configures login through an OpenID Connect provider such as
+// Authentik, Keycloak or Authelia. Members of AdminGroups sign in as admin;
+// when AllowedGroups is set, everyone else must be in one of them.
+type OidcSettings struct {
+	Enable        bool     `json:"enable"`
+	Name          string   `json:"name,omitempty"` // Button label, e.g. "Authentik"
+	Issuer        string   `json:"issuer"`
+	ClientId      string   `json:"clientId"`
+	ClientSecret  string   `json:"clientSecret,omitempty"`
+	RedirectUrl   string   `json:"redirectUrl,omitempty"`   // Defaults to <origin>/api/auth/oidc/callback
+	Scopes        []string `json:"scopes,omitempty"`        // Defaults to openid profile email groups
+	UsernameClaim string   `json:"usernameClaim,omitempty"` // Defaults to preferred_username
+	GroupsClaim   string   `json:"groupsClaim,omitempty"`   // Defaults to groups
+	AdminGroups   []string `json:"adminGroups,omitempty"`
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+}
+
+// OutboundGuard blocks fetches of loopback, private and link-local addresses
+// unless the target is allowed explicitly.
+type OutboundGuard struct {
+	Disable bool     `json:"disable,omitempty"`
+	Allow   []string `json:"allow,omitempty"` // e.g. "rsshub.lan", "192.168.1.20", "10.0.0.0/24"
+}
+
+// ProxyRules routes hosts through the proxy or around it. When Proxied is
+// set, only matching hosts use the proxy; Bypass always wins.
+type ProxyRules struct {
+	Proxied []string `json:"proxied,omitempty"` // e.g. "*.reddit.com", "youtube.com"
+	Bypass  []string `json:"bypass,omitempty"`  // e.g. "example.org", "10.0.0.0/8"
+}
+
+// ProxySettings describes an HTTP or SOCKS5 proxy. Type "" disables it.
+type ProxySettings struct {
+	Name     string `json:"name,omitempty"`
+	Type     string `json:"type"` // "http", "https", "socks5" or "socks5h"
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Redacted returns a copy safe to hand to the browser: proxy passwords
+// are dropped, as system config is readable without logging in.
+func (c SystemConfig) Redacted() SystemConfig {
+	if c.Proxy != nil {
+		p := *c.Proxy
+		p.Password = ""
+		c.Proxy = &p
+	}
+	if len(c.Proxies) > 0 {
+		proxies := make([]ProxySettings, len(c.Proxies))
+		copy(proxies, c.Proxies)
+		for i := range proxies {
+			proxies[i].Password = ""
+		}
+		c.Proxies = proxies
+	}
+	if c.Oidc != nil {
+		o := *c.Oidc
+		o.ClientSecret = ""
+		c.Oidc = &o
+	}
+	if c.Ldap != nil {
+		l := *c.Ldap
+		l.BindPassword = ""
+		c.Ldap = &l
+	}
+	if c.Backup != nil {
+		b := *c.Backup
+		b.Password = ""
+		b.RemotePassword = ""
+		c.Backup = &b
+	}
+	if c.Transcode != nil {
+		t := *c.Transcode
+		t.Dir, t.Device = "", ""
+		c.Transcode = &t
+	}
+	if len(c.Shares) > 0 {
+		shares := make([]FileShare, len(c.Shares))
+		copy(shares, c.Shares)
+		for i := range shares {
+			shares[i].Path = ""
+		}
+		c.Shares = shares
+	}
+	return c
 }
 
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Code     string `json:"code,omitempty"` // TOTP or recovery code
+}
+
+// AuditEntry records one security relevant action
+type AuditEntry struct {
+	Time    int64             `json:"time"` // Unix timestamp in ms
+	User    string            `json:"user"`
+	IP      string            `json:"ip,omitempty"`
+	Action  string            `json:"action"` // e.g. "login", "user.delete", "docker.container"
+	Target  string            `json:"target,omitempty"`
+	Success bool              `json:"success"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// ApiToken is a personal access token. Only the SHA-256 of the secret is
+// stored; the secret itself is shown once when the token is created.
+type ApiToken struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Username   string   `json:"username"`
+	Scopes     []string `json:"scopes"` // "read", "write" or "admin"
+	Hash       string   `json:"hash,omitempty"`
+	Hint       string   `json:"hint"`                 // Last characters of the secret
+	CreatedAt  int64    `json:"createdAt"`            // Unix timestamp in ms
+	LastUsedAt int64    `json:"lastUsedAt,omitempty"` // Unix timestamp in ms
+	ExpiresAt  int64    `json:"expiresAt,omitempty"`  // Unix timestamp in ms, 0 = never
+}
+
+// SftpKey is a public key that may log in to SFTP as its account
+type SftpKey struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	Name        string `json:"name"`
+	Key         string `json:"key"`         // authorized_keys line
+	Fingerprint string `json:"fingerprint"` // As ssh-keygen -l shows it
+	CreatedAt   int64  `json:"createdAt"`
+}
+
+// ShareLink is a public URL for a file or folder of a file share. Only the
+// bcrypt hash of its password is stored.
+type ShareLink struct {
+	Token        string `json:"token"`
+	Share        string `json:"share"`
+	Path         string `json:"path"`
+	Name         string `json:"name"`
+	IsDir        bool   `json:"isDir"`
+	Owner        string `json:"owner"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	HasPassword  bool   `json:"hasPassword"`
+	ExpiresAt    int64  `json:"expiresAt,omitempty"`    // Unix timestamp in ms, 0 = never
+	MaxDownloads int    `json:"maxDownloads,omitempty"` // 0 = unlimited
+	Downloads    int    `json:"downloads"`
+	AllowUpload  bool   `json:"allowUpload"` // Visitors may upload into the folder
+	CreatedAt    int64  `json:"createdAt"`   // Unix timestamp in ms
 }
 
 type VisitorStats struct {
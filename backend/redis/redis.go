@@ -0,0 +1,258 @@
+// Package redis is a minimal Redis client, enough for the shared cache:
+// strings with expiry, SET NX locks and PING. It speaks RESP2 over a small
+// connection pool.
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	poolSize    = 8
+	dialTimeout = 5 * time.Second
+	ioTimeout   = 5 * time.Second
+)
+
+// Error is an error reply from the server
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// Client is safe for concurrent use
+type Client struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+	pool     chan *conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Open parses redis://[user:password@]host[:port][/db] (rediss:// for TLS)
+// and checks the server answers
+func Open(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("redis: unsupported scheme %q", u.Scheme)
+	}
+	c := &Client{addr: u.Host, useTLS: u.Scheme == "rediss", pool: make(chan *conn, poolSize)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+		if c.password == "" {
+			// redis://secret@host is commonly used for a password only
+			c.password, c.username = c.username, ""
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis: invalid database %q", db)
+		}
+	}
+	if err := c.Ping(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) dial() (*conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var nc net.Conn
+	var err error
+	if c.useTLS {
+		nc, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: strings.Split(c.addr, ":")[0]})
+	} else {
+		nc, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := cn.do(args); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do([]string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// Do sends one command and returns its reply: string, int64, []interface{}
+// or nil for a nil reply
+func (c *Client) Do(args ...string) (interface{}, error) {
+	var cn *conn
+	select {
+	case cn = <-c.pool:
+	default:
+		var err error
+		if cn, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := cn.do(args)
+	var serverErr Error
+	if err != nil && !errors.As(err, &serverErr) {
+		// The connection state is unknown after an I/O error
+		cn.Close()
+		return nil, err
+	}
+	select {
+	case c.pool <- cn:
+	default:
+		cn.Close()
+	}
+	return reply, err
+}
+
+// Close closes the idle connections
+func (c *Client) Close() {
+	for {
+		select {
+		case cn := <-c.pool:
+			cn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (c *Client) Ping() error {
+	_, err := c.Do("PING")
+	return err
+}
+
+// Get returns the value of key; ok is false when it does not exist
+func (c *Client) Get(key string) (value []byte, ok bool, err error) {
+	reply, err := c.Do("GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	s, _ := reply.(string)
+	return []byte(s), true, nil
+}
+
+// Set stores value, expiring after ttl when ttl > 0
+func (c *Client) Set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := c.Do(args...)
+	return err
+}
+
+// SetNX stores value only if key does not exist and reports whether it did
+func (c *Client) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	args := []string{"SET", key, string(value), "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	reply, err := c.Do(args...)
+	return err == nil && reply != nil, err
+}
+
+func (c *Client) Del(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := c.Do(append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+func (cn *conn) do(args []string) (interface{}, error) {
+	cn.SetDeadline(time.Now().Add(ioTimeout))
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+	if _, err := io.WriteString(cn.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readReply(cn.r)
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readReply(r)
+			var serverErr Error
+			if errors.As(err, &serverErr) {
+				// Keep reading so the connection stays in sync
+				item = serverErr
+			} else if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+	}
+}
@@ -0,0 +1,136 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers the commands the client uses from an in-memory map
+func fakeServer(t *testing.T, password string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	store := map[string]string{}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(nc net.Conn) {
+				defer nc.Close()
+				r := bufio.NewReader(nc)
+				authed := password == ""
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					var reply string
+					mu.Lock()
+					switch cmd := strings.ToUpper(args[0]); {
+					case cmd == "AUTH":
+						authed = args[len(args)-1] == password
+						reply = "+OK\r\n"
+						if !authed {
+							reply = "-WRONGPASS invalid password\r\n"
+						}
+					case !authed:
+						reply = "-NOAUTH Authentication required.\r\n"
+					case cmd == "PING":
+						reply = "+PONG\r\n"
+					case cmd == "GET":
+						if v, ok := store[args[1]]; ok {
+							reply = "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+						} else {
+							reply = "$-1\r\n"
+						}
+					case cmd == "SET":
+						_, exists := store[args[1]]
+						if len(args) > 3 && strings.ToUpper(args[3]) == "NX" && exists {
+							reply = "$-1\r\n"
+						} else {
+							store[args[1]] = args[2]
+							reply = "+OK\r\n"
+						}
+					case cmd == "DEL":
+						n := 0
+						for _, k := range args[1:] {
+							if _, ok := store[k]; ok {
+								delete(store, k)
+								n++
+							}
+						}
+						reply = ":" + strconv.Itoa(n) + "\r\n"
+					default:
+						reply = "-ERR unknown command\r\n"
+					}
+					mu.Unlock()
+					nc.Write([]byte(reply))
+				}
+			}(nc)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	args := make([]string, 0, len(items))
+	for _, it := range items {
+		s, _ := it.(string)
+		args = append(args, s)
+	}
+	return args, nil
+}
+
+func TestClientCommands(t *testing.T) {
+	addr := fakeServer(t, "secret")
+
+	if _, err := Open("redis://wrong@" + addr); err == nil {
+		t.Fatalf("expected a wrong password to fail")
+	}
+	c, err := Open("redis://secret@" + addr)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer c.Close()
+
+	if _, ok, err := c.Get("missing"); err != nil || ok {
+		t.Fatalf("expected a miss, got ok=%v err=%v", ok, err)
+	}
+	if err := c.Set("k", []byte("a\r\nb"), time.Minute); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if v, ok, err := c.Get("k"); err != nil || !ok || string(v) != "a\r\nb" {
+		t.Fatalf("unexpected get: %q %v %v", v, ok, err)
+	}
+	if ok, err := c.SetNX("k", []byte("other"), time.Minute); err != nil || ok {
+		t.Fatalf("expected SETNX on an existing key to fail, got %v %v", ok, err)
+	}
+	if err := c.Del("k"); err != nil {
+		t.Fatalf("del: %v", err)
+	}
+	if ok, err := c.SetNX("k", []byte("mine"), time.Minute); err != nil || !ok {
+		t.Fatalf("expected SETNX to take the lock, got %v %v", ok, err)
+	}
+	if _, err := c.Do("NOPE"); err == nil {
+		t.Fatalf("expected a server error")
+	}
+	// The connection stays usable after an error reply
+	if err := c.Ping(); err != nil {
+		t.Fatalf("ping after error: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// Album is a photo album of a user. Manual albums hold the photos added
+// to them; the others gather photos by Rule, which the store keeps as
+// given.
+type Album struct {
+	ID         int64
+	User       string
+	Name       string
+	Kind       string
+	Rule       string
+	CoverShare string
+	CoverPath  string
+	Items      int // Photos added, for manual albums
+	Created    int64
+	Updated    int64
+}
+
+// PhotoRef names a photo
+type PhotoRef struct {
+	Share string
+	Path  string
+}
+
+// PersonCount is a person and the number of photos they are on
+type PersonCount struct {
+	Person string
+	Count  int
+}
+
+// coverUnder is under for the cover of an album
+const coverUnder = `(cover_path = ? OR substr(cover_path, 1, ?) = ?)`
+
+const albumColumns = `id, username, name, kind, rule, cover_share, cover_path,
+	(SELECT COUNT(*) FROM album_items WHERE album_id = albums.id), created_at, updated_at`
+
+func scanAlbum(row interface{ Scan(...interface{}) error }) (Album, error) {
+	var a Album
+	err := row.Scan(&a.ID, &a.User, &a.Name, &a.Kind, &a.Rule, &a.CoverShare, &a.CoverPath, &a.Items, &a.Created, &a.Updated)
+	return a, err
+}
+
+// Albums returns the albums of user by name
+func (s *Store) Albums(user string) ([]Album, error) {
+	rows, err := s.db.Query(`SELECT `+albumColumns+` FROM albums WHERE username = ? ORDER BY lower(name), id`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var albums []Album
+	for rows.Next() {
+		a, err := scanAlbum(rows)
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+// Album returns an album of user, os.ErrNotExist when there is none with
+// that ID
+func (s *Store) Album(user string, id int64) (Album, error) {
+	a, err := scanAlbum(s.db.QueryRow(`SELECT `+albumColumns+` FROM albums WHERE username = ? AND id = ?`, user, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, os.ErrNotExist
+	}
+	return a, err
+}
+
+// CreateAlbum adds an album and returns it with its ID
+func (s *Store) CreateAlbum(a Album) (Album, error) {
+	now := time.Now().UnixMilli()
+	res, err := s.db.Exec(`INSERT INTO albums (username, name, kind, rule, cover_share, cover_path, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.User, a.Name, a.Kind, a.Rule, a.CoverShare, a.CoverPath, now, now)
+	if err != nil {
+		return a, err
+	}
+	a.ID, err = res.LastInsertId()
+	a.Created, a.Updated = now, now
+	return a, err
+}
+
+// UpdateAlbum saves the name, rule and cover of an album of a.User. The
+// kind never changes.
+func (s *Store) UpdateAlbum(a Album) error {
+	res, err := s.db.Exec(`UPDATE albums SET name = ?, rule = ?, cover_share = ?, cover_path = ?, updated_at = ? WHERE username = ? AND id = ?`,
+		a.Name, a.Rule, a.CoverShare, a.CoverPath, time.Now().UnixMilli(), a.User, a.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// DeleteAlbum drops an album of user and its list of photos
+func (s *Store) DeleteAlbum(user string, id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM albums WHERE username = ? AND id = ?`, user, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return os.ErrNotExist
+	}
+	if _, err := tx.Exec(`DELETE FROM album_items WHERE album_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteUserAlbums drops the albums of a user
+func (s *Store) DeleteUserAlbums(user string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM album_items WHERE album_id IN (SELECT id FROM albums WHERE username = ?)`, user); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM albums WHERE username = ?`, user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AlbumItems returns the photos added to an album, the latest first
+func (s *Store) AlbumItems(id int64) ([]PhotoRef, error) {
+	return s.photoRefs(`SELECT share, path FROM album_items WHERE album_id = ? ORDER BY added_at DESC, share, path`, id)
+}
+
+// AddAlbumItems adds photos to an album, or takes them out when remove is
+// set
+func (s *Store) AddAlbumItems(id int64, refs []PhotoRef, remove bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixMilli()
+	for _, ref := range refs {
+		if remove {
+			_, err = tx.Exec(`DELETE FROM album_items WHERE album_id = ? AND share = ? AND path = ?`, id, ref.Share, ref.Path)
+		} else {
+			_, err = tx.Exec(`INSERT OR IGNORE INTO album_items (album_id, share, path, added_at) VALUES (?, ?, ?, ?)`, id, ref.Share, ref.Path, now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE albums SET updated_at = ? WHERE id = ?`, now, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetPhotoPeople replaces the people on a photo
+func (s *Store) SetPhotoPeople(ref PhotoRef, people []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM photo_people WHERE share = ? AND path = ?`, ref.Share, ref.Path); err != nil {
+		return err
+	}
+	for _, person := range people {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO photo_people (share, path, person) VALUES (?, ?, ?)`, ref.Share, ref.Path, person); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PhotoPeople returns the people on the photos of share, by path
+func (s *Store) PhotoPeople(share string) (map[string][]string, error) {
+	rows, err := s.db.Query(`SELECT path, person FROM photo_people WHERE share = ? ORDER BY lower(person)`, share)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	people := make(map[string][]string)
+	for rows.Next() {
+		var p, person string
+		if err := rows.Scan(&p, &person); err != nil {
+			return nil, err
+		}
+		people[p] = append(people[p], person)
+	}
+	return people, rows.Err()
+}
+
+// People counts the photos of each person, by name. Names match whatever
+// their case.
+func (s *Store) People() ([]PersonCount, error) {
+	rows, err := s.db.Query(`SELECT MIN(person), COUNT(*) FROM photo_people GROUP BY lower(person) ORDER BY lower(person)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var people []PersonCount
+	for rows.Next() {
+		var p PersonCount
+		if err := rows.Scan(&p.Person, &p.Count); err != nil {
+			return nil, err
+		}
+		people = append(people, p)
+	}
+	return people, rows.Err()
+}
+
+// PersonPhotos returns the photos a person is on
+func (s *Store) PersonPhotos(person string) ([]PhotoRef, error) {
+	return s.photoRefs(`SELECT share, path FROM photo_people WHERE lower(person) = ? ORDER BY share, path`, strings.ToLower(person))
+}
+
+func (s *Store) photoRefs(query string, args ...interface{}) ([]PhotoRef, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var refs []PhotoRef
+	for rows.Next() {
+		var ref PhotoRef
+		if err := rows.Scan(&ref.Share, &ref.Path); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
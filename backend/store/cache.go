@@ -0,0 +1,63 @@
+package store
+
+import "time"
+
+// CacheEntry is one item of the widget cache
+type CacheEntry struct {
+	Kind      string
+	Key       string
+	Data      []byte // JSON
+	UpdatedAt int64  // Unix timestamp in ms; 0 marks the item stale
+	TTL       int64  // Seconds
+	Status    string
+}
+
+// CacheEntries returns the widget cache. Items whose TTL ran out more than
+// retention after they were last written are deleted first, so feeds and
+// cities no longer on any dashboard do not pile up. updated_at cannot tell,
+// since expiring an item sets it to 0.
+func (s *Store) CacheEntries(retention time.Duration) ([]CacheEntry, error) {
+	cutoff := time.Now().Add(-retention).UnixMilli()
+	if _, err := s.db.Exec(`DELETE FROM widget_cache WHERE saved_at + ttl * 1000 < ?`, cutoff); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT kind, key, data, updated_at, ttl, status FROM widget_cache`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []CacheEntry
+	for rows.Next() {
+		var e CacheEntry
+		if err := rows.Scan(&e.Kind, &e.Key, &e.Data, &e.UpdatedAt, &e.TTL, &e.Status); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// SaveCache writes changed items and removes deleted ones in one
+// transaction
+func (s *Store) SaveCache(put []CacheEntry, remove []CacheEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixMilli()
+	for _, e := range put {
+		if _, err := tx.Exec(`INSERT INTO widget_cache (kind, key, data, updated_at, ttl, status, saved_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(kind, key) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at,
+			ttl = excluded.ttl, status = excluded.status, saved_at = excluded.saved_at`,
+			e.Kind, e.Key, e.Data, e.UpdatedAt, e.TTL, e.Status, now); err != nil {
+			return err
+		}
+	}
+	for _, e := range remove {
+		if _, err := tx.Exec(`DELETE FROM widget_cache WHERE kind = ? AND key = ?`, e.Kind, e.Key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,51 @@
+package store
+
+import "time"
+
+// JobRecord is a saved background job
+type JobRecord struct {
+	ID       string
+	Data     []byte // JSON
+	Finished bool
+}
+
+// Jobs returns the saved jobs, oldest first
+func (s *Store) Jobs() ([]JobRecord, error) {
+	rows, err := s.db.Query(`SELECT id, data, finished FROM jobs ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []JobRecord
+	for rows.Next() {
+		var j JobRecord
+		if err := rows.Scan(&j.ID, &j.Data, &j.Finished); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// SaveJob writes a job, replacing what was saved of it
+func (s *Store) SaveJob(j JobRecord) error {
+	now := time.Now().UnixMilli()
+	_, err := s.db.Exec(`INSERT INTO jobs (id, data, finished, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET data = excluded.data, finished = excluded.finished, updated_at = excluded.updated_at`,
+		j.ID, j.Data, j.Finished, now, now)
+	return err
+}
+
+// DeleteJob removes a job
+func (s *Store) DeleteJob(id string) error {
+	_, err := s.db.Exec(`DELETE FROM jobs WHERE id = ?`, id)
+	return err
+}
+
+// PruneJobs keeps the keep finished jobs that finished last and deletes
+// the older ones
+func (s *Store) PruneJobs(keep int) error {
+	_, err := s.db.Exec(`DELETE FROM jobs WHERE finished = 1 AND id NOT IN
+		(SELECT id FROM jobs WHERE finished = 1 ORDER BY updated_at DESC LIMIT ?)`, keep)
+	return err
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FileMark is what a user noted on a file or folder: its tags and whether
+// it is starred
+type FileMark struct {
+	Share   string
+	Path    string
+	Tags    []string
+	Starred bool
+}
+
+// TagCount is a tag and the number of items a user put it on
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// under matches path and everything below it. SQLite counts the
+// characters of text, not its bytes.
+const under = `(path = ? OR substr(path, 1, ?) = ?)`
+
+func underArgs(p string) []interface{} {
+	return []interface{}{p, utf8.RuneCountInString(p) + 1, p + "/"}
+}
+
+// marks gathers the tags and stars of user on the items matching where,
+// sorted by share and path
+func (s *Store) marks(user, where string, args ...interface{}) ([]FileMark, error) {
+	byItem := make(map[[2]string]*FileMark)
+	item := func(share, p string) *FileMark {
+		m := byItem[[2]string{share, p}]
+		if m == nil {
+			m = &FileMark{Share: share, Path: p}
+			byItem[[2]string{share, p}] = m
+		}
+		return m
+	}
+	params := append([]interface{}{user}, args...)
+	rows, err := s.db.Query(`SELECT share, path, tag FROM file_tags WHERE username = ? AND `+where+` ORDER BY lower(tag)`, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var share, p, tag string
+		if err := rows.Scan(&share, &p, &tag); err != nil {
+			return nil, err
+		}
+		m := item(share, p)
+		m.Tags = append(m.Tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	stars, err := s.db.Query(`SELECT share, path FROM file_stars WHERE username = ? AND `+where, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer stars.Close()
+	for stars.Next() {
+		var share, p string
+		if err := stars.Scan(&share, &p); err != nil {
+			return nil, err
+		}
+		item(share, p).Starred = true
+	}
+	if err := stars.Err(); err != nil {
+		return nil, err
+	}
+	marks := make([]FileMark, 0, len(byItem))
+	for _, m := range byItem {
+		marks = append(marks, *m)
+	}
+	sort.Slice(marks, func(i, j int) bool {
+		if marks[i].Share != marks[j].Share {
+			return marks[i].Share < marks[j].Share
+		}
+		return marks[i].Path < marks[j].Path
+	})
+	return marks, nil
+}
+
+// FileMarks returns the marks of user on the items below dir of share,
+// the whole share when dir is ""
+func (s *Store) FileMarks(user, share, dir string) ([]FileMark, error) {
+	if dir == "" {
+		return s.marks(user, `share = ?`, share)
+	}
+	return s.marks(user, `share = ? AND substr(path, 1, ?) = ?`, share, utf8.RuneCountInString(dir)+1, dir+"/")
+}
+
+// StarredFiles returns the items user starred
+func (s *Store) StarredFiles(user string) ([]FileMark, error) {
+	return s.marks(user, `(share, path) IN (SELECT share, path FROM file_stars WHERE username = ?)`, user)
+}
+
+// TaggedFiles returns the items user put all of tags on. Tags match
+// whatever their case.
+func (s *Store) TaggedFiles(user string, tags []string) ([]FileMark, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{user}
+	for _, tag := range tags {
+		args = append(args, strings.ToLower(tag))
+	}
+	args = append(args, len(tags))
+	return s.marks(user, `(share, path) IN (SELECT share, path FROM file_tags WHERE username = ? AND lower(tag) IN (?`+
+		strings.Repeat(", ?", len(tags)-1)+`) GROUP BY share, path HAVING COUNT(*) = ?)`, args...)
+}
+
+// FileTags counts the items user put each tag on, by tag
+func (s *Store) FileTags(user string) ([]TagCount, error) {
+	rows, err := s.db.Query(`SELECT MIN(tag), COUNT(*) FROM file_tags WHERE username = ? GROUP BY lower(tag) ORDER BY lower(tag)`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tags []TagCount
+	for rows.Next() {
+		var t TagCount
+		if err := rows.Scan(&t.Tag, &t.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// SetFileTags replaces the tags of user on an item
+func (s *Store) SetFileTags(user, share, p string, tags []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM file_tags WHERE username = ? AND share = ? AND path = ?`, user, share, p); err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	for _, tag := range tags {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO file_tags (username, share, path, tag, created_at) VALUES (?, ?, ?, ?, ?)`,
+			user, share, p, tag, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// StarFile stars an item for user, or takes the star away
+func (s *Store) StarFile(user, share, p string, starred bool) error {
+	var err error
+	if starred {
+		_, err = s.db.Exec(`INSERT OR IGNORE INTO file_stars (username, share, path, created_at) VALUES (?, ?, ?, ?)`,
+			user, share, p, time.Now().UnixMilli())
+	} else {
+		_, err = s.db.Exec(`DELETE FROM file_stars WHERE username = ? AND share = ? AND path = ?`, user, share, p)
+	}
+	return err
+}
+
+// markTables hold what users noted on items, pathTables everything kept
+// by share and path: the marks, the photos of albums, the people on
+// photos and the music library
+var (
+	markTables = []string{"file_tags", "file_stars"}
+	pathTables = []string{"file_tags", "file_stars", "album_items", "photo_people", "music_tracks"}
+)
+
+// MoveFileMarks makes the marks of every user on an item and what is below
+// it follow the item to its new place, along with its places in albums,
+// album covers, the people on it and its music tracks, which keep their
+// IDs. What was left at the target by an item it replaced is dropped.
+func (s *Store) MoveFileMarks(share, from, toShare, to string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range pathTables {
+		args := append(append([]interface{}{toShare}, underArgs(to)...), share)
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE share = ? AND `+under+` AND NOT (share = ? AND `+under+`)`,
+			append(args, underArgs(from)...)...); err != nil {
+			return err
+		}
+		args = append([]interface{}{toShare, to, utf8.RuneCountInString(from) + 1, share}, underArgs(from)...)
+		if _, err := tx.Exec(`UPDATE OR REPLACE `+table+` SET share = ?, path = ? || substr(path, ?) WHERE share = ? AND `+under,
+			args...); err != nil {
+			return err
+		}
+	}
+	args := append([]interface{}{toShare, to, utf8.RuneCountInString(from) + 1, share}, underArgs(from)...)
+	if _, err := tx.Exec(`UPDATE albums SET cover_share = ?, cover_path = ? || substr(cover_path, ?) WHERE cover_share = ? AND `+
+		coverUnder, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteFileMarks drops the marks of every user on an item and what is
+// below it, with its places in albums, the people on it and its music
+// tracks
+func (s *Store) DeleteFileMarks(share, p string) error {
+	return s.deleteMarks(pathTables, `share = ? AND `+under, append([]interface{}{share}, underArgs(p)...)...)
+}
+
+// DeleteUserMarks drops the marks of a user
+func (s *Store) DeleteUserMarks(user string) error {
+	return s.deleteMarks(markTables, `username = ?`, user)
+}
+
+func (s *Store) deleteMarks(tables []string, where string, args ...interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range tables {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE `+where, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
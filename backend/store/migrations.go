@@ -0,0 +1,295 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// migration moves the schema from version-1 to version inside a single
+// transaction; schema_migrations records the versions applied. after, if
+// set, runs once the transaction is committed.
+type migration struct {
+	version int
+	name    string
+	apply   func(s *Store, tx *sql.Tx) error
+	after   func(s *Store)
+}
+
+// migrations must stay in version order. Add new ones at the end and never
+// change one that has shipped.
+var migrations = []migration{
+	{version: 1, name: "documents", apply: execSQL(`CREATE TABLE documents (
+		path       TEXT PRIMARY KEY,
+		data       BLOB NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`)},
+	{version: 2, name: "import json files", apply: importJSONFiles, after: archiveJSONFiles},
+	{version: 3, name: "widget cache", apply: createWidgetCache, after: removeWidgetCacheFile},
+	{version: 4, name: "jobs", apply: execSQL(`CREATE TABLE jobs (
+		id         TEXT PRIMARY KEY,
+		data       BLOB NOT NULL,
+		finished   INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`, `CREATE INDEX jobs_finished ON jobs (finished, updated_at)`)},
+	{version: 5, name: "file marks", apply: execSQL(`CREATE TABLE file_tags (
+		username   TEXT NOT NULL,
+		share      TEXT NOT NULL,
+		path       TEXT NOT NULL,
+		tag        TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (username, share, path, tag)
+	)`, `CREATE INDEX file_tags_tag ON file_tags (username, tag)`, `CREATE TABLE file_stars (
+		username   TEXT NOT NULL,
+		share      TEXT NOT NULL,
+		path       TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (username, share, path)
+	)`)},
+	{version: 6, name: "photo albums", apply: execSQL(`CREATE TABLE albums (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		username    TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		kind        TEXT NOT NULL,
+		rule        TEXT NOT NULL DEFAULT '',
+		cover_share TEXT NOT NULL DEFAULT '',
+		cover_path  TEXT NOT NULL DEFAULT '',
+		created_at  INTEGER NOT NULL,
+		updated_at  INTEGER NOT NULL
+	)`, `CREATE INDEX albums_user ON albums (username)`, `CREATE TABLE album_items (
+		album_id INTEGER NOT NULL,
+		share    TEXT NOT NULL,
+		path     TEXT NOT NULL,
+		added_at INTEGER NOT NULL,
+		PRIMARY KEY (album_id, share, path)
+	)`, `CREATE INDEX album_items_path ON album_items (share, path)`, `CREATE TABLE photo_people (
+		share  TEXT NOT NULL,
+		path   TEXT NOT NULL,
+		person TEXT NOT NULL,
+		PRIMARY KEY (share, path, person)
+	)`, `CREATE INDEX photo_people_person ON photo_people (person)`)},
+	{version: 7, name: "music library", apply: execSQL(`CREATE TABLE music_tracks (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		share        TEXT NOT NULL,
+		path         TEXT NOT NULL,
+		size         INTEGER NOT NULL,
+		mtime        INTEGER NOT NULL,
+		title        TEXT NOT NULL,
+		artist       TEXT NOT NULL,
+		album_artist TEXT NOT NULL,
+		album        TEXT NOT NULL,
+		artist_key   TEXT NOT NULL,
+		album_key    TEXT NOT NULL,
+		genre        TEXT NOT NULL DEFAULT '',
+		track        INTEGER NOT NULL DEFAULT 0,
+		disc         INTEGER NOT NULL DEFAULT 0,
+		year         INTEGER NOT NULL DEFAULT 0,
+		duration     INTEGER NOT NULL DEFAULT 0,
+		bit_rate     INTEGER NOT NULL DEFAULT 0,
+		format       TEXT NOT NULL,
+		cover        INTEGER NOT NULL DEFAULT 0,
+		added_at     INTEGER NOT NULL,
+		UNIQUE (share, path)
+	)`, `CREATE INDEX music_tracks_artist ON music_tracks (artist_key)`,
+		`CREATE INDEX music_tracks_album ON music_tracks (album_key)`)},
+	{version: 8, name: "disk health", apply: execSQL(`CREATE TABLE smart_samples (
+		disk           TEXT NOT NULL,
+		time           INTEGER NOT NULL,
+		healthy        INTEGER NOT NULL,
+		temperature    INTEGER NOT NULL DEFAULT 0,
+		reallocated    INTEGER NOT NULL DEFAULT 0,
+		pending        INTEGER NOT NULL DEFAULT 0,
+		uncorrectable  INTEGER NOT NULL DEFAULT 0,
+		media_errors   INTEGER NOT NULL DEFAULT 0,
+		power_on_hours INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (disk, time)
+	)`, `CREATE INDEX smart_samples_time ON smart_samples (time)`)},
+}
+
+func execSQL(stmts ...string) func(*Store, *sql.Tx) error {
+	return func(_ *Store, tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Version is the schema version of the database
+func (s *Store) Version() int {
+	var version sql.NullInt64
+	s.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	return int(version.Int64)
+}
+
+// migrate applies pending migrations. An existing database is copied to
+// backups first, so a failed upgrade can be rolled back by hand.
+func (s *Store) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+	current := s.Version()
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+	if current > 0 {
+		dst := filepath.Join(s.root, "backups", fmt.Sprintf("pre-migration-v%d-%s.db", current, time.Now().Format("20060102-150405")))
+		if err := s.Snapshot(dst); err != nil {
+			return fmt.Errorf("backup before migration: %w", err)
+		}
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := s.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		storeLog.Info("Applied database migration", "version", m.version, "name", m.name)
+		if m.after != nil {
+			m.after(s)
+		}
+	}
+	return nil
+}
+
+func (s *Store) applyMigration(m migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.apply(s, tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.name, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// jsonFiles lists the files the store took over from an older install
+func (s *Store) jsonFiles() []string {
+	files := []string{filepath.Join(s.root, "data.json"), filepath.Join(s.root, "system.json")}
+	if entries, err := os.ReadDir(filepath.Join(s.root, "users")); err == nil {
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+				files = append(files, filepath.Join(s.root, "users", e.Name()))
+			}
+		}
+	}
+	return files
+}
+
+// importJSONFiles copies the configuration files into the database. A
+// file that is not valid JSON stops the upgrade rather than being lost.
+func importJSONFiles(s *Store, tx *sql.Tx) error {
+	for _, file := range s.jsonFiles() {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("%s is not valid JSON", file)
+		}
+		var modTime int64
+		if info, err := os.Stat(file); err == nil {
+			modTime = info.ModTime().UnixNano()
+		}
+		key, _ := s.key(file)
+		if _, err := tx.Exec(`INSERT INTO documents (path, data, updated_at) VALUES (?, ?, ?)`, key, data, modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveJSONFiles moves the imported files to backups/pre-sqlite, so no
+// one edits a file that is no longer read
+func archiveJSONFiles(s *Store) {
+	dir := filepath.Join(s.root, "backups", "pre-sqlite")
+	for _, file := range s.jsonFiles() {
+		rel, _ := filepath.Rel(s.root, file)
+		dst := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			storeLog.Warn("Failed to archive imported file", "file", file, "error", err)
+			continue
+		}
+		if err := os.Rename(file, dst); err != nil && !os.IsNotExist(err) {
+			storeLog.Warn("Failed to archive imported file", "file", file, "error", err)
+		}
+	}
+}
+
+func (s *Store) widgetCacheFile() string {
+	return filepath.Join(s.root, "widget_cache.json")
+}
+
+// createWidgetCache creates the table of the widget cache and fills it from
+// widget_cache.json. The file is only a cache, so one that cannot be read
+// is left out rather than stopping the upgrade.
+func createWidgetCache(s *Store, tx *sql.Tx) error {
+	if _, err := tx.Exec(`CREATE TABLE widget_cache (
+		kind       TEXT NOT NULL,
+		key        TEXT NOT NULL,
+		data       BLOB NOT NULL,
+		updated_at INTEGER NOT NULL,
+		ttl        INTEGER NOT NULL,
+		status     TEXT NOT NULL,
+		saved_at   INTEGER NOT NULL,
+		PRIMARY KEY (kind, key)
+	)`); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.widgetCacheFile())
+	if err != nil {
+		return nil
+	}
+	var cache map[string]map[string]struct {
+		Data         json.RawMessage `json:"data"`
+		UpdatedAt    int64           `json:"updatedAt"`
+		TTL          int64           `json:"ttl"`
+		SourceStatus string          `json:"sourceStatus"`
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		storeLog.Warn("Skipping unreadable widget cache", "error", err)
+		return nil
+	}
+	for kind, items := range cache {
+		for key, item := range items {
+			if len(item.Data) == 0 {
+				item.Data = json.RawMessage("null")
+			}
+			if _, err := tx.Exec(`INSERT INTO widget_cache (kind, key, data, updated_at, ttl, status, saved_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				kind, key, []byte(item.Data), item.UpdatedAt, item.TTL, item.SourceStatus, item.UpdatedAt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func removeWidgetCacheFile(s *Store) {
+	if err := os.Remove(s.widgetCacheFile()); err != nil && !os.IsNotExist(err) {
+		storeLog.Warn("Failed to remove imported widget cache", "error", err)
+	}
+}
@@ -0,0 +1,336 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// MusicTrack is a song of the music library. ArtistKey and AlbumKey group
+// the tracks of an album artist and of an album.
+type MusicTrack struct {
+	ID          int64
+	Share       string
+	Path        string
+	Size        int64
+	ModTime     int64 // ms
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	ArtistKey   string
+	AlbumKey    string
+	Genre       string
+	Track       int
+	Disc        int
+	Year        int
+	Duration    int64 // ms
+	BitRate     int   // kbps
+	Format      string
+	Cover       bool // The file holds a picture
+	Added       int64
+}
+
+// MusicStamp tells whether a file changed since it was read
+type MusicStamp struct {
+	ID      int64
+	Size    int64
+	ModTime int64
+}
+
+// MusicArtist is an album artist of the library
+type MusicArtist struct {
+	Key    string
+	Name   string
+	Albums int
+	Tracks int
+	Cover  int64 // A track of the artist with a picture, 0 when none has one
+}
+
+// MusicAlbum is an album of the library
+type MusicAlbum struct {
+	Key       string
+	Name      string
+	Artist    string
+	ArtistKey string
+	Year      int
+	Genre     string
+	Tracks    int
+	Duration  int64
+	Cover     int64 // A track of the album with a picture, 0 when none has one
+	Added     int64
+}
+
+// MusicGenre is a genre with its number of tracks and albums
+type MusicGenre struct {
+	Name   string
+	Tracks int
+	Albums int
+}
+
+// MusicAlbumQuery picks albums. Sort is name (the default), artist, year,
+// newest, recent (by added) or random.
+type MusicAlbumQuery struct {
+	ArtistKey string
+	Genre     string
+	Search    string
+	FromYear  int
+	ToYear    int
+	Sort      string
+	Offset    int
+	Limit     int
+}
+
+const musicTrackColumns = `id, share, path, size, mtime, title, artist, album_artist, album, artist_key, album_key,
+	genre, track, disc, year, duration, bit_rate, format, cover, added_at`
+
+// coverTrack picks a track of a group that has a picture, 0 when none has
+const coverTrack = `COALESCE(MIN(CASE WHEN cover THEN id END), 0)`
+
+// likeArg makes text a LIKE pattern that matches it anywhere
+func likeArg(text string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(strings.ToLower(text)) + "%"
+}
+
+func (s *Store) musicTracks(query string, args ...interface{}) ([]MusicTrack, error) {
+	rows, err := s.db.Query(`SELECT `+musicTrackColumns+` FROM music_tracks `+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tracks []MusicTrack
+	for rows.Next() {
+		var t MusicTrack
+		if err := rows.Scan(&t.ID, &t.Share, &t.Path, &t.Size, &t.ModTime, &t.Title, &t.Artist, &t.AlbumArtist, &t.Album,
+			&t.ArtistKey, &t.AlbumKey, &t.Genre, &t.Track, &t.Disc, &t.Year, &t.Duration, &t.BitRate, &t.Format, &t.Cover, &t.Added); err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+// MusicStamps returns the size and modification time of the tracks of a
+// share by path, so a scan only reads the files that changed
+func (s *Store) MusicStamps(share string) (map[string]MusicStamp, error) {
+	rows, err := s.db.Query(`SELECT path, id, size, mtime FROM music_tracks WHERE share = ?`, share)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stamps := make(map[string]MusicStamp)
+	for rows.Next() {
+		var p string
+		var st MusicStamp
+		if err := rows.Scan(&p, &st.ID, &st.Size, &st.ModTime); err != nil {
+			return nil, err
+		}
+		stamps[p] = st
+	}
+	return stamps, rows.Err()
+}
+
+// MusicShares lists the shares that have tracks
+func (s *Store) MusicShares() ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT share FROM music_tracks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var shares []string
+	for rows.Next() {
+		var share string
+		if err := rows.Scan(&share); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// SaveMusicTrack adds a track, or updates the one at its path, which keeps
+// its ID
+func (s *Store) SaveMusicTrack(t MusicTrack) error {
+	_, err := s.db.Exec(`INSERT INTO music_tracks (share, path, size, mtime, title, artist, album_artist, album, artist_key, album_key,
+		genre, track, disc, year, duration, bit_rate, format, cover, added_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (share, path) DO UPDATE SET size = excluded.size, mtime = excluded.mtime, title = excluded.title,
+		artist = excluded.artist, album_artist = excluded.album_artist, album = excluded.album, artist_key = excluded.artist_key,
+		album_key = excluded.album_key, genre = excluded.genre, track = excluded.track, disc = excluded.disc, year = excluded.year,
+		duration = excluded.duration, bit_rate = excluded.bit_rate, format = excluded.format, cover = excluded.cover`,
+		t.Share, t.Path, t.Size, t.ModTime, t.Title, t.Artist, t.AlbumArtist, t.Album, t.ArtistKey, t.AlbumKey,
+		t.Genre, t.Track, t.Disc, t.Year, t.Duration, t.BitRate, t.Format, t.Cover, time.Now().UnixMilli())
+	return err
+}
+
+// DeleteMusicTracks drops tracks by ID
+func (s *Store) DeleteMusicTracks(ids []int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		if _, err := tx.Exec(`DELETE FROM music_tracks WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// MusicTrack returns a track, os.ErrNotExist when there is none with that
+// ID
+func (s *Store) MusicTrack(id int64) (MusicTrack, error) {
+	tracks, err := s.musicTracks(`WHERE id = ?`, id)
+	if err != nil {
+		return MusicTrack{}, err
+	}
+	if len(tracks) == 0 {
+		return MusicTrack{}, os.ErrNotExist
+	}
+	return tracks[0], nil
+}
+
+// AlbumTracks returns the tracks of an album in play order
+func (s *Store) AlbumTracks(albumKey string) ([]MusicTrack, error) {
+	return s.musicTracks(`WHERE album_key = ? ORDER BY disc, track, lower(title), id`, albumKey)
+}
+
+// RandomMusicTracks returns up to n tracks at random, of genre when given
+func (s *Store) RandomMusicTracks(n int, genre string) ([]MusicTrack, error) {
+	if genre != "" {
+		return s.musicTracks(`WHERE lower(genre) = ? ORDER BY random() LIMIT ?`, strings.ToLower(genre), n)
+	}
+	return s.musicTracks(`ORDER BY random() LIMIT ?`, n)
+}
+
+// SearchMusicTracks returns the tracks whose title, artist or album holds
+// text, whatever its case
+func (s *Store) SearchMusicTracks(text string, offset, limit int) ([]MusicTrack, error) {
+	like := likeArg(text)
+	return s.musicTracks(`WHERE lower(title) LIKE ? ESCAPE '\' OR lower(artist) LIKE ? ESCAPE '\' OR lower(album) LIKE ? ESCAPE '\'
+		ORDER BY lower(title), id LIMIT ? OFFSET ?`, like, like, like, limit, offset)
+}
+
+// MusicArtists returns the album artists by name, those whose name holds
+// search when it is given
+func (s *Store) MusicArtists(search string, offset, limit int) ([]MusicArtist, error) {
+	where, args := ``, []interface{}{}
+	if search != "" {
+		where, args = `WHERE lower(album_artist) LIKE ? ESCAPE '\'`, append(args, likeArg(search))
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT artist_key, MIN(album_artist), COUNT(DISTINCT album_key), COUNT(*), `+coverTrack+`
+		FROM music_tracks `+where+` GROUP BY artist_key ORDER BY lower(MIN(album_artist)) LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var artists []MusicArtist
+	for rows.Next() {
+		var a MusicArtist
+		if err := rows.Scan(&a.Key, &a.Name, &a.Albums, &a.Tracks, &a.Cover); err != nil {
+			return nil, err
+		}
+		artists = append(artists, a)
+	}
+	return artists, rows.Err()
+}
+
+// MusicAlbums returns the albums q picks
+func (s *Store) MusicAlbums(q MusicAlbumQuery) ([]MusicAlbum, error) {
+	var conds []string
+	var args []interface{}
+	if q.ArtistKey != "" {
+		conds, args = append(conds, `artist_key = ?`), append(args, q.ArtistKey)
+	}
+	if q.Genre != "" {
+		conds, args = append(conds, `lower(genre) = ?`), append(args, strings.ToLower(q.Genre))
+	}
+	if q.Search != "" {
+		conds, args = append(conds, `lower(album) LIKE ? ESCAPE '\'`), append(args, likeArg(q.Search))
+	}
+	having := ``
+	if q.FromYear != 0 || q.ToYear != 0 {
+		// A range from a later year to an earlier one lists newest first
+		from, to := min(q.FromYear, q.ToYear), max(q.FromYear, q.ToYear)
+		having, args = ` HAVING MAX(year) BETWEEN ? AND ?`, append(args, from, to)
+	}
+	where := ``
+	if len(conds) > 0 {
+		where = ` WHERE ` + strings.Join(conds, ` AND `)
+	}
+	order := `lower(MIN(album)), lower(MIN(album_artist))`
+	switch q.Sort {
+	case "artist":
+		order = `lower(MIN(album_artist)), MAX(year), lower(MIN(album))`
+	case "year":
+		order = `MAX(year), lower(MIN(album))`
+		if q.FromYear > q.ToYear {
+			order = `MAX(year) DESC, lower(MIN(album))`
+		}
+	case "newest":
+		order = `MAX(added_at) DESC, MIN(id)`
+	case "recent":
+		order = `MAX(mtime) DESC, MIN(id)`
+	case "random":
+		order = `random()`
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT album_key, MIN(album), MIN(album_artist), MIN(artist_key), MAX(year), MAX(genre), COUNT(*),
+		SUM(duration), `+coverTrack+`, MAX(added_at) FROM music_tracks`+where+` GROUP BY album_key`+having+` ORDER BY `+order+` LIMIT ? OFFSET ?`,
+		append(args, limit, q.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var albums []MusicAlbum
+	for rows.Next() {
+		var a MusicAlbum
+		if err := rows.Scan(&a.Key, &a.Name, &a.Artist, &a.ArtistKey, &a.Year, &a.Genre, &a.Tracks, &a.Duration, &a.Cover, &a.Added); err != nil {
+			return nil, err
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+// MusicAlbum returns an album, os.ErrNotExist when there is none with that
+// key
+func (s *Store) MusicAlbum(key string) (MusicAlbum, error) {
+	var a MusicAlbum
+	err := s.db.QueryRow(`SELECT album_key, MIN(album), MIN(album_artist), MIN(artist_key), MAX(year), MAX(genre), COUNT(*),
+		SUM(duration), `+coverTrack+`, MAX(added_at) FROM music_tracks WHERE album_key = ? GROUP BY album_key`, key).
+		Scan(&a.Key, &a.Name, &a.Artist, &a.ArtistKey, &a.Year, &a.Genre, &a.Tracks, &a.Duration, &a.Cover, &a.Added)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, os.ErrNotExist
+	}
+	return a, err
+}
+
+// MusicGenres returns the genres by name with their number of tracks and
+// albums
+func (s *Store) MusicGenres() ([]MusicGenre, error) {
+	rows, err := s.db.Query(`SELECT MIN(genre), COUNT(*), COUNT(DISTINCT album_key) FROM music_tracks WHERE genre != ''
+		GROUP BY lower(genre) ORDER BY lower(genre)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var genres []MusicGenre
+	for rows.Next() {
+		var g MusicGenre
+		if err := rows.Scan(&g.Name, &g.Tracks, &g.Albums); err != nil {
+			return nil, err
+		}
+		genres = append(genres, g)
+	}
+	return genres, rows.Err()
+}
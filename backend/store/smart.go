@@ -0,0 +1,51 @@
+package store
+
+// SmartSample is what the health counters of a disk read at one poll,
+// kept for trend graphs
+type SmartSample struct {
+	Disk          string // The serial number, or the device of a disk without one
+	Time          int64  // ms
+	Healthy       bool
+	Temperature   int // °C, 0 when unknown
+	Reallocated   int64
+	Pending       int64
+	Uncorrectable int64
+	MediaErrors   int64
+	PowerOnHours  int64
+}
+
+// AddSmartSample records a reading
+func (s *Store) AddSmartSample(sample SmartSample) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO smart_samples (disk, time, healthy, temperature, reallocated, pending,
+		uncorrectable, media_errors, power_on_hours) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sample.Disk, sample.Time, sample.Healthy, sample.Temperature, sample.Reallocated, sample.Pending,
+		sample.Uncorrectable, sample.MediaErrors, sample.PowerOnHours)
+	return err
+}
+
+// SmartHistory returns the readings of a disk since a time in ms, oldest
+// first
+func (s *Store) SmartHistory(disk string, since int64) ([]SmartSample, error) {
+	rows, err := s.db.Query(`SELECT disk, time, healthy, temperature, reallocated, pending, uncorrectable, media_errors,
+		power_on_hours FROM smart_samples WHERE disk = ? AND time >= ? ORDER BY time`, disk, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	samples := []SmartSample{}
+	for rows.Next() {
+		var r SmartSample
+		if err := rows.Scan(&r.Disk, &r.Time, &r.Healthy, &r.Temperature, &r.Reallocated, &r.Pending, &r.Uncorrectable,
+			&r.MediaErrors, &r.PowerOnHours); err != nil {
+			return nil, err
+		}
+		samples = append(samples, r)
+	}
+	return samples, rows.Err()
+}
+
+// PruneSmartHistory deletes the readings taken before a time in ms
+func (s *Store) PruneSmartHistory(before int64) error {
+	_, err := s.db.Exec(`DELETE FROM smart_samples WHERE time < ?`, before)
+	return err
+}
@@ -0,0 +1,210 @@
+// Package store keeps the dashboard, user and system configuration in an
+// embedded SQLite database. The documents are the JSON the files used to
+// hold, keyed by their path under the data folder, so the rest of the
+// backend reads and writes them through utils as before. The database runs
+// in WAL mode and every update is a transaction, so concurrent edits and
+// crashes cannot leave half a document behind.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"flatnasgo-backend/logging"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// FileName is the database in the data folder
+const FileName = "flatnas.db"
+
+var storeLog = logging.For("store")
+
+// Store is the configuration database of one data folder
+type Store struct {
+	db   *sql.DB
+	root string
+}
+
+// Open opens or creates the database in root and brings its schema up to
+// date. The first time, the JSON files it replaces are imported.
+func Open(root string) (*Store, error) {
+	name := filepath.ToSlash(filepath.Join(root, FileName))
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name // C:/... on Windows
+	}
+	dsn := "file://" + (&url.URL{Path: name}).EscapedPath() +
+		"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)&_pragma=synchronous(NORMAL)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{db: db, root: filepath.Clean(root)}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// key maps a file under the data folder to its document: data.json,
+// system.json and users/<name>.json are kept in the database
+func (s *Store) key(filename string) (string, bool) {
+	rel, err := filepath.Rel(s.root, filepath.Clean(filename))
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	switch dir, name := path.Split(rel); {
+	case dir == "" && (name == "data.json" || name == "system.json"):
+		return rel, true
+	case dir == "users/" && strings.HasSuffix(name, ".json"):
+		return rel, true
+	}
+	return "", false
+}
+
+// Handles reports whether filename is a document of the store
+func (s *Store) Handles(filename string) bool {
+	_, ok := s.key(filename)
+	return ok
+}
+
+// Get returns a document and when it last changed
+func (s *Store) Get(filename string) ([]byte, time.Time, error) {
+	key, ok := s.key(filename)
+	if !ok {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	var data []byte
+	var updated int64
+	err := s.db.QueryRow(`SELECT data, updated_at FROM documents WHERE path = ?`, key).Scan(&data, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, time.Unix(0, updated), nil
+}
+
+// Put stores a document, replacing what was there
+func (s *Store) Put(filename string, data []byte) error {
+	key, ok := s.key(filename)
+	if !ok {
+		return fmt.Errorf("%s is not a stored document", filename)
+	}
+	_, err := s.db.Exec(`INSERT INTO documents (path, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(path) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		key, data, time.Now().UnixNano())
+	return err
+}
+
+// Update runs fn on a document inside a write transaction, so no other
+// writer, in this process or another, changes it in between. fn gets nil
+// for a missing document; nothing is written when it fails.
+func (s *Store) Update(filename string, fn func(data []byte) ([]byte, error)) error {
+	key, ok := s.key(filename)
+	if !ok {
+		return fmt.Errorf("%s is not a stored document", filename)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var data []byte
+	err = tx.QueryRow(`SELECT data FROM documents WHERE path = ?`, key).Scan(&data)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	updated, err := fn(data)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO documents (path, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(path) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		key, updated, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete removes a document; a missing one is os.ErrNotExist
+func (s *Store) Delete(filename string) error {
+	key, ok := s.key(filename)
+	if !ok {
+		return os.ErrNotExist
+	}
+	res, err := s.db.Exec(`DELETE FROM documents WHERE path = ?`, key)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// List returns the file names of the documents directly in dir
+func (s *Store) List(dir string) ([]string, error) {
+	prefix, ok := s.key(filepath.Join(dir, "x.json"))
+	if !ok {
+		return nil, nil
+	}
+	prefix = strings.TrimSuffix(prefix, "x.json")
+	rows, err := s.db.Query(`SELECT path FROM documents WHERE substr(path, 1, ?) = ?`, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if name := strings.TrimPrefix(key, prefix); !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	return names, rows.Err()
+}
+
+// Files returns the paths of every document, as files under the data folder
+func (s *Store) Files() ([]string, error) {
+	rows, err := s.db.Query(`SELECT path FROM documents ORDER BY path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		files = append(files, filepath.Join(s.root, filepath.FromSlash(key)))
+	}
+	return files, rows.Err()
+}
+
+// Snapshot writes a consistent copy of the database to dst
+func (s *Store) Snapshot(dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`VACUUM INTO ?`, dst)
+	return err
+}
@@ -0,0 +1,368 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportAndDocuments(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "users"), 0755)
+	os.WriteFile(filepath.Join(root, "data.json"), []byte(`{"groups":[]}`), 0644)
+	os.WriteFile(filepath.Join(root, "users", "bob.json"), []byte(`{"username":"bob"}`), 0644)
+
+	s, err := Open(root)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+	if data, _, err := s.Get(filepath.Join(root, "users", "bob.json")); err != nil || string(data) != `{"username":"bob"}` {
+		t.Fatalf("expected imported user, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "users", "bob.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected the imported file moved away, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "backups", "pre-sqlite", "users", "bob.json")); err != nil {
+		t.Fatalf("expected the imported file archived: %v", err)
+	}
+	if s.Handles(filepath.Join(root, "visitors.json")) || s.Handles(filepath.Join(root, "users", "x", "a.json")) {
+		t.Fatalf("only the configuration documents belong in the store")
+	}
+
+	alice := filepath.Join(root, "users", "alice.json")
+	if err := s.Put(alice, []byte(`{"username":"alice"}`)); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if names, _ := s.List(filepath.Join(root, "users")); len(names) != 2 {
+		t.Fatalf("expected two users, got %v", names)
+	}
+	err = s.Update(alice, func(data []byte) ([]byte, error) { return nil, os.ErrPermission })
+	if data, _, _ := s.Get(alice); err == nil || string(data) != `{"username":"alice"}` {
+		t.Fatalf("a failed update must not write, got %q, %v", data, err)
+	}
+	if err := s.Delete(alice); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := s.Delete(alice); !os.IsNotExist(err) {
+		t.Fatalf("expected ErrNotExist deleting twice, got %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	root := t.TempDir()
+	saved := migrations
+	defer func() { migrations = saved }()
+
+	s, err := Open(root)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	s.Close()
+
+	latest := migrations[len(migrations)-1].version
+	applied := 0
+	migrations = append(migrations[:len(migrations):len(migrations)], migration{version: latest + 1, name: "test",
+		apply: func(_ *Store, tx *sql.Tx) error { applied++; return nil }})
+	for i := 0; i < 2; i++ {
+		s, err := Open(root)
+		if err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+		if s.Version() != latest+1 {
+			t.Fatalf("expected version %d, got %d", latest+1, s.Version())
+		}
+		s.Close()
+	}
+	if applied != 1 {
+		t.Fatalf("expected the new migration once, applied %d times", applied)
+	}
+	backups, _ := filepath.Glob(filepath.Join(root, "backups", fmt.Sprintf("pre-migration-v%d-*.db", latest)))
+	if len(backups) != 1 {
+		t.Fatalf("expected the database copied before migrating, got %v", backups)
+	}
+
+	migrations = saved
+	if _, err := Open(root); err == nil {
+		t.Fatalf("expected an error for a database newer than the build")
+	}
+}
+
+func TestWidgetCache(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now().UnixMilli()
+	os.WriteFile(filepath.Join(root, "widget_cache.json"), []byte(fmt.Sprintf(`{"rss": {
+		"fresh": {"data": ["a"], "updatedAt": %d, "ttl": 600, "sourceStatus": "ok"},
+		"gone": {"data": ["b"], "updatedAt": 1, "ttl": 60, "sourceStatus": "ok"}
+	}}`, now)), 0644)
+
+	s, err := Open(root)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+	if _, err := os.Stat(filepath.Join(root, "widget_cache.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected the imported cache file removed, got %v", err)
+	}
+	entries, err := s.CacheEntries(24 * time.Hour)
+	if err != nil || len(entries) != 1 || entries[0].Key != "fresh" || string(entries[0].Data) != `["a"]` || entries[0].TTL != 600 {
+		t.Fatalf("expected only the fresh item, got %+v, %v", entries, err)
+	}
+
+	put := []CacheEntry{{Kind: "weather", Key: "Paris", Data: []byte(`{}`), UpdatedAt: now, TTL: 60, Status: "ok"}}
+	if err := s.SaveCache(put, []CacheEntry{{Kind: "rss", Key: "fresh"}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	entries, _ = s.CacheEntries(24 * time.Hour)
+	if len(entries) != 1 || entries[0].Kind != "weather" {
+		t.Fatalf("unexpected entries after save: %+v", entries)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+
+	for i := 1; i <= 4; i++ {
+		if err := s.SaveJob(JobRecord{ID: fmt.Sprint(i), Data: []byte(`{"status":"queued"}`)}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		s.SaveJob(JobRecord{ID: id, Data: []byte(`{"status":"done"}`), Finished: true})
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := s.PruneJobs(2); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	s.DeleteJob("3")
+	jobs, err := s.Jobs()
+	if err != nil || len(jobs) != 2 || jobs[0].ID != "2" || !jobs[0].Finished || jobs[1].ID != "4" || jobs[1].Finished {
+		t.Fatalf("expected the last finished job and the queued one in order, got %+v, %v", jobs, err)
+	}
+	if string(jobs[0].Data) != `{"status":"done"}` {
+		t.Fatalf("expected the saved update, got %s", jobs[0].Data)
+	}
+}
+
+func TestFileMarks(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+
+	s.SetFileTags("alice", "main", "Fotos/Été", []string{"Travel"})
+	s.SetFileTags("alice", "main", "Fotos/Été/a.jpg", []string{"travel", "Best"})
+	s.StarFile("alice", "main", "Fotos/Été/a.jpg", true)
+	s.SetFileTags("alice", "main", "Fotos/Étés", []string{"travel"})
+	s.SetFileTags("alice", "main", "Album/a.jpg", []string{"old"})
+	s.SetFileTags("bob", "main", "Fotos/Été/a.jpg", []string{"travel"})
+
+	if err := s.MoveFileMarks("main", "Fotos/Été/a.jpg", "main", "Album/a.jpg"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if err := s.MoveFileMarks("main", "Fotos/Été", "media", "Été"); err != nil {
+		t.Fatalf("move folder: %v", err)
+	}
+	marks, err := s.TaggedFiles("alice", []string{"TRAVEL"})
+	if err != nil || len(marks) != 3 {
+		t.Fatalf("expected three items tagged travel, got %+v, %v", marks, err)
+	}
+	if m := marks[0]; m.Share != "main" || m.Path != "Album/a.jpg" || strings.Join(m.Tags, ",") != "Best,travel" || !m.Starred {
+		t.Fatalf("the moved file replaced the marks at its target wrongly: %+v", m)
+	}
+	if marks[1].Path != "Fotos/Étés" || marks[2].Share != "media" || marks[2].Path != "Été" {
+		t.Fatalf("the folder move touched a sibling or missed the folder: %+v", marks)
+	}
+	tags, _ := s.FileTags("alice")
+	if len(tags) != 2 || tags[0] != (TagCount{"Best", 1}) || tags[1].Count != 3 {
+		t.Fatalf("unexpected tag counts %+v", tags)
+	}
+
+	s.DeleteFileMarks("main", "Album")
+	if marks, _ := s.FileMarks("alice", "main", ""); len(marks) != 1 || marks[0].Path != "Fotos/Étés" {
+		t.Fatalf("expected only the sibling folder left in main, got %+v", marks)
+	}
+	if marks, _ := s.FileMarks("bob", "main", ""); len(marks) != 0 {
+		t.Fatalf("expected the marks of every user deleted, got %+v", marks)
+	}
+	s.StarFile("bob", "media", "x", true)
+	s.DeleteUserMarks("alice")
+	if marks, _ := s.StarredFiles("bob"); len(marks) != 1 {
+		t.Fatalf("expected the marks of another user kept, got %+v", marks)
+	}
+	if tags, _ := s.FileTags("alice"); len(tags) != 0 {
+		t.Fatalf("expected no tags left, got %+v", tags)
+	}
+}
+
+func TestAlbums(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+
+	trip, err := s.CreateAlbum(Album{User: "alice", Name: "Trip", Kind: "manual", CoverShare: "main", CoverPath: "Fotos/b.jpg"})
+	if err != nil || trip.ID == 0 {
+		t.Fatalf("create: %+v, %v", trip, err)
+	}
+	s.CreateAlbum(Album{User: "alice", Name: "beach", Kind: "folder", Rule: `{"share":"main","path":"Beach"}`})
+	s.CreateAlbum(Album{User: "bob", Name: "Mine", Kind: "manual"})
+	s.AddAlbumItems(trip.ID, []PhotoRef{{"main", "Fotos/a.jpg"}, {"main", "Fotos/b.jpg"}, {"main", "Fotos/a.jpg"}}, false)
+	albums, err := s.Albums("alice")
+	if err != nil || len(albums) != 2 || albums[0].Name != "beach" || albums[1].Items != 2 {
+		t.Fatalf("unexpected albums %+v, %v", albums, err)
+	}
+	if _, err := s.Album("bob", trip.ID); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected another user's album to be missing, got %v", err)
+	}
+
+	// Album places and covers follow moves, and go with deletes
+	s.SetPhotoPeople(PhotoRef{"main", "Fotos/b.jpg"}, []string{"Ana", "Ben"})
+	s.SetPhotoPeople(PhotoRef{"main", "Other/c.jpg"}, []string{"ana"})
+	if err := s.MoveFileMarks("main", "Fotos", "media", "Trips"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	trip, _ = s.Album("alice", trip.ID)
+	items, _ := s.AlbumItems(trip.ID)
+	if trip.CoverShare != "media" || trip.CoverPath != "Trips/b.jpg" || len(items) != 2 || items[0].Share != "media" {
+		t.Fatalf("the album did not follow the move: %+v %+v", trip, items)
+	}
+	if people, _ := s.People(); len(people) != 2 || people[0] != (PersonCount{"Ana", 2}) {
+		t.Fatalf("unexpected people %+v", people)
+	}
+	if refs, _ := s.PersonPhotos("ANA"); len(refs) != 2 || refs[0] != (PhotoRef{"main", "Other/c.jpg"}) || refs[1] != (PhotoRef{"media", "Trips/b.jpg"}) {
+		t.Fatalf("unexpected photos of a person %+v", refs)
+	}
+	s.DeleteFileMarks("media", "Trips/a.jpg")
+	s.AddAlbumItems(trip.ID, []PhotoRef{{"media", "Trips/b.jpg"}}, true)
+	if items, _ := s.AlbumItems(trip.ID); len(items) != 0 {
+		t.Fatalf("expected an empty album, got %+v", items)
+	}
+
+	if err := s.DeleteAlbum("bob", trip.ID); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a user not to delete another's album, got %v", err)
+	}
+	s.DeleteUserAlbums("alice")
+	if albums, _ := s.Albums("alice"); len(albums) != 0 {
+		t.Fatalf("expected no albums left, got %+v", albums)
+	}
+	if albums, _ := s.Albums("bob"); len(albums) != 1 {
+		t.Fatalf("expected the albums of another user kept, got %+v", albums)
+	}
+}
+
+func TestMusicLibrary(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+
+	track := func(p, title, artist, album string, year, n int, cover bool) MusicTrack {
+		return MusicTrack{Share: "main", Path: p, Size: 10, ModTime: 1, Title: title, Artist: artist, AlbumArtist: artist,
+			Album: album, ArtistKey: strings.ToLower(artist), AlbumKey: strings.ToLower(artist + "/" + album), Genre: "Rock",
+			Track: n, Year: year, Duration: 1000, Format: "mp3", Cover: cover}
+	}
+	s.SaveMusicTrack(track("Music/b.mp3", "Beta", "Band", "First", 2001, 2, true))
+	s.SaveMusicTrack(track("Music/a.mp3", "Alpha", "Band", "First", 2001, 1, false))
+	s.SaveMusicTrack(track("Music/c.mp3", "Gamma", "Band", "Second", 2005, 1, false))
+	s.SaveMusicTrack(track("Other/d.flac", "Delta", "Artist", "Solo_", 1999, 1, false))
+
+	stamps, err := s.MusicStamps("main")
+	if err != nil || len(stamps) != 4 {
+		t.Fatalf("unexpected stamps %+v, %v", stamps, err)
+	}
+	first := stamps["Music/a.mp3"].ID
+	retitled := track("Music/a.mp3", "Alpha (live)", "Band", "First", 2001, 1, false)
+	retitled.Size = 20
+	if err := s.SaveMusicTrack(retitled); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if got, err := s.MusicTrack(first); err != nil || got.Title != "Alpha (live)" || got.Size != 20 {
+		t.Fatalf("expected the update to keep the ID: %+v, %v", got, err)
+	}
+
+	// Albums and artists group tracks, and pick a track with a picture
+	tracks, _ := s.AlbumTracks("band/first")
+	if len(tracks) != 2 || tracks[0].Path != "Music/a.mp3" {
+		t.Fatalf("unexpected album tracks %+v", tracks)
+	}
+	album, err := s.MusicAlbum("band/first")
+	if err != nil || album.Tracks != 2 || album.Duration != 2000 || album.Cover != stamps["Music/b.mp3"].ID {
+		t.Fatalf("unexpected album %+v, %v", album, err)
+	}
+	artists, _ := s.MusicArtists("", 0, 0)
+	if len(artists) != 2 || artists[0].Name != "Artist" || artists[0].Cover != 0 || artists[1].Albums != 2 || artists[1].Tracks != 3 {
+		t.Fatalf("unexpected artists %+v", artists)
+	}
+	albums, _ := s.MusicAlbums(MusicAlbumQuery{Sort: "year", FromYear: 2010, ToYear: 2000})
+	if len(albums) != 2 || albums[0].Name != "Second" {
+		t.Fatalf("unexpected albums by year %+v", albums)
+	}
+	if albums, _ := s.MusicAlbums(MusicAlbumQuery{Search: "_"}); len(albums) != 1 || albums[0].Name != "Solo_" {
+		t.Fatalf("expected LIKE wildcards to match themselves: %+v", albums)
+	}
+	if found, _ := s.SearchMusicTracks("BAND", 0, 10); len(found) != 3 {
+		t.Fatalf("unexpected search %+v", found)
+	}
+	if genres, _ := s.MusicGenres(); len(genres) != 1 || genres[0].Tracks != 4 || genres[0].Albums != 3 {
+		t.Fatalf("unexpected genres %+v", genres)
+	}
+
+	// Tracks follow moves, keeping their ID, and go with deletes
+	if err := s.MoveFileMarks("main", "Music", "media", "Songs"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if got, _ := s.MusicTrack(first); got.Share != "media" || got.Path != "Songs/a.mp3" {
+		t.Fatalf("the track did not follow the move: %+v", got)
+	}
+	if err := s.DeleteFileMarks("media", "Songs"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.MusicTrack(first); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the track to go, got %v", err)
+	}
+	if shares, _ := s.MusicShares(); len(shares) != 1 || shares[0] != "main" {
+		t.Fatalf("unexpected shares %v", shares)
+	}
+}
+
+func TestSmartHistory(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+
+	for i, realloc := range []int64{0, 0, 8} {
+		if err := s.AddSmartSample(SmartSample{Disk: "WD-1", Time: int64(1000 * (i + 1)), Healthy: true, Temperature: 30 + i, Reallocated: realloc}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	s.AddSmartSample(SmartSample{Disk: "WD-2", Time: 1500})
+	if err := s.PruneSmartHistory(1500); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	samples, err := s.SmartHistory("WD-1", 0)
+	if err != nil || len(samples) != 2 || samples[0].Time != 2000 || samples[1].Reallocated != 8 || samples[1].Temperature != 32 || !samples[1].Healthy {
+		t.Fatalf("unexpected history %+v, %v", samples, err)
+	}
+	if samples, _ := s.SmartHistory("WD-1", 2500); len(samples) != 1 {
+		t.Fatalf("expected one sample since 2500, got %+v", samples)
+	}
+	if samples, _ := s.SmartHistory("WD-2", 0); len(samples) != 1 || samples[0].Healthy {
+		t.Fatalf("expected the failing sample of the other disk, got %+v", samples)
+	}
+}
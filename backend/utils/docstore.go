@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DocumentStore keeps some JSON files in a database instead of on disk.
+// The helpers of this package send the paths it handles to it, so callers
+// keep addressing those documents by file name.
+type DocumentStore interface {
+	// Handles reports whether filename lives in the store
+	Handles(filename string) bool
+	// Get returns a document and when it last changed, os.ErrNotExist
+	// when there is none
+	Get(filename string) ([]byte, time.Time, error)
+	Put(filename string, data []byte) error
+	// Update runs fn on a document (nil when missing) in one transaction
+	// and stores what fn returns
+	Update(filename string, fn func(data []byte) ([]byte, error)) error
+	Delete(filename string) error
+	// List returns the file names of the documents directly in dir
+	List(dir string) ([]string, error)
+}
+
+var docStore atomic.Value // DocumentStore
+
+// SetDocumentStore routes the documents s handles to it; nil puts every
+// file back on disk
+func SetDocumentStore(s DocumentStore) {
+	docStore.Store(&s)
+}
+
+func storeFor(filename string) DocumentStore {
+	s, _ := docStore.Load().(*DocumentStore)
+	if s == nil || *s == nil || !(*s).Handles(filename) {
+		return nil
+	}
+	return *s
+}
+
+// ReadFile is os.ReadFile for files that may be documents
+func ReadFile(filename string) ([]byte, error) {
+	if s := storeFor(filename); s != nil {
+		data, _, err := s.Get(filename)
+		return data, err
+	}
+	return os.ReadFile(filename)
+}
+
+// ModTime is when a file or document last changed
+func ModTime(filename string) (time.Time, error) {
+	if s := storeFor(filename); s != nil {
+		_, mod, err := s.Get(filename)
+		return mod, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// RemoveFile is os.Remove for files that may be documents
+func RemoveFile(filename string) error {
+	if s := storeFor(filename); s != nil {
+		return s.Delete(filename)
+	}
+	return os.Remove(filename)
+}
+
+// ListJSON returns the names of the .json files or documents in dir, sorted
+func ListJSON(dir string) ([]string, error) {
+	if s := storeFor(filepath.Join(dir, "x.json")); s != nil {
+		names, err := s.List(dir)
+		sort.Strings(names)
+		return names, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
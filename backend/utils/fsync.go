@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// writeFileSync is os.WriteFile followed by fsync, so the rename that
+// follows never exposes a file whose data is not on disk yet
+func writeFileSync(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// UpdateJSON reads filename into v, lets fn change it and writes it back,
+// all under the file's lock. A missing file leaves v as it is. Nothing is
+// written when fn fails.
+func UpdateJSON(filename string, v interface{}, fn func() error) error {
+	return WithFileLock(filename, func() error {
+		if s := storeFor(filename); s != nil {
+			return s.Update(filename, func(data []byte) ([]byte, error) {
+				if data != nil {
+					if err := json.Unmarshal(data, v); err != nil {
+						return nil, err
+					}
+				}
+				if err := fn(); err != nil {
+					return nil, err
+				}
+				return json.MarshalIndent(v, "", "  ")
+			})
+		}
+		if err := ReadJSONUnlocked(filename, v); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+		return WriteJSONUnlocked(filename, v)
+	})
+}
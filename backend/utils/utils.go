@@ -21,7 +21,7 @@ func WithFileLock(filename string, fn func() error) error {
 }
 
 func ReadJSONUnlocked(filename string, v interface{}) error {
-	data, err := os.ReadFile(filename)
+	data, err := ReadFile(filename)
 	if err != nil {
 		return err
 	}
@@ -33,8 +33,11 @@ func WriteJSONUnlocked(filename string, v interface{}) error {
 	if err != nil {
 		return err
 	}
+	if s := storeFor(filename); s != nil {
+		return s.Put(filename, data)
+	}
 	tempFile := filename + ".tmp"
-	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+	if err := writeFileSync(tempFile, data, 0644); err != nil {
 		return err
 	}
 	return os.Rename(tempFile, filename)
@@ -45,12 +48,15 @@ func AtomicWriteFile(filename string, data []byte) error {
 	lock.Lock()
 	defer lock.Unlock()
 
+	if s := storeFor(filename); s != nil {
+		return s.Put(filename, data)
+	}
 	tempFile := filename + ".tmp"
-	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+	if err := writeFileSync(tempFile, data, 0644); err != nil {
 		return err
 	}
-	// On Windows, rename might fail if destination exists and is open. 
-    // os.Rename in Go on Windows replaces existing file if possible.
+	// On Windows, rename might fail if destination exists and is open.
+	// os.Rename in Go on Windows replaces existing file if possible.
 	return os.Rename(tempFile, filename)
 }
 
@@ -59,7 +65,7 @@ func ReadJSON(filename string, v interface{}) error {
 	lock.Lock()
 	defer lock.Unlock()
 
-	data, err := os.ReadFile(filename)
+	data, err := ReadFile(filename)
 	if err != nil {
 		return err
 	}
@@ -1,7 +1,7 @@
 import { ref, computed, watch } from "vue";
 import { defineStore } from "pinia";
 import { useStorage } from "@vueuse/core";
-import io from "socket.io-client";
+import { createRealtimeSocket, rememberRealtimeTransport } from "@/utils/realtime";
 import type {
   NavItem,
   NavGroup,
@@ -27,11 +27,7 @@ interface BackupData {
 }
 
 export const useMainStore = defineStore("main", () => {
-  const socket = io({
-    transports: ["websocket"],
-    reconnection: true,
-    reconnectionAttempts: 10,
-  });
+  const socket = createRealtimeSocket();
   const isConnected = ref(false);
   let socketListenersBound = false;
   let isInitializing = false;
@@ -123,6 +119,7 @@ export const useMainStore = defineStore("main", () => {
       const res = await fetch(new URL("/api/system-config", base).toString());
       if (res.ok) {
         systemConfig.value = await res.json();
+        rememberRealtimeTransport((systemConfig.value as { realtimeTransport?: string }).realtimeTransport);
       }
     } catch (e) {
       console.error("Failed to fetch system config", e);
@@ -141,6 +138,7 @@ export const useMainStore = defineStore("main", () => {
       });
       if (res.ok) {
         systemConfig.value = await res.json();
+        rememberRealtimeTransport((systemConfig.value as { realtimeTransport?: string }).realtimeTransport);
         return true;
       }
       return false;
@@ -159,6 +157,18 @@ export const useMainStore = defineStore("main", () => {
   const pendingServerVersion = ref(0);
 
   // Auth State
+  // Single sign-on returns the session in the URL fragment
+  const ssoParams = new URLSearchParams(window.location.hash.replace(/^#/, ""));
+  const ssoToken = ssoParams.get("sso_token");
+  if (ssoToken) {
+    localStorage.setItem("flat-nas-token", ssoToken);
+    localStorage.setItem("flat-nas-username", ssoParams.get("sso_user") || "");
+  } else if (ssoParams.get("sso_error")) {
+    console.error("SSO login failed:", ssoParams.get("sso_error"));
+  }
+  if (ssoToken || ssoParams.get("sso_error")) {
+    history.replaceState(null, "", window.location.pathname + window.location.search);
+  }
   const token = ref(localStorage.getItem("flat-nas-token") || "");
   const username = ref(localStorage.getItem("flat-nas-username") || "");
   const isLogged = ref(!!token.value);
@@ -1780,12 +1790,12 @@ export const useMainStore = defineStore("main", () => {
     }
   };
 
-  const login = async (usr: string, pwd: string) => {
+  const login = async (usr: string, pwd: string, code = "") => {
     try {
       const res = await fetch("/api/login", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
-        body: JSON.stringify({ username: usr, password: pwd }),
+        body: JSON.stringify({ username: usr, password: pwd, code }),
       });
       if (res.ok) {
         const data = await res.json();
@@ -1801,7 +1811,9 @@ export const useMainStore = defineStore("main", () => {
         return true;
       }
       const data = await res.json();
-      throw new Error(data.error || "Login failed");
+      const err = new Error(data.error || "Login failed") as Error & { twoFactorRequired?: boolean };
+      err.twoFactorRequired = !!data.twoFactorRequired;
+      throw err;
     } catch (e: unknown) {
       console.error(e);
       throw e;
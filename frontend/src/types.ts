@@ -98,6 +98,7 @@ export interface AppConfig {
   mobileRotationInterval?: number;
   mobileRotationMode?: "random" | "sequential";
   deviceMode?: "auto" | "desktop" | "tablet" | "mobile";
+  locale?: "en" | "zh"; // Language of server messages; unset follows the browser
   widgetAreaSize?: number;
   widgetAreaCols?: number;
   widgetAreaRows?: number;
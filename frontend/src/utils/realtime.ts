@@ -0,0 +1,138 @@
+import io from "socket.io-client";
+
+// The backend serves realtime events over socket.io and over a plain
+// WebSocket at /ws (systemConfig.realtimeTransport picks one). Both are used
+// through this small socket.io-like interface.
+
+// eslint-disable-next-line @typescript-eslint/no-explicit-any
+type Listener = (...args: any[]) => void;
+
+export interface RealtimeSocket {
+  id?: string;
+  connected: boolean;
+  on(event: string, fn: Listener): RealtimeSocket;
+  off(event: string, fn?: Listener): RealtimeSocket;
+  emit(event: string, ...args: unknown[]): RealtimeSocket;
+  close(): RealtimeSocket;
+}
+
+const TRANSPORT_KEY = "flatnas_realtime_transport";
+const MAX_BACKOFF = 30000;
+
+// The transport is chosen before the system config loads, so the last one
+// seen is remembered and takes effect on the next page load
+export const rememberRealtimeTransport = (transport?: string) => {
+  try {
+    if (transport) localStorage.setItem(TRANSPORT_KEY, transport);
+    else localStorage.removeItem(TRANSPORT_KEY);
+  } catch {
+    // Storage may be unavailable in private mode
+  }
+};
+
+const preferredTransport = () => {
+  try {
+    return localStorage.getItem(TRANSPORT_KEY) || "socketio";
+  } catch {
+    return "socketio";
+  }
+};
+
+// NativeSocket speaks the {event, data} envelope of /ws and reconnects with
+// backoff like the socket.io client does
+class NativeSocket implements RealtimeSocket {
+  id?: string;
+  connected = false;
+  private ws: WebSocket | null = null;
+  private listeners = new Map<string, Set<Listener>>();
+  private queue: string[] = [];
+  private attempts = 0;
+  private closed = false;
+  private timer: ReturnType<typeof setTimeout> | null = null;
+
+  constructor(private url: string) {
+    this.open();
+  }
+
+  private open() {
+    const ws = new WebSocket(this.url);
+    this.ws = ws;
+    ws.onmessage = (ev) => {
+      let env: { event?: string; data?: unknown };
+      try {
+        env = JSON.parse(String(ev.data));
+      } catch {
+        return;
+      }
+      if (!env.event) return;
+      if (env.event === "connect") {
+        this.id = (env.data as { id?: string })?.id;
+        this.connected = true;
+        this.attempts = 0;
+        for (const frame of this.queue.splice(0)) ws.send(frame);
+      }
+      this.fire(env.event, env.data);
+    };
+    ws.onerror = (err) => {
+      if (!this.connected) this.fire("connect_error", err);
+    };
+    ws.onclose = () => {
+      const wasConnected = this.connected;
+      this.connected = false;
+      this.ws = null;
+      if (wasConnected) this.fire("disconnect", "transport close");
+      if (this.closed) return;
+      const delay = Math.min(MAX_BACKOFF, 1000 * 2 ** this.attempts) * (0.5 + Math.random() / 2);
+      this.attempts++;
+      this.timer = setTimeout(() => this.open(), delay);
+    };
+  }
+
+  private fire(event: string, data?: unknown) {
+    for (const fn of Array.from(this.listeners.get(event) ?? [])) {
+      try {
+        fn(data);
+      } catch (e) {
+        console.error(`Realtime listener for ${event} failed`, e);
+      }
+    }
+  }
+
+  on(event: string, fn: Listener) {
+    if (!this.listeners.has(event)) this.listeners.set(event, new Set());
+    this.listeners.get(event)!.add(fn);
+    return this;
+  }
+
+  off(event: string, fn?: Listener) {
+    if (fn) this.listeners.get(event)?.delete(fn);
+    else this.listeners.delete(event);
+    return this;
+  }
+
+  emit(event: string, ...args: unknown[]) {
+    const frame = JSON.stringify({ event, data: args.length > 1 ? args : args[0] });
+    if (this.connected && this.ws?.readyState === WebSocket.OPEN) this.ws.send(frame);
+    else this.queue.push(frame);
+    return this;
+  }
+
+  close() {
+    this.closed = true;
+    if (this.timer) clearTimeout(this.timer);
+    this.ws?.close();
+    return this;
+  }
+}
+
+export const createRealtimeSocket = (): RealtimeSocket => {
+  if (preferredTransport() === "websocket" && typeof window !== "undefined" && "WebSocket" in window) {
+    const proto = window.location.protocol === "https:" ? "wss:" : "ws:";
+    return new NativeSocket(`${proto}//${window.location.host}/ws`);
+  }
+  return io({
+    transports: ["websocket"],
+    reconnection: true,
+    reconnectionAttempts: 10,
+  }) as unknown as RealtimeSocket;
+};
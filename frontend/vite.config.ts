@@ -65,6 +65,11 @@ export default defineConfig(({ mode }) => {
           ws: true,
           changeOrigin: true,
         },
+        "/ws": {
+          target: process.env.VITE_BACKEND || "http://127.0.0.1:3000",
+          ws: true,
+          changeOrigin: true,
+        },
       },
     },
   })